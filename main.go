@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -8,15 +9,26 @@ import (
 	"net/http"
 	"simple-one-api/pkg/apis"
 	"simple-one-api/pkg/initializer"
+	"simple-one-api/pkg/mybatch"
+	"simple-one-api/pkg/mychatws"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mydashboard"
+	"simple-one-api/pkg/mygrpc"
 	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mymetrics"
+	"simple-one-api/pkg/myplugin"
 	"simple-one-api/pkg/mywebui"
 	"simple-one-api/pkg/translation"
 	"strings"
 
 	//"log"
 	"os"
+	"os/signal"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/handler"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -31,21 +43,32 @@ func main() {
 		configName = "config.json"
 	}
 
+	// 先注册completion模式的健康检查，Setup中会开始后台探测
+	mycommon.SetCompletionProbe(handler.ProbeServiceCompletion)
 	if err := initializer.Setup(configName); err != nil {
 		return
 	}
 	defer initializer.Cleanup()
 
+	if names := myplugin.Names(); len(names) > 0 {
+		mylog.Logger.Info("plugins registered", zap.Strings("plugins", names))
+	}
+
 	// 创建一个 Gin 路由器实例
 	r := gin.New()
 	r.Use(gin.Recovery())
+	r.Use(handler.RequestIDMiddleware())
+	r.Use(handler.TracingMiddleware())
+	if config.GetConf().AccessLog {
+		r.Use(handler.AccessLogMiddleware())
+	}
 
 	// 配置 CORS 中间件
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // 允许所有来源，如果需要限制来源，可以将 "*" 替换为具体的 URL
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Access-Control-Request-Private-Network"},
-		ExposeHeaders:    []string{"Content-Length", "Access-Control-Allow-Private-Network"},
+		ExposeHeaders:    []string{"Content-Length", "Access-Control-Allow-Private-Network", mycomdef.KEYNAME_HEADER_REQUEST_ID, mycomdef.KEYNAME_HEADER_COST, mycomdef.KEYNAME_HEADER_COST_CURRENCY},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -60,8 +83,8 @@ func main() {
 		c.Status(204)
 	})
 
-	mylog.Logger.Warn("check EnableWeb config", zap.Bool("config.GSOAConf.EnableWeb", config.GSOAConf.EnableWeb))
-	if config.GSOAConf.EnableWeb {
+	mylog.Logger.Warn("check EnableWeb config", zap.Bool("config.GetConf().EnableWeb", config.GetConf().EnableWeb))
+	if config.GetConf().EnableWeb {
 		mylog.Logger.Info("web enabled")
 		// 设置静态文件夹
 		r.Static("/static", "./static")
@@ -81,32 +104,188 @@ func main() {
 	}
 	// 添加POST请求方法处理
 	//r.POST("/v1/chat/completions", handler.OpenAIHandler)
+	r.GET("/health", apis.HealthHandler)
+	r.GET("/health/ready", apis.ReadinessHandler)
 	r.GET("/v1/models", apis.ModelsHandler)
-	r.GET("/v1/models/:model", apis.RetrieveModelHandler)
+	r.GET("/v1/models/*model", apis.RetrieveModelHandler)
+	r.GET("/v1/model_capabilities", apis.ModelCapabilitiesHandler)
+	r.GET("/v1/model_capabilities/:model", apis.RetrieveModelCapabilitiesHandler)
+	r.GET("/debug/lb_scores", apis.LBScoresHandler)
+	r.GET("/admin/upstreams", apis.UpstreamsHandler)
+	r.GET("/debug/retry_budget", apis.RetryBudgetHandler)
+	r.GET("/v1/conversations/:id/usage", apis.ConversationUsageHandler)
+	r.GET("/v1/usage", apis.UsageHandler)
+	r.POST("/admin/keys", apis.CreateKeyHandler)
+	r.GET("/admin/keys", apis.ListKeysHandler)
+	r.GET("/admin/keys/:id", apis.GetKeyHandler)
+	r.DELETE("/admin/keys/:id", apis.RevokeKeyHandler)
+	r.POST("/admin/reload", apis.ReloadConfigHandler)
+	r.GET("/admin/logs", apis.AuditLogsHandler)
+	r.GET("/v1/files", handler.AuthMiddleware(), handler.ListFilesHandler)
+	r.GET("/v1/files/:id", handler.AuthMiddleware(), handler.RetrieveFileHandler)
+	r.GET("/v1/files/:id/content", handler.AuthMiddleware(), handler.FileContentHandler)
+	r.DELETE("/v1/files/:id", handler.AuthMiddleware(), handler.DeleteFileHandler)
+	r.GET("/v1/batches", handler.AuthMiddleware(), handler.ListBatchesHandler)
+	r.GET("/v1/batches/:id", handler.AuthMiddleware(), handler.RetrieveBatchHandler)
+
+	if config.GetConf().Dashboard.Enable {
+		dashboardPath := strings.TrimRight(config.GetConf().Dashboard.Path, "/")
+		if dashboardPath == "" {
+			dashboardPath = config.DefaultDashboardPath
+		}
+		mylog.Logger.Info("dashboard enabled", zap.String("path", dashboardPath+"/"))
+		r.GET(dashboardPath, func(c *gin.Context) {
+			c.Redirect(http.StatusMovedPermanently, dashboardPath+"/")
+		})
+		r.StaticFS(dashboardPath, mydashboard.FileSystem())
+		r.GET("/admin/dashboard/stats", apis.DashboardStatsHandler)
+		r.GET("/admin/dashboard/config", apis.DashboardConfigHandler)
+		r.PUT("/admin/dashboard/services/:service/:index", apis.UpdateDashboardServiceHandler)
+		r.POST("/admin/dashboard/api_keys", apis.AddDashboardAPIKeyHandler)
+		r.PUT("/admin/dashboard/api_keys/:index", apis.UpdateDashboardAPIKeyHandler)
+		r.DELETE("/admin/dashboard/api_keys/:index", apis.DeleteDashboardAPIKeyHandler)
+	}
+
+	if config.GetConf().Metrics.Enable {
+		if addr := config.GetConf().Metrics.ListenAddr; addr != "" {
+			go func() {
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", mymetrics.Handler())
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					mylog.Logger.Error("metrics server", zap.String("listen_addr", addr), zap.Error(err))
+				}
+			}()
+		} else {
+			r.GET("/metrics", gin.WrapH(mymetrics.Handler()))
+		}
+	}
 
 	r.POST("/v2/translate", translation.TranslateV2Handler)
 	r.POST("/translate", translation.TranslateV1Handler)
 
 	r.GET("/multimodelcall", mywebui.WSMultiModelCallHandler)
 
+	if config.GetConf().ChatWS.Enable {
+		r.GET("/v1/chat/ws", handler.AuthMiddleware(), mychatws.Handler(r))
+	}
+
 	// 啥也不错，有些客户端真的很无语，不知道会怎么补全，尽量兼容吧
 	v1 := r.Group("/v1")
+	v1.Use(handler.RequestSizeLimitMiddleware(), handler.InboundAPIKeyMiddleware(), handler.AuthMiddleware(), handler.KeyLimitMiddleware())
 	{
 		// 中间件检查路径是否以 /v1/chat/completions 结尾
 		v1.POST("/*path", func(c *gin.Context) {
 			if strings.HasSuffix(c.Request.URL.Path, "/v1/chat/completions") || strings.HasSuffix(c.Request.URL.Path, "/chat/completions") || strings.HasSuffix(c.Request.URL.Path, "/v1") {
 				handler.OpenAIHandler(c)
 				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/embeddings") {
+				handler.EmbeddingsHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/images/generations") {
+				handler.ImageGenerationsHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/audio/transcriptions") {
+				handler.AudioTranscriptionsHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/audio/translations") {
+				handler.AudioTranslationsHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/audio/speech") {
+				handler.AudioSpeechHandler(c)
+				return
 			} else if strings.HasSuffix(c.Request.URL.Path, "/v1/translate") {
 				translation.TranslateV1Handler(c)
 				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/files") {
+				handler.CreateFileHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/batches") {
+				handler.CreateBatchHandler(c)
+				return
+			} else if strings.Contains(c.Request.URL.Path, "/batches/") && strings.HasSuffix(c.Request.URL.Path, "/cancel") {
+				handler.CancelBatchHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/messages/count_tokens") {
+				handler.AnthropicCountTokensHandler(c)
+				return
+			} else if strings.HasSuffix(c.Request.URL.Path, "/messages") {
+				handler.AnthropicMessagesHandler(c)
+				return
+			} else if handler.IsGeminiPath(c.Request.URL.Path) {
+				handler.GeminiHandler(c)
+				return
 			}
 			c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
 		})
 	}
+
+	// Gemini格式的接口，/v1/models/{model}:generateContent在上面的/v1中处理
+	v1beta := r.Group("/v1beta")
+	v1beta.Use(handler.RequestSizeLimitMiddleware(), handler.InboundAPIKeyMiddleware(), handler.AuthMiddleware(), handler.KeyLimitMiddleware())
+	{
+		v1beta.POST("/models/*action", handler.GeminiHandler)
+	}
+	if config.GetConf().GRPC.Enable {
+		if err := mygrpc.Start(r); err != nil {
+			mylog.Logger.Error("grpc server", zap.Error(err))
+			return
+		}
+	}
+	mybatch.Start(r)
+
 	// 启动服务器，使用配置中的端口
-	if err := r.Run(config.ServerPort); err != nil {
+	srv := &http.Server{Addr: config.ServerPort, Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		mylog.Logger.Info("http server started", zap.String("listen_addr", config.ServerPort))
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
 		mylog.Logger.Error(err.Error())
+		mygrpc.Shutdown(context.Background())
 		return
+	case sig := <-quit:
+		mylog.Logger.Info("shutting down", zap.String("signal", sig.String()))
+	}
+	shutdown(srv, quit)
+}
+
+// shutdown 不再接受新的连接，等待进行中的请求和流式响应结束，超过drain_timeout或再次收到信号时断开剩余的连接，
+// 返回后由initializer.Cleanup写入用量、审计等缓冲中剩余的数据
+func shutdown(srv *http.Server, quit <-chan os.Signal) {
+	drainTimeout := config.GetConf().Shutdown.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = config.DefaultShutdownDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			mylog.Logger.Warn("received second signal, closing remaining connections")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mychatws.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		mygrpc.Shutdown(ctx)
+	}()
+	if err := srv.Shutdown(ctx); err != nil {
+		mylog.Logger.Warn("drain timeout, closing remaining connections", zap.Int("drain_timeout", drainTimeout), zap.Error(err))
+		srv.Close()
 	}
+	wg.Wait()
+	mylog.Logger.Info("server stopped")
 }
@@ -14,12 +14,37 @@ func OpenAIRequestToDashScopeCommonRequest(oaiReq *openai.ChatCompletionRequest)
 
 	dsComReq.Model = oaiReq.Model
 
+	// role为tool的消息需要函数名，没有传name时从之前assistant消息的tool_calls中查找
+	toolNames := make(map[string]string)
 	for _, msg := range oaiReq.Messages {
 
 		var dsComMsg ds_com_request.Message
 
 		dsComMsg.Role = msg.Role
-		dsComMsg.Content = msg.Content
+		if IsDashScopeMultiModalModel(oaiReq.Model) {
+			dsComMsg.Content = openAIMessageToDashScopeContentParts(msg)
+		} else {
+			dsComMsg.Content = msg.Content
+		}
+
+		for _, tc := range msg.ToolCalls {
+			toolNames[tc.ID] = tc.Function.Name
+			dsComMsg.ToolCalls = append(dsComMsg.ToolCalls, ds_com_request.ToolCall{
+				ID:   tc.ID,
+				Type: string(tc.Type),
+				Function: ds_com_request.FunctionCall{
+					Name:      tc.Function.Name,
+					Arguments: tc.Function.Arguments,
+				},
+			})
+		}
+		if msg.Role == openai.ChatMessageRoleTool {
+			dsComMsg.ToolCallID = msg.ToolCallID
+			dsComMsg.Name = msg.Name
+			if dsComMsg.Name == "" {
+				dsComMsg.Name = toolNames[msg.ToolCallID]
+			}
+		}
 
 		dsComReq.Input.Messages = append(dsComReq.Input.Messages, dsComMsg)
 
@@ -27,12 +52,95 @@ func OpenAIRequestToDashScopeCommonRequest(oaiReq *openai.ChatCompletionRequest)
 
 	var param ds_com_request.Parameters
 	param.ResultFormat = "message"
+	param.Tools = openAIToolsToDashScopeTools(oaiReq)
+	if len(param.Tools) > 0 {
+		param.ToolChoice = oaiReq.ToolChoice
+	}
 
 	dsComReq.Parameters = &param
 
 	return &dsComReq
 }
 
+// IsDashScopeMultiModalModel qwen-vl等视觉模型使用multimodal-generation接口，消息内容为数组
+func IsDashScopeMultiModalModel(model string) bool {
+	return strings.HasPrefix(model, "qwen-vl") || strings.HasPrefix(model, "qwen2-vl") || strings.HasPrefix(model, "qwen2.5-vl")
+}
+
+// openAIMessageToDashScopeContentParts 文本转换为{"text": ...}，图片转换为{"image": ...}，http链接和data URL都原样传入
+func openAIMessageToDashScopeContentParts(msg openai.ChatCompletionMessage) []ds_com_request.ContentPart {
+	if len(msg.MultiContent) == 0 {
+		return []ds_com_request.ContentPart{{Text: msg.Content}}
+	}
+	var parts []ds_com_request.ContentPart
+	for _, content := range msg.MultiContent {
+		switch content.Type {
+		case openai.ChatMessagePartTypeText:
+			parts = append(parts, ds_com_request.ContentPart{Text: content.Text})
+		case openai.ChatMessagePartTypeImageURL:
+			if content.ImageURL != nil {
+				parts = append(parts, ds_com_request.ContentPart{Image: content.ImageURL.URL})
+			}
+		}
+	}
+	return parts
+}
+
+// openAIToolsToDashScopeTools 转换tools，旧版的functions同样转换为tools
+func openAIToolsToDashScopeTools(oaiReq *openai.ChatCompletionRequest) []ds_com_request.Tool {
+	var tools []ds_com_request.Tool
+	for _, tool := range oaiReq.Tools {
+		if tool.Function == nil {
+			continue
+		}
+		tools = append(tools, ds_com_request.Tool{
+			Type: string(tool.Type),
+			Function: ds_com_request.FunctionDefinition{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				Parameters:  tool.Function.Parameters,
+			},
+		})
+	}
+	for _, fn := range oaiReq.Functions {
+		tools = append(tools, ds_com_request.Tool{
+			Type: string(openai.ToolTypeFunction),
+			Function: ds_com_request.FunctionDefinition{
+				Name:        fn.Name,
+				Description: fn.Description,
+				Parameters:  fn.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+func dashScopeToolCallsToOpenAIToolCalls(toolCalls []ds_com_resp.ToolCall) []myopenai.ToolCall {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+	result := make([]myopenai.ToolCall, len(toolCalls))
+	for i, tc := range toolCalls {
+		result[i] = myopenai.ToolCall{
+			ID:   tc.ID,
+			Type: myopenai.ToolType(tc.Type),
+			Function: myopenai.FunctionCall{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		}
+	}
+	return result
+}
+
+// getDashScopeFinishReason 流式响应未结束时finish_reason为"null"
+func getDashScopeFinishReason(finishReason string) string {
+	if finishReason == "null" {
+		return ""
+	}
+	return finishReason
+}
+
 func DashScopeCommonResponseToOpenAIResponse(dsComResp *ds_com_resp.ModelResponse) *myopenai.OpenAIResponse {
 	if dsComResp == nil {
 		return nil
@@ -40,10 +148,13 @@ func DashScopeCommonResponseToOpenAIResponse(dsComResp *ds_com_resp.ModelRespons
 
 	var oaiChoices []myopenai.Choice
 
-	for _, choice := range dsComResp.Output.Choices {
+	for i, choice := range dsComResp.Output.Choices {
 		var oaiChoice myopenai.Choice
+		oaiChoice.Index = i
 		oaiChoice.Message.Role = choice.Message.Role
-		oaiChoice.Message.Content = choice.Message.Content
+		oaiChoice.Message.Content = string(choice.Message.Content)
+		oaiChoice.Message.ToolCalls = dashScopeToolCallsToOpenAIToolCalls(choice.Message.ToolCalls)
+		oaiChoice.FinishReason = getDashScopeFinishReason(choice.FinishReason)
 		oaiChoices = append(oaiChoices, oaiChoice)
 	}
 
@@ -74,38 +185,65 @@ func compareAndExtractDelta(prev, current string) string {
 	return current
 }
 
-func GetStreamResponseContent(dsResp *ds_com_resp.ModelStreamResponse) string {
+// GetStreamResponseMessage 获取流式分片中的消息，DashScope每个分片都包含到目前为止完整的内容
+func GetStreamResponseMessage(dsResp *ds_com_resp.ModelStreamResponse) *ds_com_resp.StreamResponseMessage {
 	if dsResp == nil || len(dsResp.Output.Choices) == 0 {
-		return ""
+		return nil
 	}
 
-	choice := dsResp.Output.Choices[0]
-
-	return choice.Message.Content
+	return &dsResp.Output.Choices[0].Message
+}
 
+// extractToolCallsDelta 与上一个分片比较，只返回新增的工具调用和参数，工具调用第一次出现时带上id和函数名
+func extractToolCallsDelta(prev []ds_com_resp.ToolCall, current []ds_com_resp.ToolCall) []myopenai.ToolCall {
+	var delta []myopenai.ToolCall
+	for i, tc := range current {
+		index := i
+		if i >= len(prev) {
+			delta = append(delta, myopenai.ToolCall{
+				Index: &index,
+				ID:    tc.ID,
+				Type:  myopenai.ToolType(tc.Type),
+				Function: myopenai.FunctionCall{
+					Name:      tc.Function.Name,
+					Arguments: tc.Function.Arguments,
+				},
+			})
+			continue
+		}
+		if args := compareAndExtractDelta(prev[i].Function.Arguments, tc.Function.Arguments); args != "" {
+			delta = append(delta, myopenai.ToolCall{Index: &index, Function: myopenai.FunctionCall{Arguments: args}})
+		}
+	}
+	return delta
 }
 
-func DashScopeCommonResponseToOpenAIStreamResponse(dsResp *ds_com_resp.ModelStreamResponse, prevContent string) *myopenai.OpenAIStreamResponse {
+func DashScopeCommonResponseToOpenAIStreamResponse(dsResp *ds_com_resp.ModelStreamResponse, prevMsg *ds_com_resp.StreamResponseMessage) *myopenai.OpenAIStreamResponse {
 	openAIResp := &myopenai.OpenAIStreamResponse{
 		ID:      dsResp.RequestID,
 		Object:  "chat.completion.chunk",
 		Created: time.Now().Unix(), // 使用当前 Unix 时间戳
 	}
 
+	var prevContent string
+	var prevToolCalls []ds_com_resp.ToolCall
+	if prevMsg != nil {
+		prevContent, prevToolCalls = string(prevMsg.Content), prevMsg.ToolCalls
+	}
+
 	for _, dsChoice := range dsResp.Output.Choices {
-		deltaContent := compareAndExtractDelta(prevContent, dsChoice.Message.Content)
-		choice := struct {
-			Index        int                    `json:"index"`
-			Delta        myopenai.ResponseDelta `json:"delta,omitempty"`
-			Logprobs     interface{}            `json:"logprobs,omitempty"`
-			FinishReason interface{}            `json:"finish_reason,omitempty"`
-		}{
+		deltaContent := compareAndExtractDelta(prevContent, string(dsChoice.Message.Content))
+		choice := myopenai.OpenAIStreamResponseChoice{
 			Index: 0,
 			Delta: myopenai.ResponseDelta{
-				Role:    dsChoice.Message.Role,
-				Content: deltaContent,
+				Role:      dsChoice.Message.Role,
+				Content:   deltaContent,
+				ToolCalls: extractToolCallsDelta(prevToolCalls, dsChoice.Message.ToolCalls),
 			},
 		}
+		if finishReason := getDashScopeFinishReason(dsChoice.FinishReason); finishReason != "" {
+			choice.FinishReason = finishReason
+		}
 
 		openAIResp.Choices = append(openAIResp.Choices, choice)
 	}
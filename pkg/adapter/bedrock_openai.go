@@ -0,0 +1,110 @@
+package adapter
+
+import (
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	awsbedrock "simple-one-api/pkg/llm/aws-bedrock"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	myopenai "simple-one-api/pkg/openai"
+	"strings"
+	"time"
+)
+
+// OpenAIRequestToBedrockClaudeRequest 与Claude的转换相同，只是模型和stream不放在请求体中
+func OpenAIRequestToBedrockClaudeRequest(oaiReq *openai.ChatCompletionRequest) *awsbedrock.ClaudeRequest {
+	claudeReq := OpenAIRequestToClaudeRequest(oaiReq)
+	return &awsbedrock.ClaudeRequest{
+		AnthropicVersion: awsbedrock.ClaudeAnthropicVersion,
+		Messages:         claudeReq.Messages,
+		MaxTokens:        claudeReq.MaxTokens,
+		System:           claudeReq.System,
+		StopSequences:    claudeReq.StopSequences,
+		Temperature:      claudeReq.Temperature,
+		TopP:             claudeReq.TopP,
+		TopK:             claudeReq.TopK,
+		Tools:            claudeReq.Tools,
+		ToolChoice:       claudeReq.ToolChoice,
+	}
+}
+
+// OpenAIRequestToBedrockLlamaRequest 按Llama 3的对话模板拼接prompt，最后以assistant的开头结束
+func OpenAIRequestToBedrockLlamaRequest(oaiReq *openai.ChatCompletionRequest) *awsbedrock.LlamaRequest {
+	var prompt strings.Builder
+	prompt.WriteString("<|begin_of_text|>")
+	for _, msg := range oaiReq.Messages {
+		role := strings.ToLower(msg.Role)
+		if role != openai.ChatMessageRoleSystem && role != openai.ChatMessageRoleAssistant {
+			role = openai.ChatMessageRoleUser
+		}
+		prompt.WriteString("<|start_header_id|>" + role + "<|end_header_id|>\n\n")
+		prompt.WriteString(strings.TrimSpace(mycommon.GetMessageText(msg)))
+		prompt.WriteString("<|eot_id|>")
+	}
+	prompt.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+
+	return &awsbedrock.LlamaRequest{
+		Prompt:      prompt.String(),
+		MaxGenLen:   oaiReq.MaxTokens,
+		Temperature: oaiReq.Temperature,
+		TopP:        oaiReq.TopP,
+	}
+}
+
+func bedrockLlamaStopReasonToFinishReason(stopReason *string) string {
+	if stopReason == nil {
+		return ""
+	}
+	if *stopReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+func BedrockLlamaResponseToOpenAIResponse(resp *awsbedrock.LlamaResponse, model string) *myopenai.OpenAIResponse {
+	return &myopenai.OpenAIResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []myopenai.Choice{
+			{
+				Message: myopenai.ResponseMessage{
+					Role:    mycomdef.KEYNAME_ASSISTANT,
+					Content: resp.Generation,
+				},
+				FinishReason: bedrockLlamaStopReasonToFinishReason(resp.StopReason),
+			},
+		},
+		Usage: &myopenai.Usage{
+			PromptTokens:     resp.PromptTokenCount,
+			CompletionTokens: resp.GenerationTokenCount,
+			TotalTokens:      resp.PromptTokenCount + resp.GenerationTokenCount,
+		},
+	}
+}
+
+// BedrockLlamaChunkToOpenAIStreamResponse 转换一个流式分片，结束的分片带finish_reason和invocationMetrics中的用量
+func BedrockLlamaChunkToOpenAIStreamResponse(chunk *awsbedrock.LlamaResponse) *myopenai.OpenAIStreamResponse {
+	choice := myopenai.OpenAIStreamResponseChoice{
+		Delta: myopenai.ResponseDelta{
+			Role:    mycomdef.KEYNAME_ASSISTANT,
+			Content: chunk.Generation,
+		},
+	}
+	resp := &myopenai.OpenAIStreamResponse{
+		Object: "chat.completion.chunk",
+	}
+	if chunk.StopReason != nil {
+		choice.FinishReason = bedrockLlamaStopReasonToFinishReason(chunk.StopReason)
+		if chunk.InvocationMetrics != nil {
+			resp.Usage = &myopenai.Usage{
+				PromptTokens:     chunk.InvocationMetrics.InputTokenCount,
+				CompletionTokens: chunk.InvocationMetrics.OutputTokenCount,
+				TotalTokens:      chunk.InvocationMetrics.InputTokenCount + chunk.InvocationMetrics.OutputTokenCount,
+			}
+		}
+	}
+	resp.Choices = []myopenai.OpenAIStreamResponseChoice{choice}
+	return resp
+}
@@ -0,0 +1,225 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/llm/claude"
+	"strings"
+)
+
+// ClaudeMessagesRequestToOpenAIRequest 将Anthropic格式的/v1/messages请求转换为OpenAI格式，
+// tool_result转换为tool消息，放在同一条user消息的其他内容之前；thinking等不支持的内容块忽略
+func ClaudeMessagesRequestToOpenAIRequest(req *claude.MessagesRequest) (*openai.ChatCompletionRequest, error) {
+	oaiReq := &openai.ChatCompletionRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
+		Stream:      req.Stream,
+	}
+	if req.Stream {
+		oaiReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	if req.Metadata != nil {
+		oaiReq.User = req.Metadata.UserID
+	}
+
+	system, err := claudeSystemText(req.System)
+	if err != nil {
+		return nil, err
+	}
+	if system != "" {
+		oaiReq.Messages = append(oaiReq.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system})
+	}
+
+	for _, msg := range req.Messages {
+		msgs, err := claudeMessageToOpenAIMessages(msg)
+		if err != nil {
+			return nil, err
+		}
+		oaiReq.Messages = append(oaiReq.Messages, msgs...)
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "" && tool.Type != "custom" {
+			continue
+		}
+		oaiReq.Tools = append(oaiReq.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if req.ToolChoice != nil && len(oaiReq.Tools) > 0 {
+		switch req.ToolChoice.Type {
+		case "any":
+			oaiReq.ToolChoice = "required"
+		case "none":
+			oaiReq.ToolChoice = "none"
+		case "tool":
+			oaiReq.ToolChoice = openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: req.ToolChoice.Name}}
+		default:
+			oaiReq.ToolChoice = "auto"
+		}
+	}
+	return oaiReq, nil
+}
+
+// claudeSystemText system为字符串或者text内容块数组
+func claudeSystemText(system json.RawMessage) (string, error) {
+	if len(system) == 0 || string(system) == "null" {
+		return "", nil
+	}
+	if system[0] != '[' {
+		var text string
+		if err := json.Unmarshal(system, &text); err != nil {
+			return "", fmt.Errorf("invalid system: %w", err)
+		}
+		return text, nil
+	}
+	var blocks []claude.ContentBlock
+	if err := json.Unmarshal(system, &blocks); err != nil {
+		return "", fmt.Errorf("invalid system: %w", err)
+	}
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func claudeMessageToOpenAIMessages(msg claude.Message) ([]openai.ChatCompletionMessage, error) {
+	role := openai.ChatMessageRoleUser
+	if msg.Role == openai.ChatMessageRoleAssistant {
+		role = openai.ChatMessageRoleAssistant
+	}
+	if len(msg.MultiContent) == 0 {
+		return []openai.ChatCompletionMessage{{Role: role, Content: msg.Content}}, nil
+	}
+
+	var msgs []openai.ChatCompletionMessage
+	var parts []openai.ChatMessagePart
+	var toolCalls []openai.ToolCall
+	hasImage := false
+	for _, block := range msg.MultiContent {
+		switch block.Type {
+		case "text":
+			parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: block.Text})
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			url := block.Source.URL
+			if block.Source.Type == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+			}
+			if url == "" {
+				continue
+			}
+			hasImage = true
+			parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: url}})
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 {
+				arguments = string(block.Input)
+			}
+			toolCalls = append(toolCalls, openai.ToolCall{
+				ID:       block.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: block.Name, Arguments: arguments},
+			})
+		case "tool_result":
+			msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: block.ToolUseID, Content: block.Content})
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return msgs, nil
+	}
+	oaiMsg := openai.ChatCompletionMessage{Role: role, ToolCalls: toolCalls}
+	if hasImage {
+		oaiMsg.MultiContent = parts
+	} else {
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			texts = append(texts, part.Text)
+		}
+		oaiMsg.Content = strings.Join(texts, "\n")
+	}
+	return append(msgs, oaiMsg), nil
+}
+
+// FinishReasonToClaudeStopReason 将finish_reason转换为Anthropic的stop_reason
+func FinishReasonToClaudeStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return string(claude.MaxTokens)
+	case "tool_calls", "function_call":
+		return string(claude.ToolUse)
+	case "content_filter":
+		return "refusal"
+	default:
+		return string(claude.EndTurn)
+	}
+}
+
+// ClaudeMessageID 使用OpenAI响应的id生成Anthropic格式的消息id，上游是Claude时id已经是该格式
+func ClaudeMessageID(id string) string {
+	if strings.HasPrefix(id, "msg_") {
+		return id
+	}
+	return "msg_" + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// OpenAIResponseToClaudeResponse 将OpenAI格式的非流式响应转换为Anthropic格式，只使用第一个choice
+func OpenAIResponseToClaudeResponse(resp *openai.ChatCompletionResponse, model string) *claude.ResponseBody {
+	claudeResp := &claude.ResponseBody{
+		ID:         ClaudeMessageID(resp.ID),
+		Type:       "message",
+		Role:       openai.ChatMessageRoleAssistant,
+		Content:    []claude.RespContent{},
+		Model:      model,
+		StopReason: string(claude.EndTurn),
+	}
+	claudeResp.Usage.InputTokens = resp.Usage.PromptTokens
+	claudeResp.Usage.OutputTokens = resp.Usage.CompletionTokens
+	if len(resp.Choices) == 0 {
+		return claudeResp
+	}
+
+	choice := resp.Choices[0]
+	claudeResp.StopReason = FinishReasonToClaudeStopReason(string(choice.FinishReason))
+	if content := choice.Message.Content; content != "" {
+		claudeResp.Content = append(claudeResp.Content, claude.RespContent{Type: "text", Text: content})
+	}
+	toolCalls := choice.Message.ToolCalls
+	if choice.Message.FunctionCall != nil {
+		toolCalls = append(toolCalls, openai.ToolCall{ID: "call_" + strings.TrimPrefix(resp.ID, "chatcmpl-"), Function: *choice.Message.FunctionCall})
+	}
+	for _, tc := range toolCalls {
+		claudeResp.Content = append(claudeResp.Content, claude.RespContent{
+			Type:  "tool_use",
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: ToolArgumentsObject(tc.Function.Arguments),
+		})
+	}
+	return claudeResp
+}
+
+// ToolArgumentsObject 工具调用的参数不是JSON对象时返回空对象
+func ToolArgumentsObject(arguments string) json.RawMessage {
+	arguments = strings.TrimSpace(arguments)
+	var obj map[string]json.RawMessage
+	if arguments == "" || json.Unmarshal([]byte(arguments), &obj) != nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
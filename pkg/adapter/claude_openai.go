@@ -1,49 +1,39 @@
 package adapter
 
 import (
+	"encoding/json"
 	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
 	"simple-one-api/pkg/llm/claude"
 	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
+	"strings"
 	"time"
 )
 
-// OpenAIRequestToClaudeRequest 将 OpenAI 的 ChatCompletionRequest 转换为 Claude 的 RequestBody
+const defaultClaudeMaxTokens = 4096
+
+// OpenAIRequestToClaudeRequest 将 OpenAI 的 ChatCompletionRequest 转换为 Claude 的 RequestBody。
+// Claude的system消息是单独的字段，user和assistant需要严格交替，max_tokens必填
 func OpenAIRequestToClaudeRequest(oaiReq *openai.ChatCompletionRequest) *claude.RequestBody {
-	claudeMessages := make([]claude.Message, len(oaiReq.Messages))
-
-	for i, oaiMsg := range oaiReq.Messages {
-		var content string
-		var multiContent []claude.ContentBlock
-
-		if oaiMsg.Content != "" {
-			content = oaiMsg.Content
-		} else {
-			for _, part := range oaiMsg.MultiContent {
-				cb := claude.ContentBlock{
-					Type: string(part.Type),
-					Text: part.Text,
-				}
-
-				if part.ImageURL != nil {
-					imgData, mType, _ := mycommon.GetImageURLData(part.ImageURL.URL)
-					cb.Image = &claude.Image{
-						Source: claude.ImageSource{
-							Type:      "base64",
-							MediaType: mType, // Assuming media type, this might need adjustment
-							Data:      imgData,
-						},
-					}
-				}
-				multiContent = append(multiContent, cb)
+	var systemParts []string
+	var oaiMessages []openai.ChatCompletionMessage
+	for _, oaiMsg := range oaiReq.Messages {
+		if strings.ToLower(oaiMsg.Role) == openai.ChatMessageRoleSystem {
+			if text := mycommon.GetMessageText(oaiMsg); text != "" {
+				systemParts = append(systemParts, text)
 			}
+			continue
 		}
+		oaiMessages = append(oaiMessages, oaiMsg)
+	}
+	// 去掉system消息后可能出现相邻的同角色消息
+	oaiMessages = mycommon.MergeConsecutiveRoleMessages(oaiMessages, mycommon.DefaultMergeSeparator)
 
-		claudeMessages[i] = claude.Message{
-			Role:         oaiMsg.Role,
-			Content:      content,
-			MultiContent: multiContent,
-		}
+	var claudeMessages []claude.Message
+	for _, oaiMsg := range oaiMessages {
+		claudeMessages = appendClaudeMessage(claudeMessages, openAIMessageToClaudeMessage(oaiMsg))
 	}
 
 	var metadata *claude.Metadata
@@ -52,64 +42,167 @@ func OpenAIRequestToClaudeRequest(oaiReq *openai.ChatCompletionRequest) *claude.
 		metadata = &claude.Metadata{UserID: oaiReq.User}
 	}
 
-	maxTokens := 4096
-	if oaiReq.MaxTokens >= 0 {
+	maxTokens := defaultClaudeMaxTokens
+	if oaiReq.MaxTokens > 0 {
 		maxTokens = oaiReq.MaxTokens
 	}
 
+	// tool_choice为none时Claude不接受tools，直接不发送
+	tools := convertTools(oaiReq.Tools)
+	toolChoice := convertToolChoice(oaiReq.ToolChoice)
+	if choice, ok := oaiReq.ToolChoice.(string); ok && choice == "none" {
+		tools, toolChoice = nil, nil
+	}
+	if len(tools) == 0 {
+		toolChoice = nil
+	}
+
+	// Claude的temperature取值范围为0~1
+	temperature := oaiReq.Temperature
+	if temperature > 1 {
+		temperature = 1
+	}
+
 	return &claude.RequestBody{
 		Model:         oaiReq.Model,
 		Messages:      claudeMessages,
+		System:        strings.Join(systemParts, "\n\n"),
 		MaxTokens:     maxTokens,
 		StopSequences: oaiReq.Stop,
 		Stream:        oaiReq.Stream,
-		Temperature:   oaiReq.Temperature,
-		TopK:          int(oaiReq.TopP), // Assuming TopP maps to TopK, adjust if needed
+		Temperature:   temperature,
 		TopP:          oaiReq.TopP,
-		ToolChoice:    convertToolChoice(oaiReq.ToolChoice),
-		Tools:         convertTools(oaiReq.Tools),
+		ToolChoice:    toolChoice,
+		Tools:         tools,
 		Metadata:      metadata,
 	}
 }
 
-func convertToolChoice(oaiToolChoice interface{}) *claude.ToolChoice {
-	if oaiToolChoice == nil {
-		return nil
+// openAIMessageToClaudeMessage 转换一条消息，tool消息转换为user角色的tool_result，assistant的tool_calls转换为tool_use
+func openAIMessageToClaudeMessage(oaiMsg openai.ChatCompletionMessage) claude.Message {
+	role := strings.ToLower(oaiMsg.Role)
+	if role == openai.ChatMessageRoleTool {
+		return claude.Message{
+			Role: openai.ChatMessageRoleUser,
+			MultiContent: []claude.ContentBlock{{
+				Type:      "tool_result",
+				ToolUseID: oaiMsg.ToolCallID,
+				Content:   mycommon.GetMessageText(oaiMsg),
+			}},
+		}
+	}
+
+	if len(oaiMsg.ToolCalls) > 0 {
+		var blocks []claude.ContentBlock
+		if text := mycommon.GetMessageText(oaiMsg); text != "" {
+			blocks = append(blocks, claude.ContentBlock{Type: "text", Text: text})
+		}
+		for _, tc := range oaiMsg.ToolCalls {
+			input := json.RawMessage(tc.Function.Arguments)
+			if !json.Valid(input) {
+				input = json.RawMessage("{}")
+			}
+			blocks = append(blocks, claude.ContentBlock{
+				Type:  "tool_use",
+				ID:    tc.ID,
+				Name:  tc.Function.Name,
+				Input: input,
+			})
+		}
+		return claude.Message{Role: openai.ChatMessageRoleAssistant, MultiContent: blocks}
+	}
+
+	if oaiMsg.Content != "" || len(oaiMsg.MultiContent) == 0 {
+		return claude.Message{Role: oaiMsg.Role, Content: oaiMsg.Content}
+	}
+
+	var multiContent []claude.ContentBlock
+	for _, part := range oaiMsg.MultiContent {
+		cb := claude.ContentBlock{
+			Type: string(part.Type),
+			Text: part.Text,
+		}
+
+		if part.ImageURL != nil {
+			imgData, mType, err := mycommon.GetImageURLData(part.ImageURL.URL)
+			if err != nil {
+				mylog.Logger.Warn("skip image", zap.Error(err))
+				continue
+			}
+			cb.Type = "image"
+			cb.Source = &claude.ImageSource{
+				Type:      "base64",
+				MediaType: mType,
+				Data:      imgData,
+			}
+		}
+		multiContent = append(multiContent, cb)
+	}
+	return claude.Message{Role: oaiMsg.Role, MultiContent: multiContent}
+}
+
+// appendClaudeMessage 与上一条消息角色相同时合并内容块，多个工具结果以及工具结果后的user消息需要放在同一条user消息中
+func appendClaudeMessage(msgs []claude.Message, msg claude.Message) []claude.Message {
+	n := len(msgs)
+	if n == 0 || msgs[n-1].Role != msg.Role {
+		return append(msgs, msg)
 	}
+	last := &msgs[n-1]
+	last.MultiContent = append(claudeMessageBlocks(*last), claudeMessageBlocks(msg)...)
+	last.Content = ""
+	return msgs
+}
 
+func claudeMessageBlocks(msg claude.Message) []claude.ContentBlock {
+	if msg.Content == "" {
+		return msg.MultiContent
+	}
+	return []claude.ContentBlock{{Type: "text", Text: msg.Content}}
+}
+
+// convertToolChoice OpenAI的auto、required对应Claude的auto、any，指定函数时对应tool；
+// 请求体解析后指定函数的tool_choice为map
+func convertToolChoice(oaiToolChoice interface{}) *claude.ToolChoice {
 	switch tc := oaiToolChoice.(type) {
+	case string:
+		switch tc {
+		case "auto":
+			return &claude.ToolChoice{Type: "auto"}
+		case "required":
+			return &claude.ToolChoice{Type: "any"}
+		}
 	case openai.ToolChoice:
-		return &claude.ToolChoice{
-			Type: string(tc.Type),
-			Name: tc.Function.Name,
+		return &claude.ToolChoice{Type: "tool", Name: tc.Function.Name}
+	case *openai.ToolChoice:
+		if tc != nil {
+			return &claude.ToolChoice{Type: "tool", Name: tc.Function.Name}
 		}
-	case string:
-		return &claude.ToolChoice{
-			Type: "tool",
-			Name: tc,
+	case map[string]interface{}:
+		if fn, ok := tc["function"].(map[string]interface{}); ok {
+			if name, _ := fn["name"].(string); name != "" {
+				return &claude.ToolChoice{Type: "tool", Name: name}
+			}
 		}
-	default:
-		return nil
 	}
+	return nil
 }
 
 func convertTools(oaiTools []openai.Tool) []claude.Tool {
-	claudeTools := make([]claude.Tool, len(oaiTools))
-
-	for i, oaiTool := range oaiTools {
-		claudeTools[i] = claude.Tool{
+	var claudeTools []claude.Tool
+	for _, oaiTool := range oaiTools {
+		if oaiTool.Function == nil {
+			continue
+		}
+		var inputSchema interface{} = claude.ToolInputSchema{Type: "object"}
+		if oaiTool.Function.Parameters != nil {
+			inputSchema = oaiTool.Function.Parameters
+		}
+		claudeTools = append(claudeTools, claude.Tool{
 			Name:        oaiTool.Function.Name,
 			Description: oaiTool.Function.Description,
-			InputSchema: claude.ToolInputSchema{
-				Type: "object",
-				Properties: map[string]interface{}{
-					"parameters": oaiTool.Function.Parameters,
-				},
-				Required: []string{"parameters"},
-			},
-		}
+			InputSchema: inputSchema,
+		})
 	}
-
 	return claudeTools
 }
 
@@ -129,22 +222,44 @@ func claudeStopReasonToFinishReason(stopReason string) string {
 	}
 }
 
-// ClaudeReponseToOpenAIResponse 将 claude.ResponseBody 转换为 myopenai.OpenAIResponse
+// ClaudeReponseToOpenAIResponse 将 claude.ResponseBody 转换为 myopenai.OpenAIResponse，所有文本内容块合并为一个choice
 func ClaudeReponseToOpenAIResponse(resp *claude.ResponseBody) *myopenai.OpenAIResponse {
 	if resp == nil {
 		return nil
 	}
 
-	choices := make([]myopenai.Choice, len(resp.Content))
-	for i, content := range resp.Content {
-		choices[i] = myopenai.Choice{
-			Index: i,
+	var content strings.Builder
+	var toolCalls []myopenai.ToolCall
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "", "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			toolCalls = append(toolCalls, myopenai.ToolCall{
+				ID:   block.ID,
+				Type: myopenai.ToolType(openai.ToolTypeFunction),
+				Function: myopenai.FunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+
+	choices := []myopenai.Choice{
+		{
+			Index: 0,
 			Message: myopenai.ResponseMessage{
-				Role:    resp.Role,
-				Content: content.Text, // 假设 RespContent 有一个 Text 字段
+				Role:      resp.Role,
+				Content:   content.String(),
+				ToolCalls: toolCalls,
 			},
 			FinishReason: claudeStopReasonToFinishReason(resp.StopReason),
-		}
+		},
 	}
 
 	usage := &myopenai.Usage{
@@ -155,7 +270,7 @@ func ClaudeReponseToOpenAIResponse(resp *claude.ResponseBody) *myopenai.OpenAIRe
 
 	openAIResponse := &myopenai.OpenAIResponse{
 		ID:      resp.ID,
-		Object:  resp.Type,
+		Object:  "chat.completion",
 		Created: time.Now().Unix(), // 假设我们在转换时设置当前时间戳
 		Model:   resp.Model,
 		Choices: choices,
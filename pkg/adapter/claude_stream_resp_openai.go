@@ -1,21 +1,17 @@
 package adapter
 
 import (
+	"github.com/sashabaranov/go-openai"
 	"simple-one-api/pkg/llm/claude"
 	"simple-one-api/pkg/mycomdef"
 	myopenai "simple-one-api/pkg/openai"
 )
 
-// 将 MsgMessageStart 转换为 OpenAIStreamResponse 的函数
+// 将 MsgMessageStart 转换为 OpenAIStreamResponse 的函数，输入的token数在message_delta中和输出的token数一起返回
 func ConvertMsgMessageStartToOpenAIStreamResponse(msg *claude.MsgMessageStart) *myopenai.OpenAIStreamResponse {
 	response := &myopenai.OpenAIStreamResponse{
 		ID:    msg.Message.ID,
 		Model: msg.Message.Model,
-		Usage: &myopenai.Usage{
-			PromptTokens:     msg.Message.Usage.InputTokens,
-			CompletionTokens: msg.Message.Usage.OutputTokens,
-			TotalTokens:      msg.Message.Usage.InputTokens + msg.Message.Usage.OutputTokens,
-		},
 		Choices: []myopenai.OpenAIStreamResponseChoice{
 			{
 				Delta: myopenai.ResponseDelta{
@@ -28,16 +24,70 @@ func ConvertMsgMessageStartToOpenAIStreamResponse(msg *claude.MsgMessageStart) *
 	return response
 }
 
-func ConvertMsgContentBlockDeltaToOpenAIStreamResponse(msg *claude.MsgContentBlockDelta) *myopenai.OpenAIStreamResponse {
+// ConvertMsgContentBlockStartToOpenAIStreamResponse tool_use内容块开始时返回带id和函数名的tool_calls分片，其他内容块返回nil
+func ConvertMsgContentBlockStartToOpenAIStreamResponse(msg *claude.MsgContentBlockStart, toolIndex int) *myopenai.OpenAIStreamResponse {
+	if msg.ContentBlock.Type != "tool_use" {
+		return nil
+	}
 	return &myopenai.OpenAIStreamResponse{
 		Choices: []myopenai.OpenAIStreamResponseChoice{
 			{
-				Index: msg.Index,
+				Index: 0,
 				Delta: myopenai.ResponseDelta{
-					Role:    mycomdef.KEYNAME_ASSISTANT,
-					Content: msg.Delta.Text,
+					Role: mycomdef.KEYNAME_ASSISTANT,
+					ToolCalls: []myopenai.ToolCall{{
+						Index: &toolIndex,
+						ID:    msg.ContentBlock.ID,
+						Type:  myopenai.ToolType(openai.ToolTypeFunction),
+						Function: myopenai.FunctionCall{
+							Name: msg.ContentBlock.Name,
+						},
+					}},
 				},
 			},
 		},
 	}
 }
+
+// ConvertMsgContentBlockDeltaToOpenAIStreamResponse text_delta转换为content，input_json_delta转换为tool_calls的arguments，
+// toolIndex为内容块对应的工具调用序号，thinking等其他类型返回nil
+func ConvertMsgContentBlockDeltaToOpenAIStreamResponse(msg *claude.MsgContentBlockDelta, toolIndex int) *myopenai.OpenAIStreamResponse {
+	delta := myopenai.ResponseDelta{Role: mycomdef.KEYNAME_ASSISTANT}
+	switch msg.Delta.Type {
+	case "", "text_delta":
+		delta.Content = msg.Delta.Text
+	case "input_json_delta":
+		delta.ToolCalls = []myopenai.ToolCall{{
+			Index:    &toolIndex,
+			Function: myopenai.FunctionCall{Arguments: msg.Delta.PartialJSON},
+		}}
+	default:
+		return nil
+	}
+	return &myopenai.OpenAIStreamResponse{
+		Choices: []myopenai.OpenAIStreamResponseChoice{
+			{
+				Index: 0,
+				Delta: delta,
+			},
+		},
+	}
+}
+
+// ConvertMsgMessageDeltaToOpenAIStreamResponse 将 message_delta 转换为带finish_reason和usage的最后一个分片
+func ConvertMsgMessageDeltaToOpenAIStreamResponse(msg *claude.MsgMessageDelta, inputTokens int) *myopenai.OpenAIStreamResponse {
+	return &myopenai.OpenAIStreamResponse{
+		Choices: []myopenai.OpenAIStreamResponseChoice{
+			{
+				Index:        0,
+				Delta:        myopenai.ResponseDelta{},
+				FinishReason: claudeStopReasonToFinishReason(msg.Delta.StopReason),
+			},
+		},
+		Usage: &myopenai.Usage{
+			PromptTokens:     inputTokens,
+			CompletionTokens: msg.Usage.OutputTokens,
+			TotalTokens:      inputTokens + msg.Usage.OutputTokens,
+		},
+	}
+}
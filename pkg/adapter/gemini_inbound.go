@@ -0,0 +1,215 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	googlegemini "simple-one-api/pkg/llm/google-gemini"
+	"simple-one-api/pkg/mycomdef"
+	"strings"
+)
+
+// GeminiRequestToOpenAIRequest 将Gemini格式的generateContent请求转换为OpenAI格式，model为路径中的模型名称。
+// Gemini的函数调用没有id，按顺序生成，functionResponse按名称对应到之前未返回结果的调用
+func GeminiRequestToOpenAIRequest(req *googlegemini.GeminiRequest, model string, stream bool) (*openai.ChatCompletionRequest, error) {
+	conf := req.GenerationConfig
+	oaiReq := &openai.ChatCompletionRequest{
+		Model:       model,
+		MaxTokens:   conf.MaxOutputTokens,
+		Temperature: conf.Temperature,
+		TopP:        conf.TopP,
+		Stop:        conf.StopSequences,
+		Stream:      stream,
+	}
+	if conf.CandidateCount > 1 {
+		oaiReq.N = conf.CandidateCount
+	}
+	if stream {
+		oaiReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	if conf.ResponseMimeType == "application/json" {
+		oaiReq.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+
+	if req.SystemInstruction != nil {
+		if text := geminiPartsText(req.SystemInstruction.Parts); text != "" {
+			oaiReq.Messages = append(oaiReq.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: text})
+		}
+	}
+
+	var pending []openai.ToolCall
+	callCount := 0
+	for _, content := range req.Contents {
+		var parts []openai.ChatMessagePart
+		var toolCalls []openai.ToolCall
+		hasImage := false
+		for _, part := range content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				callCount++
+				tc := openai.ToolCall{
+					ID:       fmt.Sprintf("call_%d", callCount),
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: part.FunctionCall.Name, Arguments: string(ToolArgumentsObject(string(part.FunctionCall.Args)))},
+				}
+				toolCalls = append(toolCalls, tc)
+				pending = append(pending, tc)
+			case part.FunctionResponse != nil:
+				id := ""
+				for i, tc := range pending {
+					if tc.Function.Name == part.FunctionResponse.Name {
+						id = tc.ID
+						pending = append(pending[:i], pending[i+1:]...)
+						break
+					}
+				}
+				if id == "" {
+					callCount++
+					id = fmt.Sprintf("call_%d", callCount)
+				}
+				oaiReq.Messages = append(oaiReq.Messages, openai.ChatCompletionMessage{
+					Role:       openai.ChatMessageRoleTool,
+					ToolCallID: id,
+					Content:    string(part.FunctionResponse.Response),
+				})
+			case part.InlineData != nil:
+				hasImage = true
+				url := fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data)
+				parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: url}})
+			case part.FileData != nil:
+				hasImage = true
+				parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: part.FileData.FileURI}})
+			case part.Text != "":
+				parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: part.Text})
+			}
+		}
+		if len(parts) == 0 && len(toolCalls) == 0 {
+			continue
+		}
+
+		role := openai.ChatMessageRoleUser
+		if content.Role == mycomdef.KEYNAME_MODEL {
+			role = openai.ChatMessageRoleAssistant
+		}
+		msg := openai.ChatCompletionMessage{Role: role, ToolCalls: toolCalls}
+		if hasImage {
+			msg.MultiContent = parts
+		} else {
+			texts := make([]string, 0, len(parts))
+			for _, part := range parts {
+				texts = append(texts, part.Text)
+			}
+			msg.Content = strings.Join(texts, "\n")
+		}
+		oaiReq.Messages = append(oaiReq.Messages, msg)
+	}
+
+	for _, tool := range req.Tools {
+		for _, fd := range tool.FunctionDeclarations {
+			def := &openai.FunctionDefinition{Name: fd.Name, Description: fd.Description}
+			if len(fd.Parameters) > 0 {
+				var params interface{}
+				if err := json.Unmarshal(fd.Parameters, &params); err != nil {
+					return nil, fmt.Errorf("invalid parameters of function %s: %w", fd.Name, err)
+				}
+				def.Parameters = lowerSchemaTypes(params)
+			}
+			oaiReq.Tools = append(oaiReq.Tools, openai.Tool{Type: openai.ToolTypeFunction, Function: def})
+		}
+	}
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil && len(oaiReq.Tools) > 0 {
+		fc := req.ToolConfig.FunctionCallingConfig
+		switch strings.ToUpper(fc.Mode) {
+		case "ANY":
+			oaiReq.ToolChoice = "required"
+			if len(fc.AllowedFunctionNames) == 1 {
+				oaiReq.ToolChoice = openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: fc.AllowedFunctionNames[0]}}
+			}
+		case "NONE":
+			oaiReq.ToolChoice = "none"
+		case "AUTO":
+			oaiReq.ToolChoice = "auto"
+		}
+	}
+	return oaiReq, nil
+}
+
+func geminiPartsText(parts []googlegemini.Part) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// lowerSchemaTypes Gemini的schema中type为大写（OBJECT、STRING），转换为JSON Schema的小写
+func lowerSchemaTypes(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if s, ok := item.(string); ok && k == "type" {
+				val[k] = strings.ToLower(s)
+				continue
+			}
+			val[k] = lowerSchemaTypes(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = lowerSchemaTypes(item)
+		}
+	}
+	return v
+}
+
+// FinishReasonToGeminiFinishReason 将finish_reason转换为Gemini的finishReason，没有结束时为空
+func FinishReasonToGeminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "":
+		return ""
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	default:
+		return "STOP"
+	}
+}
+
+// OpenAIMessageToGeminiParts 回答的文本和工具调用转换为Gemini的parts
+func OpenAIMessageToGeminiParts(msg openai.ChatCompletionMessage) []googlegemini.Part {
+	parts := []googlegemini.Part{}
+	if msg.Content != "" {
+		parts = append(parts, googlegemini.Part{Text: msg.Content})
+	}
+	toolCalls := msg.ToolCalls
+	if msg.FunctionCall != nil {
+		toolCalls = append(toolCalls, openai.ToolCall{Function: *msg.FunctionCall})
+	}
+	for _, tc := range toolCalls {
+		parts = append(parts, googlegemini.Part{FunctionCall: &googlegemini.FunctionCall{Name: tc.Function.Name, Args: ToolArgumentsObject(tc.Function.Arguments)}})
+	}
+	return parts
+}
+
+// OpenAIResponseToGeminiResponse 将OpenAI格式的非流式响应转换为Gemini格式，每个choice为一个候选项
+func OpenAIResponseToGeminiResponse(resp *openai.ChatCompletionResponse) *googlegemini.GeminiResponse {
+	geminiResp := &googlegemini.GeminiResponse{
+		Candidates: make([]googlegemini.Candidate, 0, len(resp.Choices)),
+		UsageMetadata: googlegemini.UsageMetadata{
+			PromptTokenCount:     resp.Usage.PromptTokens,
+			CandidatesTokenCount: resp.Usage.CompletionTokens,
+			TotalTokenCount:      resp.Usage.TotalTokens,
+		},
+		ModelVersion: resp.Model,
+	}
+	for _, choice := range resp.Choices {
+		geminiResp.Candidates = append(geminiResp.Candidates, googlegemini.Candidate{
+			Content:      googlegemini.ContentEntity{Role: mycomdef.KEYNAME_MODEL, Parts: OpenAIMessageToGeminiParts(choice.Message)},
+			FinishReason: FinishReasonToGeminiFinishReason(string(choice.FinishReason)),
+			Index:        choice.Index,
+		})
+	}
+	return geminiResp
+}
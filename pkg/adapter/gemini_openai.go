@@ -1,98 +1,126 @@
 package adapter
 
 import (
+	"github.com/google/uuid"
 	google_gemini "simple-one-api/pkg/llm/google-gemini"
+	"simple-one-api/pkg/mycomdef"
 	myopenai "simple-one-api/pkg/openai"
 	"strings"
 	"time"
 )
 
+// geminiFinishReasonToFinishReason 将 finishReason 转换为 finish_reason，被安全策略拦截时为content_filter
+func geminiFinishReasonToFinishReason(finishReason string) string {
+	switch finishReason {
+	case "":
+		return ""
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// geminiCandidateText 合并候选项中所有的文本
+func geminiCandidateText(candidate *google_gemini.Candidate) string {
+	var content strings.Builder
+	for _, part := range candidate.Content.Parts {
+		content.WriteString(part.Text)
+	}
+	return content.String()
+}
+
+// geminiPromptBlocked 输入被拦截时Gemini不返回候选项，只在promptFeedback中返回原因
+func geminiPromptBlocked(resp *google_gemini.GeminiResponse) bool {
+	return len(resp.Candidates) == 0 && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != ""
+}
+
+func geminiUsage(resp *google_gemini.GeminiResponse) *myopenai.Usage {
+	return &myopenai.Usage{
+		PromptTokens:     resp.UsageMetadata.PromptTokenCount,
+		CompletionTokens: resp.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      resp.UsageMetadata.TotalTokenCount,
+	}
+}
+
 func GeminiResponseToOpenAIResponse(qfResp *google_gemini.GeminiResponse) *myopenai.OpenAIResponse {
 	// 创建 OpenAIResponse 实例
 	openAIResp := &myopenai.OpenAIResponse{
-		Object: "chat.completion",
-		Usage: &myopenai.Usage{
-			PromptTokens:     qfResp.UsageMetadata.PromptTokenCount,
-			CompletionTokens: qfResp.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      qfResp.UsageMetadata.TotalTokenCount,
-		},
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   qfResp.ModelVersion,
+		Usage:   geminiUsage(qfResp),
 		Choices: make([]myopenai.Choice, len(qfResp.Candidates)),
 	}
 
-	// 遍历所有候选项
-	for i, candidate := range qfResp.Candidates {
-
-		role := candidate.Content.Role
-		if strings.ToLower(role) == "model" {
-			role = "assitant"
-		}
-
-		var content string
-		if len(candidate.Content.Parts) > 0 {
-			content = candidate.Content.Parts[0].Text
-		}
+	if geminiPromptBlocked(qfResp) {
+		openAIResp.Choices = []myopenai.Choice{{
+			Message:      myopenai.ResponseMessage{Role: mycomdef.KEYNAME_ASSISTANT},
+			FinishReason: "content_filter",
+		}}
+		return openAIResp
+	}
 
+	// 遍历所有候选项
+	for i := range qfResp.Candidates {
+		candidate := &qfResp.Candidates[i]
 		openAIResp.Choices[i] = myopenai.Choice{
 			Index: candidate.Index,
 			Message: myopenai.ResponseMessage{
-				Role:    role,
-				Content: content,
+				Role:    mycomdef.KEYNAME_ASSISTANT,
+				Content: geminiCandidateText(candidate),
 			},
-			FinishReason: candidate.FinishReason,
+			FinishReason: geminiFinishReasonToFinishReason(candidate.FinishReason),
 		}
-
-		// 示例代码，假设不处理 LogProbs
-		/*
-			var logProbs json.RawMessage = nil
-			openAIResp.Choices[i].LogProbs = &logProbs
-
-		*/
 	}
 
 	return openAIResp
 }
 
+// GeminiResponseToOpenAIStreamResponse 转换流式响应的一个分片，id和created由调用方在整个流中保持一致；
+// 分片中的usageMetadata为累计值，只在带finishReason的分片中返回usage
 func GeminiResponseToOpenAIStreamResponse(qfResp *google_gemini.GeminiResponse) *myopenai.OpenAIStreamResponse {
 	if qfResp == nil {
 		return nil
 	}
 
-	var Choices []myopenai.OpenAIStreamResponseChoice
-
-	for i, candidate := range qfResp.Candidates {
-		role := candidate.Content.Role
-		if strings.ToLower(role) == "model" {
-			role = "assitant"
-		}
+	openAIResponse := &myopenai.OpenAIStreamResponse{
+		Object: "chat.completion.chunk",
+		Model:  qfResp.ModelVersion,
+	}
 
-		var content string
-		if len(candidate.Content.Parts) > 0 {
-			content = candidate.Content.Parts[0].Text
-		}
+	if geminiPromptBlocked(qfResp) {
+		openAIResponse.Choices = []myopenai.OpenAIStreamResponseChoice{{
+			Delta:        myopenai.ResponseDelta{Role: mycomdef.KEYNAME_ASSISTANT},
+			FinishReason: "content_filter",
+		}}
+		openAIResponse.Usage = geminiUsage(qfResp)
+		return openAIResponse
+	}
 
+	finished := false
+	for i := range qfResp.Candidates {
+		candidate := &qfResp.Candidates[i]
 		choice := myopenai.OpenAIStreamResponseChoice{
-			Index: i,
+			Index: candidate.Index,
 			Delta: myopenai.ResponseDelta{
-				Role:    role,
-				Content: content,
+				Role:    mycomdef.KEYNAME_ASSISTANT,
+				Content: geminiCandidateText(candidate),
 			},
-			//FinishReason: candidate.FinishReason,
 		}
-
-		Choices = append(Choices, choice)
+		if candidate.FinishReason != "" {
+			choice.FinishReason = geminiFinishReasonToFinishReason(candidate.FinishReason)
+			finished = true
+		}
+		openAIResponse.Choices = append(openAIResponse.Choices, choice)
 	}
-
-	openAIResponse := &myopenai.OpenAIStreamResponse{
-		ID:      "chatcmpl-" + time.Now().Format("20060102150405"), // 生成一个唯一的ID
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		//Model:   "gpt-3.5-turbo-0613", // 假设模型名称
-		Choices: Choices,
-		Usage: &myopenai.Usage{
-			PromptTokens:     qfResp.UsageMetadata.PromptTokenCount,
-			CompletionTokens: qfResp.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      qfResp.UsageMetadata.TotalTokenCount,
-		},
+	if finished {
+		openAIResponse.Usage = geminiUsage(qfResp)
 	}
 
 	return openAIResponse
@@ -39,39 +39,72 @@ func DeepCopyGeminiRequest(original *googlegemini.GeminiRequest) (*googlegemini.
 }
 
 // OpenAIRequestToGeminiRequest converts OpenAI chat completion request to a Gemini request.
+// system消息放在systemInstruction中（gemini-1.0不支持，合并到第一条user消息），assistant角色转换为model，其他角色转换为user
 func OpenAIRequestToGeminiRequest(oaiReq *openai.ChatCompletionRequest) *googlegemini.GeminiRequest {
-	contents := convertMessagesToContents(oaiReq.Messages)
+	var systemInstruction *googlegemini.ContentEntity
+	messages := oaiReq.Messages
+	if geminiSupportsSystemInstruction(oaiReq.Model) {
+		var systemParts []googlegemini.Part
+		messages = nil
+		for _, msg := range oaiReq.Messages {
+			if strings.ToLower(msg.Role) != openai.ChatMessageRoleSystem {
+				messages = append(messages, msg)
+				continue
+			}
+			if text := mycommon.GetMessageText(msg); text != "" {
+				systemParts = append(systemParts, googlegemini.Part{Text: text})
+			}
+		}
+		if len(systemParts) > 0 {
+			systemInstruction = &googlegemini.ContentEntity{Parts: systemParts}
+		}
+	} else {
+		messages = mycommon.ConvertSystemMessages2NoSystem(messages)
+	}
+
+	contents := convertMessagesToContents(messages)
 
 	//mylog.Logger.Debug("convertMessagesToContents", zap.Any("contents", contents))
 
 	geminiReq := &googlegemini.GeminiRequest{
-		Contents: contents,
+		Contents:          contents,
+		SystemInstruction: systemInstruction,
 		//	SafetySettings: []googlegemini.SafetySetting{},
 		GenerationConfig: googlegemini.GenerationConfig{
 			StopSequences:   oaiReq.Stop,
 			Temperature:     oaiReq.Temperature,
 			MaxOutputTokens: oaiReq.MaxTokens,
 			TopP:            oaiReq.TopP,
-			TopK:            oaiReq.TopLogProbs,
 		},
 	}
+	if oaiReq.N > 1 {
+		geminiReq.GenerationConfig.CandidateCount = oaiReq.N
+	}
 
 	return geminiReq
 }
 
+// geminiSupportsSystemInstruction gemini-1.0-pro和gemini-pro-vision不支持systemInstruction
+func geminiSupportsSystemInstruction(model string) bool {
+	model = strings.ToLower(model)
+	return !strings.HasPrefix(model, "gemini-1.0") && !strings.HasPrefix(model, "gemini-pro")
+}
+
 // convertMessagesToContents converts messages from OpenAI format to Gemini content entities.
+// 没有内容的消息会被跳过，相邻的同角色消息合并为一条
 func convertMessagesToContents(messages []openai.ChatCompletionMessage) []googlegemini.ContentEntity {
 	var contents []googlegemini.ContentEntity
-	hisMessages := mycommon.ConvertSystemMessages2NoSystem(messages)
-
-	//mylog.Logger.Debug("ConvertSystemMessages2NoSystem", zap.Any("hisMessages", hisMessages))
-
-	for _, msg := range hisMessages {
+	for _, msg := range messages {
 		role := getRole(msg)
 		contentEntity := createContentEntity(msg, role)
-		if contentEntity != nil {
-			contents = append(contents, *contentEntity)
+		if contentEntity == nil || len(contentEntity.Parts) == 0 {
+			continue
+		}
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, contentEntity.Parts...)
+			continue
 		}
+		contents = append(contents, *contentEntity)
 	}
 
 	return contents
@@ -82,7 +115,7 @@ func getRole(msg openai.ChatCompletionMessage) string {
 	if strings.ToLower(msg.Role) == mycomdef.KEYNAME_ASSISTANT {
 		return mycomdef.KEYNAME_MODEL
 	}
-	return msg.Role
+	return openai.ChatMessageRoleUser
 }
 
 // createContentEntity creates a Gemini content entity from an OpenAI message.
@@ -2,13 +2,13 @@ package adapter
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/google/uuid"
 	"github.com/sashabaranov/go-openai"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	tchttp "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/http"
 	hunyuan "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/hunyuan/v20230901"
 	"go.uber.org/zap"
+	"simple-one-api/pkg/mycommon"
 	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
 	"simple-one-api/pkg/utils"
@@ -25,13 +25,35 @@ const (
 	Custom ToolChoiceType = "custom"
 )
 
+func openAIMultiContentToHunYuanContents(parts []openai.ChatMessagePart) []*hunyuan.Content {
+	var contents []*hunyuan.Content
+	for _, part := range parts {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			contents = append(contents, &hunyuan.Content{
+				Type: common.StringPtr(string(part.Type)),
+				Text: common.StringPtr(part.Text),
+			})
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				continue
+			}
+			contents = append(contents, &hunyuan.Content{
+				Type:     common.StringPtr(string(part.Type)),
+				ImageUrl: &hunyuan.ImageUrl{Url: common.StringPtr(part.ImageURL.URL)},
+			})
+		}
+	}
+	return contents
+}
+
 func OpenAIRequestToHunYuanRequest(oaiReq *openai.ChatCompletionRequest) *hunyuan.ChatCompletionsRequest {
 	request := hunyuan.NewChatCompletionsRequest()
 
 	model := oaiReq.Model
 	request.Model = common.StringPtr(model)
 
-	mylog.Logger.Info("messages", zap.Any("oaiReq.Messages", oaiReq.Messages))
+	mylog.Logger.Info("messages", zap.String("oaiReq.Messages", mycommon.ElideBase64JSON(oaiReq.Messages)))
 
 	for i, msg := range oaiReq.Messages {
 		//超级对齐，多余的system直接删除
@@ -55,19 +77,32 @@ func OpenAIRequestToHunYuanRequest(oaiReq *openai.ChatCompletionRequest) *hunyua
 			}
 		}
 
-		request.Messages = append(request.Messages, &hunyuan.Message{
-			Role:       &tmpMsg.Role,
-			Content:    &tmpMsg.Content,
-			ToolCallId: &tmpMsg.ToolCallID,
-			ToolCalls:  hyToolCalls,
-		})
+		hyMsg := &hunyuan.Message{
+			Role:      &tmpMsg.Role,
+			ToolCalls: hyToolCalls,
+		}
+		if tmpMsg.ToolCallID != "" {
+			hyMsg.ToolCallId = &tmpMsg.ToolCallID
+		}
+		if len(tmpMsg.MultiContent) > 0 && tmpMsg.Content == "" {
+			// 混元视觉模型的图片支持http地址和带data:image前缀的base64
+			hyMsg.Contents = openAIMultiContentToHunYuanContents(tmpMsg.MultiContent)
+		} else {
+			hyMsg.Content = &tmpMsg.Content
+		}
+		request.Messages = append(request.Messages, hyMsg)
 	}
 
-	topP := float64(oaiReq.TopP) // 将 *float32 转换为 float64
-	request.TopP = &topP
+	// 没有设置时使用混元的默认值
+	if oaiReq.TopP > 0 {
+		topP := float64(oaiReq.TopP)
+		request.TopP = &topP
+	}
 
-	temperature := float64(oaiReq.Temperature) // 将 *float32 转换为 float64
-	request.Temperature = &temperature
+	if oaiReq.Temperature > 0 {
+		temperature := float64(oaiReq.Temperature)
+		request.Temperature = &temperature
+	}
 
 	request.Stream = &oaiReq.Stream
 
@@ -89,8 +124,9 @@ func OpenAIRequestToHunYuanRequest(oaiReq *openai.ChatCompletionRequest) *hunyua
 	request.Tools = hyTools
 
 	// 工具执行方式字段
-	choiceType, toolChoice := convertHYToolChoice(oaiReq.ToolChoice)
-	request.ToolChoice, request.CustomTool = (*string)(&choiceType), toolChoice
+	if choiceType, toolChoice := convertHYToolChoice(oaiReq.ToolChoice); choiceType != "" {
+		request.ToolChoice, request.CustomTool = (*string)(&choiceType), toolChoice
+	}
 
 	return request
 }
@@ -142,9 +178,6 @@ func HunYuanResponseToOpenAIStreamResponse(event tchttp.SSEvent) (*myopenai.Open
 		return nil, err
 	}
 
-	var sResponse tecenthunyuan.StreamResponse
-	json.Unmarshal(event.Data, &sResponse)
-
 	id := event.Id
 	if id == "" {
 		id = uuid.New().String()
@@ -152,23 +185,40 @@ func HunYuanResponseToOpenAIStreamResponse(event tchttp.SSEvent) (*myopenai.Open
 
 	openAIResp := &myopenai.OpenAIStreamResponse{
 		ID:      id,
+		Object:  "chat.completion.chunk",
 		Created: utils.GetInt64(sResponse.Created),
+		Error:   convertError(sResponse.ErrorMsg),
 	}
-	openAIResp.Usage = &myopenai.Usage{
-		PromptTokens:     int(utils.GetInt64(sResponse.Usage.PromptTokens)),
-		CompletionTokens: int(utils.GetInt64(sResponse.Usage.CompletionTokens)),
-		TotalTokens:      int(utils.GetInt64(sResponse.Usage.TotalTokens)),
-	}
+
+	// 每个分片都带有累计的usage，只在最后一个分片返回
+	finished := false
 	for _, choice := range sResponse.Choices {
-		openAIResp.Choices = append(openAIResp.Choices, myopenai.OpenAIStreamResponseChoice{
-			Delta:        convertHYDelta(*choice.Delta),
-			FinishReason: utils.GetString(choice.FinishReason),
-		})
+		var delta myopenai.ResponseDelta
+		if choice.Delta != nil {
+			delta = convertHYDelta(*choice.Delta)
+		}
+		streamChoice := myopenai.OpenAIStreamResponseChoice{Delta: delta}
+		if finishReason := convertHYFinishReason(utils.GetString(choice.FinishReason)); finishReason != "" {
+			streamChoice.FinishReason = finishReason
+			finished = true
+		}
+		openAIResp.Choices = append(openAIResp.Choices, streamChoice)
+	}
+	if finished {
+		openAIResp.Usage = convertUsage(sResponse.Usage)
 	}
 
 	return openAIResp, nil
 }
 
+// convertHYFinishReason 混元开启流式审核时，审核未通过返回sensitive
+func convertHYFinishReason(reason string) string {
+	if reason == "sensitive" {
+		return "content_filter"
+	}
+	return reason
+}
+
 // 转换函数实现
 func HunYuanResponseToOpenAIResponse(qfResp *hunyuan.ChatCompletionsResponse) *myopenai.OpenAIResponse {
 	if qfResp == nil || qfResp.Response == nil {
@@ -189,7 +239,7 @@ func HunYuanResponseToOpenAIResponse(qfResp *hunyuan.ChatCompletionsResponse) *m
 			//Index:   choice.Index,
 			Message: convertHYMessage(*choice.Message),
 			//LogProbs:     choice.LogProbs,
-			FinishReason: utils.GetString(choice.FinishReason),
+			FinishReason: convertHYFinishReason(utils.GetString(choice.FinishReason)),
 		})
 	}
 
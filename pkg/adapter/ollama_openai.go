@@ -3,7 +3,10 @@ package adapter
 import (
 	"github.com/google/uuid"
 	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
 	"simple-one-api/pkg/llm/ollama"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
 	"simple-one-api/pkg/utils"
 )
@@ -20,7 +23,19 @@ func OpenAIRequestToOllamaRequest(oaiReq *openai.ChatCompletionRequest) *ollama.
 	for i, msg := range oaiReq.Messages {
 		messages[i] = ollama.Message{
 			Role:    msg.Role,
-			Content: msg.Content,
+			Content: mycommon.GetMessageText(msg),
+		}
+		// 图片以base64的形式放在images中
+		for _, part := range msg.MultiContent {
+			if part.ImageURL == nil {
+				continue
+			}
+			imgData, _, err := mycommon.GetImageURLData(part.ImageURL.URL)
+			if err != nil {
+				mylog.Logger.Warn("skip image", zap.Error(err))
+				continue
+			}
+			messages[i].Images = append(messages[i].Images, imgData)
 		}
 	}
 
@@ -28,15 +43,22 @@ func OpenAIRequestToOllamaRequest(oaiReq *openai.ChatCompletionRequest) *ollama.
 		Temperature: oaiReq.Temperature,
 		TopP:        oaiReq.TopP,
 		NumPredict:  oaiReq.MaxTokens,
+		Stop:        oaiReq.Stop,
+	}
+	if oaiReq.Seed != nil {
+		options.Seed = *oaiReq.Seed
 	}
 
-	return &ollama.ChatRequest{
+	req := &ollama.ChatRequest{
 		Model:    oaiReq.Model,
 		Messages: messages,
 		Stream:   oaiReq.Stream,
 		Options:  options,
-		Format:   getFormat(oaiReq.ResponseFormat),
 	}
+	if format := getFormat(oaiReq.ResponseFormat); format != "" {
+		req.Format = format
+	}
+	return req
 }
 
 func getFormat(format *openai.ChatCompletionResponseFormat) string {
@@ -66,7 +88,7 @@ func OllamaResponseToOpenAIResponse(resp *ollama.ChatResponse) *myopenai.OpenAIR
 				Role:    resp.Message.Role,
 				Content: resp.Message.Content,
 			},
-			//FinishReason: determineFinishReason(resp.Done),
+			FinishReason: determineFinishReason(resp),
 		},
 	}
 
@@ -80,6 +102,7 @@ func OllamaResponseToOpenAIResponse(resp *ollama.ChatResponse) *myopenai.OpenAIR
 
 	return &myopenai.OpenAIResponse{
 		ID:      uuid.New().String(),
+		Object:  "chat.completion",
 		Created: timeCreate,
 		Model:   resp.Model,
 		Choices: choices,
@@ -87,42 +110,45 @@ func OllamaResponseToOpenAIResponse(resp *ollama.ChatResponse) *myopenai.OpenAIR
 	}
 }
 
-func determineFinishReason(done bool) string {
-	if done {
-		return stopFinish
+// determineFinishReason 优先使用done_reason，旧版本的ollama没有该字段时按stop处理
+func determineFinishReason(resp *ollama.ChatResponse) string {
+	if resp.DoneReason == lengthFinish {
+		return lengthFinish
 	}
-	return lengthFinish
+	return stopFinish
 }
 
+// OllamaResponseToOpenAIStreamResponse 转换ollama的一行流式响应，done为true的最后一行带有finish_reason和usage
 func OllamaResponseToOpenAIStreamResponse(resp *ollama.ChatResponse) *myopenai.OpenAIStreamResponse {
 	if resp == nil {
 		return nil
 	}
 
 	//log.Println(resp.Message.Role, resp.Message.Content)
-	choices := []myopenai.OpenAIStreamResponseChoice{
-		{
-			Index: 0,
-			Delta: myopenai.ResponseDelta{
-				Role:    resp.Message.Role,
-				Content: resp.Message.Content,
-			},
+	choice := myopenai.OpenAIStreamResponseChoice{
+		Index: 0,
+		Delta: myopenai.ResponseDelta{
+			Role:    resp.Message.Role,
+			Content: resp.Message.Content,
 		},
 	}
 
-	usage := &myopenai.Usage{
-		PromptTokens:     resp.PromptEvalCount,
-		CompletionTokens: resp.EvalCount,
-		TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
-	}
-
 	timeCreate, _ := utils.ParseRFC3339NanoToUnixTime(resp.CreatedAt)
 
-	return &myopenai.OpenAIStreamResponse{
-		ID:      uuid.New().String(),
+	streamResp := &myopenai.OpenAIStreamResponse{
 		Created: timeCreate,
 		Model:   resp.Model,
-		Choices: choices,
-		Usage:   usage,
 	}
+
+	if resp.Done {
+		choice.FinishReason = determineFinishReason(resp)
+		streamResp.Usage = &myopenai.Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		}
+	}
+	streamResp.Choices = []myopenai.OpenAIStreamResponseChoice{choice}
+
+	return streamResp
 }
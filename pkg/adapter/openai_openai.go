@@ -3,7 +3,9 @@ package adapter
 import (
 	"encoding/json"
 	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
 	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
 	"strings"
 )
@@ -28,12 +30,17 @@ func OpenAIResponseToOpenAIResponse(resp *openai.ChatCompletionResponse) *myopen
 			role = mycomdef.KEYNAME_ASSISTANT
 		}
 		message := myopenai.ResponseMessage{
-			Role:    role,
-			Content: choice.Message.Content,
+			Role:       role,
+			Content:    choice.Message.Content,
+			ToolCalls:  OpenAIToolCallsToToolCalls(choice.Message.ToolCalls),
+			ToolCallID: choice.Message.ToolCallID,
+		}
+		if fc := choice.Message.FunctionCall; fc != nil {
+			message.FunctionCall = &myopenai.FunctionCall{Name: fc.Name, Arguments: fc.Arguments}
 		}
 		var logProbs json.RawMessage
 		if choice.LogProbs != nil {
-			logProbs, _ = json.Marshal(choice.LogProbs)
+			logProbs, _ = json.Marshal(convertLogProbs(choice.LogProbs))
 		}
 		choices = append(choices, myopenai.Choice{
 			Index:        choice.Index,
@@ -60,6 +67,63 @@ func OpenAIResponseToOpenAIResponse(resp *openai.ChatCompletionResponse) *myopen
 	}
 }
 
+// logProb go-openai中bytes为[]byte，序列化后是base64字符串，OpenAI返回的是整数数组
+type logProb struct {
+	Token       string       `json:"token"`
+	LogProb     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogProbs []topLogProb `json:"top_logprobs"`
+}
+
+type topLogProb struct {
+	Token   string  `json:"token"`
+	LogProb float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+func bytesToInts(b []byte) []int {
+	if b == nil {
+		return nil
+	}
+	ints := make([]int, len(b))
+	for i, v := range b {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+// convertLogProbs 按OpenAI的格式返回logprobs
+func convertLogProbs(lp *openai.LogProbs) map[string][]logProb {
+	content := make([]logProb, len(lp.Content))
+	for i, c := range lp.Content {
+		content[i] = logProb{Token: c.Token, LogProb: c.LogProb, Bytes: bytesToInts(c.Bytes), TopLogProbs: make([]topLogProb, len(c.TopLogProbs))}
+		for j, t := range c.TopLogProbs {
+			content[i].TopLogProbs[j] = topLogProb{Token: t.Token, LogProb: t.LogProb, Bytes: bytesToInts(t.Bytes)}
+		}
+	}
+	return map[string][]logProb{"content": content}
+}
+
+// OpenAIToolCallsToToolCalls 转换工具调用，流式分片中的index原样保留
+func OpenAIToolCallsToToolCalls(toolCalls []openai.ToolCall) []myopenai.ToolCall {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+	result := make([]myopenai.ToolCall, len(toolCalls))
+	for i, tc := range toolCalls {
+		result[i] = myopenai.ToolCall{
+			Index: tc.Index,
+			ID:    tc.ID,
+			Type:  myopenai.ToolType(tc.Type),
+			Function: myopenai.FunctionCall{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		}
+	}
+	return result
+}
+
 // OpenAIMultiContentRequestToOpenAIContentResponse 转换含多内容消息的请求到单内容响应。
 func OpenAIMultiContentRequestToOpenAIContentRequest(oaiReq *openai.ChatCompletionRequest) {
 	for i := range oaiReq.Messages {
@@ -74,6 +138,8 @@ func OpenAIMultiContentRequestToOpenAIContentRequest(oaiReq *openai.ChatCompleti
 				} else if content.Type == openai.ChatMessagePartTypeImageURL {
 					if strings.HasPrefix(content.ImageURL.URL, "http") {
 						msg.Content += "\n" + content.ImageURL.URL
+					} else {
+						mylog.Logger.Warn("model does not support image content, base64 image dropped", zap.String("model", oaiReq.Model))
 					}
 				}
 			}
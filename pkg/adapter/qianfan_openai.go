@@ -59,17 +59,11 @@ func qianFanCheckMaxTokens(model string, maxtokens int) int {
 	return 0
 }
 
+// OpenAIRequestToQianFanRequest 千帆的system单独传入，messages必须以user开始并且user和assistant严格交替，
+// 相邻的同角色消息合并为一条，开头不是user的消息丢弃
 func OpenAIRequestToQianFanRequest(oaiReq *openai.ChatCompletionRequest) *baiduqianfan.QianFanRequest {
 	var req baiduqianfan.QianFanRequest
 
-	for _, chatMsg := range req.Messages {
-		qianMsg := mycommon.Message{
-			Role:    chatMsg.Role,
-			Content: chatMsg.Content,
-		}
-		req.Messages = append(req.Messages, qianMsg)
-	}
-
 	req.Stream = &oaiReq.Stream
 	req.Stop = oaiReq.Stop
 
@@ -78,50 +72,54 @@ func OpenAIRequestToQianFanRequest(oaiReq *openai.ChatCompletionRequest) *baiduq
 		req.MaxOutputTokens = &maxTokens
 	}
 
-	topP := float64(oaiReq.TopP) // 将 *float32 转换为 float64
-
-	if topP < 0 {
-		topP = 0
-	}
-	if topP > 1.0 {
-		topP = 1.0
+	// 没有设置时使用千帆的默认值
+	if oaiReq.TopP > 0 {
+		topP := float64(oaiReq.TopP)
+		if topP > 1.0 {
+			topP = 1.0
+		}
+		req.TopP = &topP
 	}
-	req.TopP = &topP
-
-	temperature := float64(oaiReq.Temperature) // 将 *float32 转换为 float64
 
-	if temperature <= 0 {
-		temperature = 0.1
+	if oaiReq.Temperature > 0 {
+		temperature := float64(oaiReq.Temperature)
+		if temperature > 1 {
+			temperature = 1
+		}
+		req.Temperature = &temperature
 	}
 
-	if temperature > 1 {
-		temperature = 1
+	// 处理系统名称或描述等可能需要自定义的转换
+	if oaiReq.User != "" {
+		req.UserID = &oaiReq.User
 	}
-	req.Temperature = &temperature
 
-	req.Stream = &oaiReq.Stream
-	// 处理系统名称或描述等可能需要自定义的转换
-	req.UserID = &oaiReq.User
-
-	if len(oaiReq.Messages) > 0 && strings.ToUpper(oaiReq.Messages[0].Role) == "SYSTEM" {
-		if len(oaiReq.Messages) > 1 {
-			oaiReq.Messages = oaiReq.Messages[1:]
-		} else {
-			// 处理数组长度不足的情况，例如可以清空或给出错误提示
-			req.Messages = nil // 或其他适当的错误处理
+	var systems []string
+	var messages []openai.ChatCompletionMessage
+	for _, msg := range oaiReq.Messages {
+		role := strings.ToLower(msg.Role)
+		if role == openai.ChatMessageRoleSystem {
+			systems = append(systems, mycommon.GetMessageText(msg))
+			continue
 		}
-
-		req.System = &oaiReq.Messages[0].Content
+		if role != openai.ChatMessageRoleUser && role != openai.ChatMessageRoleAssistant {
+			mylog.Logger.Warn("qianfan skip unsupported role", zap.String("role", msg.Role))
+			continue
+		}
+		messages = append(messages, openai.ChatCompletionMessage{Role: role, Content: mycommon.GetMessageText(msg)})
+	}
+	if len(systems) > 0 {
+		system := strings.Join(systems, "\n")
+		req.System = &system
 	}
 
-	for _, msg := range oaiReq.Messages {
-		req.Messages = append(req.Messages, struct {
-			Role    string `json:"role"`    // 用户或助手的角色
-			Content string `json:"content"` // 对话内容
-		}{
-			Role:    msg.Role,
-			Content: msg.Content,
-		})
+	for len(messages) > 0 && messages[0].Role != openai.ChatMessageRoleUser {
+		mylog.Logger.Warn("qianfan drop leading message", zap.String("role", messages[0].Role))
+		messages = messages[1:]
+	}
+	messages = mycommon.MergeConsecutiveRoleMessages(messages, mycommon.DefaultMergeSeparator)
+	for _, msg := range messages {
+		req.Messages = append(req.Messages, mycommon.Message{Role: msg.Role, Content: msg.Content})
 	}
 
 	// 将FrequencyPenalty 转换为 PenaltyScore
@@ -137,6 +135,17 @@ func OpenAIRequestToQianFanRequest(oaiReq *openai.ChatCompletionRequest) *baiduq
 	return &req
 }
 
+// qianFanFinishReason 回答被截断时为length，触发安全策略需要清空历史时为content_filter
+func qianFanFinishReason(qfResp *baiduqianfan.QianFanResponse) string {
+	if qfResp.NeedClearHistory {
+		return "content_filter"
+	}
+	if qfResp.IsTruncated {
+		return "length"
+	}
+	return "stop"
+}
+
 func QianFanResponseToOpenAIResponse(qfResp *baiduqianfan.QianFanResponse) *myopenai.OpenAIResponse {
 	// 创建一个 OpenAIResponse 实例
 	if qfResp.ErrorCode != 0 && len(qfResp.ErrorMsg) > 0 {
@@ -170,12 +179,7 @@ func QianFanResponseToOpenAIResponse(qfResp *baiduqianfan.QianFanResponse) *myop
 			Role:    "assistant", // 默认设置为助手回复
 			Content: qfResp.Result,
 		},
-		FinishReason: "completed", // 默认完成原因，可以根据QianFanResponse字段进一步定制
-	}
-
-	// 如果 QianFanResponse 中有 IsEnd 且为 true，则认为对话结束
-	if qfResp.IsEnd != nil && *qfResp.IsEnd {
-		choice.FinishReason = "stop"
+		FinishReason: qianFanFinishReason(qfResp),
 	}
 
 	// 将 Choice 添加到 Choices 数组
@@ -207,11 +211,16 @@ func QianFanResponseToOpenAIStreamResponse(qfResp *baiduqianfan.QianFanResponse)
 		Created:           qfResp.Created,
 		Model:             "", // 假定使用的模型
 		SystemFingerprint: "", // 假定一个系统指纹
-		Usage: &myopenai.Usage{
+	}
+
+	// 每个分片都带有累计的usage，只在最后一个分片返回
+	isEnd := qfResp.IsEnd != nil && *qfResp.IsEnd
+	if isEnd {
+		oaResp.Usage = &myopenai.Usage{
 			PromptTokens:     qfResp.Usage.PromptTokens,
 			CompletionTokens: qfResp.Usage.CompletionTokens,
 			TotalTokens:      qfResp.Usage.TotalTokens,
-		},
+		}
 	}
 
 	// 根据结果和是否结束设置 Choices
@@ -226,9 +235,8 @@ func QianFanResponseToOpenAIStreamResponse(qfResp *baiduqianfan.QianFanResponse)
 	choice.Delta.Role = "assistant" // 假设角色为 assistant
 	choice.Delta.Content = qfResp.Result
 
-	// 如果 QianFanResponse 中有 IsEnd 且为 true，则认为对话结束
-	if qfResp.IsEnd != nil && *qfResp.IsEnd {
-		choice.FinishReason = "stop"
+	if isEnd {
+		choice.FinishReason = qianFanFinishReason(qfResp)
 	}
 
 	oaResp.Choices = append(oaResp.Choices, choice)
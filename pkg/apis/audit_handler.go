@@ -0,0 +1,93 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myaudit"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"time"
+)
+
+// AuditLogsHandler 分页查询审计日志，需要配置顶层api_key，并在请求中带上该key。
+// 支持start、end（unix时间戳或YYYY-MM-DD）、key、model、service、status、q（在请求、响应和错误中查找）、page、page_size
+func AuditLogsHandler(c *gin.Context) {
+	if config.GetAPIKey() == "" {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "api_key must be configured to query audit logs"})
+		return
+	}
+	apikey, err := utils.GetAPIKeyFromHeader(c)
+	if err != nil || apikey != config.GetAPIKey() {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+		return
+	}
+	if !myaudit.Enabled() {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "audit log is not enabled"})
+		return
+	}
+
+	q := &myaudit.Query{
+		KeyName:     c.Query("key"),
+		Model:       c.Query("model"),
+		ServiceName: c.Query("service"),
+		Keyword:     c.Query("q"),
+	}
+	var ok bool
+	if q.Start, ok = parseAuditTime(c, "start", false); !ok {
+		return
+	}
+	if q.End, ok = parseAuditTime(c, "end", true); !ok {
+		return
+	}
+	for name, dst := range map[string]*int{"status": &q.StatusCode, "page": &q.Page, "page_size": &q.PageSize} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + " '" + v + "'"})
+			return
+		}
+		*dst = n
+	}
+
+	records, total, err := myaudit.QueryRecords(c.Request.Context(), q)
+	if err != nil {
+		mylog.Logger.Error("query audit logs failed", zap.Error(err))
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "query audit logs failed"})
+		return
+	}
+	if records == nil {
+		records = []*myaudit.Record{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"data":      records,
+		"total":     total,
+		"page":      q.Page,
+		"page_size": q.PageSize,
+	})
+}
+
+// parseAuditTime 日期作为结束时间时包含当天
+func parseAuditTime(c *gin.Context, name string, endOfDay bool) (int64, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, true
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, true
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid " + name + " '" + v + "', expected unix timestamp or YYYY-MM-DD"})
+		return 0, false
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t.Unix(), true
+}
@@ -0,0 +1,34 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/utils"
+)
+
+// ReloadConfigHandler 重新加载配置文件，需要配置顶层api_key，并在请求中带上该key，加载失败时保持原来的配置
+func ReloadConfigHandler(c *gin.Context) {
+	if config.GetAPIKey() == "" {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "api_key must be configured to reload config"})
+		return
+	}
+	apikey, err := utils.GetAPIKeyFromHeader(c)
+	if err != nil || apikey != config.GetAPIKey() {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+		return
+	}
+
+	if err = config.ReloadConfig(); err != nil {
+		mylog.Logger.Error("reload config failed, keep the current config", zap.Error(err))
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "reload config failed: " + err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"status":   "reloaded",
+		"models":   len(config.GetModelToService()),
+		"api_keys": len(config.GetConf().APIKeys),
+	})
+}
@@ -0,0 +1,33 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+)
+
+// ConversationUsageHandler 返回会话累计的token用量，按使用的模型拆分
+func ConversationUsageHandler(c *gin.Context) {
+	if config.GetAPIKey() != "" {
+		apikey, err := utils.GetAPIKeyFromHeader(c)
+		if err != nil || apikey != config.GetAPIKey() {
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+			return
+		}
+	}
+
+	if !config.GetConf().ConversationUsage.Enable {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "conversation usage is not enabled"})
+		return
+	}
+
+	usage, found := mycommon.GetConversationUsage(c.Param("id"))
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, usage)
+}
@@ -0,0 +1,210 @@
+package apis
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mydashboard"
+	"simple-one-api/pkg/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type dashboardService struct {
+	Service     string            `json:"service"`
+	Index       int               `json:"index"`
+	ServerURL   string            `json:"server_url"`
+	Enabled     bool              `json:"enabled"`
+	Models      []string          `json:"models"`
+	ModelMap    map[string]string `json:"model_map"`
+	Weight      int               `json:"weight"`
+	Credentials string            `json:"credentials"`
+}
+
+type dashboardAPIKey struct {
+	Index             int      `json:"index"`
+	APIKey            string   `json:"api_key"`
+	Name              string   `json:"name"`
+	AllowedModels     []string `json:"allowed_models"`
+	ExpiresAt         string   `json:"expires_at"`
+	MaxStreams        int      `json:"max_streams"`
+	RPM               int      `json:"rpm"`
+	TPM               int      `json:"tpm"`
+	MonthlyTokenQuota int64    `json:"monthly_token_quota"`
+}
+
+// checkDashboardAdmin 控制台的管理接口需要配置顶层api_key，并在请求中带上该key
+func checkDashboardAdmin(c *gin.Context) bool {
+	if !config.GetConf().Dashboard.Enable {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "dashboard is not enabled"})
+		return false
+	}
+	if config.GetAPIKey() == "" {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "api_key must be configured to use the dashboard"})
+		return false
+	}
+	apikey, err := utils.GetAPIKeyFromHeader(c)
+	if err != nil || apikey != config.GetAPIKey() {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+		return false
+	}
+	return true
+}
+
+// DashboardStatsHandler 返回启动以来按服务、key和模型统计的请求数、错误率、token用量和费用，以及最近几分钟每秒的请求数
+func DashboardStatsHandler(c *gin.Context) {
+	if !checkDashboardAdmin(c) {
+		return
+	}
+	snap := mydashboard.GetSnapshot()
+	if len(config.GetConf().Pricing.Models) > 0 {
+		snap.Currency = config.GetPricingCurrency()
+	}
+	c.JSON(http.StatusOK, snap)
+}
+
+// DashboardConfigHandler 返回控制台可以修改的服务和api_keys配置，凭证和key只返回脱敏后的值
+func DashboardConfigHandler(c *gin.Context) {
+	soaConf := config.GetConf()
+	if !checkDashboardAdmin(c) {
+		return
+	}
+
+	serviceNames := make([]string, 0, len(soaConf.Services))
+	for name := range soaConf.Services {
+		serviceNames = append(serviceNames, name)
+	}
+	sort.Strings(serviceNames)
+
+	services := make([]dashboardService, 0)
+	for _, name := range serviceNames {
+		for i, s := range soaConf.Services[name] {
+			services = append(services, dashboardService{
+				Service:     name,
+				Index:       i,
+				ServerURL:   s.ServerURL,
+				Enabled:     s.Enabled,
+				Models:      s.Models,
+				ModelMap:    s.ModelMap,
+				Weight:      s.Weight,
+				Credentials: maskCredentials(&s),
+			})
+		}
+	}
+
+	apiKeys := make([]dashboardAPIKey, 0, len(soaConf.APIKeys))
+	for i, k := range soaConf.APIKeys {
+		apiKeys = append(apiKeys, dashboardAPIKey{
+			Index:             i,
+			APIKey:            mycommon.MaskKey(k.APIKey),
+			Name:              k.Name,
+			AllowedModels:     k.AllowedModels,
+			ExpiresAt:         k.ExpiresAt,
+			MaxStreams:        k.MaxStreams,
+			RPM:               k.RPM,
+			TPM:               k.TPM,
+			MonthlyTokenQuota: k.MonthlyTokenQuota,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"services": services, "api_keys": apiKeys})
+}
+
+// maskCredentials 凭证中的字符串脱敏后按key排序输出，配置了credential_list时只返回数量
+func maskCredentials(s *config.ServiceModel) string {
+	if len(s.CredentialList) > 0 {
+		return fmt.Sprintf("credential_list: %d", len(s.CredentialList))
+	}
+	keys := make([]string, 0, len(s.Credentials))
+	for key := range s.Credentials {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, _ := s.Credentials[key].(string)
+		parts = append(parts, key+": "+mycommon.MaskKey(value))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// UpdateDashboardServiceHandler 修改服务的enabled、models、model_map、weight，写入配置文件后重新加载
+func UpdateDashboardServiceHandler(c *gin.Context) {
+	if !checkDashboardAdmin(c) {
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid index"})
+		return
+	}
+	var edit config.ServiceEdit
+	if err := c.ShouldBindJSON(&edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if err := config.UpdateService(c.Param("service"), index, &edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "saved"})
+}
+
+// AddDashboardAPIKeyHandler 在api_keys中增加一个key
+func AddDashboardAPIKeyHandler(c *gin.Context) {
+	if !checkDashboardAdmin(c) {
+		return
+	}
+	var edit config.APIKeyEdit
+	if err := c.ShouldBindJSON(&edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if err := config.AddAPIKey(&edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"status": "saved"})
+}
+
+// UpdateDashboardAPIKeyHandler 修改api_keys中的第index个key
+func UpdateDashboardAPIKeyHandler(c *gin.Context) {
+	if !checkDashboardAdmin(c) {
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid index"})
+		return
+	}
+	var edit config.APIKeyEdit
+	if err := c.ShouldBindJSON(&edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if err := config.UpdateAPIKey(index, &edit); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "saved"})
+}
+
+// DeleteDashboardAPIKeyHandler 删除api_keys中的第index个key
+func DeleteDashboardAPIKeyHandler(c *gin.Context) {
+	if !checkDashboardAdmin(c) {
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid index"})
+		return
+	}
+	if err := config.DeleteAPIKey(index); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "deleted"})
+}
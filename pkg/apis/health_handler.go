@@ -0,0 +1,49 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+// HealthHandler 进程存活检查，不访问上游，总是返回200；有上游处于熔断期、探测不健康或者凭证全部被隔离时status为degraded，
+// 并列出这些服务
+func HealthHandler(c *gin.Context) {
+	var degraded []gin.H
+	if config.GetConf() != nil {
+		for _, u := range mycommon.GetUpstreamStatuses() {
+			if u.Status == mycommon.UpstreamStatusDegraded {
+				degraded = append(degraded, gin.H{"service_name": u.ServiceName, "service_id": u.ServiceID, "reasons": u.Reasons})
+			}
+		}
+	}
+	if len(degraded) == 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "degraded", "degraded_upstreams": degraded})
+}
+
+// ReadinessHandler 检查配置是否已加载，带上probe=upstream参数时探测各上游服务，探测失败只把对应服务标记为不健康，
+// 请求仍然返回200；没有配置可用的模型时返回503
+func ReadinessHandler(c *gin.Context) {
+	modelToService := config.GetModelToService()
+	if config.GetConf() == nil || len(modelToService) == 0 {
+		c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready", "error": "config is not loaded"})
+		return
+	}
+
+	resp := gin.H{"status": "ready", "models": len(modelToService)}
+	if c.Query("probe") == "upstream" {
+		results := mycommon.ProbeServices(false)
+		for _, r := range results {
+			if r.Status == mycommon.ProbeStatusUnhealthy {
+				resp["status"] = "degraded"
+				break
+			}
+		}
+		resp["providers"] = results
+	}
+	c.IndentedJSON(http.StatusOK, resp)
+}
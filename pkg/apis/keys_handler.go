@@ -0,0 +1,90 @@
+package apis
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mykeys"
+	"simple-one-api/pkg/utils"
+	"time"
+)
+
+// checkKeysAdmin 管理虚拟key需要配置顶层api_key，并在请求中带上该key
+func checkKeysAdmin(c *gin.Context) bool {
+	if config.GetAPIKey() == "" {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "api_key must be configured to manage keys"})
+		return false
+	}
+	apikey, err := utils.GetAPIKeyFromHeader(c)
+	if err != nil || apikey != config.GetAPIKey() {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+		return false
+	}
+	if !mykeys.Enabled() {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "key management is not enabled"})
+		return false
+	}
+	return true
+}
+
+// CreateKeyHandler 创建虚拟key，响应中的key只返回这一次
+func CreateKeyHandler(c *gin.Context) {
+	if !checkKeysAdmin(c) {
+		return
+	}
+
+	var req mykeys.CreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	k, key, err := mykeys.Create(&req)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"key": key, "data": k})
+}
+
+// ListKeysHandler 返回所有虚拟key，不包含原始的key
+func ListKeysHandler(c *gin.Context) {
+	if !checkKeysAdmin(c) {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"data": mykeys.List()})
+}
+
+func GetKeyHandler(c *gin.Context) {
+	if !checkKeysAdmin(c) {
+		return
+	}
+	k, found := mykeys.Get(c.Param("id"))
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "key not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, k)
+}
+
+// RevokeKeyHandler 吊销虚拟key，立即生效
+func RevokeKeyHandler(c *gin.Context) {
+	if !checkKeysAdmin(c) {
+		return
+	}
+	k, err := mykeys.Revoke(c.Param("id"))
+	if errors.Is(err, mykeys.ErrKeyNotFound) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "key not found"})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, k)
+}
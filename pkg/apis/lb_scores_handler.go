@@ -0,0 +1,49 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"sort"
+)
+
+// LBScoresHandler 返回各模型服务按成本和耗时计算的得分，用于调整cost_latency的权重，可以通过model参数指定模型
+func LBScoresHandler(c *gin.Context) {
+	modelToService := config.GetModelToService()
+	if config.GetAPIKey() != "" {
+		apikey, err := utils.GetAPIKeyFromHeader(c)
+		if err != nil || apikey != config.GetAPIKey() {
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+			return
+		}
+	}
+
+	var models []string
+	if model := c.Query("model"); model != "" {
+		if _, found := modelToService[model]; !found {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"error": "Model not found"})
+			return
+		}
+		models = append(models, model)
+	} else {
+		for k := range modelToService {
+			models = append(models, k)
+		}
+		sort.Strings(models)
+	}
+
+	costWeight, latencyWeight := mycommon.GetCostLatencyWeights()
+	scores := make(map[string][]mycommon.ServiceScore, len(models))
+	for _, model := range models {
+		scores[model] = mycommon.ScoreModelServices(model)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"load_balancing": config.GetLoadBalancingStrategy(),
+		"cost_weight":    costWeight,
+		"latency_weight": latencyWeight,
+		"scores":         scores,
+	})
+}
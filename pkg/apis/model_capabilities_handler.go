@@ -0,0 +1,127 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"sort"
+)
+
+// ServiceCapabilities 模型在一个服务上的能力
+type ServiceCapabilities struct {
+	ServiceName        string              `json:"service_name"`
+	MaxContext         int                 `json:"max_context,omitempty"`
+	SupportsTools      bool                `json:"supports_tools"`
+	SupportsVision     bool                `json:"supports_vision"`
+	SupportsJSONMode   bool                `json:"supports_json_mode"`
+	SupportsJSONSchema bool                `json:"supports_json_schema"`
+	SupportsLogProbs   bool                `json:"supports_logprobs"`
+	Pricing            *config.PricingConf `json:"pricing,omitempty"`
+}
+
+// ModelCapabilities 模型的能力，同一模型配置在多个服务中时，顶层的值按所有服务中最保守的情况给出
+type ModelCapabilities struct {
+	ID                 string                `json:"id"`
+	Object             string                `json:"object"`
+	MaxContext         int                   `json:"max_context,omitempty"`
+	SupportsTools      bool                  `json:"supports_tools"`
+	SupportsVision     bool                  `json:"supports_vision"`
+	SupportsJSONMode   bool                  `json:"supports_json_mode"`
+	SupportsJSONSchema bool                  `json:"supports_json_schema"`
+	SupportsLogProbs   bool                  `json:"supports_logprobs"`
+	Services           []ServiceCapabilities `json:"services"`
+}
+
+// hasVisionModel 配置了vision_model_map时，请求中包含图片会切换到对应的视觉模型
+func hasVisionModel(model string) bool {
+	_, exists := config.GetConf().VisionModelMap[model]
+	return exists
+}
+
+func getModelCapabilities(model string) (*ModelCapabilities, bool) {
+	modelToService := config.GetModelToService()
+	var services []ServiceCapabilities
+	for i := range modelToService[model] {
+		s := &modelToService[model][i]
+		if !s.Enabled {
+			continue
+		}
+
+		upstreamModel := config.GetModelMapping(s, config.GetModelRedirect(s, model))
+		sc := ServiceCapabilities{
+			ServiceName:        s.ServiceName,
+			MaxContext:         config.GetModelMaxContext(s, upstreamModel),
+			SupportsTools:      !config.IsNoTools(s),
+			SupportsVision:     config.IsSupportMultiContent(upstreamModel) || hasVisionModel(model),
+			SupportsJSONMode:   !config.IsNoJSONMode(s),
+			SupportsJSONSchema: !config.IsNoJSONSchema(s),
+			SupportsLogProbs:   !config.IsNoLogProbs(s),
+		}
+		if s.Pricing.Input > 0 || s.Pricing.Output > 0 {
+			pricing := s.Pricing
+			sc.Pricing = &pricing
+		}
+		services = append(services, sc)
+	}
+	if len(services) == 0 {
+		return nil, false
+	}
+
+	mc := &ModelCapabilities{
+		ID:                 model,
+		Object:             "model.capabilities",
+		SupportsTools:      true,
+		SupportsVision:     true,
+		SupportsJSONMode:   true,
+		SupportsJSONSchema: true,
+		SupportsLogProbs:   true,
+		Services:           services,
+	}
+	for _, sc := range services {
+		if sc.MaxContext > 0 && (mc.MaxContext == 0 || sc.MaxContext < mc.MaxContext) {
+			mc.MaxContext = sc.MaxContext
+		}
+		mc.SupportsTools = mc.SupportsTools && sc.SupportsTools
+		mc.SupportsVision = mc.SupportsVision && sc.SupportsVision
+		mc.SupportsJSONMode = mc.SupportsJSONMode && sc.SupportsJSONMode
+		mc.SupportsJSONSchema = mc.SupportsJSONSchema && sc.SupportsJSONSchema
+		mc.SupportsLogProbs = mc.SupportsLogProbs && sc.SupportsLogProbs
+	}
+	return mc, true
+}
+
+// ModelCapabilitiesHandler 返回所有模型的能力，包括每个服务的能力和价格
+func ModelCapabilitiesHandler(c *gin.Context) {
+	supportModels := config.GetSupportModels()
+	keys := make([]string, 0, len(supportModels))
+	for k := range supportModels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var models []*ModelCapabilities
+	for _, k := range keys {
+		if mc, ok := getModelCapabilities(k); ok {
+			models = append(models, mc)
+		}
+	}
+
+	if len(models) == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "No models found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   models,
+	})
+}
+
+// RetrieveModelCapabilitiesHandler 返回指定模型的能力
+func RetrieveModelCapabilitiesHandler(c *gin.Context) {
+	mc, ok := getModelCapabilities(c.Param("model"))
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "Model not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, mc)
+}
@@ -1,72 +1,174 @@
 package apis
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/utils"
 	"sort"
+	"strings"
 	"time"
 )
 
+const modelOwnedBy = "simple-one-api"
+
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID           string                `json:"id"`
+	Object       string                `json:"object"`
+	Created      int64                 `json:"created"`
+	OwnedBy      string                `json:"owned_by"`
+	Capabilities *ModelCapabilityFlags `json:"capabilities,omitempty"`
 }
 
-func ModelsHandler(c *gin.Context) {
-	var models []Model
-	keys := make([]string, 0, len(config.ModelToService))
+// ModelCapabilityFlags 附加在/v1/models中的能力信息，OpenAI的SDK会忽略这个字段，完整的信息见/v1/model_capabilities
+type ModelCapabilityFlags struct {
+	Streaming  bool `json:"streaming"`
+	Vision     bool `json:"vision"`
+	Tools      bool `json:"tools"`
+	JSONMode   bool `json:"json_mode"`
+	MaxContext int  `json:"max_context,omitempty"`
+}
 
-	for k := range config.SupportModels {
-		keys = append(keys, k)
+// resolveListedModel 别名和模型重定向按指向的模型返回能力，schedule和targets不固定，只使用别名的model
+func resolveListedModel(id string) string {
+	soaConf := config.GetConf()
+	if _, exists := config.GetSupportModels()[id]; exists {
+		return id
 	}
-	sort.Strings(keys) // 对keys进行排序
+	if target, exists := soaConf.ModelRedirect[id]; exists {
+		return target
+	}
+	if soaConf != nil {
+		if alias, exists := soaConf.ModelAliases[id]; exists {
+			return alias.Model
+		}
+	}
+	return ""
+}
 
-	t := time.Now()
-	for _, k := range keys {
-		models = append(models, Model{
-			ID:      k,
-			Object:  "model",
-			Created: t.Unix(),
-			OwnedBy: "openai",
-		})
+func newModel(id string, created int64) Model {
+	m := Model{
+		ID:      id,
+		Object:  "model",
+		Created: created,
+		OwnedBy: modelOwnedBy,
+	}
+	// 所有服务的流式请求都由网关统一处理，random等无法确定的模型不返回能力
+	if mc, ok := getModelCapabilities(resolveListedModel(id)); ok {
+		m.Capabilities = &ModelCapabilityFlags{
+			Streaming:  true,
+			Vision:     mc.SupportsVision,
+			Tools:      mc.SupportsTools,
+			JSONMode:   mc.SupportsJSONMode,
+			MaxContext: mc.MaxContext,
+		}
+	}
+	return m
+}
+
+// hasEnabledService 模型是否至少有一个启用的服务
+func hasEnabledService(model string) bool {
+	for _, sd := range config.GetModelToService()[model] {
+		if sd.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// getTenantKeyConfig 请求带有租户的key时返回key的配置，其他情况返回nil，/v1/models不要求鉴权
+func getTenantKeyConfig(c *gin.Context) *config.APIKeyConfig {
+	apikey, _ := utils.GetAPIKeyFromHeader(c)
+	if apikey == "" {
+		return nil
+	}
+	keyConf, err := config.AuthenticateAPIKey(apikey)
+	if err != nil || keyConf == nil || keyConf.Tenant() == "" {
+		return nil
+	}
+	return keyConf
+}
+
+// listModelIDs 返回客户端可以使用的模型名称，包括服务中的模型重定向、全局的模型重定向和model_aliases中的别名，多个服务配置了同一模型时只返回一次。
+// keyConf为租户的key时还包括租户services中的模型，并且只返回key可以使用的模型
+func listModelIDs(keyConf *config.APIKeyConfig) []string {
+	soaConf := config.GetConf()
+	ids := make(map[string]struct{})
+	for k := range config.GetSupportModels() {
+		if hasEnabledService(k) {
+			ids[k] = struct{}{}
+		}
+	}
+	if keyConf != nil {
+		tenant := keyConf.Tenant()
+		for k := range config.GetTenantSupportModels()[tenant] {
+			if hasEnabledService(config.TenantModelKey(tenant, k)) {
+				ids[k] = struct{}{}
+			}
+		}
+	}
+	for k, v := range soaConf.ModelRedirect {
+		if k == config.KEYNAME_ALL {
+			continue
+		}
+		if _, exists := ids[v]; exists || hasEnabledService(v) || v == config.KEYNAME_RANDOM {
+			ids[k] = struct{}{}
+		}
+	}
+	// 模式匹配的别名没有固定的名称，不返回
+	if soaConf != nil {
+		for k := range soaConf.ModelAliases {
+			if !strings.ContainsAny(k, "*?[") {
+				ids[k] = struct{}{}
+			}
+		}
 	}
 
-	if len(models) > 0 {
-		models = append(models, Model{
-			ID:      "random",
-			Object:  "model",
-			Created: t.Unix(),
-			OwnedBy: "openai",
-		})
+	keys := make([]string, 0, len(ids))
+	for k := range ids {
+		if keyConf == nil || config.IsModelAllowed(keyConf, k) {
+			keys = append(keys, k)
+		}
 	}
+	sort.Strings(keys) // 对keys进行排序
+
+	if len(keys) > 0 {
+		keys = append(keys, config.KEYNAME_RANDOM)
+	}
+	return keys
+}
 
-	if len(models) == 0 {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "No models found"})
-		return
+func ModelsHandler(c *gin.Context) {
+	models := make([]Model, 0)
+
+	t := time.Now()
+	for _, k := range listModelIDs(getTenantKeyConfig(c)) {
+		models = append(models, newModel(k, t.Unix()))
 	}
+
 	c.IndentedJSON(http.StatusOK, gin.H{
 		"object": "list",
 		"data":   models,
 	})
 }
 
-// RetrieveModelHandler RetrieveModelHandler用于根据模型ID检索模型信息
+// RetrieveModelHandler RetrieveModelHandler用于根据模型ID检索模型信息，未知的模型按OpenAI的格式返回404
 func RetrieveModelHandler(c *gin.Context) {
-	modelID := c.Param("model") // 从路径中获取模型ID
-
-	if _, found := config.ModelToService[modelID]; found {
-		model := Model{
-			ID:      "gpt-3.5-turbo-instruct",
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "openai",
+	// 模型名称中可以包含/，例如Qwen/Qwen2-7B-Instruct
+	modelID := strings.TrimPrefix(c.Param("model"), "/")
+
+	for _, k := range listModelIDs(getTenantKeyConfig(c)) {
+		if k == modelID {
+			c.IndentedJSON(http.StatusOK, newModel(modelID, time.Now().Unix()))
+			return
 		}
-		c.IndentedJSON(http.StatusOK, model)
-		return
 	}
 
-	c.IndentedJSON(http.StatusNotFound, gin.H{"error": "Model not found"})
+	c.IndentedJSON(http.StatusNotFound, gin.H{"error": gin.H{
+		"message": fmt.Sprintf("The model '%s' does not exist", modelID),
+		"type":    "invalid_request_error",
+		"param":   "model",
+		"code":    "model_not_found",
+	}})
 }
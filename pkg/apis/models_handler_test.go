@@ -0,0 +1,148 @@
+package apis
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	mylog.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+const modelsTestConfig = `
+model_redirect:
+    gpt-4: gpt-4o
+    old-disabled: disabled-model
+model_aliases:
+    smart:
+        model: gpt-4o
+    "qwen-*":
+        model: qwen-max
+services:
+    openai:
+        - models: [gpt-4o, gpt-4o-mini]
+          enabled: true
+          credentials:
+              api_key: sk-test
+        - models: [disabled-model]
+          enabled: false
+          credentials:
+              api_key: sk-test
+    ollama:
+        - models: [llama3]
+          enabled: true
+          model_redirect:
+              local-chat: llama3
+`
+
+func loadModelsTestConfig(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(modelsTestConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.InitConfig(path); err != nil {
+		t.Fatalf("InitConfig: %v", err)
+	}
+}
+
+func serveModels(path string) *httptest.ResponseRecorder {
+	engine := gin.New()
+	engine.GET("/v1/models", ModelsHandler)
+	engine.GET("/v1/models/*model", RetrieveModelHandler)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestModelsHandler(t *testing.T) {
+	loadModelsTestConfig(t)
+
+	w := serveModels("/v1/models")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	var resp struct {
+		Object string  `json:"object"`
+		Data   []Model `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Object != "list" {
+		t.Errorf("object = %q", resp.Object)
+	}
+
+	var ids []string
+	for _, m := range resp.Data {
+		ids = append(ids, m.ID)
+		if m.Object != "model" || m.OwnedBy != modelOwnedBy || m.Created == 0 {
+			t.Errorf("model %+v", m)
+		}
+	}
+	// 排序后的模型、服务的model_redirect、全局的model_redirect和别名，最后是random；禁用的模型、指向禁用模型的重定向和模式匹配的别名不返回
+	want := []string{"gpt-4", "gpt-4o", "gpt-4o-mini", "local-chat", "smart", config.KEYNAME_RANDOM}
+	if len(ids) != len(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("ids = %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestRetrieveModelHandler(t *testing.T) {
+	loadModelsTestConfig(t)
+
+	for _, id := range []string{"gpt-4o", "smart", "local-chat"} {
+		w := serveModels("/v1/models/" + id)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", id, w.Code, w.Body.String())
+		}
+		var m Model
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != id || m.Object != "model" {
+			t.Errorf("%s: model = %+v", id, m)
+		}
+	}
+}
+
+func TestRetrieveModelHandlerNotFound(t *testing.T) {
+	loadModelsTestConfig(t)
+
+	for _, id := range []string{"unknown-model", "disabled-model", "Qwen/Qwen2-7B-Instruct"} {
+		w := serveModels("/v1/models/" + id)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s: status = %d, want 404", id, w.Code)
+		}
+		var resp struct {
+			Error struct {
+				Message string  `json:"message"`
+				Type    string  `json:"type"`
+				Param   *string `json:"param"`
+				Code    *string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		e := resp.Error
+		if e.Message != "The model '"+id+"' does not exist" || e.Type != "invalid_request_error" ||
+			e.Param == nil || *e.Param != "model" || e.Code == nil || *e.Code != "model_not_found" {
+			t.Errorf("%s: error = %s", id, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+)
+
+// RetryBudgetHandler 返回各服务当前窗口内的重试预算使用情况
+func RetryBudgetHandler(c *gin.Context) {
+	if config.GetAPIKey() != "" {
+		apikey, err := utils.GetAPIKeyFromHeader(c)
+		if err != nil || apikey != config.GetAPIKey() {
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+			return
+		}
+	}
+
+	conf := config.GetConf().RetryBudget
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"enable":   conf.Enable,
+		"services": mycommon.GetRetryBudgetStats(),
+	})
+}
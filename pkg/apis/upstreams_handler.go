@@ -0,0 +1,51 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// UpstreamsHandler 返回各上游服务的熔断、探测和凭证隔离状态，需要配置顶层api_key，带上probe=true参数时先重新探测
+func UpstreamsHandler(c *gin.Context) {
+	soaConf := config.GetConf()
+	if config.GetAPIKey() == "" {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"error": "api_key must be configured to query upstreams"})
+		return
+	}
+	apikey, err := utils.GetAPIKeyFromHeader(c)
+	if err != nil || apikey != config.GetAPIKey() {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+		return
+	}
+
+	if c.Query("probe") == "true" {
+		mycommon.ProbeServices(true)
+	}
+	upstreams := mycommon.GetUpstreamStatuses()
+	degraded := 0
+	for _, u := range upstreams {
+		if u.Status == mycommon.UpstreamStatusDegraded {
+			degraded++
+		}
+	}
+
+	cbMode := strings.ToLower(soaConf.CircuitBreaker.Mode)
+	if cbMode == "" {
+		cbMode = config.CircuitBreakerModeWeight
+	}
+	hcMode := strings.ToLower(soaConf.HealthCheck.Mode)
+	if hcMode == "" {
+		hcMode = config.HealthCheckModePing
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"circuit_breaker_mode": cbMode,
+		"health_check_mode":    hcMode,
+		"total":                len(upstreams),
+		"degraded":             degraded,
+		"upstreams":            upstreams,
+	})
+}
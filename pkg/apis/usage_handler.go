@@ -0,0 +1,59 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myusage"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultUsageGroupBy = "key,model"
+
+// UsageHandler 按key和模型返回汇总的token用量，支持start、end（YYYY-MM-DD）、key、model过滤，
+// group_by可选date、key、model，records=N时同时返回最近N条明细
+func UsageHandler(c *gin.Context) {
+	if config.GetAPIKey() != "" {
+		apikey, err := utils.GetAPIKeyFromHeader(c)
+		if err != nil || apikey != config.GetAPIKey() {
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "key is not valid"})
+			return
+		}
+	}
+
+	if !myusage.Enabled() {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "usage is not enabled"})
+		return
+	}
+
+	q := &myusage.Query{
+		Start:   c.Query("start"),
+		End:     c.Query("end"),
+		KeyName: c.Query("key"),
+		Model:   c.Query("model"),
+		GroupBy: strings.Split(c.DefaultQuery("group_by", defaultUsageGroupBy), ","),
+	}
+	for _, date := range []string{q.Start, q.End} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid date '" + date + "', expected YYYY-MM-DD"})
+			return
+		}
+	}
+
+	resp := gin.H{"data": myusage.GetSummaries(q)}
+	if len(config.GetConf().Pricing.Models) > 0 {
+		resp["currency"] = config.GetPricingCurrency()
+	}
+	if v := c.Query("records"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid records '" + v + "'"})
+			return
+		}
+		resp["records"] = myusage.GetRecentRecords(q, limit)
+	}
+	c.IndentedJSON(http.StatusOK, resp)
+}
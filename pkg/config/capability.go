@@ -0,0 +1,109 @@
+package config
+
+// Capabilities 描述后端服务对OpenAI协议特性的支持情况，未配置的字段使用服务的默认能力
+type Capabilities struct {
+	NoSystemRole         *bool `json:"no_system_role,omitempty" yaml:"no_system_role,omitempty"`
+	AlternatingRoles     *bool `json:"alternating_roles,omitempty" yaml:"alternating_roles,omitempty"`
+	NoToolChoiceRequired *bool `json:"no_tool_choice_required,omitempty" yaml:"no_tool_choice_required,omitempty"`
+	NoJSONMode           *bool `json:"no_json_mode,omitempty" yaml:"no_json_mode,omitempty"`
+	NoTools              *bool `json:"no_tools,omitempty" yaml:"no_tools,omitempty"`
+	NoJSONSchema         *bool `json:"no_json_schema,omitempty" yaml:"no_json_schema,omitempty"`
+	NoLogProbs           *bool `json:"no_logprobs,omitempty" yaml:"no_logprobs,omitempty"`
+	NoMultipleChoices    *bool `json:"no_multiple_choices,omitempty" yaml:"no_multiple_choices,omitempty"`
+}
+
+// SystemPromptConf 不支持system角色时，system消息合并到首条user消息的方式。
+// MaxChars为服务对system消息的长度限制，超出的部分按Overflow移到首条user消息或直接截断
+type SystemPromptConf struct {
+	Separator string `json:"separator" yaml:"separator"`
+	Template  string `json:"template" yaml:"template"`
+	MaxChars  int    `json:"max_chars" yaml:"max_chars"`
+	Overflow  string `json:"overflow" yaml:"overflow"`
+}
+
+var DefaultSystemPromptSeparator = "\n"
+
+var SystemPromptOverflowUser = "user"
+var SystemPromptOverflowTruncate = "truncate"
+
+// DefaultServiceCapabilities 各服务默认的能力描述
+var DefaultServiceCapabilities = map[string]Capabilities{
+	"cozecn":       {NoSystemRole: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"cozecom":      {NoSystemRole: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"coze":         {NoSystemRole: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"agentbuilder": {NoSystemRole: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"qianfan":      {AlternatingRoles: boolPtr(true), NoToolChoiceRequired: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"claude":       {AlternatingRoles: boolPtr(true), NoJSONMode: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"bedrock":      {AlternatingRoles: boolPtr(true), NoJSONMode: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"gemini":       {AlternatingRoles: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true)},
+	"vertexai":     {AlternatingRoles: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true)},
+	"perplexity":   {AlternatingRoles: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"zhipu":        {NoToolChoiceRequired: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"ollama":       {NoToolChoiceRequired: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"hunyuan":      {NoToolChoiceRequired: boolPtr(true), NoJSONMode: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"xinghuo":      {NoToolChoiceRequired: boolPtr(true), NoJSONMode: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"huoshan":      {NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"dashscope":    {NoToolChoiceRequired: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"bailian":      {NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"minimax":      {NoToolChoiceRequired: boolPtr(true), NoJSONMode: boolPtr(true), NoTools: boolPtr(true), NoJSONSchema: boolPtr(true), NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"deepseek":     {NoJSONSchema: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"groq":         {NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+	"mock":         {NoLogProbs: boolPtr(true), NoMultipleChoices: boolPtr(true)},
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// getCapabilityFlag 优先使用服务配置中的能力，其次使用服务默认能力
+func getCapabilityFlag(s *ModelDetails, get func(Capabilities) *bool) bool {
+	if v := get(s.Capabilities); v != nil {
+		return *v
+	}
+	if dc, exists := DefaultServiceCapabilities[s.ServiceName]; exists {
+		if v := get(dc); v != nil {
+			return *v
+		}
+	}
+	return false
+}
+
+// IsNoSystemRole 判断服务是否不支持system角色
+func IsNoSystemRole(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoSystemRole })
+}
+
+// IsAlternatingRoles 判断服务是否要求user和assistant角色严格交替
+func IsAlternatingRoles(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.AlternatingRoles })
+}
+
+// IsNoToolChoiceRequired 判断服务是否不支持 tool_choice: "required"
+func IsNoToolChoiceRequired(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoToolChoiceRequired })
+}
+
+// IsNoJSONSchema 判断服务是否不支持 response_format: json_schema
+func IsNoJSONSchema(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoJSONSchema })
+}
+
+// IsNoJSONMode 判断服务是否不支持 response_format: json_object
+func IsNoJSONMode(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoJSONMode })
+}
+
+// IsNoTools 判断服务是否不支持tools
+func IsNoTools(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoTools })
+}
+
+// IsNoLogProbs 判断服务是否不支持logprobs和top_logprobs
+func IsNoLogProbs(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoLogProbs })
+}
+
+// IsNoMultipleChoices 判断服务是否不支持n大于1，每次只返回一个回答
+func IsNoMultipleChoices(s *ModelDetails) bool {
+	return getCapabilityFlag(s, func(c Capabilities) *bool { return c.NoMultipleChoices })
+}
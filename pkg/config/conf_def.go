@@ -2,7 +2,175 @@ package config
 
 var ServiceTimeOut int = 30
 
+var DefaultMaxTimeout int = 600
+
+var DefaultCredentialQuarantine int = 60
+
+var DefaultAssistantHistoryKeepRecent int = 1
+
+var DefaultStaleOnErrorMaxAge int = 86400
+var DefaultStaleOnErrorMaxEntries int = 1000
+
+var DefaultConversationIDTemplate = "Conversation ID: {conversation_id}"
+
+var DefaultConversationUsageTTL int = 86400
+var DefaultConversationUsageMaxEntries int = 100000
+
+var ImageFormatJPEG = "jpeg"
+var ImageFormatPNG = "png"
+
+var DefaultImageQuality int = 85
+var DefaultImageMaxPixels int = 40000000
+var DefaultImageMaxBytes int = 20 << 20
+
+var DefaultCostWeight float64 = 0.5
+var DefaultLatencyWeight float64 = 0.5
+
+var DefaultSessionAffinityTTL int = 1800
+var DefaultSessionAffinityMaxEntries int = 10000
+
+var DefaultGRPCListenAddr = ":9091"
+
+var DefaultChatWSPingInterval int = 30
+var DefaultChatWSMaxMessageSize int64 = 32 << 20
+var DefaultChatWSMaxConcurrency int = 4
+
+var DefaultShutdownDrainTimeout int = 30
+
+var ContextCheckOnExceedError = "error"
+var ContextCheckOnExceedTruncate = "truncate"
+var DefaultContextCheckKeepRecent int = 1
+
+var DefaultMockChunkSize int = 4
+var DefaultMockErrorStatus int = 500
+var DefaultMockErrorMessage = "mock error"
+
+var DefaultMultipleChoicesMaxN int = 8
+var DefaultMultipleChoicesConcurrency int = 4
+var DefaultEmbeddingBatchConcurrency int = 4
+
+var DefaultHTTPConnectTimeout int = 30
+var DefaultHTTPIdleConnTimeout int = 90
+var DefaultHTTPMaxIdleConns int = 256
+var DefaultHTTPMaxIdleConnsPerHost int = 64
+var DefaultHTTP2PingTimeout int = 15
+var DefaultTLSSessionCacheSize int = 128
+
+var DefaultDashboardPath = "/dashboard"
+
+var DefaultBatchDir = "data/batches"
+var DefaultBatchConcurrency int = 4
+var DefaultBatchMaxFileSize int = 100
+var DefaultBatchMaxRequests int = 50000
+
+var DefaultAzureAuthorityHost = "https://login.microsoftonline.com"
+var DefaultAzureScope = "https://cognitiveservices.azure.com/.default"
+
+var DefaultRetryBudgetRatio float64 = 0.1
+var DefaultRetryBudgetWindow int = 60
+var DefaultRetryBudgetMinRetries int = 3
+
+var DefaultStreamIdleLoadThreshold int = 10
+var DefaultStreamIdleLoadFactor float64 = 0.1
+var DefaultStreamIdleMaxTimeoutFactor int = 4
+
+var DefaultFailoverMaxRetries int = 2
+var DefaultFailoverBackoff int = 500
+var DefaultFailoverMaxBackoff int = 5000
+var DefaultFailoverStatusCodes = []int{429, 500, 502, 503}
+
+var DefaultServiceWeight int = 1
+
+var DefaultCircuitBreakerFailureThreshold int = 3
+var DefaultCircuitBreakerCooldown int = 30
+var DefaultCircuitBreakerWeightFactor float64 = 0.1
+var CircuitBreakerModeWeight = "weight"
+var CircuitBreakerModeOpen = "open"
+
+var DefaultHealthCheckCacheTTL int = 30
+var DefaultHealthCheckTimeout int = 5
+var HealthCheckModePing = "ping"
+var HealthCheckModeCompletion = "completion"
+
+var DefaultUsageMaxRecords int = 1000
+var DefaultUsageRetentionDays int = 31
+var DefaultUsageExportTable = "usage_records"
+var DefaultUsageExportBatchSize int = 100
+var DefaultUsageExportFlushInterval int = 5
+var DefaultUsageExportQueueSize int = 1024
+
+var DefaultConfigReloadInterval int = 10
+
+var DefaultKeyManagementPath = "data/keys.json"
+
+var DefaultAuditPath = "data/audit.jsonl"
+var DefaultAuditTable = "audit_logs"
+var DefaultAuditQueueSize int = 1024
+var DefaultAuditPageSize int = 20
+var DefaultAuditMaxPageSize int = 200
+
+var DefaultModerationStreamWindow int = 100
+var DefaultModerationMask = "***"
+var DefaultModerationTimeout int = 10
+var DefaultOpenAIModerationURL = "https://api.openai.com/v1/moderations"
+var DefaultOpenAIModerationModel = "omni-moderation-latest"
+
+var ModerationActionBlock = "block"
+var ModerationActionMask = "mask"
+
+var DefaultResponseCacheTTL int = 3600
+var DefaultResponseCacheMaxEntries int = 1000
+var DefaultResponseCacheRedisKeyPrefix = "soa:cache:"
+var DefaultSharedStateRedisKeyPrefix = "soa:state:"
+
+var DefaultReasoningModelPatterns = []string{"o1*", "o3*"}
+
+var DefaultLogPrivacyMaxChars int = 200
+
+var ParamCompatDrop = "drop"
+var ParamCompatTopP = "top_p"
+
 var PROXY_STRATEGY_FORCEALL = "force_all"
 var PROXY_STRATEGY_ALL = "all"
 var PROXY_STRATEGY_DEFAULT = "default"
 var PROXY_STRATEGY_DISABLED = "disabled"
+
+var AttemptLogOff = "off"
+var AttemptLogFailover = "failover"
+var AttemptLogAll = "all"
+
+var CitationsFormatFootnote = "footnote"
+var CitationsFormatField = "field"
+var CitationsFormatBoth = "both"
+var CitationsFormatRaw = "raw"
+
+var DefaultCitationsHeader = "\n\n参考来源：\n"
+var DefaultCitationsTemplate = "[{index}] {title} {url}"
+
+var ToolChoiceRequiredModeInstruct = "instruct"
+var ToolChoiceRequiredModeError = "error"
+
+var GuardrailsOnExceedClamp = "clamp"
+var GuardrailsOnExceedError = "error"
+
+var ParamConstraintsOnExceedClamp = "clamp"
+var ParamConstraintsOnExceedError = "error"
+
+var PromptTruncationDropOldest = "drop_oldest"
+var PromptTruncationSummarize = "summarize"
+var DefaultPromptKeepRecent int = 1
+var DefaultPromptSummaryMaxTokens int = 512
+var DefaultPromptSummaryPrompt = "请用简洁的语言总结以下对话的要点，保留其中的事实、结论和未完成的事项，只输出摘要：\n\n%s"
+var DefaultPromptSummaryPrefix = "以下是之前对话的摘要：\n"
+
+var DefaultStreamPacingInterval int = 50
+var DefaultStreamPacingMaxLag int = 1000
+
+var DefaultStreamTranscriptMaxChars int = 2000
+
+var DefaultStreamWriteTimeout int = 30
+
+var DefaultTracingServiceName = "simple-one-api"
+var DefaultTracingSampleRatio float64 = 1
+
+var DefaultPricingCurrency = "USD"
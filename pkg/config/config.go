@@ -9,27 +9,22 @@ import (
 	"gopkg.in/yaml.v3"
 	"log"
 	"os"
+	"path"
 	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 	"sort"
 	"strings"
+	"time"
 )
 
-var GSOAConf *Configuration
+// 服务、模型和key等可以热加载的配置通过GetConf等函数读取，见configSnapshot
 
-var ModelToService map[string][]ModelDetails
-var LoadBalancingStrategy string
 var ServerPort string
-var APIKey string
 var Debug bool
 var LogLevel string
-var SupportModels map[string]string
-var GlobalModelRedirect map[string]string
-var SupportMultiContentModels = []string{"gpt-4o", "gpt-4-turbo", "glm-4v", "gemini-*", "yi-vision", "gpt-4o*"}
-var GProxyConf *ProxyConf
-var GTranslation *Translation
-
-var apiKeyMap map[string]APIKeyConfig
+var defaultMultiContentModels = []string{"gpt-4o", "gpt-4-turbo", "glm-4v", "glm-4v*", "gemini-*", "hunyuan-vision", "yi-vision", "gpt-4o*", "grok-vision-beta", "grok-2-vision*",
+	"claude-3*", "anthropic.claude-3*", "us.anthropic.claude-3*", "eu.anthropic.claude-3*", "apac.anthropic.claude-3*",
+	"qwen-vl*", "qwen2-vl*", "qwen2.5-vl*", "llava*", "llama3.2-vision*", "minicpm-v*"}
 
 type Limit struct {
 	QPS         float64 `json:"qps" yaml:"qps"`
@@ -37,8 +32,23 @@ type Limit struct {
 	RPM         float64 `json:"rpm" yaml:"rpm"`
 	Concurrency float64 `json:"concurrency" yaml:"concurrency"`
 	Timeout     int     `json:"timeout" yaml:"timeout"`
+	Scope       string  `json:"scope" yaml:"scope"`         // 限流粒度：service(默认)、model、credential、model_credential
+	Reject      bool    `json:"reject" yaml:"reject"`       // 超过限制时直接返回429，不排队等待
+	MaxQueue    int     `json:"max_queue" yaml:"max_queue"` // 排队等待并发许可的最大请求数，超过后直接返回429，0表示不限制
 }
 
+const (
+	UnsupportedImageReject = "reject"
+	UnsupportedImageText   = "text"
+)
+
+const (
+	LimitScopeService         = "service"
+	LimitScopeModel           = "model"
+	LimitScopeCredential      = "credential"
+	LimitScopeModelCredential = "model_credential"
+)
+
 type Range struct {
 	Min float64 `json:"min" yaml:"min"`
 	Max float64 `json:"max" yaml:"max"`
@@ -52,17 +62,277 @@ type ModelParams struct {
 
 // ServiceModel 定义相关结构体
 type ServiceModel struct {
-	Provider       string                   `json:"provider" yaml:"provider"`
-	Models         []string                 `json:"models" yaml:"models"`
-	Enabled        bool                     `json:"enabled" yaml:"enabled"`
-	Credentials    map[string]interface{}   `json:"credentials" yaml:"credentials"`
-	CredentialList []map[string]interface{} `json:"credential_list" yaml:"credential_list"`
-	ServerURL      string                   `json:"server_url" yaml:"server_url"`
-	ModelMap       map[string]string        `json:"model_map" yaml:"model_map"`
-	ModelRedirect  map[string]string        `json:"model_redirect" yaml:"model_redirect"`
-	Limit          Limit                    `json:"limit" yaml:"limit"`
-	UseProxy       *bool                    `json:"use_proxy,omitempty" yaml:"use_proxy,omitempty"`
-	Timeout        int                      `json:"timeout" yaml:"timeout"`
+	Provider                string                          `json:"provider" yaml:"provider"`
+	Models                  []string                        `json:"models" yaml:"models"`
+	Enabled                 bool                            `json:"enabled" yaml:"enabled"`
+	Credentials             map[string]interface{}          `json:"credentials" yaml:"credentials"`
+	CredentialList          []map[string]interface{}        `json:"credential_list" yaml:"credential_list"`
+	ServerURL               string                          `json:"server_url" yaml:"server_url"`
+	ModelMap                map[string]string               `json:"model_map" yaml:"model_map"`
+	ModelRedirect           map[string]string               `json:"model_redirect" yaml:"model_redirect"`
+	Limit                   Limit                           `json:"limit" yaml:"limit"`
+	UseProxy                *bool                           `json:"use_proxy,omitempty" yaml:"use_proxy,omitempty"`
+	Proxy                   string                          `json:"proxy" yaml:"proxy"`
+	HTTPClient              HTTPClientConf                  `json:"http_client" yaml:"http_client"`
+	Timeout                 int                             `json:"timeout" yaml:"timeout"`
+	Capabilities            Capabilities                    `json:"capabilities" yaml:"capabilities"`
+	SystemPrompt            SystemPromptConf                `json:"system_prompt" yaml:"system_prompt"`
+	DedupMessages           bool                            `json:"dedup_messages" yaml:"dedup_messages"`
+	ContextFallbackModel    string                          `json:"context_fallback_model" yaml:"context_fallback_model"`
+	CredentialLoadBalancing string                          `json:"credential_load_balancing" yaml:"credential_load_balancing"`
+	CredentialFailover      bool                            `json:"credential_failover" yaml:"credential_failover"`
+	ForceLanguage           ForceLanguageConf               `json:"force_language" yaml:"force_language"`
+	MaxPromptChars          int                             `json:"max_prompt_chars" yaml:"max_prompt_chars"`
+	Citations               CitationsConf                   `json:"citations" yaml:"citations"`
+	AssistantHistory        AssistantHistoryConf            `json:"assistant_history" yaml:"assistant_history"`
+	StaleOnError            StaleOnErrorConf                `json:"stale_on_error" yaml:"stale_on_error"`
+	Signer                  SignerConf                      `json:"signer" yaml:"signer"`
+	OpenAIOrganization      string                          `json:"openai_organization" yaml:"openai_organization"`
+	OpenAIProject           string                          `json:"openai_project" yaml:"openai_project"`
+	Headers                 map[string]string               `json:"headers" yaml:"headers"` // 值支持${VAR}环境变量
+	ToolChoiceRequired      ToolChoiceRequiredConf          `json:"tool_choice_required" yaml:"tool_choice_required"`
+	ResponseTrim            ResponseTrimConf                `json:"response_trim" yaml:"response_trim"`
+	InjectTools             []ToolConf                      `json:"inject_tools" yaml:"inject_tools"`
+	Cost                    float64                         `json:"cost" yaml:"cost"`
+	JSONMode                JSONModeConf                    `json:"json_mode" yaml:"json_mode"`
+	UsageFactor             float64                         `json:"usage_factor" yaml:"usage_factor"`
+	ImageDownscale          ImageDownscaleConf              `json:"image_downscale" yaml:"image_downscale"`
+	ConversationID          ConversationIDConf              `json:"conversation_id" yaml:"conversation_id"`
+	MaxStreamDuration       int                             `json:"max_stream_duration" yaml:"max_stream_duration"`
+	FirstTokenTimeout       int                             `json:"first_token_timeout" yaml:"first_token_timeout"`
+	RequestTimeout          int                             `json:"request_timeout" yaml:"request_timeout"`
+	ModelTimeouts           map[string]int                  `json:"model_timeouts" yaml:"model_timeouts"` // 按模型配置的请求总时长（秒），流式和非流式请求都生效
+	StreamDecision          StreamDecisionConf              `json:"stream_decision" yaml:"stream_decision"`
+	MaxContext              int                             `json:"max_context" yaml:"max_context"`
+	ModelMaxContext         map[string]int                  `json:"model_max_context" yaml:"model_max_context"` // 按模型配置的上下文长度（token），key为发送给上游的模型名称，支持通配符
+	ContextCheck            ContextCheckConf                `json:"context_check" yaml:"context_check"`
+	Pricing                 PricingConf                     `json:"pricing" yaml:"pricing"`
+	RedactPaths             RedactPathsConf                 `json:"redact_paths" yaml:"redact_paths"`
+	StreamIdleTimeout       StreamIdleTimeoutConf           `json:"stream_idle_timeout" yaml:"stream_idle_timeout"`
+	Failover                FailoverConf                    `json:"failover" yaml:"failover"`
+	ReasoningModels         []string                        `json:"reasoning_models" yaml:"reasoning_models"`
+	Weight                  int                             `json:"weight" yaml:"weight"`
+	Guardrails              GuardrailsConf                  `json:"guardrails" yaml:"guardrails"`
+	Azure                   AzureConf                       `json:"azure" yaml:"azure"`
+	Mock                    MockConf                        `json:"mock" yaml:"mock"`
+	MultipleChoices         MultipleChoicesConf             `json:"multiple_choices" yaml:"multiple_choices"`
+	EmbeddingBatch          EmbeddingBatchConf              `json:"embedding_batch" yaml:"embedding_batch"`
+	ParamConstraints        map[string]ParamConstraintsConf `json:"param_constraints" yaml:"param_constraints"` // key为模型名称，支持通配符
+	Extra                   map[string]interface{}          `json:"extra" yaml:"extra"`                         // 各服务特有的参数，如ollama的keep_alive、num_ctx
+}
+
+// AzureConf Azure OpenAI的部署名称和api-version，deployments的key为发送给上游的模型名称（model_map之后），
+// 凭证中配置tenant_id、client_id、client_secret时使用Entra ID的token代替api-key
+type AzureConf struct {
+	APIVersion    string                     `json:"api_version" yaml:"api_version"`
+	Deployments   map[string]AzureDeployment `json:"deployments" yaml:"deployments"`
+	AuthorityHost string                     `json:"authority_host" yaml:"authority_host"`
+	Scope         string                     `json:"scope" yaml:"scope"`
+}
+
+// ContextCheckConf 请求发送给上游之前估算输入的token数，加上max_tokens超过模型的上下文长度时，OnExceed为error返回400；
+// 为truncate时从最早的消息开始删除，保留system消息和最近的KeepRecent条消息，删除后仍然超过时返回400；为空时不检查
+type ContextCheckConf struct {
+	OnExceed   string `json:"on_exceed" yaml:"on_exceed"`
+	KeepRecent int    `json:"keep_recent" yaml:"keep_recent"`
+}
+
+// MockConf mock服务不请求上游，按配置返回回答，用于测试客户端以及网关的负载均衡、重试和失败切换。
+// responses有多个时随机选择一个，为空时返回最后一条user消息；latency和token_interval的单位为毫秒
+type MockConf struct {
+	Responses     []string `json:"responses" yaml:"responses"`
+	Latency       int      `json:"latency" yaml:"latency"`               // 返回响应（流式为第一个分片）之前等待的时间
+	LatencyJitter int      `json:"latency_jitter" yaml:"latency_jitter"` // 在latency的基础上随机增加0到latency_jitter
+	TokenInterval int      `json:"token_interval" yaml:"token_interval"` // 流式响应每个分片之间的间隔
+	ChunkSize     int      `json:"chunk_size" yaml:"chunk_size"`         // 流式响应每个分片的字符数，默认为4
+	ErrorRate     float64  `json:"error_rate" yaml:"error_rate"`         // 0到1之间，按这个比例返回错误
+	ErrorStatus   int      `json:"error_status" yaml:"error_status"`     // 默认为500
+	ErrorMessage  string   `json:"error_message" yaml:"error_message"`
+}
+
+// MultipleChoicesConf 服务不支持n大于1时拆分为多个并行的请求再合并为多个choices，best_of大于n时生成best_of个回答后选出n个。
+// MaxN限制n和best_of的最大值，Concurrency为同时请求上游的数量，不超过limit.concurrency
+type MultipleChoicesConf struct {
+	MaxN        int `json:"max_n" yaml:"max_n"`
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+}
+
+// EmbeddingBatchConf embeddings的input数组超过MaxBatchSize时拆分为多个并行的请求，再按原来的顺序合并，
+// MaxBatchSize为0时使用服务类型的默认值，Concurrency为同时请求上游的数量
+type EmbeddingBatchConf struct {
+	MaxBatchSize int `json:"max_batch_size" yaml:"max_batch_size"`
+	Concurrency  int `json:"concurrency" yaml:"concurrency"`
+}
+
+// AzureDeployment api_version为空时使用服务的api_version
+type AzureDeployment struct {
+	Deployment string `json:"deployment" yaml:"deployment"`
+	APIVersion string `json:"api_version" yaml:"api_version"`
+}
+
+type ForceLanguageConf struct {
+	Language    string `json:"language" yaml:"language"`
+	Instruction string `json:"instruction" yaml:"instruction"`
+	PostCheck   bool   `json:"post_check" yaml:"post_check"`
+	MaxRetries  int    `json:"max_retries" yaml:"max_retries"`
+}
+
+type CitationsConf struct {
+	Enable   bool   `json:"enable" yaml:"enable"`
+	Format   string `json:"format" yaml:"format"`
+	Header   string `json:"header" yaml:"header"`
+	Template string `json:"template" yaml:"template"`
+}
+
+type AssistantHistoryConf struct {
+	MaxChars   int  `json:"max_chars" yaml:"max_chars"`
+	KeepRecent *int `json:"keep_recent,omitempty" yaml:"keep_recent,omitempty"`
+}
+
+type StaleOnErrorConf struct {
+	Enable bool `json:"enable" yaml:"enable"`
+	MaxAge int  `json:"max_age" yaml:"max_age"`
+}
+
+type SignerConf struct {
+	Type    string `json:"type" yaml:"type"`
+	Header  string `json:"header" yaml:"header"`
+	Prefix  string `json:"prefix" yaml:"prefix"`
+	Region  string `json:"region" yaml:"region"`
+	Service string `json:"service" yaml:"service"`
+}
+
+type ToolChoiceRequiredConf struct {
+	Mode        string `json:"mode" yaml:"mode"`
+	Instruction string `json:"instruction" yaml:"instruction"`
+	MaxRetries  int    `json:"max_retries" yaml:"max_retries"`
+}
+
+// RedactPathsConf 消息内容或工具参数为JSON时需要脱敏的路径，Upstream为true时发送给上游前也会脱敏
+type RedactPathsConf struct {
+	Paths    []string `json:"paths" yaml:"paths"`
+	Upstream bool     `json:"upstream" yaml:"upstream"`
+}
+
+// PricingConf 模型的价格，如每百万token的价格，只用于通过接口返回给客户端
+type PricingConf struct {
+	Input    float64 `json:"input" yaml:"input"`
+	Output   float64 `json:"output" yaml:"output"`
+	Currency string  `json:"currency" yaml:"currency"`
+}
+
+// StreamDecisionConf 不论客户端是否要求流式，按预计的输出长度决定请求上游的方式
+type StreamDecisionConf struct {
+	Enable              bool `json:"enable" yaml:"enable"`
+	BatchMaxTokens      int  `json:"batch_max_tokens" yaml:"batch_max_tokens"`
+	BatchMaxPromptChars int  `json:"batch_max_prompt_chars" yaml:"batch_max_prompt_chars"`
+}
+
+// StreamIdleTimeoutConf 流式响应两个分片之间的最长间隔，服务上进行中的流式请求超过LoadThreshold后，
+// 每多一个请求间隔延长LoadFactor倍，最长不超过MaxTimeout
+type StreamIdleTimeoutConf struct {
+	Timeout       int     `json:"timeout" yaml:"timeout"`
+	LoadThreshold int     `json:"load_threshold" yaml:"load_threshold"`
+	LoadFactor    float64 `json:"load_factor" yaml:"load_factor"`
+	MaxTimeout    int     `json:"max_timeout" yaml:"max_timeout"`
+}
+
+// FailoverConf 上游返回StatusCodes中的状态码或连接失败时重试的次数和退避时长（毫秒），
+// 重试次数用完后切换到同一模型的下一个服务
+type FailoverConf struct {
+	Enable      bool  `json:"enable" yaml:"enable"`
+	MaxRetries  int   `json:"max_retries" yaml:"max_retries"`
+	Backoff     int   `json:"backoff" yaml:"backoff"`
+	MaxBackoff  int   `json:"max_backoff" yaml:"max_backoff"`
+	StatusCodes []int `json:"status_codes" yaml:"status_codes"`
+}
+
+// GuardrailsConf 转发前对请求参数的限制，OnExceed为error时超出限制返回400，否则调整到限制内；
+// SystemPrompt会加在所有对话的最前面，客户端已经发送相同的内容时不重复添加，Override为true时替换客户端的system消息
+type GuardrailsConf struct {
+	DefaultMaxTokens int    `json:"default_max_tokens" yaml:"default_max_tokens"`
+	MaxTokens        int    `json:"max_tokens" yaml:"max_tokens"`
+	TemperatureRange *Range `json:"temperature_range,omitempty" yaml:"temperature_range,omitempty"`
+	SystemPrompt     string `json:"system_prompt" yaml:"system_prompt"`
+	Override         bool   `json:"override" yaml:"override"`
+	OnExceed         string `json:"on_exceed" yaml:"on_exceed"`
+}
+
+// PromptTemplateConf 按模型改写对话请求：SystemPrepend、SystemAppend加在第一条system消息的前后，没有system消息时新增一条，
+// 其中的{{name}}替换为Variables中的值或内置变量date、time、datetime、model、key_name；
+// 估算的输入token数加max_tokens超过MaxContext（默认为服务的model_max_context或max_context）时，Truncation为drop_oldest（默认）删除最早的消息，
+// 为summarize时把删除的消息总结为一段摘要加到system消息中，KeepRecent为始终保留的最近消息数
+type PromptTemplateConf struct {
+	SystemPrepend    string            `json:"system_prepend" yaml:"system_prepend"`
+	SystemAppend     string            `json:"system_append" yaml:"system_append"`
+	Variables        map[string]string `json:"variables" yaml:"variables"`
+	MaxContext       int               `json:"max_context" yaml:"max_context"`
+	Truncation       string            `json:"truncation" yaml:"truncation"`
+	KeepRecent       int               `json:"keep_recent" yaml:"keep_recent"`
+	SummaryModel     string            `json:"summary_model" yaml:"summary_model"`
+	SummaryPrompt    string            `json:"summary_prompt" yaml:"summary_prompt"`
+	SummaryMaxTokens int               `json:"summary_max_tokens" yaml:"summary_max_tokens"`
+}
+
+// StreamPacingConf 按模型平滑流式输出，上游返回的内容先放入队列，每隔Interval毫秒输出一个分片，
+// 每次输出的字数按队列长度计算，保证队列中的内容在MaxLag毫秒内输出完，连续的小分片会合并
+type StreamPacingConf struct {
+	Interval int `json:"interval" yaml:"interval"`
+	MaxLag   int `json:"max_lag" yaml:"max_lag"`
+}
+
+// ParamConstraintsConf 按模型限制采样参数，没有传入的参数使用default，超出min、max时OnExceed为error返回400，否则调整到范围内；
+// MaxContext为估算的输入token数加max_tokens的上限
+type ParamConstraintsConf struct {
+	Temperature      *ParamConstraint `json:"temperature,omitempty" yaml:"temperature,omitempty"`
+	TopP             *ParamConstraint `json:"top_p,omitempty" yaml:"top_p,omitempty"`
+	PresencePenalty  *ParamConstraint `json:"presence_penalty,omitempty" yaml:"presence_penalty,omitempty"`
+	FrequencyPenalty *ParamConstraint `json:"frequency_penalty,omitempty" yaml:"frequency_penalty,omitempty"`
+	MaxTokens        *ParamConstraint `json:"max_tokens,omitempty" yaml:"max_tokens,omitempty"`
+	MaxContext       int              `json:"max_context" yaml:"max_context"`
+	OnExceed         string           `json:"on_exceed" yaml:"on_exceed"`
+}
+
+// ParamConstraint 没有配置的min、max不限制
+type ParamConstraint struct {
+	Min     *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+	Default *float64 `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+type ConversationIDConf struct {
+	Enable   bool   `json:"enable" yaml:"enable"`
+	Template string `json:"template" yaml:"template"`
+}
+
+type ImageDownscaleConf struct {
+	MaxDimension int    `json:"max_dimension" yaml:"max_dimension"`
+	Format       string `json:"format" yaml:"format"`
+	Quality      int    `json:"quality" yaml:"quality"`
+	MaxPixels    int    `json:"max_pixels" yaml:"max_pixels"`
+	MaxBytes     int    `json:"max_bytes" yaml:"max_bytes"`
+}
+
+type JSONModeConf struct {
+	Instruction string `json:"instruction" yaml:"instruction"`
+	Validate    bool   `json:"validate" yaml:"validate"`
+}
+
+type ToolConf struct {
+	Type     string           `json:"type" yaml:"type"`
+	Function ToolFunctionConf `json:"function" yaml:"function"`
+}
+
+type ToolFunctionConf struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description" yaml:"description"`
+	Parameters  map[string]interface{} `json:"parameters" yaml:"parameters"`
+}
+
+type ResponseTrimConf struct {
+	Whitespace bool     `json:"whitespace" yaml:"whitespace"`
+	Leading    []string `json:"leading" yaml:"leading"`
+	Trailing   []string `json:"trailing" yaml:"trailing"`
 }
 
 type ProxyConf struct {
@@ -74,6 +344,24 @@ type ProxyConf struct {
 	Timeout     int    `json:"timeout" yaml:"timeout"`
 }
 
+// HTTPClientConf 请求上游的连接超时、等待响应头超时和空闲连接保持时长（秒），不限制流式响应的总时长；
+// CACert为PEM格式的CA证书文件路径或证书内容，用于校验使用私有CA签发证书的上游或代理。
+// 相同配置的服务共用一个连接池，其他字段用于调整连接池的大小、HTTP/2、TLS会话复用和DNS缓存
+type HTTPClientConf struct {
+	ConnectTimeout        int    `json:"connect_timeout" yaml:"connect_timeout"`
+	ResponseHeaderTimeout int    `json:"response_header_timeout" yaml:"response_header_timeout"`
+	IdleConnTimeout       int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+	CACert                string `json:"ca_cert" yaml:"ca_cert"`
+	InsecureSkipVerify    bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	MaxIdleConns          int    `json:"max_idle_conns" yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int    `json:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int    `json:"max_conns_per_host" yaml:"max_conns_per_host"` // 0为不限制
+	DisableHTTP2          bool   `json:"disable_http2" yaml:"disable_http2"`
+	HTTP2ReadIdleTimeout  int    `json:"http2_read_idle_timeout" yaml:"http2_read_idle_timeout"` // HTTP/2连接空闲多久后发送ping检查连接，0为不检查
+	TLSSessionCacheSize   int    `json:"tls_session_cache_size" yaml:"tls_session_cache_size"`   // 小于0时不复用TLS会话
+	DNSCacheTTL           int    `json:"dns_cache_ttl" yaml:"dns_cache_ttl"`                     // 域名解析结果的缓存时长，0为不缓存
+}
+
 type Translation struct {
 	Enable         bool   `json:"enable" yaml:"enable"`
 	PromptTemplate string `json:"promptTemplate" yaml:"prompt_template"`
@@ -81,25 +369,363 @@ type Translation struct {
 	Concurrency    int    `json:"concurrency" yaml:"concurrency"`
 }
 
+type PublisherConf struct {
+	Enable           bool                   `json:"enable" yaml:"enable"`
+	Type             string                 `json:"type" yaml:"type"`
+	Address          string                 `json:"address" yaml:"address"`
+	Topic            string                 `json:"topic" yaml:"topic"`
+	QueueSize        int                    `json:"queue_size" yaml:"queue_size"`
+	IncludeContent   bool                   `json:"include_content" yaml:"include_content"`
+	MaxContentLength int                    `json:"max_content_length" yaml:"max_content_length"`
+	Options          map[string]interface{} `json:"options" yaml:"options"`
+}
+
+type BackendPreferenceConf struct {
+	Enable  bool     `json:"enable" yaml:"enable"`
+	APIKeys []string `json:"api_keys" yaml:"api_keys"`
+}
+
+type PromptLogSamplingConf struct {
+	Enable bool               `json:"enable" yaml:"enable"`
+	Rate   float64            `json:"rate" yaml:"rate"`
+	Models map[string]float64 `json:"models" yaml:"models"`
+}
+
+// MetricsConf Prometheus指标，listen_addr为空时在服务端口上提供/metrics
+type MetricsConf struct {
+	Enable     bool   `json:"enable" yaml:"enable"`
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr"`
+}
+
+// LogPrivacyConf 日志中消息内容的记录方式：full（默认）、truncated、metadata
+type LogPrivacyConf struct {
+	Level    string `json:"level" yaml:"level"`
+	MaxChars int    `json:"max_chars" yaml:"max_chars"`
+}
+
+type ConversationUsageConf struct {
+	Enable     bool `json:"enable" yaml:"enable"`
+	TTL        int  `json:"ttl" yaml:"ttl"`
+	MaxEntries int  `json:"max_entries" yaml:"max_entries"`
+}
+
+// SessionAffinityConf 同一会话的请求固定使用同一服务和凭证，以利用上游的提示词缓存。会话ID来自Header（默认为X-Conversation-ID），
+// UseUser为true时没有Header的请求使用请求中的user字段；TTL为最后一次请求后保持的时间（秒），服务或凭证不可用时重新选择
+type SessionAffinityConf struct {
+	Enable     bool   `json:"enable" yaml:"enable"`
+	Header     string `json:"header" yaml:"header"`
+	UseUser    bool   `json:"use_user" yaml:"use_user"`
+	TTL        int    `json:"ttl" yaml:"ttl"`
+	MaxEntries int    `json:"max_entries" yaml:"max_entries"`
+}
+
+// GRPCConf gRPC对话接口，与HTTP接口共用鉴权、限流和模型适配，listen_addr默认为:9091
+type GRPCConf struct {
+	Enable     bool   `json:"enable" yaml:"enable"`
+	ListenAddr string `json:"listen_addr" yaml:"listen_addr"`
+}
+
+// ChatWSConf WebSocket对话接口/v1/chat/ws，每个请求与HTTP接口共用鉴权、限流和模型适配。
+// ping_interval为发送ping的间隔（秒），max_message_size为客户端一条消息的最大字节数，max_concurrency为一个连接同时进行的请求数
+type ChatWSConf struct {
+	Enable         bool  `json:"enable" yaml:"enable"`
+	PingInterval   int   `json:"ping_interval" yaml:"ping_interval"`
+	MaxMessageSize int64 `json:"max_message_size" yaml:"max_message_size"`
+	MaxConcurrency int   `json:"max_concurrency" yaml:"max_concurrency"`
+}
+
+// ShutdownConf 收到SIGTERM或SIGINT后不再接受新的请求，等待进行中的请求（包括流式响应）结束，
+// 最多等待drain_timeout秒，超时后断开剩余的连接，默认为30
+type ShutdownConf struct {
+	DrainTimeout int `json:"drain_timeout" yaml:"drain_timeout"`
+}
+
+// DashboardConf 管理控制台，页面在path下，管理接口需要顶层api_key，path默认为/dashboard
+type DashboardConf struct {
+	Enable bool   `json:"enable" yaml:"enable"`
+	Path   string `json:"path" yaml:"path"`
+}
+
+// BatchConf Batch API，上传的文件和任务状态保存在Dir下，任务按创建顺序依次执行，每个任务同时发送Concurrency个请求，
+// MaxFileSize为上传文件的大小限制，单位MB
+type BatchConf struct {
+	Enable      bool   `json:"enable" yaml:"enable"`
+	Dir         string `json:"dir" yaml:"dir"`
+	Concurrency int    `json:"concurrency" yaml:"concurrency"`
+	MaxFileSize int    `json:"max_file_size" yaml:"max_file_size"`
+}
+
+// RetryBudgetConf 时间窗口内每个服务的重试数不超过请求数的Ratio，MinRetries为窗口内始终允许的重试数
+type RetryBudgetConf struct {
+	Enable     bool    `json:"enable" yaml:"enable"`
+	Ratio      float64 `json:"ratio" yaml:"ratio"`
+	Window     int     `json:"window" yaml:"window"`
+	MinRetries int     `json:"min_retries" yaml:"min_retries"`
+}
+
+type CostLatencyConf struct {
+	CostWeight    float64 `json:"cost_weight" yaml:"cost_weight"`
+	LatencyWeight float64 `json:"latency_weight" yaml:"latency_weight"`
+}
+
+// CircuitBreakerConf 服务连续失败FailureThreshold次后熔断Cooldown秒，Mode为weight（默认）时权重乘以WeightFactor，
+// 为open时不再选择该服务；冷却结束后进入半开状态，再次失败立即重新熔断
+type CircuitBreakerConf struct {
+	FailureThreshold int     `json:"failure_threshold" yaml:"failure_threshold"`
+	Cooldown         int     `json:"cooldown" yaml:"cooldown"`
+	WeightFactor     float64 `json:"weight_factor" yaml:"weight_factor"`
+	Mode             string  `json:"mode" yaml:"mode"`
+}
+
+// HealthCheckConf 探测上游服务的配置，单位为秒。Interval大于0时后台定时探测，否则只在请求/health/ready?probe=upstream时探测，
+// 探测结果在CacheTTL内复用；Mode为ping（默认）时只检查连通性，为completion时向每个服务发送一个max_tokens为1的对话请求
+type HealthCheckConf struct {
+	Interval int    `json:"interval" yaml:"interval"`
+	CacheTTL int    `json:"cache_ttl" yaml:"cache_ttl"`
+	Timeout  int    `json:"timeout" yaml:"timeout"`
+	Mode     string `json:"mode" yaml:"mode"`
+}
+
+// UsageConf 按key统计用量，内存中保留RetentionDays天的按天汇总和最近MaxRecords条明细
+type UsageConf struct {
+	Enable        bool            `json:"enable" yaml:"enable"`
+	MaxRecords    int             `json:"max_records" yaml:"max_records"`
+	RetentionDays int             `json:"retention_days" yaml:"retention_days"`
+	Export        UsageExportConf `json:"export" yaml:"export"`
+}
+
+// UsageExportConf 用量明细导出到数据库，Type为sqlite或mysql，Driver为database/sql的驱动名，FlushInterval单位为秒
+type UsageExportConf struct {
+	Enable        bool   `json:"enable" yaml:"enable"`
+	Type          string `json:"type" yaml:"type"`
+	Driver        string `json:"driver" yaml:"driver"`
+	DSN           string `json:"dsn" yaml:"dsn"`
+	Table         string `json:"table" yaml:"table"`
+	BatchSize     int    `json:"batch_size" yaml:"batch_size"`
+	FlushInterval int    `json:"flush_interval" yaml:"flush_interval"`
+	QueueSize     int    `json:"queue_size" yaml:"queue_size"`
+}
+
+// KeyManagementConf 通过管理接口创建的虚拟key，Store为file（默认）、sqlite或mysql，
+// file保存到Path，sqlite和mysql使用Driver和DSN连接数据库
+type KeyManagementConf struct {
+	Enable bool   `json:"enable" yaml:"enable"`
+	Store  string `json:"store" yaml:"store"`
+	Path   string `json:"path" yaml:"path"`
+	Driver string `json:"driver" yaml:"driver"`
+	DSN    string `json:"dsn" yaml:"dsn"`
+}
+
+// AuditConf 审计日志，Store为file（默认）、sqlite、mysql或postgres，file按行追加写入Path，
+// 其他使用Driver和DSN连接数据库；IncludeContent为true时保存脱敏后的完整请求和响应，RedactPatterns中的正则匹配的内容替换为[REDACTED]
+type AuditConf struct {
+	Enable           bool     `json:"enable" yaml:"enable"`
+	Store            string   `json:"store" yaml:"store"`
+	Path             string   `json:"path" yaml:"path"`
+	Driver           string   `json:"driver" yaml:"driver"`
+	DSN              string   `json:"dsn" yaml:"dsn"`
+	Table            string   `json:"table" yaml:"table"`
+	IncludeContent   bool     `json:"include_content" yaml:"include_content"`
+	MaxContentLength int      `json:"max_content_length" yaml:"max_content_length"`
+	RedactPatterns   []string `json:"redact_patterns" yaml:"redact_patterns"`
+	QueueSize        int      `json:"queue_size" yaml:"queue_size"`
+}
+
+// StreamTranscriptConf 流式请求在服务端拼接完整的回答，审计、用量、费用等记录使用拼接的结果，不再保存原始分片；
+// Log为true时请求结束后输出拼接的回答，MaxChars为日志中content的最大字符数；Moderate为true时流式回答结束后审核完整的内容，只记录违规
+type StreamTranscriptConf struct {
+	Enable   bool `json:"enable" yaml:"enable"`
+	Log      bool `json:"log" yaml:"log"`
+	MaxChars int  `json:"max_chars" yaml:"max_chars"`
+	Moderate bool `json:"moderate" yaml:"moderate"`
+}
+
+// SizeLimitsConf 请求和响应的大小限制，避免单个客户端占用过多的内存。MaxRequestBody和MaxOutputTokens为0时不限制，
+// Models按客户端请求的模型名称单独设置，支持通配符，请求体在解析出模型之前已经按全局的MaxRequestBody读取，模型的值不能超过全局的值；StreamBuffer大于0时流式响应先写入缓冲区，
+// 缓冲区满时等待客户端读取，超过StreamWriteTimeout秒仍然写不进去时断开连接
+type SizeLimitsConf struct {
+	MaxRequestBody     int64                          `json:"max_request_body" yaml:"max_request_body"`
+	MaxOutputTokens    int                            `json:"max_output_tokens" yaml:"max_output_tokens"`
+	StreamBuffer       int                            `json:"stream_buffer" yaml:"stream_buffer"`
+	StreamWriteTimeout int                            `json:"stream_write_timeout" yaml:"stream_write_timeout"`
+	Models             map[string]ModelSizeLimitsConf `json:"models" yaml:"models"`
+}
+
+// ModelSizeLimitsConf 模型的请求体字节数和max_tokens上限，为0时使用size_limits中的全局配置
+type ModelSizeLimitsConf struct {
+	MaxRequestBody  int64 `json:"max_request_body" yaml:"max_request_body"`
+	MaxOutputTokens int   `json:"max_output_tokens" yaml:"max_output_tokens"`
+}
+
+// ModerationConf 内容审核，Input审核请求中最新的user消息，Output审核回答，按providers的顺序执行；
+// 命中action为block的过滤器时拒绝请求或中止回答，为mask时替换命中的内容。Models为空时审核所有模型，支持通配符，
+// 流式回答按句子或者StreamWindow个字符分段审核；FailClosed为true时审核服务出错按命中处理
+type ModerationConf struct {
+	Enable       bool                     `json:"enable" yaml:"enable"`
+	Input        bool                     `json:"input" yaml:"input"`
+	Output       bool                     `json:"output" yaml:"output"`
+	Models       []string                 `json:"models" yaml:"models"`
+	Providers    []ModerationProviderConf `json:"providers" yaml:"providers"`
+	BlockMessage string                   `json:"block_message" yaml:"block_message"`
+	StreamWindow int                      `json:"stream_window" yaml:"stream_window"`
+	FailClosed   bool                     `json:"fail_closed" yaml:"fail_closed"`
+}
+
+// ModerationProviderConf 一个审核过滤器，Type为keyword、regex、openai、webhook或者通过mymoderation.Register注册的类型，
+// Name用于记录违规，默认为Type；Action为block（默认）或mask，Mask为替换的内容，默认为***
+type ModerationProviderConf struct {
+	Name       string            `json:"name" yaml:"name"`
+	Type       string            `json:"type" yaml:"type"`
+	Action     string            `json:"action" yaml:"action"`
+	Mask       string            `json:"mask" yaml:"mask"`
+	Keywords   []string          `json:"keywords" yaml:"keywords"`
+	Patterns   []string          `json:"patterns" yaml:"patterns"`
+	IgnoreCase bool              `json:"ignore_case" yaml:"ignore_case"`
+	ServerURL  string            `json:"server_url" yaml:"server_url"`
+	APIKey     string            `json:"api_key" yaml:"api_key"`
+	Model      string            `json:"model" yaml:"model"`
+	Categories []string          `json:"categories" yaml:"categories"`
+	Headers    map[string]string `json:"headers" yaml:"headers"`
+	Timeout    int               `json:"timeout" yaml:"timeout"`
+}
+
+// ResponseCacheConf 非流式请求的响应缓存，TTL单位为秒，Backend为memory或redis，默认为memory，
+// Models为空时缓存所有模型，支持通配符
+type ResponseCacheConf struct {
+	Enable     bool      `json:"enable" yaml:"enable"`
+	TTL        int       `json:"ttl" yaml:"ttl"`
+	MaxEntries int       `json:"max_entries" yaml:"max_entries"`
+	Backend    string    `json:"backend" yaml:"backend"`
+	Models     []string  `json:"models" yaml:"models"`
+	Redis      RedisConf `json:"redis" yaml:"redis"`
+}
+
+// RedisConf backend为redis时的连接配置
+type RedisConf struct {
+	Addr      string `json:"addr" yaml:"addr"`
+	Password  string `json:"password" yaml:"password"`
+	DB        int    `json:"db" yaml:"db"`
+	KeyPrefix string `json:"key_prefix" yaml:"key_prefix"`
+}
+
+// SharedStateConf 多个实例共享的状态，Backend为memory（默认）时保存在进程内，为redis时key限流和配额、服务的QPS和每分钟请求数限流、
+// 虚拟key的吊销状态和用量汇总保存在Redis中
+type SharedStateConf struct {
+	Backend string    `json:"backend" yaml:"backend"`
+	Redis   RedisConf `json:"redis" yaml:"redis"`
+}
+
+// PricingTableConf 按模型计算请求的费用，Models的key为模型名称，支持通配符，价格为0的模型为免费模型，没有配置价格的模型不计算费用；
+// 与服务中只用于返回给客户端的pricing不同
+type PricingTableConf struct {
+	Currency string                    `json:"currency" yaml:"currency"`
+	Models   map[string]ModelPriceConf `json:"models" yaml:"models"`
+}
+
+// ModelPriceConf 每1000个输入和输出token的价格
+type ModelPriceConf struct {
+	Input  float64 `json:"input" yaml:"input"`
+	Output float64 `json:"output" yaml:"output"`
+}
+
+// TracingConf OpenTelemetry链路追踪，开启后每个请求、每次请求上游和上游的HTTP请求都会生成span，通过OTLP导出，
+// Protocol为http（默认）或grpc，SampleRatio为根span的采样比例，默认为1
+type TracingConf struct {
+	Enable      bool              `json:"enable" yaml:"enable"`
+	Endpoint    string            `json:"endpoint" yaml:"endpoint"`
+	Protocol    string            `json:"protocol" yaml:"protocol"`
+	Insecure    bool              `json:"insecure" yaml:"insecure"`
+	Headers     map[string]string `json:"headers" yaml:"headers"`
+	ServiceName string            `json:"service_name" yaml:"service_name"`
+	SampleRatio float64           `json:"sample_ratio" yaml:"sample_ratio"`
+}
+
+// KeyRateLimitConf 每个客户端key的每分钟请求数、每分钟token数和每月token配额，0表示不限制
+type KeyRateLimitConf struct {
+	RPM               int   `json:"rpm" yaml:"rpm"`
+	TPM               int   `json:"tpm" yaml:"tpm"`
+	MonthlyTokenQuota int64 `json:"monthly_token_quota" yaml:"monthly_token_quota"`
+}
+
 type APIKeyConfig struct {
 	APIKey          string              `json:"api_key" yaml:"api_key"`
+	Name            string              `json:"name" yaml:"name"`
 	SupportedModels map[string][]string `json:"supported_models" yaml:"supported_models"`
+	AllowedModels   []string            `json:"allowed_models" yaml:"allowed_models"` // 支持通配符，如glm-*
+	ExpiresAt       string              `json:"expires_at" yaml:"expires_at"`         // RFC3339格式或2006-01-02
+	MaxStreams      int                 `json:"max_streams" yaml:"max_streams"`
+	// RPM、TPM和MonthlyTokenQuota没有配置时使用key_rate_limit中的默认值
+	RPM               int   `json:"rpm" yaml:"rpm"`
+	TPM               int   `json:"tpm" yaml:"tpm"`
+	MonthlyTokenQuota int64 `json:"monthly_token_quota" yaml:"monthly_token_quota"`
+	expiresAt         time.Time
+	invalidExpiry     bool
+	tenant            string
 }
 
 type Configuration struct {
-	ServerPort         string                    `json:"server_port" yaml:"server_port"`
-	Debug              bool                      `json:"debug" yaml:"debug"`
-	LogLevel           string                    `json:"log_level" yaml:"log_level"`
-	Proxy              ProxyConf                 `json:"proxy" yaml:"proxy"`
-	APIKey             string                    `json:"api_key" yaml:"api_key"`
-	LoadBalancing      string                    `json:"load_balancing" yaml:"load_balancing"`
-	MultiContentModels []string                  `json:"multi_content_models" yaml:"multi_content_models"`
-	ModelRedirect      map[string]string         `json:"model_redirect" yaml:"model_redirect"`
-	ParamsRange        map[string]ModelParams    `json:"params_range" yaml:"params_range"`
-	Services           map[string][]ServiceModel `json:"services" yaml:"services"`
-	Translation        Translation               `json:"translation" yaml:"translation"`
-	EnableWeb          bool                      `json:"enable_web" yaml:"enable_web"`
-	APIKeys            []APIKeyConfig            `json:"api_keys" yaml:"api_keys"`
+	ServerPort           string                        `json:"server_port" yaml:"server_port"`
+	Debug                bool                          `json:"debug" yaml:"debug"`
+	LogLevel             string                        `json:"log_level" yaml:"log_level"`
+	Proxy                ProxyConf                     `json:"proxy" yaml:"proxy"`
+	APIKey               string                        `json:"api_key" yaml:"api_key"`
+	LoadBalancing        string                        `json:"load_balancing" yaml:"load_balancing"`
+	MultiContentModels   []string                      `json:"multi_content_models" yaml:"multi_content_models"`
+	UnsupportedImage     string                        `json:"unsupported_image" yaml:"unsupported_image"` // 不支持图片的模型收到图片时的处理：reject(默认)、text
+	ModelRedirect        map[string]string             `json:"model_redirect" yaml:"model_redirect"`
+	ModelAliases         map[string]ModelAlias         `json:"model_aliases" yaml:"model_aliases"`
+	VisionModelMap       map[string]string             `json:"vision_model_map" yaml:"vision_model_map"`
+	ParamsRange          map[string]ModelParams        `json:"params_range" yaml:"params_range"`
+	Services             map[string][]ServiceModel     `json:"services" yaml:"services"`
+	Translation          Translation                   `json:"translation" yaml:"translation"`
+	EnableWeb            bool                          `json:"enable_web" yaml:"enable_web"`
+	APIKeys              []APIKeyConfig                `json:"api_keys" yaml:"api_keys"`
+	MaxTimeout           int                           `json:"max_timeout" yaml:"max_timeout"`
+	CredentialQuarantine int                           `json:"credential_quarantine" yaml:"credential_quarantine"`
+	AuthErrorRetry       *bool                         `json:"auth_error_retry" yaml:"auth_error_retry"`
+	Publisher            PublisherConf                 `json:"publisher" yaml:"publisher"`
+	AttemptLog           string                        `json:"attempt_log" yaml:"attempt_log"`
+	TimingHeaders        bool                          `json:"timing_headers" yaml:"timing_headers"`
+	AccessLog            bool                          `json:"access_log" yaml:"access_log"`
+	BackendPreference    BackendPreferenceConf         `json:"backend_preference" yaml:"backend_preference"`
+	MaxStreamsPerKey     int                           `json:"max_streams_per_key" yaml:"max_streams_per_key"`
+	LogBase64Images      bool                          `json:"log_base64_images" yaml:"log_base64_images"`
+	LogPrivacy           LogPrivacyConf                `json:"log_privacy" yaml:"log_privacy"`
+	Metrics              MetricsConf                   `json:"metrics" yaml:"metrics"`
+	CostLatency          CostLatencyConf               `json:"cost_latency" yaml:"cost_latency"`
+	PromptLogSampling    PromptLogSamplingConf         `json:"prompt_log_sampling" yaml:"prompt_log_sampling"`
+	SyntheticFingerprint bool                          `json:"synthetic_fingerprint" yaml:"synthetic_fingerprint"`
+	StreamUsageEstimate  bool                          `json:"stream_usage_estimate" yaml:"stream_usage_estimate"`
+	ErrorMessages        map[string]string             `json:"error_messages" yaml:"error_messages"`
+	ConversationUsage    ConversationUsageConf         `json:"conversation_usage" yaml:"conversation_usage"`
+	ParamCompat          map[string]map[string]string  `json:"param_compat" yaml:"param_compat"`
+	RetryBudget          RetryBudgetConf               `json:"retry_budget" yaml:"retry_budget"`
+	AcceptNegotiation    bool                          `json:"accept_negotiation" yaml:"accept_negotiation"`
+	ModelLoadBalancing   map[string]string             `json:"model_load_balancing" yaml:"model_load_balancing"`
+	ModelFallbacks       map[string][]string           `json:"model_fallbacks" yaml:"model_fallbacks"`
+	CircuitBreaker       CircuitBreakerConf            `json:"circuit_breaker" yaml:"circuit_breaker"`
+	ResponseCache        ResponseCacheConf             `json:"response_cache" yaml:"response_cache"`
+	HealthCheck          HealthCheckConf               `json:"health_check" yaml:"health_check"`
+	Usage                UsageConf                     `json:"usage" yaml:"usage"`
+	KeyRateLimit         KeyRateLimitConf              `json:"key_rate_limit" yaml:"key_rate_limit"`
+	ConfigReloadInterval int                           `json:"config_reload_interval" yaml:"config_reload_interval"`
+	KeyManagement        KeyManagementConf             `json:"key_management" yaml:"key_management"`
+	Audit                AuditConf                     `json:"audit" yaml:"audit"`
+	Moderation           ModerationConf                `json:"moderation" yaml:"moderation"`
+	SessionAffinity      SessionAffinityConf           `json:"session_affinity" yaml:"session_affinity"`
+	GRPC                 GRPCConf                      `json:"grpc" yaml:"grpc"`
+	Dashboard            DashboardConf                 `json:"dashboard" yaml:"dashboard"`
+	Batch                BatchConf                     `json:"batch" yaml:"batch"`
+	PromptTemplates      map[string]PromptTemplateConf `json:"prompt_templates" yaml:"prompt_templates"` // key为客户端请求的模型名称，支持通配符
+	SharedState          SharedStateConf               `json:"shared_state" yaml:"shared_state"`
+	StreamPacing         map[string]StreamPacingConf   `json:"stream_pacing" yaml:"stream_pacing"` // key为客户端请求的模型名称，支持通配符
+	StreamTranscript     StreamTranscriptConf          `json:"stream_transcript" yaml:"stream_transcript"`
+	SizeLimits           SizeLimitsConf                `json:"size_limits" yaml:"size_limits"`
+	Tracing              TracingConf                   `json:"tracing" yaml:"tracing"`
+	Pricing              PricingTableConf              `json:"pricing" yaml:"pricing"`
+	Tenants              []TenantConf                  `json:"tenants" yaml:"tenants"`
+	ChatWS               ChatWSConf                    `json:"chat_ws" yaml:"chat_ws"`
+	Shutdown             ShutdownConf                  `json:"shutdown" yaml:"shutdown"`
 }
 
 // ModelDetails 结构用于返回模型相关的服务信息
@@ -109,11 +735,64 @@ type ModelDetails struct {
 	ServiceID    string `json:"service_id" yaml:"service_id"`
 }
 
+// expandCredentialAPIKeys credentials中配置了api_keys列表时，按每个key展开为一个凭证加入credential_list，
+// credentials中的其他字段对每个key都生效。api_keys中的元素可以是key，也可以是带weight等字段的对象
+func expandCredentialAPIKeys(model *ServiceModel) {
+	keys, ok := model.Credentials[KEYNAME_API_KEYS].([]interface{})
+	if !ok || len(keys) == 0 {
+		return
+	}
+	if len(model.CredentialList) > 0 {
+		log.Printf("both credential_list and api_keys in credentials are configured, %d keys appended to credential_list\n", len(keys))
+	}
+	// 不修改配置中原来的credential_list
+	model.CredentialList = model.CredentialList[:len(model.CredentialList):len(model.CredentialList)]
+
+	for _, k := range keys {
+		creds := make(map[string]interface{}, len(model.Credentials))
+		for name, v := range model.Credentials {
+			if name != KEYNAME_API_KEYS {
+				creds[name] = v
+			}
+		}
+		switch key := k.(type) {
+		case string:
+			creds[KEYNAME_API_KEY] = key
+		case map[string]interface{}:
+			for name, v := range key {
+				creds[name] = v
+			}
+		}
+		if key, _ := creds[KEYNAME_API_KEY].(string); key == "" {
+			continue
+		}
+		model.CredentialList = append(model.CredentialList, creds)
+	}
+}
+
 // 创建模型到服务的映射
-func createModelToServiceMap(config Configuration) map[string][]ModelDetails {
+func createModelToServiceMap(config Configuration) (map[string][]ModelDetails, map[string]string, map[string]map[string]string) {
 	modelToService := make(map[string][]ModelDetails)
-	SupportModels = make(map[string]string)
-	for serviceName, serviceModels := range config.Services {
+	// 先创建新的表再替换，热加载时不会修改正在读取的表
+	supportModels := make(map[string]string)
+	addServiceModels(modelToService, supportModels, config.Services, "")
+
+	// 租户的服务使用带有租户名称的模型名称，只有租户的key才会使用
+	tenantSupportModels := make(map[string]map[string]string)
+	for _, tenant := range getValidTenants(config.Tenants) {
+		if len(tenant.Services) == 0 {
+			continue
+		}
+		tenantModels := make(map[string]string)
+		addServiceModels(modelToService, tenantModels, tenant.Services, TenantModelKey(tenant.Name, ""))
+		tenantSupportModels[tenant.Name] = tenantModels
+	}
+	return modelToService, supportModels, tenantSupportModels
+}
+
+// addServiceModels 把服务中启用的模型加入映射，keyPrefix不为空时作为模型名称的前缀
+func addServiceModels(modelToService map[string][]ModelDetails, supportModels map[string]string, services map[string][]ServiceModel, keyPrefix string) {
+	for serviceName, serviceModels := range services {
 		for _, model := range serviceModels {
 			if model.Enabled {
 				log.Printf("Models: %v, service Timeout:%v,Limit Timeout: %v, QPS: %v, QPM: %v, RPM: %v,Concurrency: %v\n",
@@ -131,6 +810,8 @@ func createModelToServiceMap(config Configuration) map[string][]ModelDetails {
 					model.Timeout = ServiceTimeOut
 				}
 
+				expandCredentialAPIKeys(&model)
+
 				for _, modelName := range model.Models {
 					detail := ModelDetails{
 						ServiceName:  serviceName,
@@ -139,28 +820,27 @@ func createModelToServiceMap(config Configuration) map[string][]ModelDetails {
 					}
 
 					//modelNameLower := strings.ToLower(modelName)
-					modelToService[modelName] = append(modelToService[modelName], detail)
+					modelToService[keyPrefix+modelName] = append(modelToService[keyPrefix+modelName], detail)
 
 					//存储支持的模型名称列表
-					SupportModels[modelName] = modelName
+					supportModels[modelName] = modelName
 					for k, v := range detail.ModelRedirect {
 						//support models
-						SupportModels[k] = v
+						supportModels[k] = v
 
-						_, exists := SupportModels[v]
+						_, exists := supportModels[v]
 						if exists {
-							delete(SupportModels, v)
+							delete(supportModels, v)
 						}
 
 						//
-						modelToService[k] = append(modelToService[k], detail)
+						modelToService[keyPrefix+k] = append(modelToService[keyPrefix+k], detail)
 						//delete(modelToService, modelName)
 					}
 				}
 			}
 		}
 	}
-	return modelToService
 }
 
 // InitConfig 初始化配置
@@ -186,6 +866,7 @@ func InitConfig(configName string) error {
 	}
 
 	log.Println("config name:", configAbsolutePath)
+	configFilePath = configAbsolutePath
 	// 从文件读取配置数据
 	data, err := os.ReadFile(configAbsolutePath)
 	if err != nil {
@@ -195,6 +876,7 @@ func InitConfig(configName string) error {
 
 	fname, ftype := utils.GetFileNameAndType(configName)
 	log.Println(fname, ftype)
+	configFileType = ftype
 
 	if ftype == "yml" || ftype == "yaml" {
 
@@ -222,65 +904,98 @@ func InitConfig(configName string) error {
 		return errors.New("unsupport config type")
 	}
 
-	log.Println(conf)
+	// 不输出完整的配置，避免日志中出现客户端和上游的key
+	log.Println("config loaded, services:", len(conf.Services), "api_keys:", len(conf.APIKeys), "tenants:", len(conf.Tenants))
 
-	// 设置负载均衡策略，默认为 "first"
-	if conf.LoadBalancing == "" {
-		LoadBalancingStrategy = "random"
+	// 设置服务器端口，默认为 "9090"
+	if conf.ServerPort == "" {
+		ServerPort = ":9090"
 	} else {
-		LoadBalancingStrategy = conf.LoadBalancing
+		ServerPort = conf.ServerPort
 	}
+	log.Println("read ServerPort ok,", ServerPort)
+
+	Debug = conf.Debug
 
-	GSOAConf = &conf
+	LogLevel = conf.LogLevel
+	log.Println("log level: ", LogLevel)
 
-	GProxyConf = &(conf.Proxy)
+	if err = checkModelAliases(conf.ModelAliases); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err = checkForceLanguage(&conf); err != nil {
+		log.Println(err)
+		return err
+	}
 
-	log.Println(conf.Proxy)
+	applyConfig(&conf)
+	return nil
+}
 
-	if conf.APIKey != "" {
-		APIKey = conf.APIKey
+// applyConfig 使用新的配置替换模型、凭证和key等配置，启动和热加载时都通过这里设置。
+// 所有配置先在新的快照中创建完整，再一次替换，进行中的请求继续使用原来的服务配置
+func applyConfig(conf *Configuration) {
+	modelToService, supportModels, tenantSupportModels := createModelToServiceMap(*conf)
+	snapshot := &configSnapshot{
+		conf:                conf,
+		modelToService:      modelToService,
+		supportModels:       supportModels,
+		tenantSupportModels: tenantSupportModels,
+		apiKey:              conf.APIKey,
 	}
+	snapshot.apiKeyMap, snapshot.tenantMap = createAPIKeyMap(conf.APIKeys, conf.Tenants)
 
-	initAPIKeyMap()
+	// 设置负载均衡策略，默认为 "first"
+	if conf.LoadBalancing == "" {
+		snapshot.loadBalancingStrategy = "random"
+	} else {
+		snapshot.loadBalancingStrategy = conf.LoadBalancing
+	}
+
+	log.Println(conf.Proxy)
 
-	log.Println("read LoadBalancingStrategy ok,", LoadBalancingStrategy)
+	log.Println("read LoadBalancingStrategy ok,", snapshot.loadBalancingStrategy)
 
-	// 设置服务器端口，默认为 "9090"
-	if conf.ServerPort == "" {
-		ServerPort = ":9090"
+	// 客户端通过header指定超时时间的上限，默认为 600 秒
+	if conf.MaxTimeout <= 0 {
+		snapshot.maxTimeout = DefaultMaxTimeout
 	} else {
-		ServerPort = conf.ServerPort
+		snapshot.maxTimeout = conf.MaxTimeout
 	}
-	log.Println("read ServerPort ok,", ServerPort)
 
-	Debug = conf.Debug
+	// 凭证返回429/401/403后的隔离时间，默认为 60 秒
+	if conf.CredentialQuarantine <= 0 {
+		snapshot.credentialQuarantine = DefaultCredentialQuarantine
+	} else {
+		snapshot.credentialQuarantine = conf.CredentialQuarantine
+	}
 
-	LogLevel = conf.LogLevel
-	log.Println("log level: ", LogLevel)
+	// 凭证返回401/403时永久隔离该凭证并换用其他凭证重试，默认开启
+	snapshot.authErrorRetry = conf.AuthErrorRetry == nil || *conf.AuthErrorRetry
 
-	// 创建映射
-	ModelToService = createModelToServiceMap(conf)
+	// 上游请求汇总日志，默认只在多次请求或失败时输出
+	if conf.AttemptLog == "" {
+		snapshot.attemptLog = AttemptLogFailover
+	} else {
+		snapshot.attemptLog = conf.AttemptLog
+	}
 
-	GlobalModelRedirect = conf.ModelRedirect
+	snapshot.supportMultiContentModels = append(append([]string(nil), defaultMultiContentModels...), conf.MultiContentModels...)
 
-	GTranslation = &conf.Translation
+	currentSnapshot.Store(snapshot)
 
-	log.Println("GlobalModelRedirect: ", GlobalModelRedirect)
+	log.Println("GlobalModelRedirect: ", conf.ModelRedirect)
 	//
 	ShowSupportModels()
 
-	if len(conf.MultiContentModels) > 0 {
-		SupportMultiContentModels = append(SupportMultiContentModels, conf.MultiContentModels...)
-	}
-	log.Println("SupportMultiContentModels: ", SupportMultiContentModels)
-
-	return nil
+	log.Println("SupportMultiContentModels: ", snapshot.supportMultiContentModels)
 }
 
 /*
 // GetAllModelService 根据模型名称获取服务和凭证信息
 func GetAllModelService(modelName string) ([]ModelDetails, error) {
-	if serviceDetails, found := ModelToService[modelName]; found {
+	if serviceDetails, found := GetModelToService()[modelName]; found {
 		return serviceDetails, nil
 	}
 	return nil, fmt.Errorf("model %s not found in the configuration", modelName)
@@ -290,7 +1005,7 @@ func GetAllModelService(modelName string) ([]ModelDetails, error) {
 
 // GetModelService 根据模型名称获取启用的服务和凭证信息
 func GetModelService(modelName string) (*ModelDetails, error) {
-	if serviceDetails, found := ModelToService[modelName]; found {
+	if serviceDetails, found := GetModelToService()[modelName]; found {
 		var enabledServices []ModelDetails
 		for _, sd := range serviceDetails {
 			if sd.Enabled {
@@ -302,31 +1017,62 @@ func GetModelService(modelName string) (*ModelDetails, error) {
 			return nil, fmt.Errorf("no enabled model %s found in the configuration", modelName)
 		}
 
-		index := GetLBIndex(LoadBalancingStrategy, modelName, len(enabledServices))
+		index := GetLBIndex(GetLoadBalancingStrategy(), modelName, len(enabledServices))
 
 		return &enabledServices[index], nil
 	}
 	return nil, fmt.Errorf("model %s not found in the configuration", modelName)
 }
 
-func GetRandomEnabledModelDetails() (*ModelDetails, error) {
+// GetModelLBStrategy 获取模型的负载均衡策略，model_load_balancing中没有配置时使用全局的策略
+func GetModelLBStrategy(modelName string) string {
+	snapshot := loadSnapshot()
+	if snapshot.conf != nil {
+		if strategy, exists := snapshot.conf.ModelLoadBalancing[modelName]; exists && strategy != "" {
+			return strategy
+		}
+	}
+	return snapshot.loadBalancingStrategy
+}
+
+// GetModelServiceByName 获取模型在指定服务下启用的配置，同一服务有多个配置时按负载均衡策略选择
+func GetModelServiceByName(modelName string, serviceName string) (*ModelDetails, error) {
+	var enabledServices []ModelDetails
+	for _, sd := range GetModelToService()[modelName] {
+		if sd.Enabled && strings.ToLower(sd.ServiceName) == serviceName {
+			enabledServices = append(enabledServices, sd)
+		}
+	}
+
+	if len(enabledServices) == 0 {
+		return nil, fmt.Errorf("no enabled model %s found in service %s", modelName, serviceName)
+	}
 
-	index := GetLBIndex(LoadBalancingStrategy, KEYNAME_RANDOM, len(ModelToService))
+	index := GetLBIndex(GetLoadBalancingStrategy(), serviceName+"_"+modelName, len(enabledServices))
 
-	keys := make([]string, 0, len(ModelToService))
+	return &enabledServices[index], nil
+}
+
+func GetRandomEnabledModelDetails() (*ModelDetails, error) {
+	snapshot := loadSnapshot()
+	keys := make([]string, 0, len(snapshot.modelToService))
 
-	// 遍历 ModelToService 映射，收集所有 Enabled 为 true 的 ModelDetails
-	for modelName := range ModelToService {
-		keys = append(keys, modelName)
+	// 遍历 ModelToService 映射，收集所有 Enabled 为 true 的 ModelDetails，租户的服务不参与
+	for modelName := range snapshot.modelToService {
+		if !IsTenantModelKey(modelName) {
+			keys = append(keys, modelName)
+		}
 	}
 
 	sort.Strings(keys)
 
+	index := GetLBIndex(snapshot.loadBalancingStrategy, KEYNAME_RANDOM, len(keys))
+
 	model := keys[index]
 
-	modelDetails := ModelToService[model]
+	modelDetails := snapshot.modelToService[model]
 
-	index2 := GetLBIndex(LoadBalancingStrategy, model, len(modelDetails))
+	index2 := GetLBIndex(snapshot.loadBalancingStrategy, model, len(modelDetails))
 
 	randomModel := modelDetails[index2]
 
@@ -347,16 +1093,46 @@ func GetRandomEnabledModelDetailsV1() (*ModelDetails, string, error) {
 
 }
 
-// GetModelMapping 函数，根据model在ModelMap中查找对应的映射，如果找不到则返回原始model
+// GetModelMapping 函数，根据model在ModelMap中查找对应的映射，如果找不到则返回原始model。
+// 先精确匹配，再按通配符匹配（例如gpt-4*），多个通配符都匹配时使用最长的
 func GetModelMapping(s *ModelDetails, model string) string {
 	if mappedModel, exists := s.ModelMap[model]; exists {
 		mylog.Logger.Info("model map found", zap.String("model", model), zap.String("mappedModel", mappedModel))
 		return mappedModel
 	}
+
+	bestPattern := ""
+	for pattern := range s.ModelMap {
+		if !strings.Contains(pattern, "*") {
+			continue
+		}
+		if matched, _ := path.Match(pattern, model); !matched {
+			continue
+		}
+		if len(pattern) > len(bestPattern) || (len(pattern) == len(bestPattern) && pattern < bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern != "" {
+		mappedModel := s.ModelMap[bestPattern]
+		mylog.Logger.Info("model map found", zap.String("model", model), zap.String("pattern", bestPattern), zap.String("mappedModel", mappedModel))
+		return mappedModel
+	}
+
 	mylog.Logger.Debug("no model map found", zap.String("model", model))
 	return model
 }
 
+// IsModelMapTarget model是否为ModelMap中映射的目标
+func IsModelMapTarget(s *ModelDetails, model string) bool {
+	for _, mappedModel := range s.ModelMap {
+		if mappedModel == model {
+			return true
+		}
+	}
+	return false
+}
+
 // GetModelRedirect 函数，根据model在ModelMap中查找对应的映射，如果找不到则返回原始model
 func GetModelRedirect(s *ModelDetails, model string) string {
 	if redirectModel, exists := s.ModelRedirect[model]; exists {
@@ -367,9 +1143,179 @@ func GetModelRedirect(s *ModelDetails, model string) string {
 	return model
 }
 
-// GetGlobalModelRedirect 函数，根据model在ModelMap中查找对应的映射，如果找不到则返回原始model
+// GetModelTimeout 根据model_timeouts查找模型请求上游的总时长（秒），先精确匹配再按模式匹配，找不到时返回0
+func GetModelTimeout(s *ModelDetails, model string) int {
+	if len(s.ModelTimeouts) == 0 {
+		return 0
+	}
+	if timeout, exists := s.ModelTimeouts[model]; exists {
+		return timeout
+	}
+	names := make([]string, 0, len(s.ModelTimeouts))
+	for name := range s.ModelTimeouts {
+		names = append(names, name)
+	}
+	if pattern := matchModelPattern(names, model); pattern != "" {
+		return s.ModelTimeouts[pattern]
+	}
+	return 0
+}
+
+// GetModelMaxContext 模型的上下文长度，model_max_context中先精确匹配再按模式匹配，没有配置时使用服务的max_context
+func GetModelMaxContext(s *ModelDetails, model string) int {
+	if maxContext, exists := s.ModelMaxContext[model]; exists {
+		return maxContext
+	}
+	if len(s.ModelMaxContext) > 0 {
+		names := make([]string, 0, len(s.ModelMaxContext))
+		for name := range s.ModelMaxContext {
+			names = append(names, name)
+		}
+		if pattern := matchModelPattern(names, model); pattern != "" {
+			return s.ModelMaxContext[pattern]
+		}
+	}
+	return s.MaxContext
+}
+
+// GetParamConstraints 根据param_constraints查找模型的参数限制，先精确匹配再按模式匹配，找不到时返回nil
+func GetParamConstraints(s *ModelDetails, model string) *ParamConstraintsConf {
+	if len(s.ParamConstraints) == 0 {
+		return nil
+	}
+	if conf, exists := s.ParamConstraints[model]; exists {
+		return &conf
+	}
+	names := make([]string, 0, len(s.ParamConstraints))
+	for name := range s.ParamConstraints {
+		names = append(names, name)
+	}
+	if pattern := matchModelPattern(names, model); pattern != "" {
+		conf := s.ParamConstraints[pattern]
+		return &conf
+	}
+	return nil
+}
+
+// GetPromptTemplate 根据prompt_templates查找模型的请求改写配置，先精确匹配再按模式匹配，找不到时返回nil
+func GetPromptTemplate(model string) *PromptTemplateConf {
+	soaConf := GetConf()
+	if len(soaConf.PromptTemplates) == 0 {
+		return nil
+	}
+	if conf, exists := soaConf.PromptTemplates[model]; exists {
+		return &conf
+	}
+	names := make([]string, 0, len(soaConf.PromptTemplates))
+	for name := range soaConf.PromptTemplates {
+		names = append(names, name)
+	}
+	if pattern := matchModelPattern(names, model); pattern != "" {
+		conf := soaConf.PromptTemplates[pattern]
+		return &conf
+	}
+	return nil
+}
+
+// GetModelPrice 根据pricing查找模型的价格，依次查找models中的每个模型，先精确匹配再按模式匹配，都找不到时返回nil
+func GetModelPrice(models ...string) *ModelPriceConf {
+	soaConf := GetConf()
+	if len(soaConf.Pricing.Models) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(soaConf.Pricing.Models))
+	for name := range soaConf.Pricing.Models {
+		names = append(names, name)
+	}
+	for _, model := range models {
+		if model == "" {
+			continue
+		}
+		if price, exists := soaConf.Pricing.Models[model]; exists {
+			return &price
+		}
+		if pattern := matchModelPattern(names, model); pattern != "" {
+			price := soaConf.Pricing.Models[pattern]
+			return &price
+		}
+	}
+	return nil
+}
+
+// GetPricingCurrency 费用的货币单位
+func GetPricingCurrency() string {
+	soaConf := GetConf()
+	if soaConf.Pricing.Currency != "" {
+		return soaConf.Pricing.Currency
+	}
+	return DefaultPricingCurrency
+}
+
+// GetStreamPacing 根据stream_pacing查找模型的流式输出平滑配置，先精确匹配再按模式匹配，找不到时返回nil
+func GetStreamPacing(model string) *StreamPacingConf {
+	soaConf := GetConf()
+	if len(soaConf.StreamPacing) == 0 {
+		return nil
+	}
+	if conf, exists := soaConf.StreamPacing[model]; exists {
+		return &conf
+	}
+	names := make([]string, 0, len(soaConf.StreamPacing))
+	for name := range soaConf.StreamPacing {
+		names = append(names, name)
+	}
+	if pattern := matchModelPattern(names, model); pattern != "" {
+		conf := soaConf.StreamPacing[pattern]
+		return &conf
+	}
+	return nil
+}
+
+// GetModelSizeLimits 模型的请求体字节数和max_tokens上限，size_limits.models中先精确匹配再按模式匹配，没有配置的使用全局的值
+func GetModelSizeLimits(model string) ModelSizeLimitsConf {
+	soaConf := GetConf()
+	limits := ModelSizeLimitsConf{
+		MaxRequestBody:  soaConf.SizeLimits.MaxRequestBody,
+		MaxOutputTokens: soaConf.SizeLimits.MaxOutputTokens,
+	}
+	models := soaConf.SizeLimits.Models
+	if len(models) == 0 {
+		return limits
+	}
+	conf, exists := models[model]
+	if !exists {
+		names := make([]string, 0, len(models))
+		for name := range models {
+			names = append(names, name)
+		}
+		pattern := matchModelPattern(names, model)
+		if pattern == "" {
+			return limits
+		}
+		conf = models[pattern]
+	}
+	if conf.MaxRequestBody > 0 {
+		limits.MaxRequestBody = conf.MaxRequestBody
+	}
+	if conf.MaxOutputTokens > 0 {
+		limits.MaxOutputTokens = conf.MaxOutputTokens
+	}
+	return limits
+}
+
+// GetVisionModel 请求中包含图片时，根据vision_model_map查找对应的视觉模型，如果找不到则返回原始model
+func GetVisionModel(model string) string {
+	if visionModel, exists := GetConf().VisionModelMap[model]; exists {
+		mylog.Logger.Info("vision model found", zap.String("model", model), zap.String("visionModel", visionModel))
+		return visionModel
+	}
+	return model
+}
+
+// GetGlobalModelRedirect 函数，根据model在ModelMap中查找对应的映射，再查找model_aliases，如果找不到则返回原始model
 func GetGlobalModelRedirect(model string) string {
-	if redirectModel, exists := GlobalModelRedirect[KEYNAME_ALL]; exists {
+	soaConf := GetConf()
+	if redirectModel, exists := soaConf.ModelRedirect[KEYNAME_ALL]; exists {
 		if redirectModel == KEYNAME_ALL {
 			redirectModel = KEYNAME_RANDOM
 		}
@@ -377,19 +1323,23 @@ func GetGlobalModelRedirect(model string) string {
 		return redirectModel
 	}
 
-	if redirectModel, exists := GlobalModelRedirect[model]; exists {
+	if redirectModel, exists := soaConf.ModelRedirect[model]; exists {
 		mylog.Logger.Info("GlobalModelRedirect model found", zap.String("model", model), zap.String("redirectModel", redirectModel))
 		return redirectModel
 	}
 
+	if aliasModel, exists := ResolveModelAlias(model); exists {
+		return aliasModel
+	}
+
 	mylog.Logger.Debug(" GlobalModelRedirect no model found", zap.String("model", model))
 	return model
 }
 
 func ShowSupportModels() {
-	keys := make([]string, 0, len(ModelToService))
+	keys := make([]string, 0, len(GetModelToService()))
 
-	for k := range SupportModels {
+	for k := range GetSupportModels() {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys) // 对keys进行排序
@@ -398,7 +1348,7 @@ func ShowSupportModels() {
 }
 
 func IsSupportMultiContent(model string) bool {
-	for _, item := range SupportMultiContentModels {
+	for _, item := range loadSnapshot().supportMultiContentModels {
 		if strings.HasSuffix(item, "*") {
 			prefix := strings.TrimSuffix(item, "*")
 			if strings.HasPrefix(model, prefix) {
@@ -411,8 +1361,14 @@ func IsSupportMultiContent(model string) bool {
 	return false
 }
 
+// IsUnsupportedImageToText 不支持图片的模型收到图片时是否转为纯文本，默认返回错误
+func IsUnsupportedImageToText() bool {
+	soaConf := GetConf()
+	return soaConf != nil && soaConf.UnsupportedImage == UnsupportedImageText
+}
+
 func IsProxyEnabled(s *ModelDetails) bool {
-	switch GProxyConf.Strategy {
+	switch getProxyConf().Strategy {
 	case PROXY_STRATEGY_FORCEALL:
 		// 配置全部启用代理，即使服务内配置了false，也忽略
 		return true
@@ -436,34 +1392,162 @@ func IsProxyEnabled(s *ModelDetails) bool {
 	return false
 }
 
-func initAPIKeyMap() {
-	apiKeyMap = make(map[string]APIKeyConfig)
-	for _, keyConfig := range GSOAConf.APIKeys {
-		apiKeyMap[keyConfig.APIKey] = keyConfig
+// createAPIKeyMap 创建客户端key和租户的表，租户的key同样加入key的表
+func createAPIKeyMap(keys []APIKeyConfig, tenantConfs []TenantConf) (map[string]APIKeyConfig, map[string]*TenantConf) {
+	tenants := make(map[string]*TenantConf)
+	for _, tenant := range getValidTenants(tenantConfs) {
+		tenants[tenant.Name] = tenant
+		for _, keyConfig := range tenant.APIKeys {
+			keyConfig.tenant = tenant.Name
+			keys = append(keys, keyConfig)
+		}
+	}
+
+	m := make(map[string]APIKeyConfig)
+	for _, keyConfig := range keys {
+		if prev, exists := m[keyConfig.APIKey]; exists {
+			// 同一个key只能属于一个租户，重复时使用先配置的
+			log.Println("duplicate api key", keyConfig.Name, "in tenant", keyConfig.tenant, "ignored, already used by", prev.Name, prev.tenant)
+			continue
+		}
+		if keyConfig.ExpiresAt != "" {
+			expiresAt, err := parseKeyExpiry(keyConfig.ExpiresAt)
+			if err != nil {
+				// 过期时间无法解析时按已过期处理，避免key意外长期有效
+				log.Println("invalid expires_at of api key", keyConfig.Name, keyConfig.ExpiresAt, err)
+				keyConfig.invalidExpiry = true
+			}
+			keyConfig.expiresAt = expiresAt
+		}
+		m[keyConfig.APIKey] = keyConfig
 	}
+	return m, tenants
 }
 
-func ValidateAPIKeyAndModel(apikey string, model string) (bool, string) {
-	if len(apiKeyMap) == 0 {
-		return true, ""
+func parseKeyExpiry(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
 	}
-	keyConfig, exists := apiKeyMap[apikey]
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+// GetRedactPaths 获取模型所有启用的服务配置的脱敏路径，用于选择服务之前记录日志
+func GetRedactPaths(model string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, sd := range GetModelToService()[model] {
+		if !sd.Enabled {
+			continue
+		}
+		for _, p := range sd.RedactPaths.Paths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// GetMaxStreams 获取key允许的最大并发流式请求数，key单独配置的优先，0表示不限制
+func GetMaxStreams(apikey string) int {
+	snapshot := loadSnapshot()
+	if keyConfig, exists := snapshot.apiKeyMap[apikey]; exists && keyConfig.MaxStreams > 0 {
+		return keyConfig.MaxStreams
+	}
+	return snapshot.conf.MaxStreamsPerKey
+}
+
+// GetKeyRateLimit 获取key的每分钟请求数、每分钟token数和每月token配额，key单独配置的优先，其次是key所属租户的key_rate_limit
+func GetKeyRateLimit(apikey string) KeyRateLimitConf {
+	snapshot := loadSnapshot()
+	var limit KeyRateLimitConf
+	if snapshot.conf != nil {
+		limit = snapshot.conf.KeyRateLimit
+	}
+	if keyConfig, exists := snapshot.apiKeyMap[apikey]; exists {
+		if tenant, exists := snapshot.tenantMap[keyConfig.tenant]; exists {
+			if tenant.KeyRateLimit.RPM > 0 {
+				limit.RPM = tenant.KeyRateLimit.RPM
+			}
+			if tenant.KeyRateLimit.TPM > 0 {
+				limit.TPM = tenant.KeyRateLimit.TPM
+			}
+			if tenant.KeyRateLimit.MonthlyTokenQuota > 0 {
+				limit.MonthlyTokenQuota = tenant.KeyRateLimit.MonthlyTokenQuota
+			}
+		}
+		if keyConfig.RPM > 0 {
+			limit.RPM = keyConfig.RPM
+		}
+		if keyConfig.TPM > 0 {
+			limit.TPM = keyConfig.TPM
+		}
+		if keyConfig.MonthlyTokenQuota > 0 {
+			limit.MonthlyTokenQuota = keyConfig.MonthlyTokenQuota
+		}
+	}
+	return limit
+}
+
+var (
+	ErrMissingAPIKey = errors.New("missing API key, please pass it in the Authorization header as Bearer token")
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrExpiredAPIKey = errors.New("API key has expired")
+)
+
+// HasAPIKeys 配置文件中是否配置了api_key或api_keys
+func HasAPIKeys() bool {
+	snapshot := loadSnapshot()
+	return snapshot.apiKey != "" || len(snapshot.apiKeyMap) > 0
+}
+
+// AuthenticateAPIKey 校验客户端的key。没有配置api_key和api_keys时不校验；与api_key一致时可以使用所有模型；
+// 否则需要是api_keys中未过期的key，返回该key的配置，其他情况返回nil
+func AuthenticateAPIKey(apikey string) (*APIKeyConfig, error) {
+	snapshot := loadSnapshot()
+	if snapshot.apiKey == "" && len(snapshot.apiKeyMap) == 0 {
+		return nil, nil
+	}
+	if apikey == "" {
+		return nil, ErrMissingAPIKey
+	}
+	if snapshot.apiKey != "" && apikey == snapshot.apiKey {
+		return nil, nil
+	}
+	keyConfig, exists := snapshot.apiKeyMap[apikey]
 	if !exists {
-		mylog.Logger.Error("ValidateAPIKeyAndModel|Forbidden: invalid API key", zap.String("apikey", apikey))
-		return false, "Forbidden: invalid API key"
+		return nil, ErrInvalidAPIKey
+	}
+	if keyConfig.invalidExpiry || (!keyConfig.expiresAt.IsZero() && time.Now().After(keyConfig.expiresAt)) {
+		return nil, ErrExpiredAPIKey
 	}
+	return &keyConfig, nil
+}
 
-	mylog.Logger.Debug("ValidateAPIKeyAndModel", zap.String("model", model))
+// IsModelAllowed 判断key是否可以使用模型，租户的key还需要是租户allowed_models中的模型，
+// allowed_models和supported_models都没有配置时可以使用所有模型
+func IsModelAllowed(keyConfig *APIKeyConfig, model string) bool {
+	if keyConfig != nil && !isTenantModelAllowed(keyConfig.tenant, model) {
+		return false
+	}
+	if keyConfig == nil || (len(keyConfig.AllowedModels) == 0 && len(keyConfig.SupportedModels) == 0) {
+		return true
+	}
+
+	for _, pattern := range keyConfig.AllowedModels {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
 
 	// 检查所有服务和通配符的配置
-	for service, models := range keyConfig.SupportedModels {
-		mylog.Logger.Info(service, zap.Any("SupportedModels", models))
+	for _, models := range keyConfig.SupportedModels {
 		for _, m := range models {
 			if m == "*" || m == model {
-				mylog.Logger.Debug("ValidateAPIKeyAndModel", zap.String("model", model), zap.String("m", m))
-				return true, ""
+				return true
 			}
 		}
 	}
-	return false, "Forbidden: model not supported"
+	return false
 }
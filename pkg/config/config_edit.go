@@ -0,0 +1,206 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/mylog"
+	"sync"
+)
+
+// editMu 控制台的修改依次写入配置文件
+var editMu sync.Mutex
+
+// ServiceEdit 控制台可以修改的服务配置，为nil的字段保持不变
+type ServiceEdit struct {
+	Enabled  *bool              `json:"enabled"`
+	Models   *[]string          `json:"models"`
+	ModelMap *map[string]string `json:"model_map"`
+	Weight   *int               `json:"weight"`
+}
+
+// APIKeyEdit 控制台可以修改的api_keys配置，为nil的字段保持不变
+type APIKeyEdit struct {
+	APIKey            *string   `json:"api_key"`
+	Name              *string   `json:"name"`
+	AllowedModels     *[]string `json:"allowed_models"`
+	ExpiresAt         *string   `json:"expires_at"`
+	MaxStreams        *int      `json:"max_streams"`
+	RPM               *int      `json:"rpm"`
+	TPM               *int      `json:"tpm"`
+	MonthlyTokenQuota *int64    `json:"monthly_token_quota"`
+}
+
+func (e *ServiceEdit) apply(m map[string]interface{}) {
+	setEditField(m, "enabled", e.Enabled)
+	setEditField(m, "models", e.Models)
+	setEditField(m, "model_map", e.ModelMap)
+	setEditField(m, "weight", e.Weight)
+}
+
+func (e *APIKeyEdit) apply(m map[string]interface{}) {
+	setEditField(m, "api_key", e.APIKey)
+	setEditField(m, "name", e.Name)
+	setEditField(m, "allowed_models", e.AllowedModels)
+	setEditField(m, "expires_at", e.ExpiresAt)
+	setEditField(m, "max_streams", e.MaxStreams)
+	setEditField(m, "rpm", e.RPM)
+	setEditField(m, "tpm", e.TPM)
+	setEditField(m, "monthly_token_quota", e.MonthlyTokenQuota)
+}
+
+// setEditField value为指针，nil时不修改
+func setEditField[T any](m map[string]interface{}, key string, value *T) {
+	if value != nil {
+		m[key] = *value
+	}
+}
+
+// UpdateService 修改services中serviceName的第index个服务并重新加载配置
+func UpdateService(serviceName string, index int, edit *ServiceEdit) error {
+	return editConfigFile(func(root map[string]interface{}) error {
+		services, _ := root["services"].(map[string]interface{})
+		list, _ := services[serviceName].([]interface{})
+		if index < 0 || index >= len(list) {
+			return fmt.Errorf("service %s[%d] not found", serviceName, index)
+		}
+		m, ok := list[index].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("service %s[%d] is not an object", serviceName, index)
+		}
+		edit.apply(m)
+		return nil
+	})
+}
+
+// UpdateAPIKey 修改api_keys中的第index个key并重新加载配置
+func UpdateAPIKey(index int, edit *APIKeyEdit) error {
+	return editConfigFile(func(root map[string]interface{}) error {
+		list, _ := root["api_keys"].([]interface{})
+		if index < 0 || index >= len(list) {
+			return fmt.Errorf("api_keys[%d] not found", index)
+		}
+		m, ok := list[index].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("api_keys[%d] is not an object", index)
+		}
+		edit.apply(m)
+		return nil
+	})
+}
+
+// AddAPIKey 在api_keys末尾增加一个key并重新加载配置
+func AddAPIKey(edit *APIKeyEdit) error {
+	if edit.APIKey == nil || *edit.APIKey == "" {
+		return errors.New("api_key is required")
+	}
+	return editConfigFile(func(root map[string]interface{}) error {
+		list, _ := root["api_keys"].([]interface{})
+		for _, item := range list {
+			if m, ok := item.(map[string]interface{}); ok && m["api_key"] == *edit.APIKey {
+				return errors.New("api_key already exists")
+			}
+		}
+		m := make(map[string]interface{})
+		edit.apply(m)
+		root["api_keys"] = append(list, m)
+		return nil
+	})
+}
+
+// DeleteAPIKey 删除api_keys中的第index个key并重新加载配置
+func DeleteAPIKey(index int) error {
+	return editConfigFile(func(root map[string]interface{}) error {
+		list, _ := root["api_keys"].([]interface{})
+		if index < 0 || index >= len(list) {
+			return fmt.Errorf("api_keys[%d] not found", index)
+		}
+		root["api_keys"] = append(list[:index], list[index+1:]...)
+		return nil
+	})
+}
+
+// editConfigFile 按原来的格式修改配置文件后重新加载，没有修改的配置项保持原样（JSON会重新缩进，YAML的注释会丢失），
+// 重新加载失败时恢复原来的文件
+func editConfigFile(edit func(root map[string]interface{}) error) error {
+	if configFilePath == "" {
+		return errors.New("config file is not available")
+	}
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	orig, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return err
+	}
+	root := make(map[string]interface{})
+	switch configFileType {
+	case "yml", "yaml":
+		err = yaml.Unmarshal(orig, &root)
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(orig))
+		decoder.UseNumber()
+		err = decoder.Decode(&root)
+	default:
+		err = errors.New("unsupport config type")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = edit(root); err != nil {
+		return err
+	}
+
+	var data []byte
+	if configFileType == "json" {
+		data, err = json.MarshalIndent(root, "", "  ")
+	} else {
+		data, err = yaml.Marshal(root)
+	}
+	if err != nil {
+		return err
+	}
+	if err = writeConfigFile(data); err != nil {
+		return err
+	}
+
+	if err = ReloadConfig(); err != nil {
+		mylog.Logger.Error("config edit rejected, restore the config file", zap.Error(err))
+		if restoreErr := writeConfigFile(orig); restoreErr != nil {
+			mylog.Logger.Error("restore config file failed", zap.String("config", configFilePath), zap.Error(restoreErr))
+		}
+		return err
+	}
+	mylog.Logger.Info("config file edited", zap.String("config", configFilePath))
+	return nil
+}
+
+// writeConfigFile 先写入临时文件再替换，避免文件监控读到写了一半的配置
+func writeConfigFile(data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(configFilePath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configFilePath), ".config-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configFilePath)
+}
@@ -1,6 +1,8 @@
 package config
 
 const KEYNAME_API_KEY = "api_key"
+const KEYNAME_API_KEYS = "api_keys"
+const KEYNAME_WEIGHT = "weight"
 const KEYNAME_TOKEN = "token"
 const KEYNAME_SECRET_ID = "secret_id"
 const KEYNAME_SECRET_KEY = "secret_key"
@@ -9,6 +11,7 @@ const KEYNAME_APPID = "appid"
 const KEYNAME_API_SECRET = "api_secret"
 const KEYNAME_DOMAIN = "domain"
 const KEYNAME_ACCESS_KEY = "access_key"
+const KEYNAME_SESSION_TOKEN = "session_token"
 
 const KEYNAME_GCP_PROJECT_ID = "project_id"
 const KEYNAME_GCP_LOCATION = "location"
@@ -17,3 +20,12 @@ const KEYNAME_GCP_JSON_FILE = "json_file"
 
 const KEYNAME_RANDOM = "random"
 const KEYNAME_ALL = "all"
+
+// KEYNAME_REGION AWS Bedrock等服务的区域
+const KEYNAME_REGION = "region"
+
+// Azure Entra ID的服务主体，azure_ad_token为直接配置的token
+const KEYNAME_AZURE_TENANT_ID = "tenant_id"
+const KEYNAME_AZURE_CLIENT_ID = "client_id"
+const KEYNAME_AZURE_CLIENT_SECRET = "client_secret"
+const KEYNAME_AZURE_AD_TOKEN = "azure_ad_token"
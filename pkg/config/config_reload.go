@@ -0,0 +1,176 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/signal"
+	"reflect"
+	"simple-one-api/pkg/mylog"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	configFilePath string
+	configFileType string
+)
+
+// reloadMu 文件监控、SIGHUP和管理接口可能同时触发重新加载，依次执行
+var reloadMu sync.Mutex
+
+// reloadListeners 重新加载配置后依次调用，用于清理按旧配置保存的状态
+var reloadListeners []func()
+
+// OnReload 注册重新加载配置后调用的函数，需要在启动时注册
+func OnReload(f func()) {
+	reloadListeners = append(reloadListeners, f)
+}
+
+// startupOnlyConfs 启动时初始化的配置，热加载时保留原来的值，修改后需要重启
+var startupOnlyConfs = []struct {
+	name string
+	get  func(c *Configuration) interface{}
+}{
+	{"server_port", func(c *Configuration) interface{} { return &c.ServerPort }},
+	{"debug", func(c *Configuration) interface{} { return &c.Debug }},
+	{"log_level", func(c *Configuration) interface{} { return &c.LogLevel }},
+	{"log_privacy", func(c *Configuration) interface{} { return &c.LogPrivacy }},
+	{"enable_web", func(c *Configuration) interface{} { return &c.EnableWeb }},
+	{"access_log", func(c *Configuration) interface{} { return &c.AccessLog }},
+	{"metrics", func(c *Configuration) interface{} { return &c.Metrics }},
+	{"response_cache", func(c *Configuration) interface{} { return &c.ResponseCache }},
+	{"publisher", func(c *Configuration) interface{} { return &c.Publisher }},
+	{"usage", func(c *Configuration) interface{} { return &c.Usage }},
+	{"key_management", func(c *Configuration) interface{} { return &c.KeyManagement }},
+	{"audit", func(c *Configuration) interface{} { return &c.Audit }},
+	{"config_reload_interval", func(c *Configuration) interface{} { return &c.ConfigReloadInterval }},
+	{"dashboard", func(c *Configuration) interface{} { return &c.Dashboard }},
+	{"batch", func(c *Configuration) interface{} { return &c.Batch }},
+	{"tracing", func(c *Configuration) interface{} { return &c.Tracing }},
+	{"chat_ws", func(c *Configuration) interface{} { return &c.ChatWS }},
+	{"shared_state", func(c *Configuration) interface{} { return &c.SharedState }},
+}
+
+// keepStartupOnlyConfs 将启动时初始化的配置保留为当前的值，返回被修改而没有生效的配置名
+func keepStartupOnlyConfs(cur, conf *Configuration) []string {
+	var changed []string
+	for _, item := range startupOnlyConfs {
+		curValue := reflect.ValueOf(item.get(cur)).Elem()
+		newValue := reflect.ValueOf(item.get(conf)).Elem()
+		if !reflect.DeepEqual(curValue.Interface(), newValue.Interface()) {
+			changed = append(changed, item.name)
+			newValue.Set(curValue)
+		}
+	}
+	return changed
+}
+
+// hasEnabledModels 配置中是否有启用的服务，避免写到一半的配置文件使所有模型不可用
+func hasEnabledModels(conf *Configuration) bool {
+	for serviceName, serviceModels := range conf.Services {
+		for _, model := range serviceModels {
+			if model.Enabled && (len(model.Models) > 0 || len(DefaultSupportModelMap[serviceName]) > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func readConfigFile() (*Configuration, error) {
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf Configuration
+	switch configFileType {
+	case "yml", "yaml":
+		err = yaml.Unmarshal(data, &conf)
+	case "json":
+		err = json.Unmarshal(data, &conf)
+	default:
+		err = errors.New("unsupport config type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// ReloadConfig 重新读取配置文件，替换服务、模型、凭证和api_keys等配置，不需要重启，进行中的请求（包括流式响应）不受影响；
+// 配置文件解析失败或者没有可用的模型时保持原来的配置
+func ReloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	conf, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if !hasEnabledModels(conf) {
+		return errors.New("no enabled models in config")
+	}
+	if err = checkModelAliases(conf.ModelAliases); err != nil {
+		return err
+	}
+	if err = checkForceLanguage(conf); err != nil {
+		return err
+	}
+
+	if changed := keepStartupOnlyConfs(GetConf(), conf); len(changed) > 0 {
+		mylog.Logger.Warn("config changes that need a restart are ignored", zap.Strings("confs", changed))
+	}
+	applyConfig(conf)
+	for _, f := range reloadListeners {
+		f()
+	}
+
+	mylog.Logger.Info("config reloaded",
+		zap.String("config", configFilePath),
+		zap.Int("models", len(GetModelToService())),
+		zap.Int("api_keys", len(conf.APIKeys)))
+	return nil
+}
+
+// StartConfigReload 配置文件修改后（每隔config_reload_interval秒检查一次）或者收到SIGHUP信号时重新加载配置
+func StartConfigReload() {
+	if configFilePath == "" {
+		return
+	}
+	interval := GetConf().ConfigReloadInterval
+	if interval <= 0 {
+		interval = DefaultConfigReloadInterval
+	}
+
+	var modTime time.Time
+	if fi, err := os.Stat(configFilePath); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fi, err := os.Stat(configFilePath)
+				if err != nil || fi.ModTime().Equal(modTime) {
+					continue
+				}
+				modTime = fi.ModTime()
+			case <-hup:
+			}
+			if err := ReloadConfig(); err != nil {
+				mylog.Logger.Error("reload config failed, keep the current config", zap.String("config", configFilePath), zap.Error(err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package config
+
+import "sync/atomic"
+
+// configSnapshot 一次加载得到的配置以及由其生成的模型到服务的映射等，发布后不再修改。
+// 热加载时创建新的快照整体替换，请求读取时不会看到一半新一半旧的配置
+type configSnapshot struct {
+	conf                      *Configuration
+	modelToService            map[string][]ModelDetails
+	supportModels             map[string]string
+	tenantSupportModels       map[string]map[string]string
+	loadBalancingStrategy     string
+	apiKey                    string
+	apiKeyMap                 map[string]APIKeyConfig
+	tenantMap                 map[string]*TenantConf
+	maxTimeout                int
+	credentialQuarantine      int
+	authErrorRetry            bool
+	attemptLog                string
+	supportMultiContentModels []string
+}
+
+// emptySnapshot 加载配置之前使用
+var emptySnapshot = &configSnapshot{
+	maxTimeout:                DefaultMaxTimeout,
+	credentialQuarantine:      DefaultCredentialQuarantine,
+	authErrorRetry:            true,
+	attemptLog:                AttemptLogFailover,
+	supportMultiContentModels: defaultMultiContentModels,
+}
+
+var currentSnapshot atomic.Pointer[configSnapshot]
+
+func loadSnapshot() *configSnapshot {
+	if s := currentSnapshot.Load(); s != nil {
+		return s
+	}
+	return emptySnapshot
+}
+
+// GetConf 当前生效的配置，加载配置之前返回nil。返回的配置不能修改
+func GetConf() *Configuration {
+	return loadSnapshot().conf
+}
+
+// GetModelToService 模型到服务的映射
+func GetModelToService() map[string][]ModelDetails {
+	return loadSnapshot().modelToService
+}
+
+// GetSupportModels 顶层services中支持的模型名称
+func GetSupportModels() map[string]string {
+	return loadSnapshot().supportModels
+}
+
+// GetTenantSupportModels 每个租户的services中支持的模型名称
+func GetTenantSupportModels() map[string]map[string]string {
+	return loadSnapshot().tenantSupportModels
+}
+
+func GetLoadBalancingStrategy() string {
+	return loadSnapshot().loadBalancingStrategy
+}
+
+// GetAPIKey 顶层的api_key，没有配置时为空
+func GetAPIKey() string {
+	return loadSnapshot().apiKey
+}
+
+// GetMaxTimeout 客户端通过header指定超时时间的上限（秒）
+func GetMaxTimeout() int {
+	return loadSnapshot().maxTimeout
+}
+
+// GetCredentialQuarantine 凭证返回429/401/403后的隔离时间（秒）
+func GetCredentialQuarantine() int {
+	return loadSnapshot().credentialQuarantine
+}
+
+// IsAuthErrorRetry 凭证返回401/403时是否永久隔离该凭证并换用其他凭证重试
+func IsAuthErrorRetry() bool {
+	return loadSnapshot().authErrorRetry
+}
+
+// GetAttemptLog 上游请求汇总日志的输出方式
+func GetAttemptLog() string {
+	return loadSnapshot().attemptLog
+}
+
+// GetTranslation 翻译接口的配置，加载配置之前返回nil
+func GetTranslation() *Translation {
+	if conf := GetConf(); conf != nil {
+		return &conf.Translation
+	}
+	return nil
+}
+
+func getProxyConf() *ProxyConf {
+	return &GetConf().Proxy
+}
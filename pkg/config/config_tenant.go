@@ -0,0 +1,95 @@
+package config
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// tenantModelKeyPrefix 租户服务中的模型在ModelToService中的名称前缀，格式为tenant:<租户名称>:<模型名称>
+const tenantModelKeyPrefix = "tenant:"
+
+// TenantConf 租户有自己的客户端key、可以使用的模型、key的默认限额和上游服务，
+// 租户的services只有该租户的key可以使用，租户没有配置的模型使用全局的services
+type TenantConf struct {
+	Name          string                    `json:"name" yaml:"name"`
+	APIKeys       []APIKeyConfig            `json:"api_keys" yaml:"api_keys"`
+	AllowedModels []string                  `json:"allowed_models" yaml:"allowed_models"` // 支持通配符，为空时可以使用所有模型
+	KeyRateLimit  KeyRateLimitConf          `json:"key_rate_limit" yaml:"key_rate_limit"` // 没有配置时使用全局的key_rate_limit
+	Services      map[string][]ServiceModel `json:"services" yaml:"services"`
+}
+
+// getValidTenants 跳过没有名称、名称中包含:以及重复名称的租户
+func getValidTenants(tenants []TenantConf) []*TenantConf {
+	var list []*TenantConf
+	seen := make(map[string]bool)
+	for i := range tenants {
+		tenant := &tenants[i]
+		if tenant.Name == "" || strings.Contains(tenant.Name, ":") || seen[tenant.Name] {
+			log.Println("invalid or duplicate tenant name ignored:", tenant.Name)
+			continue
+		}
+		seen[tenant.Name] = true
+		list = append(list, tenant)
+	}
+	return list
+}
+
+// Tenant 返回key所属的租户名称，不属于租户时为空
+func (k *APIKeyConfig) Tenant() string {
+	return k.tenant
+}
+
+// TenantModelKey 租户服务中的模型在ModelToService中的名称，与全局的服务和其他租户的服务区分开
+func TenantModelKey(tenant, model string) string {
+	return tenantModelKeyPrefix + tenant + ":" + model
+}
+
+// IsTenantModelKey 是否是租户服务中的模型名称
+func IsTenantModelKey(model string) bool {
+	return strings.HasPrefix(model, tenantModelKeyPrefix)
+}
+
+// ResolveTenantModel 租户的services中有该模型时返回租户服务中的模型名称，否则返回原来的名称，使用全局的服务
+func ResolveTenantModel(tenant, model string) string {
+	if tenant == "" {
+		return model
+	}
+	if key := TenantModelKey(tenant, model); len(GetModelToService()[key]) > 0 {
+		return key
+	}
+	return model
+}
+
+// StripTenantModelKey 去掉租户服务中的模型名称前缀，返回客户端请求的模型名称
+func StripTenantModelKey(model string) string {
+	if !IsTenantModelKey(model) {
+		return model
+	}
+	if i := strings.Index(model[len(tenantModelKeyPrefix):], ":"); i >= 0 {
+		return model[len(tenantModelKeyPrefix)+i+1:]
+	}
+	return model
+}
+
+// GetTenant 根据名称获取租户的配置，不存在时返回nil
+func GetTenant(name string) *TenantConf {
+	return loadSnapshot().tenantMap[name]
+}
+
+// isTenantModelAllowed 判断租户是否可以使用模型，不属于租户或者租户没有配置allowed_models时可以使用所有模型
+func isTenantModelAllowed(name string, model string) bool {
+	if name == "" {
+		return true
+	}
+	tenant := GetTenant(name)
+	if tenant == nil || len(tenant.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range tenant.AllowedModels {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
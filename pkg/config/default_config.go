@@ -10,5 +10,6 @@ var DefaultSupportModelMap = map[string][]string{
 	"huoshan":  {"Doubao-pro-4k", "Doubao-pro-32k", "Doubao-pro-128k", "Doubao-lite-4k", "Doubao-lite-32k", "Doubao-lite-128k"},
 	"gemini":   {"gemini-1.5-pro", "gemini-1.5-flash", "gemini-1.0-pro", "gemini-pro-vision"},
 	"groq":     {"llama3-70b-8192", "llama3-8b-8192", "gemma-7b-it", "mixtral-8x7b-32768"},
+	"xai":      {"grok-2", "grok-2-vision", "grok-beta", "grok-vision-beta"},
 	"aliyun":   {"qwen-turbo", "qwen-plus", "qwen-max", "qwen-max-longcontext"},
 }
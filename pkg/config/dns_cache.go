@@ -0,0 +1,85 @@
+package config
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache 缓存域名解析的结果，ttl内同一个域名不重复解析；解析失败时继续使用过期的结果
+type dnsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCaches 缓存时长相同的Transport共用一个缓存，key为秒数
+var dnsCaches sync.Map
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// withDNSCache 配置了dns_cache_ttl时连接之前先从缓存中取域名的地址，依次尝试直到连接成功
+func withDNSCache(dial dialFunc, conf *HTTPClientConf) dialFunc {
+	if conf.DNSCacheTTL <= 0 || dial == nil {
+		return dial
+	}
+	v, _ := dnsCaches.LoadOrStore(conf.DNSCacheTTL, &dnsCache{
+		ttl:     time.Duration(conf.DNSCacheTTL) * time.Second,
+		entries: make(map[string]dnsEntry),
+	})
+	cache := v.(*dnsCache)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := cache.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	entry, exists := d.entries[host]
+	d.mu.Unlock()
+	if exists && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		if exists {
+			return entry.addrs, nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+	return addrs, nil
+}
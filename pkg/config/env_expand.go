@@ -0,0 +1,15 @@
+package config
+
+import (
+	"os"
+	"regexp"
+)
+
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnvVars 将${VAR}替换为环境变量的值，没有设置的环境变量替换为空字符串，其他的$保持不变
+func ExpandEnvVars(s string) string {
+	return envVarRe.ReplaceAllStringFunc(s, func(m string) string {
+		return os.Getenv(envVarRe.FindStringSubmatch(m)[1])
+	})
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ForceLanguagePostCheckLanguages post_check支持的语言，只能检测有独特文字的语言，
+// en、fr、de等都使用拉丁字母，无法通过文字区分
+var ForceLanguagePostCheckLanguages = []string{"zh", "ja", "ko", "ru", "ar", "th"}
+
+// isPostCheckLanguage 判断post_check是否支持该语言，zh-CN、zh_TW等按zh判断
+func isPostCheckLanguage(lang string) bool {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+	for _, l := range ForceLanguagePostCheckLanguages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// checkForceLanguage post_check的语言不支持检测时启动或重新加载失败
+func checkForceLanguage(conf *Configuration) error {
+	check := func(services map[string][]ServiceModel) error {
+		for serviceName, serviceModels := range services {
+			for _, model := range serviceModels {
+				if model.ForceLanguage.PostCheck && !isPostCheckLanguage(model.ForceLanguage.Language) {
+					return fmt.Errorf("service %s: force_language.post_check does not support language %q, supported: %s",
+						serviceName, model.ForceLanguage.Language, strings.Join(ForceLanguagePostCheckLanguages, ", "))
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(conf.Services); err != nil {
+		return err
+	}
+	for _, tenant := range conf.Tenants {
+		if err := check(tenant.Services); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+	}
+	return nil
+}
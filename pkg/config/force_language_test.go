@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestCheckForceLanguage(t *testing.T) {
+	tests := []struct {
+		language  string
+		postCheck bool
+		wantErr   bool
+	}{
+		{"zh", true, false},
+		{"zh-CN", true, false},
+		{"ja_JP", true, false},
+		{"ru", true, false},
+		{"en", true, true},
+		{"fr", true, true},
+		{"en", false, false},
+	}
+	for _, tt := range tests {
+		conf := &Configuration{Services: map[string][]ServiceModel{
+			"openai": {{ForceLanguage: ForceLanguageConf{Language: tt.language, PostCheck: tt.postCheck}}},
+		}}
+		if err := checkForceLanguage(conf); (err != nil) != tt.wantErr {
+			t.Errorf("language %q post_check %v: err = %v, wantErr %v", tt.language, tt.postCheck, err, tt.wantErr)
+		}
+	}
+
+	conf := &Configuration{Tenants: []TenantConf{{Name: "t1", Services: map[string][]ServiceModel{
+		"openai": {{ForceLanguage: ForceLanguageConf{Language: "de", PostCheck: true}}},
+	}}}}
+	if err := checkForceLanguage(conf); err == nil {
+		t.Error("tenant service with post_check for de should be rejected")
+	}
+}
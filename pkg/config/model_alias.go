@@ -0,0 +1,196 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"math/rand"
+	"path"
+	"simple-one-api/pkg/mylog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelAlias 模型别名，按schedule、targets、model的顺序确定实际请求的模型
+type ModelAlias struct {
+	Model    string               `json:"model" yaml:"model"`
+	Targets  []ModelAliasTarget   `json:"targets" yaml:"targets"`
+	Schedule []ModelAliasSchedule `json:"schedule" yaml:"schedule"`
+}
+
+// ModelAliasTarget 按权重随机选择的模型，weight没有配置时为1
+type ModelAliasTarget struct {
+	Model  string `json:"model" yaml:"model"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// ModelAliasSchedule 在start到end之间（服务器本地时间，格式为15:04）使用的模型，end小于start时表示跨过零点
+type ModelAliasSchedule struct {
+	Start   string             `json:"start" yaml:"start"`
+	End     string             `json:"end" yaml:"end"`
+	Model   string             `json:"model" yaml:"model"`
+	Targets []ModelAliasTarget `json:"targets" yaml:"targets"`
+}
+
+// UnmarshalJSON 别名也可以直接写成模型名称的字符串
+func (ma *ModelAlias) UnmarshalJSON(data []byte) error {
+	var model string
+	if err := json.Unmarshal(data, &model); err == nil {
+		*ma = ModelAlias{Model: model}
+		return nil
+	}
+	type Alias ModelAlias
+	return json.Unmarshal(data, (*Alias)(ma))
+}
+
+func (ma *ModelAlias) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*ma = ModelAlias{Model: value.Value}
+		return nil
+	}
+	type Alias ModelAlias
+	return value.Decode((*Alias)(ma))
+}
+
+// ResolveModelAlias 查找model_aliases中的别名，先精确匹配，再按模式从长到短匹配（支持*通配符），找不到时返回false
+func ResolveModelAlias(model string) (string, bool) {
+	soaConf := GetConf()
+	if soaConf == nil || len(soaConf.ModelAliases) == 0 {
+		return model, false
+	}
+
+	alias, exists := soaConf.ModelAliases[model]
+	if !exists {
+		pattern := matchModelAliasPattern(soaConf.ModelAliases, model)
+		if pattern == "" {
+			return model, false
+		}
+		alias = soaConf.ModelAliases[pattern]
+	}
+
+	target := alias.resolve(time.Now())
+	if target == "" {
+		return model, false
+	}
+	mylog.Logger.Info("model alias found", zap.String("model", model), zap.String("target", target))
+	return target, true
+}
+
+func matchModelAliasPattern(aliases map[string]ModelAlias, model string) string {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	return matchModelPattern(names, model)
+}
+
+// matchModelPattern 在names中找出与model匹配的最具体的模式，不含通配符的名称忽略
+func matchModelPattern(names []string, model string) string {
+	var patterns []string
+	for _, pattern := range names {
+		if strings.ContainsAny(pattern, "*?[") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	// 模式越长越具体，长度相同时按字典序，保证结果稳定
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, model); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+func (ma *ModelAlias) resolve(now time.Time) string {
+	for _, sch := range ma.Schedule {
+		if !sch.contains(now) {
+			continue
+		}
+		if model := pickModelAliasTarget(sch.Targets); model != "" {
+			return model
+		}
+		if sch.Model != "" {
+			return sch.Model
+		}
+	}
+	if model := pickModelAliasTarget(ma.Targets); model != "" {
+		return model
+	}
+	return ma.Model
+}
+
+func (sch *ModelAliasSchedule) contains(now time.Time) bool {
+	start, err1 := parseClock(sch.Start)
+	end, err2 := parseClock(sch.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	cur := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return cur >= start && cur < end
+	}
+	return cur >= start || cur < end
+}
+
+// parseClock 把15:04格式的时间转换为当天的分钟数
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func pickModelAliasTarget(targets []ModelAliasTarget) string {
+	total := 0
+	for _, t := range targets {
+		total += modelAliasTargetWeight(t)
+	}
+	if total == 0 {
+		return ""
+	}
+	n := rand.Intn(total)
+	for _, t := range targets {
+		n -= modelAliasTargetWeight(t)
+		if n < 0 {
+			return t.Model
+		}
+	}
+	return ""
+}
+
+func modelAliasTargetWeight(t ModelAliasTarget) int {
+	if t.Model == "" {
+		return 0
+	}
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// checkModelAliases 检查schedule中的时间格式，配置错误时启动或重新加载失败
+func checkModelAliases(aliases map[string]ModelAlias) error {
+	for name, alias := range aliases {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("model_aliases %s: invalid pattern: %v", name, err)
+		}
+		for _, sch := range alias.Schedule {
+			if _, err := parseClock(sch.Start); err != nil {
+				return fmt.Errorf("model_aliases %s: invalid schedule start %q", name, sch.Start)
+			}
+			if _, err := parseClock(sch.End); err != nil {
+				return fmt.Errorf("model_aliases %s: invalid schedule end %q", name, sch.End)
+			}
+		}
+	}
+	return nil
+}
@@ -2,13 +2,18 @@ package config
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -76,29 +81,30 @@ func GetTypeProxyTransport(proxyType, proxyAddr string, timeout int) (*http.Tran
 
 // GetConfProxyTransport 根据全局配置返回相应的 http.Transport
 func GetConfProxyTransport() (string, string, *http.Transport, error) {
-	proxyType := strings.ToLower(GProxyConf.Type)
+	proxyConf := getProxyConf()
+	proxyType := strings.ToLower(proxyConf.Type)
 	var proxyAddr string
 	var transport *http.Transport
 	var err error
 
-	timeout := GProxyConf.Timeout
+	timeout := proxyConf.Timeout
 	if timeout <= 0 {
 		timeout = 30
 	}
 
 	switch proxyType {
 	case ProxyTypeHTTP:
-		proxyAddr = GProxyConf.HTTPProxy
+		proxyAddr = proxyConf.HTTPProxy
 		transport, err = getHttpProxyTransport(proxyAddr, timeout)
 	case ProxyTypeSOCKS5:
-		if len(GProxyConf.Socks5Proxy) >= 7 && GProxyConf.Socks5Proxy[:7] == "socks5:" {
-			proxyURL, err := url.Parse(GProxyConf.Socks5Proxy)
+		if len(proxyConf.Socks5Proxy) >= 7 && proxyConf.Socks5Proxy[:7] == "socks5:" {
+			proxyURL, err := url.Parse(proxyConf.Socks5Proxy)
 			if err != nil {
 				return "", "", nil, errors.New(fmt.Sprintf("error parsing proxy URL: %v\n", err))
 			}
 			proxyAddr = proxyURL.Host
 		} else {
-			proxyAddr = GProxyConf.Socks5Proxy
+			proxyAddr = proxyConf.Socks5Proxy
 		}
 
 		transport, err = getSocks5Transport(proxyAddr, timeout)
@@ -108,3 +114,214 @@ func GetConfProxyTransport() (string, string, *http.Transport, error) {
 
 	return proxyType, proxyAddr, transport, err
 }
+
+var serviceTransports sync.Map
+var globalProxyTransports sync.Map
+
+// globalProxyTransport 使用全局代理的Transport和用于日志的代理地址
+type globalProxyTransport struct {
+	proxy     string
+	transport *http.Transport
+}
+
+// GetServiceTransport 返回服务请求上游使用的 http.Transport。
+// 服务配置了proxy时使用服务自己的代理，否则按全局代理策略决定是否使用全局代理；
+// 相同配置的服务共用同一个Transport以复用连接，都没有配置时同样返回共用的Transport，返回的代理地址为空
+func GetServiceTransport(s *ModelDetails) (string, *http.Transport, error) {
+	if s.Proxy != "" {
+		transport, err := getServiceProxyTransport(s.Proxy, &s.HTTPClient)
+		return redactProxyURL(s.Proxy), transport, err
+	}
+
+	if IsProxyEnabled(s) {
+		return getGlobalProxyTransport(&s.HTTPClient)
+	}
+
+	transport, err := getServiceProxyTransport("", &s.HTTPClient)
+	return "", transport, err
+}
+
+// getGlobalProxyTransport 按全局代理配置创建 http.Transport，代理配置和http_client相同时共用
+func getGlobalProxyTransport(conf *HTTPClientConf) (string, *http.Transport, error) {
+	proxyConf := getProxyConf()
+	key := fmt.Sprintf("%s|%s|%s|%d|%+v", proxyConf.Type, proxyConf.HTTPProxy, proxyConf.Socks5Proxy, proxyConf.Timeout, *conf)
+	if v, ok := globalProxyTransports.Load(key); ok {
+		gt := v.(*globalProxyTransport)
+		return gt.proxy, gt.transport, nil
+	}
+
+	proxyType, proxyAddr, transport, err := GetConfProxyTransport()
+	if err != nil {
+		return "", nil, err
+	}
+	applyHTTPClientConf(transport, conf)
+	if err := applyTLSConf(transport, conf); err != nil {
+		return "", nil, err
+	}
+	if proxyType == ProxyTypeHTTP {
+		transport.DialContext = withDNSCache(transport.DialContext, conf)
+	}
+	if err := applyPoolConf(transport, conf); err != nil {
+		return "", nil, err
+	}
+
+	v, _ := globalProxyTransports.LoadOrStore(key, &globalProxyTransport{proxy: proxyType + "://" + proxyAddr, transport: transport})
+	gt := v.(*globalProxyTransport)
+	return gt.proxy, gt.transport, nil
+}
+
+// getServiceProxyTransport 按代理地址和超时配置创建 http.Transport，相同配置的服务共用一个以复用连接
+func getServiceProxyTransport(proxyURL string, conf *HTTPClientConf) (*http.Transport, error) {
+	key := fmt.Sprintf("%s|%+v", proxyURL, *conf)
+	if v, ok := serviceTransports.Load(key); ok {
+		return v.(*http.Transport), nil
+	}
+
+	connectTimeout := conf.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultHTTPConnectTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = withDNSCache(dialer.DialContext, conf)
+	if proxyURL != "" {
+		parsedURL, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing proxy URL %s: %v", proxyURL, err)
+		}
+
+		switch strings.ToLower(parsedURL.Scheme) {
+		case "http", "https":
+			transport.Proxy = http.ProxyURL(parsedURL)
+		case "socks5", "socks5h":
+			socksDialer, err := proxy.FromURL(parsedURL, dialer)
+			if err != nil {
+				return nil, fmt.Errorf("error creating SOCKS5 proxy at %s: %v", parsedURL.Host, err)
+			}
+			transport.Proxy = nil
+			transport.DialContext = socksDialer.(proxy.ContextDialer).DialContext
+		default:
+			return nil, errors.New("unsupported proxy scheme: " + parsedURL.Scheme)
+		}
+	}
+	applyHTTPClientConf(transport, conf)
+	if err := applyTLSConf(transport, conf); err != nil {
+		return nil, err
+	}
+	if err := applyPoolConf(transport, conf); err != nil {
+		return nil, err
+	}
+
+	v, _ := serviceTransports.LoadOrStore(key, transport)
+	return v.(*http.Transport), nil
+}
+
+// redactProxyURL 隐藏代理地址中的密码，用于日志输出
+func redactProxyURL(proxyURL string) string {
+	if u, err := url.Parse(proxyURL); err == nil {
+		return u.Redacted()
+	}
+	return proxyURL
+}
+
+func applyHTTPClientConf(transport *http.Transport, conf *HTTPClientConf) {
+	if conf.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(conf.ResponseHeaderTimeout) * time.Second
+	}
+	if conf.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(conf.IdleConnTimeout) * time.Second
+	}
+}
+
+// applyPoolConf 设置连接池的大小、HTTP/2和TLS会话复用，没有配置的字段使用默认值，需要在Transport使用之前调用
+func applyPoolConf(transport *http.Transport, conf *HTTPClientConf) error {
+	transport.MaxIdleConns = DefaultHTTPMaxIdleConns
+	if conf.MaxIdleConns > 0 {
+		transport.MaxIdleConns = conf.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = DefaultHTTPMaxIdleConnsPerHost
+	if conf.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	if conf.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = conf.MaxConnsPerHost
+	}
+	if transport.IdleConnTimeout <= 0 {
+		transport.IdleConnTimeout = time.Duration(DefaultHTTPIdleConnTimeout) * time.Second
+	}
+
+	cacheSize := conf.TLSSessionCacheSize
+	if cacheSize == 0 {
+		cacheSize = DefaultTLSSessionCacheSize
+	}
+	if cacheSize > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cacheSize)
+	}
+
+	if conf.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		// 从DefaultTransport复制的TLSClientConfig中已经带有h2
+		if transport.TLSClientConfig != nil {
+			var nextProtos []string
+			for _, p := range transport.TLSClientConfig.NextProtos {
+				if p != "h2" {
+					nextProtos = append(nextProtos, p)
+				}
+			}
+			transport.TLSClientConfig.NextProtos = nextProtos
+		}
+		return nil
+	}
+	// 设置了DialContext或TLSClientConfig时需要ForceAttemptHTTP2才会使用HTTP/2
+	transport.ForceAttemptHTTP2 = true
+	if conf.HTTP2ReadIdleTimeout > 0 {
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return fmt.Errorf("error configuring http2: %v", err)
+		}
+		h2.ReadIdleTimeout = time.Duration(conf.HTTP2ReadIdleTimeout) * time.Second
+		h2.PingTimeout = time.Duration(DefaultHTTP2PingTimeout) * time.Second
+	}
+	return nil
+}
+
+// applyTLSConf 在系统根证书之外信任ca_cert中的证书，insecure_skip_verify为true时不校验上游证书
+func applyTLSConf(transport *http.Transport, conf *HTTPClientConf) error {
+	if conf.CACert == "" && !conf.InsecureSkipVerify {
+		return nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+		tlsConfig.InsecureSkipVerify = conf.InsecureSkipVerify
+	}
+
+	if conf.CACert != "" {
+		pemData := []byte(conf.CACert)
+		if !strings.Contains(conf.CACert, "-----BEGIN") {
+			data, err := os.ReadFile(conf.CACert)
+			if err != nil {
+				return fmt.Errorf("error reading ca_cert %s: %v", conf.CACert, err)
+			}
+			pemData = data
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return errors.New("no valid PEM certificate found in ca_cert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return nil
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"simple-one-api/pkg/adapter"
+	"simple-one-api/pkg/llm/claude"
+	"simple-one-api/pkg/mycommon"
+)
+
+// AnthropicMessagesHandler 处理Anthropic格式的/v1/messages请求，转换为OpenAI格式后与/v1/chat/completions的处理相同，
+// 响应再转换为Anthropic的格式，流式响应按message_start、content_block_*、message_delta、message_stop输出
+func AnthropicMessagesHandler(c *gin.Context) {
+	oaiReq, req, ok := bindAnthropicRequest(c)
+	if !ok {
+		return
+	}
+	serveInboundRequest(c, oaiReq, &anthropicConverter{model: req.Model})
+}
+
+// AnthropicCountTokensHandler 处理/v1/messages/count_tokens，按字符估算输入的token数，不请求上游
+func AnthropicCountTokensHandler(c *gin.Context) {
+	oaiReq, _, ok := bindAnthropicRequest(c)
+	if !ok {
+		return
+	}
+	tokens := mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))
+	if len(oaiReq.Tools) > 0 {
+		if data, err := json.Marshal(oaiReq.Tools); err == nil {
+			tokens += mycommon.EstimateTokens(string(data))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
+}
+
+func bindAnthropicRequest(c *gin.Context) (*openai.ChatCompletionRequest, *claude.MessagesRequest, bool) {
+	var req claude.MessagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		getLogger(c).Warn("invalid anthropic request: " + err.Error())
+		sendAnthropicError(c, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	oaiReq, err := adapter.ClaudeMessagesRequestToOpenAIRequest(&req)
+	if err != nil {
+		sendAnthropicError(c, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+	return oaiReq, &req, true
+}
+
+// anthropicErrorType 按状态码对应Anthropic的错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	}
+	if status < http.StatusInternalServerError {
+		return "invalid_request_error"
+	}
+	return "api_error"
+}
+
+func anthropicErrorBody(status int, message string) gin.H {
+	return gin.H{"type": "error", "error": gin.H{"type": anthropicErrorType(status), "message": message}}
+}
+
+func sendAnthropicError(c *gin.Context, status int, message string) {
+	c.JSON(status, anthropicErrorBody(status, message))
+}
+
+// anthropicConverter 把OpenAI格式的响应转换为Anthropic格式，只转换第一个choice；
+// 文本和每个工具调用分别是一个内容块，stop_reason和usage在[DONE]时输出
+type anthropicConverter struct {
+	model      string
+	id         string
+	started    bool
+	done       bool
+	blocks     int    // 已经开始的内容块数量，当前内容块的index为blocks-1
+	blockType  string // 当前打开的内容块类型，为空时没有打开的内容块
+	toolIndex  int
+	stopReason string
+	usage      openai.Usage
+}
+
+func (a *anthropicConverter) response(status int, body []byte) (int, []byte) {
+	if status == http.StatusOK {
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(body, &resp); err == nil && (resp.Object != "" || len(resp.Choices) > 0) {
+			if data, err := json.Marshal(adapter.OpenAIResponseToClaudeResponse(&resp, a.model)); err == nil {
+				return status, data
+			}
+		}
+		status = http.StatusBadGateway
+	}
+	data, _ := json.Marshal(anthropicErrorBody(status, openAIErrorMessage(body)))
+	return status, data
+}
+
+func (a *anthropicConverter) streamLine(line []byte) []byte {
+	payload := streamPayload(line)
+	if len(payload) == 0 || a.done {
+		return nil
+	}
+	if bytes.Equal(payload, []byte("[DONE]")) {
+		return a.finishStream()
+	}
+	if isStreamErrorPayload(payload) {
+		a.done = true
+		var out bytes.Buffer
+		writeAnthropicEvent(&out, "error", gin.H{"type": "error", "error": gin.H{"type": "api_error", "message": openAIErrorMessage(payload)}})
+		return out.Bytes()
+	}
+
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil
+	}
+	var out bytes.Buffer
+	if a.id == "" {
+		a.id = chunk.ID
+	}
+	a.start(&out)
+	if chunk.Usage != nil {
+		a.usage = *chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if choice.Delta.Content != "" {
+			if a.blockType != "text" {
+				a.openBlock(&out, "text", gin.H{"type": "text", "text": ""})
+			}
+			writeAnthropicEvent(&out, "content_block_delta", gin.H{"type": "content_block_delta", "index": a.blocks - 1,
+				"delta": gin.H{"type": "text_delta", "text": choice.Delta.Content}})
+		}
+		for i, tc := range choice.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			if a.blockType != "tool_use" || a.toolIndex != toolIndex {
+				id := tc.ID
+				if id == "" {
+					id = "toolu_" + uuid.New().String()
+				}
+				a.openBlock(&out, "tool_use", gin.H{"type": "tool_use", "id": id, "name": tc.Function.Name, "input": gin.H{}})
+				a.toolIndex = toolIndex
+			}
+			if tc.Function.Arguments != "" {
+				writeAnthropicEvent(&out, "content_block_delta", gin.H{"type": "content_block_delta", "index": a.blocks - 1,
+					"delta": gin.H{"type": "input_json_delta", "partial_json": tc.Function.Arguments}})
+			}
+		}
+		if choice.FinishReason != "" {
+			a.stopReason = adapter.FinishReasonToClaudeStopReason(string(choice.FinishReason))
+		}
+	}
+	return out.Bytes()
+}
+
+func (a *anthropicConverter) finishStream() []byte {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	var out bytes.Buffer
+	a.start(&out)
+	a.closeBlock(&out)
+	stopReason := a.stopReason
+	if stopReason == "" {
+		stopReason = string(claude.EndTurn)
+	}
+	writeAnthropicEvent(&out, "message_delta", gin.H{"type": "message_delta",
+		"delta": gin.H{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": gin.H{"input_tokens": a.usage.PromptTokens, "output_tokens": a.usage.CompletionTokens}})
+	writeAnthropicEvent(&out, "message_stop", gin.H{"type": "message_stop"})
+	return out.Bytes()
+}
+
+// start 输出message_start，input_tokens在开始时还不知道，在message_delta中返回
+func (a *anthropicConverter) start(out *bytes.Buffer) {
+	if a.started {
+		return
+	}
+	a.started = true
+	if a.id == "" {
+		a.id = uuid.New().String()
+	}
+	writeAnthropicEvent(out, "message_start", gin.H{"type": "message_start", "message": gin.H{
+		"id":            adapter.ClaudeMessageID(a.id),
+		"type":          "message",
+		"role":          openai.ChatMessageRoleAssistant,
+		"model":         a.model,
+		"content":       []interface{}{},
+		"stop_reason":   nil,
+		"stop_sequence": nil,
+		"usage":         gin.H{"input_tokens": 0, "output_tokens": 0},
+	}})
+}
+
+func (a *anthropicConverter) openBlock(out *bytes.Buffer, blockType string, block gin.H) {
+	a.closeBlock(out)
+	a.blocks++
+	a.blockType = blockType
+	writeAnthropicEvent(out, "content_block_start", gin.H{"type": "content_block_start", "index": a.blocks - 1, "content_block": block})
+}
+
+func (a *anthropicConverter) closeBlock(out *bytes.Buffer) {
+	if a.blockType == "" {
+		return
+	}
+	writeAnthropicEvent(out, "content_block_stop", gin.H{"type": "content_block_stop", "index": a.blocks - 1})
+	a.blockType = ""
+}
+
+func writeAnthropicEvent(out *bytes.Buffer, event string, data gin.H) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(out, "event: %s\ndata: %s\n\n", event, payload)
+}
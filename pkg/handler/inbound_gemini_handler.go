@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"simple-one-api/pkg/adapter"
+	googlegemini "simple-one-api/pkg/llm/google-gemini"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+const (
+	geminiActionGenerate       = "generateContent"
+	geminiActionStreamGenerate = "streamGenerateContent"
+	geminiActionCountTokens    = "countTokens"
+)
+
+// parseGeminiPath 从/v1beta/models/{model}:{action}中取出模型名称和操作
+func parseGeminiPath(path string) (string, string) {
+	idx := strings.LastIndex(path, "/models/")
+	if idx < 0 {
+		return "", ""
+	}
+	model, action, found := strings.Cut(path[idx+len("/models/"):], ":")
+	if !found {
+		return "", ""
+	}
+	return model, action
+}
+
+// IsGeminiPath 是否为Gemini格式的generateContent、streamGenerateContent或countTokens请求
+func IsGeminiPath(path string) bool {
+	_, action := parseGeminiPath(path)
+	switch action {
+	case geminiActionGenerate, geminiActionStreamGenerate, geminiActionCountTokens:
+		return true
+	}
+	return false
+}
+
+// GeminiHandler 处理Gemini格式的请求，路径中的模型作为请求的模型，转换为OpenAI格式后与/v1/chat/completions的处理相同，
+// 响应再转换为Gemini的格式；streamGenerateContent按SSE（alt=sse）输出
+func GeminiHandler(c *gin.Context) {
+	model, action := parseGeminiPath(c.Request.URL.Path)
+	if !IsGeminiPath(c.Request.URL.Path) || model == "" {
+		sendGeminiError(c, http.StatusNotFound, fmt.Sprintf("unsupported path %s", c.Request.URL.Path))
+		return
+	}
+
+	var req struct {
+		googlegemini.GeminiRequest
+		// countTokens可以直接传contents，也可以传完整的generateContent请求
+		GenerateContentRequest *googlegemini.GeminiRequest `json:"generateContentRequest,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		getLogger(c).Warn("invalid gemini request: " + err.Error())
+		sendGeminiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	geminiReq := &req.GeminiRequest
+	if req.GenerateContentRequest != nil {
+		geminiReq = req.GenerateContentRequest
+	}
+
+	oaiReq, err := adapter.GeminiRequestToOpenAIRequest(geminiReq, model, action == geminiActionStreamGenerate)
+	if err != nil {
+		sendGeminiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if action == geminiActionCountTokens {
+		c.JSON(http.StatusOK, gin.H{"totalTokens": mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))})
+		return
+	}
+	serveInboundRequest(c, oaiReq, newGeminiConverter(model))
+}
+
+// geminiErrorStatus 按HTTP状态码对应Google API的错误状态
+func geminiErrorStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	if status < http.StatusInternalServerError {
+		return "FAILED_PRECONDITION"
+	}
+	return "INTERNAL"
+}
+
+func geminiErrorBody(status int, message string) gin.H {
+	return gin.H{"error": gin.H{"code": status, "message": message, "status": geminiErrorStatus(status)}}
+}
+
+func sendGeminiError(c *gin.Context, status int, message string) {
+	c.JSON(status, geminiErrorBody(status, message))
+}
+
+// geminiConverter 把OpenAI格式的响应转换为Gemini格式。流式响应的文本按分片输出，
+// 工具调用的参数拼接完整后和finishReason、usageMetadata一起在最后一个分片中输出
+type geminiConverter struct {
+	model         string
+	done          bool
+	indexes       []int
+	toolCalls     map[int][]openai.ToolCall
+	finishReasons map[int]string
+	usage         openai.Usage
+}
+
+func newGeminiConverter(model string) *geminiConverter {
+	return &geminiConverter{model: model, toolCalls: make(map[int][]openai.ToolCall), finishReasons: make(map[int]string)}
+}
+
+func (g *geminiConverter) response(status int, body []byte) (int, []byte) {
+	if status == http.StatusOK {
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(body, &resp); err == nil && (resp.Object != "" || len(resp.Choices) > 0) {
+			geminiResp := adapter.OpenAIResponseToGeminiResponse(&resp)
+			geminiResp.ModelVersion = g.model
+			if data, err := json.Marshal(geminiResp); err == nil {
+				return status, data
+			}
+		}
+		status = http.StatusBadGateway
+	}
+	data, _ := json.Marshal(geminiErrorBody(status, openAIErrorMessage(body)))
+	return status, data
+}
+
+func (g *geminiConverter) streamLine(line []byte) []byte {
+	payload := streamPayload(line)
+	if len(payload) == 0 || g.done {
+		return nil
+	}
+	if bytes.Equal(payload, []byte("[DONE]")) {
+		return g.finishStream()
+	}
+	if isStreamErrorPayload(payload) {
+		g.done = true
+		return geminiEvent(geminiErrorBody(http.StatusInternalServerError, openAIErrorMessage(payload)))
+	}
+
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil
+	}
+	if chunk.Usage != nil {
+		g.usage = *chunk.Usage
+	}
+	var candidates []googlegemini.Candidate
+	for _, choice := range chunk.Choices {
+		g.track(choice.Index)
+		for i, tc := range choice.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			calls := g.toolCalls[choice.Index]
+			for len(calls) <= toolIndex {
+				calls = append(calls, openai.ToolCall{Type: openai.ToolTypeFunction})
+			}
+			calls[toolIndex].Function.Name += tc.Function.Name
+			calls[toolIndex].Function.Arguments += tc.Function.Arguments
+			g.toolCalls[choice.Index] = calls
+		}
+		if choice.FinishReason != "" {
+			g.finishReasons[choice.Index] = adapter.FinishReasonToGeminiFinishReason(string(choice.FinishReason))
+		}
+		if choice.Delta.Content != "" {
+			candidates = append(candidates, googlegemini.Candidate{
+				Content: googlegemini.ContentEntity{Role: mycomdef.KEYNAME_MODEL, Parts: []googlegemini.Part{{Text: choice.Delta.Content}}},
+				Index:   choice.Index,
+			})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return geminiEvent(&googlegemini.GeminiResponse{Candidates: candidates, ModelVersion: g.model})
+}
+
+func (g *geminiConverter) track(index int) {
+	for _, i := range g.indexes {
+		if i == index {
+			return
+		}
+	}
+	g.indexes = append(g.indexes, index)
+}
+
+func (g *geminiConverter) finishStream() []byte {
+	if g.done {
+		return nil
+	}
+	g.done = true
+	if len(g.indexes) == 0 {
+		g.indexes = append(g.indexes, 0)
+	}
+	resp := &googlegemini.GeminiResponse{
+		UsageMetadata: googlegemini.UsageMetadata{
+			PromptTokenCount:     g.usage.PromptTokens,
+			CandidatesTokenCount: g.usage.CompletionTokens,
+			TotalTokenCount:      g.usage.TotalTokens,
+		},
+		ModelVersion: g.model,
+	}
+	for _, index := range g.indexes {
+		parts := adapter.OpenAIMessageToGeminiParts(openai.ChatCompletionMessage{ToolCalls: g.toolCalls[index]})
+		finishReason := g.finishReasons[index]
+		if finishReason == "" {
+			finishReason = "STOP"
+		}
+		resp.Candidates = append(resp.Candidates, googlegemini.Candidate{
+			Content:      googlegemini.ContentEntity{Role: mycomdef.KEYNAME_MODEL, Parts: parts},
+			FinishReason: finishReason,
+			Index:        index,
+		})
+	}
+	return geminiEvent(resp)
+}
+
+func geminiEvent(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return []byte("data: " + string(data) + "\r\n\r\n")
+}
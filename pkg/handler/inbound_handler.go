@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// InboundAPIKeyMiddleware Anthropic和Gemini的客户端不使用Authorization请求头，没有Authorization时把x-api-key、
+// x-goog-api-key请求头或者Gemini接口的key参数转换为Bearer，之后与OpenAI接口一样鉴权
+func InboundAPIKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			key := c.GetHeader("x-api-key")
+			if key == "" {
+				key = c.GetHeader("x-goog-api-key")
+			}
+			if key == "" && IsGeminiPath(c.Request.URL.Path) {
+				// 从URL中去掉key，避免记录到日志中
+				query := c.Request.URL.Query()
+				key = query.Get("key")
+				query.Del("key")
+				c.Request.URL.RawQuery = query.Encode()
+			}
+			if key != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+key)
+			}
+		}
+		c.Next()
+	}
+}
+
+// inboundConverter 把OpenAI格式的响应转换为客户端请求的格式
+type inboundConverter interface {
+	// streamLine 转换流式响应中的一行，返回需要输出的内容
+	streamLine(line []byte) []byte
+	// finishStream 流式响应结束时输出剩余的内容，可能被调用多次
+	finishStream() []byte
+	// response 转换非流式响应以及开始流式输出之前的错误
+	response(status int, body []byte) (int, []byte)
+}
+
+// serveInboundRequest 用转换后的OpenAI请求替换请求体，与/v1/chat/completions一样处理，
+// 鉴权、限流、审核、路由、重试和模型适配都不变，输出时再由conv转换格式
+func serveInboundRequest(c *gin.Context, oaiReq *openai.ChatCompletionRequest, conv inboundConverter) {
+	data, err := json.Marshal(oaiReq)
+	if err != nil {
+		status, body := conv.response(http.StatusInternalServerError, []byte(err.Error()))
+		c.Data(status, mimeJSON, body)
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	c.Request.ContentLength = int64(len(data))
+	c.Request.Header.Set("Content-Type", mimeJSON)
+	// 是否流式由请求格式决定，不按Accept协商
+	c.Request.Header.Del("Accept")
+
+	w := newInboundWriter(c.Writer, conv)
+	c.Writer = w
+	defer w.finish()
+
+	OpenAIHandler(c)
+}
+
+// inboundWriter 流式响应逐行转换后输出，非流式响应和错误暂存到结束时整体转换
+type inboundWriter struct {
+	gin.ResponseWriter
+	conv      inboundConverter
+	status    int
+	body      bytes.Buffer
+	pending   bytes.Buffer
+	streaming bool
+}
+
+func newInboundWriter(w gin.ResponseWriter, conv inboundConverter) *inboundWriter {
+	return &inboundWriter{ResponseWriter: w, conv: conv}
+}
+
+func (w *inboundWriter) isEventStream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), mimeEventStream)
+}
+
+// startStream 第一次以流式输出时才真正写出状态码
+func (w *inboundWriter) startStream() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *inboundWriter) WriteHeader(code int) {
+	if w.streaming || w.isEventStream() {
+		w.startStream()
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *inboundWriter) WriteHeaderNow() {
+	if w.streaming || w.isEventStream() {
+		w.startStream()
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+}
+
+func (w *inboundWriter) Write(data []byte) (int, error) {
+	if !w.streaming && w.isEventStream() {
+		w.startStream()
+	}
+	if !w.streaming {
+		w.WriteHeaderNow()
+		return w.body.Write(data)
+	}
+
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := make([]byte, idx+1)
+		w.pending.Read(line)
+		if out := w.conv.streamLine(line); len(out) > 0 {
+			if _, err := w.ResponseWriter.Write(out); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(data), nil
+}
+
+func (w *inboundWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *inboundWriter) Status() int {
+	if w.streaming {
+		return w.ResponseWriter.Status()
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *inboundWriter) Size() int {
+	if w.streaming {
+		return w.ResponseWriter.Size()
+	}
+	return w.body.Len()
+}
+
+func (w *inboundWriter) Written() bool {
+	if w.streaming {
+		return w.ResponseWriter.Written()
+	}
+	return w.status != 0
+}
+
+// Unwrap 用于http.ResponseController设置写超时
+func (w *inboundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *inboundWriter) Flush() {
+	if w.streaming {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// finish 流式响应输出结束的事件，非流式响应转换后输出
+func (w *inboundWriter) finish() {
+	if w.streaming {
+		var out bytes.Buffer
+		if w.pending.Len() > 0 {
+			out.Write(w.conv.streamLine(w.pending.Bytes()))
+			w.pending.Reset()
+		}
+		out.Write(w.conv.finishStream())
+		if out.Len() > 0 {
+			w.ResponseWriter.Write(out.Bytes())
+			w.ResponseWriter.Flush()
+		}
+		return
+	}
+	if !w.Written() {
+		return
+	}
+	status, body := w.conv.response(w.Status(), w.body.Bytes())
+	w.Header().Set("Content-Type", mimeJSON)
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(body)
+}
+
+// streamPayload 取出SSE中data行的内容，中途出错时直接输出的JSON对象也返回
+func streamPayload(line []byte) []byte {
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '{' {
+		return line
+	}
+	if !bytes.HasPrefix(line, streamDataPrefix) {
+		return nil
+	}
+	return bytes.TrimSpace(line[len(streamDataPrefix):])
+}
+
+// openAIErrorMessage 取出OpenAI格式错误响应中的message，不是该格式时返回原始内容
+func openAIErrorMessage(body []byte) string {
+	var errResp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && len(errResp.Error) > 0 {
+		var errObj struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(errResp.Error, &errObj) == nil && errObj.Message != "" {
+			return errObj.Message
+		}
+		var msg string
+		if json.Unmarshal(errResp.Error, &msg) == nil && msg != "" {
+			return msg
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// isStreamErrorPayload 流式响应中的错误事件
+func isStreamErrorPayload(payload []byte) bool {
+	var chunk struct {
+		Error json.RawMessage `json:"error"`
+	}
+	return json.Unmarshal(payload, &chunk) == nil && len(chunk.Error) > 0 && string(chunk.Error) != "null"
+}
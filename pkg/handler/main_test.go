@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	mylog.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// loadTestConfig 把yaml写入临时文件并加载为当前配置
+func loadTestConfig(t testing.TB, yamlText string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yamlText), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.InitConfig(path); err != nil {
+		t.Fatalf("InitConfig: %v", err)
+	}
+}
+
+// serveTestRequest 通过gin的路由调用handler，与实际请求一样经过gin.Context的初始化
+func serveTestRequest(h gin.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	engine := gin.New()
+	engine.Handle(method, path, h)
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+// recordingChatUpstream 模拟OpenAI协议的上游，记录最后一次请求，由respond返回响应
+func recordingChatUpstream(t *testing.T, lastReq *map[string]interface{}, respond func(w http.ResponseWriter, req map[string]interface{})) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("upstream path = %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer sk-test" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req map[string]interface{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("decode upstream request: %v", err)
+		}
+		*lastReq = req
+		respond(w, req)
+	}))
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"mime"
+	"simple-one-api/pkg/config"
+	"strconv"
+	"strings"
+)
+
+const keyResponseFormat = "responseFormat"
+
+const (
+	mimeJSON        = "application/json"
+	mimeEventStream = "text/event-stream"
+	mimeNDJSON      = "application/x-ndjson"
+)
+
+// negotiateResponseFormat 按Accept中q值最高的格式选择响应方式，没有支持的格式时返回空
+func negotiateResponseFormat(accept string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case mimeJSON, mimeEventStream, mimeNDJSON:
+		default:
+			continue
+		}
+		q := 1.0
+		if v, exists := params["q"]; exists {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// applyAcceptFormat 开启accept_negotiation时按Accept请求头决定是否流式，与stream参数冲突时以Accept为准
+func applyAcceptFormat(c *gin.Context, oaiReq *openai.ChatCompletionRequest) {
+	if !config.GetConf().AcceptNegotiation {
+		return
+	}
+	format := negotiateResponseFormat(c.GetHeader("Accept"))
+	if format == "" {
+		return
+	}
+	c.Set(keyResponseFormat, format)
+
+	stream := format != mimeJSON
+	if oaiReq.Stream != stream {
+		getLogger(c).Info("stream flag overridden by accept header",
+			zap.String("accept", format),
+			zap.Bool("stream", oaiReq.Stream))
+		oaiReq.Stream = stream
+		if !stream {
+			oaiReq.StreamOptions = nil
+		}
+	}
+}
+
+func isNDJSONRequested(c *gin.Context) bool {
+	return c.GetString(keyResponseFormat) == mimeNDJSON
+}
+
+// ndjsonWriter 将SSE格式的流式响应转为每行一个JSON对象，去掉data前缀和结束标记，非流式的响应原样输出
+type ndjsonWriter struct {
+	gin.ResponseWriter
+	pending bytes.Buffer
+}
+
+func newNDJSONWriter(w gin.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{ResponseWriter: w}
+}
+
+func (w *ndjsonWriter) isEventStream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), mimeEventStream)
+}
+
+// setContentType 在响应头发送前把text/event-stream换为application/x-ndjson
+func (w *ndjsonWriter) setContentType() {
+	if !w.ResponseWriter.Written() && w.isEventStream() {
+		w.Header().Set("Content-Type", mimeNDJSON)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+}
+
+func (w *ndjsonWriter) WriteHeaderNow() {
+	w.setContentType()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *ndjsonWriter) Flush() {
+	w.setContentType()
+	w.ResponseWriter.Flush()
+}
+
+func (w *ndjsonWriter) Write(data []byte) (int, error) {
+	if !w.isEventStream() && w.Header().Get("Content-Type") != mimeNDJSON {
+		return w.ResponseWriter.Write(data)
+	}
+	w.setContentType()
+
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := make([]byte, idx+1)
+		w.pending.Read(line)
+		if out := ndjsonLine(line); out != nil {
+			if _, err := w.ResponseWriter.Write(out); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(data), nil
+}
+
+func (w *ndjsonWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// finish 输出剩余不完整的行
+func (w *ndjsonWriter) finish() {
+	if w.pending.Len() > 0 {
+		if out := ndjsonLine(w.pending.Bytes()); out != nil {
+			w.ResponseWriter.Write(out)
+		}
+		w.pending.Reset()
+	}
+}
+
+// ndjsonLine 只保留data行中的JSON对象，空行、注释、[DONE]都去掉，上游出错时直接输出的JSON原样保留
+func ndjsonLine(line []byte) []byte {
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '{' {
+		return append(line, '\n')
+	}
+	if !bytes.HasPrefix(line, streamDataPrefix) {
+		return nil
+	}
+	payload := bytes.TrimSpace(line[len(streamDataPrefix):])
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil
+	}
+	return append(payload, '\n')
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mylog"
+	"time"
+)
+
+const keyRequestID = "requestID"
+
+// maxRequestIDLength 客户端传入的请求ID超过该长度或包含其他字符时重新生成，避免写入日志的内容不可控
+const maxRequestIDLength = 128
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware 为每个请求分配请求ID，优先使用请求头X-Request-ID，并在响应头中返回，
+// 通过getLogger获取的日志都会带上request_id字段
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(mycomdef.KEYNAME_HEADER_REQUEST_ID)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		c.Set(keyRequestID, requestID)
+		c.Request = c.Request.WithContext(mylog.NewContext(c.Request.Context(), requestID))
+		c.Header(mycomdef.KEYNAME_HEADER_REQUEST_ID, requestID)
+		c.Next()
+	}
+}
+
+// getLogger 获取当前请求的日志，带有request_id字段
+func getLogger(c *gin.Context) *zap.Logger {
+	return mylog.FromContext(c.Request.Context())
+}
+
+// AccessLogMiddleware 每个请求结束后输出一条访问日志，与upstream attempts一样使用Warn级别，默认的日志级别下也能看到
+func AccessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		trace := getRequestTrace(c)
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.Int("status", c.Writer.Status()),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("key_name", getAuthKeyName(c)),
+			zap.String("model", trace.ClientModel),
+			zap.String("provider", trace.ServiceName),
+			zap.Bool("stream", trace.Stream),
+		}
+		if n := len(trace.Attempts); n > 0 {
+			fields = append(fields, zap.Int("upstream_status", trace.Attempts[n-1].Status))
+		}
+		if trace.Stream && trace.TimeToFirstToken > 0 {
+			fields = append(fields, zap.Duration("time_to_first_token", trace.TimeToFirstToken))
+		}
+		if trace.Usage != nil {
+			fields = append(fields,
+				zap.Int("prompt_tokens", trace.Usage.PromptTokens),
+				zap.Int("completion_tokens", trace.Usage.CompletionTokens))
+		}
+		getLogger(c).Warn("access", fields...)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/devplatform/baidu_agentbuilder"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 )
 
@@ -20,6 +19,11 @@ func OpenAI2AgentBuilderHandler(c *gin.Context, oaiReqParam *OAIRequestParam) er
 	credentials := oaiReqParam.creds
 	secretKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_SECRET_KEY)
 
+	client := &http.Client{}
+	if oaiReqParam.httpTransport != nil {
+		client.Transport = oaiReqParam.httpTransport
+	}
+
 	query := mycommon.GetLastestMessage(oaiReq.Messages)
 
 	if oaiReq.Stream {
@@ -28,29 +32,31 @@ func OpenAI2AgentBuilderHandler(c *gin.Context, oaiReqParam *OAIRequestParam) er
 			var resp baidu_agentbuilder.ConversationResponse
 			err := json.Unmarshal([]byte(data), &resp)
 			if err != nil {
-				mylog.Logger.Error("An error occurred",
+				getLogger(c).Error("An error occurred",
 					zap.Error(err)) // 记录错误对象
 				return
 			}
 
 			oaiRespStream := baidu_agentbuilder_adapter.AgentBuilderResponseToOpenAIStreamResponse(&resp)
 
+			utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 			oaiRespStream.Model = oaiReq.Model
 
 			respData, err := json.Marshal(&oaiRespStream)
 			if err != nil {
-				mylog.Logger.Error("Error marshaling response:", zap.Error(err))
+				getLogger(c).Error("Error marshaling response:", zap.Error(err))
 				return
 			}
 
 			// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Info("Response HTTP data",
+			getLogger(c).Debug("Response HTTP data",
 				zap.String("data", string(respData))) // 记录响应数据
 
+			utils.SetEventStreamHeaders(c)
 			_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 			if err != nil {
 				// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-				mylog.Logger.Error("An error occurred",
+				getLogger(c).Error("An error occurred",
 					zap.Error(err)) // 记录错误对象
 
 				return
@@ -58,17 +64,17 @@ func OpenAI2AgentBuilderHandler(c *gin.Context, oaiReqParam *OAIRequestParam) er
 			c.Writer.(http.Flusher).Flush()
 		}
 
-		err := baidu_agentbuilder.Conversation(oaiReq.Model, secretKey, query, cb)
+		err := baidu_agentbuilder.Conversation(c.Request.Context(), client, oaiReq.Model, secretKey, query, cb)
 		if err != nil {
 			// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Error("OpenAI2AgentBuilderHandler|baidu_agentbuilder.Conversation",
+			getLogger(c).Error("OpenAI2AgentBuilderHandler|baidu_agentbuilder.Conversation",
 				zap.Error(err)) // 记录错误对象
 
 			return err
 		}
 
 	} else {
-		abResp, err := baidu_agentbuilder.GetAnswer(oaiReq.Model, secretKey, query)
+		abResp, err := baidu_agentbuilder.GetAnswer(c.Request.Context(), client, oaiReq.Model, secretKey, query)
 		if err != nil {
 
 			return err
@@ -76,10 +82,11 @@ func OpenAI2AgentBuilderHandler(c *gin.Context, oaiReqParam *OAIRequestParam) er
 
 		oaiResp := baidu_agentbuilder_adapter.AgentBuilderResponseToOpenAIResponse(abResp)
 
+		utils.SetUpstreamModelHeader(c, oaiResp.Model)
 		oaiResp.Model = oaiReq.Model
 
 		// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-		mylog.Logger.Info("Standard response",
+		getLogger(c).Info("Standard response",
 			zap.Any("response", *oaiResp)) // 记录响应对象
 
 		c.JSON(http.StatusOK, oaiResp)
@@ -11,12 +11,15 @@ import (
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/aliyun-dashscope/common_btype"
 	"simple-one-api/pkg/llm/aliyun-dashscope/commsg/ds_com_resp"
-	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mycommon"
 	"simple-one-api/pkg/utils"
 )
 
 var dashscopeServerURL string = "https://dashscope.aliyuncs.com/api/v1/services/aigc/text-generation/generation"
 
+// dashscopeMultiModalServerURL qwen-vl等视觉模型的接口
+var dashscopeMultiModalServerURL string = "https://dashscope.aliyuncs.com/api/v1/services/aigc/multimodal-generation/generation"
+
 // 根据模型名称决定调用哪个服务
 // A表示common普通类型
 // B表示
@@ -56,7 +59,7 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 
 	bType, err := getModelProtocolType(oaiReq.Model)
 	if err != nil {
-		mylog.Logger.Error("OpenAI2AliyunDashScopeHandler|getModelProtocolType", zap.Error(err))
+		getLogger(c).Error("OpenAI2AliyunDashScopeHandler|getModelProtocolType", zap.Error(err))
 
 		return err
 	}
@@ -66,15 +69,15 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 
 	clientModel := oaiReqParam.ClientModel
 
-	mylog.Logger.Info("OpenAI2AliyunDashScopeHandler", zap.Any("oaiReq", oaiReq), zap.String("bType", bType))
+	getLogger(c).Info("OpenAI2AliyunDashScopeHandler", zap.Any("oaiReq", mycommon.ElideBase64Images(oaiReq)), zap.String("bType", bType))
 
 	if bType == "B" {
 		llamaReq := aliyun_dashscope_adapter.OpenAIRequestToDashScopeBTypeRequest(oaiReq)
 
 		reqJsonData, _ := json.Marshal(llamaReq)
-		respJson, err := utils.SendHTTPRequest(apiKey, dashscopeServerURL, reqJsonData, oaiReqParam.httpTransport)
+		respJson, err := utils.SendHTTPRequest(c.Request.Context(), apiKey, dashscopeServerURL, reqJsonData, oaiReqParam.httpTransport)
 		if err != nil {
-			mylog.Logger.Error("An error occurred", zap.Error(err))
+			getLogger(c).Error("An error occurred", zap.Error(err))
 
 			return err
 		}
@@ -86,29 +89,30 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 			utils.SetEventStreamHeaders(c)
 			oaiRespStream := aliyun_dashscope_adapter.DashScopeBTypeResponseToOpenAIStreamResponse(&resp)
 
+			utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 			oaiRespStream.Model = clientModel
 			respData, err := json.Marshal(&oaiRespStream)
 			if err != nil {
-				mylog.Logger.Error("Error marshaling response:", zap.Error(err))
+				getLogger(c).Error("Error marshaling response:", zap.Error(err))
 				return err
 			}
 
 			// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Info("Response HTTP data",
+			getLogger(c).Debug("Response HTTP data",
 				zap.String("data", string(respData))) // 记录响应数据
 
 			if oaiRespStream.Error != nil {
 				// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-				mylog.Logger.Error("Error response",
+				getLogger(c).Error("Error response",
 					zap.Any("error", *oaiRespStream.Error)) // 记录错误对象
 
-				return err
+				return errorDetailToError(oaiRespStream.Error)
 			}
 
 			_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 			if err != nil {
 				// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-				mylog.Logger.Error("An error occurred",
+				getLogger(c).Error("An error occurred",
 					zap.Error(err)) // 记录错误对象
 
 				return err
@@ -116,44 +120,50 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 			c.Writer.(http.Flusher).Flush()
 		} else {
 			oaiResp := aliyun_dashscope_adapter.DashScopeBTypeResponseToOpenAIResponse(&resp)
+			utils.SetUpstreamModelHeader(c, oaiResp.Model)
 			oaiResp.Model = clientModel
 			//待完成
 
-			mylog.Logger.Info("Standard response",
+			getLogger(c).Info("Standard response",
 				zap.Any("response", *oaiResp)) // 记录响应对象
 
 			c.JSON(http.StatusOK, oaiResp)
 		}
 
 	} else if bType == "A" {
+		serverURL := dashscopeServerURL
+		if aliyun_dashscope_adapter.IsDashScopeMultiModalModel(oaiReq.Model) {
+			serverURL = dashscopeMultiModalServerURL
+		}
 		if oaiReq.Stream {
 			utils.SetEventStreamHeaders(c)
 			commReq := aliyun_dashscope_adapter.OpenAIRequestToDashScopeCommonRequest(oaiReq)
-			mylog.Logger.Info("OpenAI2AliyunDashScopeHandler", zap.Any("commReq", commReq))
+			getLogger(c).Info("OpenAI2AliyunDashScopeHandler", zap.String("commReq", mycommon.ElideBase64JSON(commReq)))
 
 			reqJsonData, _ := json.Marshal(commReq)
 
 			var dsLastestStreamResp *ds_com_resp.ModelStreamResponse
-			err := utils.SendSSERequest(apiKey, dashscopeServerURL, reqJsonData, func(data string) {
-				mylog.Logger.Debug("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.String("data", data))
+			err := utils.SendSSERequest(c.Request.Context(), apiKey, serverURL, reqJsonData, func(data string) {
+				getLogger(c).Debug("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.String("data", data))
 
 				var dsResp ds_com_resp.ModelStreamResponse
 				json.Unmarshal([]byte(data), &dsResp)
 
-				prevContent := aliyun_dashscope_adapter.GetStreamResponseContent(dsLastestStreamResp)
-				oaiStreamResp := aliyun_dashscope_adapter.DashScopeCommonResponseToOpenAIStreamResponse(&dsResp, prevContent)
+				prevMsg := aliyun_dashscope_adapter.GetStreamResponseMessage(dsLastestStreamResp)
+				oaiStreamResp := aliyun_dashscope_adapter.DashScopeCommonResponseToOpenAIStreamResponse(&dsResp, prevMsg)
 
-				mylog.Logger.Debug("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.Any("oaiStreamResp", oaiStreamResp))
+				getLogger(c).Debug("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.Any("oaiStreamResp", oaiStreamResp))
 
 				dsLastestStreamResp = &dsResp
 
+				utils.SetUpstreamModelHeader(c, oaiStreamResp.Model)
 				oaiStreamResp.Model = clientModel
 				respJsonData, _ := json.Marshal(oaiStreamResp)
 
 				_, err := c.Writer.WriteString("data: " + string(respJsonData) + "\n\n")
 				if err != nil {
 					// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-					mylog.Logger.Error("An error occurred", zap.Error(err)) // 记录错误对象
+					getLogger(c).Error("An error occurred", zap.Error(err)) // 记录错误对象
 
 					return
 				}
@@ -161,7 +171,7 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 			}, oaiReqParam.httpTransport)
 
 			if err != nil {
-				mylog.Logger.Error("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.Error(err))
+				getLogger(c).Error("OpenAI2AliyunDashScopeHandler|utils.SendSSERequest", zap.Error(err))
 
 				return err
 			}
@@ -169,9 +179,9 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 		} else {
 			commReq := aliyun_dashscope_adapter.OpenAIRequestToDashScopeCommonRequest(oaiReq)
 			reqJsonData, _ := json.Marshal(commReq)
-			respJson, err := utils.SendHTTPRequest(apiKey, dashscopeServerURL, reqJsonData, oaiReqParam.httpTransport)
+			respJson, err := utils.SendHTTPRequest(c.Request.Context(), apiKey, serverURL, reqJsonData, oaiReqParam.httpTransport)
 			if err != nil {
-				mylog.Logger.Error("An error occurred", zap.Error(err))
+				getLogger(c).Error("An error occurred", zap.Error(err))
 
 				return err
 			}
@@ -181,9 +191,10 @@ func OpenAI2AliyunDashScopeHandler(c *gin.Context, oaiReqParam *OAIRequestParam)
 
 			oaiResp := aliyun_dashscope_adapter.DashScopeCommonResponseToOpenAIResponse(&commResp)
 			//待完成
+			utils.SetUpstreamModelHeader(c, oaiResp.Model)
 			oaiResp.Model = clientModel
 
-			mylog.Logger.Info("Standard response",
+			getLogger(c).Info("Standard response",
 				zap.Any("response", *oaiResp)) // 记录响应对象
 
 			c.JSON(http.StatusOK, oaiResp)
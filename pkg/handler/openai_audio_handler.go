@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// azureAudioAPIVersion Azure的whisper和tts接口需要较新的api-version
+const azureAudioAPIVersion = "2024-06-01"
+
+const (
+	audioTranscriptions = "transcriptions"
+	audioTranslations   = "translations"
+	audioSpeech         = "speech"
+)
+
+// audioAdapter 各服务语音接口的差异
+type audioAdapter struct {
+	// defaultServerURL 服务没有配置server_url时使用的地址
+	defaultServerURL string
+	// xunfei 使用讯飞的语音听写和语音合成接口，不是OpenAI协议
+	xunfei bool
+}
+
+// audioServices 支持语音转写和语音合成的服务
+var audioServices = map[string]audioAdapter{
+	"openai":  {defaultServerURL: "https://api.openai.com/v1"},
+	"azure":   {},
+	"groq":    {defaultServerURL: "https://api.groq.com/openai/v1"},
+	"xinghuo": {xunfei: true},
+}
+
+// audioUpstream 语音请求使用的服务、凭证和上游模型
+type audioUpstream struct {
+	s             *config.ModelDetails
+	adapter       audioAdapter
+	clientModel   string
+	upstreamModel string
+	oaiReqParam   *OAIRequestParam
+	release       func()
+}
+
+// resolveAudioUpstream 按模型查找支持语音接口的服务并获取凭证，失败时已经返回了错误响应
+func resolveAudioUpstream(c *gin.Context, clientModel string) (*audioUpstream, bool) {
+	if clientModel == "" {
+		sendErrorResponse(c, http.StatusBadRequest, "model is required")
+		return nil, false
+	}
+	if !checkModelAllowed(c, clientModel) {
+		return nil, false
+	}
+
+	model := config.GetGlobalModelRedirect(clientModel)
+	s, err := config.GetModelService(config.ResolveTenantModel(getTenantName(c), model))
+	if err != nil {
+		getLogger(c).Warn("audio model not found", zap.String("model", model), zap.Error(err))
+		sendModelNotFoundResponse(c, clientModel)
+		return nil, false
+	}
+	adapter, supported := audioServices[strings.ToLower(s.ServiceName)]
+	if !supported {
+		sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("service %s does not support audio", s.ServiceName))
+		return nil, false
+	}
+	if !adapter.xunfei && s.ServerURL == "" {
+		sd := *s
+		sd.ServerURL = adapter.defaultServerURL
+		s = &sd
+	}
+
+	upstreamModel := config.GetModelMapping(s, config.GetModelRedirect(s, model))
+	creds, credsID := mycommon.GetACredentials(s, upstreamModel)
+	release := func() {}
+	if credsID != "" {
+		mycommon.AcquireCredential(credsID)
+		release = func() { mycommon.ReleaseCredential(credsID) }
+	}
+
+	oaiReqParam := &OAIRequestParam{
+		chatCompletionReq: &openai.ChatCompletionRequest{Model: upstreamModel},
+		modelDetails:      s,
+		creds:             creds,
+		ClientModel:       clientModel,
+	}
+	if _, transport, err := config.GetServiceTransport(s); err != nil {
+		getLogger(c).Error("GetServiceTransport", zap.String("service_name", s.ServiceName), zap.Error(err))
+	} else {
+		oaiReqParam.httpTransport = mytrace.WrapTransport(transport)
+	}
+
+	return &audioUpstream{
+		s:             s,
+		adapter:       adapter,
+		clientModel:   clientModel,
+		upstreamModel: upstreamModel,
+		oaiReqParam:   oaiReqParam,
+		release:       release,
+	}, true
+}
+
+// newAudioRequest 创建OpenAI协议的语音请求，Azure使用部署名称的地址和api-key请求头
+func newAudioRequest(c *gin.Context, up *audioUpstream, endpoint string, body io.Reader, contentType string) (*http.Request, *http.Client, error) {
+	s := up.s
+	var conf openai.ClientConfig
+	var err error
+	isAzure := strings.ToLower(s.ServiceName) == "azure"
+	if isAzure {
+		conf, err = getAzureConfig(c, s, up.oaiReqParam)
+	} else {
+		conf, err = getConfig(c, s, up.oaiReqParam)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqURL := strings.TrimRight(conf.BaseURL, "/") + "/audio/" + endpoint
+	if isAzure {
+		reqURL = fmt.Sprintf("%s/openai/deployments/%s/audio/%s?api-version=%s",
+			strings.TrimRight(conf.BaseURL, "/"), url.PathEscape(conf.AzureModelMapperFunc(up.upstreamModel)), endpoint,
+			url.QueryEscape(getAzureAPIVersion(s, up.upstreamModel, azureAudioAPIVersion)))
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, reqURL, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	apiKey, _ := utils.GetStringFromMap(up.oaiReqParam.creds, config.KEYNAME_API_KEY)
+	if isAzure {
+		token, isAD, err := getAzureADToken(s, up.oaiReqParam.creds, conf.HTTPClient.Transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isAD {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.Header.Set("api-key", apiKey)
+		}
+	} else {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		if conf.OrgID != "" {
+			req.Header.Set("OpenAI-Organization", conf.OrgID)
+		}
+	}
+	return req, conf.HTTPClient, nil
+}
+
+// proxyAudioResponse 原样返回上游的状态码、Content-Type和响应体，音频边读边写给客户端
+func proxyAudioResponse(c *gin.Context, up *audioUpstream, req *http.Request, client *http.Client) {
+	resp, err := client.Do(req)
+	if err != nil {
+		getLogger(c).Error("audio request", zap.String("service_name", up.s.ServiceName), zap.Error(err))
+		sendUpstreamErrorResponse(c, up.s.ServiceName, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		getLogger(c).Warn("audio upstream error",
+			zap.String("service_name", up.s.ServiceName),
+			zap.Int("status_code", resp.StatusCode))
+	}
+	utils.SetUpstreamModelHeader(c, up.upstreamModel)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		c.Header("Content-Type", contentType)
+	}
+	c.Status(resp.StatusCode)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				getLogger(c).Warn("read audio response", zap.String("service_name", up.s.ServiceName), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// AudioTranscriptionsHandler handles POST requests on /v1/audio/transcriptions path
+func AudioTranscriptionsHandler(c *gin.Context) {
+	handleAudioFileRequest(c, audioTranscriptions)
+}
+
+// AudioTranslationsHandler handles POST requests on /v1/audio/translations path
+func AudioTranslationsHandler(c *gin.Context) {
+	handleAudioFileRequest(c, audioTranslations)
+}
+
+// handleAudioFileRequest 上传音频文件的接口，将multipart表单中的model替换为上游模型后转发
+func handleAudioFileRequest(c *gin.Context, endpoint string) {
+	if !validateRequestMethod(c, "POST") {
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		return
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		sendErrorResponse(c, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	up, ok := resolveAudioUpstream(c, c.PostForm("model"))
+	if !ok {
+		return
+	}
+	defer up.release()
+
+	getLogger(c).Info("audio request",
+		zap.String("endpoint", endpoint),
+		zap.String("service_name", up.s.ServiceName),
+		zap.String("client_model", up.clientModel),
+		zap.String("upstream_model", up.upstreamModel),
+		zap.String("filename", files[0].Filename),
+		zap.Int64("size", files[0].Size))
+
+	if up.adapter.xunfei {
+		if endpoint != audioTranscriptions {
+			sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("service %s does not support audio %s", up.s.ServiceName, endpoint))
+			return
+		}
+		xunfeiTranscription(c, up, form)
+		return
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, values := range form.Value {
+		if name == "model" {
+			continue
+		}
+		for _, v := range values {
+			if err = mw.WriteField(name, v); err != nil {
+				sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	if err = mw.WriteField("model", up.upstreamModel); err != nil {
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = copyFormFile(mw, files[0]); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "read file: "+err.Error())
+		return
+	}
+	if err = mw.Close(); err != nil {
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	req, client, err := newAudioRequest(c, up, endpoint, &body, mw.FormDataContentType())
+	if err != nil {
+		getLogger(c).Error("audio config", zap.String("service_name", up.s.ServiceName), zap.Error(err))
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	proxyAudioResponse(c, up, req, client)
+}
+
+// copyFormFile 将客户端上传的文件写入新的表单，保留文件名和Content-Type
+func copyFormFile(mw *multipart.Writer, fh *multipart.FileHeader) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := make(map[string][]string)
+	h["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(fh.Filename))}
+	contentType := fh.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h["Content-Type"] = []string{contentType}
+
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// AudioSpeechHandler handles POST requests on /v1/audio/speech path
+func AudioSpeechHandler(c *gin.Context) {
+	if !validateRequestMethod(c, "POST") {
+		return
+	}
+
+	// 使用map保留客户端的所有参数，只替换model
+	var req map[string]interface{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	input, _ := req["input"].(string)
+	if input == "" {
+		sendErrorResponse(c, http.StatusBadRequest, "input is required")
+		return
+	}
+
+	clientModel, _ := req["model"].(string)
+	up, ok := resolveAudioUpstream(c, clientModel)
+	if !ok {
+		return
+	}
+	defer up.release()
+
+	getLogger(c).Info("audio request",
+		zap.String("endpoint", audioSpeech),
+		zap.String("service_name", up.s.ServiceName),
+		zap.String("client_model", up.clientModel),
+		zap.String("upstream_model", up.upstreamModel),
+		zap.Int("input_length", len([]rune(input))))
+
+	if up.adapter.xunfei {
+		xunfeiSpeech(c, up, req)
+		return
+	}
+
+	req["model"] = up.upstreamModel
+	body, err := json.Marshal(req)
+	if err != nil {
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpReq, client, err := newAudioRequest(c, up, audioSpeech, bytes.NewReader(body), "application/json")
+	if err != nil {
+		getLogger(c).Error("audio config", zap.String("service_name", up.s.ServiceName), zap.Error(err))
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	proxyAudioResponse(c, up, httpReq, client)
+}
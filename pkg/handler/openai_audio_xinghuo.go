@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	xunfei_speech "simple-one-api/pkg/llm/xunfei-speech"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// xunfeiDefaultVoice OpenAI的音色名称对应讯飞的默认发音人
+const xunfeiDefaultVoice = "xiaoyan"
+
+var openaiVoices = map[string]bool{
+	"alloy": true, "ash": true, "coral": true, "echo": true, "fable": true,
+	"onyx": true, "nova": true, "sage": true, "shimmer": true,
+}
+
+// xunfeiIATLanguages 客户端的language对应讯飞语音听写的语种
+var xunfeiIATLanguages = map[string]string{
+	"":   "zh_cn",
+	"zh": "zh_cn",
+	"en": "en_us",
+}
+
+func newXunfeiSpeechClient(up *audioUpstream) *xunfei_speech.Client {
+	creds := up.oaiReqParam.creds
+	appid, _ := utils.GetStringFromMap(creds, config.KEYNAME_APPID)
+	apiKey, _ := utils.GetStringFromMap(creds, config.KEYNAME_API_KEY)
+	apiSecret, _ := utils.GetStringFromMap(creds, config.KEYNAME_API_SECRET)
+	return &xunfei_speech.Client{
+		AppID:     appid,
+		APIKey:    apiKey,
+		APISecret: apiSecret,
+		Transport: mytrace.BaseTransport(up.oaiReqParam.httpTransport),
+	}
+}
+
+// xunfeiServerURL 星火服务的server_url是大模型的地址，只有配置为语音接口的地址（以/tts或/iat结尾）时才使用
+func xunfeiServerURL(s *config.ModelDetails, suffix string) string {
+	if strings.HasSuffix(strings.TrimRight(s.ServerURL, "/"), suffix) {
+		return s.ServerURL
+	}
+	return ""
+}
+
+// xunfeiSpeech 使用讯飞语音合成，音频分片一收到就写给客户端
+func xunfeiSpeech(c *gin.Context, up *audioUpstream, req map[string]interface{}) {
+	input, _ := req["input"].(string)
+	format, _ := req["response_format"].(string)
+
+	ttsReq := &xunfei_speech.TTSRequest{Text: input}
+	var contentType string
+	switch format {
+	case "", "mp3":
+		ttsReq.Encoding = "lame"
+		contentType = "audio/mpeg"
+	case "pcm":
+		ttsReq.Encoding = "raw"
+		contentType = "audio/pcm"
+	default:
+		sendErrorResponse(c, http.StatusBadRequest, "response_format "+format+" is not supported by xunfei, use mp3 or pcm")
+		return
+	}
+
+	ttsReq.Voice, _ = req["voice"].(string)
+	if ttsReq.Voice == "" || openaiVoices[ttsReq.Voice] {
+		ttsReq.Voice = xunfeiDefaultVoice
+	}
+	// OpenAI的speed为0.25-4.0，默认1.0，对应讯飞的50
+	if speed, ok := req["speed"].(float64); ok && speed > 0 {
+		ttsReq.Speed = min(max(int(math.Round(speed*50)), 1), 100)
+	}
+
+	started := false
+	err := newXunfeiSpeechClient(up).Synthesize(c.Request.Context(), xunfeiServerURL(up.s, "/tts"), ttsReq, func(audio []byte) error {
+		if !started {
+			started = true
+			utils.SetUpstreamModelHeader(c, up.upstreamModel)
+			c.Header("Content-Type", contentType)
+			c.Status(http.StatusOK)
+		}
+		if _, err := c.Writer.Write(audio); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err == nil {
+		return
+	}
+
+	getLogger(c).Error("xunfei tts", zap.String("service_name", up.s.ServiceName), zap.Bool("started", started), zap.Error(err))
+	if !started {
+		sendXunfeiError(c, err)
+	}
+}
+
+// xunfeiTranscription 使用讯飞语音听写识别上传的音频，支持16k或8k采样率16bit单声道的wav、16k的pcm和mp3
+func xunfeiTranscription(c *gin.Context, up *audioUpstream, form *multipart.Form) {
+	fh := form.File["file"][0]
+	language, exists := xunfeiIATLanguages[strings.ToLower(c.PostForm("language"))]
+	if !exists {
+		sendErrorResponse(c, http.StatusBadRequest, "language "+c.PostForm("language")+" is not supported by xunfei, use zh or en")
+		return
+	}
+	responseFormat := c.DefaultPostForm("response_format", "json")
+	if responseFormat != "json" && responseFormat != "text" && responseFormat != "verbose_json" {
+		sendErrorResponse(c, http.StatusBadRequest, "response_format "+responseFormat+" is not supported by xunfei, use json, text or verbose_json")
+		return
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "read file: "+err.Error())
+		return
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "read file: "+err.Error())
+		return
+	}
+
+	iatReq := &xunfei_speech.IATRequest{Language: language}
+	sampleRate := 16000
+	switch strings.ToLower(filepath.Ext(fh.Filename)) {
+	case ".wav":
+		iatReq.Audio, sampleRate, err = parseWavPCM(data)
+		if err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		iatReq.Encoding = "raw"
+	case ".pcm", ".raw":
+		iatReq.Audio = data
+		iatReq.Encoding = "raw"
+	case ".mp3":
+		iatReq.Audio = data
+		iatReq.Encoding = "lame"
+	default:
+		sendErrorResponse(c, http.StatusBadRequest, "file format "+filepath.Ext(fh.Filename)+" is not supported by xunfei, use wav, pcm or mp3")
+		return
+	}
+	if sampleRate == 8000 {
+		iatReq.Format = "audio/L16;rate=8000"
+	} else {
+		iatReq.Format = "audio/L16;rate=16000"
+	}
+
+	text, err := newXunfeiSpeechClient(up).Recognize(c.Request.Context(), xunfeiServerURL(up.s, "/iat"), iatReq)
+	if err != nil {
+		getLogger(c).Error("xunfei iat", zap.String("service_name", up.s.ServiceName), zap.Error(err))
+		sendXunfeiError(c, err)
+		return
+	}
+
+	utils.SetUpstreamModelHeader(c, up.upstreamModel)
+	switch responseFormat {
+	case "text":
+		c.String(http.StatusOK, text)
+	case "verbose_json":
+		resp := gin.H{"task": "transcribe", "language": language, "text": text}
+		if iatReq.Encoding == "raw" {
+			resp["duration"] = float64(len(iatReq.Audio)) / float64(sampleRate*2)
+		}
+		c.JSON(http.StatusOK, resp)
+	default:
+		c.JSON(http.StatusOK, gin.H{"text": text})
+	}
+}
+
+// parseWavPCM 解析wav文件，返回pcm数据和采样率，只支持讯飞可以识别的16bit单声道16k或8k的pcm
+func parseWavPCM(data []byte) ([]byte, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("invalid wav file")
+	}
+
+	var sampleRate int
+	var fmtFound bool
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, errors.New("invalid wav fmt chunk")
+			}
+			audioFormat := binary.LittleEndian.Uint16(body[0:2])
+			channels := binary.LittleEndian.Uint16(body[2:4])
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bitsPerSample := binary.LittleEndian.Uint16(body[14:16])
+			if audioFormat != 1 || channels != 1 || bitsPerSample != 16 || (sampleRate != 16000 && sampleRate != 8000) {
+				return nil, 0, errors.New("wav must be 16bit mono pcm with 16000 or 8000 sample rate")
+			}
+			fmtFound = true
+		case "data":
+			if !fmtFound {
+				return nil, 0, errors.New("invalid wav file, data chunk before fmt chunk")
+			}
+			return body, sampleRate, nil
+		}
+		// chunk按2字节对齐
+		pos += 8 + size + size%2
+	}
+	return nil, 0, errors.New("invalid wav file, data chunk not found")
+}
+
+// sendXunfeiError 讯飞返回的错误码大多是鉴权、参数和额度问题，以502返回错误信息
+func sendXunfeiError(c *gin.Context, err error) {
+	var xfErr *xunfei_speech.Error
+	if errors.As(err, &xfErr) {
+		sendErrorResponse(c, http.StatusBadGateway, xfErr.Error())
+		return
+	}
+	sendUpstreamErrorResponse(c, "xinghuo", err)
+}
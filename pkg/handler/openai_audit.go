@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myaudit"
+	"simple-one-api/pkg/mycommon"
+	"time"
+)
+
+// recordAudit 请求结束后写入审计日志，开启include_content时保存脱敏后的请求和响应，命中响应缓存的请求也会记录
+func recordAudit(c *gin.Context, trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) {
+	if !myaudit.Enabled() {
+		return
+	}
+
+	resp := recorder.parse(trace.Stream)
+	record := &myaudit.Record{
+		Timestamp:        trace.StartTime.Unix(),
+		RequestID:        c.GetString(keyRequestID),
+		KeyName:          trace.KeyName,
+		ClientModel:      trace.ClientModel,
+		Model:            trace.Model,
+		ServiceName:      trace.ServiceName,
+		Stream:           trace.Stream,
+		StatusCode:       recorder.Status(),
+		LatencyMs:        time.Since(trace.StartTime).Milliseconds(),
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		Error:            myaudit.Redact(mycommon.RedactSensitiveText(resp.ErrorMessage)),
+	}
+
+	if myaudit.IncludeContent() {
+		logReq := mycommon.RedactRequestPaths(mycommon.ElideBase64Images(oaiReq), config.GetRedactPaths(oaiReq.Model))
+		if reqData, err := json.Marshal(logReq); err == nil {
+			record.Prompt = myaudit.Redact(mycommon.RedactSensitiveText(string(reqData)))
+		}
+		record.Response = myaudit.Redact(mycommon.RedactSensitiveText(resp.Content))
+	}
+
+	myaudit.AddRecord(record)
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mykeys"
+	"simple-one-api/pkg/utils"
+)
+
+const keyAuthKey = "authKey"
+
+// authKey 通过鉴权的客户端key，name用于日志和指标，不包含原始的key
+type authKey struct {
+	name string
+	conf *config.APIKeyConfig
+}
+
+// AuthMiddleware 校验请求头 Authorization: Bearer 中的key，缺少或无效时返回401
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apikey, _ := utils.GetAPIKeyFromHeader(c)
+		keyConf, err := authenticateAPIKey(apikey)
+		if err != nil {
+			getLogger(c).Warn("authentication failed", zap.String("key", mycommon.MaskKey(apikey)), zap.String("path", c.Request.URL.Path), zap.Error(err))
+			sendErrorResponse(c, http.StatusUnauthorized, err.Error())
+			c.Abort()
+			return
+		}
+
+		ak := &authKey{name: mycommon.MaskKey(apikey), conf: keyConf}
+		if keyConf != nil && keyConf.Name != "" {
+			ak.name = keyConf.Name
+		}
+		c.Set(keyAuthKey, ak)
+		c.Next()
+	}
+}
+
+// authenticateAPIKey 开启key管理时先校验虚拟key，不是虚拟key时再按配置文件中的api_key和api_keys校验，
+// 此时即使配置文件中没有配置key也必须带上有效的key
+func authenticateAPIKey(apikey string) (*config.APIKeyConfig, error) {
+	if !mykeys.Enabled() {
+		return config.AuthenticateAPIKey(apikey)
+	}
+	if apikey == "" {
+		return nil, config.ErrMissingAPIKey
+	}
+	if keyConf, err := mykeys.Authenticate(apikey); !errors.Is(err, mykeys.ErrKeyNotFound) {
+		return keyConf, err
+	}
+	if !config.HasAPIKeys() {
+		return nil, config.ErrInvalidAPIKey
+	}
+	return config.AuthenticateAPIKey(apikey)
+}
+
+func getAuthKey(c *gin.Context) *authKey {
+	if v, exists := c.Get(keyAuthKey); exists {
+		if ak, ok := v.(*authKey); ok {
+			return ak
+		}
+	}
+	return nil
+}
+
+// getAuthKeyName 获取当前请求的key名称，没有配置名称时为掩码后的key
+func getAuthKeyName(c *gin.Context) string {
+	if ak := getAuthKey(c); ak != nil {
+		return ak.name
+	}
+	return ""
+}
+
+// getTenantName 获取当前请求的key所属的租户，不属于租户时为空
+func getTenantName(c *gin.Context) string {
+	if ak := getAuthKey(c); ak != nil && ak.conf != nil {
+		return ak.conf.Tenant()
+	}
+	return ""
+}
+
+// checkModelAllowed 检查当前请求的key是否可以使用模型，不可以时返回403
+func checkModelAllowed(c *gin.Context, model string) bool {
+	ak := getAuthKey(c)
+	if ak == nil || config.IsModelAllowed(ak.conf, model) {
+		return true
+	}
+	getLogger(c).Warn("model not allowed for this key", zap.String("key_name", ak.name), zap.String("model", model))
+	sendErrorResponse(c, http.StatusForbidden, fmt.Sprintf("the model '%s' is not allowed for this API key", model))
+	return false
+}
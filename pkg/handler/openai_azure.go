@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/utils"
+	"strings"
+	"sync"
+)
+
+// azureTokenSources 按服务主体缓存的Entra ID token，过期前复用
+var azureTokenSources sync.Map
+
+// getAzureDeployment 返回deployments中配置的部署名称，没有配置时返回空
+func getAzureDeployment(s *config.ModelDetails, model string) string {
+	if d, exists := s.Azure.Deployments[model]; exists {
+		return d.Deployment
+	}
+	return ""
+}
+
+// getAzureAPIVersion 依次使用部署的api_version、服务的api_version和defaultVersion
+func getAzureAPIVersion(s *config.ModelDetails, model string, defaultVersion string) string {
+	if d, exists := s.Azure.Deployments[model]; exists && d.APIVersion != "" {
+		return d.APIVersion
+	}
+	if s.Azure.APIVersion != "" {
+		return s.Azure.APIVersion
+	}
+	return defaultVersion
+}
+
+// getAzureADToken 返回Entra ID的access token，凭证中没有配置服务主体和azure_ad_token时返回false，使用api-key鉴权
+func getAzureADToken(s *config.ModelDetails, credentials map[string]interface{}, transport http.RoundTripper) (string, bool, error) {
+	if token, _ := utils.GetStringFromMap(credentials, config.KEYNAME_AZURE_AD_TOKEN); token != "" {
+		return token, true, nil
+	}
+	tenantID, _ := utils.GetStringFromMap(credentials, config.KEYNAME_AZURE_TENANT_ID)
+	clientID, _ := utils.GetStringFromMap(credentials, config.KEYNAME_AZURE_CLIENT_ID)
+	clientSecret, _ := utils.GetStringFromMap(credentials, config.KEYNAME_AZURE_CLIENT_SECRET)
+	if tenantID == "" || clientID == "" || clientSecret == "" {
+		return "", false, nil
+	}
+
+	authorityHost := s.Azure.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = config.DefaultAzureAuthorityHost
+	}
+	scope := s.Azure.Scope
+	if scope == "" {
+		scope = config.DefaultAzureScope
+	}
+	tokenURL := strings.TrimRight(authorityHost, "/") + "/" + tenantID + "/oauth2/v2.0/token"
+	key := tokenURL + "|" + scope + "|" + clientID + "|" + clientSecret
+
+	ts, ok := azureTokenSources.Load(key)
+	if !ok {
+		ctx := context.Background()
+		if transport != nil {
+			ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+		}
+		cc := &clientcredentials.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			TokenURL:     tokenURL,
+			Scopes:       []string{scope},
+			AuthStyle:    oauth2.AuthStyleInParams,
+		}
+		ts, _ = azureTokenSources.LoadOrStore(key, cc.TokenSource(ctx))
+	}
+	token, err := ts.(oauth2.TokenSource).Token()
+	if err != nil {
+		return "", true, err
+	}
+	return token.AccessToken, true, nil
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+const keyBackendPreference = "backendPreference"
+
+// backendPreference 客户端通过 X-Backend-Preference 指定的后端顺序
+type backendPreference struct {
+	names      []string
+	model      string
+	candidates []*config.ModelDetails
+	next       int
+}
+
+// parseBackendPreference 解析客户端指定的后端顺序，需要开启配置，并且配置了api_keys时只允许其中的key使用
+func parseBackendPreference(c *gin.Context) {
+	header := c.GetHeader(mycomdef.KEYNAME_HEADER_BACKEND_PREFERENCE)
+	conf := &config.GetConf().BackendPreference
+	if header == "" || !conf.Enable {
+		return
+	}
+
+	if len(conf.APIKeys) > 0 {
+		apikey, _ := utils.GetAPIKeyFromHeader(c)
+		allowed := false
+		for _, k := range conf.APIKeys {
+			if k == apikey {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			getLogger(c).Warn("backend preference not allowed for this key", zap.String("apikey", mycommon.MaskKey(apikey)))
+			return
+		}
+	}
+
+	var names []string
+	for _, name := range strings.Split(header, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		c.Set(keyBackendPreference, &backendPreference{names: names})
+	}
+}
+
+func getBackendPreference(c *gin.Context) *backendPreference {
+	if v, exists := c.Get(keyBackendPreference); exists {
+		if bp, ok := v.(*backendPreference); ok {
+			return bp
+		}
+	}
+	return nil
+}
+
+// getPreferredModelDetails 按客户端指定的顺序选择可用的后端，没有指定时优先使用会话上次使用的服务，都不可用时使用默认的选择方式
+func getPreferredModelDetails(c *gin.Context, oaiReq *openai.ChatCompletionRequest) (*config.ModelDetails, string, error) {
+	if s := getPinnedService(c, oaiReq.Model); s != nil {
+		return s, oaiReq.Model, nil
+	}
+
+	bp := getBackendPreference(c)
+	if bp == nil || oaiReq.Model == config.KEYNAME_RANDOM {
+		if s := getAffinityService(c, oaiReq); s != nil {
+			return s, oaiReq.Model, nil
+		}
+		return getModelDetails(c, oaiReq)
+	}
+
+	if bp.model != oaiReq.Model {
+		bp.model = oaiReq.Model
+		bp.candidates = nil
+		bp.next = 0
+		for _, name := range bp.names {
+			if s, err := config.GetModelServiceByName(oaiReq.Model, name); err == nil {
+				bp.candidates = append(bp.candidates, s)
+			}
+		}
+	}
+
+	for ; bp.next < len(bp.candidates); bp.next++ {
+		s := bp.candidates[bp.next]
+		if mycommon.IsServiceUnavailable(s) {
+			getLogger(c).Warn("preferred backend is unavailable", zap.String("service_name", s.ServiceName))
+			continue
+		}
+		getLogger(c).Info("use preferred backend", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model))
+		return s, oaiReq.Model, nil
+	}
+
+	getLogger(c).Info("no valid preferred backend, use default order", zap.Strings("preference", bp.names))
+	return getModelDetails(c, oaiReq)
+}
+
+// tryBackendPreferenceFallback 请求失败时按客户端指定的顺序切换到下一个后端
+func tryBackendPreferenceFallback(c *gin.Context, origReq *openai.ChatCompletionRequest, clientModel string, err error) bool {
+	bp := getBackendPreference(c)
+	if bp == nil || c.Writer.Written() || bp.next+1 >= len(bp.candidates) || !isUpstreamUnavailable(err) {
+		return false
+	}
+	if !mycommon.AcquireRetryBudget(bp.candidates[bp.next]) {
+		return false
+	}
+
+	getLogger(c).Warn("preferred backend failed, try next",
+		zap.String("service_name", bp.candidates[bp.next].ServiceName),
+		zap.String("next_service_name", bp.candidates[bp.next+1].ServiceName),
+		zap.Error(err))
+	bp.next++
+
+	nextReq := mycommon.DeepCopyChatCompletionRequest(*origReq)
+	handleOpenAIRequestWithClientModel(c, &nextReq, clientModel)
+
+	return true
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"mime"
+	"net/http"
+	"simple-one-api/pkg/mybatch"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBatchListLimit = 20
+	maxBatchListLimit     = 100
+)
+
+// getBatchOwner 文件和任务属于创建它的key，返回key的sha256和原始的key，没有配置key时所有请求共用
+func getBatchOwner(c *gin.Context) (string, string) {
+	apikey, _ := utils.GetAPIKeyFromHeader(c)
+	if apikey == "" {
+		return "", ""
+	}
+	sum := sha256.Sum256([]byte(apikey))
+	return hex.EncodeToString(sum[:]), apikey
+}
+
+func checkBatchEnabled(c *gin.Context) bool {
+	if !mybatch.Enabled() {
+		sendErrorResponse(c, http.StatusNotFound, "batch api is not enabled")
+		return false
+	}
+	return true
+}
+
+// sendBatchError 文件或任务不存在时返回404，其他错误是请求参数的问题
+func sendBatchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, mybatch.ErrFileNotFound), errors.Is(err, mybatch.ErrBatchNotFound):
+		sendErrorResponse(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, mybatch.ErrFileTooLarge):
+		sendErrorResponse(c, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+	}
+}
+
+// CreateFileHandler 上传Batch API的输入文件，multipart表单中file为文件，purpose为batch
+func CreateFileHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "file is required: "+err.Error())
+		return
+	}
+	src, err := fh.Open()
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer src.Close()
+
+	f, err := mybatch.CreateFile(owner, fh.Filename, c.PostForm("purpose"), src)
+	if err != nil {
+		getLogger(c).Warn("create batch file failed", zap.String("filename", fh.Filename), zap.Error(err))
+		sendBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, f)
+}
+
+// ListFilesHandler 返回当前key上传的文件和任务生成的结果文件，可以通过purpose过滤
+func ListFilesHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": mybatch.ListFiles(owner, c.Query("purpose")), "has_more": false})
+}
+
+// RetrieveFileHandler 返回文件信息
+func RetrieveFileHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	f, err := mybatch.GetFile(owner, c.Param("id"))
+	if err != nil {
+		sendBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, f)
+}
+
+// FileContentHandler 下载文件内容
+func FileContentHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	f, content, err := mybatch.OpenFileContent(owner, c.Param("id"))
+	if err != nil {
+		sendBatchError(c, err)
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(http.StatusOK, f.Bytes, "application/octet-stream", content, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": f.Filename}),
+	})
+}
+
+// DeleteFileHandler 删除文件
+func DeleteFileHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	id := c.Param("id")
+	if err := mybatch.DeleteFile(owner, id); err != nil {
+		sendBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+// CreateBatchHandler 创建任务，任务在后台依次执行，通过RetrieveBatchHandler查询状态
+func CreateBatchHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, apikey := getBatchOwner(c)
+
+	var req mybatch.CreateBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	b, err := mybatch.CreateBatch(owner, apikey, &req)
+	if err != nil {
+		getLogger(c).Warn("create batch failed", zap.String("input_file_id", req.InputFileID), zap.Error(err))
+		sendBatchError(c, err)
+		return
+	}
+	getLogger(c).Info("batch created", zap.String("batch_id", b.ID), zap.String("input_file_id", b.InputFileID), zap.String("key_name", getAuthKeyName(c)))
+	c.JSON(http.StatusOK, b)
+}
+
+// ListBatchesHandler 按创建时间从新到旧分页返回任务，参数为after和limit
+func ListBatchesHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultBatchListLimit)))
+	if err != nil || limit <= 0 || limit > maxBatchListLimit {
+		sendErrorResponse(c, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxBatchListLimit))
+		return
+	}
+
+	list, hasMore := mybatch.ListBatches(owner, c.Query("after"), limit)
+	resp := gin.H{"object": "list", "data": list, "first_id": nil, "last_id": nil, "has_more": hasMore}
+	if len(list) > 0 {
+		resp["first_id"] = list[0].ID
+		resp["last_id"] = list[len(list)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RetrieveBatchHandler 返回任务的状态
+func RetrieveBatchHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	b, err := mybatch.GetBatch(owner, c.Param("id"))
+	if err != nil {
+		sendBatchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// CancelBatchHandler 取消任务，路径为/v1/batches/{batch_id}/cancel
+func CancelBatchHandler(c *gin.Context) {
+	if !checkBatchEnabled(c) {
+		return
+	}
+	owner, _ := getBatchOwner(c)
+	path := strings.TrimSuffix(c.Request.URL.Path, "/cancel")
+	id := path[strings.LastIndex(path, "/")+1:]
+	b, err := mybatch.CancelBatch(owner, id)
+	if err != nil {
+		sendBatchError(c, err)
+		return
+	}
+	getLogger(c).Info("batch cancelling", zap.String("batch_id", b.ID))
+	c.JSON(http.StatusOK, b)
+}
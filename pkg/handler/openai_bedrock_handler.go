@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/adapter"
+	"simple-one-api/pkg/config"
+	awsbedrock "simple-one-api/pkg/llm/aws-bedrock"
+	"simple-one-api/pkg/llm/claude"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mysigner"
+	myopenai "simple-one-api/pkg/openai"
+	"simple-one-api/pkg/utils"
+	"time"
+)
+
+// bedrockSignerService SigV4签名使用的服务名
+const bedrockSignerService = "bedrock"
+
+// OpenAI2BedrockHandler 调用AWS Bedrock的InvokeModel接口，支持Anthropic Claude和Meta Llama模型，
+// 使用access_key和secret_key进行SigV4签名
+func OpenAI2BedrockHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	oaiReq := oaiReqParam.chatCompletionReq
+	s := oaiReqParam.modelDetails
+
+	signerConf := getBedrockSignerConf(s, oaiReqParam.creds)
+	modelID := oaiReq.Model
+
+	// 客户端只传了max_completion_tokens时使用该值
+	oaiReq.MaxTokens = effectiveMaxTokens(c, oaiReq)
+
+	var reqBody interface{}
+	switch {
+	case awsbedrock.IsClaudeModel(modelID):
+		reqBody = adapter.OpenAIRequestToBedrockClaudeRequest(oaiReq)
+	case awsbedrock.IsLlamaModel(modelID):
+		reqBody = adapter.OpenAIRequestToBedrockLlamaRequest(oaiReq)
+	default:
+		return fmt.Errorf("unsupported bedrock model: %s", modelID)
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+
+	invokeURL := awsbedrock.InvokeURL(s.ServerURL, signerConf.Region, modelID, oaiReq.Stream)
+	getLogger(c).Info("OpenAI2BedrockHandler", zap.String("url", invokeURL), zap.String("bedrockReq", mycommon.ElideBase64JSON(reqBody)))
+
+	ctx, cancel := upstreamContext(c, 3*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, invokeURL, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if oaiReq.Stream {
+		req.Header.Set("Accept", "application/vnd.amazon.eventstream")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	signer, err := mysigner.New(signerConf, oaiReqParam.creds)
+	if err != nil {
+		return err
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if oaiReqParam.httpTransport != nil {
+		transport = oaiReqParam.httpTransport
+	}
+	transport = mysigner.NewTransport(transport, signer)
+	if headers := getCustomHeaders(c, s); len(headers) > 0 {
+		transport = &utils.HeaderTransport{Transport: transport, Headers: headers}
+	}
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		getLogger(c).Error("bedrock request", zap.Error(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = mycommon.CheckStatusCode(resp); err != nil {
+		getLogger(c).Error("bedrock response", zap.Error(err))
+		return err
+	}
+
+	if oaiReq.Stream {
+		return handleBedrockStreamResponse(c, resp, oaiReq, oaiReqParam)
+	}
+	return handleBedrockResponse(c, resp, oaiReq, oaiReqParam)
+}
+
+// getBedrockSignerConf 服务没有配置signer时使用SigV4，区域取自signer.region或credentials中的region，默认us-east-1
+func getBedrockSignerConf(s *config.ModelDetails, creds map[string]interface{}) *config.SignerConf {
+	signerConf := s.Signer
+	if signerConf.Type == "" {
+		signerConf.Type = "sigv4"
+	}
+	if signerConf.Region == "" {
+		signerConf.Region, _ = utils.GetStringFromMap(creds, config.KEYNAME_REGION)
+	}
+	if signerConf.Region == "" {
+		signerConf.Region = awsbedrock.DefaultRegion
+	}
+	if signerConf.Service == "" {
+		signerConf.Service = bedrockSignerService
+	}
+	return &signerConf
+}
+
+func handleBedrockResponse(c *gin.Context, resp *http.Response, oaiReq *openai.ChatCompletionRequest, oaiReqParam *OAIRequestParam) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	getLogger(c).Info("response", zap.String("body", string(body)))
+
+	var myresp *myopenai.OpenAIResponse
+	if awsbedrock.IsClaudeModel(oaiReq.Model) {
+		var claudeResp claude.ResponseBody
+		if err := json.Unmarshal(body, &claudeResp); err != nil {
+			return fmt.Errorf("json解码错误: %v", err)
+		}
+		myresp = adapter.ClaudeReponseToOpenAIResponse(&claudeResp)
+	} else {
+		var llamaResp awsbedrock.LlamaResponse
+		if err := json.Unmarshal(body, &llamaResp); err != nil {
+			return fmt.Errorf("json解码错误: %v", err)
+		}
+		myresp = adapter.BedrockLlamaResponseToOpenAIResponse(&llamaResp, oaiReq.Model)
+	}
+
+	if myresp.Model == "" {
+		myresp.Model = oaiReq.Model
+	}
+	utils.SetUpstreamModelHeader(c, myresp.Model)
+	myresp.Model = oaiReqParam.ClientModel
+	c.JSON(http.StatusOK, myresp)
+	return nil
+}
+
+// handleBedrockStreamResponse 读取二进制事件流，chunk事件的内容是模型原始的流式分片：
+// Claude的分片与Anthropic的SSE事件相同，按Claude的方式转换；Llama的分片直接转换为OpenAI的分片
+func handleBedrockStreamResponse(c *gin.Context, resp *http.Response, oaiReq *openai.ChatCompletionRequest, oaiReqParam *OAIRequestParam) error {
+	utils.SetEventStreamHeaders(c)
+	reader := awsbedrock.NewEventStreamReader(resp.Body)
+	isClaude := awsbedrock.IsClaudeModel(oaiReq.Model)
+	claudeState := &claudeStreamState{created: time.Now().Unix(), clientModel: oaiReqParam.ClientModel, toolIndexes: make(map[int]int)}
+	// Llama的分片中没有id，整个流使用同一个id
+	llamaID := "chatcmpl-" + uuid.New().String()
+
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("读取流响应错误: %v", err)
+		}
+		if err = event.Err(); err != nil {
+			getLogger(c).Error("bedrock stream exception", zap.Error(err))
+			return err
+		}
+		if event.EventType() != "chunk" {
+			continue
+		}
+
+		var payload awsbedrock.ChunkPayload
+		if err = json.Unmarshal(event.Payload, &payload); err != nil {
+			return err
+		}
+		getLogger(c).Debug("bedrock chunk", zap.String("data", string(payload.Bytes)))
+
+		if isClaude {
+			var eventType struct {
+				Type string `json:"type"`
+			}
+			if err = json.Unmarshal(payload.Bytes, &eventType); err != nil {
+				return err
+			}
+			if err = processClaudeStreamEvent(c, eventType.Type, string(payload.Bytes), claudeState); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var chunk awsbedrock.LlamaResponse
+		if err = json.Unmarshal(payload.Bytes, &chunk); err != nil {
+			return err
+		}
+		if err = writeBedrockStreamChunk(c, adapter.BedrockLlamaChunkToOpenAIStreamResponse(&chunk), oaiReq, oaiReqParam, llamaID, claudeState.created); err != nil {
+			return err
+		}
+	}
+}
+
+func writeBedrockStreamChunk(c *gin.Context, oaiResp *myopenai.OpenAIStreamResponse, oaiReq *openai.ChatCompletionRequest, oaiReqParam *OAIRequestParam, id string, created int64) error {
+	utils.SetUpstreamModelHeader(c, oaiReq.Model)
+	oaiResp.ID = id
+	oaiResp.Created = created
+	oaiResp.Model = oaiReqParam.ClientModel
+	respData, err := json.Marshal(oaiResp)
+	if err != nil {
+		return err
+	}
+	if _, err = c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
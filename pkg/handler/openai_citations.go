@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	myopenai "simple-one-api/pkg/openai"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"strings"
+)
+
+// 最多缓存的上游响应大小，超出部分不再参与来源提取
+const maxCitationBodySize = 8 << 20
+
+type citation struct {
+	Index int    `json:"index"`
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url"`
+}
+
+// upstreamSources 各家返回来源的字段，GLM为web_search，Perplexity为citations和search_results
+type upstreamSources struct {
+	Citations []json.RawMessage `json:"citations"`
+	WebSearch []struct {
+		Title string `json:"title"`
+		Link  string `json:"link"`
+	} `json:"web_search"`
+	SearchResults []struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	} `json:"search_results"`
+}
+
+type chatCompletionResponseWithCitations struct {
+	myopenai.OpenAIResponse
+	Citations interface{} `json:"citations,omitempty"`
+}
+
+type chatCompletionStreamResponseWithCitations struct {
+	openai.ChatCompletionStreamResponse
+	Citations interface{} `json:"citations,omitempty"`
+}
+
+// citationCollector 包装上游的Transport，保留一份原始响应用于提取被go-openai丢弃的来源字段
+type citationCollector struct {
+	Transport http.RoundTripper
+	conf      *config.CitationsConf
+	body      bytes.Buffer
+}
+
+func newCitationCollector(transport http.RoundTripper, conf *config.CitationsConf) *citationCollector {
+	return &citationCollector{Transport: transport, conf: conf}
+}
+
+func (cc *citationCollector) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := cc.Transport.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 400 {
+		return resp, err
+	}
+
+	resp.Body = &teeReadCloser{Reader: io.TeeReader(resp.Body, cc), Closer: resp.Body}
+	return resp, nil
+}
+
+func (cc *citationCollector) Write(p []byte) (int, error) {
+	if remain := maxCitationBodySize - cc.body.Len(); remain > 0 {
+		cc.body.Write(p[:utils.Min(len(p), remain)])
+	}
+	return len(p), nil
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// payloads 将缓存的响应拆分为JSON对象，非流式为整个响应，流式为每个分片
+func (cc *citationCollector) payloads() [][]byte {
+	data := bytes.TrimSpace(cc.body.Bytes())
+	if len(data) == 0 {
+		return nil
+	}
+
+	if data[0] == '{' {
+		return [][]byte{data}
+	}
+
+	var payloads [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		payload := bytes.TrimSpace(line[len("data:"):])
+		if len(payload) > 0 && payload[0] == '{' {
+			payloads = append(payloads, payload)
+		}
+	}
+	return payloads
+}
+
+// rawCitations 返回上游最后一次给出的原始citations数组
+func (cc *citationCollector) rawCitations() json.RawMessage {
+	var raw json.RawMessage
+	for _, payload := range cc.payloads() {
+		var sources struct {
+			Citations json.RawMessage `json:"citations"`
+		}
+		if err := json.Unmarshal(payload, &sources); err == nil && len(sources.Citations) > 0 && string(sources.Citations) != "null" {
+			raw = sources.Citations
+		}
+	}
+	return raw
+}
+
+// citations 从缓存的响应中提取来源，按URL去重
+func (cc *citationCollector) citations() []citation {
+	var result []citation
+	seen := make(map[string]bool)
+	add := func(title, url string) {
+		if url == "" || seen[url] {
+			return
+		}
+		seen[url] = true
+		result = append(result, citation{Index: len(result) + 1, Title: title, URL: url})
+	}
+
+	for _, payload := range cc.payloads() {
+		var sources upstreamSources
+		if err := json.Unmarshal(payload, &sources); err != nil {
+			continue
+		}
+		for _, r := range sources.SearchResults {
+			add(r.Title, r.URL)
+		}
+		for _, r := range sources.WebSearch {
+			add(r.Title, r.Link)
+		}
+		for _, raw := range sources.Citations {
+			var url string
+			if err := json.Unmarshal(raw, &url); err == nil {
+				add("", url)
+				continue
+			}
+			var obj struct {
+				Title string `json:"title"`
+				URL   string `json:"url"`
+			}
+			if err := json.Unmarshal(raw, &obj); err == nil {
+				add(obj.Title, obj.URL)
+			}
+		}
+	}
+
+	return result
+}
+
+func (cc *citationCollector) format() string {
+	switch cc.conf.Format {
+	case config.CitationsFormatField, config.CitationsFormatBoth, config.CitationsFormatRaw:
+		return cc.conf.Format
+	default:
+		return config.CitationsFormatFootnote
+	}
+}
+
+func (cc *citationCollector) useFootnote() bool {
+	format := cc.format()
+	return format == config.CitationsFormatFootnote || format == config.CitationsFormatBoth
+}
+
+func (cc *citationCollector) useField() bool {
+	return cc.format() != config.CitationsFormatFootnote
+}
+
+// fieldValue 返回citations字段的内容，raw格式时原样保留上游的数组
+func (cc *citationCollector) fieldValue(list []citation) interface{} {
+	if cc.format() == config.CitationsFormatRaw {
+		if raw := cc.rawCitations(); raw != nil {
+			return raw
+		}
+	}
+	return list
+}
+
+// footnote 按配置的模板把来源格式化为追加到回答后的文本
+func (cc *citationCollector) footnote(list []citation) string {
+	header := cc.conf.Header
+	if header == "" {
+		header = config.DefaultCitationsHeader
+	}
+	template := cc.conf.Template
+	if template == "" {
+		template = config.DefaultCitationsTemplate
+	}
+
+	lines := make([]string, 0, len(list))
+	for _, c := range list {
+		line := strings.NewReplacer("{index}", strconv.Itoa(c.Index), "{title}", c.Title, "{url}", c.URL).Replace(template)
+		lines = append(lines, strings.TrimSpace(strings.ReplaceAll(line, "  ", " ")))
+	}
+
+	return header + strings.Join(lines, "\n")
+}
+
+// applyToResponse 将来源加入非流式响应，未开启或没有来源时原样返回
+func (cc *citationCollector) applyToResponse(resp *myopenai.OpenAIResponse) interface{} {
+	if cc == nil {
+		return resp
+	}
+	list := cc.citations()
+	if len(list) == 0 {
+		return resp
+	}
+
+	if cc.useFootnote() {
+		footnote := cc.footnote(list)
+		for i := range resp.Choices {
+			resp.Choices[i].Message.Content += footnote
+		}
+	}
+
+	if cc.useField() {
+		return &chatCompletionResponseWithCitations{OpenAIResponse: *resp, Citations: cc.fieldValue(list)}
+	}
+
+	return resp
+}
+
+// sendStreamChunk 流式响应结束后追加一个包含来源的分片
+func (cc *citationCollector) sendStreamChunk(c *gin.Context, clientModel string) error {
+	if cc == nil {
+		return nil
+	}
+	list := cc.citations()
+	if len(list) == 0 {
+		return nil
+	}
+
+	chunk := chatCompletionStreamResponseWithCitations{
+		ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+			Object:  "chat.completion.chunk",
+			Model:   clientModel,
+			Choices: []openai.ChatCompletionStreamChoice{{Index: 0}},
+		},
+	}
+	if cc.useFootnote() {
+		chunk.Choices[0].Delta.Content = cc.footnote(list)
+	}
+	if cc.useField() {
+		chunk.Citations = cc.fieldValue(list)
+	}
+
+	respData, err := json.Marshal(&chunk)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+		return err
+	}
+	c.Writer.(http.Flusher).Flush()
+	return nil
+}
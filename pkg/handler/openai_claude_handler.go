@@ -14,7 +14,6 @@ import (
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/claude"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
 	"simple-one-api/pkg/utils"
 	"strings"
@@ -30,6 +29,8 @@ func OpenAI2ClaudeHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
 
+	// Claude的max_tokens必填，客户端只传了max_completion_tokens时使用该值
+	oaiReq.MaxTokens = effectiveMaxTokens(c, oaiReq)
 	claudeReq := adapter.OpenAIRequestToClaudeRequest(oaiReq)
 
 	claudeServerURL := s.ServerURL
@@ -38,18 +39,16 @@ func OpenAI2ClaudeHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 		claudeServerURL = defaultClaudeServerURL
 	}
 
-	client := &http.Client{
-		Timeout: 3 * time.Minute,
-	}
+	client := &http.Client{}
 	if oaiReqParam.httpTransport != nil {
 		client.Transport = oaiReqParam.httpTransport
 	}
 
-	mylog.Logger.Info("OpenAI2ClaudeHandler", zap.Any("claudeReq", claudeReq))
+	getLogger(c).Info("OpenAI2ClaudeHandler", zap.String("claudeReq", mycommon.ElideBase64JSON(claudeReq)))
 	// 使用统一的错误处理函数
 	if err := sendClaudeRequest(c, client, apiKey, claudeServerURL, claudeReq, oaiReq, oaiReqParam); err != nil {
-		mylog.Logger.Error(err.Error(), zap.String("claudeServerURL", claudeServerURL),
-			zap.Any("claudeReq", claudeReq), zap.Any("oaiReq", oaiReq))
+		getLogger(c).Error(err.Error(), zap.String("claudeServerURL", claudeServerURL),
+			zap.String("claudeReq", mycommon.ElideBase64JSON(claudeReq)), zap.Any("oaiReq", mycommon.ElideBase64Images(oaiReq)))
 		return err
 	}
 
@@ -62,9 +61,12 @@ func sendClaudeRequest(c *gin.Context, client *http.Client, apiKey, url string,
 		return fmt.Errorf("json编码错误: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := upstreamContext(c, 3*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
@@ -74,14 +76,14 @@ func sendClaudeRequest(c *gin.Context, client *http.Client, apiKey, url string,
 
 	resp, err := client.Do(req)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 	defer resp.Body.Close()
 
 	err = mycommon.CheckStatusCode(resp)
 	if err != nil {
-		mylog.Logger.Error("sendClaudeRequest", zap.Error(err))
+		getLogger(c).Error("sendClaudeRequest", zap.Error(err))
 		return err
 	}
 
@@ -96,31 +98,45 @@ func handleClaudeResponse(c *gin.Context, resp *http.Response, oaiReq *openai.Ch
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	mylog.Logger.Info("response", zap.String("body", string(body)))
+	getLogger(c).Info("response", zap.String("body", string(body)))
 
 	var claudeResp claude.ResponseBody
 	if err := json.Unmarshal(body, &claudeResp); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return fmt.Errorf("json解码错误: %v", err)
 	}
 
 	myresp := adapter.ClaudeReponseToOpenAIResponse(&claudeResp)
+	utils.SetUpstreamModelHeader(c, myresp.Model)
 	myresp.Model = oaiReqParam.ClientModel
 	c.JSON(http.StatusOK, myresp)
 
 	return nil
 }
 
+// claudeStreamState 记录message_start中的id和输入token数，补充到之后的每个分片中；
+// toolIndexes记录tool_use内容块的序号对应的OpenAI工具调用序号
+type claudeStreamState struct {
+	id          string
+	created     int64
+	clientModel string
+	inputTokens int
+	toolIndexes map[int]int
+}
+
 func handleClaudeStreamResponse(c *gin.Context, resp *http.Response, oaiReq *openai.ChatCompletionRequest, oaiReqParam *OAIRequestParam) error {
+	utils.SetEventStreamHeaders(c)
 	reader := bufio.NewReader(resp.Body)
 
 	var eventBuilder strings.Builder
 	var dataBuilder strings.Builder
 
+	state := &claudeStreamState{created: time.Now().Unix(), clientModel: oaiReqParam.ClientModel, toolIndexes: make(map[int]int)}
+
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
@@ -134,7 +150,9 @@ func handleClaudeStreamResponse(c *gin.Context, resp *http.Response, oaiReq *ope
 		if len(lineStr) == 0 {
 			// 完整的事件消息读取完毕，发送SSE消息
 			if eventBuilder.Len() > 0 && dataBuilder.Len() > 0 {
-				processClaudeStreamEvent(c, eventBuilder.String(), dataBuilder.String(), oaiReqParam.ClientModel)
+				if err := processClaudeStreamEvent(c, eventBuilder.String(), dataBuilder.String(), state); err != nil {
+					return err
+				}
 				// 重置builders
 				eventBuilder.Reset()
 				dataBuilder.Reset()
@@ -153,48 +171,72 @@ func handleClaudeStreamResponse(c *gin.Context, resp *http.Response, oaiReq *ope
 	return nil
 }
 
-func processClaudeStreamEvent(c *gin.Context, eventType string, eventData string, clientModel string) error {
+func processClaudeStreamEvent(c *gin.Context, eventType string, eventData string, state *claudeStreamState) error {
 	switch eventType {
 	case "message_start":
-		return handleClaudeEvent(c, eventData, claude.MsgMessageStart{}, adapter.ConvertMsgMessageStartToOpenAIStreamResponse, clientModel)
-	case "content_block_delta":
-		return handleClaudeEvent(c, eventData, claude.MsgContentBlockDelta{}, adapter.ConvertMsgContentBlockDeltaToOpenAIStreamResponse, clientModel)
+		return handleClaudeEvent(c, eventData, claude.MsgMessageStart{}, func(msg *claude.MsgMessageStart) *myopenai.OpenAIStreamResponse {
+			state.id = msg.Message.ID
+			state.inputTokens = msg.Message.Usage.InputTokens
+			return adapter.ConvertMsgMessageStartToOpenAIStreamResponse(msg)
+		}, state)
 	case "content_block_start":
-		// 处理content_block_start事件
+		return handleClaudeEvent(c, eventData, claude.MsgContentBlockStart{}, func(msg *claude.MsgContentBlockStart) *myopenai.OpenAIStreamResponse {
+			if msg.ContentBlock.Type == "tool_use" {
+				state.toolIndexes[msg.Index] = len(state.toolIndexes)
+			}
+			return adapter.ConvertMsgContentBlockStartToOpenAIStreamResponse(msg, state.toolIndexes[msg.Index])
+		}, state)
+	case "content_block_delta":
+		return handleClaudeEvent(c, eventData, claude.MsgContentBlockDelta{}, func(msg *claude.MsgContentBlockDelta) *myopenai.OpenAIStreamResponse {
+			return adapter.ConvertMsgContentBlockDeltaToOpenAIStreamResponse(msg, state.toolIndexes[msg.Index])
+		}, state)
+	case "message_delta":
+		return handleClaudeEvent(c, eventData, claude.MsgMessageDelta{}, func(msg *claude.MsgMessageDelta) *myopenai.OpenAIStreamResponse {
+			return adapter.ConvertMsgMessageDeltaToOpenAIStreamResponse(msg, state.inputTokens)
+		}, state)
+	case "error":
+		return fmt.Errorf("claude stream error: %s", eventData)
 	case "content_block_stop":
 		// 处理content_block_stop事件
-	case "message_delta":
-		// 处理message_delta事件
 	case "message_stop":
 		// 处理message_stop事件
 	case "ping":
 		// 处理ping事件
 	default:
 		// 可以添加日志来记录未知事件类型
-		mylog.Logger.Error("Unknown event type: " + eventType)
+		getLogger(c).Error("Unknown event type: " + eventType)
 	}
 
 	return nil
 }
 
-// handleEvent 处理事件的通用逻辑
-func handleClaudeEvent[T any](c *gin.Context, eventData string, eventStruct T, converter func(*T) *myopenai.OpenAIStreamResponse, clientModel string) error {
+// handleEvent 处理事件的通用逻辑，converter返回nil时不发送分片
+func handleClaudeEvent[T any](c *gin.Context, eventData string, eventStruct T, converter func(*T) *myopenai.OpenAIStreamResponse, state *claudeStreamState) error {
 	if err := json.Unmarshal([]byte(eventData), &eventStruct); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
 	respStruct := converter(&eventStruct)
-	respStruct.Model = clientModel
+	if respStruct == nil {
+		return nil
+	}
+	if respStruct.Model != "" {
+		utils.SetUpstreamModelHeader(c, respStruct.Model)
+	}
+	respStruct.ID = state.id
+	respStruct.Object = "chat.completion.chunk"
+	respStruct.Created = state.created
+	respStruct.Model = state.clientModel
 	respData, err := json.Marshal(&respStruct)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
 	_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
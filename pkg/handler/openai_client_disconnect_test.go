@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingStreamUpstream 输出第一个分片后一直等待，直到请求被取消
+func stallingStreamUpstream(firstChunk string, canceled chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: " + firstChunk + "\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+}
+
+// assertDisconnectCancelsUpstream 读到第一个分片后断开客户端连接，上游的请求应该被取消
+func assertDisconnectCancelsUpstream(t *testing.T, model string, canceled <-chan struct{}) {
+	t.Helper()
+	engine := gin.New()
+	engine.POST("/v1/chat/completions", OpenAIHandler)
+	gateway := httptest.NewServer(engine)
+	defer gateway.Close()
+
+	body := fmt.Sprintf(`{"model":%q,"stream":true,"messages":[{"role":"user","content":"hi"}]}`, model)
+	resp, err := http.Post(gateway.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read first chunk: %v", err)
+		}
+		if strings.HasPrefix(line, "data:") {
+			break
+		}
+	}
+	resp.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled after the client disconnected")
+	}
+}
+
+func TestClientDisconnectCancelsOpenAIUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	upstream := stallingStreamUpstream(`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}`, canceled)
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [gpt-4o]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	assertDisconnectCancelsUpstream(t, "gpt-4o", canceled)
+}
+
+func TestClientDisconnectCancelsMinimaxUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	upstream := stallingStreamUpstream(`{"id":"m1","created":1,"model":"abab6.5s-chat","choices":[{"index":0,"messages":[{"sender_type":"BOT","text":"hi"}]}]}`, canceled)
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    minimax:
+        - models: [abab6.5s-chat]
+          enabled: true
+          server_url: %s/v1/text/chatcompletion_pro
+          credentials:
+              api_key: mm-test
+              group_id: "1"
+`, upstream.URL))
+
+	assertDisconnectCancelsUpstream(t, "abab6.5s-chat", canceled)
+}
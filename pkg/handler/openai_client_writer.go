@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+)
+
+const keyClientWriteGuard = "clientWriteGuard"
+
+// clientWriteGuard 直接包装客户端连接，写入失败时记录错误并取消请求的context，让上游的请求和流尽快结束；
+// 开启stream_buffer时由streamBuffer的goroutine写入，err需要加锁
+type clientWriteGuard struct {
+	gin.ResponseWriter
+	clientCtx context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	err       error
+}
+
+// newClientWriteGuard 替换c.Writer和c.Request的context，返回的cancel需要在请求结束时调用
+func newClientWriteGuard(c *gin.Context) context.CancelFunc {
+	clientCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(clientCtx)
+	c.Request = c.Request.WithContext(ctx)
+
+	guard := &clientWriteGuard{ResponseWriter: c.Writer, clientCtx: clientCtx, cancel: cancel}
+	c.Writer = guard
+	c.Set(keyClientWriteGuard, guard)
+	return cancel
+}
+
+func (w *clientWriteGuard) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.checkErr(err)
+	return n, err
+}
+
+func (w *clientWriteGuard) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.checkErr(err)
+	return n, err
+}
+
+// Unwrap 用于http.ResponseController设置写超时
+func (w *clientWriteGuard) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *clientWriteGuard) checkErr(err error) {
+	if err == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.cancel()
+	}
+}
+
+func (w *clientWriteGuard) writeErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func getClientWriteGuard(c *gin.Context) *clientWriteGuard {
+	v, exists := c.Get(keyClientWriteGuard)
+	if !exists {
+		return nil
+	}
+	guard, _ := v.(*clientWriteGuard)
+	return guard
+}
+
+// isClientDisconnected 判断请求失败是否由客户端断开导致，而不是上游的错误
+func isClientDisconnected(c *gin.Context, err error) bool {
+	guard := getClientWriteGuard(c)
+	if guard == nil {
+		return false
+	}
+	if guard.writeErr() != nil {
+		return true
+	}
+	return errors.Is(err, context.Canceled) && guard.clientCtx.Err() != nil
+}
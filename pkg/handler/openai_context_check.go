@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// contextLengthError 估算的输入token数加max_tokens超过模型的上下文长度，返回给客户端时带上计算的结果
+type contextLengthError struct {
+	model        string
+	maxContext   int
+	promptTokens int
+	maxTokens    int
+}
+
+func (e *contextLengthError) Error() string {
+	if e.maxTokens > 0 {
+		return fmt.Sprintf("model '%s' has a maximum context length of %d tokens, the messages are about %d tokens and max_tokens is %d",
+			e.model, e.maxContext, e.promptTokens, e.maxTokens)
+	}
+	return fmt.Sprintf("model '%s' has a maximum context length of %d tokens, the messages are about %d tokens", e.model, e.maxContext, e.promptTokens)
+}
+
+// applyContextCheck 按服务的context_check检查请求是否超过模型的上下文长度，truncate时删除最早的消息，
+// 仍然超过时返回*contextLengthError
+func applyContextCheck(c *gin.Context, oaiReq *openai.ChatCompletionRequest, s *config.ModelDetails) error {
+	onExceed := strings.ToLower(s.ContextCheck.OnExceed)
+	if onExceed != config.ContextCheckOnExceedError && onExceed != config.ContextCheckOnExceedTruncate {
+		return nil
+	}
+	maxContext := config.GetModelMaxContext(s, oaiReq.Model)
+	if maxContext <= 0 {
+		return nil
+	}
+
+	maxTokens := effectiveMaxTokens(c, oaiReq)
+	promptTokens := mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))
+	if promptTokens+maxTokens <= maxContext {
+		return nil
+	}
+
+	if onExceed == config.ContextCheckOnExceedTruncate && maxTokens < maxContext {
+		keepRecent := s.ContextCheck.KeepRecent
+		if keepRecent <= 0 {
+			keepRecent = config.DefaultContextCheckKeepRecent
+		}
+		kept, dropped := mycommon.DropOldestMessages(oaiReq.Messages, maxContext-maxTokens, keepRecent)
+		if len(dropped) > 0 {
+			oaiReq.Messages = kept
+			truncatedTokens := mycommon.EstimateTokens(joinMessagesText(kept))
+			getLogger(c).Info("messages truncated to fit the context",
+				zap.String("model", oaiReq.Model),
+				zap.Int("max_context", maxContext),
+				zap.Int("prompt_tokens", promptTokens),
+				zap.Int("truncated_prompt_tokens", truncatedTokens),
+				zap.Int("dropped", len(dropped)))
+			promptTokens = truncatedTokens
+			if promptTokens+maxTokens <= maxContext {
+				return nil
+			}
+		}
+	}
+	return &contextLengthError{model: oaiReq.Model, maxContext: maxContext, promptTokens: promptTokens, maxTokens: maxTokens}
+}
+
+func sendContextLengthError(c *gin.Context, err *contextLengthError) {
+	param := "messages"
+	if err.maxTokens > 0 && err.promptTokens < err.maxContext {
+		param = "max_tokens"
+	}
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+		"message":       err.Error(),
+		"type":          "invalid_request_error",
+		"code":          "context_length_exceeded",
+		"param":         param,
+		"prompt_tokens": err.promptTokens,
+		"max_tokens":    err.maxTokens,
+		"max_context":   err.maxContext,
+	}})
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"strings"
+)
+
+// 客户端传入的会话ID的最大长度，超过时重新生成
+const maxConversationIDLength = 128
+
+// getConversationID 优先使用客户端通过X-Conversation-ID传入的会话ID，没有时生成一个，
+// 同一请求重试或回退时保持不变
+func getConversationID(c *gin.Context) string {
+	if id := c.GetString("conversationID"); id != "" {
+		return id
+	}
+
+	id := strings.TrimSpace(c.GetHeader(mycomdef.KEYNAME_HEADER_CONVERSATION_ID))
+	if id == "" || len(id) > maxConversationIDLength || strings.ContainsAny(id, "\r\n") {
+		id = uuid.New().String()
+	}
+	c.Set("conversationID", id)
+	return id
+}
+
+// injectConversationID 按模板将会话ID加入system消息，并通过响应头返回给客户端
+func injectConversationID(c *gin.Context, oaiReq *openai.ChatCompletionRequest, conf *config.ConversationIDConf) {
+	template := conf.Template
+	if template == "" {
+		template = config.DefaultConversationIDTemplate
+	}
+
+	id := getConversationID(c)
+	c.Header(mycomdef.KEYNAME_HEADER_CONVERSATION_ID, id)
+	appendToSystemMessage(oaiReq, strings.ReplaceAll(template, "{conversation_id}", id))
+}
+
+// getRequestConversationID 返回请求使用的会话ID，没有开启注入且客户端没有传入时为空
+func getRequestConversationID(c *gin.Context) string {
+	if id := c.GetString("conversationID"); id != "" {
+		return id
+	}
+	id := strings.TrimSpace(c.GetHeader(mycomdef.KEYNAME_HEADER_CONVERSATION_ID))
+	if len(id) > maxConversationIDLength {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+// recordConversationUsage 请求结束后将用量累加到会话，上游没有返回用量时按内容估算
+func recordConversationUsage(c *gin.Context, trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) {
+	if !config.GetConf().ConversationUsage.Enable {
+		return
+	}
+	conversationID := getRequestConversationID(c)
+	if conversationID == "" {
+		return
+	}
+
+	resp := recorder.parse(trace.Stream)
+	if resp.ErrorMessage != "" {
+		return
+	}
+
+	promptTokens, completionTokens, totalTokens := resp.PromptTokens, resp.CompletionTokens, resp.TotalTokens
+	if totalTokens == 0 {
+		promptTokens = mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))
+		completionTokens = mycommon.EstimateTokens(resp.Content)
+		totalTokens = promptTokens + completionTokens
+	}
+
+	model := trace.Model
+	if model == "" {
+		model = trace.ClientModel
+	}
+	mycommon.RecordConversationUsage(conversationID, model, promptTokens, completionTokens, totalTokens)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+)
+
+// isPricingEnabled 是否配置了pricing
+func isPricingEnabled() bool {
+	return len(config.GetConf().Pricing.Models) > 0
+}
+
+// costHeaderWriter 返回请求的费用，非流式响应在写出响应体之前按其中的usage设置响应头，
+// 流式响应的响应头已经先发送，声明trailer后在请求结束时按记录的响应设置；命中响应缓存时费用为0
+type costHeaderWriter struct {
+	gin.ResponseWriter
+	trace    *requestTrace
+	oaiReq   *openai.ChatCompletionRequest
+	recorder *responseRecorder
+	written  bool
+}
+
+func newCostHeaderWriter(w gin.ResponseWriter, trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) *costHeaderWriter {
+	return &costHeaderWriter{ResponseWriter: w, trace: trace, oaiReq: oaiReq, recorder: recorder}
+}
+
+func (w *costHeaderWriter) beforeWrite(data []byte) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if w.trace.Stream {
+		w.Header().Set("Trailer", mycomdef.KEYNAME_HEADER_COST+", "+mycomdef.KEYNAME_HEADER_COST_CURRENCY)
+		return
+	}
+	if w.Status() >= http.StatusBadRequest {
+		return
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return
+	}
+	promptTokens, completionTokens := resp.Usage.PromptTokens, resp.Usage.CompletionTokens
+	if resp.Usage.TotalTokens <= 0 {
+		promptTokens = mycommon.EstimateTokens(joinMessagesText(w.oaiReq.Messages))
+		completionTokens = 0
+		for _, choice := range resp.Choices {
+			completionTokens += mycommon.EstimateTokens(choice.Message.Content)
+		}
+	}
+	w.setCost(promptTokens, completionTokens)
+}
+
+func (w *costHeaderWriter) setCost(promptTokens, completionTokens int) {
+	cost, ok := mycommon.CalculateCost(w.trace.ClientModel, w.trace.Model, promptTokens, completionTokens)
+	if !ok {
+		return
+	}
+	if w.trace.CacheHit {
+		cost = 0
+	}
+	w.Header().Set(mycomdef.KEYNAME_HEADER_COST, mycommon.FormatCost(cost))
+	w.Header().Set(mycomdef.KEYNAME_HEADER_COST_CURRENCY, config.GetPricingCurrency())
+}
+
+func (w *costHeaderWriter) Write(data []byte) (int, error) {
+	w.beforeWrite(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *costHeaderWriter) WriteString(s string) (int, error) {
+	w.beforeWrite([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *costHeaderWriter) WriteHeaderNow() {
+	w.beforeWrite(nil)
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *costHeaderWriter) Flush() {
+	w.beforeWrite(nil)
+	w.ResponseWriter.Flush()
+}
+
+// finish 流式请求结束后设置trailer，失败的请求没有费用
+func (w *costHeaderWriter) finish() {
+	if !w.trace.Stream || !w.written || w.recorder.Status() >= http.StatusBadRequest {
+		return
+	}
+	promptTokens, completionTokens, _, _ := getRecordedUsage(w.trace, w.oaiReq, w.recorder)
+	w.setCost(promptTokens, completionTokens)
+}
@@ -15,7 +15,6 @@ import (
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/devplatform/cozecn"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 	"strings"
 	"time"
@@ -54,20 +53,18 @@ func OpenAI2CozecnHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 			cozeServerURL = defaultCozecnURL
 		}
 	}
-	client := &http.Client{
-		Timeout: 3 * time.Minute,
-	}
+	client := &http.Client{}
 	if oaiReqParam.httpTransport != nil {
 		client.Transport = oaiReqParam.httpTransport
 	}
 
-	mylog.Logger.Info(cozeServerURL)
-	mylog.Logger.Info("oaiReq", zap.Any("oaiReq", oaiReq))
-	mylog.Logger.Info("cozecnReq", zap.Any("cozecnReq", cozecnReq))
+	getLogger(c).Info(cozeServerURL)
+	getLogger(c).Info("oaiReq", zap.Any("oaiReq", mycommon.ElideBase64Images(oaiReq)))
+	getLogger(c).Info("cozecnReq", zap.Any("cozecnReq", cozecnReq))
 	// 使用统一的错误处理函数
 	if err := sendRequest(c, client, secretToken, cozeServerURL, cozecnReq, oaiReq, oaiReqParam); err != nil {
-		mylog.Logger.Error(err.Error(), zap.String("cozeServerURL", cozeServerURL),
-			zap.Any("cozecnReq", cozecnReq), zap.Any("oaiReq", oaiReq))
+		getLogger(c).Error(err.Error(), zap.String("cozeServerURL", cozeServerURL),
+			zap.Any("cozecnReq", cozecnReq), zap.Any("oaiReq", mycommon.ElideBase64Images(oaiReq)))
 		return err
 	}
 
@@ -80,9 +77,12 @@ func sendRequest(c *gin.Context, client *http.Client, token, url string, request
 		return fmt.Errorf("json编码错误: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := upstreamContext(c, 3*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
@@ -91,7 +91,7 @@ func sendRequest(c *gin.Context, client *http.Client, token, url string, request
 
 	resp, err := client.Do(req)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 	defer resp.Body.Close()
@@ -112,15 +112,15 @@ func handleCozecnResponse(c *gin.Context, resp *http.Response, oaiReq *openai.Ch
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	mylog.Logger.Info("response", zap.String("body", string(body)))
+	getLogger(c).Info("response", zap.String("body", string(body)))
 
 	var respJson cozecn.Response
 	if err := json.Unmarshal(body, &respJson); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return fmt.Errorf("json解码错误: %v", err)
 	}
 
@@ -129,6 +129,7 @@ func handleCozecnResponse(c *gin.Context, resp *http.Response, oaiReq *openai.Ch
 	}
 
 	myresp := adapter.CozecnReponseToOpenAIResponse(&respJson)
+	utils.SetUpstreamModelHeader(c, myresp.Model)
 	myresp.Model = oaiReqParam.ClientModel
 	c.JSON(http.StatusOK, myresp)
 
@@ -143,11 +144,11 @@ func handleCozecnStreamResponse(c *gin.Context, oaiReq *openai.ChatCompletionReq
 		line := scanner.Text()
 		//log.Println(line)
 		if strings.HasPrefix(line, "data:") {
-			mylog.Logger.Info(line)
+			getLogger(c).Debug(line)
 			line = strings.TrimPrefix(line, "data:")
 			var response cozecn.StreamResponse
 			if err := json.Unmarshal([]byte(line), &response); err != nil {
-				mylog.Logger.Error(err.Error())
+				getLogger(c).Error(err.Error())
 				return fmt.Errorf("解析响应数据错误: %v", err)
 			}
 			//log.Println(response)
@@ -157,17 +158,18 @@ func handleCozecnStreamResponse(c *gin.Context, oaiReq *openai.ChatCompletionReq
 					continue
 				}
 				oaiRespStream := adapter.CozecnReponseToOpenAIResponseStream(&response)
+				utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 				oaiRespStream.Model = oaiReqParam.ClientModel
 				respData, err := json.Marshal(&oaiRespStream)
 				if err != nil {
-					mylog.Logger.Error(err.Error())
+					getLogger(c).Error(err.Error())
 					return err
 				}
 
-				mylog.Logger.Info(string(respData))
+				getLogger(c).Debug(string(respData))
 				_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 				if err != nil {
-					mylog.Logger.Error(err.Error())
+					getLogger(c).Error(err.Error())
 				}
 				c.Writer.(http.Flusher).Flush()
 
@@ -175,7 +177,7 @@ func handleCozecnStreamResponse(c *gin.Context, oaiReq *openai.ChatCompletionReq
 
 				return nil
 			case "error":
-				mylog.Logger.Error(response.ErrorInformation.Msg)
+				getLogger(c).Error(response.ErrorInformation.Msg)
 				return fmt.Errorf("错误码: %d, 错误信息: %s", response.ErrorInformation.Code, response.ErrorInformation.Msg)
 			default:
 				fmt.Printf("未知事件: %s\n", line)
@@ -185,7 +187,7 @@ func handleCozecnStreamResponse(c *gin.Context, oaiReq *openai.ChatCompletionReq
 	}
 
 	if err := scanner.Err(); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return fmt.Errorf("读取流式响应数据错误: %v", err)
 	}
 
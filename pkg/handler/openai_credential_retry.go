@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+const keyPinnedService = "pinnedService"
+
+// pinnedService 换用其他凭证重试时固定使用的服务
+type pinnedService struct {
+	model string
+	s     *config.ModelDetails
+}
+
+// getPinnedService 返回重试时固定的服务，模型不一致时不生效
+func getPinnedService(c *gin.Context, model string) *config.ModelDetails {
+	if v, exists := c.Get(keyPinnedService); exists {
+		if ps, ok := v.(*pinnedService); ok && ps.model == model {
+			return ps.s
+		}
+	}
+	return nil
+}
+
+func isAuthError(err error) bool {
+	switch mycommon.GetErrorStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// isCredentialFailoverError 开启credential_failover时，凭证返回429或5xx后临时隔离并换用其他凭证
+func isCredentialFailoverError(err error) bool {
+	code := mycommon.GetErrorStatusCode(err)
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// tryCredentialRetry 凭证返回401/403时永久隔离该凭证，开启credential_failover时凭证返回429/5xx也会重试，
+// 服务还有其他可用凭证时换用其他凭证重试
+func tryCredentialRetry(c *gin.Context, s *config.ModelDetails, credsID string, model string, origReq *openai.ChatCompletionRequest, clientModel string, err error) bool {
+	if credsID == "" {
+		return false
+	}
+	switch {
+	case config.IsAuthErrorRetry() && isAuthError(err):
+		mycommon.RevokeCredential(credsID, err)
+	case s.CredentialFailover && isCredentialFailoverError(err):
+		// 已经在调用前临时隔离
+	default:
+		return false
+	}
+
+	if c.Writer.Written() || mycommon.IsServiceQuarantined(s) || !mycommon.AcquireRetryBudget(s) {
+		return false
+	}
+
+	getLogger(c).Warn("credential rejected, retry with next credential",
+		zap.String("service_name", s.ServiceName),
+		zap.String("model", model),
+		zap.String("cred_id", credsID),
+		zap.Int("status_code", mycommon.GetErrorStatusCode(err)))
+
+	c.Set(keyPinnedService, &pinnedService{model: model, s: s})
+	retryReq := mycommon.DeepCopyChatCompletionRequest(*origReq)
+	handleOpenAIRequestWithClientModel(c, &retryReq, clientModel)
+
+	return true
+}
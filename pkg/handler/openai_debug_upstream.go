@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+	"sync"
+)
+
+const debugResponseKey = "_debug"
+
+var base64ImageRe = regexp.MustCompile(`"data:[^";,]*;base64,([A-Za-z0-9+/=]*)"`)
+
+// upstreamCapture 记录经过所有处理后最终发送给上游的请求。
+// 使用go-openai的服务从Transport拿到实际的请求体，其他服务只能记录转换为各家协议之前的请求
+type upstreamCapture struct {
+	Transport  http.RoundTripper
+	mu         sync.Mutex
+	url        string
+	body       json.RawMessage
+	gatewayReq json.RawMessage
+}
+
+type upstreamDebugInfo struct {
+	ServiceName     string          `json:"service_name"`
+	Model           string          `json:"model"`
+	UpstreamURL     string          `json:"upstream_url,omitempty"`
+	Source          string          `json:"source"`
+	UpstreamRequest json.RawMessage `json:"upstream_request"`
+}
+
+// isUpstreamDebugRequested 开启debug模式时，客户端可以通过X-Debug请求头要求返回发送给上游的请求
+func isUpstreamDebugRequested(c *gin.Context) bool {
+	if !config.Debug {
+		return false
+	}
+	v := strings.ToLower(strings.TrimSpace(c.GetHeader(mycomdef.KEYNAME_HEADER_DEBUG)))
+	return v == "true" || v == "1"
+}
+
+func (uc *upstreamCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		uc.mu.Lock()
+		uc.url = req.URL.Redacted()
+		if json.Valid(body) {
+			uc.body = elideBase64InJSON(body)
+		}
+		uc.mu.Unlock()
+	}
+	return uc.Transport.RoundTrip(req)
+}
+
+// setGatewayRequest 记录分发给各服务处理之前的请求，Transport没有拿到请求体时使用
+func (uc *upstreamCapture) setGatewayRequest(req *openai.ChatCompletionRequest) {
+	logReq := mycommon.RedactRequestPaths(mycommon.ElideBase64Images(req), config.GetRedactPaths(req.Model))
+	data, err := json.Marshal(logReq)
+	if err != nil {
+		return
+	}
+	uc.mu.Lock()
+	uc.gatewayReq = data
+	uc.mu.Unlock()
+}
+
+func (uc *upstreamCapture) info(s *config.ModelDetails, model string) *upstreamDebugInfo {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	info := &upstreamDebugInfo{ServiceName: s.ServiceName, Model: model, UpstreamURL: uc.url}
+	if len(uc.body) > 0 {
+		info.Source = "http"
+		info.UpstreamRequest = uc.body
+	} else {
+		info.Source = "gateway"
+		info.UpstreamRequest = uc.gatewayReq
+	}
+	return info
+}
+
+// log 输出一条包含最终上游请求的日志
+func (uc *upstreamCapture) log(c *gin.Context, s *config.ModelDetails, model string) {
+	info := uc.info(s, model)
+	getLogger(c).Info("effective upstream request",
+		zap.String("service_name", info.ServiceName),
+		zap.String("model", info.Model),
+		zap.String("upstream_url", info.UpstreamURL),
+		zap.String("source", info.Source),
+		zap.ByteString("upstream_request", info.UpstreamRequest))
+}
+
+// newUpstreamDebugTransformer 在非流式响应或第一个流式分片中加入_debug字段
+func newUpstreamDebugTransformer(uc *upstreamCapture, s *config.ModelDetails, model string) streamChunkTransformer {
+	done := false
+	return func(chunk map[string]json.RawMessage) bool {
+		if done {
+			return false
+		}
+		done = true
+		data, err := json.Marshal(uc.info(s, model))
+		if err != nil {
+			return false
+		}
+		chunk[debugResponseKey] = data
+		return true
+	}
+}
+
+// elideBase64InJSON 将请求体中的base64图片替换为长度说明，避免输出过长
+func elideBase64InJSON(body []byte) []byte {
+	if config.GetConf() != nil && config.GetConf().LogBase64Images {
+		return body
+	}
+	return base64ImageRe.ReplaceAllFunc(body, func(m []byte) []byte {
+		sub := base64ImageRe.FindSubmatch(m)
+		return []byte(fmt.Sprintf(`"[base64 image, %d bytes]"`, len(sub[1])))
+	})
+}
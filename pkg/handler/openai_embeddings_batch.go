@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"sort"
+	"sync"
+)
+
+// getEmbeddingBatching 返回每批的数量和并发数，没有配置max_batch_size时使用服务类型的默认值
+func getEmbeddingBatching(s *config.ModelDetails, adapter embeddingAdapter) (int, int) {
+	size := s.EmbeddingBatch.MaxBatchSize
+	if size <= 0 {
+		size = adapter.maxBatchSize
+	}
+	concurrency := s.EmbeddingBatch.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.DefaultEmbeddingBatchConcurrency
+	}
+	if s.Limit.Concurrency > 0 && int(s.Limit.Concurrency) < concurrency {
+		concurrency = int(s.Limit.Concurrency)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return size, concurrency
+}
+
+// splitEmbeddingInput input为字符串数组或token数组的数组且超过size时按size拆分，不需要拆分时返回nil
+func splitEmbeddingInput(input interface{}, size int) [][]interface{} {
+	items, ok := input.([]interface{})
+	if !ok || size <= 0 || len(items) <= size {
+		return nil
+	}
+	// 元素为数字时整个数组是一个输入的token
+	if _, isToken := items[0].(float64); isToken {
+		return nil
+	}
+	var batches [][]interface{}
+	for start := 0; start < len(items); start += size {
+		batches = append(batches, items[start:min(start+size, len(items))])
+	}
+	return batches
+}
+
+// createEmbeddingsInBatches 并行请求每一批，任意一批失败时取消其他请求并返回该错误；
+// 成功时按原来的顺序合并向量，index加上所在批次的偏移，usage为所有请求的合计
+func createEmbeddingsInBatches(c *gin.Context, client *openai.Client, req openai.EmbeddingRequest, batches [][]interface{}, concurrency int) (openai.EmbeddingResponse, error) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	resps := make([]openai.EmbeddingResponse, len(batches))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range batches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+
+			batchReq := req
+			batchReq.Input = batches[i]
+			resp, err := client.CreateEmbeddings(ctx, batchReq)
+			if err != nil {
+				getLogger(c).Warn("embedding batch failed", zap.Int("batch", i), zap.Int("size", len(batches[i])), zap.Error(err))
+				fail(err)
+				return
+			}
+			resps[i] = resp
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return openai.EmbeddingResponse{}, firstErr
+	}
+
+	merged := openai.EmbeddingResponse{Object: resps[0].Object, Model: resps[0].Model}
+	offset := 0
+	for i, resp := range resps {
+		// 上游不保证data按index排序
+		sort.SliceStable(resp.Data, func(a, b int) bool { return resp.Data[a].Index < resp.Data[b].Index })
+		for _, e := range resp.Data {
+			e.Index += offset
+			merged.Data = append(merged.Data, e)
+		}
+		offset += len(batches[i])
+		merged.Usage.PromptTokens += resp.Usage.PromptTokens
+		merged.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		merged.Usage.TotalTokens += resp.Usage.TotalTokens
+	}
+	return merged, nil
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitEmbeddingInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		input interface{}
+		size  int
+		want  []int
+	}{
+		{"string", "hello", 2, nil},
+		{"within limit", []interface{}{"a", "b"}, 2, nil},
+		{"strings", []interface{}{"a", "b", "c", "d", "e"}, 2, []int{2, 2, 1}},
+		{"token arrays", []interface{}{[]interface{}{1.0}, []interface{}{2.0}, []interface{}{3.0}}, 2, []int{2, 1}},
+		{"single token array", []interface{}{1.0, 2.0, 3.0}, 2, nil},
+		{"no limit", []interface{}{"a", "b", "c"}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := splitEmbeddingInput(tt.input, tt.size)
+			var sizes []int
+			for _, b := range batches {
+				sizes = append(sizes, len(b))
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.want) {
+				t.Fatalf("batch sizes = %v, want %v", sizes, tt.want)
+			}
+		})
+	}
+}
+
+// embeddingsUpstream 每个输入返回[输入的序号]作为向量，data倒序返回，每个输入计1个token
+func embeddingsUpstream(t *testing.T, requests, inFlight, maxInFlight *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		n := atomic.AddInt32(inFlight, 1)
+		defer atomic.AddInt32(inFlight, -1)
+		for {
+			m := atomic.LoadInt32(maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode upstream request: %v", err)
+		}
+		resp := openai.EmbeddingResponse{Object: "list", Model: "text-embedding-3-small"}
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			var v float32
+			fmt.Sscanf(req.Input[i], "in-%f", &v)
+			resp.Data = append(resp.Data, openai.Embedding{Object: "embedding", Embedding: []float32{v}, Index: i})
+		}
+		resp.Usage = openai.Usage{PromptTokens: len(req.Input), TotalTokens: len(req.Input)}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestEmbeddingsHandlerBatches(t *testing.T) {
+	var requests, inFlight, maxInFlight int32
+	upstream := embeddingsUpstream(t, &requests, &inFlight, &maxInFlight)
+	defer upstream.Close()
+
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [text-embedding-3-small]
+          enabled: true
+          server_url: %s
+          credentials:
+              api_key: sk-test
+          embedding_batch:
+              max_batch_size: 3
+              concurrency: 2
+`, upstream.URL))
+
+	var inputs []string
+	for i := 0; i < 10; i++ {
+		inputs = append(inputs, fmt.Sprintf("in-%d", i))
+	}
+	body, _ := json.Marshal(map[string]interface{}{"model": "text-embedding-3-small", "input": inputs})
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(string(body)))
+	c.Request.Header.Set("Content-Type", "application/json")
+	EmbeddingsHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp openai.EmbeddingResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 4 {
+		t.Errorf("upstream requests = %d, want 4", requests)
+	}
+	if maxInFlight := atomic.LoadInt32(&maxInFlight); maxInFlight > 2 {
+		t.Errorf("max concurrent upstream requests = %d, want at most 2", maxInFlight)
+	}
+	if len(resp.Data) != len(inputs) {
+		t.Fatalf("got %d embeddings, want %d", len(resp.Data), len(inputs))
+	}
+	for i, e := range resp.Data {
+		if e.Index != i || len(e.Embedding) != 1 || e.Embedding[0] != float32(i) {
+			t.Errorf("data[%d] = index %d embedding %v", i, e.Index, e.Embedding)
+		}
+	}
+	if resp.Usage.PromptTokens != 10 || resp.Usage.TotalTokens != 10 {
+		t.Errorf("usage = %+v, want 10 prompt and total tokens", resp.Usage)
+	}
+}
+
+func TestEmbeddingsHandlerBatchError(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 2 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"bad batch","type":"invalid_request_error"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[{"object":"embedding","embedding":[1],"index":0}],"usage":{"prompt_tokens":1,"total_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [text-embedding-3-small]
+          enabled: true
+          server_url: %s
+          credentials:
+              api_key: sk-test
+          embedding_batch:
+              max_batch_size: 1
+              concurrency: 1
+`, upstream.URL))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(`{"model":"text-embedding-3-small","input":["a","b","c"]}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	EmbeddingsHandler(c)
+
+	if w.Code == http.StatusOK {
+		t.Fatalf("status = %d, want an error, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "bad batch") {
+		t.Errorf("body = %s, want the upstream error", w.Body.String())
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 2 {
+		t.Errorf("upstream requests = %d, want 2", requests)
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// embeddingAdapter 各服务embeddings接口的差异，都使用OpenAI协议
+type embeddingAdapter struct {
+	// defaultServerURL 服务没有配置server_url时使用的地址
+	defaultServerURL string
+	// compatibleMode 服务的server_url是原生接口的地址，不包含compatible-mode时使用defaultServerURL
+	compatibleMode bool
+	// floatOnly 不支持encoding_format为base64，请求上游时使用float，返回时再按客户端的格式编码
+	floatOnly bool
+	// maxBatchSize 一次请求最多的input数量，超过时拆分为多个请求，0为不拆分
+	maxBatchSize int
+}
+
+// embeddingServices 支持embeddings的服务
+var embeddingServices = map[string]embeddingAdapter{
+	"openai":    {defaultServerURL: "https://api.openai.com/v1", maxBatchSize: 2048},
+	"azure":     {maxBatchSize: 2048},
+	"deepseek":  {defaultServerURL: "https://api.deepseek.com/v1", maxBatchSize: 2048},
+	"zhipu":     {defaultServerURL: "https://open.bigmodel.cn/api/paas/v4", floatOnly: true, maxBatchSize: 64},
+	"dashscope": {defaultServerURL: "https://dashscope.aliyuncs.com/compatible-mode/v1", compatibleMode: true, floatOnly: true, maxBatchSize: 10},
+}
+
+// getEmbeddingModelDetails 返回使用embeddings地址的服务配置副本
+func getEmbeddingModelDetails(s *config.ModelDetails, adapter embeddingAdapter) *config.ModelDetails {
+	sd := *s
+	if sd.ServerURL == "" || (adapter.compatibleMode && !strings.Contains(sd.ServerURL, "compatible-mode")) {
+		sd.ServerURL = adapter.defaultServerURL
+	}
+	return &sd
+}
+
+// embeddingBase64 encoding_format为base64时返回的向量
+type embeddingBase64 struct {
+	Object    string `json:"object"`
+	Embedding string `json:"embedding"`
+	Index     int    `json:"index"`
+}
+
+type embeddingBase64Response struct {
+	Object string            `json:"object"`
+	Data   []embeddingBase64 `json:"data"`
+	Model  string            `json:"model"`
+	Usage  openai.Usage      `json:"usage"`
+}
+
+// encodeEmbeddingBase64 按OpenAI的格式将float32向量以小端序编码为base64
+func encodeEmbeddingBase64(embedding []float32) string {
+	buf := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func sendModelNotFoundResponse(c *gin.Context, model string) {
+	c.JSON(http.StatusNotFound, gin.H{"error": gin.H{
+		"message": fmt.Sprintf("The model '%s' does not exist", model),
+		"type":    "invalid_request_error",
+		"param":   "model",
+		"code":    "model_not_found",
+	}})
+}
+
+// EmbeddingsHandler handles POST requests on /v1/embeddings path
+func EmbeddingsHandler(c *gin.Context) {
+	if !validateRequestMethod(c, "POST") {
+		return
+	}
+
+	var req openai.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Model == "" {
+		sendErrorResponse(c, http.StatusBadRequest, "model is required")
+		return
+	}
+	if req.Input == nil {
+		sendErrorResponse(c, http.StatusBadRequest, "input is required")
+		return
+	}
+
+	clientModel := string(req.Model)
+	if !checkModelAllowed(c, clientModel) {
+		return
+	}
+
+	model := config.GetGlobalModelRedirect(clientModel)
+	s, err := config.GetModelService(config.ResolveTenantModel(getTenantName(c), model))
+	if err != nil {
+		getLogger(c).Warn("embedding model not found", zap.String("model", model), zap.Error(err))
+		sendModelNotFoundResponse(c, clientModel)
+		return
+	}
+	adapter, supported := embeddingServices[strings.ToLower(s.ServiceName)]
+	if !supported {
+		sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("service %s does not support embeddings", s.ServiceName))
+		return
+	}
+	s = getEmbeddingModelDetails(s, adapter)
+
+	upstreamModel := config.GetModelMapping(s, config.GetModelRedirect(s, model))
+	creds, credsID := mycommon.GetACredentials(s, upstreamModel)
+	if credsID != "" {
+		mycommon.AcquireCredential(credsID)
+		defer mycommon.ReleaseCredential(credsID)
+	}
+
+	oaiReqParam := &OAIRequestParam{
+		chatCompletionReq: &openai.ChatCompletionRequest{Model: upstreamModel},
+		modelDetails:      s,
+		creds:             creds,
+		ClientModel:       clientModel,
+	}
+	if _, transport, err := config.GetServiceTransport(s); err != nil {
+		getLogger(c).Error("GetServiceTransport", zap.String("service_name", s.ServiceName), zap.Error(err))
+	} else {
+		oaiReqParam.httpTransport = mytrace.WrapTransport(transport)
+	}
+
+	var conf openai.ClientConfig
+	if strings.ToLower(s.ServiceName) == "azure" {
+		conf, err = getAzureConfig(c, s, oaiReqParam)
+	} else {
+		conf, err = getConfig(c, s, oaiReqParam)
+	}
+	if err != nil {
+		getLogger(c).Error("embedding config", zap.String("service_name", s.ServiceName), zap.Error(err))
+		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	batchSize, concurrency := getEmbeddingBatching(s, adapter)
+	batches := splitEmbeddingInput(req.Input, batchSize)
+	getLogger(c).Info("embedding request",
+		zap.String("service_name", s.ServiceName),
+		zap.String("client_model", clientModel),
+		zap.String("upstream_model", upstreamModel),
+		zap.String("encoding_format", string(req.EncodingFormat)),
+		zap.Int("batches", len(batches)))
+
+	encodingFormat := req.EncodingFormat
+	if adapter.floatOnly && encodingFormat == openai.EmbeddingEncodingFormatBase64 {
+		req.EncodingFormat = openai.EmbeddingEncodingFormatFloat
+	}
+	req.Model = openai.EmbeddingModel(upstreamModel)
+	client := openai.NewClientWithConfig(conf)
+	var resp openai.EmbeddingResponse
+	if len(batches) > 0 {
+		resp, err = createEmbeddingsInBatches(c, client, req, batches, concurrency)
+	} else {
+		resp, err = client.CreateEmbeddings(c.Request.Context(), req)
+	}
+	if err != nil {
+		getLogger(c).Error("CreateEmbeddings", zap.String("service_name", s.ServiceName), zap.Error(err))
+		sendUpstreamErrorResponse(c, s.ServiceName, err)
+		return
+	}
+
+	utils.SetUpstreamModelHeader(c, string(resp.Model))
+	if encodingFormat != openai.EmbeddingEncodingFormatBase64 {
+		resp.Model = openai.EmbeddingModel(clientModel)
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	// go-openai会把base64解码为float32，floatOnly的服务返回的也是float32，这里按客户端要求的格式编码
+	b64Resp := embeddingBase64Response{Object: resp.Object, Model: clientModel, Usage: resp.Usage}
+	for _, e := range resp.Data {
+		b64Resp.Data = append(b64Resp.Data, embeddingBase64{Object: e.Object, Embedding: encodeEmbeddingBase64(e.Embedding), Index: e.Index})
+	}
+	c.JSON(http.StatusOK, b64Resp)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"time"
+)
+
+const keyFailoverState = "failoverState"
+
+// failoverState 记录一次请求中每个服务已经重试的次数
+type failoverState struct {
+	retries map[string]int
+}
+
+func getFailoverState(c *gin.Context) *failoverState {
+	if v, exists := c.Get(keyFailoverState); exists {
+		if fs, ok := v.(*failoverState); ok {
+			return fs
+		}
+	}
+	fs := &failoverState{retries: make(map[string]int)}
+	c.Set(keyFailoverState, fs)
+	return fs
+}
+
+// isFailoverError 按配置的状态码判断是否需要重试，没有状态码的连接错误也会重试
+func isFailoverError(conf *config.FailoverConf, err error) bool {
+	code := mycommon.GetErrorStatusCode(err)
+	if code == 0 {
+		return true
+	}
+	statusCodes := conf.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = config.DefaultFailoverStatusCodes
+	}
+	for _, sc := range statusCodes {
+		if sc == code {
+			return true
+		}
+	}
+	return false
+}
+
+// getFailoverBackoff 第n次重试前的等待时长，每次翻倍，不超过max_backoff
+func getFailoverBackoff(conf *config.FailoverConf, n int) time.Duration {
+	backoff, maxBackoff := conf.Backoff, conf.MaxBackoff
+	if backoff <= 0 {
+		backoff = config.DefaultFailoverBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = config.DefaultFailoverMaxBackoff
+	}
+	d := time.Duration(backoff) * time.Millisecond << uint(n)
+	if d <= 0 || d > time.Duration(maxBackoff)*time.Millisecond {
+		d = time.Duration(maxBackoff) * time.Millisecond
+	}
+	return d
+}
+
+// nextFailoverService 返回同一模型下还没有尝试过的可用服务，优先选择不在熔断期的服务
+func nextFailoverService(fs *failoverState, model string) *config.ModelDetails {
+	services := config.GetModelToService()[model]
+	for _, skipOpen := range []bool{true, false} {
+		for i := range services {
+			sd := &services[i]
+			if !sd.Enabled || mycommon.IsServiceUnavailable(sd) || (skipOpen && mycommon.IsServiceCircuitOpen(sd)) {
+				continue
+			}
+			if _, tried := fs.retries[sd.ServiceID]; !tried {
+				return sd
+			}
+		}
+	}
+	return nil
+}
+
+// tryFailover 上游返回429/5xx或连接失败时，先按指数退避重试当前服务，重试次数用完后切换到同一模型的下一个服务。
+// 流式请求只在还没有向客户端输出时才会重试
+func tryFailover(c *gin.Context, s *config.ModelDetails, model string, origReq *openai.ChatCompletionRequest, clientModel string, err error) bool {
+	conf := &s.Failover
+	if !conf.Enable || c.Writer.Written() || c.Request.Context().Err() != nil || !isFailoverError(conf, err) {
+		return false
+	}
+
+	fs := getFailoverState(c)
+	retries := fs.retries[s.ServiceID]
+
+	// max_retries小于0时不重试当前服务，直接切换
+	maxRetries := conf.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = config.DefaultFailoverMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	next := s
+	if retries >= maxRetries || mycommon.IsServiceUnavailable(s) {
+		fs.retries[s.ServiceID] = maxRetries
+		if next = nextFailoverService(fs, model); next == nil {
+			getLogger(c).Warn("failover exhausted", zap.String("service_name", s.ServiceName), zap.String("model", model))
+			return false
+		}
+	}
+	if !mycommon.AcquireRetryBudget(s) {
+		return false
+	}
+
+	if next == s {
+		backoff := getFailoverBackoff(conf, retries)
+		getLogger(c).Warn("upstream failed, retry",
+			zap.String("service_name", s.ServiceName),
+			zap.String("model", model),
+			zap.Int("attempt", retries+1),
+			zap.Int("status_code", mycommon.GetErrorStatusCode(err)),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+			timer.Stop()
+			return false
+		}
+		fs.retries[s.ServiceID] = retries + 1
+	} else {
+		getLogger(c).Warn("upstream failed, failover to next service",
+			zap.String("service_name", s.ServiceName),
+			zap.String("next_service_name", next.ServiceName),
+			zap.String("model", model),
+			zap.Int("status_code", mycommon.GetErrorStatusCode(err)),
+			zap.Error(err))
+		fs.retries[next.ServiceID] = 0
+	}
+
+	c.Set(keyPinnedService, &pinnedService{model: model, s: next})
+	retryReq := mycommon.DeepCopyChatCompletionRequest(*origReq)
+	handleOpenAIRequestWithClientModel(c, &retryReq, clientModel)
+
+	return true
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+const keyContextFallbackModels = "contextFallbackModels"
+
+// tryContextLengthFallback 当上游因输入超出上下文长度失败时，切换到配置的更大上下文模型重新处理请求
+func tryContextLengthFallback(c *gin.Context, s *config.ModelDetails, origReq *openai.ChatCompletionRequest, clientModel string, err error) bool {
+	fallbackModel := s.ContextFallbackModel
+	if fallbackModel == "" || c.Writer.Written() {
+		return false
+	}
+
+	if !mycommon.IsContextLengthError(s.ServiceName, err) {
+		return false
+	}
+
+	// 记录已经尝试过的模型，避免循环切换
+	var triedModels []string
+	if v, exists := c.Get(keyContextFallbackModels); exists {
+		triedModels = v.([]string)
+	}
+	for _, m := range triedModels {
+		if m == fallbackModel {
+			getLogger(c).Warn("context fallback model already tried", zap.String("fallback_model", fallbackModel))
+			return false
+		}
+	}
+	c.Set(keyContextFallbackModels, append(triedModels, origReq.Model))
+
+	getLogger(c).Warn("context length exceeded, fallback to larger context model",
+		zap.String("service_name", s.ServiceName),
+		zap.String("model", origReq.Model),
+		zap.String("fallback_model", fallbackModel),
+		zap.Error(err))
+
+	fallbackReq := mycommon.DeepCopyChatCompletionRequest(*origReq)
+	fallbackReq.Model = fallbackModel
+	handleOpenAIRequestWithClientModel(c, &fallbackReq, clientModel)
+
+	return true
+}
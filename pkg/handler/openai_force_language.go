@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+var defaultForceLanguageInstruction = "Please always respond in %s, regardless of the language used in the input."
+var defaultForceLanguageCorrection = "Your previous answer was not in %s. Please answer again in %s."
+
+// injectLanguageInstruction 在system消息中加入指定输出语言的指令
+func injectLanguageInstruction(oaiReq *openai.ChatCompletionRequest, conf *config.ForceLanguageConf) {
+	instruction := conf.Instruction
+	if instruction == "" {
+		instruction = defaultForceLanguageInstruction
+	}
+	// 自定义的instruction中可能有其他%，只替换语言的占位符
+	instruction = strings.Replace(instruction, "%s", conf.Language, 1)
+
+	if len(oaiReq.Messages) > 0 && strings.ToLower(oaiReq.Messages[0].Role) == openai.ChatMessageRoleSystem && len(oaiReq.Messages[0].MultiContent) == 0 {
+		oaiReq.Messages[0].Content = oaiReq.Messages[0].Content + "\n" + instruction
+		return
+	}
+
+	systemMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: instruction}
+	oaiReq.Messages = append([]openai.ChatCompletionMessage{systemMsg}, oaiReq.Messages...)
+}
+
+// dispatchWithLanguageCheck 非流式请求检查输出语言，不符合时追加纠正消息重新请求
+func dispatchWithLanguageCheck(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	oaiReq := oaiReqParam.chatCompletionReq
+	conf := &oaiReqParam.modelDetails.ForceLanguage
+
+	maxRetries := conf.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 1
+	}
+
+	origWriter := c.Writer
+	defer func() {
+		c.Writer = origWriter
+	}()
+
+	for attempt := 0; ; attempt++ {
+		buf := newResponseBuffer(origWriter)
+		c.Writer = buf
+		if err := dispatchToServiceHandler(c, oaiReqParam); err != nil {
+			return err
+		}
+
+		resp, ok := buf.chatCompletionResponse()
+		if !ok || len(resp.Choices) == 0 || attempt >= maxRetries ||
+			mycommon.IsTextInLanguage(resp.Choices[0].Message.Content, conf.Language) {
+			return buf.flushTo(origWriter)
+		}
+
+		getLogger(c).Warn("response language mismatch, retry",
+			zap.String("language", conf.Language),
+			zap.Int("attempt", attempt+1))
+
+		oaiReq.Messages = append(oaiReq.Messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: resp.Choices[0].Message.Content},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf(defaultForceLanguageCorrection, conf.Language, conf.Language)},
+		)
+	}
+}
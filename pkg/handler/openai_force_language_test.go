@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"testing"
+)
+
+func TestInjectLanguageInstruction(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction string
+		want        string
+	}{
+		{"default", "", "Please always respond in zh, regardless of the language used in the input."},
+		{"placeholder", "Answer in %s.", "Answer in zh."},
+		{"literal percent", "Answer 100% in %s, never %d.", "Answer 100% in zh, never %d."},
+		{"no placeholder", "请始终使用简体中文回答。", "请始终使用简体中文回答。"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}}
+			injectLanguageInstruction(req, &config.ForceLanguageConf{Language: "zh", Instruction: tt.instruction})
+			if len(req.Messages) != 2 || req.Messages[0].Role != openai.ChatMessageRoleSystem {
+				t.Fatalf("messages = %+v", req.Messages)
+			}
+			if req.Messages[0].Content != tt.want {
+				t.Errorf("instruction = %q, want %q", req.Messages[0].Content, tt.want)
+			}
+		})
+	}
+}
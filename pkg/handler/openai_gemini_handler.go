@@ -6,15 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
 	"io"
 	"regexp"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylog"
 
 	//"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -31,10 +32,8 @@ const (
 	RequestTimeout = 1 * time.Minute
 )
 
-// 使用全局客户端
-var geminiHttpClient = &http.Client{
-	Timeout: RequestTimeout,
-}
+// geminiKeyRegexp 日志中隐藏地址里的api key
+var geminiKeyRegexp = regexp.MustCompile(`key=[^&]*`)
 
 // OpenAI2GeminiHandler 主要的处理函数
 func OpenAI2GeminiHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
@@ -42,54 +41,70 @@ func OpenAI2GeminiHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	s := oaiReqParam.modelDetails
 	credentials := oaiReqParam.creds
 
-	//mylog.Logger.Info("oaiReq", zap.Any("oaiReq", oaiReq))
+	serverURL := s.ServerURL
+	if serverURL == "" {
+		serverURL = BaseURL
+	}
+
+	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
+	geminiURL := fmt.Sprintf("%s/%s:%s%s", strings.TrimRight(serverURL, "/"), oaiReq.Model, getRequestType(oaiReq.Stream), apiKey)
+
+	return sendGeminiRequest(c, oaiReqParam, geminiURL, nil)
+}
+
+// sendGeminiRequest 发送generateContent请求并转换响应，Gemini和Vertex AI共用，header为需要额外设置的请求头
+func sendGeminiRequest(c *gin.Context, oaiReqParam *OAIRequestParam, geminiURL string, header http.Header) error {
+	oaiReq := oaiReqParam.chatCompletionReq
+
+	// 客户端只传了max_completion_tokens时使用该值
+	oaiReq.MaxTokens = effectiveMaxTokens(c, oaiReq)
 	geminiReq := adapter.OpenAIRequestToGeminiRequest(oaiReq)
 
 	debugGeminiReq, _ := adapter.DeepCopyGeminiRequest(geminiReq)
-	mylog.Logger.Info("debugGeminiReq", zap.Any("debugGeminiReq", debugGeminiReq))
+	getLogger(c).Info("debugGeminiReq", zap.Any("debugGeminiReq", debugGeminiReq))
 
 	jsonData, err := json.Marshal(geminiReq)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	serverURL := s.ServerURL
-	if serverURL == "" {
-		serverURL = BaseURL
-	}
-
-	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
-	geminiURL := fmt.Sprintf("%s/%s:%s%s", serverURL, oaiReq.Model, getRequestType(oaiReq.Stream), apiKey)
+	getLogger(c).Debug(geminiKeyRegexp.ReplaceAllString(geminiURL, "key=***"))
 
-	mylog.Logger.Debug(geminiURL)
-	//mylog.Logger.Debug(string(jsonData))
+	ctx, cancel := upstreamContext(c, RequestTimeout)
+	defer cancel()
 
-	req, err := http.NewRequest("POST", geminiURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", geminiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set("Content-Type", "application/json")
 
+	// 每个服务的代理可能不同，不能修改共用的客户端
+	client := &http.Client{}
 	if oaiReqParam.httpTransport != nil {
-		geminiHttpClient.Transport = oaiReqParam.httpTransport
+		client.Transport = oaiReqParam.httpTransport
 	}
 
-	resp, err := geminiHttpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		errStr := err.Error()
-		re := regexp.MustCompile(`key=[^&]*`)
-		outputErr := re.ReplaceAllString(errStr, "key=***")
-
-		mylog.Logger.Error(outputErr, zap.Error(err))
+		// 错误信息中包含请求地址，去掉其中的api key，保留原来的错误类型
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = geminiKeyRegexp.ReplaceAllString(urlErr.URL, "key=***")
+		}
+		getLogger(c).Error(err.Error())
 		return err
 	}
 	defer resp.Body.Close()
 
 	err = mycommon.CheckStatusCode(resp)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
@@ -99,25 +114,31 @@ func OpenAI2GeminiHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	return handleRegularResponse(c, oaiReq, resp, oaiReqParam)
 }
 
-// 处理流响应
+// geminiStreamState 整个流式响应使用同一个id和created
+type geminiStreamState struct {
+	id      string
+	created int64
+}
+
+// 处理流响应，Gemini的每个分片是一个完整的GenerateContentResponse
 func handleStreamResponse(c *gin.Context, chatCompletionReq *openai.ChatCompletionRequest, resp *http.Response, oaiReqParam *OAIRequestParam) error {
 	utils.SetEventStreamHeaders(c)
+	state := &geminiStreamState{id: "chatcmpl-" + uuid.New().String(), created: time.Now().Unix()}
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "data: ") {
+			if err := processAndSendData(c, chatCompletionReq, line, oaiReqParam, state); err != nil {
+				return err
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
-
-		if strings.HasPrefix(line, "data: ") {
-			if err := processAndSendData(c, chatCompletionReq, line, oaiReqParam); err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -126,24 +147,26 @@ func handleStreamResponse(c *gin.Context, chatCompletionReq *openai.ChatCompleti
 func handleRegularResponse(c *gin.Context, chatCompletionReq *openai.ChatCompletionRequest, resp *http.Response, oaiReqParam *OAIRequestParam) error {
 	responseBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	mylog.Logger.Info(string(responseBytes))
-
-	if resp.StatusCode != 200 {
-		mylog.Logger.Error(string(responseBytes))
-		return errors.New(string(responseBytes))
-	}
+	getLogger(c).Info(string(responseBytes))
 
 	var geminiResp googlegemini.GeminiResponse
 	if err := json.Unmarshal(responseBytes, &geminiResp); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
+	if geminiResp.PromptFeedback != nil && geminiResp.PromptFeedback.BlockReason != "" {
+		getLogger(c).Warn("gemini prompt blocked", zap.String("block_reason", geminiResp.PromptFeedback.BlockReason))
+	}
 
 	oaiResp := adapter.GeminiResponseToOpenAIResponse(&geminiResp)
+	if oaiResp.Model == "" {
+		oaiResp.Model = chatCompletionReq.Model
+	}
+	utils.SetUpstreamModelHeader(c, oaiResp.Model)
 	oaiResp.Model = oaiReqParam.ClientModel
 
 	c.JSON(http.StatusOK, oaiResp)
@@ -151,33 +174,42 @@ func handleRegularResponse(c *gin.Context, chatCompletionReq *openai.ChatComplet
 }
 
 // 处理并发送流数据
-func processAndSendData(c *gin.Context, chatCompletionReq *openai.ChatCompletionRequest, line string, oaiReqParam *OAIRequestParam) error {
+func processAndSendData(c *gin.Context, chatCompletionReq *openai.ChatCompletionRequest, line string, oaiReqParam *OAIRequestParam, state *geminiStreamState) error {
 	data := strings.TrimPrefix(line, "data: ")
 	data = strings.TrimSpace(data)
 	if data == "" {
 		return nil
 	}
 
-	mylog.Logger.Debug("process genimi data:", zap.String("data", data))
+	getLogger(c).Debug("process genimi data:", zap.String("data", data))
 
 	var response googlegemini.GeminiResponse
 	if err := json.Unmarshal([]byte(data), &response); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
+	if response.PromptFeedback != nil && response.PromptFeedback.BlockReason != "" {
+		getLogger(c).Warn("gemini prompt blocked", zap.String("block_reason", response.PromptFeedback.BlockReason))
+	}
 
 	oaiResp := adapter.GeminiResponseToOpenAIStreamResponse(&response)
+	if oaiResp.Model == "" {
+		oaiResp.Model = chatCompletionReq.Model
+	}
+	utils.SetUpstreamModelHeader(c, oaiResp.Model)
+	oaiResp.ID = state.id
+	oaiResp.Created = state.created
 	oaiResp.Model = oaiReqParam.ClientModel
 	respData, err := json.Marshal(oaiResp)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	mylog.Logger.Info(string(respData))
+	getLogger(c).Debug(string(respData))
 
 	if _, err := c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
-		mylog.Logger.Warn(err.Error())
+		getLogger(c).Warn(err.Error())
 	}
 	c.Writer.(http.Flusher).Flush()
 	return nil
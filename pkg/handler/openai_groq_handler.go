@@ -28,13 +28,12 @@ func OpenAI2GroqOpenAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) erro
 	req := oaiReqParam.chatCompletionReq
 	s := oaiReqParam.modelDetails
 	//credentials := oaiReqParam.creds
-	conf, err := getConfig(s, oaiReqParam)
+	conf, err := getConfig(c, s, oaiReqParam)
 	if err != nil {
 		return err
 	}
 
 	adjustGroqReq(req)
 
-	clientModel := oaiReqParam.ClientModel
-	return handleOpenAIOpenAIRequest(conf, c, req, clientModel)
+	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam, nil)
 }
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+// applyGuardrails 转发给上游前按服务的guardrails配置调整max_tokens、temperature和system消息，
+// on_exceed为error时超出限制返回错误，不修改请求
+func applyGuardrails(c *gin.Context, oaiReq *openai.ChatCompletionRequest, conf *config.GuardrailsConf) error {
+	strict := strings.ToLower(conf.OnExceed) == config.GuardrailsOnExceedError
+
+	maxTokens := effectiveMaxTokens(c, oaiReq)
+	if maxTokens <= 0 {
+		maxTokens = conf.DefaultMaxTokens
+	}
+	if conf.MaxTokens > 0 && maxTokens > 0 {
+		var err error
+		if maxTokens, err = clampMaxTokens(c, oaiReq.Model, maxTokens, maxTokensLimit(conf.MaxTokens), strict); err != nil {
+			return err
+		}
+	}
+
+	temperature := oaiReq.Temperature
+	if r := conf.TemperatureRange; r != nil && (temperature != 0 || isExplicitZeroTemperature(c, oaiReq)) {
+		// 按float32比较，避免0.1等配置值因为精度被误判为超出范围
+		lo, hi := float32(r.Min), float32(r.Max)
+		if temperature < lo || temperature > hi {
+			if strict {
+				return fmt.Errorf("temperature %g is out of the allowed range [%g, %g] for model '%s'", temperature, lo, hi, oaiReq.Model)
+			}
+			if temperature < lo {
+				temperature = lo
+			} else {
+				temperature = hi
+			}
+			getLogger(c).Warn("temperature clamped", zap.String("model", oaiReq.Model), zap.Float32("temperature", oaiReq.Temperature), zap.Float32("adjusted", temperature))
+		}
+	}
+
+	if maxTokens > 0 {
+		oaiReq.MaxTokens = maxTokens
+	}
+	oaiReq.Temperature = temperature
+
+	if conf.SystemPrompt != "" {
+		injectGuardrailSystemPrompt(oaiReq, conf)
+	}
+	return nil
+}
+
+// injectGuardrailSystemPrompt 在对话最前面加上配置的system消息，客户端的system消息中已经包含相同内容时不再添加，
+// override为true时去掉客户端的system消息。除moonshot等服务外只保留第一条system消息，所以与第一条system消息合并
+func injectGuardrailSystemPrompt(oaiReq *openai.ChatCompletionRequest, conf *config.GuardrailsConf) {
+	messages := make([]openai.ChatCompletionMessage, 0, len(oaiReq.Messages)+1)
+	for _, msg := range oaiReq.Messages {
+		if strings.ToLower(msg.Role) != openai.ChatMessageRoleSystem {
+			messages = append(messages, msg)
+			continue
+		}
+		if conf.Override {
+			continue
+		}
+		if strings.Contains(mycommon.GetMessageText(msg), conf.SystemPrompt) {
+			return
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(messages) > 0 && strings.ToLower(messages[0].Role) == openai.ChatMessageRoleSystem && len(messages[0].MultiContent) == 0 {
+		messages[0].Content = conf.SystemPrompt + "\n" + messages[0].Content
+		oaiReq.Messages = messages
+		return
+	}
+
+	systemMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: conf.SystemPrompt}
+	oaiReq.Messages = append([]openai.ChatCompletionMessage{systemMsg}, messages...)
+}
@@ -3,7 +3,9 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
@@ -11,10 +13,16 @@ import (
 	"net/http"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myaudit"
+	"simple-one-api/pkg/mycache"
+	"simple-one-api/pkg/mycomdef"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylimiter"
-	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/myplugin"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/myusage"
+	myopenai "simple-one-api/pkg/openai"
 	"simple-one-api/pkg/utils"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,7 +33,9 @@ type OAIRequestParam struct {
 	chatCompletionReq *openai.ChatCompletionRequest
 	modelDetails      *config.ModelDetails
 	creds             map[string]interface{}
-	httpTransport     *http.Transport
+	httpTransport     http.RoundTripper
+	upstreamCapture   *upstreamCapture
+	bodyPatch         map[string]interface{}
 	ClientModel       string
 }
 
@@ -50,12 +60,17 @@ var serviceHandlerMap = map[string]func(*gin.Context, *OAIRequestParam) error{
 	"bailian":      OpenAI2AliyunBaiLianHandler,
 	"vertexai":     OpenAI2VertexAIHandler,
 	"claude":       OpenAI2ClaudeHandler,
+	"bedrock":      OpenAI2BedrockHandler,
 	"agentbuilder": OpenAI2AgentBuilderHandler,
+	"perplexity":   OpenAI2PerplexityHandler,
+	"xai":          OpenAI2XAIHandler,
+	"grok":         OpenAI2XAIHandler,
+	"mock":         OpenAI2MockHandler,
 }
 
 func LogRequestDetails(c *gin.Context) {
 	// 使用 zap 的字段记录功能来记录请求细节
-	mylog.Logger.Debug("HTTP request details",
+	getLogger(c).Debug("HTTP request details",
 		zap.String("method", c.Request.Method),
 		zap.String("path", c.Request.URL.Path),
 		zap.Any("parameters", c.Request.URL.Query()),
@@ -88,36 +103,28 @@ func OpenAIHandler(c *gin.Context) {
 
 	apikey, err := utils.GetAPIKeyFromHeader(c)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 	}
 
-	mylog.Logger.Info("OpenAIHandler", zap.String("apikey", apikey))
-
-	isValid := validateAPIKey(apikey)
-	if !isValid {
-		err = errors.New("key is not valid")
-		mylog.Logger.Error("key is not valid", zap.String("apikey", apikey))
-		sendErrorResponse(c, http.StatusUnauthorized, err.Error())
-		return
-	}
+	getLogger(c).Info("OpenAIHandler", zap.String("key_name", getAuthKeyName(c)))
 
 	bodyData, getBodyerr := getBodyDataCopy(c)
 
 	var oaiReq openai.ChatCompletionRequest
 	if err := c.ShouldBindJSON(&oaiReq); err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		// 尝试重新解析请求体
 
 		if getBodyerr != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			sendErrorResponse(c, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		mylog.Logger.Debug(string(bodyData))
+		getLogger(c).Debug(string(bodyData))
 		parsedReq, parseErr := mycommon.ParseChatCompletionRequest(bodyData)
 		if parseErr != nil {
-			mylog.Logger.Error("ParseChatCompletionRequest error: " + parseErr.Error())
+			getLogger(c).Error("ParseChatCompletionRequest error: " + parseErr.Error())
 			sendErrorResponse(c, http.StatusBadRequest, parseErr.Error())
 			return
 		}
@@ -126,15 +133,31 @@ func OpenAIHandler(c *gin.Context) {
 		oaiReq = *parsedReq
 	}
 
-	isValid, _ = config.ValidateAPIKeyAndModel(apikey, oaiReq.Model)
-	if !isValid {
-		err = errors.New("key not valid")
-		mylog.Logger.Error(err.Error())
-		sendErrorResponse(c, http.StatusUnauthorized, err.Error())
+	if !checkModelAllowed(c, oaiReq.Model) {
+		return
+	}
+
+	if !applySizeLimits(c, &oaiReq, len(bodyData)) {
 		return
 	}
 
-	mycommon.LogChatCompletionRequest(oaiReq)
+	applyAcceptFormat(c, &oaiReq)
+
+	if oaiReq.Stream {
+		maxStreams := config.GetMaxStreams(apikey)
+		if !mycommon.AcquireStream(apikey, maxStreams) {
+			getLogger(c).Warn("too many concurrent streams", zap.String("apikey", mycommon.MaskKey(apikey)), zap.Int("max_streams", maxStreams))
+			sendErrorResponse(c, http.StatusTooManyRequests, fmt.Sprintf("too many concurrent streams, the maximum allowed is %d", maxStreams))
+			return
+		}
+		defer mycommon.ReleaseStream(apikey)
+	}
+
+	if config.GetConf().PromptLogSampling.Enable {
+		defer startPromptLog(c, &oaiReq)()
+	} else {
+		mycommon.LogChatCompletionRequest(c.Request.Context(), oaiReq)
+	}
 
 	HandleOpenAIRequest(c, &oaiReq)
 
@@ -142,31 +165,160 @@ func OpenAIHandler(c *gin.Context) {
 }
 
 func HandleOpenAIRequest(c *gin.Context, oaiReq *openai.ChatCompletionRequest) {
+	soaConf := config.GetConf()
 
 	clientModel := oaiReq.Model
+	trace := newRequestTrace(c, oaiReq)
 
-	//全局模型重定向名称
-	gRedirectModel := config.GetGlobalModelRedirect(clientModel)
+	defer newClientWriteGuard(c)()
+	if conf := &soaConf.SizeLimits; oaiReq.Stream && conf.StreamBuffer > 0 {
+		defer newStreamBuffer(c, conf).finish()
+	}
+
+	if soaConf.Metrics.Enable || soaConf.AccessLog || soaConf.Dashboard.Enable {
+		mw := newMetricsWriter(c.Writer, trace)
+		c.Writer = mw
+		defer mw.finish()
+	}
+
+	if oaiReq.Stream && isNDJSONRequested(c) {
+		nw := newNDJSONWriter(c.Writer)
+		c.Writer = nw
+		defer nw.finish()
+	}
+
+	if cancel := applyHeaderTimeout(c); cancel != nil {
+		defer cancel()
+	}
+
+	parseBackendPreference(c)
+
+	if soaConf.TimingHeaders {
+		c.Writer = newTimingHeaderWriter(c.Writer, trace)
+	}
+
+	hc := newHookContext(c, clientModel)
+	if !runPluginRequestHooks(c, hc, oaiReq) {
+		return
+	}
+
+	if needResponseRecord() || soaConf.ConversationUsage.Enable || myusage.Enabled() || myaudit.Enabled() || isKeyLimited(c) || isPricingEnabled() || isStreamTranscriptEnabled(oaiReq) {
+		origReq := mycommon.DeepCopyChatCompletionRequest(*oaiReq)
+		recorder := newResponseRecorder(c.Writer)
+		c.Writer = recorder
+		if isStreamTranscriptEnabled(oaiReq) {
+			recorder.recordTranscript()
+			defer finishStreamTranscript(c, hc, clientModel, recorder)
+		}
+		if isPricingEnabled() {
+			cw := newCostHeaderWriter(c.Writer, trace, &origReq, recorder)
+			c.Writer = cw
+			defer cw.finish()
+		}
+		defer publishRequestEvent(trace, &origReq, recorder)
+		defer recordConversationUsage(c, trace, &origReq, recorder)
+		defer recordKeyUsage(c, trace, &origReq, recorder)
+		defer recordAudit(c, trace, &origReq, recorder)
+		defer recordKeyLimitTokens(c, trace, &origReq, recorder)
+	}
+
+	defer trace.logAttempts(c)
+
+	if oaiReq.Stream {
+		sw := newIdentityStreamWriter(c.Writer)
+		sw.trackDone = true
+		if isStreamUsageRequested(oaiReq) {
+			splitter := &streamUsageSplitter{}
+			sw.transformers = append(sw.transformers, splitter.transformer())
+			sw.beforeDone = splitter.beforeDone
+		}
+		if myplugin.HasStreamChunkHooks() {
+			sw.transformers = append(sw.transformers, newPluginStreamTransformer(hc))
+		}
+		c.Writer = sw
+		defer sw.ensureDone(c)
+
+		if pacing := config.GetStreamPacing(clientModel); pacing != nil {
+			pw := newPacedStreamWriter(c, pacing)
+			c.Writer = pw
+			defer pw.finish()
+		}
+	}
+
+	if !oaiReq.Stream && myplugin.HasResponseHooks() {
+		pb := newPluginResponseBuffer(c.Writer)
+		c.Writer = pb
+		defer func() {
+			c.Writer = pb.origWriter
+			pb.finish(hc)
+		}()
+	}
 
-	oaiReq.Model = gRedirectModel
+	if moderation := &soaConf.Moderation; isModerationModel(moderation, clientModel) {
+		if moderation.Input && !moderateInput(c, moderation, oaiReq) {
+			return
+		}
+		if moderation.Output && oaiReq.Stream {
+			mw := newModerationStreamWriter(c, moderation, clientModel)
+			c.Writer = mw
+			defer mw.finish()
+		} else if moderation.Output {
+			mb := newModerationBuffer(c.Writer)
+			c.Writer = mb
+			defer func() {
+				c.Writer = mb.origWriter
+				mb.finish(c, moderation, clientModel)
+			}()
+		}
+	}
 
-	s, serviceModelName, err := getModelDetails(oaiReq)
+	handleWithResponseCache(c, oaiReq, func() {
+		handleOpenAIRequestWithClientModel(c, oaiReq, clientModel)
+	})
+}
+
+func handleOpenAIRequestWithClientModel(c *gin.Context, oaiReq *openai.ChatCompletionRequest, clientModel string) {
+	soaConf := config.GetConf()
+	// 保留一份原始请求，用于切换到其他模型时重新处理
+	origReq := mycommon.DeepCopyChatCompletionRequest(*oaiReq)
+
+	oaiReq.Model = resolveServiceModel(c, oaiReq)
+	serviceModel := oaiReq.Model
+
+	s, serviceModelName, err := getPreferredModelDetails(c, oaiReq)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		sendErrorResponse(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	mycommon.AcquireService(s.ServiceID)
+	defer mycommon.ReleaseService(s.ServiceID)
+
+	// 在其他处理之前先按字符数做粗略的长度检查
+	if s.MaxPromptChars > 0 {
+		if promptChars := mycommon.CountMessagesChars(oaiReq.Messages); promptChars > s.MaxPromptChars {
+			errMsg := fmt.Sprintf("prompt is too long: %d characters, the maximum allowed is %d", promptChars, s.MaxPromptChars)
+			getLogger(c).Warn(errMsg, zap.String("model", oaiReq.Model))
+			sendErrorResponse(c, http.StatusBadRequest, errMsg)
+			return
+		}
+	}
+
 	//模型重定向名称
-	mrModel := config.GetModelRedirect(s, serviceModelName)
+	mrModel := config.GetModelRedirect(s, config.StripTenantModelKey(serviceModelName))
 	mpModel := config.GetModelMapping(s, mrModel)
 
 	oaiReq.Model = mpModel
 
-	mylog.Logger.Info("Service details",
+	trace := getRequestTrace(c)
+	trace.ServiceName = s.ServiceName
+	trace.Model = oaiReq.Model
+
+	getLogger(c).Info("Service details",
 		zap.String("service_name", s.ServiceName),
 		zap.String("client_model", clientModel),
-		zap.String("g_redirect_model", gRedirectModel),
+		zap.String("g_redirect_model", config.GetGlobalModelRedirect(origReq.Model)),
 		zap.String("service_model_name", serviceModelName),
 		zap.String("redirect_model", mrModel),
 		zap.String("map_model", mpModel),
@@ -174,27 +326,32 @@ func HandleOpenAIRequest(c *gin.Context, oaiReq *openai.ChatCompletionRequest) {
 
 	if mycommon.IsMultiContentMessage(oaiReq.Messages) {
 		isSupportMC := config.IsSupportMultiContent(oaiReq.Model)
+		if !isSupportMC && mycommon.HasImageContent(oaiReq.Messages) && !config.IsUnsupportedImageToText() {
+			errMsg := fmt.Sprintf("model %s does not support image input", oaiReq.Model)
+			getLogger(c).Warn(errMsg, zap.String("service_name", s.ServiceName))
+			sendErrorResponse(c, http.StatusBadRequest, errMsg)
+			return
+		}
 		if !isSupportMC {
-			mylog.Logger.Warn("model support vision", zap.Bool("isSupportMC", isSupportMC))
+			getLogger(c).Warn("model support vision", zap.Bool("isSupportMC", isSupportMC))
 			//convert message
 			adapter.OpenAIMultiContentRequestToOpenAIContentRequest(oaiReq)
-			mylog.Logger.Info("", zap.Any("oaiReq", oaiReq))
-		} else {
-
+			getLogger(c).Info("", zap.Any("oaiReq", mycommon.ElideBase64Images(oaiReq)))
+		} else if s.ImageDownscale.MaxDimension > 0 {
+			if n := mycommon.DownscaleImages(oaiReq.Messages, &s.ImageDownscale); n > 0 {
+				getLogger(c).Info("images downscaled", zap.Int("count", n), zap.Int("max_dimension", s.ImageDownscale.MaxDimension))
+			}
 		}
 	}
 
-	creds, credsID := mycommon.GetACredentials(s, oaiReq.Model)
-
-	var limiter *mylimiter.Limiter
-	lt, ln, timeout := mycommon.GetServiceModelDetailsLimit(s)
-	if lt != "" && ln > 0 {
-		limiter = mylimiter.GetLimiter(s.ServiceID, lt, ln)
-	} else {
-		lt, ln, timeout = mycommon.GetCredentialLimit(creds)
-		if lt != "" && ln > 0 {
-			limiter = mylimiter.GetLimiter(credsID, lt, ln)
-		}
+	creds, credsID := getAffinityCredentials(c, oaiReq, s, serviceModelName)
+	if credsID != "" {
+		mycommon.AcquireCredential(credsID)
+		defer mycommon.ReleaseCredential(credsID)
+		getLogger(c).Info("credential selected",
+			zap.String("service_name", s.ServiceName),
+			zap.String("credential_id", credsID),
+			zap.String("key", mycommon.MaskKey(mycommon.GetCredentialKey(creds))))
 	}
 
 	oaiReqParam := &OAIRequestParam{
@@ -204,92 +361,421 @@ func HandleOpenAIRequest(c *gin.Context, oaiReq *openai.ChatCompletionRequest) {
 		ClientModel:       clientModel,
 	}
 
-	if limiter != nil {
-		if timeout <= 0 {
-			timeout = defaultReqTimeout
+	release, ok := acquireRateLimit(c, s, creds, credsID, oaiReq.Model, trace)
+	if !ok {
+		return
+	}
+	defer release()
+
+	proxyAddr, transport, err := config.GetServiceTransport(s)
+	if err != nil {
+		getLogger(c).Error("GetServiceTransport", zap.String("service_name", s.ServiceName), zap.Error(err))
+	} else {
+		if proxyAddr != "" {
+			getLogger(c).Debug("GetServiceTransport", zap.String("service_name", s.ServiceName), zap.String("proxy", proxyAddr))
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-		defer cancel()
+		oaiReqParam.httpTransport = mytrace.WrapTransport(transport)
+	}
 
-		startWaitTime := time.Now()
-
-		mylog.Logger.Info("Rate limits and timeout configuration",
-			zap.String("limit type:", lt),
-			zap.Float64("limit num:", ln),
-			zap.Int("timeout", timeout))
-
-		if lt == "qps" || lt == "qpm" {
-			err = limiter.Wait(ctx)
-			elapsed := time.Since(startWaitTime)
-
-			if err != nil {
-				if errors.Is(err, context.DeadlineExceeded) {
-					// Log a message if the request could not obtain a token within the specified timeout period.
-					// 假设 logger 是一个已经配置好的 zap.Logger 实例
-					mylog.Logger.Error("Failed to obtain token within the specified time",
-						zap.Error(err),                   // 记录错误对象
-						zap.Int("timeout", timeout),      // 假设 timeout 是 time.Duration 类型
-						zap.Duration("elapsed", elapsed)) // 假设 elapsed 是 time.Duration 类型
-
-				} else if errors.Is(err, context.Canceled) {
-					// Log a message if the operation was canceled.
-					mylog.Logger.Error("Operation canceled %v, actual waiting time: %v", zap.Error(err), zap.Duration("elapsed", elapsed))
-				} else {
-					// Log a message for any other unknown errors that occurred while waiting for a token.
-					mylog.Logger.Error("Unknown error occurred while waiting for a token: ", zap.Error(err), zap.Duration("elapsed", elapsed))
-				}
-
-				//waitDuration := time.Since(startWaitTime)
-				mylog.Logger.Info("waited for: ", zap.Duration("elapsed", elapsed))
-				sendErrorResponse(c, http.StatusTooManyRequests, "Request rate limit exceeded")
-				return
-			}
-			// 假设 logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Info("Wait duration",
-				zap.Duration("waited_for", time.Since(startWaitTime)))
+	keepAllSystem := false
 
-		} else if lt == "concurrency" {
+	//moonshot支持system模型，并且system可以放在任何位置并且可以是多个
+	if s.Provider == "moonshot" || strings.HasPrefix(s.ServerURL, "https://api.moonshot.cn") {
+		keepAllSystem = true
+	}
+	//claude的system消息会统一合并到单独的system字段
+	if strings.ToLower(s.ServiceName) == "claude" {
+		keepAllSystem = true
+	}
+
+	if err := applyGuardrails(c, oaiReq, &s.Guardrails); err != nil {
+		getLogger(c).Warn(err.Error(), zap.String("service_name", s.ServiceName))
+		var pcErr *paramConstraintError
+		if errors.As(err, &pcErr) {
+			sendParamConstraintError(c, pcErr)
+		} else {
+			sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
 
-			err := limiter.Acquire(ctx)
-			if err != nil {
-				mylog.Logger.Error(err.Error())
+	if tmpl := config.GetPromptTemplate(clientModel); tmpl != nil && !c.GetBool(keySkipPromptTemplate) {
+		applyPromptTemplate(c, oaiReq, s, tmpl, clientModel)
+	}
+
+	if constraints := config.GetParamConstraints(s, oaiReq.Model); constraints != nil {
+		if err := applyParamConstraints(c, oaiReq, constraints); err != nil {
+			getLogger(c).Warn(err.Error(), zap.String("service_name", s.ServiceName))
+			var pcErr *paramConstraintError
+			if errors.As(err, &pcErr) {
+				sendParamConstraintError(c, pcErr)
+			} else {
+				sendErrorResponse(c, http.StatusBadRequest, err.Error())
 			}
-			defer limiter.Release()
+			return
+		}
+	}
+
+	var clErr *contextLengthError
+	if err := applyContextCheck(c, oaiReq, s); errors.As(err, &clErr) {
+		getLogger(c).Warn(err.Error(), zap.String("service_name", s.ServiceName))
+		// 配置了context_fallback_model时与上游返回超出上下文长度的错误一样切换模型
+		if tryContextLengthFallback(c, s, &origReq, clientModel, err) {
+			return
+		}
+		sendContextLengthError(c, clErr)
+		return
+	}
+
+	applyParamCompat(c, oaiReq, s.ServiceName)
+
+	if isLogProbsRequested(oaiReq) && config.IsNoLogProbs(s) {
+		getLogger(c).Warn(errLogProbsNotSupported.Error(), zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model))
+		sendErrorResponse(c, http.StatusBadRequest, errLogProbsNotSupported.Error())
+		return
+	}
+
+	if s.RedactPaths.Upstream && len(s.RedactPaths.Paths) > 0 {
+		*oaiReq = *mycommon.RedactRequestPaths(oaiReq, s.RedactPaths.Paths)
+	}
+
+	if len(s.InjectTools) > 0 {
+		injected := injectTools(oaiReq, s.InjectTools)
+		getLogger(c).Debug("inject tools", zap.Int("injected", injected), zap.Int("tools", len(oaiReq.Tools)))
+	}
+
+	if len(oaiReq.Tools) > 0 && config.IsNoTools(s) {
+		getLogger(c).Warn("tools are not supported by the service and will be ignored",
+			zap.String("service_name", s.ServiceName), zap.Int("tools", len(oaiReq.Tools)))
+	}
+
+	if s.ConversationID.Enable {
+		injectConversationID(c, oaiReq, &s.ConversationID)
+	}
 
-			mylog.Logger.Info("Concurrency wait time",
-				zap.Duration("waited_for", time.Since(startWaitTime)))
+	if s.ForceLanguage.Language != "" {
+		injectLanguageInstruction(oaiReq, &s.ForceLanguage)
+	}
+
+	toolChoiceRequired := isToolChoiceRequired(oaiReq)
+	if toolChoiceRequired && config.IsNoToolChoiceRequired(s) {
+		if s.ToolChoiceRequired.Mode == config.ToolChoiceRequiredModeError {
+			getLogger(c).Warn(errToolChoiceRequiredNotSupported.Error(), zap.String("model", oaiReq.Model))
+			sendErrorResponse(c, http.StatusBadRequest, errToolChoiceRequiredNotSupported.Error())
+			return
 		}
+		injectToolChoiceInstruction(oaiReq, &s.ToolChoiceRequired)
+	}
+
+	if err := checkResponseFormat(c, oaiReq); err != nil {
+		getLogger(c).Warn("invalid response_format", zap.String("model", oaiReq.Model), zap.Error(err))
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
 
+	jsonModeFallback := isJSONModeRequested(oaiReq) && config.IsNoJSONMode(s)
+	jsonSchema := getJSONSchemaFormat(c, oaiReq)
+	if jsonSchema != nil && config.IsNoJSONSchema(s) {
+		jsonModeFallback = true
+		injectJSONSchemaInstruction(oaiReq, &s.JSONMode, jsonSchema, !config.IsNoJSONMode(s))
+	} else if jsonModeFallback {
+		injectJSONModeInstruction(oaiReq, &s.JSONMode)
 	}
 
-	if config.IsProxyEnabled(s) {
-		proxyType, proxyAddr, transport, err := config.GetConfProxyTransport()
-		if err != nil {
-			mylog.Logger.Error("GetConfProxyTransport", zap.Error(err))
-		} else {
-			mylog.Logger.Debug("GetConfProxyTransport", zap.String("proxyType", proxyType), zap.String("proxyAddr", proxyAddr))
-			oaiReqParam.httpTransport = transport
+	if s.DedupMessages {
+		var removed int
+		oaiReq.Messages, removed = mycommon.DedupConsecutiveMessages(oaiReq.Messages)
+		if removed > 0 {
+			getLogger(c).Warn("duplicate consecutive messages removed",
+				zap.String("model", oaiReq.Model),
+				zap.Int("removed", removed))
 		}
 	}
 
-	keepAllSystem := false
+	if s.AssistantHistory.MaxChars > 0 {
+		keepRecent := config.DefaultAssistantHistoryKeepRecent
+		if s.AssistantHistory.KeepRecent != nil {
+			keepRecent = *s.AssistantHistory.KeepRecent
+		}
+		var savedTokens int
+		oaiReq.Messages, savedTokens = mycommon.TruncateAssistantHistory(oaiReq.Messages, s.AssistantHistory.MaxChars, keepRecent)
+		if savedTokens > 0 {
+			getLogger(c).Info("assistant history truncated",
+				zap.String("model", oaiReq.Model),
+				zap.Int("saved_tokens", savedTokens))
+		}
+	}
 
-	//moonshot支持system模型，并且system可以放在任何位置并且可以是多个
-	if s.Provider == "moonshot" || strings.HasPrefix(s.ServerURL, "https://api.moonshot.cn") {
-		keepAllSystem = true
+	if config.IsAlternatingRoles(s) {
+		oaiReq.Messages = mycommon.MergeConsecutiveRoleMessages(oaiReq.Messages, mycommon.DefaultMergeSeparator)
 	}
-	//mylog.Logger.Debug("oaiReq", zap.Any("oaiReq", oaiReq))
+
+	//getLogger(c).Debug("oaiReq", zap.Any("oaiReq", oaiReq))
 	oaiReq.Messages = mycommon.NormalizeMessages(oaiReq.Messages, keepAllSystem)
 
-	if err := dispatchToServiceHandler(c, oaiReqParam); err != nil {
-		mylog.Logger.Error(err.Error())
-		sendErrorResponse(c, http.StatusInternalServerError, err.Error())
+	separator := s.SystemPrompt.Separator
+	if separator == "" {
+		separator = config.DefaultSystemPromptSeparator
+	}
+	if config.IsNoSystemRole(s) {
+		oaiReq.Messages = mycommon.FoldSystemMessages(oaiReq.Messages, separator, s.SystemPrompt.Template)
+	} else if s.SystemPrompt.MaxChars > 0 {
+		truncate := strings.ToLower(s.SystemPrompt.Overflow) == config.SystemPromptOverflowTruncate
+		var overflowChars int
+		oaiReq.Messages, overflowChars = mycommon.SplitSystemPrompt(oaiReq.Messages, s.SystemPrompt.MaxChars, truncate, separator)
+		if overflowChars > 0 {
+			getLogger(c).Warn("system prompt exceeds limit",
+				zap.String("model", oaiReq.Model),
+				zap.Int("max_chars", s.SystemPrompt.MaxChars),
+				zap.Int("overflow_chars", overflowChars),
+				zap.Bool("truncated", truncate))
+		}
+	}
+
+	limiter, _, _ := getRateLimiter(s, creds, credsID, oaiReq.Model)
+	mc, err := getMultipleChoices(c, s, oaiReq, limiter)
+	if err != nil {
+		getLogger(c).Warn(err.Error(), zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model))
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	dispatch := dispatchToServiceHandler
+	if s.StreamDecision.Enable {
+		dispatch = withStreamDecision(dispatch, &s.StreamDecision)
+	}
+	if !oaiReq.Stream && s.ForceLanguage.PostCheck && mycommon.IsLanguageCheckable(s.ForceLanguage.Language) {
+		dispatch = dispatchWithLanguageCheck
+	}
+	if toolChoiceRequired && !oaiReq.Stream {
+		dispatch = withToolCallCheck(dispatch)
+	}
+	if jsonModeFallback && !oaiReq.Stream && s.JSONMode.Validate {
+		dispatch = withJSONModeCheck(dispatch, jsonSchema)
+	}
+	if !oaiReq.Stream && isResponseTrimEnabled(&s.ResponseTrim) {
+		dispatch = withResponseTrim(dispatch)
+	}
+	if !oaiReq.Stream && needUsageNormalization(s.UsageFactor) {
+		dispatch = withResponseTransform(dispatch, newUsageNormalizeTransformer(s.UsageFactor))
+	}
+	if !oaiReq.Stream && soaConf.SyntheticFingerprint {
+		dispatch = withResponseTransform(dispatch, newSystemFingerprintTransformer(getSyntheticFingerprint(s, oaiReq.Model)))
+	}
+	if mc != nil {
+		dispatch = withMultipleChoices(dispatch, mc)
+	}
+	if isUpstreamDebugRequested(c) {
+		oaiReqParam.upstreamCapture = &upstreamCapture{}
+		defer oaiReqParam.upstreamCapture.log(c, s, oaiReq.Model)
+		if !oaiReq.Stream {
+			dispatch = withResponseTransform(dispatch, newUpstreamDebugTransformer(oaiReqParam.upstreamCapture, s, oaiReq.Model))
+		}
+	}
+
+	// 下面为本次请求包装的c.Writer，重新处理时需要恢复，否则每次重试都会再包装一层
+	origWriter := c.Writer
+	var staleRecorder *responseRecorder
+	if s.StaleOnError.Enable {
+		staleRecorder = newResponseRecorder(c.Writer)
+		c.Writer = staleRecorder
+	}
+
+	var usageEstimator *streamUsageEstimator
 	if oaiReq.Stream {
+		var transformers []streamChunkTransformer
+		if soaConf.StreamUsageEstimate && isStreamUsageRequested(oaiReq) {
+			usageEstimator = &streamUsageEstimator{}
+			transformers = append(transformers, usageEstimator.transformer())
+		}
+		if needUsageNormalization(s.UsageFactor) {
+			transformers = append(transformers, newUsageNormalizeTransformer(s.UsageFactor))
+		}
+		if soaConf.SyntheticFingerprint {
+			transformers = append(transformers, newSystemFingerprintTransformer(getSyntheticFingerprint(s, oaiReq.Model)))
+		}
+		if oaiReqParam.upstreamCapture != nil {
+			transformers = append(transformers, newUpstreamDebugTransformer(oaiReqParam.upstreamCapture, s, oaiReq.Model))
+		}
+		if len(transformers) > 0 {
+			sw := newStreamWriter(c.Writer, transformers...)
+			c.Writer = sw
+			defer sw.finish()
+		}
+	}
+
+	if oaiReq.Stream && isResponseTrimEnabled(&s.ResponseTrim) {
+		trimWriter := newTrimStreamWriter(c.Writer, &s.ResponseTrim)
+		c.Writer = trimWriter
+		defer trimWriter.finish()
+	}
+
+	var durationLimiter *streamDurationLimiter
+	if oaiReq.Stream && s.MaxStreamDuration > 0 {
+		durationLimiter = newStreamDurationLimiter(c, time.Duration(s.MaxStreamDuration)*time.Second)
+	}
+
+	// 按非流式请求上游时没有分片，不做空闲超时的判断
+	var idleLimiter *streamIdleLimiter
+	if oaiReq.Stream && s.StreamIdleTimeout.Timeout > 0 && (!s.StreamDecision.Enable || decideUpstreamStream(&s.StreamDecision, oaiReq)) {
+		idleLimiter = newStreamIdleLimiter(c, s)
+	}
+
+	// 非流式请求的总时长，model_timeouts中配置的模型流式请求同样限制总时长，超时后按504返回或切换到其他后端
+	var stopRequestTimeout func() bool
+	requestTimeout := 0
+	if !oaiReq.Stream {
+		requestTimeout = s.RequestTimeout
+	}
+	if t := config.GetModelTimeout(s, oaiReq.Model); t > 0 {
+		requestTimeout = t
+	}
+	if requestTimeout > 0 {
+		stopRequestTimeout = applyRequestTimeout(c, time.Duration(requestTimeout)*time.Second)
+	}
+
+	// 第一个分片之后的时长由max_stream_duration和stream_idle_timeout限制
+	var firstTokenLimit *firstTokenLimiter
+	if oaiReq.Stream && s.FirstTokenTimeout > 0 {
+		firstTokenLimit = newFirstTokenLimiter(c, time.Duration(s.FirstTokenTimeout)*time.Second)
+	}
+
+	if len(trace.Attempts) == 0 {
+		mycommon.RecordRetryBudgetRequest(s)
+	}
+
+	if oaiReqParam.upstreamCapture != nil {
+		oaiReqParam.upstreamCapture.setGatewayRequest(oaiReq)
+	}
+
+	attemptStart := time.Now()
+	trace.UpstreamStart = attemptStart
+	var upstreamMetrics *upstreamMetricsWriter
+	if oaiReq.Stream && soaConf.Metrics.Enable {
+		upstreamMetrics = newUpstreamMetricsWriter(c, trace.Model, s.ServiceName, attemptStart)
+	}
+	endAdapterSpan := startAdapterSpan(c, s, oaiReqParam, len(trace.Attempts)+1)
+	err = dispatch(c, oaiReqParam)
+	endAdapterSpan(err)
+	if upstreamMetrics != nil {
+		upstreamMetrics.stop(c)
+	}
+	firstTokenExpired := firstTokenLimit != nil && firstTokenLimit.stop(c)
+	// 流式响应被中断时部分处理函数不返回错误，同样按超时处理
+	if stopRequestTimeout != nil && stopRequestTimeout() && (err != nil || oaiReq.Stream) {
+		getLogger(c).Warn("upstream request timeout", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model), zap.Int("timeout", requestTimeout), zap.Error(err))
+		err = errUpstreamRequestTimeout
+	}
+	idleExpired := idleLimiter != nil && idleLimiter.stop(c)
+	if durationLimiter != nil && durationLimiter.stop(c) {
+		getLogger(c).Warn("stream reached max duration", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model), zap.Int("max_stream_duration", s.MaxStreamDuration))
+		if err = sendStreamLengthFinish(c, clientModel); err == nil {
+			utils.SendOpenAIStreamEOFData(c)
+		}
+		trace.addAttempt(s, creds, c.Writer.Status(), time.Since(attemptStart), nil)
+		return
+	}
+	if firstTokenExpired {
+		getLogger(c).Warn("stream first token timeout", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model), zap.Int("first_token_timeout", s.FirstTokenTimeout))
+		err = errFirstTokenTimeout
+	}
+	if idleExpired {
+		getLogger(c).Warn("stream idle timeout", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model), zap.Int("stream_idle_timeout", s.StreamIdleTimeout.Timeout))
+		if c.Writer.Written() {
+			trace.addAttempt(s, creds, c.Writer.Status(), time.Since(attemptStart), errStreamIdleTimeout)
+			sendUpstreamErrorResponse(c, s.ServiceName, errStreamIdleTimeout)
+			return
+		}
+		err = errStreamIdleTimeout
+	}
+	trace.addAttempt(s, creds, c.Writer.Status(), time.Since(attemptStart), err)
+	if err == nil {
+		mycommon.RecordServiceLatency(s.ServiceID, time.Since(attemptStart))
+		mycommon.RecordServiceSuccess(s)
+	}
+
+	if err != nil && isClientDisconnected(c, err) {
+		trace.markClientDisconnect()
+		getLogger(c).Info("client disconnected", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model), zap.Error(err))
+		return
+	}
+
+	if err != nil {
+		if isUpstreamUnavailable(err) {
+			mycommon.RecordServiceFailure(s, err)
+		}
+		switch code := mycommon.GetErrorStatusCode(err); {
+		case code == http.StatusTooManyRequests, code == http.StatusUnauthorized, code == http.StatusForbidden,
+			s.CredentialFailover && code >= http.StatusInternalServerError:
+			mycommon.QuarantineCredential(credsID, time.Duration(config.GetCredentialQuarantine())*time.Second)
+		}
+		attemptWriter := c.Writer
+		c.Writer = origWriter
+		if tryCredentialRetry(c, s, credsID, serviceModelName, &origReq, clientModel, err) ||
+			tryContextLengthFallback(c, s, &origReq, clientModel, err) ||
+			tryBackendPreferenceFallback(c, &origReq, clientModel, err) ||
+			tryFailover(c, s, serviceModelName, &origReq, clientModel, err) ||
+			tryModelFallback(c, s, &origReq, clientModel, err) {
+			return
+		}
+		c.Writer = attemptWriter
+		if s.StaleOnError.Enable && serveStaleResponse(c, mycache.GetRequestKey(&origReq, getTenantName(c), serviceModel), clientModel, oaiReq.Stream, err) {
+			return
+		}
+		getLogger(c).Error(err.Error())
+		sendUpstreamErrorResponse(c, s.ServiceName, err)
+		return
+	}
+
+	if oaiReq.Stream {
+		if usageEstimator != nil {
+			usageEstimator.writeEstimatedUsage(c, oaiReq, clientModel)
+		}
 		utils.SendOpenAIStreamEOFData(c)
 	}
+
+	if staleRecorder != nil {
+		storeStaleResponse(s, mycache.GetRequestKey(&origReq, getTenantName(c), serviceModel), staleRecorder, oaiReq.Stream)
+	}
+}
+
+// resolveServiceModel 返回实际查找服务使用的模型名称
+func resolveServiceModel(c *gin.Context, oaiReq *openai.ChatCompletionRequest) string {
+	//全局模型重定向名称
+	model := config.GetGlobalModelRedirect(oaiReq.Model)
+
+	// 请求中包含图片时自动切换到对应的视觉模型
+	if mycommon.HasImageContent(oaiReq.Messages) {
+		model = config.GetVisionModel(model)
+	}
+
+	// 租户的services中有该模型时使用租户的服务
+	return config.ResolveTenantModel(getTenantName(c), model)
+}
+
+// applyHeaderTimeout 根据客户端传入的 X-Timeout-Seconds 设置请求的超时时间，超过上限时按上限处理
+func applyHeaderTimeout(c *gin.Context) context.CancelFunc {
+	maxTimeout := config.GetMaxTimeout()
+	timeoutStr := c.GetHeader(mycomdef.KEYNAME_HEADER_TIMEOUT)
+	if timeoutStr == "" {
+		return nil
+	}
+
+	timeout, err := strconv.Atoi(strings.TrimSpace(timeoutStr))
+	if err != nil || timeout <= 0 {
+		getLogger(c).Warn("invalid timeout header", zap.String("timeout", timeoutStr))
+		return nil
+	}
+
+	if timeout > maxTimeout {
+		getLogger(c).Info("timeout header clamped", zap.Int("timeout", timeout), zap.Int("max_timeout", maxTimeout))
+		timeout = maxTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(timeout)*time.Second)
+	c.Request = c.Request.WithContext(ctx)
+
+	return cancel
 }
 
 // dispatchToServiceHandler dispatches the request to the appropriate service handler based on the service name
@@ -310,29 +796,111 @@ func validateRequestMethod(c *gin.Context, method string) bool {
 	return true
 }
 
-func validateAPIKey(apikey string) bool {
-	if config.APIKey == "" {
-		return true
-	}
-
-	if config.APIKey != apikey {
-		return false
-	}
-	return true
-}
-
-func getModelDetails(oaiReq *openai.ChatCompletionRequest) (*config.ModelDetails, string, error) {
+func getModelDetails(c *gin.Context, oaiReq *openai.ChatCompletionRequest) (*config.ModelDetails, string, error) {
 	if oaiReq.Model == config.KEYNAME_RANDOM {
 		return config.GetRandomEnabledModelDetailsV1()
 	}
-	s, err := config.GetModelService(oaiReq.Model)
+	strategy := strings.ToLower(config.GetModelLBStrategy(oaiReq.Model))
+	getModelService := mycommon.GetProbedModelService
+	switch strategy {
+	case mycomdef.KEYNAME_COST_LATENCY:
+		getModelService = mycommon.GetBestScoredModelService
+	case mycomdef.KEYNAME_WEIGHTED:
+		getModelService = mycommon.GetWeightedModelService
+	case mycomdef.KEYNAME_LEAST_ACTIVE:
+		getModelService = mycommon.GetLeastInFlightModelService
+	}
+	s, err := getModelService(oaiReq.Model)
 	if err != nil {
 		return nil, "", err
 	}
 
+	if len(config.GetModelToService()[oaiReq.Model]) > 1 {
+		getLogger(c).Info("backend selected",
+			zap.String("model", oaiReq.Model),
+			zap.String("strategy", strategy),
+			zap.String("service_name", s.ServiceName),
+			zap.String("service_id", s.ServiceID),
+			zap.String("server_url", s.ServerURL),
+			zap.Int("weight", mycommon.GetServiceWeight(s)),
+			zap.Float64("effective_weight", mycommon.GetServiceEffectiveWeight(s)),
+			zap.Int64("in_flight", mycommon.GetServiceInFlight(s.ServiceID)))
+	}
+
 	return s, oaiReq.Model, err
 }
 
 func sendErrorResponse(c *gin.Context, code int, msg string) {
-	c.JSON(code, gin.H{"error": msg})
+	errType := "server_error"
+	if code < http.StatusInternalServerError {
+		errType = "invalid_request_error"
+	}
+	errObj := gin.H{"message": msg, "type": errType, "code": nil, "param": nil}
+	if isEventStreamStarted(c) {
+		sendStreamErrorEvent(c, errObj)
+		return
+	}
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(code, gin.H{"error": errObj})
+}
+
+// isEventStreamStarted 流式响应是否已经开始输出，此时不能再改变状态码
+func isEventStreamStarted(c *gin.Context) bool {
+	return c.Writer.Written() && strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// sendStreamErrorEvent 流式响应中途出错时，以一个SSE事件返回OpenAI格式的错误，然后发送结束标记
+func sendStreamErrorEvent(c *gin.Context, errObj gin.H) {
+	data, err := json.Marshal(gin.H{"error": errObj})
+	if err != nil {
+		return
+	}
+	if _, err = c.Writer.WriteString("data: " + string(data) + "\n\n"); err != nil {
+		return
+	}
+	utils.SendOpenAIStreamEOFData(c)
+}
+
+// errorDetailToError 流式分片中的错误转换为error返回，错误信息中带有OpenAI格式的JSON，由sendUpstreamErrorResponse统一返回给客户端
+func errorDetailToError(detail *myopenai.ErrorDetail) error {
+	data, _ := json.Marshal(map[string]interface{}{"error": detail})
+	return fmt.Errorf("upstream error: %s", data)
+}
+
+// sendUpstreamErrorResponse 能归类的上游错误按OpenAI的格式返回统一的错误信息，error_messages中可以按code配置本地化的信息
+func sendUpstreamErrorResponse(c *gin.Context, serviceName string, err error) {
+	upstreamErr, ok := mycommon.ClassifyUpstreamError(serviceName, err)
+	if !ok {
+		upstreamErr = mycommon.TranslateUpstreamError(err)
+	}
+
+	message := upstreamErr.Message
+	if msg, exists := config.GetConf().ErrorMessages[upstreamErr.Code]; exists && msg != "" {
+		message = msg
+	}
+
+	getLogger(c).Warn("upstream error translated",
+		zap.String("service_name", serviceName),
+		zap.String("code", upstreamErr.Code),
+		zap.Error(err))
+
+	var code, param interface{}
+	if upstreamErr.Code != "" {
+		code = upstreamErr.Code
+	}
+	if upstreamErr.Param != "" {
+		param = upstreamErr.Param
+	}
+	errObj := gin.H{
+		"message": message,
+		"type":    upstreamErr.Type,
+		"code":    code,
+		"param":   param,
+	}
+	if isEventStreamStarted(c) {
+		sendStreamErrorEvent(c, errObj)
+		return
+	}
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(upstreamErr.Status, gin.H{"error": errObj})
 }
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"net/http/httptest"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+// ProbeServiceCompletion health_check.mode为completion时的探测，直接用指定的服务发送一个max_tokens为1的非流式对话请求，
+// 不经过负载均衡、重试和请求改写，返回上游的状态码
+func ProbeServiceCompletion(ctx context.Context, s *config.ModelDetails, model string) (int, error) {
+	oaiReq := &openai.ChatCompletionRequest{
+		Model:     config.GetModelMapping(s, config.GetModelRedirect(s, config.StripTenantModelKey(model))),
+		MaxTokens: 1,
+		Messages:  []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ping"}},
+	}
+	creds := s.Credentials
+	if len(s.CredentialList) > 0 {
+		creds = s.CredentialList[0]
+	}
+	oaiReqParam := &OAIRequestParam{
+		chatCompletionReq: oaiReq,
+		modelDetails:      s,
+		creds:             creds,
+		ClientModel:       config.StripTenantModelKey(model),
+	}
+	_, transport, err := config.GetServiceTransport(s)
+	if err != nil {
+		return 0, err
+	}
+	if transport != nil {
+		oaiReqParam.httpTransport = transport
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	if c.Request, err = http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", nil); err != nil {
+		return 0, err
+	}
+
+	err = dispatchToServiceHandler(c, oaiReqParam)
+	statusCode := 0
+	if c.Writer.Written() {
+		statusCode = w.Code
+	}
+	if err != nil {
+		if code := mycommon.GetErrorStatusCode(err); code > 0 {
+			statusCode = code
+		}
+		return statusCode, err
+	}
+	if statusCode >= http.StatusBadRequest {
+		return statusCode, fmt.Errorf("unexpected status code %d", statusCode)
+	}
+	return statusCode, nil
+}
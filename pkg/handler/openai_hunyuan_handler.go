@@ -3,100 +3,113 @@ package handler
 import (
 	"encoding/json"
 	"github.com/gin-gonic/gin"
-	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
-	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	tchttp "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/http"
 	hunyuan "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/hunyuan/v20230901"
+	"go.uber.org/zap"
 	"net/http"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
-	"simple-one-api/pkg/mylog"
+	tecenthunyuan "simple-one-api/pkg/llm/tecent-hunyuan"
+	"simple-one-api/pkg/mysigner"
 	"simple-one-api/pkg/utils"
 )
 
+// getHunYuanClient 返回请求混元使用的client，没有配置signer时使用secret_id、secret_key进行TC3-HMAC-SHA256签名
+func getHunYuanClient(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam) (*http.Client, error) {
+	transport, err := getUpstreamTransport(c, s, oaiReqParam)
+	if err != nil {
+		return nil, err
+	}
+	if s.Signer.Type == "" {
+		signer, err := mysigner.New(&config.SignerConf{Type: "tc3", Service: "hunyuan"}, oaiReqParam.creds)
+		if err != nil {
+			return nil, err
+		}
+		transport = mysigner.NewTransport(transport, signer)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
 func OpenAI2HunYuanHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
-	// 创建认证对象
 	oaiReq := oaiReqParam.chatCompletionReq
-	//s := oaiReqParam.modelDetails
-	credentials := oaiReqParam.creds
-	secretId, _ := utils.GetStringFromMap(credentials, config.KEYNAME_SECRET_ID)
-	secretKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_SECRET_KEY)
-	credential := common.NewCredential(
-		secretId,
-		secretKey,
-	)
-
-	// 创建客户端配置
-	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "hunyuan.tencentcloudapi.com"
+	s := oaiReqParam.modelDetails
 
-	// 创建HunYuan客户端
-	client, err := hunyuan.NewClient(credential, "", cpf)
+	client, err := getHunYuanClient(c, s, oaiReqParam)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	if oaiReqParam.httpTransport != nil {
-		client.Client.WithHttpTransport(oaiReqParam.httpTransport)
-	}
-
 	// 创建HunYuan请求对象
 	request := adapter.OpenAIRequestToHunYuanRequest(oaiReq)
 
 	// 打印请求数据
 	djData, _ := json.Marshal(request)
-	mylog.Logger.Info(string(djData))
+	getLogger(c).Info(string(djData))
+
+	if oaiReq.Stream {
+		return handleHunYuanStreamResponse(c, client, s.ServerURL, request, oaiReqParam)
+	}
 
-	// 发送请求并处理响应
-	response, err := client.ChatCompletions(request)
+	response, err := tecenthunyuan.ChatCompletions(c.Request.Context(), client, s.ServerURL, request)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
-
-	// 处理响应数据
-	return handleHunYuanResponse(c, response, oaiReq.Model, oaiReqParam)
+	return handleHunYuanNonStreamResponse(c, response, oaiReq.Model, oaiReqParam)
 }
 
-// handleHunYuanResponse 处理HunYuan的响应数据
-func handleHunYuanResponse(c *gin.Context, response *hunyuan.ChatCompletionsResponse, model string, oaiReqParam *OAIRequestParam) error {
-	if response.Response != nil {
-		// 非流式响应
-		return handleHunYuanNonStreamResponse(c, response, model, oaiReqParam)
-	}
-
-	// 流式响应
-	utils.SetEventStreamHeaders(c)
-	for event := range response.Events {
-		oaiStreamResp, err := adapter.HunYuanResponseToOpenAIStreamResponse(event)
+// handleHunYuanStreamResponse 把混元的SSE事件转换为OpenAI格式，分片中的错误在调用结束后返回，由上层统一转换为OpenAI格式的错误
+func handleHunYuanStreamResponse(c *gin.Context, client *http.Client, serverURL string, request *hunyuan.ChatCompletionsRequest, oaiReqParam *OAIRequestParam) error {
+	headersSet := false
+	err := tecenthunyuan.ChatCompletionsStream(c.Request.Context(), client, serverURL, request, func(id string, data []byte) error {
+		oaiStreamResp, err := adapter.HunYuanResponseToOpenAIStreamResponse(tchttp.SSEvent{Id: id, Data: data})
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
+		if oaiStreamResp.Error != nil {
+			getLogger(c).Error("Error response", zap.Any("error", *oaiStreamResp.Error))
+			return errorDetailToError(oaiStreamResp.Error)
+		}
+		if !headersSet {
+			utils.SetEventStreamHeaders(c)
+			headersSet = true
+		}
+
+		utils.SetUpstreamModelHeader(c, oaiStreamResp.Model)
 		oaiStreamResp.Model = oaiReqParam.ClientModel
 		respData, err := json.Marshal(&oaiStreamResp)
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
-		mylog.Logger.Info(string(respData))
-		_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
-		if err != nil {
-			mylog.Logger.Error(err.Error())
+		getLogger(c).Debug(string(respData))
+		if _, err := c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+			getLogger(c).Error(err.Error())
 			return err
 		}
 		c.Writer.(http.Flusher).Flush()
+		return nil
+	})
+	if err != nil {
+		getLogger(c).Error("Error during SSE call", zap.Error(err))
 	}
-	return nil
+	return err
 }
 
 // handleNonStreamResponse 处理非流式响应
 func handleHunYuanNonStreamResponse(c *gin.Context, response *hunyuan.ChatCompletionsResponse, model string, oaiReqParam *OAIRequestParam) error {
 	oaiResp := adapter.HunYuanResponseToOpenAIResponse(response)
+	if oaiResp.Error != nil {
+		getLogger(c).Error("Error response", zap.Any("error", *oaiResp.Error))
+		return errorDetailToError(oaiResp.Error)
+	}
+	utils.SetUpstreamModelHeader(c, oaiResp.Model)
 	oaiResp.Model = oaiReqParam.ClientModel
 
 	jdata, _ := json.Marshal(*oaiResp)
-	mylog.Logger.Info(string(jdata))
+	getLogger(c).Info(string(jdata))
 	c.JSON(http.StatusOK, oaiResp)
 	return nil
 }
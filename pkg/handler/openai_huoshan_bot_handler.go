@@ -3,7 +3,6 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/sashabaranov/go-openai"
 	"github.com/volcengine/volcengine-go-sdk/service/arkruntime"
@@ -14,10 +13,8 @@ import (
 	"net/http"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
-	"simple-one-api/pkg/mylog"
 	myopenai "simple-one-api/pkg/openai"
 	"simple-one-api/pkg/utils"
-	"time"
 )
 
 func configureClientWithApiKey(oaiReqParam *OAIRequestParam, model string) (*arkruntime.Client, error) {
@@ -32,10 +29,7 @@ func configureClientWithApiKey(oaiReqParam *OAIRequestParam, model string) (*ark
 	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
 
 	// 创建自定义 HTTP client 使用上述 transport
-	httpHSClient := &http.Client{
-		//Transport: transport,
-		Timeout: 30 * time.Second,
-	}
+	httpHSClient := &http.Client{}
 
 	if oaiReqParam.httpTransport != nil {
 		httpHSClient.Transport = oaiReqParam.httpTransport
@@ -84,11 +78,11 @@ func handleHuoShanBotRequest(ctx context.Context, c *gin.Context, huoshanReq mod
 	clientModel := oaiReqParam.ClientModel
 
 	botReq := prepareHuoshanBotRequest(oaiReq, s)
-	mylog.Logger.Info("handleHuoShanBotRequest", zap.Any("botReq", botReq))
+	getLogger(c).Info("handleHuoShanBotRequest", zap.Any("botReq", botReq))
 	if oaiReq.Stream {
 		stream, err := client.CreateBotChatCompletionStream(ctx, botReq)
 		if err != nil {
-			mylog.Logger.Error("handleHuoShanBotRequest", zap.Error(err))
+			getLogger(c).Error("handleHuoShanBotRequest", zap.Error(err))
 			return nil
 		}
 		defer stream.Close()
@@ -99,50 +93,54 @@ func handleHuoShanBotRequest(ctx context.Context, c *gin.Context, huoshanReq mod
 				return nil
 			}
 			if err != nil {
-				mylog.Logger.Error("handleHuoShanBotRequest", zap.Error(err))
-				return nil
+				getLogger(c).Error("handleHuoShanBotRequest", zap.Error(err))
+				return err
 			}
 
 			oaiRespStream := adapter.HuoShanBotResponseToOpenAIStreamResponse(&recv)
 
+			utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 			oaiRespStream.Model = clientModel
 
 			respData, err := json.Marshal(&oaiRespStream)
 			if err != nil {
-				mylog.Logger.Error("Error marshaling response",
+				getLogger(c).Error("Error marshaling response",
 					zap.Error(err)) // 记录错误对象
 
 				return err
 			}
 
-			mylog.Logger.Info("Response HTTP data",
+			getLogger(c).Debug("Response HTTP data",
 				zap.String("http_data", string(respData))) // 记录 HTTP 响应数据
 
 			if oaiRespStream.Error != nil {
-				mylog.Logger.Error("Error response",
+				getLogger(c).Error("Error response",
 					zap.Any("error", *oaiRespStream.Error)) // 记录错误对象
 
-				c.JSON(http.StatusBadRequest, recv)
-				return errors.New("error")
+				return errorDetailToError(oaiRespStream.Error)
 			}
 
-			c.Writer.WriteString("data: " + string(respData) + "\n\n")
+			if _, err := c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+				getLogger(c).Error("handleHuoShanBotRequest", zap.Error(err))
+				return err
+			}
 			c.Writer.(http.Flusher).Flush()
 		}
 	} else {
 		resp, err := client.CreateBotChatCompletion(ctx, botReq)
 		if err != nil {
-			mylog.Logger.Error("handleHuoShanBotRequest", zap.Error(err))
+			getLogger(c).Error("handleHuoShanBotRequest", zap.Error(err))
 			return nil
 		}
-		mylog.Logger.Info("", zap.Any("resp", resp))
+		getLogger(c).Info("", zap.Any("resp", resp))
 
 		myresp := adapter.HuoShanBotResponseToOpenAIResponse(&resp)
 
+		utils.SetUpstreamModelHeader(c, myresp.Model)
 		myresp.Model = clientModel
 
 		respData, _ := json.Marshal(*myresp)
-		mylog.Logger.Info(string(respData))
+		getLogger(c).Info(string(respData))
 
 		c.JSON(http.StatusOK, myresp)
 
@@ -159,7 +157,7 @@ func handleHuoShanBotRequest(ctx context.Context, c *gin.Context, huoshanReq mod
 	}
 
 	botReq := prepareHuoshanBotRequest(oaiReq)
-	mylog.Logger.Info("handleHuoShanBotRequest", zap.Any("botReq", botReq))
+	getLogger(c).Info("handleHuoShanBotRequest", zap.Any("botReq", botReq))
 
 	if oaiReq.Stream {
 		return handleHuoshanBotStreamResponse(ctx, c, client, botReq, oaiReqParam.ClientModel)
@@ -171,22 +169,25 @@ func handleHuoShanBotRequest(ctx context.Context, c *gin.Context, huoshanReq mod
 func handleHuoshanBotStreamResponse(ctx context.Context, c *gin.Context, client *arkruntime.Client, botReq model.BotChatCompletionRequest, clientModel string) error {
 	stream, err := client.CreateBotChatCompletionStream(ctx, botReq)
 	if err != nil {
-		mylog.Logger.Error("Failed to create stream", zap.Error(err))
+		getLogger(c).Error("Failed to create stream", zap.Error(err))
 		return err
 	}
 	defer stream.Close()
 
+	utils.SetEventStreamHeaders(c)
+
 	for {
 		recv, err := stream.Recv()
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
-			mylog.Logger.Error("Stream receive error", zap.Error(err))
+			getLogger(c).Error("Stream receive error", zap.Error(err))
 			return err
 		}
 
 		oaiRespStream := adapter.HuoShanBotResponseToOpenAIStreamResponse(&recv)
+		utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 		oaiRespStream.Model = clientModel
 
 		if err := writeHuoshanBotStreamResponse(c, oaiRespStream); err != nil {
@@ -198,12 +199,13 @@ func handleHuoshanBotStreamResponse(ctx context.Context, c *gin.Context, client
 func handleHuoshanBotNonStreamResponse(ctx context.Context, c *gin.Context, client *arkruntime.Client, botReq model.BotChatCompletionRequest, clientModel string) error {
 	resp, err := client.CreateBotChatCompletion(ctx, botReq)
 	if err != nil {
-		mylog.Logger.Error("Failed to create bot chat completion", zap.Error(err))
+		getLogger(c).Error("Failed to create bot chat completion", zap.Error(err))
 		return err
 	}
-	mylog.Logger.Info("Received response", zap.Any("resp", resp))
+	getLogger(c).Info("Received response", zap.Any("resp", resp))
 
 	myresp := adapter.HuoShanBotResponseToOpenAIResponse(&resp)
+	utils.SetUpstreamModelHeader(c, myresp.Model)
 	myresp.Model = clientModel
 
 	c.JSON(http.StatusOK, myresp)
@@ -213,16 +215,15 @@ func handleHuoshanBotNonStreamResponse(ctx context.Context, c *gin.Context, clie
 func writeHuoshanBotStreamResponse(c *gin.Context, oaiRespStream *myopenai.OpenAIStreamResponse) error {
 	respData, err := json.Marshal(oaiRespStream)
 	if err != nil {
-		mylog.Logger.Error("Error marshaling response", zap.Error(err))
+		getLogger(c).Error("Error marshaling response", zap.Error(err))
 		return err
 	}
 
-	mylog.Logger.Info("Response HTTP data", zap.String("http_data", string(respData)))
+	getLogger(c).Info("Response HTTP data", zap.String("http_data", string(respData)))
 
 	if oaiRespStream.Error != nil {
-		mylog.Logger.Error("Error response", zap.Any("error", *oaiRespStream.Error))
-		c.JSON(http.StatusBadRequest, oaiRespStream.Error)
-		return errors.New("error in response")
+		getLogger(c).Error("Error response", zap.Any("error", *oaiRespStream.Error))
+		return errorDetailToError(oaiRespStream.Error)
 	}
 
 	c.Writer.WriteString("data: " + string(respData) + "\n\n")
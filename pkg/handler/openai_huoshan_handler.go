@@ -13,7 +13,6 @@ import (
 	"io"
 	"net/http"
 	"simple-one-api/pkg/config"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 	"strings"
 	"time"
@@ -34,10 +33,7 @@ func configureClientWithAkSk(oaiReqParam *OAIRequestParam, model string) (*arkru
 	secretKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_SECRET_KEY)
 
 	// 创建自定义 HTTP client 使用上述 transport
-	httpHSClient := &http.Client{
-		//Transport: transport,
-		Timeout: 30 * time.Second,
-	}
+	httpHSClient := &http.Client{}
 
 	if oaiReqParam.httpTransport != nil {
 		httpHSClient.Transport = oaiReqParam.httpTransport
@@ -72,7 +68,8 @@ func OpenAI2HuoShanHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	}
 
 	huoshanReq := prepareHuoshanRequest(oaiReq, s)
-	ctx := context.Background()
+	ctx, cancel := upstreamContext(c, 30*time.Second)
+	defer cancel()
 
 	//如果是bot
 	if strings.HasPrefix(oaiReq.Model, "bot-") {
@@ -106,12 +103,12 @@ func prepareHuoshanRequest(oaiReq *openai.ChatCompletionRequest, s *config.Model
 }
 
 func handleHuoShanStream(ctx context.Context, c *gin.Context, client *arkruntime.Client, huoshanReq model.ChatCompletionRequest, oaiReqParam *OAIRequestParam) error {
-	mylog.Logger.Debug("Entering handleHuoShanStream", zap.Any("huoshanReq", huoshanReq))
+	getLogger(c).Debug("Entering handleHuoShanStream", zap.Any("huoshanReq", huoshanReq))
 	utils.SetEventStreamHeaders(c)
 
 	stream, err := client.CreateChatCompletionStream(ctx, huoshanReq)
 	if err != nil {
-		mylog.Logger.Error("Failed to create chat completion stream", zap.Error(err))
+		getLogger(c).Error("Failed to create chat completion stream", zap.Error(err))
 		handleErrorResponse(c, err)
 		return err
 	}
@@ -127,28 +124,29 @@ func streamHuoshanResponses(c *gin.Context, stream *huoshanutils.ChatCompletionS
 			return nil // 正常结束流
 		}
 		if err != nil {
-			mylog.Logger.Error("Error receiving stream data", zap.Error(err))
+			getLogger(c).Error("Error receiving stream data", zap.Error(err))
 			return err
 		}
 
+		utils.SetUpstreamModelHeader(c, recv.Model)
 		recv.Model = oaiReqParam.ClientModel
 
 		jsonData, err := json.Marshal(recv)
 		if err != nil {
-			mylog.Logger.Error("JSON marshaling error", zap.Error(err))
+			getLogger(c).Error("JSON marshaling error", zap.Error(err))
 			return err
 		}
 
-		mylog.Logger.Info("Streaming JSON data", zap.ByteString("json_data", jsonData))
+		getLogger(c).Debug("Streaming JSON data", zap.ByteString("json_data", jsonData))
 		if _, err = c.Writer.WriteString("data: " + string(jsonData) + "\n\n"); err != nil {
-			mylog.Logger.Error("Write to client error", zap.Error(err))
+			getLogger(c).Error("Write to client error", zap.Error(err))
 			return err
 		}
 
 		if flusher, ok := c.Writer.(http.Flusher); ok {
 			flusher.Flush()
 		} else {
-			mylog.Logger.Warn("Response writer does not support flush operation")
+			getLogger(c).Warn("Response writer does not support flush operation")
 		}
 	}
 }
@@ -160,20 +158,20 @@ func handleSingleHuoShanRequest(ctx context.Context, c *gin.Context, client *ark
 		return err
 	}
 
+	utils.SetUpstreamModelHeader(c, resp.Model)
 	resp.Model = oaiReqParam.ClientModel
 
 	// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-	mylog.Logger.Info("Response received",
+	getLogger(c).Info("Response received",
 		zap.Any("response", resp)) // 记录响应对象
 
 	c.JSON(http.StatusOK, resp)
 	return nil
 }
 
+// handleErrorResponse 只记录错误，响应由调用方按统一的错误格式返回，避免写入响应后无法重试
 func handleErrorResponse(c *gin.Context, err error) {
 	// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-	mylog.Logger.Error("An error occurred",
+	getLogger(c).Error("An error occurred",
 		zap.Error(err)) // 记录错误对象
-
-	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
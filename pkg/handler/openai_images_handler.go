@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	baiduqianfan "simple-one-api/pkg/llm/baidu-qianfan"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureImageAPIVersion Azure的dall-e-3需要2024-02-01及以后的api-version
+const azureImageAPIVersion = "2024-02-01"
+
+// maxImageDownloadSize 上游只返回图片地址而客户端要求b64_json时，下载图片的大小上限
+const maxImageDownloadSize = 20 << 20
+
+// imageAdapter 各服务图片生成接口的差异
+type imageAdapter struct {
+	// defaultServerURL 服务没有配置server_url时使用的地址
+	defaultServerURL string
+	// basicParams 只支持prompt、size和user参数，其他OpenAI参数不发送给上游
+	basicParams bool
+	// urlOnly 只返回图片地址，客户端要求b64_json时下载后编码
+	urlOnly bool
+	// qianfan 使用百度的文生图接口，不是OpenAI协议
+	qianfan bool
+}
+
+// imageServices 支持图片生成的服务
+var imageServices = map[string]imageAdapter{
+	"openai":  {defaultServerURL: "https://api.openai.com/v1"},
+	"azure":   {},
+	"zhipu":   {defaultServerURL: "https://open.bigmodel.cn/api/paas/v4", basicParams: true, urlOnly: true},
+	"qianfan": {qianfan: true},
+}
+
+// ImageGenerationsHandler handles POST requests on /v1/images/generations path
+func ImageGenerationsHandler(c *gin.Context) {
+	if !validateRequestMethod(c, "POST") {
+		return
+	}
+
+	var req openai.ImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Prompt == "" {
+		sendErrorResponse(c, http.StatusBadRequest, "prompt is required")
+		return
+	}
+	if req.ResponseFormat != "" && req.ResponseFormat != openai.CreateImageResponseFormatURL && req.ResponseFormat != openai.CreateImageResponseFormatB64JSON {
+		sendErrorResponse(c, http.StatusBadRequest, "response_format must be url or b64_json")
+		return
+	}
+	// 与OpenAI一致，没有指定模型时使用dall-e-2
+	clientModel := req.Model
+	if clientModel == "" {
+		clientModel = openai.CreateImageModelDallE2
+	}
+	if !checkModelAllowed(c, clientModel) {
+		return
+	}
+
+	model := config.GetGlobalModelRedirect(clientModel)
+	s, err := config.GetModelService(config.ResolveTenantModel(getTenantName(c), model))
+	if err != nil {
+		getLogger(c).Warn("image model not found", zap.String("model", model), zap.Error(err))
+		sendModelNotFoundResponse(c, clientModel)
+		return
+	}
+	adapter, supported := imageServices[strings.ToLower(s.ServiceName)]
+	if !supported {
+		sendErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("service %s does not support image generation", s.ServiceName))
+		return
+	}
+	if s.ServerURL == "" && adapter.defaultServerURL != "" {
+		sd := *s
+		sd.ServerURL = adapter.defaultServerURL
+		s = &sd
+	}
+
+	upstreamModel := config.GetModelMapping(s, config.GetModelRedirect(s, model))
+	creds, credsID := mycommon.GetACredentials(s, upstreamModel)
+	if credsID != "" {
+		mycommon.AcquireCredential(credsID)
+		defer mycommon.ReleaseCredential(credsID)
+	}
+
+	oaiReqParam := &OAIRequestParam{
+		chatCompletionReq: &openai.ChatCompletionRequest{Model: upstreamModel},
+		modelDetails:      s,
+		creds:             creds,
+		ClientModel:       clientModel,
+	}
+	if _, transport, err := config.GetServiceTransport(s); err != nil {
+		getLogger(c).Error("GetServiceTransport", zap.String("service_name", s.ServiceName), zap.Error(err))
+	} else {
+		oaiReqParam.httpTransport = mytrace.WrapTransport(transport)
+	}
+	httpClient := &http.Client{}
+	if oaiReqParam.httpTransport != nil {
+		httpClient.Transport = oaiReqParam.httpTransport
+	}
+
+	getLogger(c).Info("image request",
+		zap.String("service_name", s.ServiceName),
+		zap.String("client_model", clientModel),
+		zap.String("upstream_model", upstreamModel),
+		zap.String("size", req.Size),
+		zap.Int("n", req.N),
+		zap.String("response_format", req.ResponseFormat))
+
+	var resp *openai.ImageResponse
+	if adapter.qianfan {
+		resp, err = createQianFanImage(c, s, oaiReqParam, httpClient, &req)
+		if err != nil {
+			getLogger(c).Error("qianfan image", zap.String("service_name", s.ServiceName), zap.Error(err))
+			sendErrorResponse(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	} else {
+		resp, err = createOpenAIImage(c, s, adapter, oaiReqParam, &req)
+		if err != nil {
+			getLogger(c).Error("CreateImage", zap.String("service_name", s.ServiceName), zap.Error(err))
+			sendUpstreamErrorResponse(c, s.ServiceName, err)
+			return
+		}
+	}
+
+	if err = normalizeImageResponse(c, httpClient, resp, req.ResponseFormat); err != nil {
+		getLogger(c).Error("normalize image response", zap.String("service_name", s.ServiceName), zap.Error(err))
+		sendErrorResponse(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	if resp.Created == 0 {
+		resp.Created = time.Now().Unix()
+	}
+	utils.SetUpstreamModelHeader(c, upstreamModel)
+	c.JSON(http.StatusOK, resp)
+}
+
+// createOpenAIImage 使用OpenAI协议的图片生成接口
+func createOpenAIImage(c *gin.Context, s *config.ModelDetails, adapter imageAdapter, oaiReqParam *OAIRequestParam, req *openai.ImageRequest) (*openai.ImageResponse, error) {
+	var conf openai.ClientConfig
+	var err error
+	if strings.ToLower(s.ServiceName) == "azure" {
+		conf, err = getAzureConfig(c, s, oaiReqParam)
+		conf.APIVersion = getAzureAPIVersion(s, oaiReqParam.chatCompletionReq.Model, azureImageAPIVersion)
+	} else {
+		conf, err = getConfig(c, s, oaiReqParam)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upReq := *req
+	upReq.Model = oaiReqParam.chatCompletionReq.Model
+	if adapter.basicParams {
+		upReq = openai.ImageRequest{Prompt: req.Prompt, Model: upReq.Model, Size: req.Size, User: req.User}
+	} else if adapter.urlOnly {
+		upReq.ResponseFormat = ""
+	}
+
+	resp, err := openai.NewClientWithConfig(conf).CreateImage(c.Request.Context(), upReq)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// createQianFanImage 百度千帆的文生图接口只返回base64，ERNIE-ViLG为异步接口，返回图片地址
+func createQianFanImage(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam, client *http.Client, req *openai.ImageRequest) (*openai.ImageResponse, error) {
+	apiKey, _ := utils.GetStringFromMap(oaiReqParam.creds, config.KEYNAME_API_KEY)
+	secretKey, _ := utils.GetStringFromMap(oaiReqParam.creds, config.KEYNAME_SECRET_KEY)
+	accessToken, err := baiduqianfan.GetAccessToken(c.Request.Context(), client, s.ServerURL, apiKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	model := oaiReqParam.chatCompletionReq.Model
+	size := req.Size
+	if size == "" {
+		size = openai.CreateImageSize1024x1024
+	}
+
+	if baiduqianfan.IsErnieVilgModel(model) {
+		width, height, err := parseImageSize(size)
+		if err != nil {
+			return nil, err
+		}
+		urls, err := baiduqianfan.ErnieVilg(c.Request.Context(), client, s.ServerURL, accessToken, &baiduqianfan.ErnieVilgRequest{
+			Prompt:   req.Prompt,
+			Width:    width,
+			Height:   height,
+			ImageNum: req.N,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp := &openai.ImageResponse{}
+		for _, u := range urls {
+			resp.Data = append(resp.Data, openai.ImageResponseDataInner{URL: u})
+		}
+		return resp, nil
+	}
+
+	qfResp, err := baiduqianfan.Text2Image(c.Request.Context(), client, s.ServerURL, accessToken, model, &baiduqianfan.Text2ImageRequest{
+		Prompt: req.Prompt,
+		Size:   size,
+		N:      req.N,
+		UserID: req.User,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := &openai.ImageResponse{Created: qfResp.Created}
+	for _, d := range qfResp.Data {
+		resp.Data = append(resp.Data, openai.ImageResponseDataInner{B64JSON: d.B64Image})
+	}
+	return resp, nil
+}
+
+func parseImageSize(size string) (int, int, error) {
+	w, h, found := strings.Cut(size, "x")
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if !found || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return width, height, nil
+}
+
+// normalizeImageResponse 按客户端要求的response_format返回图片，上游只返回地址时下载后编码为b64_json，
+// 只返回base64时以data URL放在url中
+func normalizeImageResponse(c *gin.Context, client *http.Client, resp *openai.ImageResponse, format string) error {
+	for i := range resp.Data {
+		d := &resp.Data[i]
+		if format == openai.CreateImageResponseFormatB64JSON {
+			if d.B64JSON != "" || d.URL == "" {
+				continue
+			}
+			b64, err := downloadImageBase64(c, client, d.URL)
+			if err != nil {
+				return err
+			}
+			d.B64JSON, d.URL = b64, ""
+			continue
+		}
+		if d.URL == "" && d.B64JSON != "" {
+			d.URL, d.B64JSON = "data:image/png;base64,"+d.B64JSON, ""
+		}
+	}
+	return nil
+}
+
+func downloadImageBase64(c *gin.Context, client *http.Client, imageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download image failed, status code: %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxImageDownloadSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxImageDownloadSize {
+		return "", errors.New("image is too large")
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
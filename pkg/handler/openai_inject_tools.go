@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+)
+
+// injectTools 将配置的工具定义加入请求，与客户端传入的工具同名时以客户端的为准
+func injectTools(req *openai.ChatCompletionRequest, tools []config.ToolConf) int {
+	existing := make(map[string]bool, len(req.Tools))
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			existing[tool.Function.Name] = true
+		}
+	}
+
+	injected := 0
+	for _, t := range tools {
+		if t.Function.Name == "" || existing[t.Function.Name] {
+			continue
+		}
+		existing[t.Function.Name] = true
+
+		toolType := openai.ToolType(t.Type)
+		if toolType == "" {
+			toolType = openai.ToolTypeFunction
+		}
+
+		// 部分服务不接受为null的parameters
+		var params interface{} = t.Function.Parameters
+		if t.Function.Parameters == nil {
+			params = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+
+		req.Tools = append(req.Tools, openai.Tool{
+			Type: toolType,
+			Function: &openai.FunctionDefinition{
+				Name:        t.Function.Name,
+				Description: t.Function.Description,
+				Parameters:  params,
+			},
+		})
+		injected++
+	}
+
+	return injected
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+var defaultJSONModeInstruction = "Respond only with a single valid JSON object. Do not include any prose, explanation or markdown code fences."
+
+var defaultJSONSchemaInstruction = "Respond only with a single valid JSON object that conforms to the JSON Schema below. Do not include any prose, explanation or markdown code fences."
+
+// responseFormatTypeJSONSchema go-openai v1.24.1中还没有json_schema类型
+const responseFormatTypeJSONSchema openai.ChatCompletionResponseFormatType = "json_schema"
+
+// jsonSchemaFormat response_format为json_schema时的参数，go-openai解析请求时会丢掉，从原始请求体中读取
+type jsonSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+}
+
+// getRawResponseFormat 从原始请求体中取出完整的response_format，没有时返回nil
+func getRawResponseFormat(c *gin.Context) json.RawMessage {
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return nil
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return nil
+	}
+	var params struct {
+		ResponseFormat json.RawMessage `json:"response_format"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil || len(params.ResponseFormat) == 0 || bytes.Equal(params.ResponseFormat, []byte("null")) {
+		return nil
+	}
+	return params.ResponseFormat
+}
+
+// getJSONSchemaFormat 请求的response_format为json_schema时返回其参数，否则返回nil
+func getJSONSchemaFormat(c *gin.Context, oaiReq *openai.ChatCompletionRequest) *jsonSchemaFormat {
+	if oaiReq.ResponseFormat == nil || oaiReq.ResponseFormat.Type != responseFormatTypeJSONSchema {
+		return nil
+	}
+	var params struct {
+		JSONSchema *jsonSchemaFormat `json:"json_schema"`
+	}
+	if raw := getRawResponseFormat(c); raw != nil {
+		json.Unmarshal(raw, &params)
+	}
+	if params.JSONSchema == nil {
+		return &jsonSchemaFormat{}
+	}
+	return params.JSONSchema
+}
+
+// checkResponseFormat 检查response_format的类型和json_schema的参数，不合法时返回错误，按400返回给客户端
+func checkResponseFormat(c *gin.Context, oaiReq *openai.ChatCompletionRequest) error {
+	if oaiReq.ResponseFormat == nil {
+		return nil
+	}
+	switch oaiReq.ResponseFormat.Type {
+	case "", openai.ChatCompletionResponseFormatTypeText, openai.ChatCompletionResponseFormatTypeJSONObject:
+		return nil
+	case responseFormatTypeJSONSchema:
+		js := getJSONSchemaFormat(c, oaiReq)
+		if js.Name == "" {
+			return fmt.Errorf("response_format.json_schema.name is required")
+		}
+		if len(js.Schema) > 0 {
+			var schema map[string]interface{}
+			if err := json.Unmarshal(js.Schema, &schema); err != nil {
+				return fmt.Errorf("response_format.json_schema.schema must be a JSON object")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported response_format type: %s", oaiReq.ResponseFormat.Type)
+}
+
+// isJSONModeRequested 判断请求是否要求返回JSON对象
+func isJSONModeRequested(oaiReq *openai.ChatCompletionRequest) bool {
+	return oaiReq.ResponseFormat != nil && oaiReq.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject
+}
+
+// injectJSONModeInstruction 对不支持JSON模式的服务，去掉response_format并在system消息末尾要求只返回JSON
+func injectJSONModeInstruction(oaiReq *openai.ChatCompletionRequest, conf *config.JSONModeConf) {
+	instruction := conf.Instruction
+	if instruction == "" {
+		instruction = defaultJSONModeInstruction
+	}
+	oaiReq.ResponseFormat = nil
+	appendToSystemMessage(oaiReq, instruction)
+}
+
+// injectJSONSchemaInstruction 对不支持json_schema的服务，在system消息末尾要求按schema返回JSON，
+// 服务支持json_object时降级为json_object，否则去掉response_format
+func injectJSONSchemaInstruction(oaiReq *openai.ChatCompletionRequest, conf *config.JSONModeConf, js *jsonSchemaFormat, keepJSONObject bool) {
+	instruction := conf.Instruction
+	if instruction == "" {
+		instruction = defaultJSONSchemaInstruction
+	}
+	if len(js.Schema) > 0 {
+		instruction += "\nJSON Schema:\n" + string(js.Schema)
+	}
+	if keepJSONObject {
+		oaiReq.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	} else {
+		oaiReq.ResponseFormat = nil
+	}
+	appendToSystemMessage(oaiReq, instruction)
+}
+
+// appendToSystemMessage 追加到第一条文本的system消息末尾，没有时在开头加入一条system消息
+func appendToSystemMessage(oaiReq *openai.ChatCompletionRequest, text string) {
+	for i := range oaiReq.Messages {
+		if strings.ToLower(oaiReq.Messages[i].Role) == openai.ChatMessageRoleSystem && len(oaiReq.Messages[i].MultiContent) == 0 {
+			oaiReq.Messages[i].Content = oaiReq.Messages[i].Content + "\n" + text
+			return
+		}
+	}
+
+	systemMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: text}
+	oaiReq.Messages = append([]openai.ChatCompletionMessage{systemMsg}, oaiReq.Messages...)
+}
+
+// withJSONModeCheck 非流式请求检查回答是否为合法的JSON，不合法时尝试修复，无法修复则原样返回；
+// js不为空时还会按schema校验，不符合时记录日志
+func withJSONModeCheck(next func(*gin.Context, *OAIRequestParam) error, js *jsonSchemaFormat) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		origWriter := c.Writer
+		defer func() {
+			c.Writer = origWriter
+		}()
+
+		buf := newResponseBuffer(origWriter)
+		c.Writer = buf
+		if err := next(c, oaiReqParam); err != nil {
+			return err
+		}
+
+		if buf.Status() == 200 {
+			data, _ := editChoicesContent(buf.body.Bytes(), "message", func(content string) string {
+				repaired, ok := mycommon.RepairJSONContent(content)
+				if !ok {
+					getLogger(c).Warn("response is not valid json", zap.String("model", oaiReqParam.chatCompletionReq.Model))
+				} else if js != nil && len(js.Schema) > 0 {
+					if err := mycommon.ValidateJSONSchema(repaired, js.Schema); err != nil {
+						getLogger(c).Warn("response does not match json schema", zap.String("model", oaiReqParam.chatCompletionReq.Model),
+							zap.String("schema_name", js.Name), zap.Error(err))
+					}
+				}
+				return repaired
+			})
+			buf.body.Reset()
+			buf.body.Write(data)
+		}
+		return buf.flushTo(origWriter)
+	}
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mylimiter"
+	"simple-one-api/pkg/utils"
+	"strconv"
+	"time"
+)
+
+const keyLimitedAPIKey = "limitedAPIKey"
+
+// KeyLimitMiddleware 按客户端key限制每分钟请求数、每分钟token数和每月token配额，超过时返回429和Retry-After，
+// 限制值每次请求时读取，api_keys热加载后立即生效
+func KeyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apikey, _ := utils.GetAPIKeyFromHeader(c)
+		limit := config.GetKeyRateLimit(apikey)
+		if limit.RPM <= 0 && limit.TPM <= 0 && limit.MonthlyTokenQuota <= 0 {
+			c.Next()
+			return
+		}
+
+		exceeded, retryAfter, usage := mylimiter.AllowKey(apikey, limit.RPM, limit.TPM, limit.MonthlyTokenQuota)
+		setRateLimitHeaders(c, limit, usage)
+		if exceeded != "" {
+			getLogger(c).Warn("api key rate limit exceeded",
+				zap.String("key_name", getAuthKeyName(c)),
+				zap.String("limit", exceeded),
+				zap.Int("minute_requests", usage.MinuteRequests),
+				zap.Int("minute_tokens", usage.MinuteTokens),
+				zap.Int64("month_tokens", usage.MonthTokens),
+				zap.Duration("retry_after", retryAfter))
+			sendKeyLimitError(c, exceeded, limit, usage, retryAfter)
+			c.Abort()
+			return
+		}
+
+		c.Set(keyLimitedAPIKey, apikey)
+		c.Next()
+	}
+}
+
+func setRateLimitHeaders(c *gin.Context, limit config.KeyRateLimitConf, usage mylimiter.KeyUsage) {
+	if limit.RPM > 0 {
+		c.Header(mycomdef.KEYNAME_HEADER_RATELIMIT_LIMIT_REQUESTS, strconv.Itoa(limit.RPM))
+		c.Header(mycomdef.KEYNAME_HEADER_RATELIMIT_REMAINING_REQUESTS, strconv.Itoa(max(limit.RPM-usage.MinuteRequests, 0)))
+	}
+	if limit.TPM > 0 {
+		c.Header(mycomdef.KEYNAME_HEADER_RATELIMIT_LIMIT_TOKENS, strconv.Itoa(limit.TPM))
+		c.Header(mycomdef.KEYNAME_HEADER_RATELIMIT_REMAINING_TOKENS, strconv.Itoa(max(limit.TPM-usage.MinuteTokens, 0)))
+	}
+}
+
+// sendKeyLimitError 与OpenAI一致，超过每分钟限制时code为rate_limit_exceeded，超过配额时为insufficient_quota
+func sendKeyLimitError(c *gin.Context, exceeded string, limit config.KeyRateLimitConf, usage mylimiter.KeyUsage, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+
+	errObj := gin.H{"type": "requests", "code": "rate_limit_exceeded", "param": nil}
+	switch exceeded {
+	case mylimiter.KeyLimitRPM:
+		errObj["message"] = fmt.Sprintf("Rate limit reached on requests per min (RPM): Limit %d, Used %d. Please try again in %ds.", limit.RPM, usage.MinuteRequests, seconds)
+	case mylimiter.KeyLimitTPM:
+		errObj["type"] = "tokens"
+		errObj["message"] = fmt.Sprintf("Rate limit reached on tokens per min (TPM): Limit %d, Used %d. Please try again in %ds.", limit.TPM, usage.MinuteTokens, seconds)
+	default:
+		errObj["type"] = "insufficient_quota"
+		errObj["code"] = "insufficient_quota"
+		errObj["message"] = fmt.Sprintf("You exceeded your monthly token quota: Limit %d, Used %d.", limit.MonthlyTokenQuota, usage.MonthTokens)
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": errObj})
+}
+
+// isKeyLimited 当前请求的key是否配置了限制，需要在请求结束后记录token数
+func isKeyLimited(c *gin.Context) bool {
+	_, exists := c.Get(keyLimitedAPIKey)
+	return exists
+}
+
+// recordKeyLimitTokens 请求结束后将使用的token数计入key的每分钟token数和每月配额，命中响应缓存时不计入
+func recordKeyLimitTokens(c *gin.Context, trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) {
+	if !isKeyLimited(c) || trace.CacheHit {
+		return
+	}
+	_, _, totalTokens, _ := getRecordedUsage(trace, oaiReq, recorder)
+	mylimiter.AddKeyTokens(c.GetString(keyLimitedAPIKey), totalTokens)
+}
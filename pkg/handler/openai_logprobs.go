@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+)
+
+var errLogProbsNotSupported = errors.New("logprobs is not supported by this model")
+
+// isLogProbsRequested 判断请求是否需要返回logprobs
+func isLogProbsRequested(req *openai.ChatCompletionRequest) bool {
+	return req.LogProbs || req.TopLogProbs > 0
+}
+
+// getChoicesLogprobs 取出分片中每个choice的logprobs，key为choice的index，没有或为null时不返回
+func getChoicesLogprobs(payload []byte) map[int]json.RawMessage {
+	var chunk struct {
+		Choices []struct {
+			Index    int             `json:"index"`
+			Logprobs json.RawMessage `json:"logprobs"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil
+	}
+	var result map[int]json.RawMessage
+	for _, choice := range chunk.Choices {
+		if isJSONNull(choice.Logprobs) {
+			continue
+		}
+		if result == nil {
+			result = make(map[int]json.RawMessage)
+		}
+		result[choice.Index] = choice.Logprobs
+	}
+	return result
+}
+
+// setChoicesLogprobs 把logprobs按choice的index放回序列化后的分片中，失败时返回原来的数据
+func setChoicesLogprobs(data []byte, logprobs map[int]json.RawMessage) []byte {
+	if len(logprobs) == 0 {
+		return data
+	}
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return data
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil {
+		return data
+	}
+	for _, choice := range choices {
+		var index int
+		json.Unmarshal(choice["index"], &index)
+		if lp, exists := logprobs[index]; exists {
+			choice["logprobs"] = lp
+		}
+	}
+	var err error
+	if chunk["choices"], err = json.Marshal(choices); err != nil {
+		return data
+	}
+	result, err := json.Marshal(chunk)
+	if err != nil {
+		return data
+	}
+	return result
+}
+
+// streamLogprobsCollector 包装上游的Transport，按顺序记录流式响应每个分片中的logprobs，
+// go-openai的流式响应结构中没有logprobs，通过next按stream.Recv的顺序取回
+type streamLogprobsCollector struct {
+	Transport http.RoundTripper
+	pending   bytes.Buffer
+	chunks    []map[int]json.RawMessage
+}
+
+func (lc *streamLogprobsCollector) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := lc.Transport.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 400 {
+		return resp, err
+	}
+	resp.Body = &teeReadCloser{Reader: io.TeeReader(resp.Body, lc), Closer: resp.Body}
+	return resp, nil
+}
+
+// Write 与go-openai一致，只有以"data: "开头且不是[DONE]的行才是一个分片
+func (lc *streamLogprobsCollector) Write(p []byte) (int, error) {
+	lc.pending.Write(p)
+	for {
+		idx := bytes.IndexByte(lc.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := bytes.TrimSpace(lc.pending.Next(idx + 1))
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		payload := bytes.TrimPrefix(line, []byte("data: "))
+		if string(payload) == "[DONE]" {
+			continue
+		}
+		lc.chunks = append(lc.chunks, getChoicesLogprobs(payload))
+	}
+	return len(p), nil
+}
+
+// next 返回下一个分片的logprobs
+func (lc *streamLogprobsCollector) next() map[int]json.RawMessage {
+	if lc == nil || len(lc.chunks) == 0 {
+		return nil
+	}
+	lp := lc.chunks[0]
+	lc.chunks = lc.chunks[1:]
+	return lp
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mydashboard"
+	"simple-one-api/pkg/mymetrics"
+	"time"
+)
+
+var usageKey = []byte(`"usage"`)
+
+// metricsWriter 记录写给客户端的第一个分片的时间，并从响应中取出usage，在请求结束后统计指标和输出访问日志
+type metricsWriter struct {
+	gin.ResponseWriter
+	trace      *requestTrace
+	firstWrite time.Time
+	pending    bytes.Buffer
+	usage      *openai.Usage
+}
+
+func newMetricsWriter(w gin.ResponseWriter, trace *requestTrace) *metricsWriter {
+	return &metricsWriter{ResponseWriter: w, trace: trace}
+}
+
+func (w *metricsWriter) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *metricsWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *metricsWriter) record(data []byte) {
+	if w.firstWrite.IsZero() && len(bytes.TrimSpace(data)) > 0 {
+		w.firstWrite = time.Now()
+	}
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		w.parseUsage(w.pending.Next(idx + 1))
+	}
+}
+
+// parseUsage 流式响应取最后一个带usage的分片，非流式响应取响应体中的usage
+func (w *metricsWriter) parseUsage(line []byte) {
+	if !bytes.Contains(line, usageKey) {
+		return
+	}
+	line = bytes.TrimSpace(line)
+	line = bytes.TrimSpace(bytes.TrimPrefix(line, streamDataPrefix))
+	var resp struct {
+		Usage *openai.Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(line, &resp); err == nil && resp.Usage != nil {
+		w.usage = resp.Usage
+	}
+}
+
+// finish 请求结束后调用，流式请求的时长包括整个输出过程
+func (w *metricsWriter) finish() {
+	soaConf := config.GetConf()
+	if w.pending.Len() > 0 {
+		w.parseUsage(w.pending.Bytes())
+		w.pending.Reset()
+	}
+
+	record := &mymetrics.RequestRecord{
+		Model:    w.trace.ClientModel,
+		Provider: w.trace.ServiceName,
+		Key:      w.trace.KeyName,
+		Status:   w.Status(),
+		Stream:   w.trace.Stream,
+		Duration: time.Since(w.trace.StartTime),
+	}
+	if !w.firstWrite.IsZero() {
+		w.trace.TimeToFirstToken = w.firstWrite.Sub(w.trace.StartTime)
+		record.TimeToFirstToken = w.trace.TimeToFirstToken
+	}
+	if w.usage != nil {
+		w.trace.Usage = w.usage
+		record.PromptTokens = w.usage.PromptTokens
+		record.CompletionTokens = w.usage.CompletionTokens
+		if !w.trace.CacheHit {
+			record.Cost, _ = mycommon.CalculateCost(w.trace.ClientModel, w.trace.Model, w.usage.PromptTokens, w.usage.CompletionTokens)
+		}
+	}
+	if soaConf.Metrics.Enable {
+		mymetrics.ObserveRequest(record)
+	}
+	if soaConf.Dashboard.Enable {
+		mydashboard.Record(record)
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"simple-one-api/pkg/mymetrics"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric 返回指标中包含所有labels的行的值之和
+func scrapeMetric(t *testing.T, name string, labels ...string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mymetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var total float64
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+		matched := true
+		for _, label := range labels {
+			if !strings.Contains(line, label) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[strings.LastIndexByte(line, ' ')+1:], 64)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		total += v
+	}
+	return total
+}
+
+func TestMetricsCounters(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		if req["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"metrics-gpt","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}` + "\n\n" +
+				`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"metrics-gpt","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}` + "\n\n" +
+				"data: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"metrics-gpt","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	})
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+metrics:
+    enable: true
+services:
+    openai:
+        - models: [metrics-gpt]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	model := `model="metrics-gpt"`
+	provider := `provider="openai"`
+	requestsBefore := scrapeMetric(t, "simple_one_api_requests_total", model, provider, `status="200"`)
+	upstreamBefore := scrapeMetric(t, "simple_one_api_upstream_requests_total", model, provider, `status="200"`)
+	promptBefore := scrapeMetric(t, "simple_one_api_prompt_tokens_total", model, provider)
+	completionBefore := scrapeMetric(t, "simple_one_api_completion_tokens_total", model, provider)
+	ttftBefore := scrapeMetric(t, "simple_one_api_time_to_first_token_seconds_count", model, provider)
+	durationBefore := scrapeMetric(t, "simple_one_api_request_duration_seconds_count", model, provider)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", `{"model":"metrics-gpt","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"metrics-gpt","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stream status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	checks := []struct {
+		name   string
+		labels []string
+		before float64
+		delta  float64
+	}{
+		{"simple_one_api_requests_total", []string{model, provider, `status="200"`}, requestsBefore, 2},
+		{"simple_one_api_upstream_requests_total", []string{model, provider, `status="200"`}, upstreamBefore, 2},
+		{"simple_one_api_prompt_tokens_total", []string{model, provider}, promptBefore, 13},
+		{"simple_one_api_completion_tokens_total", []string{model, provider}, completionBefore, 9},
+		{"simple_one_api_time_to_first_token_seconds_count", []string{model, provider}, ttftBefore, 1},
+		{"simple_one_api_request_duration_seconds_count", []string{model, provider}, durationBefore, 2},
+	}
+	for _, check := range checks {
+		if got := scrapeMetric(t, check.name, check.labels...) - check.before; got != check.delta {
+			t.Errorf("%s increased by %v, want %v", check.name, got, check.delta)
+		}
+	}
+	if active := scrapeMetric(t, "simple_one_api_active_streams", model, provider); active != 0 {
+		t.Errorf("active_streams = %v after the stream finished", active)
+	}
+}
+
+// TestMetricsUpstreamErrorStatus 上游返回错误时请求和上游请求都按错误的状态码统计
+func TestMetricsUpstreamErrorStatus(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad request","type":"invalid_request_error"}}`))
+	})
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+metrics:
+    enable: true
+services:
+    openai:
+        - models: [metrics-bad]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	model := `model="metrics-bad"`
+	requestsBefore := scrapeMetric(t, "simple_one_api_requests_total", model, `status="400"`)
+	upstreamBefore := scrapeMetric(t, "simple_one_api_upstream_requests_total", model, `status="400"`)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", `{"model":"metrics-bad","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := scrapeMetric(t, "simple_one_api_requests_total", model, `status="400"`) - requestsBefore; got != 1 {
+		t.Errorf("requests_total{status=400} increased by %v, want 1", got)
+	}
+	if got := scrapeMetric(t, "simple_one_api_upstream_requests_total", model, `status="400"`) - upstreamBefore; got != 1 {
+		t.Errorf("upstream_requests_total{status=400} increased by %v, want 1", got)
+	}
+}
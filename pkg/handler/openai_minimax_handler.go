@@ -13,7 +13,6 @@ import (
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/minimax"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 	"strings"
 )
@@ -38,17 +37,17 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 	jsonData, err := json.Marshal(minimaxReq)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
+		getLogger(c).Error(err.Error())
 		return err
 	}
 
-	mylog.Logger.Info(string(jsonData))
+	getLogger(c).Info(string(jsonData))
 
 	if oaiReq.Stream {
 
-		request, err := http.NewRequest("POST", serverUrl, bytes.NewBuffer(jsonData))
+		request, err := http.NewRequestWithContext(c.Request.Context(), "POST", serverUrl, bytes.NewBuffer(jsonData))
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
 
@@ -63,7 +62,7 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 		response, err := client.Do(request)
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
 		defer response.Body.Close()
@@ -79,7 +78,7 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 					break
 				}
 
-				mylog.Logger.Error(err.Error())
+				getLogger(c).Error(err.Error())
 				return err
 			}
 
@@ -94,27 +93,31 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 				continue
 			}
 
-			mylog.Logger.Info(line)
+			getLogger(c).Debug(line)
 
 			var minimaxresp minimax.MinimaxResponse
 			json.Unmarshal([]byte(line), &minimaxresp)
 
 			oaiRespStream := adapter.MinimaxResponseToOpenAIStreamResponse(&minimaxresp)
 			oaiRespStream.ID = id.String()
+			utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 			oaiRespStream.Model = oaiReqParam.ClientModel
 			respData, err := json.Marshal(&oaiRespStream)
 			if err != nil {
-				mylog.Logger.Error(err.Error())
+				getLogger(c).Error(err.Error())
 				return err
 			} else {
-				mylog.Logger.Info(string(respData))
+				getLogger(c).Debug(string(respData))
 
 				if oaiRespStream.Error != nil {
-					mylog.Logger.Info(oaiRespStream.Error.Message)
+					getLogger(c).Info(oaiRespStream.Error.Message)
 					errInfo, _ := json.Marshal(oaiRespStream.Error)
 					return errors.New(string(errInfo))
 				} else {
-					c.Writer.WriteString("data: " + string(respData) + "\n\n")
+					if _, err := c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+						getLogger(c).Error(err.Error())
+						return err
+					}
 					c.Writer.(http.Flusher).Flush()
 				}
 			}
@@ -122,9 +125,9 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 		}
 
 	} else {
-		request, err := http.NewRequest("POST", serverUrl, bytes.NewBuffer(jsonData))
+		request, err := http.NewRequestWithContext(c.Request.Context(), "POST", serverUrl, bytes.NewBuffer(jsonData))
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
 
@@ -133,9 +136,12 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 		// 使用http.Client发送请求
 		client := &http.Client{}
+		if oaiReqParam.httpTransport != nil {
+			client.Transport = oaiReqParam.httpTransport
+		}
 		response, err := client.Do(request)
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 
 			return err
 		}
@@ -143,20 +149,21 @@ func OpenAI2MinimaxHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 		bodyData, err := io.ReadAll(response.Body)
 		if err != nil {
-			mylog.Logger.Error(err.Error())
+			getLogger(c).Error(err.Error())
 			return err
 		}
 
-		mylog.Logger.Info(string(bodyData))
+		getLogger(c).Info(string(bodyData))
 
 		var minimaxresp minimax.MinimaxResponse
 		json.Unmarshal(bodyData, &minimaxresp)
-		//mylog.Logger.Info((minimaxresp)
+		//getLogger(c).Info((minimaxresp)
 		myresp := adapter.MinimaxResponseToOpenAIResponse(&minimaxresp)
+		utils.SetUpstreamModelHeader(c, myresp.Model)
 		myresp.Model = oaiReqParam.ClientModel
 
 		respData, _ := json.Marshal(*myresp)
-		mylog.Logger.Info(string(respData))
+		getLogger(c).Info(string(respData))
 
 		c.JSON(http.StatusOK, myresp)
 
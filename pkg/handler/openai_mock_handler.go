@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"math/rand"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"time"
+)
+
+// OpenAI2MockHandler mock服务不请求上游，按服务的mock配置模拟延迟、错误和逐字输出
+func OpenAI2MockHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	req := oaiReqParam.chatCompletionReq
+	conf := &oaiReqParam.modelDetails.Mock
+	ctx := c.Request.Context()
+
+	if err := sleepMockDelay(ctx, conf.Latency, conf.LatencyJitter); err != nil {
+		return err
+	}
+	// 返回go-openai的APIError，失败重试和切换按状态码处理，与真实的上游一致
+	if conf.ErrorRate > 0 && rand.Float64() < conf.ErrorRate {
+		status := conf.ErrorStatus
+		if status <= 0 {
+			status = config.DefaultMockErrorStatus
+		}
+		message := conf.ErrorMessage
+		if message == "" {
+			message = config.DefaultMockErrorMessage
+		}
+		errType := "invalid_request_error"
+		if status >= http.StatusInternalServerError {
+			errType = "server_error"
+		}
+		return &openai.APIError{HTTPStatusCode: status, Message: message, Type: errType}
+	}
+
+	content := getMockContent(conf, req)
+	usage := openai.Usage{PromptTokens: estimateMockPromptTokens(req), CompletionTokens: mycommon.EstimateTokens(content)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	id := "chatcmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+	utils.SetUpstreamModelHeader(c, req.Model)
+
+	if !req.Stream {
+		c.JSON(http.StatusOK, openai.ChatCompletionResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   oaiReqParam.ClientModel,
+			Choices: []openai.ChatCompletionChoice{{
+				Index:        0,
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+				FinishReason: openai.FinishReasonStop,
+			}},
+			Usage: usage,
+		})
+		return nil
+	}
+
+	utils.SetEventStreamHeaders(c)
+	chunkSize := conf.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = config.DefaultMockChunkSize
+	}
+	writeChunk := func(delta openai.ChatCompletionStreamChoiceDelta, finishReason openai.FinishReason) error {
+		chunk := openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   oaiReqParam.ClientModel,
+			Choices: []openai.ChatCompletionStreamChoice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+		}
+		return writeMockEvent(c, chunk)
+	}
+
+	runes := []rune(content)
+	for i := 0; i < len(runes); i += chunkSize {
+		if i > 0 {
+			if err := sleepMockDelay(ctx, conf.TokenInterval, 0); err != nil {
+				return err
+			}
+		}
+		end := i + chunkSize
+		if end > len(runes) {
+			end = len(runes)
+		}
+		if err := writeChunk(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant, Content: string(runes[i:end])}, ""); err != nil {
+			return err
+		}
+	}
+	if err := writeChunk(openai.ChatCompletionStreamChoiceDelta{}, openai.FinishReasonStop); err != nil {
+		return err
+	}
+	if isStreamUsageRequested(req) {
+		if err := writeMockEvent(c, gin.H{"id": id, "object": "chat.completion.chunk", "created": created, "model": oaiReqParam.ClientModel, "choices": []interface{}{}, "usage": usage}); err != nil {
+			return err
+		}
+	}
+	_, err := c.Writer.WriteString("data: [DONE]\n\n")
+	c.Writer.Flush()
+	return err
+}
+
+func writeMockEvent(c *gin.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Writer.WriteString("data: " + string(data) + "\n\n"); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// sleepMockDelay 等待delay加上0到jitter毫秒，请求取消时提前返回
+func sleepMockDelay(ctx context.Context, delay int, jitter int) error {
+	if jitter > 0 {
+		delay += rand.Intn(jitter + 1)
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// getMockContent 随机选择一个配置的回答，没有配置时返回最后一条user消息
+func getMockContent(conf *config.MockConf, req *openai.ChatCompletionRequest) string {
+	if len(conf.Responses) > 0 {
+		return conf.Responses[rand.Intn(len(conf.Responses))]
+	}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == openai.ChatMessageRoleUser {
+			return mycommon.GetMessageText(req.Messages[i])
+		}
+	}
+	return ""
+}
+
+func estimateMockPromptTokens(req *openai.ChatCompletionRequest) int {
+	tokens := 0
+	for _, msg := range req.Messages {
+		tokens += mycommon.EstimateTokens(mycommon.GetMessageText(msg))
+	}
+	return tokens
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+const keyModelFallback = "modelFallback"
+
+// modelFallbackState 记录一次请求使用的降级链和下一个要尝试的模型
+type modelFallbackState struct {
+	chain []string
+	next  int
+}
+
+// tryModelFallback 重试和failover都失败后，按model_fallbacks配置的顺序切换到下一个模型重新处理请求，
+// 降级链按第一次失败的模型确定，后面的模型失败时继续使用同一条链
+func tryModelFallback(c *gin.Context, s *config.ModelDetails, origReq *openai.ChatCompletionRequest, clientModel string, err error) bool {
+	if c.Writer.Written() || c.Request.Context().Err() != nil || !isFailoverError(&s.Failover, err) {
+		return false
+	}
+
+	var state *modelFallbackState
+	if v, exists := c.Get(keyModelFallback); exists {
+		state = v.(*modelFallbackState)
+	} else {
+		chain := config.GetConf().ModelFallbacks[origReq.Model]
+		if len(chain) == 0 {
+			return false
+		}
+		state = &modelFallbackState{chain: chain}
+		c.Set(keyModelFallback, state)
+	}
+
+	for ; state.next < len(state.chain); state.next++ {
+		fallbackModel := state.chain[state.next]
+		if _, found := config.GetModelToService()[config.ResolveTenantModel(getTenantName(c), fallbackModel)]; !found || fallbackModel == origReq.Model {
+			getLogger(c).Warn("fallback model not found, skipped", zap.String("fallback_model", fallbackModel))
+			continue
+		}
+		state.next++
+
+		getLogger(c).Warn("upstream failed, fallback to next model",
+			zap.String("service_name", s.ServiceName),
+			zap.String("model", origReq.Model),
+			zap.String("fallback_model", fallbackModel),
+			zap.Int("status_code", mycommon.GetErrorStatusCode(err)),
+			zap.Error(err))
+
+		fallbackReq := mycommon.DeepCopyChatCompletionRequest(*origReq)
+		fallbackReq.Model = fallbackModel
+		handleOpenAIRequestWithClientModel(c, &fallbackReq, clientModel)
+		return true
+	}
+
+	getLogger(c).Warn("model fallback exhausted", zap.String("model", origReq.Model), zap.Strings("chain", state.chain))
+	return false
+}
@@ -0,0 +1,410 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"path"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mymetrics"
+	"simple-one-api/pkg/mymoderation"
+	"simple-one-api/pkg/utils"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const finishReasonContentFilter = "content_filter"
+
+// isModerationModel 是否审核该模型的请求，models为空时审核所有模型
+func isModerationModel(conf *config.ModerationConf, model string) bool {
+	if !conf.Enable || len(conf.Providers) == 0 {
+		return false
+	}
+	if len(conf.Models) == 0 {
+		return true
+	}
+	for _, pattern := range conf.Models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// recordModerationViolations 违规记录输出到日志和Prometheus指标
+func recordModerationViolations(c *gin.Context, stage string, model string, res *mymoderation.Result) {
+	for _, v := range res.Violations {
+		getLogger(c).Warn("moderation violation",
+			zap.String("stage", stage),
+			zap.String("provider", v.Provider),
+			zap.String("action", v.Action),
+			zap.Strings("categories", v.Categories),
+			zap.String("key_name", getRequestTrace(c).KeyName),
+			zap.String("model", model))
+		mymetrics.ObserveModerationViolation(stage, v.Provider, v.Action)
+	}
+}
+
+// moderateInput 审核最后一条assistant消息之后的user消息，之前的消息在上一轮已经审核过；
+// mask直接修改请求，block时返回false并按400返回给客户端
+func moderateInput(c *gin.Context, conf *config.ModerationConf, oaiReq *openai.ChatCompletionRequest) bool {
+	start := 0
+	for i := len(oaiReq.Messages) - 1; i >= 0; i-- {
+		if oaiReq.Messages[i].Role == openai.ChatMessageRoleAssistant {
+			start = i + 1
+			break
+		}
+	}
+
+	moderate := func(text string) (string, bool) {
+		res := mymoderation.Moderate(c.Request.Context(), conf, mymoderation.StageInput, text)
+		recordModerationViolations(c, mymoderation.StageInput, oaiReq.Model, res)
+		return res.Content, !res.Blocked
+	}
+
+	for i := start; i < len(oaiReq.Messages); i++ {
+		msg := &oaiReq.Messages[i]
+		if msg.Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		var ok bool
+		if msg.Content != "" {
+			if msg.Content, ok = moderate(msg.Content); !ok {
+				sendModerationErrorResponse(c)
+				return false
+			}
+		}
+		for j := range msg.MultiContent {
+			part := &msg.MultiContent[j]
+			if part.Type != openai.ChatMessagePartTypeText || part.Text == "" {
+				continue
+			}
+			if part.Text, ok = moderate(part.Text); !ok {
+				sendModerationErrorResponse(c)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sendModerationErrorResponse(c *gin.Context) {
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+		"message": "the request was rejected by content moderation",
+		"type":    "invalid_request_error",
+		"code":    "content_policy_violation",
+		"param":   "messages",
+	}})
+}
+
+// moderateResponse 非流式响应逐个审核choice的content，block时content替换为block_message，finish_reason为content_filter
+func moderateResponse(c *gin.Context, conf *config.ModerationConf, model string, data []byte) []byte {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return data
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(resp["choices"], &choices); err != nil {
+		return data
+	}
+
+	modified := false
+	for i := range choices {
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(choices[i]["message"], &msg); err != nil {
+			continue
+		}
+		var content string
+		if err := json.Unmarshal(msg["content"], &content); err != nil || content == "" {
+			continue
+		}
+
+		res := mymoderation.Moderate(c.Request.Context(), conf, mymoderation.StageOutput, content)
+		recordModerationViolations(c, mymoderation.StageOutput, model, res)
+		if res.Blocked {
+			msg["content"], _ = json.Marshal(conf.BlockMessage)
+			choices[i]["finish_reason"], _ = json.Marshal(finishReasonContentFilter)
+		} else if res.Content != content {
+			msg["content"], _ = json.Marshal(res.Content)
+		} else {
+			continue
+		}
+		choices[i]["message"], _ = json.Marshal(msg)
+		modified = true
+	}
+	if !modified {
+		return data
+	}
+
+	resp["choices"], _ = json.Marshal(choices)
+	newData, err := json.Marshal(resp)
+	if err != nil {
+		return data
+	}
+	return newData
+}
+
+// moderationBuffer 暂存非流式响应，输出前审核回答
+type moderationBuffer struct {
+	*responseBuffer
+	origWriter gin.ResponseWriter
+}
+
+func newModerationBuffer(w gin.ResponseWriter) *moderationBuffer {
+	return &moderationBuffer{responseBuffer: newResponseBuffer(w), origWriter: w}
+}
+
+func (b *moderationBuffer) finish(c *gin.Context, conf *config.ModerationConf, model string) {
+	if b.Status() == http.StatusOK && b.body.Len() > 0 {
+		data := moderateResponse(c, conf, model, b.body.Bytes())
+		b.body.Reset()
+		b.body.Write(data)
+	}
+	if b.Written() {
+		b.flushTo(b.origWriter)
+	}
+}
+
+// heldStreamContent 一个choice中还没有审核的内容
+type heldStreamContent struct {
+	text strings.Builder
+	role json.RawMessage
+}
+
+// moderationStreamWriter 流式响应中只包含content的分片先暂存，按句子或者stream_window个字符合并为一个分片审核后输出；
+// 其他分片（如tool_calls、finish_reason）输出前先输出暂存的内容，暂存的分片中的usage不保留。命中block后输出block_message并以content_filter结束，之后上游的内容分片丢弃
+type moderationStreamWriter struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	conf    *config.ModerationConf
+	model   string
+	window  int
+	pending bytes.Buffer
+	held    map[int]*heldStreamContent
+	base    map[string]json.RawMessage
+	blocked bool
+}
+
+func newModerationStreamWriter(c *gin.Context, conf *config.ModerationConf, model string) *moderationStreamWriter {
+	window := conf.StreamWindow
+	if window <= 0 {
+		window = config.DefaultModerationStreamWindow
+	}
+	return &moderationStreamWriter{
+		ResponseWriter: c.Writer,
+		c:              c,
+		conf:           conf,
+		model:          model,
+		window:         window,
+		held:           make(map[int]*heldStreamContent),
+	}
+}
+
+func (w *moderationStreamWriter) Write(data []byte) (int, error) {
+	w.pending.Write(data)
+	for {
+		idx := bytes.Index(w.pending.Bytes(), []byte("\n\n"))
+		if idx < 0 {
+			break
+		}
+		event := make([]byte, idx+2)
+		w.pending.Read(event)
+		if err := w.handleEvent(event); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *moderationStreamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *moderationStreamWriter) handleEvent(event []byte) error {
+	payload, isData := getEventPayload(event)
+	if !isData || payload[0] != '{' {
+		if err := w.flushAll(); err != nil {
+			return err
+		}
+		_, err := w.ResponseWriter.Write(event)
+		return err
+	}
+
+	var chunk map[string]json.RawMessage
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(payload, &chunk) != nil || json.Unmarshal(chunk["choices"], &choices) != nil {
+		if err := w.flushAll(); err != nil {
+			return err
+		}
+		_, err := w.ResponseWriter.Write(event)
+		return err
+	}
+
+	// 中止后只保留没有choices的分片，如单独返回的usage
+	if w.blocked {
+		if len(choices) == 0 {
+			_, err := w.ResponseWriter.Write(event)
+			return err
+		}
+		return nil
+	}
+
+	w.base = make(map[string]json.RawMessage, len(chunk))
+	for k, v := range chunk {
+		if k != "choices" && k != "usage" {
+			w.base[k] = v
+		}
+	}
+
+	contentOnly := len(choices) > 0
+	type choiceContent struct {
+		index   int
+		content string
+		role    json.RawMessage
+	}
+	var contents []choiceContent
+	for i := range choices {
+		var index int
+		json.Unmarshal(choices[i]["index"], &index)
+		var delta map[string]json.RawMessage
+		json.Unmarshal(choices[i]["delta"], &delta)
+		var content string
+		json.Unmarshal(delta["content"], &content)
+		if content != "" {
+			contents = append(contents, choiceContent{index: index, content: content, role: delta["role"]})
+			delete(delta, "content")
+			choices[i]["delta"], _ = json.Marshal(delta)
+		}
+
+		fr := choices[i]["finish_reason"]
+		if len(fr) > 0 && string(fr) != "null" {
+			contentOnly = false
+		}
+		for k := range delta {
+			if k != "role" {
+				contentOnly = false
+			}
+		}
+		for k := range choices[i] {
+			if k != "index" && k != "delta" && k != "finish_reason" && k != "logprobs" {
+				contentOnly = false
+			}
+		}
+	}
+	for _, cc := range contents {
+		h := w.held[cc.index]
+		if h == nil {
+			h = &heldStreamContent{}
+			w.held[cc.index] = h
+		}
+		if h.text.Len() == 0 && len(cc.role) > 0 {
+			h.role = cc.role
+		}
+		h.text.WriteString(cc.content)
+	}
+
+	if contentOnly && len(contents) > 0 {
+		for _, cc := range contents {
+			if text := w.held[cc.index].text.String(); isModerationSegmentEnd(text, w.window) {
+				if err := w.flushChoice(cc.index); err != nil || w.blocked {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// 其他分片输出前先审核并输出暂存的内容
+	if err := w.flushAll(); err != nil || w.blocked {
+		return err
+	}
+	if len(contents) == 0 {
+		_, err := w.ResponseWriter.Write(event)
+		return err
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	newPayload, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	_, err = w.ResponseWriter.Write(toEvent(newPayload))
+	return err
+}
+
+// isModerationSegmentEnd 暂存的内容以句子结束或者超过window个字符时审核
+func isModerationSegmentEnd(text string, window int) bool {
+	if utf8.RuneCountInString(text) >= window {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text)
+	return strings.ContainsRune("。！？!?\n", r)
+}
+
+func (w *moderationStreamWriter) flushAll() error {
+	indexes := make([]int, 0, len(w.held))
+	for index := range w.held {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		if err := w.flushChoice(index); err != nil || w.blocked {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *moderationStreamWriter) flushChoice(index int) error {
+	h := w.held[index]
+	if h == nil || h.text.Len() == 0 || w.blocked {
+		return nil
+	}
+	text := h.text.String()
+	role := h.role
+	delete(w.held, index)
+
+	res := mymoderation.Moderate(w.c.Request.Context(), w.conf, mymoderation.StageOutput, text)
+	recordModerationViolations(w.c, mymoderation.StageOutput, w.model, res)
+
+	delta := map[string]json.RawMessage{}
+	if len(role) > 0 {
+		delta["role"] = role
+	}
+	finishReason := json.RawMessage("null")
+	if res.Blocked {
+		w.blocked = true
+		delta["content"], _ = json.Marshal(w.conf.BlockMessage)
+		finishReason, _ = json.Marshal(finishReasonContentFilter)
+	} else {
+		delta["content"], _ = json.Marshal(res.Content)
+	}
+
+	chunk := make(map[string]json.RawMessage, len(w.base)+1)
+	for k, v := range w.base {
+		chunk[k] = v
+	}
+	choice := map[string]interface{}{"index": index, "delta": delta, "finish_reason": finishReason}
+	chunk["choices"], _ = json.Marshal([]interface{}{choice})
+	payload, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	_, err = w.ResponseWriter.Write(toEvent(payload))
+	return err
+}
+
+// finish 审核并输出暂存的内容和剩余的数据
+func (w *moderationStreamWriter) finish() {
+	w.flushAll()
+	if w.pending.Len() > 0 {
+		if !w.blocked {
+			w.ResponseWriter.Write(w.pending.Bytes())
+		}
+		w.pending.Reset()
+	}
+}
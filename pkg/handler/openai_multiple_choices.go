@@ -0,0 +1,500 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylimiter"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// multipleChoices 请求n大于1或best_of大于n时的处理方式
+type multipleChoices struct {
+	n           int  // 返回给客户端的choices数量
+	candidates  int  // 生成的回答数量，best_of大于n时为best_of
+	fanOut      bool // 服务不支持n大于1，拆分为candidates个请求；否则请求一次，n为candidates
+	concurrency int
+	limiter     *mylimiter.Limiter
+}
+
+// getRawBestOf 从原始请求体中取出go-openai不支持的best_of
+func getRawBestOf(c *gin.Context) int {
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return 0
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return 0
+	}
+	var params struct {
+		BestOf int `json:"best_of"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return 0
+	}
+	return params.BestOf
+}
+
+// getMultipleChoices 不需要拆分请求也不需要选择回答时返回nil，n或best_of超过max_n、流式请求使用best_of时返回错误
+func getMultipleChoices(c *gin.Context, s *config.ModelDetails, req *openai.ChatCompletionRequest, limiter *mylimiter.Limiter) (*multipleChoices, error) {
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	bestOf := getRawBestOf(c)
+	candidates := n
+	if bestOf > n {
+		candidates = bestOf
+	}
+	fanOut := config.IsNoMultipleChoices(s)
+	if candidates <= 1 || (!fanOut && bestOf <= n) {
+		return nil, nil
+	}
+
+	maxN := s.MultipleChoices.MaxN
+	if maxN <= 0 {
+		maxN = config.DefaultMultipleChoicesMaxN
+	}
+	if candidates > maxN {
+		return nil, fmt.Errorf("n and best_of must be less than or equal to %d", maxN)
+	}
+	if bestOf > n && req.Stream {
+		return nil, fmt.Errorf("best_of is not supported with stream")
+	}
+
+	concurrency := s.MultipleChoices.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.DefaultMultipleChoicesConcurrency
+	}
+	if s.Limit.Concurrency > 0 && int(s.Limit.Concurrency) < concurrency {
+		concurrency = int(s.Limit.Concurrency)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &multipleChoices{n: n, candidates: candidates, fanOut: fanOut, concurrency: concurrency, limiter: limiter}, nil
+}
+
+// withMultipleChoices 服务不支持n大于1时并行请求多次，合并为一个响应，usage为所有请求的合计；best_of大于n时选出n个回答
+func withMultipleChoices(next func(*gin.Context, *OAIRequestParam) error, mc *multipleChoices) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		getLogger(c).Info("multiple choices",
+			zap.String("model", oaiReqParam.chatCompletionReq.Model),
+			zap.Int("n", mc.n),
+			zap.Int("candidates", mc.candidates),
+			zap.Bool("fan_out", mc.fanOut),
+			zap.Int("concurrency", mc.concurrency))
+		if !mc.fanOut {
+			return dispatchBestOf(c, oaiReqParam, next, mc)
+		}
+		return dispatchFanOut(c, oaiReqParam, next, mc)
+	}
+}
+
+// dispatchBestOf 服务支持n大于1时请求一次，n为best_of，再从中选出n个回答
+func dispatchBestOf(c *gin.Context, oaiReqParam *OAIRequestParam, next func(*gin.Context, *OAIRequestParam) error, mc *multipleChoices) error {
+	req := oaiReqParam.chatCompletionReq
+	origWriter := c.Writer
+	origN := req.N
+	req.N = mc.candidates
+	defer func() {
+		c.Writer = origWriter
+		req.N = origN
+	}()
+
+	buf := newResponseBuffer(origWriter)
+	c.Writer = buf
+	if err := next(c, oaiReqParam); err != nil {
+		return err
+	}
+	var resp map[string]json.RawMessage
+	var choices []map[string]json.RawMessage
+	if buf.Status() != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &resp) != nil || json.Unmarshal(resp["choices"], &choices) != nil {
+		return buf.flushTo(origWriter)
+	}
+	if data, err := marshalChoicesResponse(resp, selectBestChoices(choices, mc.n), nil); err == nil {
+		buf.body.Reset()
+		buf.body.Write(data)
+	}
+	return buf.flushTo(origWriter)
+}
+
+// dispatchFanOut 每个请求使用复制的gin.Context和独立的ResponseWriter，n为0；
+// 任意一个请求失败时取消其他请求，按该请求的错误返回，流式响应已经开始输出时只丢弃该回答
+func dispatchFanOut(c *gin.Context, oaiReqParam *OAIRequestParam, next func(*gin.Context, *OAIRequestParam) error, mc *multipleChoices) error {
+	req := oaiReqParam.chatCompletionReq
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	var stream *choiceStream
+	if req.Stream {
+		stream = &choiceStream{w: c.Writer, usages: make(map[int]openai.Usage)}
+	}
+
+	var mu sync.Mutex
+	failed := -1
+	fail := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed >= 0 {
+			return
+		}
+		if stream != nil && !stream.abort() {
+			getLogger(c).Warn("choice failed after the stream started", zap.Int("index", i))
+			return
+		}
+		failed = i
+		cancel()
+	}
+
+	// gin.Context的Copy会读取writermem，需要在开始请求之前全部复制
+	writers := make([]*choiceWriter, mc.candidates)
+	subs := make([]*gin.Context, mc.candidates)
+	subParams := make([]OAIRequestParam, mc.candidates)
+	for i := range writers {
+		writers[i] = newChoiceWriter(c.Writer, stream, i)
+		subs[i] = c.Copy()
+		subs[i].Request = c.Request.WithContext(ctx)
+		subs[i].Writer = writers[i]
+
+		subReq := *req
+		subReq.N = 0
+		subReq.Messages = append([]openai.ChatCompletionMessage(nil), req.Messages...)
+		subParams[i] = *oaiReqParam
+		subParams[i].chatCompletionReq = &subReq
+		// 调试信息只记录第一个请求
+		if i > 0 {
+			subParams[i].upstreamCapture = nil
+		}
+	}
+
+	errs := make([]error, mc.candidates)
+	sem := make(chan struct{}, mc.concurrency)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				fail(i)
+				return
+			}
+			defer func() { <-sem }()
+
+			// 第一个请求使用已经获取的限流许可，其他请求按qps和rpm等待
+			if i > 0 && mc.limiter != nil {
+				if err := mc.limiter.Wait(ctx); err != nil {
+					errs[i] = err
+					fail(i)
+					return
+				}
+			}
+			errs[i] = next(subs[i], &subParams[i])
+			writers[i].finish()
+			if errs[i] != nil || writers[i].Status() != http.StatusOK {
+				fail(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	origWriter := c.Writer
+	if failed >= 0 {
+		if errs[failed] != nil {
+			return errs[failed]
+		}
+		writers[failed].copyHeaders(origWriter)
+		return writers[failed].flushTo(origWriter)
+	}
+
+	if stream != nil {
+		return stream.finish(isStreamUsageRequested(req))
+	}
+
+	var resp map[string]json.RawMessage
+	var choices []map[string]json.RawMessage
+	var usage openai.Usage
+	for i, w := range writers {
+		var subResp map[string]json.RawMessage
+		var subChoices []map[string]json.RawMessage
+		if err := json.Unmarshal(w.body.Bytes(), &subResp); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(subResp["choices"], &subChoices); err != nil {
+			return err
+		}
+		var subUsage openai.Usage
+		if json.Unmarshal(subResp["usage"], &subUsage) == nil {
+			usage.PromptTokens += subUsage.PromptTokens
+			usage.CompletionTokens += subUsage.CompletionTokens
+			usage.TotalTokens += subUsage.TotalTokens
+		}
+		if i == 0 {
+			resp = subResp
+		}
+		choices = append(choices, subChoices...)
+	}
+
+	data, err := marshalChoicesResponse(resp, selectBestChoices(choices, mc.n), &usage)
+	if err != nil {
+		return err
+	}
+	writers[0].copyHeaders(origWriter)
+	origWriter.WriteHeader(http.StatusOK)
+	_, err = origWriter.Write(data)
+	return err
+}
+
+// marshalChoicesResponse 替换响应中的choices，index按顺序重新编号，usage不为nil时一起替换
+func marshalChoicesResponse(resp map[string]json.RawMessage, choices []map[string]json.RawMessage, usage *openai.Usage) ([]byte, error) {
+	for i := range choices {
+		choices[i]["index"], _ = json.Marshal(i)
+	}
+	rawChoices, err := json.Marshal(choices)
+	if err != nil {
+		return nil, err
+	}
+	resp["choices"] = rawChoices
+	if usage != nil {
+		if resp["usage"], err = json.Marshal(usage); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(resp)
+}
+
+// selectBestChoices 回答多于n个时按best_of的方式选出n个：正常结束的优先，其次按logprobs的平均值从高到低，都相同时保持原来的顺序
+func selectBestChoices(choices []map[string]json.RawMessage, n int) []map[string]json.RawMessage {
+	if len(choices) <= n {
+		return choices
+	}
+	type scored struct {
+		choice   map[string]json.RawMessage
+		finished bool
+		score    float64
+	}
+	list := make([]scored, len(choices))
+	for i, choice := range choices {
+		var finishReason string
+		json.Unmarshal(choice["finish_reason"], &finishReason)
+		list[i] = scored{choice: choice, finished: finishReason == string(openai.FinishReasonStop), score: choiceLogprobScore(choice)}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].finished != list[j].finished {
+			return list[i].finished
+		}
+		return list[i].score > list[j].score
+	})
+	selected := make([]map[string]json.RawMessage, n)
+	for i := range selected {
+		selected[i] = list[i].choice
+	}
+	return selected
+}
+
+// choiceLogprobScore 回答每个token的logprob平均值，没有logprobs时为0
+func choiceLogprobScore(choice map[string]json.RawMessage) float64 {
+	var logprobs struct {
+		Content []struct {
+			Logprob float64 `json:"logprob"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(choice["logprobs"], &logprobs); err != nil || len(logprobs.Content) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, token := range logprobs.Content {
+		total += token.Logprob
+	}
+	return total / float64(len(logprobs.Content))
+}
+
+// choiceWriter 拆分后单个请求的ResponseWriter，使用独立的header；流式响应按行交给choiceStream，其他响应暂存
+type choiceWriter struct {
+	*responseBuffer
+	header  http.Header
+	stream  *choiceStream
+	index   int
+	pending bytes.Buffer
+}
+
+func newChoiceWriter(w gin.ResponseWriter, stream *choiceStream, index int) *choiceWriter {
+	return &choiceWriter{responseBuffer: newResponseBuffer(w), header: make(http.Header), stream: stream, index: index}
+}
+
+func (w *choiceWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *choiceWriter) isEventStream() bool {
+	return w.stream != nil && w.Status() == http.StatusOK && strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (w *choiceWriter) Write(data []byte) (int, error) {
+	if !w.isEventStream() {
+		return w.responseBuffer.Write(data)
+	}
+	w.WriteHeaderNow()
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := make([]byte, idx+1)
+		w.pending.Read(line)
+		if err := w.stream.writeLine(w, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *choiceWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// finish 处理剩余不完整的行
+func (w *choiceWriter) finish() {
+	if w.pending.Len() > 0 {
+		w.stream.writeLine(w, w.pending.Bytes())
+		w.pending.Reset()
+	}
+}
+
+func (w *choiceWriter) copyHeaders(dst gin.ResponseWriter) {
+	for k, v := range w.header {
+		dst.Header()[k] = v
+	}
+}
+
+// choiceStream 合并多个流式响应，分片的choices按请求的序号编号，id和created使用第一个分片的值，
+// usage分片不直接输出，结束时按合计输出一次
+type choiceStream struct {
+	mu      sync.Mutex
+	w       gin.ResponseWriter
+	started bool
+	aborted bool
+	id      json.RawMessage
+	created json.RawMessage
+	model   json.RawMessage
+	usages  map[int]openai.Usage
+}
+
+// abort 还没有输出时停止输出并返回true，已经开始输出时返回false
+func (s *choiceStream) abort() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return false
+	}
+	s.aborted = true
+	return true
+}
+
+func (s *choiceStream) writeLine(w *choiceWriter, line []byte) error {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return nil
+	}
+	payload := bytes.TrimSpace(line[len("data:"):])
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil
+	}
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted {
+		return nil
+	}
+
+	// 错误信息不做处理
+	if _, isErr := chunk["error"]; !isErr {
+		if rawUsage, exists := chunk["usage"]; exists {
+			var usage openai.Usage
+			if string(rawUsage) != "null" && json.Unmarshal(rawUsage, &usage) == nil {
+				s.usages[w.index] = usage
+			}
+			delete(chunk, "usage")
+		}
+		var choices []map[string]json.RawMessage
+		if err := json.Unmarshal(chunk["choices"], &choices); err != nil || len(choices) == 0 {
+			return nil
+		}
+		for i := range choices {
+			choices[i]["index"], _ = json.Marshal(w.index)
+		}
+		chunk["choices"], _ = json.Marshal(choices)
+
+		if s.id == nil {
+			s.id, s.created = chunk["id"], chunk["created"]
+		}
+		if s.id != nil {
+			chunk["id"] = s.id
+		}
+		if s.created != nil {
+			chunk["created"] = s.created
+		}
+		if model, exists := chunk["model"]; exists {
+			s.model = model
+		}
+		var err error
+		if payload, err = json.Marshal(chunk); err != nil {
+			return err
+		}
+	}
+
+	if !s.started {
+		s.started = true
+		w.copyHeaders(s.w)
+		s.w.WriteHeader(http.StatusOK)
+	}
+	if _, err := s.w.WriteString("data: " + string(payload) + "\n\n"); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+// finish 所有请求结束后输出合计的usage和[DONE]
+func (s *choiceStream) finish(includeUsage bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return nil
+	}
+	if includeUsage && len(s.usages) > 0 {
+		var usage openai.Usage
+		for _, u := range s.usages {
+			usage.PromptTokens += u.PromptTokens
+			usage.CompletionTokens += u.CompletionTokens
+			usage.TotalTokens += u.TotalTokens
+		}
+		data, err := json.Marshal(gin.H{"id": s.id, "object": "chat.completion.chunk", "created": s.created, "model": s.model, "choices": []interface{}{}, "usage": usage})
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.WriteString("data: " + string(data) + "\n\n"); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.WriteString("data: [DONE]\n\n")
+	s.w.Flush()
+	return err
+}
@@ -3,55 +3,58 @@ package handler
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"net/url"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/llm/ollama"
+	"simple-one-api/pkg/mycommon"
 	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
+	"strings"
 )
 
 // 设置目标URL
 var defaultOllamaUrl = "http://127.0.0.1:11434/api/chat"
 
-// 封装HTTP请求和错误处理
-func sendOllamaJSONRequest(url string, payload []byte) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+// 封装HTTP请求和错误处理，配置了代理时使用服务的transport
+func sendOllamaJSONRequest(ctx context.Context, url string, payload []byte, transport http.RoundTripper) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
 	if err != nil {
-		mylog.Logger.Error("Error creating request", zap.Error(err))
+		mylog.FromContext(ctx).Error("Error creating request", zap.Error(err))
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := http.DefaultClient // 使用全局的HTTP客户端
+	if transport != nil {
+		client = &http.Client{Transport: transport}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		mylog.Logger.Error("Error sending request", zap.Error(err))
+		mylog.FromContext(ctx).Error("Error sending request", zap.Error(err))
 		return nil, err
 	}
 	return resp, nil
 }
 
-// 错误和响应处理封装
-func handleResponse(resp *http.Response) error {
-
-	if resp.StatusCode != http.StatusOK {
-		mylog.Logger.Info("HTTP Error Response", zap.String("status", resp.Status))
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			mylog.Logger.Error("Failed to read response body", zap.Error(err))
-			return err
-		}
-
-		mylog.Logger.Info("Response body", zap.String("body", string(body)))
-		return fmt.Errorf(string(body))
+// getOllamaChatURL server_url只配置了地址（如http://127.0.0.1:11434）时补充/api/chat路径
+func getOllamaChatURL(serverURL string) string {
+	if serverURL == "" {
+		return defaultOllamaUrl
 	}
-	return nil
+	u, err := url.Parse(serverURL)
+	if err == nil && strings.Trim(u.Path, "/") == "" {
+		return strings.TrimSuffix(serverURL, "/") + "/api/chat"
+	}
+	return serverURL
 }
 
 func OpenAI2OllamaHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
@@ -60,30 +63,48 @@ func OpenAI2OllamaHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	//credentials := oaiReqParam.creds
 
 	ollamaRequest := adapter.OpenAIRequestToOllamaRequest(oaiReq)
+	// ollama的format直接支持JSON Schema
+	if js := getJSONSchemaFormat(c, oaiReq); js != nil && len(js.Schema) > 0 {
+		ollamaRequest.Format = js.Schema
+	}
+	applyOllamaExtra(ollamaRequest, s.Extra)
 	return handleOllamaRequest(c, s, ollamaRequest, oaiReqParam)
 }
 
+// applyOllamaExtra 服务extra中的keep_alive放在请求的顶层，其他参数（如num_ctx、num_gpu）放在options中，
+// 请求中已经设置的参数优先
+func applyOllamaExtra(ollamaRequest *ollama.ChatRequest, extra map[string]interface{}) {
+	for k, v := range extra {
+		if k == "keep_alive" {
+			ollamaRequest.KeepAlive = v
+			continue
+		}
+		if ollamaRequest.ExtraOptions == nil {
+			ollamaRequest.ExtraOptions = make(map[string]interface{}, len(extra))
+		}
+		ollamaRequest.ExtraOptions[k] = v
+	}
+}
+
 func handleOllamaRequest(c *gin.Context, s *config.ModelDetails, ollamaRequest *ollama.ChatRequest, oaiReqParam *OAIRequestParam) error {
 	jsonStr, err := json.Marshal(ollamaRequest)
 	if err != nil {
-		mylog.Logger.Error("Error marshaling JSON", zap.Error(err))
+		getLogger(c).Error("Error marshaling JSON", zap.Error(err))
 		return err
 	}
 
-	serverUrl := defaultOllamaUrl
-	if s.ServerURL != "" {
-		serverUrl = s.ServerURL
-	}
+	serverUrl := getOllamaChatURL(s.ServerURL)
 
-	resp, err := sendOllamaJSONRequest(serverUrl, jsonStr)
+	resp, err := sendOllamaJSONRequest(c.Request.Context(), serverUrl, jsonStr, oaiReqParam.httpTransport)
 	if err != nil {
-		mylog.Logger.Error("err", zap.Error(err))
+		getLogger(c).Error("err", zap.Error(err))
 		return err
 	}
 	defer resp.Body.Close()
-	err = handleResponse(resp)
+	// 错误中带上状态码，模型不存在时按404返回
+	err = mycommon.CheckStatusCode(resp)
 	if err != nil {
-		mylog.Logger.Error("err", zap.Error(err))
+		getLogger(c).Error("err", zap.Error(err))
 		return err
 	}
 
@@ -94,53 +115,70 @@ func processOllamaResponseBody(c *gin.Context, resp *http.Response, stream bool,
 	clientModel := oaiReqParam.ClientModel
 	if stream {
 		utils.SetEventStreamHeaders(c)
+		// 同一个流式响应的分片使用相同的id
+		id := uuid.New().String()
 		reader := bufio.NewReader(resp.Body)
 		for {
 			line, err := reader.ReadString('\n')
-			if err != nil {
+			if err != nil && (err != io.EOF || strings.TrimSpace(line) == "") {
 				if err != io.EOF {
-					mylog.Logger.Error("Error reading stream", zap.Error(err))
+					getLogger(c).Error("Error reading stream", zap.Error(err))
+					return err
 				}
 				break
 			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
 
 			var ollamaStreamResp ollama.ChatResponse
 			err = json.Unmarshal([]byte(line), &ollamaStreamResp)
 			if err != nil {
-				mylog.Logger.Error("An error occurred during unmarshal", zap.Error(err))
+				getLogger(c).Error("An error occurred during unmarshal", zap.Error(err))
 				return err
 			}
+			if ollamaStreamResp.Error != "" {
+				return fmt.Errorf("ollama stream error: %s", ollamaStreamResp.Error)
+			}
 
 			oaiRespStream := adapter.OllamaResponseToOpenAIStreamResponse(&ollamaStreamResp)
+			utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
+			oaiRespStream.ID = id
+			oaiRespStream.Object = "chat.completion.chunk"
 			oaiRespStream.Model = clientModel
 			respData, err := json.Marshal(&oaiRespStream)
 			if err != nil {
-				mylog.Logger.Error("Error marshaling response", zap.Error(err))
+				getLogger(c).Error("Error marshaling response", zap.Error(err))
 				return err
 			}
 
 			_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 			if err != nil {
-				mylog.Logger.Error("Error writing response", zap.Error(err))
+				getLogger(c).Error("Error writing response", zap.Error(err))
 				return err
 			}
 			c.Writer.(http.Flusher).Flush()
+
+			if ollamaStreamResp.Done {
+				break
+			}
 		}
 	} else {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			mylog.Logger.Error("Error reading response body", zap.Error(err))
+			getLogger(c).Error("Error reading response body", zap.Error(err))
 			return err
 		}
 
 		var ollamaResp ollama.ChatResponse
 		err = json.Unmarshal(body, &ollamaResp)
 		if err != nil {
-			mylog.Logger.Error("Error unmarshal response body", zap.Error(err))
+			getLogger(c).Error("Error unmarshal response body", zap.Error(err))
 			return err
 		}
 
 		myresp := adapter.OllamaResponseToOpenAIResponse(&ollamaResp)
+		utils.SetUpstreamModelHeader(c, myresp.Model)
 		myresp.Model = clientModel
 		c.JSON(http.StatusOK, myresp)
 	}
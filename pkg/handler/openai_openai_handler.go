@@ -11,11 +11,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/mycommon"
-	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mysigner"
 	"simple-one-api/pkg/utils"
 	"strings"
 )
@@ -36,22 +35,23 @@ func formatAzureURL(inputURL string) (string, error) {
 	return formattedURL.String(), nil
 }
 
-// validateAndFormatURL checks if the given URL matches the specified formats and returns the formatted URL
+// validateAndFormatURL checks the server URL and returns the base URL used by go-openai.
+// 以/chat/completions结尾时去掉该后缀，其他路径原样使用，去掉末尾的/以及查询参数
 func validateAndFormatURL(rawurl string) (string, bool) {
-	parsedURL, err := url.Parse(rawurl)
+	parsedURL, err := url.Parse(strings.TrimSpace(rawurl))
 	if err != nil {
 		return "", false
 	}
-
-	re := regexp.MustCompile(`/v([1-9]|[1-4][0-9]|50)(/chat/completions|/)?$`)
-	if re.MatchString(parsedURL.Path) {
-		if submatch := re.FindStringSubmatch(parsedURL.Path); submatch[2] == "/chat/completions" {
-			formattedURL := fmt.Sprintf("%s://%s%s", parsedURL.Scheme, parsedURL.Host, parsedURL.Path[:len(parsedURL.Path)-len("/chat/completions")])
-			return formattedURL, true
-		}
-		return rawurl, true
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return rawurl, false
 	}
-	return rawurl, false
+
+	path := strings.TrimRight(parsedURL.Path, "/")
+	path = strings.TrimSuffix(path, "/chat/completions")
+	path = strings.TrimRight(path, "/")
+
+	baseURL := url.URL{Scheme: parsedURL.Scheme, User: parsedURL.User, Host: parsedURL.Host, Path: path}
+	return baseURL.String(), true
 }
 
 // getDefaultServerURL returns the default server URL based on the model prefix
@@ -66,13 +66,15 @@ func getDefaultServerURL(model string) string {
 		return "https://api.lingyiwanwu.com/v1/chat/completions"
 	case strings.HasPrefix(model, "gpt-"):
 		return "https://api.openai.com/v1/chat/completions"
+	case strings.HasPrefix(model, "grok-"):
+		return xaiDefaultServerURL
 	default:
 		return ""
 	}
 }
 
 // getConfig generates the OpenAI client configuration based on model details and request
-func getConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.ClientConfig, error) {
+func getConfig(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.ClientConfig, error) {
 	req := oaiReqParam.chatCompletionReq
 	credentials := oaiReqParam.creds
 	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
@@ -81,7 +83,7 @@ func getConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.Cli
 	serverURL := s.ServerURL
 	if serverURL == "" {
 		serverURL = getDefaultServerURL(req.Model)
-		mylog.Logger.Info("Using default server URL",
+		getLogger(c).Info("Using default server URL",
 			zap.String("server_url", serverURL)) // 记录默认服务器 URL
 	}
 
@@ -89,7 +91,7 @@ func getConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.Cli
 		if formattedURL, ok := validateAndFormatURL(serverURL); ok {
 			conf.BaseURL = formattedURL
 
-			mylog.Logger.Info("Formatted server URL is valid",
+			getLogger(c).Info("Formatted server URL is valid",
 				zap.String("formatted_url", formattedURL)) // 记录格式化后的服务器 URL 是否有效
 		} else {
 			return conf, errors.New("formatted server URL is invalid")
@@ -98,27 +100,111 @@ func getConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.Cli
 		return conf, errors.New("server URL is empty")
 	}
 
+	transport, err := getUpstreamTransport(c, s, oaiReqParam)
+	if err != nil {
+		return conf, err
+	}
+
+	// OpenAI的组织和项目，用于同一账号下按项目区分计费
+	conf.OrgID = s.OpenAIOrganization
+	if s.OpenAIProject != "" {
+		transport = &utils.HeaderTransport{
+			Transport: transport,
+			Headers:   map[string]string{"OpenAI-Project": s.OpenAIProject},
+		}
+	}
+	conf.HTTPClient = &http.Client{Transport: transport}
+
 	return conf, nil
 }
 
+// getUpstreamTransport 返回请求上游使用的Transport，配置了signer时在发送前对请求签名
+func getUpstreamTransport(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam) (http.RoundTripper, error) {
+	var transport http.RoundTripper = http.DefaultTransport
+	if oaiReqParam.httpTransport != nil {
+		transport = oaiReqParam.httpTransport
+	}
+	if oaiReqParam.upstreamCapture != nil {
+		oaiReqParam.upstreamCapture.Transport = transport
+		transport = oaiReqParam.upstreamCapture
+	}
+
+	if s.Signer.Type != "" {
+		signer, err := mysigner.New(&s.Signer, oaiReqParam.creds)
+		if err != nil {
+			return nil, err
+		}
+		transport = mysigner.NewTransport(transport, signer)
+	}
+
+	// 请求体在签名之前修改，签名使用的是最终发送的请求体
+	if len(oaiReqParam.bodyPatch) > 0 {
+		transport = &utils.JSONBodyPatchTransport{Transport: transport, Set: oaiReqParam.bodyPatch}
+	}
+
+	// 自定义的请求头在签名之前加入，流式和非流式请求都会带上
+	if headers := getCustomHeaders(c, s); len(headers) > 0 {
+		transport = &utils.HeaderTransport{Transport: transport, Headers: headers}
+	}
+	return transport, nil
+}
+
+// getCustomHeaders 获取服务配置的请求头，值中的${VAR}替换为环境变量，替换后为空的请求头不发送
+func getCustomHeaders(c *gin.Context, s *config.ModelDetails) map[string]string {
+	if len(s.Headers) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(s.Headers))
+	logHeaders := make(http.Header, len(s.Headers))
+	for name, value := range s.Headers {
+		value = config.ExpandEnvVars(value)
+		if value == "" {
+			getLogger(c).Warn("custom header is empty", zap.String("service_name", s.ServiceName), zap.String("header", name))
+			continue
+		}
+		headers[name] = value
+		logHeaders.Set(name, value)
+	}
+	getLogger(c).Debug("custom upstream headers", zap.String("service_name", s.ServiceName), zap.Any("headers", logHeaders))
+	return headers
+}
+
 // handleOpenAIRequest handles OpenAI requests, supporting both streaming and non-streaming modes
-func handleOpenAIOpenAIRequest(conf openai.ClientConfig, c *gin.Context, req *openai.ChatCompletionRequest, clientModel string) error {
-	openaiClient := openai.NewClientWithConfig(conf)
-	ctx := context.Background()
+func handleOpenAIOpenAIRequest(conf openai.ClientConfig, c *gin.Context, oaiReqParam *OAIRequestParam, citations *citationCollector) error {
+	req := oaiReqParam.chatCompletionReq
+	clientModel := oaiReqParam.ClientModel
+	ctx := c.Request.Context()
 
 	if req.Stream {
-		return handleOpenAIOpenAIStreamRequest(c, openaiClient, ctx, req, clientModel)
+		// Azure的地址和鉴权方式不同，仍然使用go-openai处理
+		if conf.APIType == openai.APITypeOpenAI {
+			apiKey, _ := utils.GetStringFromMap(oaiReqParam.creds, config.KEYNAME_API_KEY)
+			return handleOpenAIOpenAIRawStreamRequest(c, conf, apiKey, ctx, req, clientModel, citations)
+		}
+		var logprobs *streamLogprobsCollector
+		if isLogProbsRequested(req) {
+			logprobs = &streamLogprobsCollector{Transport: conf.HTTPClient.Transport}
+			if logprobs.Transport == nil {
+				logprobs.Transport = http.DefaultTransport
+			}
+			httpClient := *conf.HTTPClient
+			httpClient.Transport = logprobs
+			conf.HTTPClient = &httpClient
+		}
+		return handleOpenAIOpenAIStreamRequest(c, openai.NewClientWithConfig(conf), ctx, req, clientModel, citations, logprobs)
 	}
 
-	return handleOpenAIStandardRequest(c, openaiClient, ctx, req, clientModel)
+	openaiClient := openai.NewClientWithConfig(conf)
+
+	return handleOpenAIStandardRequest(c, openaiClient, ctx, req, clientModel, citations)
 }
 
 // handleStreamRequest handles streaming OpenAI requests
-func handleOpenAIOpenAIStreamRequest(c *gin.Context, client *openai.Client, ctx context.Context, req *openai.ChatCompletionRequest, clientModel string) error {
+func handleOpenAIOpenAIStreamRequest(c *gin.Context, client *openai.Client, ctx context.Context, req *openai.ChatCompletionRequest, clientModel string, citations *citationCollector, logprobs *streamLogprobsCollector) error {
 	utils.SetEventStreamHeaders(c)
 	stream, err := client.CreateChatCompletionStream(ctx, *req)
 	if err != nil {
-		mylog.Logger.Error("An error occurred",
+		getLogger(c).Error("An error occurred",
 			zap.Error(err))
 		return fmt.Errorf("ChatCompletionStream error: %w", err)
 	}
@@ -127,33 +213,35 @@ func handleOpenAIOpenAIStreamRequest(c *gin.Context, client *openai.Client, ctx
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
-			mylog.Logger.Info(err.Error())
-			return nil
+			getLogger(c).Info(err.Error())
+			return citations.sendStreamChunk(c, clientModel)
 		} else if err != nil {
-			mylog.Logger.Error("An error occurred",
+			getLogger(c).Error("An error occurred",
 				zap.Error(err))
 			return err
 		}
 
-		mylog.Logger.Debug("CheckOpenAIStreamRespone1",
+		getLogger(c).Debug("CheckOpenAIStreamRespone1",
 			zap.Any("response", response))
 
 		adapter.CheckOpenAIStreamRespone(&response)
 
+		utils.SetUpstreamModelHeader(c, response.Model)
 		response.Model = clientModel
 		respData, err := json.Marshal(&response)
 		if err != nil {
-			mylog.Logger.Error("An error occurred",
+			getLogger(c).Error("An error occurred",
 				zap.Error(err))
 			return err
 		}
+		respData = setChoicesLogprobs(respData, logprobs.next())
 
-		mylog.Logger.Info("Response data",
+		getLogger(c).Debug("Response data",
 			zap.String("resp_data", string(respData))) // 记录响应数据
 
 		_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 		if err != nil {
-			mylog.Logger.Error("An error occurred",
+			getLogger(c).Error("An error occurred",
 				zap.Error(err))
 			return err
 		}
@@ -162,28 +250,29 @@ func handleOpenAIOpenAIStreamRequest(c *gin.Context, client *openai.Client, ctx
 }
 
 // handleStandardRequest handles non-streaming OpenAI requests
-func handleOpenAIStandardRequest(c *gin.Context, client *openai.Client, ctx context.Context, req *openai.ChatCompletionRequest, clientModel string) error {
+func handleOpenAIStandardRequest(c *gin.Context, client *openai.Client, ctx context.Context, req *openai.ChatCompletionRequest, clientModel string, citations *citationCollector) error {
 	resp, err := client.CreateChatCompletion(ctx, *req)
 	if err != nil {
-		mylog.Logger.Error("An error occurred",
-			zap.Any("req", req),
+		getLogger(c).Error("An error occurred",
+			zap.Any("req", mycommon.ElideBase64Images(req)),
 			zap.Error(err))
 		return err
 	}
 
 	myResp := adapter.OpenAIResponseToOpenAIResponse(&resp)
+	utils.SetUpstreamModelHeader(c, myResp.Model)
 	myResp.Model = clientModel
 
 	respJsonStr, err := json.Marshal(*myResp)
 	if err != nil {
-		mylog.Logger.Error("An error occurred",
+		getLogger(c).Error("An error occurred",
 			zap.Error(err)) // 记录错误对象
 	}
 
-	mylog.Logger.Info("Response JSON String",
+	getLogger(c).Info("Response JSON String",
 		zap.String("resp_json_str", string(respJsonStr))) // 记录响应 JSON 字符串
 
-	c.JSON(http.StatusOK, myResp)
+	c.JSON(http.StatusOK, citations.applyToResponse(myResp))
 	return nil
 }
 
@@ -192,45 +281,35 @@ func OpenAI2OpenAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	//oaiReq := oaiReqParam.chatCompletionReq
 	s := oaiReqParam.modelDetails
 	//credentials := oaiReqParam.creds
-	conf, err := getConfig(s, oaiReqParam)
+	oaiReqParam.bodyPatch = applyReqCompat(c, s, oaiReqParam.chatCompletionReq)
+	conf, err := getConfig(c, s, oaiReqParam)
 	if err != nil {
 		return err
 	}
 
-	if oaiReqParam.httpTransport != nil {
-		conf.HTTPClient.Transport = oaiReqParam.httpTransport
-	}
-
-	if strings.HasPrefix(s.ServerURL, "https://api.groq.com/openai/v1") {
-		adjustGroqReq(oaiReqParam.chatCompletionReq)
-	} else if strings.HasPrefix(s.ServerURL, "https://open.bigmodel.cn") {
-		mycommon.AdjustOpenAIRequestParams(oaiReqParam.chatCompletionReq)
+	defaultTransport := conf.HTTPClient.Transport
 
-		if strings.Contains(oaiReqParam.chatCompletionReq.Model, "glm-4v") {
-			AdjustChatCompletionRequestForZhiPu(oaiReqParam.chatCompletionReq)
-		}
+	scTransport := &utils.SimpleCustomTransport{
+		Transport: defaultTransport,
 	}
 
-	defaultTransport := http.DefaultTransport
-	if oaiReqParam.httpTransport != nil {
-		defaultTransport = oaiReqParam.httpTransport
+	var citations *citationCollector
+	if s.Citations.Enable {
+		citations = newCitationCollector(defaultTransport, &s.Citations)
+		scTransport.Transport = citations
 	}
 
-	scTransport := &utils.SimpleCustomTransport{
-		Transport: defaultTransport,
-	}
 	conf.HTTPClient = &http.Client{
 		Transport: scTransport,
 	}
 
-	mylog.Logger.Debug("request:", zap.Any("req", oaiReqParam.chatCompletionReq))
+	getLogger(c).Debug("request:", zap.Any("req", mycommon.ElideBase64Images(oaiReqParam.chatCompletionReq)))
 
-	clientModel := oaiReqParam.ClientModel
-	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam.chatCompletionReq, clientModel)
+	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam, citations)
 }
 
 // getAzureConfig generates the OpenAI client configuration for Azure based on model details and request
-func getAzureConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.ClientConfig, error) {
+func getAzureConfig(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam) (openai.ClientConfig, error) {
 	credentials := oaiReqParam.creds
 	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
 	serverURL, err := formatAzureURL(s.ServerURL)
@@ -238,23 +317,55 @@ func getAzureConfig(s *config.ModelDetails, oaiReqParam *OAIRequestParam) (opena
 		serverURL = s.ServerURL
 	}
 	conf := openai.DefaultAzureConfig(apiKey, serverURL)
+	conf.APIVersion = getAzureAPIVersion(s, oaiReqParam.chatCompletionReq.Model, conf.APIVersion)
+
+	// deployments中配置的部署名称优先，model_map映射后的模型是Azure的部署名称，原样使用，其他模型按默认规则去掉.和:
+	defaultModelMapper := conf.AzureModelMapperFunc
+	conf.AzureModelMapperFunc = func(model string) string {
+		if deployment := getAzureDeployment(s, model); deployment != "" {
+			return deployment
+		}
+		if config.IsModelMapTarget(s, model) {
+			return model
+		}
+		return defaultModelMapper(model)
+	}
 
 	if s.ServerURL == "" {
 		return conf, errors.New("server URL is empty")
 	}
 
+	transport, err := getUpstreamTransport(c, s, oaiReqParam)
+	if err != nil {
+		return conf, err
+	}
+	conf.HTTPClient = &http.Client{Transport: transport}
+
+	token, isAD, err := getAzureADToken(s, credentials, transport)
+	if err != nil {
+		getLogger(c).Error("getAzureADToken", zap.String("service_name", s.ServiceName), zap.Error(err))
+		return conf, fmt.Errorf("get azure entra id token: %w", err)
+	}
+	if isAD {
+		adConf := openai.DefaultAzureConfig(token, serverURL)
+		adConf.APIType = openai.APITypeAzureAD
+		adConf.APIVersion = conf.APIVersion
+		adConf.AzureModelMapperFunc = conf.AzureModelMapperFunc
+		adConf.HTTPClient = conf.HTTPClient
+		conf = adConf
+	}
+
 	return conf, nil
 }
 
 // OpenAI2AzureOpenAIHandler handles OpenAI to Azure OpenAI requests
 func OpenAI2AzureOpenAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
-	req := oaiReqParam.chatCompletionReq
 	s := oaiReqParam.modelDetails
 	//credentials := oaiReqParam.creds
-	conf, err := getAzureConfig(s, oaiReqParam)
+	oaiReqParam.bodyPatch = applyReqCompat(c, s, oaiReqParam.chatCompletionReq)
+	conf, err := getAzureConfig(c, s, oaiReqParam)
 	if err != nil {
 		return err
 	}
-	clientModel := oaiReqParam.ClientModel
-	return handleOpenAIOpenAIRequest(conf, c, req, clientModel)
+	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam, nil)
 }
@@ -0,0 +1,33 @@
+package handler
+
+import "testing"
+
+func TestValidateAndFormatURL(t *testing.T) {
+	tests := []struct {
+		rawurl string
+		want   string
+		ok     bool
+	}{
+		{"https://api.openai.com/v1", "https://api.openai.com/v1", true},
+		{"https://api.openai.com/v1/", "https://api.openai.com/v1", true},
+		{"https://api.openai.com/v1/chat/completions", "https://api.openai.com/v1", true},
+		{"https://api.openai.com/v1/chat/completions/", "https://api.openai.com/v1", true},
+		{"https://open.bigmodel.cn/api/paas/v4/chat/completions", "https://open.bigmodel.cn/api/paas/v4", true},
+		{"https://api.groq.com/openai/v1", "https://api.groq.com/openai/v1", true},
+		{"https://generativelanguage.googleapis.com/v1beta/openai/", "https://generativelanguage.googleapis.com/v1beta/openai", true},
+		{"https://example.com/v1beta", "https://example.com/v1beta", true},
+		{"http://127.0.0.1:8000/serve/v1", "http://127.0.0.1:8000/serve/v1", true},
+		{"https://example.com/v1?api-version=2024-02-01", "https://example.com/v1", true},
+		{"https://example.com/v1/chat/completions?foo=bar", "https://example.com/v1", true},
+		{"https://example.com", "https://example.com", true},
+		{" https://example.com/v2 ", "https://example.com/v2", true},
+		{"ftp://example.com/v1", "ftp://example.com/v1", false},
+		{"example.com/v1", "example.com/v1", false},
+	}
+	for _, tt := range tests {
+		got, ok := validateAndFormatURL(tt.rawurl)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("validateAndFormatURL(%q) = %q, %v, want %q, %v", tt.rawurl, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"math"
+	"simple-one-api/pkg/config"
+	"strings"
+)
+
+// paramCompatFields 可以按param_compat丢弃的请求参数，返回参数是否存在以及丢弃的方法
+var paramCompatFields = map[string]func(req *openai.ChatCompletionRequest) (bool, func()){
+	"temperature": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.Temperature != 0, func() { req.Temperature = 0 }
+	},
+	"top_p": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.TopP != 0, func() { req.TopP = 0 }
+	},
+	"logit_bias": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return len(req.LogitBias) > 0, func() { req.LogitBias = nil }
+	},
+	"logprobs": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.LogProbs, func() { req.LogProbs = false }
+	},
+	"top_logprobs": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.TopLogProbs > 0, func() { req.TopLogProbs = 0 }
+	},
+	"n": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.N > 1, func() { req.N = 0 }
+	},
+	"seed": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.Seed != nil, func() { req.Seed = nil }
+	},
+	"stop": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return len(req.Stop) > 0, func() { req.Stop = nil }
+	},
+	"presence_penalty": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.PresencePenalty != 0, func() { req.PresencePenalty = 0 }
+	},
+	"frequency_penalty": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.FrequencyPenalty != 0, func() { req.FrequencyPenalty = 0 }
+	},
+	"user": func(req *openai.ChatCompletionRequest) (bool, func()) {
+		return req.User != "", func() { req.User = "" }
+	},
+}
+
+// getRawTopK 从原始请求体中取出go-openai不支持的top_k
+func getRawTopK(c *gin.Context) (int, bool) {
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return 0, false
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return 0, false
+	}
+	var params struct {
+		TopK *float64 `json:"top_k"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil || params.TopK == nil || *params.TopK <= 0 {
+		return 0, false
+	}
+	return int(*params.TopK), true
+}
+
+// topKToTopP 将top_k近似换算为top_p，top_k为1时接近贪心采样，40左右对应常用的0.9
+func topKToTopP(topK int) float32 {
+	topP := 0.1 + 0.8*math.Log(float64(topK))/math.Log(40)
+	return float32(math.Max(0.05, math.Min(1, topP)))
+}
+
+// applyParamCompat 按param_compat中服务的配置降级上游不支持的参数
+func applyParamCompat(c *gin.Context, req *openai.ChatCompletionRequest, serviceName string) {
+	rules := config.GetConf().ParamCompat[strings.ToLower(serviceName)]
+	for param, action := range rules {
+		action = strings.ToLower(action)
+		if param == "top_k" {
+			topK, exists := getRawTopK(c)
+			if !exists {
+				continue
+			}
+			if action == config.ParamCompatTopP && req.TopP == 0 {
+				req.TopP = topKToTopP(topK)
+				getLogger(c).Warn("unsupported param mapped", zap.String("service_name", serviceName), zap.String("param", param),
+					zap.Int("top_k", topK), zap.Float32("top_p", req.TopP))
+			} else {
+				getLogger(c).Warn("unsupported param dropped", zap.String("service_name", serviceName), zap.String("param", param))
+			}
+			continue
+		}
+
+		field, known := paramCompatFields[param]
+		if !known {
+			getLogger(c).Warn("unknown param in param_compat", zap.String("service_name", serviceName), zap.String("param", param))
+			continue
+		}
+		if action != config.ParamCompatDrop {
+			continue
+		}
+		if present, drop := field(req); present {
+			drop()
+			getLogger(c).Warn("unsupported param dropped", zap.String("service_name", serviceName), zap.String("param", param))
+		}
+	}
+}
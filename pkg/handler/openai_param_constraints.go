@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// paramConstraintError 请求参数超出模型的限制，返回给客户端时带上出错的参数名称
+type paramConstraintError struct {
+	param   string
+	code    string
+	message string
+}
+
+func (e *paramConstraintError) Error() string {
+	return e.message
+}
+
+// floatParam 可以按范围限制的浮点参数
+type floatParam struct {
+	name       string
+	constraint *config.ParamConstraint
+	value      *float32
+}
+
+// applyParamConstraints 按param_constraints中模型的配置设置默认值、限制采样参数和max_tokens，
+// on_exceed为error时超出限制返回*paramConstraintError，不修改请求
+func applyParamConstraints(c *gin.Context, oaiReq *openai.ChatCompletionRequest, conf *config.ParamConstraintsConf) error {
+	strict := strings.ToLower(conf.OnExceed) == config.ParamConstraintsOnExceedError
+	present := getRawRequestParams(c)
+
+	params := []floatParam{
+		{name: "temperature", constraint: conf.Temperature, value: &oaiReq.Temperature},
+		{name: "top_p", constraint: conf.TopP, value: &oaiReq.TopP},
+		{name: "presence_penalty", constraint: conf.PresencePenalty, value: &oaiReq.PresencePenalty},
+		{name: "frequency_penalty", constraint: conf.FrequencyPenalty, value: &oaiReq.FrequencyPenalty},
+	}
+	adjusted := make([]float32, len(params))
+	for i, p := range params {
+		adjusted[i] = *p.value
+		if p.constraint == nil {
+			continue
+		}
+		if *p.value == 0 && !present[p.name] {
+			if p.constraint.Default != nil {
+				adjusted[i] = float32(*p.constraint.Default)
+			}
+			continue
+		}
+		v, err := clampParam(p.name, float64(*p.value), p.constraint, strict, oaiReq.Model)
+		if err != nil {
+			return err
+		}
+		if float32(v) != *p.value {
+			getLogger(c).Warn(p.name+" clamped", zap.String("model", oaiReq.Model), zap.Float32(p.name, *p.value), zap.Float64("adjusted", v))
+		}
+		adjusted[i] = float32(v)
+	}
+
+	maxTokens := effectiveMaxTokens(c, oaiReq)
+	if r := conf.MaxTokens; r != nil {
+		if maxTokens <= 0 {
+			if r.Default != nil {
+				maxTokens = int(*r.Default)
+			}
+		} else {
+			var err error
+			if maxTokens, err = clampMaxTokens(c, oaiReq.Model, maxTokens, r, strict); err != nil {
+				return err
+			}
+		}
+	}
+
+	if conf.MaxContext > 0 {
+		promptTokens := mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))
+		if promptTokens >= conf.MaxContext {
+			return &paramConstraintError{param: "messages", code: "context_length_exceeded",
+				message: fmt.Sprintf("model '%s' has a maximum context length of %d tokens, the messages are about %d tokens", oaiReq.Model, conf.MaxContext, promptTokens)}
+		}
+		if maxTokens > 0 && promptTokens+maxTokens > conf.MaxContext {
+			if strict {
+				return &paramConstraintError{param: "max_tokens", code: "context_length_exceeded",
+					message: fmt.Sprintf("model '%s' has a maximum context length of %d tokens, the messages are about %d tokens and max_tokens is %d", oaiReq.Model, conf.MaxContext, promptTokens, maxTokens)}
+			}
+			getLogger(c).Warn("max_tokens clamped to fit the context", zap.String("model", oaiReq.Model), zap.Int("max_tokens", maxTokens),
+				zap.Int("prompt_tokens", promptTokens), zap.Int("max_context", conf.MaxContext))
+			maxTokens = conf.MaxContext - promptTokens
+		}
+	}
+
+	for i, p := range params {
+		*p.value = adjusted[i]
+	}
+	if maxTokens > 0 {
+		oaiReq.MaxTokens = maxTokens
+	}
+	return nil
+}
+
+// clampParam 调整到[min, max]内，strict时超出范围返回错误。按float32比较，避免0.1等配置值因为精度被误判为超出范围
+func clampParam(name string, value float64, r *config.ParamConstraint, strict bool, model string) (float64, error) {
+	if r.Min != nil && float32(value) < float32(*r.Min) {
+		if strict {
+			return value, &paramConstraintError{param: name, code: "invalid_value",
+				message: fmt.Sprintf("%s %g is below the minimum %g for model '%s'", name, value, *r.Min, model)}
+		}
+		return *r.Min, nil
+	}
+	if r.Max != nil && float32(value) > float32(*r.Max) {
+		if strict {
+			return value, &paramConstraintError{param: name, code: "invalid_value",
+				message: fmt.Sprintf("%s %g is above the maximum %g for model '%s'", name, value, *r.Max, model)}
+		}
+		return *r.Max, nil
+	}
+	return value, nil
+}
+
+// clampMaxTokens guardrails、param_constraints和size_limits共用的max_tokens限制，超出范围时调整并输出max_tokens clamped日志，
+// strict时返回*paramConstraintError
+func clampMaxTokens(c *gin.Context, model string, maxTokens int, r *config.ParamConstraint, strict bool) (int, error) {
+	v, err := clampParam("max_tokens", float64(maxTokens), r, strict, model)
+	if err != nil {
+		return maxTokens, err
+	}
+	if int(v) != maxTokens {
+		getLogger(c).Warn("max_tokens clamped", zap.String("model", model), zap.Int("max_tokens", maxTokens), zap.Int("adjusted", int(v)))
+	}
+	return int(v), nil
+}
+
+// maxTokensLimit 只有上限的max_tokens限制
+func maxTokensLimit(limit int) *config.ParamConstraint {
+	max := float64(limit)
+	return &config.ParamConstraint{Max: &max}
+}
+
+// getRawRequestParams 原始请求体中显式传入（不为null）的参数，用于区分没有传入和传入0
+func getRawRequestParams(c *gin.Context) map[string]bool {
+	present := make(map[string]bool)
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return present
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return present
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return present
+	}
+	for name, value := range fields {
+		if string(value) != "null" {
+			present[name] = true
+		}
+	}
+	return present
+}
+
+func sendParamConstraintError(c *gin.Context, err *paramConstraintError) {
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+		"message": err.message,
+		"type":    "invalid_request_error",
+		"code":    err.code,
+		"param":   err.param,
+	}})
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// https://docs.perplexity.ai/api-reference/chat-completions
+var perplexityDefaultServerURL = "https://api.perplexity.ai"
+
+// perplexityExtraParams Perplexity特有的请求参数，可以放在请求顶层或extra_body中
+var perplexityExtraParams = []string{
+	"return_citations",
+	"return_images",
+	"return_related_questions",
+	"search_domain_filter",
+	"search_recency_filter",
+}
+
+func getPerplexityServerURL(serverURL string) string {
+	if serverURL == "" {
+		return perplexityDefaultServerURL
+	}
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	return strings.TrimSuffix(serverURL, "/chat/completions")
+}
+
+// getPerplexityExtraParams 从原始请求体中取出go-openai不支持的Perplexity参数
+func getPerplexityExtraParams(c *gin.Context) map[string]interface{} {
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return nil
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return nil
+	}
+
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err != nil {
+		return nil
+	}
+
+	params := make(map[string]interface{})
+	if extraBody, ok := reqMap["extra_body"].(map[string]interface{}); ok {
+		for _, key := range perplexityExtraParams {
+			if v, exists := extraBody[key]; exists {
+				params[key] = v
+			}
+		}
+	}
+	for _, key := range perplexityExtraParams {
+		if v, exists := reqMap[key]; exists {
+			params[key] = v
+		}
+	}
+
+	return params
+}
+
+func adjustPerplexityReq(req *openai.ChatCompletionRequest) {
+	req.LogProbs = false
+	req.TopLogProbs = 0
+	req.LogitBias = nil
+	req.N = 0
+}
+
+// extraParamsTransport 在发送给上游的请求体中加入额外的参数
+type extraParamsTransport struct {
+	Transport http.RoundTripper
+	params    map[string]interface{}
+}
+
+func (t *extraParamsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.params) == 0 || req.Body == nil {
+		return t.Transport.RoundTrip(req)
+	}
+	// 请求体设置在副本上，调用方的请求不变
+	req = req.Clone(req.Context())
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var reqMap map[string]interface{}
+	if err := json.Unmarshal(body, &reqMap); err == nil {
+		for k, v := range t.params {
+			reqMap[k] = v
+		}
+		if newBody, err := json.Marshal(reqMap); err == nil {
+			body = newBody
+		} else {
+			mylog.FromContext(req.Context()).Warn("marshal request with extra params failed", zap.Error(err))
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return t.Transport.RoundTrip(req)
+}
+
+// OpenAI2PerplexityHandler handles OpenAI to Perplexity requests
+func OpenAI2PerplexityHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	req := oaiReqParam.chatCompletionReq
+	s := oaiReqParam.modelDetails
+	apiKey, _ := utils.GetStringFromMap(oaiReqParam.creds, config.KEYNAME_API_KEY)
+
+	conf := openai.DefaultConfig(apiKey)
+	conf.BaseURL = getPerplexityServerURL(s.ServerURL)
+
+	adjustPerplexityReq(req)
+
+	defaultTransport, err := getUpstreamTransport(c, s, oaiReqParam)
+	if err != nil {
+		return err
+	}
+
+	extraParams := getPerplexityExtraParams(c)
+	getLogger(c).Debug("perplexity extra params", zap.Any("params", extraParams))
+
+	// 未配置citations时原样保留Perplexity返回的citations数组
+	citationsConf := &s.Citations
+	if !citationsConf.Enable {
+		citationsConf = &config.CitationsConf{Enable: true, Format: config.CitationsFormatRaw}
+	}
+	citations := newCitationCollector(&extraParamsTransport{Transport: defaultTransport, params: extraParams}, citationsConf)
+
+	conf.HTTPClient = &http.Client{
+		Transport: &utils.SimpleCustomTransport{Transport: citations},
+	}
+
+	getLogger(c).Debug("request:", zap.Any("req", mycommon.ElideBase64Images(req)))
+
+	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam, citations)
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestExtraParamsTransportClonesRequest 额外的参数只加入发出的请求，调用方的请求保持不变
+func TestExtraParamsTransportClonesRequest(t *testing.T) {
+	const original = `{"model":"sonar"}`
+	var sent map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &sent); err != nil {
+			t.Errorf("decode upstream request: %v", err)
+		}
+	}))
+	defer upstream.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL, strings.NewReader(original))
+	transport := &extraParamsTransport{Transport: http.DefaultTransport, params: map[string]interface{}{"search_recency_filter": "week"}}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if sent["search_recency_filter"] != "week" || sent["model"] != "sonar" {
+		t.Errorf("sent body = %v", sent)
+	}
+	if req.ContentLength != int64(len(original)) || req.GetBody == nil {
+		t.Fatalf("caller request was modified: ContentLength = %d", req.ContentLength)
+	}
+	body, _ := req.GetBody()
+	data, _ := io.ReadAll(body)
+	if string(data) != original {
+		t.Errorf("caller GetBody = %s, want %s", data, original)
+	}
+}
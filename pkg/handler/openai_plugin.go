@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/myplugin"
+	"simple-one-api/pkg/utils"
+)
+
+func newHookContext(c *gin.Context, clientModel string) *myplugin.HookContext {
+	return &myplugin.HookContext{
+		Context:   c.Request.Context(),
+		Request:   c.Request,
+		RequestID: c.GetString(keyRequestID),
+		KeyName:   getAuthKeyName(c),
+		Tenant:    getTenantName(c),
+		Model:     clientModel,
+		Values:    make(map[string]interface{}),
+	}
+}
+
+// runPluginRequestHooks 执行插件的请求钩子，钩子返回错误时返回给客户端并返回false
+func runPluginRequestHooks(c *gin.Context, hc *myplugin.HookContext, oaiReq *openai.ChatCompletionRequest) bool {
+	name, err := myplugin.RunRequestHooks(hc, oaiReq)
+	if err == nil {
+		return true
+	}
+	getLogger(c).Warn("request rejected by plugin", zap.String("plugin", name), zap.Error(err))
+
+	var pe *myplugin.Error
+	if !errors.As(err, &pe) {
+		pe = myplugin.NewError(http.StatusInternalServerError, err.Error())
+	}
+	var code interface{}
+	if pe.Code != "" {
+		code = pe.Code
+	}
+	utils.ClearEventStreamHeaders(c)
+	c.JSON(pe.Status, gin.H{"error": gin.H{
+		"message": pe.Message,
+		"type":    pe.Type,
+		"code":    code,
+		"param":   nil,
+	}})
+	return false
+}
+
+// newPluginStreamTransformer 分片转换为go-openai的结构交给插件的钩子，只把钩子修改的字段写回分片，结构中没有的字段保持不变
+func newPluginStreamTransformer(hc *myplugin.HookContext) streamChunkTransformer {
+	return func(chunk map[string]json.RawMessage) bool {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return false
+		}
+		var resp openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return false
+		}
+		return applyPluginChanges(chunk, &resp, func() {
+			myplugin.RunStreamChunkHooks(hc, &resp)
+		})
+	}
+}
+
+// applyPluginChanges 执行run前后分别序列化v，把有变化的字段写回raw，返回raw是否被修改
+func applyPluginChanges(raw map[string]json.RawMessage, v interface{}, run func()) bool {
+	before, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	run()
+	after, err := json.Marshal(v)
+	if err != nil || bytes.Equal(before, after) {
+		return false
+	}
+	var beforeObj, afterObj map[string]json.RawMessage
+	if json.Unmarshal(before, &beforeObj) != nil || json.Unmarshal(after, &afterObj) != nil {
+		return false
+	}
+	patchJSONObject(raw, beforeObj, afterObj)
+	return true
+}
+
+// patchJSONObject 把before到after的变化应用到raw，raw中before没有的字段保持不变
+func patchJSONObject(raw, before, after map[string]json.RawMessage) {
+	for k, v := range after {
+		if old, exists := before[k]; exists && bytes.Equal(old, v) {
+			continue
+		}
+		raw[k] = patchJSONValue(raw[k], before[k], v)
+	}
+	for k := range before {
+		if _, exists := after[k]; !exists {
+			delete(raw, k)
+		}
+	}
+}
+
+// patchJSONValue 对象按字段、长度相同的数组按元素应用变化，其他情况直接使用after
+func patchJSONValue(raw, before, after json.RawMessage) json.RawMessage {
+	raw, before, after = bytes.TrimSpace(raw), bytes.TrimSpace(before), bytes.TrimSpace(after)
+	if len(raw) == 0 || len(before) == 0 || len(after) == 0 || raw[0] != after[0] || before[0] != after[0] {
+		return after
+	}
+
+	switch after[0] {
+	case '{':
+		var rawObj, beforeObj, afterObj map[string]json.RawMessage
+		if json.Unmarshal(raw, &rawObj) != nil || json.Unmarshal(before, &beforeObj) != nil || json.Unmarshal(after, &afterObj) != nil {
+			return after
+		}
+		patchJSONObject(rawObj, beforeObj, afterObj)
+		if data, err := json.Marshal(rawObj); err == nil {
+			return data
+		}
+	case '[':
+		var rawArr, beforeArr, afterArr []json.RawMessage
+		if json.Unmarshal(raw, &rawArr) != nil || json.Unmarshal(before, &beforeArr) != nil || json.Unmarshal(after, &afterArr) != nil ||
+			len(rawArr) != len(afterArr) || len(beforeArr) != len(afterArr) {
+			return after
+		}
+		for i := range afterArr {
+			if !bytes.Equal(beforeArr[i], afterArr[i]) {
+				rawArr[i] = patchJSONValue(rawArr[i], beforeArr[i], afterArr[i])
+			}
+		}
+		if data, err := json.Marshal(rawArr); err == nil {
+			return data
+		}
+	}
+	return after
+}
+
+// pluginResponseBuffer 暂存非流式响应，输出前交给插件的钩子
+type pluginResponseBuffer struct {
+	*responseBuffer
+	origWriter gin.ResponseWriter
+}
+
+func newPluginResponseBuffer(w gin.ResponseWriter) *pluginResponseBuffer {
+	return &pluginResponseBuffer{responseBuffer: newResponseBuffer(w), origWriter: w}
+}
+
+func (b *pluginResponseBuffer) finish(hc *myplugin.HookContext) {
+	var raw map[string]json.RawMessage
+	if resp, ok := b.chatCompletionResponse(); ok && json.Unmarshal(b.body.Bytes(), &raw) == nil && raw != nil {
+		if applyPluginChanges(raw, resp, func() { myplugin.RunResponseHooks(hc, resp) }) {
+			if data, err := json.Marshal(raw); err == nil {
+				b.body.Reset()
+				b.body.Write(data)
+			}
+		}
+	}
+	if b.Written() {
+		b.flushTo(b.origWriter)
+	}
+}
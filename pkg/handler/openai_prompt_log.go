@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+)
+
+// startPromptLog 开启采样后，被采样的请求记录脱敏后的完整请求和响应，其余请求只记录元数据。
+// 使用Warn级别输出，prod模式下也能看到。返回的函数在请求结束后调用，用于记录响应
+func startPromptLog(c *gin.Context, oaiReq *openai.ChatCompletionRequest) func() {
+	if !mycommon.ShouldSamplePromptLog(oaiReq.Model) {
+		getLogger(c).Warn("chat completion request",
+			zap.String("model", oaiReq.Model),
+			zap.Bool("stream", oaiReq.Stream),
+			zap.Int("messages", len(oaiReq.Messages)),
+			zap.Int("chars", mycommon.CountMessagesChars(oaiReq.Messages)))
+		return func() {}
+	}
+
+	reqData, err := json.Marshal(mycommon.RedactRequestPaths(mycommon.ElideBase64Images(oaiReq), config.GetRedactPaths(oaiReq.Model)))
+	if err != nil {
+		getLogger(c).Error("startPromptLog|Marshal", zap.Error(err))
+	}
+	getLogger(c).Warn("sampled prompt log",
+		zap.String("model", oaiReq.Model),
+		zap.String("request", mycommon.RedactSensitiveText(string(reqData))))
+
+	recorder := newResponseRecorder(c.Writer)
+	c.Writer = recorder
+	if isStreamTranscriptEnabled(oaiReq) {
+		recorder.recordTranscript()
+	}
+	model, stream := oaiReq.Model, oaiReq.Stream
+
+	return func() {
+		resp := recorder.parse(stream)
+		getLogger(c).Warn("sampled prompt log",
+			zap.String("model", model),
+			zap.Int("status", recorder.Status()),
+			zap.String("completion", mycommon.RedactSensitiveText(resp.Content)),
+			zap.String("error", mycommon.RedactSensitiveText(resp.ErrorMessage)))
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+	"time"
+)
+
+// keySkipPromptTemplate 总结历史消息的内部请求不再按prompt_templates改写
+const keySkipPromptTemplate = "skipPromptTemplate"
+
+var promptVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// applyPromptTemplate 按prompt_templates中客户端模型的配置加上system消息，超过上下文长度时删除或总结最早的消息
+func applyPromptTemplate(c *gin.Context, oaiReq *openai.ChatCompletionRequest, s *config.ModelDetails, conf *config.PromptTemplateConf, clientModel string) {
+	vars := promptTemplateVars(c, conf, clientModel)
+	prepend := renderPromptTemplate(conf.SystemPrepend, vars)
+	appendText := renderPromptTemplate(conf.SystemAppend, vars)
+	if prepend != "" || appendText != "" {
+		oaiReq.Messages = wrapSystemPrompt(oaiReq.Messages, prepend, appendText)
+	}
+
+	maxContext := conf.MaxContext
+	if maxContext <= 0 {
+		maxContext = config.GetModelMaxContext(s, oaiReq.Model)
+	}
+	if maxContext > 0 {
+		truncatePromptMessages(c, oaiReq, conf, maxContext, clientModel)
+	}
+}
+
+func promptTemplateVars(c *gin.Context, conf *config.PromptTemplateConf, clientModel string) map[string]string {
+	now := time.Now()
+	vars := map[string]string{
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+		"datetime": now.Format("2006-01-02 15:04:05"),
+		"model":    clientModel,
+		"key_name": getAuthKeyName(c),
+	}
+	for name, value := range conf.Variables {
+		vars[name] = value
+	}
+	return vars
+}
+
+// renderPromptTemplate 替换{{name}}，没有定义的变量保持原样
+func renderPromptTemplate(tmpl string, vars map[string]string) string {
+	if tmpl == "" {
+		return ""
+	}
+	return promptVariablePattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := promptVariablePattern.FindStringSubmatch(m)[1]
+		if value, exists := vars[name]; exists {
+			return value
+		}
+		return m
+	})
+}
+
+// wrapSystemPrompt 把prepend和appendText加在第一条system消息的前后，客户端的system消息中已经包含相同内容时不再添加
+func wrapSystemPrompt(messages []openai.ChatCompletionMessage, prepend string, appendText string) []openai.ChatCompletionMessage {
+	for i := range messages {
+		msg := &messages[i]
+		if strings.ToLower(msg.Role) != openai.ChatMessageRoleSystem {
+			continue
+		}
+		text := mycommon.GetMessageText(*msg)
+		if strings.Contains(text, prepend) {
+			prepend = ""
+		}
+		if strings.Contains(text, appendText) {
+			appendText = ""
+		}
+		if len(msg.MultiContent) > 0 {
+			if prepend != "" {
+				msg.MultiContent = append([]openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: prepend}}, msg.MultiContent...)
+			}
+			if appendText != "" {
+				msg.MultiContent = append(msg.MultiContent, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: appendText})
+			}
+		} else {
+			msg.Content = joinNonEmpty("\n", prepend, msg.Content, appendText)
+		}
+		return messages
+	}
+
+	systemMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: joinNonEmpty("\n", prepend, appendText)}
+	return append([]openai.ChatCompletionMessage{systemMsg}, messages...)
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+// truncatePromptMessages 估算的输入token数加max_tokens超过maxContext时删除最早的消息，summarize时把删除的消息总结后加到system消息中，
+// 总结失败时只删除
+func truncatePromptMessages(c *gin.Context, oaiReq *openai.ChatCompletionRequest, conf *config.PromptTemplateConf, maxContext int, clientModel string) {
+	maxTokens := effectiveMaxTokens(c, oaiReq)
+	budget := maxContext - maxTokens
+	summarize := strings.ToLower(conf.Truncation) == config.PromptTruncationSummarize
+	summaryMaxTokens := conf.SummaryMaxTokens
+	if summaryMaxTokens <= 0 {
+		summaryMaxTokens = config.DefaultPromptSummaryMaxTokens
+	}
+	if summarize {
+		// 给摘要留出位置
+		budget -= summaryMaxTokens
+	}
+	if budget <= 0 {
+		getLogger(c).Warn("max_tokens leaves no room for the prompt, skip truncation", zap.String("model", clientModel),
+			zap.Int("max_context", maxContext), zap.Int("max_tokens", maxTokens))
+		return
+	}
+	keepRecent := conf.KeepRecent
+	if keepRecent <= 0 {
+		keepRecent = config.DefaultPromptKeepRecent
+	}
+
+	kept, dropped := mycommon.DropOldestMessages(oaiReq.Messages, budget, keepRecent)
+	if len(dropped) == 0 {
+		return
+	}
+
+	summarized := false
+	if summarize {
+		summary, err := summarizeMessages(c, conf, dropped, summaryMaxTokens, clientModel)
+		if err != nil {
+			getLogger(c).Warn("summarize dropped messages failed, drop them only", zap.String("model", clientModel), zap.Error(err))
+		} else {
+			kept = wrapSystemPrompt(kept, "", config.DefaultPromptSummaryPrefix+summary)
+			summarized = true
+		}
+	}
+	getLogger(c).Info("messages truncated to fit the context",
+		zap.String("model", clientModel),
+		zap.Int("max_context", maxContext),
+		zap.Int("dropped", len(dropped)),
+		zap.Int("kept", len(kept)),
+		zap.Bool("summarized", summarized))
+	oaiReq.Messages = kept
+}
+
+// summarizeMessages 在服务内部用summary_model（默认为请求的模型）总结删除的消息，按非流式请求
+func summarizeMessages(c *gin.Context, conf *config.PromptTemplateConf, dropped []openai.ChatCompletionMessage, maxTokens int, clientModel string) (string, error) {
+	model := conf.SummaryModel
+	if model == "" {
+		model = clientModel
+	}
+	prompt := conf.SummaryPrompt
+	if prompt == "" {
+		prompt = config.DefaultPromptSummaryPrompt
+	}
+	summaryReq := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf(prompt, joinMessagesText(dropped))},
+		},
+	}
+	reqBody, err := json.Marshal(summaryReq)
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, "/v1/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	engine := gin.New()
+	engine.POST("/v1/chat/completions", func(ctx *gin.Context) {
+		ctx.Set(keySkipPromptTemplate, true)
+		HandleOpenAIRequest(ctx, &summaryReq)
+	})
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httpReq)
+	if w.Code >= http.StatusBadRequest {
+		return "", fmt.Errorf("summary request failed with status %d: %s", w.Code, truncateString(w.Body.String(), 200))
+	}
+
+	var resp openai.ChatCompletionResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return "", errors.New("empty summary")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
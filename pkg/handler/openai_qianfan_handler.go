@@ -8,14 +8,13 @@ import (
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
 	baiduqianfan "simple-one-api/pkg/llm/baidu-qianfan"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
 )
 
 func OpenAI2QianFanHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 
 	oaiReq := oaiReqParam.chatCompletionReq
-	//s := oaiReqParam.modelDetails
+	s := oaiReqParam.modelDetails
 	credentials := oaiReqParam.creds
 	apiKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_API_KEY)
 	secretKey, _ := utils.GetStringFromMap(credentials, config.KEYNAME_SECRET_KEY)
@@ -29,35 +28,41 @@ func OpenAI2QianFanHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	clientModel := oaiReqParam.ClientModel
 
 	if oaiReq.Stream {
-		return handleQianFanStreamRequest(c, client, apiKey, secretKey, oaiReq.Model, clientModel, qfReq)
+		return handleQianFanStreamRequest(c, client, s.ServerURL, apiKey, secretKey, oaiReq.Model, clientModel, qfReq)
 	} else {
-		return handleQianFanStandardRequest(c, client, apiKey, secretKey, oaiReq.Model, clientModel, qfReq)
+		return handleQianFanStandardRequest(c, client, s.ServerURL, apiKey, secretKey, oaiReq.Model, clientModel, qfReq)
 	}
 }
 
-func handleQianFanStreamRequest(c *gin.Context, client *http.Client, apiKey, secretKey, model string, clientModel string, qfReq *baiduqianfan.QianFanRequest) error {
+func handleQianFanStreamRequest(c *gin.Context, client *http.Client, baseURL, apiKey, secretKey, model string, clientModel string, qfReq *baiduqianfan.QianFanRequest) error {
 	utils.SetEventStreamHeaders(c)
 
-	err := baiduqianfan.QianFanCallSSE(client, apiKey, secretKey, model, qfReq, func(qfResp *baiduqianfan.QianFanResponse) {
+	// 分片中的错误在调用结束后返回，由上层统一转换为OpenAI格式的错误
+	var streamErr error
+	err := baiduqianfan.QianFanCallSSE(c.Request.Context(), client, baseURL, apiKey, secretKey, model, qfReq, func(qfResp *baiduqianfan.QianFanResponse) {
+		if streamErr != nil {
+			return
+		}
 		oaiRespStream := adapter.QianFanResponseToOpenAIStreamResponse(qfResp)
+		utils.SetUpstreamModelHeader(c, oaiRespStream.Model)
 		oaiRespStream.Model = clientModel
 
 		respData, err := json.Marshal(&oaiRespStream)
 		if err != nil {
-			mylog.Logger.Error("Error marshaling response",
+			getLogger(c).Error("Error marshaling response",
 				zap.Error(err)) // 记录错误对象
 
 			return
 		}
 
-		mylog.Logger.Info("Response HTTP data",
+		getLogger(c).Debug("Response HTTP data",
 			zap.String("http_data", string(respData))) // 记录 HTTP 响应数据
 
 		if qfResp.ErrorCode != 0 && oaiRespStream.Error != nil {
-			mylog.Logger.Error("Error response",
+			getLogger(c).Error("Error response",
 				zap.Any("error", *oaiRespStream.Error)) // 记录错误对象
 
-			c.JSON(http.StatusBadRequest, qfResp)
+			streamErr = errorDetailToError(oaiRespStream.Error)
 			return
 		}
 
@@ -66,27 +71,34 @@ func handleQianFanStreamRequest(c *gin.Context, client *http.Client, apiKey, sec
 	})
 
 	if err != nil {
-		mylog.Logger.Error("Error during SSE call",
+		getLogger(c).Error("Error during SSE call",
 			zap.Error(err)) // 记录错误对象
 
 		return err
 	}
 
-	return nil
+	return streamErr
 }
 
-func handleQianFanStandardRequest(c *gin.Context, client *http.Client, apiKey, secretKey, model string, clientModel string, qfReq *baiduqianfan.QianFanRequest) error {
-	qfResp, err := baiduqianfan.QianFanCall(client, apiKey, secretKey, model, qfReq)
+func handleQianFanStandardRequest(c *gin.Context, client *http.Client, baseURL, apiKey, secretKey, model string, clientModel string, qfReq *baiduqianfan.QianFanRequest) error {
+	qfResp, err := baiduqianfan.QianFanCall(c.Request.Context(), client, baseURL, apiKey, secretKey, model, qfReq)
 	if err != nil {
-		mylog.Logger.Error("Error during API call",
+		getLogger(c).Error("Error during API call",
 			zap.Error(err)) // 记录错误对象
 
 		return err
 	}
 
 	oaiResp := adapter.QianFanResponseToOpenAIResponse(qfResp)
+	if oaiResp.Error != nil {
+		getLogger(c).Error("Error response",
+			zap.Any("error", *oaiResp.Error))
+
+		return errorDetailToError(oaiResp.Error)
+	}
+	utils.SetUpstreamModelHeader(c, oaiResp.Model)
 	oaiResp.Model = clientModel
-	mylog.Logger.Info("Standard response",
+	getLogger(c).Info("Standard response",
 		zap.Any("response", oaiResp)) // 记录标准响应对象
 
 	c.JSON(http.StatusOK, oaiResp)
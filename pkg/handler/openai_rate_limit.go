@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mylimiter"
+	"simple-one-api/pkg/myredis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getRateLimitKey 按limit.scope决定限流的粒度，默认整个服务共用一个限流器
+func getRateLimitKey(s *config.ModelDetails, model string, credsID string) string {
+	switch s.Limit.Scope {
+	case config.LimitScopeModel:
+		return s.ServiceID + "/" + model
+	case config.LimitScopeCredential:
+		return s.ServiceID + "/" + credsID
+	case config.LimitScopeModelCredential:
+		return s.ServiceID + "/" + model + "/" + credsID
+	}
+	return s.ServiceID
+}
+
+// getSharedRateLimitKey 配置了shared_state时多个实例共用限流的key，ServiceID在每次加载配置时重新生成，
+// 改为按服务名、server_url、模型列表和凭证计算，没有配置时返回空
+func getSharedRateLimitKey(s *config.ModelDetails, model string, creds map[string]interface{}, scope string) string {
+	if myredis.Shared() == nil {
+		return ""
+	}
+	parts := []string{s.ServiceName, s.ServerURL, strings.Join(s.Models, ",")}
+	switch scope {
+	case config.LimitScopeModel:
+		parts = append(parts, model)
+	case config.LimitScopeCredential:
+		parts = append(parts, mycommon.GetCredentialKey(creds))
+	case config.LimitScopeModelCredential:
+		parts = append(parts, model, mycommon.GetCredentialKey(creds))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// getRateLimiter 优先使用服务上配置的限流，没有配置时使用凭证上的限流
+func getRateLimiter(s *config.ModelDetails, creds map[string]interface{}, credsID string, model string) (limiter *mylimiter.Limiter, key string, timeout int) {
+	l := s.Limit
+	rpm := l.QPM
+	if rpm <= 0 {
+		rpm = l.RPM
+	}
+	if l.QPS > 0 || rpm > 0 || l.Concurrency > 0 {
+		key = getRateLimitKey(s, model, credsID)
+		sharedKey := getSharedRateLimitKey(s, model, creds, l.Scope)
+		return mylimiter.GetCombinedLimiter(key, sharedKey, l.QPS, rpm, l.Concurrency), key, l.Timeout
+	}
+
+	lt, ln, timeout := mycommon.GetCredentialLimit(creds)
+	if lt != "" && ln > 0 {
+		sharedKey := getSharedRateLimitKey(s, model, creds, config.LimitScopeCredential)
+		return mylimiter.GetLimiter(credsID, sharedKey, lt, ln), credsID, timeout
+	}
+	return nil, "", 0
+}
+
+// acquireRateLimit 请求上游前获取限流许可，获取失败时已经返回429，成功时需要调用release
+func acquireRateLimit(c *gin.Context, s *config.ModelDetails, creds map[string]interface{}, credsID string, model string, trace *requestTrace) (release func(), ok bool) {
+	limiter, key, timeout := getRateLimiter(s, creds, credsID, model)
+	if limiter == nil {
+		return func() {}, true
+	}
+
+	startWaitTime := time.Now()
+	var acquireErr error
+	if s.Limit.Reject {
+		ok = limiter.TryAcquire()
+	} else {
+		if timeout <= 0 {
+			timeout = defaultReqTimeout
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(timeout)*time.Second)
+		defer cancel()
+		acquireErr = limiter.Acquire(ctx, s.Limit.MaxQueue)
+		ok = acquireErr == nil
+		if ok && limiter.Wait(ctx) != nil {
+			limiter.Release()
+			ok = false
+		}
+	}
+	elapsed := time.Since(startWaitTime)
+	trace.QueueDuration += elapsed
+
+	windowRequests, inflight, waiting := limiter.Usage()
+	fields := []zap.Field{
+		zap.String("service_name", s.ServiceName),
+		zap.String("key", key),
+		zap.Float64("qps", s.Limit.QPS),
+		zap.Float64("rpm", math.Max(s.Limit.QPM, s.Limit.RPM)),
+		zap.Float64("concurrency", s.Limit.Concurrency),
+		zap.Int("minute_requests", windowRequests),
+		zap.Int64("inflight", inflight),
+		zap.Int64("queued", waiting),
+		zap.Duration("waited_for", elapsed),
+	}
+
+	if !ok {
+		retryAfter := limiter.RetryAfter()
+		msg := "rate limit exceeded"
+		if errors.Is(acquireErr, mylimiter.ErrQueueFull) {
+			msg = "rate limit queue is full"
+		}
+		getLogger(c).Warn(msg, append(fields, zap.Int("max_queue", s.Limit.MaxQueue), zap.Duration("retry_after", retryAfter))...)
+		if c.Request.Context().Err() != nil {
+			return nil, false
+		}
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		sendErrorResponse(c, http.StatusTooManyRequests, "Request rate limit exceeded, please retry later")
+		return nil, false
+	}
+
+	getLogger(c).Info("rate limit usage", fields...)
+	return limiter.Release, true
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"path"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+// reqCompatRule 上游对请求参数有特殊要求时的兼容规则，支持新的服务只需要增加一条规则和对应的调整函数。
+// adjust可以直接修改请求，go-openai不支持的字段写入bodyPatch，在发送前合并到请求体中
+type reqCompatRule struct {
+	name   string
+	match  func(s *config.ModelDetails, model string) bool
+	adjust func(c *gin.Context, req *openai.ChatCompletionRequest, bodyPatch map[string]interface{})
+}
+
+// reqCompatRules 按顺序检查，所有匹配的规则都会生效
+var reqCompatRules = []reqCompatRule{
+	{name: "groq", match: matchServerURLPrefix("https://api.groq.com/openai/v1"), adjust: adjustGroqCompat},
+	{name: "zhipu", match: matchServerURLPrefix("https://open.bigmodel.cn"), adjust: adjustZhiPuCompat},
+	{name: "reasoning", match: matchReasoningModel, adjust: adjustReasoningCompat},
+}
+
+func matchServerURLPrefix(prefix string) func(s *config.ModelDetails, model string) bool {
+	return func(s *config.ModelDetails, model string) bool {
+		return strings.HasPrefix(s.ServerURL, prefix)
+	}
+}
+
+// matchReasoningModel 模型名匹配reasoning_models中的任意一个模式，没有配置时使用o1*、o3*
+func matchReasoningModel(s *config.ModelDetails, model string) bool {
+	patterns := s.ReasoningModels
+	if len(patterns) == 0 {
+		patterns = config.DefaultReasoningModelPatterns
+	}
+	model = strings.ToLower(model)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func adjustGroqCompat(c *gin.Context, req *openai.ChatCompletionRequest, bodyPatch map[string]interface{}) {
+	adjustGroqReq(req)
+}
+
+func adjustZhiPuCompat(c *gin.Context, req *openai.ChatCompletionRequest, bodyPatch map[string]interface{}) {
+	mycommon.AdjustOpenAIRequestParams(req)
+	if strings.Contains(req.Model, "glm-4v") {
+		AdjustChatCompletionRequestForZhiPu(req)
+	}
+}
+
+// reasoningUnsupportedParams o1、o3等推理模型不支持的采样参数
+var reasoningUnsupportedParams = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs", "logit_bias", "n"}
+
+// adjustReasoningCompat 推理模型只接受max_completion_tokens，并且不支持调整采样参数
+func adjustReasoningCompat(c *gin.Context, req *openai.ChatCompletionRequest, bodyPatch map[string]interface{}) {
+	if maxTokens := effectiveMaxTokens(c, req); maxTokens > 0 {
+		req.MaxTokens = 0
+		bodyPatch["max_completion_tokens"] = maxTokens
+	}
+
+	// 非流式请求带stream_options时上游会报错
+	if !req.Stream {
+		req.StreamOptions = nil
+	}
+
+	var dropped []string
+	for _, param := range reasoningUnsupportedParams {
+		if present, drop := paramCompatFields[param](req); present {
+			drop()
+			dropped = append(dropped, param)
+		}
+	}
+	if len(dropped) > 0 {
+		getLogger(c).Info("unsupported params dropped for reasoning model",
+			zap.String("model", req.Model), zap.Strings("params", dropped))
+	}
+}
+
+// keyRawMaxCompletionTokens 缓存从原始请求体中解析出的max_completion_tokens，每个请求只解析一次
+const keyRawMaxCompletionTokens = "rawMaxCompletionTokens"
+
+// effectiveMaxTokens 请求实际的最大输出长度，没有max_tokens时使用max_completion_tokens，都没有传入时返回0
+func effectiveMaxTokens(c *gin.Context, req *openai.ChatCompletionRequest) int {
+	if req.MaxTokens > 0 {
+		return req.MaxTokens
+	}
+	if rawMax, exists := getRawMaxCompletionTokens(c); exists {
+		return rawMax
+	}
+	return 0
+}
+
+// getRawMaxCompletionTokens 从原始请求体中取出go-openai不支持的max_completion_tokens
+func getRawMaxCompletionTokens(c *gin.Context) (int, bool) {
+	if v, exists := c.Get(keyRawMaxCompletionTokens); exists {
+		rawMax := v.(int)
+		return rawMax, rawMax > 0
+	}
+	rawMax := parseRawMaxCompletionTokens(c)
+	c.Set(keyRawMaxCompletionTokens, rawMax)
+	return rawMax, rawMax > 0
+}
+
+func parseRawMaxCompletionTokens(c *gin.Context) int {
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return 0
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return 0
+	}
+	var params struct {
+		MaxCompletionTokens *int `json:"max_completion_tokens"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil || params.MaxCompletionTokens == nil || *params.MaxCompletionTokens <= 0 {
+		return 0
+	}
+	return *params.MaxCompletionTokens
+}
+
+// applyReqCompat 应用所有匹配的兼容规则，返回需要合并到请求体中的字段，没有匹配的规则并且不是json_schema时不修改请求
+func applyReqCompat(c *gin.Context, s *config.ModelDetails, req *openai.ChatCompletionRequest) map[string]interface{} {
+	var bodyPatch map[string]interface{}
+	for _, rule := range reqCompatRules {
+		if !rule.match(s, req.Model) {
+			continue
+		}
+		if bodyPatch == nil {
+			bodyPatch = make(map[string]interface{})
+		}
+		rule.adjust(c, req, bodyPatch)
+		getLogger(c).Debug("request compat rule applied", zap.String("rule", rule.name), zap.String("model", req.Model))
+	}
+
+	// go-openai会丢掉json_schema的参数，使用原始请求中的response_format
+	if req.ResponseFormat != nil && req.ResponseFormat.Type == responseFormatTypeJSONSchema {
+		if raw := getRawResponseFormat(c); raw != nil {
+			if bodyPatch == nil {
+				bodyPatch = make(map[string]interface{})
+			}
+			bodyPatch["response_format"] = raw
+		}
+	}
+	return bodyPatch
+}
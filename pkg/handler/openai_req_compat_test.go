@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"simple-one-api/pkg/config"
+	"testing"
+)
+
+func newReqCompatTestContext(body string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if body != "" {
+		c.Set("rawData", []byte(body))
+	}
+	return c
+}
+
+// newReqCompatTestRequest 每次返回内容相同的新请求，用于比较请求是否被修改
+func newReqCompatTestRequest(model string) *openai.ChatCompletionRequest {
+	return &openai.ChatCompletionRequest{
+		Model:            model,
+		Messages:         []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		MaxTokens:        256,
+		Temperature:      0.7,
+		TopP:             0.9,
+		PresencePenalty:  0.5,
+		FrequencyPenalty: 0.5,
+		LogitBias:        map[string]int{"50256": -100},
+		LogProbs:         true,
+		TopLogProbs:      2,
+		N:                2,
+		StreamOptions:    &openai.StreamOptions{IncludeUsage: true},
+	}
+}
+
+func TestReqCompatRuleMatching(t *testing.T) {
+	tests := []struct {
+		name            string
+		serverURL       string
+		model           string
+		reasoningModels []string
+		want            []string
+	}{
+		{"openai chat model", "https://api.openai.com/v1", "gpt-4o", nil, nil},
+		{"groq", "https://api.groq.com/openai/v1", "llama3-70b-8192", nil, []string{"groq"}},
+		{"zhipu", "https://open.bigmodel.cn/api/paas/v4", "glm-4", nil, []string{"zhipu"}},
+		{"default o1", "https://api.openai.com/v1", "o1-mini", nil, []string{"reasoning"}},
+		{"default o3 case insensitive", "https://api.openai.com/v1", "O3-mini", nil, []string{"reasoning"}},
+		{"custom patterns replace defaults", "https://api.openai.com/v1", "o1-mini", []string{"deepseek-r*"}, nil},
+		{"custom pattern", "http://127.0.0.1:8000/v1", "deepseek-r1", []string{"deepseek-r*"}, []string{"reasoning"}},
+		{"groq reasoning model", "https://api.groq.com/openai/v1", "o1-preview", nil, []string{"groq", "reasoning"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &config.ModelDetails{}
+			s.ServerURL = tt.serverURL
+			s.ReasoningModels = tt.reasoningModels
+			var got []string
+			for _, rule := range reqCompatRules {
+				if rule.match(s, tt.model) {
+					got = append(got, rule.name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("matched rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyReqCompatNoRules 没有匹配的规则时请求不被修改，也不需要修改请求体
+func TestApplyReqCompatNoRules(t *testing.T) {
+	s := &config.ModelDetails{}
+	s.ServerURL = "https://api.openai.com/v1"
+	req := newReqCompatTestRequest("gpt-4o")
+	bodyPatch := applyReqCompat(newReqCompatTestContext(""), s, req)
+	if bodyPatch != nil {
+		t.Errorf("bodyPatch = %v, want nil", bodyPatch)
+	}
+	if want := newReqCompatTestRequest("gpt-4o"); !reflect.DeepEqual(req, want) {
+		t.Errorf("request was modified:\n got  %+v\n want %+v", req, want)
+	}
+}
+
+func TestApplyReqCompatGroq(t *testing.T) {
+	s := &config.ModelDetails{}
+	s.ServerURL = "https://api.groq.com/openai/v1"
+	req := newReqCompatTestRequest("llama3-70b-8192")
+	req.Temperature = 0
+	bodyPatch := applyReqCompat(newReqCompatTestContext(""), s, req)
+	if len(bodyPatch) != 0 {
+		t.Errorf("bodyPatch = %v", bodyPatch)
+	}
+	if req.LogProbs || req.LogitBias != nil || req.TopLogProbs != 0 || req.N != 1 || req.Temperature != 0.1 {
+		t.Errorf("groq request = %+v", req)
+	}
+	if req.MaxTokens != 256 || req.TopP != 0.9 {
+		t.Errorf("other params should be kept: %+v", req)
+	}
+}
+
+func TestApplyReqCompatReasoning(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTokens int
+		rawBody   string
+		stream    bool
+		wantPatch map[string]interface{}
+	}{
+		{"max_tokens", 256, "", false, map[string]interface{}{"max_completion_tokens": 256}},
+		{"max_completion_tokens from the body", 0, `{"max_completion_tokens":512}`, false, map[string]interface{}{"max_completion_tokens": 512}},
+		{"max_tokens wins", 256, `{"max_completion_tokens":512}`, false, map[string]interface{}{"max_completion_tokens": 256}},
+		{"no limit", 0, `{"model":"o1-mini"}`, true, map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &config.ModelDetails{}
+			s.ServerURL = "https://api.openai.com/v1"
+			req := newReqCompatTestRequest("o1-mini")
+			req.MaxTokens = tt.maxTokens
+			req.Stream = tt.stream
+			bodyPatch := applyReqCompat(newReqCompatTestContext(tt.rawBody), s, req)
+			if !reflect.DeepEqual(bodyPatch, tt.wantPatch) {
+				t.Errorf("bodyPatch = %v, want %v", bodyPatch, tt.wantPatch)
+			}
+			if req.MaxTokens != 0 {
+				t.Errorf("max_tokens = %d, want 0", req.MaxTokens)
+			}
+			if req.Temperature != 0 || req.TopP != 0 || req.PresencePenalty != 0 || req.FrequencyPenalty != 0 ||
+				req.LogProbs || req.TopLogProbs != 0 || req.LogitBias != nil || req.N != 0 {
+				t.Errorf("sampling params should be dropped: %+v", req)
+			}
+			if (req.StreamOptions != nil) != tt.stream {
+				t.Errorf("stream_options = %+v with stream %v", req.StreamOptions, tt.stream)
+			}
+		})
+	}
+}
+
+// TestReqCompatReasoningUpstreamBody 推理模型的max_completion_tokens通过bodyPatch合并到发给上游的请求体中
+func TestReqCompatReasoningUpstreamBody(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"o1-mini","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	})
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [o1-mini]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"o1-mini","max_tokens":300,"temperature":0.5,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if upstreamReq["max_completion_tokens"] != float64(300) {
+		t.Errorf("max_completion_tokens = %v", upstreamReq["max_completion_tokens"])
+	}
+	for _, key := range []string{"max_tokens", "temperature"} {
+		if _, exists := upstreamReq[key]; exists {
+			t.Errorf("%s should not be sent to a reasoning model", key)
+		}
+	}
+}
+
+// TestReqCompatSignedUpstreamBody 配置了signer时签名按合并bodyPatch之后的请求体计算
+func TestReqCompatSignedUpstreamBody(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, []byte("secret-test"))
+		mac.Write([]byte(r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.Header.Get("X-Timestamp") + "\n" + hex.EncodeToString(bodyHash[:])))
+		if got := r.Header.Get("X-Signature"); got != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("signature does not match the received body")
+		}
+		if err := json.Unmarshal(body, &upstreamReq); err != nil {
+			t.Errorf("decode upstream request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"o1-mini","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	}))
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [o1-mini]
+          enabled: true
+          server_url: %s/v1
+          signer:
+              type: hmac
+          credentials:
+              access_key: ak-test
+              secret_key: secret-test
+`, upstream.URL))
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"o1-mini","max_tokens":300,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if upstreamReq["max_completion_tokens"] != float64(300) {
+		t.Errorf("max_completion_tokens = %v", upstreamReq["max_completion_tokens"])
+	}
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mymetrics"
+	"simple-one-api/pkg/mypublisher"
+	"strings"
+	"time"
+)
+
+const keyRequestTrace = "requestTrace"
+
+// requestTrace 记录一次请求在处理过程中的信息，供请求结束后统计使用
+type requestTrace struct {
+	StartTime     time.Time
+	ClientModel   string
+	KeyName       string
+	ServiceName   string
+	Model         string
+	Stream        bool
+	QueueDuration time.Duration
+	UpstreamStart time.Time
+	Attempts      []attemptRecord
+	// TimeToFirstToken和Usage在响应结束后由metricsWriter记录
+	TimeToFirstToken time.Duration
+	Usage            *openai.Usage
+	// CacheHit 响应来自响应缓存，没有访问上游
+	CacheHit bool
+}
+
+// attemptRecord 一次上游请求的记录
+type attemptRecord struct {
+	ServiceName string `json:"service_name"`
+	ServiceID   string `json:"service_id"`
+	Model       string `json:"model"`
+	Key         string `json:"key,omitempty"`
+	Status      int    `json:"status"`
+	LatencyMs   int64  `json:"latency_ms"`
+	Error       string `json:"error,omitempty"`
+	// ClientDisconnect 失败是因为客户端断开，不计为上游的错误
+	ClientDisconnect bool `json:"client_disconnect,omitempty"`
+}
+
+func newRequestTrace(c *gin.Context, oaiReq *openai.ChatCompletionRequest) *requestTrace {
+	trace := &requestTrace{
+		StartTime:   time.Now(),
+		ClientModel: oaiReq.Model,
+		KeyName:     getAuthKeyName(c),
+		Stream:      oaiReq.Stream,
+	}
+	c.Set(keyRequestTrace, trace)
+	return trace
+}
+
+// getRequestTrace 获取当前请求的trace，不存在时返回一个空的trace，避免调用方判空
+func getRequestTrace(c *gin.Context) *requestTrace {
+	if v, exists := c.Get(keyRequestTrace); exists {
+		if trace, ok := v.(*requestTrace); ok {
+			return trace
+		}
+	}
+	return &requestTrace{StartTime: time.Now()}
+}
+
+// addAttempt 记录一次上游请求
+func (t *requestTrace) addAttempt(s *config.ModelDetails, creds map[string]interface{}, status int, latency time.Duration, err error) {
+	record := attemptRecord{
+		ServiceName: s.ServiceName,
+		ServiceID:   s.ServiceID,
+		Model:       t.Model,
+		Key:         mycommon.MaskKey(mycommon.GetCredentialKey(creds)),
+		Status:      status,
+		LatencyMs:   latency.Milliseconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+		if code := mycommon.GetErrorStatusCode(err); code > 0 {
+			record.Status = code
+		} else {
+			record.Status = http.StatusInternalServerError
+		}
+	}
+	t.Attempts = append(t.Attempts, record)
+	if config.GetConf().Metrics.Enable {
+		mymetrics.ObserveUpstreamAttempt(t.Model, s.ServiceName, record.Status, latency)
+	}
+}
+
+// markClientDisconnect 将最近一次上游请求标记为客户端断开
+func (t *requestTrace) markClientDisconnect() {
+	if len(t.Attempts) > 0 {
+		t.Attempts[len(t.Attempts)-1].ClientDisconnect = true
+	}
+}
+
+// logAttempts 请求结束后将所有上游请求汇总输出为一条日志
+func (t *requestTrace) logAttempts(c *gin.Context) {
+	mode := strings.ToLower(config.GetAttemptLog())
+	if mode == config.AttemptLogOff || len(t.Attempts) == 0 {
+		return
+	}
+
+	failed := false
+	for _, a := range t.Attempts {
+		if a.Error != "" && !a.ClientDisconnect {
+			failed = true
+		}
+	}
+	if mode != config.AttemptLogAll && len(t.Attempts) < 2 && !failed {
+		return
+	}
+
+	getLogger(c).Warn("upstream attempts",
+		zap.String("client_model", t.ClientModel),
+		zap.String("key_name", t.KeyName),
+		zap.Int("attempt_count", len(t.Attempts)),
+		zap.Duration("total", time.Since(t.StartTime)),
+		zap.Any("attempts", t.Attempts))
+}
+
+// needResponseRecord 是否需要记录响应内容
+func needResponseRecord() bool {
+	return mypublisher.Enabled()
+}
+
+// publishRequestEvent 请求结束后异步发布请求信息
+func publishRequestEvent(trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) {
+	if !mypublisher.Enabled() {
+		return
+	}
+
+	resp := recorder.parse(trace.Stream)
+	event := &mypublisher.Event{
+		Timestamp:        trace.StartTime.Unix(),
+		ServiceName:      trace.ServiceName,
+		ClientModel:      trace.ClientModel,
+		Model:            trace.Model,
+		Stream:           trace.Stream,
+		StatusCode:       recorder.Status(),
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		TotalTokens:      resp.TotalTokens,
+		LatencyMs:        time.Since(trace.StartTime).Milliseconds(),
+		Error:            resp.ErrorMessage,
+	}
+
+	if mypublisher.IncludeContent() {
+		maxLen := mypublisher.MaxContentLength()
+		logReq := mycommon.RedactRequestPaths(oaiReq, config.GetRedactPaths(oaiReq.Model))
+		event.Prompt = truncateString(mycommon.RedactSensitiveText(joinMessagesText(logReq.Messages)), maxLen)
+		event.Completion = truncateString(mycommon.RedactSensitiveText(resp.Content), maxLen)
+	}
+
+	mypublisher.PublishAsync(event)
+}
+
+func joinMessagesText(messages []openai.ChatCompletionMessage) string {
+	var sb strings.Builder
+	for _, msg := range messages {
+		sb.WriteString(msg.Role)
+		sb.WriteString(": ")
+		sb.WriteString(mycommon.GetMessageText(msg))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func truncateString(s string, maxLen int) string {
+	if maxLen <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= maxLen {
+		return s
+	}
+	return string(runes[:maxLen])
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+)
+
+// responseBuffer 暂存非流式响应，不直接写给客户端，处理完成后再通过flushTo输出
+type responseBuffer struct {
+	gin.ResponseWriter
+	body   bytes.Buffer
+	status int
+}
+
+func newResponseBuffer(w gin.ResponseWriter) *responseBuffer {
+	return &responseBuffer{ResponseWriter: w}
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	b.status = code
+}
+
+func (b *responseBuffer) WriteHeaderNow() {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	b.WriteHeaderNow()
+	return b.body.Write(data)
+}
+
+func (b *responseBuffer) WriteString(s string) (int, error) {
+	b.WriteHeaderNow()
+	return b.body.WriteString(s)
+}
+
+func (b *responseBuffer) Status() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+func (b *responseBuffer) Size() int {
+	return b.body.Len()
+}
+
+func (b *responseBuffer) Written() bool {
+	return b.status != 0
+}
+
+func (b *responseBuffer) Flush() {
+}
+
+// flushTo 将暂存的响应写入真正的ResponseWriter
+func (b *responseBuffer) flushTo(w gin.ResponseWriter) error {
+	w.WriteHeader(b.Status())
+	_, err := w.Write(b.body.Bytes())
+	return err
+}
+
+// chatCompletionResponse 解析暂存的非流式响应
+func (b *responseBuffer) chatCompletionResponse() (*openai.ChatCompletionResponse, bool) {
+	if b.Status() != http.StatusOK {
+		return nil, false
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(b.body.Bytes(), &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+// withResponseTransform 非流式请求对暂存的响应执行与流式分片相同的transformer
+func withResponseTransform(next func(*gin.Context, *OAIRequestParam) error, transformer streamChunkTransformer) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		origWriter := c.Writer
+		defer func() {
+			c.Writer = origWriter
+		}()
+
+		buf := newResponseBuffer(origWriter)
+		c.Writer = buf
+		if err := next(c, oaiReqParam); err != nil {
+			return err
+		}
+
+		if buf.Status() == http.StatusOK {
+			var resp map[string]json.RawMessage
+			if err := json.Unmarshal(buf.body.Bytes(), &resp); err == nil && transformer(resp) {
+				if data, err := json.Marshal(resp); err == nil {
+					buf.body.Reset()
+					buf.body.Write(data)
+				}
+			}
+		}
+		return buf.flushTo(origWriter)
+	}
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"path"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycache"
+	"simple-one-api/pkg/mycomdef"
+	"strings"
+	"time"
+)
+
+// responseCacheFlight 同一个key同时只有一个请求访问上游，其他请求等待其结果
+var responseCacheFlight singleflight.Group
+
+// isExplicitZeroTemperature 只有显式传入temperature为0时才缓存，不传时上游一般按1采样
+func isExplicitZeroTemperature(c *gin.Context, oaiReq *openai.ChatCompletionRequest) bool {
+	if oaiReq.Temperature != 0 {
+		return false
+	}
+	rawData, exists := c.Get("rawData")
+	if !exists {
+		return false
+	}
+	body, ok := rawData.([]byte)
+	if !ok {
+		return false
+	}
+	var params struct {
+		Temperature *float64 `json:"temperature"`
+	}
+	return json.Unmarshal(body, &params) == nil && params.Temperature != nil && *params.Temperature == 0
+}
+
+// isResponseCacheBypassed 客户端通过 Cache-Control: no-cache/no-store 或 X-SimpleOneAPI-Cache: bypass 跳过缓存
+func isResponseCacheBypassed(c *gin.Context) bool {
+	cacheControl := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(cacheControl, "no-cache") || strings.Contains(cacheControl, "no-store") {
+		return true
+	}
+	return strings.EqualFold(c.GetHeader(mycomdef.KEYNAME_HEADER_RESPONSE_CACHE), mycomdef.KEYNAME_CACHE_BYPASS)
+}
+
+// isCacheableResponse 只缓存成功并且没有错误信息的响应
+func isCacheableResponse(recorder *responseRecorder) bool {
+	if recorder.Status() != http.StatusOK {
+		return false
+	}
+	var resp struct {
+		Error   json.RawMessage `json:"error"`
+		Choices []interface{}   `json:"choices"`
+	}
+	if err := json.Unmarshal(recorder.body.Bytes(), &resp); err != nil {
+		return false
+	}
+	return len(resp.Error) == 0 && len(resp.Choices) > 0
+}
+
+// isResponseCacheModel 是否缓存该模型的响应，models为空时缓存所有模型
+func isResponseCacheModel(conf *config.ResponseCacheConf, model string) bool {
+	if len(conf.Models) == 0 {
+		return true
+	}
+	for _, pattern := range conf.Models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCachedResponse 命中缓存时指标中的provider记为cache，没有访问上游，不计入用量
+func writeCachedResponse(c *gin.Context, data []byte) {
+	trace := getRequestTrace(c)
+	trace.ServiceName = "cache"
+	trace.CacheHit = true
+	c.Header(mycomdef.KEYNAME_HEADER_RESPONSE_CACHE, mycomdef.KEYNAME_CACHE_HIT)
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// handleWithResponseCache 非流式并且temperature为0的请求先查缓存，未命中时由一个请求访问上游并缓存成功的响应，
+// 同时到达的相同请求等待该请求结束后直接使用其结果，上游失败时各自重新请求
+func handleWithResponseCache(c *gin.Context, oaiReq *openai.ChatCompletionRequest, next func()) {
+	conf := &config.GetConf().ResponseCache
+	store := mycache.GetResponseStore()
+	if !conf.Enable || store == nil || oaiReq.Stream || !isResponseCacheModel(conf, oaiReq.Model) || !isExplicitZeroTemperature(c, oaiReq) {
+		next()
+		return
+	}
+	if isResponseCacheBypassed(c) {
+		c.Header(mycomdef.KEYNAME_HEADER_RESPONSE_CACHE, mycomdef.KEYNAME_CACHE_BYPASS)
+		next()
+		return
+	}
+
+	key := mycache.GetRequestKey(oaiReq, getTenantName(c), resolveServiceModel(c, oaiReq))
+	if data, found := store.Get(key); found {
+		getLogger(c).Info("response cache hit", zap.String("model", oaiReq.Model))
+		writeCachedResponse(c, data)
+		return
+	}
+
+	ttl := conf.TTL
+	if ttl <= 0 {
+		ttl = config.DefaultResponseCacheTTL
+	}
+
+	executed := false
+	v, _, shared := responseCacheFlight.Do(key, func() (interface{}, error) {
+		executed = true
+		c.Header(mycomdef.KEYNAME_HEADER_RESPONSE_CACHE, mycomdef.KEYNAME_CACHE_MISS)
+		recorder := newResponseRecorder(c.Writer)
+		c.Writer = recorder
+		next()
+		if !isCacheableResponse(recorder) {
+			return nil, nil
+		}
+		data := bytes.Clone(recorder.body.Bytes())
+		store.Set(key, data, time.Duration(ttl)*time.Second)
+		return data, nil
+	})
+	if executed {
+		return
+	}
+
+	if data, ok := v.([]byte); ok && data != nil {
+		getLogger(c).Info("response cache hit", zap.String("model", oaiReq.Model), zap.Bool("shared", shared))
+		writeCachedResponse(c, data)
+		return
+	}
+	next()
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"strings"
+)
+
+// responseRecorder 在写入客户端的同时记录响应内容，用于请求结束后的统计和处理。
+// transcript不为nil时成功的流式响应只拼接分片，不保存原始内容
+type responseRecorder struct {
+	gin.ResponseWriter
+	body       bytes.Buffer
+	transcript *streamAggregator
+	pending    []byte
+}
+
+func newResponseRecorder(w gin.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// recordTranscript 流式请求改为拼接分片记录
+func (r *responseRecorder) recordTranscript() {
+	r.transcript = newStreamAggregator()
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.record(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.record([]byte(s))
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *responseRecorder) record(data []byte) {
+	if r.transcript == nil || r.Status() >= 400 {
+		r.body.Write(data)
+		return
+	}
+	r.pending = append(r.pending, data...)
+	for {
+		idx := bytes.IndexByte(r.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		r.transcript.addLine(r.pending[:idx])
+		r.pending = r.pending[idx+1:]
+	}
+}
+
+// transcriptResponse 返回拼接的流式响应，最后不完整的一行也计入
+func (r *responseRecorder) transcriptResponse() *openai.ChatCompletionResponse {
+	if len(r.pending) > 0 {
+		r.transcript.addLine(r.pending)
+		r.pending = nil
+	}
+	return r.transcript.response()
+}
+
+// recordedResponse 从记录的响应中解析出的结果
+type recordedResponse struct {
+	ID               string
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	ErrorMessage     string
+}
+
+// parse 根据是否流式解析记录的响应内容
+func (r *responseRecorder) parse(stream bool) *recordedResponse {
+	result := &recordedResponse{}
+	data := r.body.Bytes()
+
+	if r.Status() >= 400 {
+		result.ErrorMessage = string(data)
+		return result
+	}
+
+	if stream && r.transcript != nil {
+		resp := r.transcriptResponse()
+		result.ID = resp.ID
+		if len(resp.Choices) > 0 {
+			result.Content = resp.Choices[0].Message.Content
+			result.FinishReason = string(resp.Choices[0].FinishReason)
+		}
+		result.PromptTokens = resp.Usage.PromptTokens
+		result.CompletionTokens = resp.Usage.CompletionTokens
+		result.TotalTokens = resp.Usage.TotalTokens
+		return result
+	}
+
+	if !stream {
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			result.ErrorMessage = string(data)
+			return result
+		}
+		result.ID = resp.ID
+		if len(resp.Choices) > 0 {
+			result.Content = resp.Choices[0].Message.Content
+			result.FinishReason = string(resp.Choices[0].FinishReason)
+		}
+		result.PromptTokens = resp.Usage.PromptTokens
+		result.CompletionTokens = resp.Usage.CompletionTokens
+		result.TotalTokens = resp.Usage.TotalTokens
+		return result
+	}
+
+	var content strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "" || payload == "[DONE]" {
+			continue
+		}
+
+		var chunk openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		if result.ID == "" {
+			result.ID = chunk.ID
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+			if choice.FinishReason != "" {
+				result.FinishReason = string(choice.FinishReason)
+			}
+		}
+		// 兼容部分服务在每个分片中都返回usage的情况，取最后一次的值
+		if chunk.Usage != nil {
+			result.PromptTokens = chunk.Usage.PromptTokens
+			result.CompletionTokens = chunk.Usage.CompletionTokens
+			result.TotalTokens = chunk.Usage.TotalTokens
+		}
+	}
+	result.Content = content.String()
+
+	return result
+}
@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+)
+
+var trimRegexpCache sync.Map
+
+func getTrimRegexp(expr string) *regexp.Regexp {
+	if v, ok := trimRegexpCache.Load(expr); ok {
+		return v.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		mylog.Logger.Error("invalid response_trim pattern", zap.String("pattern", expr), zap.Error(err))
+		re = nil
+	}
+	trimRegexpCache.Store(expr, re)
+	return re
+}
+
+func isResponseTrimEnabled(conf *config.ResponseTrimConf) bool {
+	return conf.Whitespace || len(conf.Leading) > 0 || len(conf.Trailing) > 0
+}
+
+// trimLeading 去掉开头的空白和匹配leading的内容
+func trimLeading(conf *config.ResponseTrimConf, content string) string {
+	if conf.Whitespace {
+		content = strings.TrimLeft(content, " \t\r\n")
+	}
+	for _, p := range conf.Leading {
+		if re := getTrimRegexp("^(?:" + p + ")"); re != nil {
+			content = re.ReplaceAllString(content, "")
+		}
+	}
+	if conf.Whitespace {
+		content = strings.TrimLeft(content, " \t\r\n")
+	}
+	return content
+}
+
+// trimTrailing 去掉结尾的空白和匹配trailing的内容
+func trimTrailing(conf *config.ResponseTrimConf, content string) string {
+	if conf.Whitespace {
+		content = strings.TrimRight(content, " \t\r\n")
+	}
+	for _, p := range conf.Trailing {
+		if re := getTrimRegexp("(?:" + p + ")$"); re != nil {
+			content = re.ReplaceAllString(content, "")
+		}
+	}
+	if conf.Whitespace {
+		content = strings.TrimRight(content, " \t\r\n")
+	}
+	return content
+}
+
+// editChoicesContent 修改响应中每个choice的content，field为message或delta，返回修改后的数据及是否存在content
+func editChoicesContent(data []byte, field string, edit func(string) string) ([]byte, bool) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return data, false
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(resp["choices"], &choices); err != nil {
+		return data, false
+	}
+
+	hasContent := false
+	for i := range choices {
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(choices[i][field], &msg); err != nil {
+			continue
+		}
+		var content string
+		if err := json.Unmarshal(msg["content"], &content); err != nil || content == "" {
+			continue
+		}
+		hasContent = true
+		msg["content"], _ = json.Marshal(edit(content))
+		choices[i][field], _ = json.Marshal(msg)
+	}
+	if !hasContent {
+		return data, false
+	}
+
+	resp["choices"], _ = json.Marshal(choices)
+	newData, err := json.Marshal(resp)
+	if err != nil {
+		return data, false
+	}
+	return newData, true
+}
+
+func hasChoicesContent(data []byte, field string) bool {
+	_, hasContent := editChoicesContent(data, field, func(content string) string {
+		return content
+	})
+	return hasContent
+}
+
+// withResponseTrim 非流式请求处理响应内容开头和结尾多余的内容
+func withResponseTrim(next func(*gin.Context, *OAIRequestParam) error) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		conf := &oaiReqParam.modelDetails.ResponseTrim
+
+		origWriter := c.Writer
+		defer func() {
+			c.Writer = origWriter
+		}()
+
+		buf := newResponseBuffer(origWriter)
+		c.Writer = buf
+		if err := next(c, oaiReqParam); err != nil {
+			return err
+		}
+
+		if buf.Status() == 200 {
+			data, _ := editChoicesContent(buf.body.Bytes(), "message", func(content string) string {
+				return trimTrailing(conf, trimLeading(conf, content))
+			})
+			buf.body.Reset()
+			buf.body.Write(data)
+		}
+		return buf.flushTo(origWriter)
+	}
+}
+
+// trimStreamWriter 流式请求只处理第一个和最后一个包含内容的分片，最近一个包含内容的分片会暂存到确定是否为最后一个
+type trimStreamWriter struct {
+	gin.ResponseWriter
+	conf        *config.ResponseTrimConf
+	pending     bytes.Buffer
+	held        []byte
+	leadingDone bool
+}
+
+func newTrimStreamWriter(w gin.ResponseWriter, conf *config.ResponseTrimConf) *trimStreamWriter {
+	return &trimStreamWriter{ResponseWriter: w, conf: conf}
+}
+
+func (w *trimStreamWriter) Write(data []byte) (int, error) {
+	w.pending.Write(data)
+	for {
+		idx := bytes.Index(w.pending.Bytes(), []byte("\n\n"))
+		if idx < 0 {
+			break
+		}
+		event := make([]byte, idx+2)
+		w.pending.Read(event)
+		if err := w.handleEvent(event); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *trimStreamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *trimStreamWriter) handleEvent(event []byte) error {
+	payload, isData := getEventPayload(event)
+	if !isData || payload[0] != '{' {
+		// [DONE]等非JSON数据出现时，暂存的分片就是最后一个
+		if err := w.flushHeld(true); err != nil {
+			return err
+		}
+		_, err := w.ResponseWriter.Write(event)
+		return err
+	}
+
+	if !w.leadingDone {
+		newPayload, hasContent := editChoicesContent(payload, "delta", func(content string) string {
+			return trimLeading(w.conf, content)
+		})
+		if hasContent {
+			payload = newPayload
+			event = toEvent(payload)
+			// 去掉开头后内容为空时，继续处理下一个分片
+			w.leadingDone = hasChoicesContent(payload, "delta")
+		}
+	}
+
+	if hasChoicesContent(payload, "delta") {
+		if err := w.flushHeld(false); err != nil {
+			return err
+		}
+		w.held = event
+		return nil
+	}
+
+	// 带有finish_reason的分片之后不会再有内容
+	if hasFinishReason(payload) {
+		if err := w.flushHeld(true); err != nil {
+			return err
+		}
+	}
+	_, err := w.ResponseWriter.Write(event)
+	return err
+}
+
+func (w *trimStreamWriter) flushHeld(last bool) error {
+	if w.held == nil {
+		return nil
+	}
+	event := w.held
+	w.held = nil
+
+	if last {
+		if payload, isData := getEventPayload(event); isData {
+			newPayload, _ := editChoicesContent(payload, "delta", func(content string) string {
+				return trimTrailing(w.conf, content)
+			})
+			event = toEvent(newPayload)
+		}
+	}
+	_, err := w.ResponseWriter.Write(event)
+	return err
+}
+
+// finish 输出暂存的分片和剩余的数据
+func (w *trimStreamWriter) finish() {
+	w.flushHeld(true)
+	if w.pending.Len() > 0 {
+		w.ResponseWriter.Write(w.pending.Bytes())
+		w.pending.Reset()
+	}
+}
+
+func hasFinishReason(data []byte) bool {
+	var chunk struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return false
+	}
+	for _, choice := range chunk.Choices {
+		if choice.FinishReason != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func getEventPayload(event []byte) ([]byte, bool) {
+	line := bytes.TrimSpace(event)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return nil, false
+	}
+	payload := bytes.TrimSpace(line[len("data:"):])
+	return payload, len(payload) > 0
+}
+
+func toEvent(payload []byte) []byte {
+	return append(append([]byte("data: "), payload...), '\n', '\n')
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+)
+
+// getAffinitySessionKey 开启session_affinity时返回会话的key，同一会话请求不同模型时分别记录，没有会话ID时返回空
+func getAffinitySessionKey(c *gin.Context, oaiReq *openai.ChatCompletionRequest, model string) string {
+	conf := &config.GetConf().SessionAffinity
+	if !conf.Enable {
+		return ""
+	}
+
+	header := conf.Header
+	if header == "" {
+		header = mycomdef.KEYNAME_HEADER_CONVERSATION_ID
+	}
+	id := strings.TrimSpace(c.GetHeader(header))
+	if id == "" && conf.UseUser {
+		id = oaiReq.User
+	}
+	if id == "" || len(id) > maxConversationIDLength {
+		return ""
+	}
+	return id + "|" + model
+}
+
+// getAffinityService 会话上次使用的服务仍然可用时继续使用，不使用负载均衡的选择
+func getAffinityService(c *gin.Context, oaiReq *openai.ChatCompletionRequest) *config.ModelDetails {
+	key := getAffinitySessionKey(c, oaiReq, oaiReq.Model)
+	if key == "" {
+		return nil
+	}
+	s := mycommon.GetAffinityService(key, oaiReq.Model)
+	if s != nil {
+		getLogger(c).Info("session affinity hit", zap.String("service_name", s.ServiceName), zap.String("model", oaiReq.Model))
+	}
+	return s
+}
+
+// getAffinityCredentials 优先使用会话上次在该服务上使用的凭证，并记录本次选择的服务和凭证
+func getAffinityCredentials(c *gin.Context, oaiReq *openai.ChatCompletionRequest, s *config.ModelDetails, selectModel string) (map[string]interface{}, string) {
+	key := getAffinitySessionKey(c, oaiReq, selectModel)
+	if key == "" {
+		return mycommon.GetACredentials(s, oaiReq.Model)
+	}
+
+	creds, credsID, ok := mycommon.GetAffinityCredentials(key, s)
+	if !ok {
+		creds, credsID = mycommon.GetACredentials(s, oaiReq.Model)
+	}
+	mycommon.SetSessionAffinity(key, s.ServiceID, credsID)
+	return creds, credsID
+}
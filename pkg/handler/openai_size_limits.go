@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+)
+
+// RequestSizeLimitMiddleware 请求体超过size_limits.max_request_body时返回413。Content-Length超过时不读取请求体直接返回，
+// 没有Content-Length时最多读取max_request_body+1字节，超大的请求体不会整个读入内存
+func RequestSizeLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := config.GetConf().SizeLimits.MaxRequestBody
+		if limit <= 0 || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			rejectRequestTooLarge(c, c.Request.ContentLength, limit, "")
+			c.Abort()
+			return
+		}
+		if c.Request.ContentLength < 0 {
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+			if err != nil {
+				getLogger(c).Warn("read request body", zap.Error(err))
+				sendErrorResponse(c, http.StatusBadRequest, err.Error())
+				c.Abort()
+				return
+			}
+			if int64(len(body)) > limit {
+				rejectRequestTooLarge(c, -1, limit, "")
+				c.Abort()
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Request.ContentLength = int64(len(body))
+		}
+		c.Next()
+	}
+}
+
+// rejectRequestTooLarge size小于0时为没有Content-Length、读取到上限仍未结束的请求体
+func rejectRequestTooLarge(c *gin.Context, size, limit int64, model string) {
+	errMsg := fmt.Sprintf("request body is too large: %d bytes, the maximum allowed is %d bytes", size, limit)
+	if size < 0 {
+		errMsg = fmt.Sprintf("request body is too large, the maximum allowed is %d bytes", limit)
+	}
+	if model != "" {
+		errMsg += fmt.Sprintf(" for model '%s'", model)
+	}
+	getLogger(c).Warn(errMsg, zap.String("path", c.Request.URL.Path))
+	sendErrorResponse(c, http.StatusRequestEntityTooLarge, errMsg)
+}
+
+// applySizeLimits 按客户端请求的模型检查请求体的大小，max_tokens（或max_completion_tokens）超过max_output_tokens时调整为该值，
+// 没有传入时也使用该值，避免上游按模型的最大长度输出
+func applySizeLimits(c *gin.Context, oaiReq *openai.ChatCompletionRequest, bodySize int) bool {
+	limits := config.GetModelSizeLimits(oaiReq.Model)
+	if limits.MaxRequestBody > 0 && int64(bodySize) > limits.MaxRequestBody {
+		rejectRequestTooLarge(c, int64(bodySize), limits.MaxRequestBody, oaiReq.Model)
+		return false
+	}
+
+	if limits.MaxOutputTokens <= 0 {
+		return true
+	}
+	maxTokens := effectiveMaxTokens(c, oaiReq)
+	if maxTokens <= 0 {
+		oaiReq.MaxTokens = limits.MaxOutputTokens
+		return true
+	}
+	if clamped, _ := clampMaxTokens(c, oaiReq.Model, maxTokens, maxTokensLimit(limits.MaxOutputTokens), false); clamped != maxTokens {
+		oaiReq.MaxTokens = clamped
+	}
+	return true
+}
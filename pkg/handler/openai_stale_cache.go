@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycache"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+	"time"
+)
+
+// storeStaleResponse 请求成功后缓存响应内容，供上游不可用时返回
+func storeStaleResponse(s *config.ModelDetails, key string, recorder *responseRecorder, stream bool) {
+	if recorder.Status() != http.StatusOK {
+		return
+	}
+	result := recorder.parse(stream)
+	if result.ErrorMessage != "" || result.Content == "" {
+		return
+	}
+
+	maxAge := s.StaleOnError.MaxAge
+	if maxAge <= 0 {
+		maxAge = config.DefaultStaleOnErrorMaxAge
+	}
+
+	mycache.SetResponse(key, &mycache.CachedResponse{
+		Content:          result.Content,
+		FinishReason:     result.FinishReason,
+		PromptTokens:     result.PromptTokens,
+		CompletionTokens: result.CompletionTokens,
+		TotalTokens:      result.TotalTokens,
+		CreatedAt:        time.Now(),
+	}, time.Duration(maxAge)*time.Second)
+}
+
+// isUpstreamUnavailable 请求本身有问题导致的错误不返回缓存
+func isUpstreamUnavailable(err error) bool {
+	switch mycommon.GetErrorStatusCode(err) {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// serveStaleResponse 上游请求失败时返回缓存的响应，并在响应头中标记 X-Cache: STALE
+func serveStaleResponse(c *gin.Context, key string, clientModel string, stream bool, err error) bool {
+	if c.Writer.Written() || !isUpstreamUnavailable(err) {
+		return false
+	}
+
+	cached, found := mycache.GetResponse(key)
+	if !found {
+		return false
+	}
+
+	getLogger(c).Warn("upstream failed, serving stale cached response",
+		zap.String("client_model", clientModel),
+		zap.Time("cached_at", cached.CreatedAt),
+		zap.Error(err))
+
+	c.Writer.Header().Set(mycomdef.KEYNAME_HEADER_CACHE, mycomdef.KEYNAME_CACHE_STALE)
+
+	id := "chatcmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+
+	if stream {
+		utils.SetEventStreamHeaders(c)
+		chunk := openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   clientModel,
+			Choices: []openai.ChatCompletionStreamChoice{{
+				Index: 0,
+				Delta: openai.ChatCompletionStreamChoiceDelta{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: cached.Content,
+				},
+				FinishReason: openai.FinishReason(cached.FinishReason),
+			}},
+		}
+		respData, err := json.Marshal(&chunk)
+		if err != nil {
+			getLogger(c).Error("marshal stale response failed", zap.Error(err))
+			return false
+		}
+		c.Writer.WriteString("data: " + string(respData) + "\n\n")
+		utils.SendOpenAIStreamEOFData(c)
+		return true
+	}
+
+	c.JSON(http.StatusOK, openai.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   clientModel,
+		Choices: []openai.ChatCompletionChoice{{
+			Index: 0,
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: cached.Content,
+			},
+			FinishReason: openai.FinishReason(cached.FinishReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     cached.PromptTokens,
+			CompletionTokens: cached.CompletionTokens,
+			TotalTokens:      cached.TotalTokens,
+		},
+	})
+	return true
+}
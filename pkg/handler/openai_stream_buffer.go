@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"simple-one-api/pkg/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errStreamClientTooSlow 缓冲区满后超过stream_write_timeout客户端仍然没有读取
+var errStreamClientTooSlow = errors.New("stream client is too slow: the response buffer is full")
+
+// streamBuffer 开启size_limits.stream_buffer时直接包装clientWriteGuard，流式响应先写入有上限的缓冲区，
+// 由单独的goroutine写给客户端，每次写入都设置写超时，客户端短暂不读取时不阻塞上游分片的读取和处理。
+// 缓冲区满时Write等待客户端读取，超过timeout仍然没有空间时返回errStreamClientTooSlow，并像客户端断开一样取消请求
+type streamBuffer struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	guard   *clientWriteGuard
+	limit   int
+	timeout time.Duration
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	size      int
+	streaming bool
+	closed    bool
+	err       error
+	space     chan struct{} // 每次写给客户端后关闭并替换，通知所有等待的Write
+	data      chan struct{}
+	done      chan struct{}
+}
+
+// newStreamBuffer 替换c.Writer，返回的streamBuffer需要在请求结束时调用finish
+func newStreamBuffer(c *gin.Context, conf *config.SizeLimitsConf) *streamBuffer {
+	timeout := conf.StreamWriteTimeout
+	if timeout <= 0 {
+		timeout = config.DefaultStreamWriteTimeout
+	}
+	w := &streamBuffer{
+		ResponseWriter: c.Writer,
+		c:              c,
+		guard:          getClientWriteGuard(c),
+		limit:          conf.StreamBuffer,
+		timeout:        time.Duration(timeout) * time.Second,
+		space:          make(chan struct{}),
+		data:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	c.Writer = w
+	return w
+}
+
+// start 第一次以text/event-stream输出时发送响应头并启动写入的goroutine，之后响应头不能再修改；
+// 返回false时直接写入，如非流式的错误响应以及finish之后的写入
+func (w *streamBuffer) start() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	if w.streaming {
+		return true
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), mimeEventStream) || w.ResponseWriter.Status() != http.StatusOK {
+		return false
+	}
+	w.streaming = true
+	w.ResponseWriter.WriteHeaderNow()
+	go w.run()
+	return true
+}
+
+// isStreaming 写入的goroutine是否在运行，finish之后直接写入
+func (w *streamBuffer) isStreaming() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.streaming && !w.closed
+}
+
+func (w *streamBuffer) Write(data []byte) (int, error) {
+	if !w.start() {
+		return w.ResponseWriter.Write(data)
+	}
+
+	var timer *time.Timer
+	for {
+		w.mu.Lock()
+		if w.err != nil {
+			err := w.err
+			w.mu.Unlock()
+			return 0, err
+		}
+		// 缓冲区为空时即使超过limit也写入，保证单个大的分片可以输出
+		if w.buf.Len() == 0 || w.buf.Len()+len(data) <= w.limit {
+			w.buf.Write(data)
+			w.size += len(data)
+			w.mu.Unlock()
+			notify(w.data)
+			if timer != nil {
+				timer.Stop()
+			}
+			return len(data), nil
+		}
+		pending, space := w.buf.Len(), w.space
+		w.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(w.timeout)
+		}
+		select {
+		case <-space:
+		case <-timer.C:
+			getLogger(w.c).Warn("stream client too slow, closing the stream",
+				zap.Int("pending_bytes", pending), zap.Int("stream_buffer", w.limit), zap.Duration("timeout", w.timeout))
+			w.fail(errStreamClientTooSlow)
+			return 0, errStreamClientTooSlow
+		case <-w.c.Request.Context().Done():
+			timer.Stop()
+			return 0, w.c.Request.Context().Err()
+		}
+	}
+}
+
+func (w *streamBuffer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeader 开始流式输出后由goroutine写入，不再修改状态码
+func (w *streamBuffer) WriteHeader(code int) {
+	if w.isStreaming() {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamBuffer) WriteHeaderNow() {
+	if w.isStreaming() {
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush 开始流式输出后每次写入都会flush
+func (w *streamBuffer) Flush() {
+	if w.isStreaming() {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *streamBuffer) Written() bool {
+	if w.isStreaming() {
+		return true
+	}
+	return w.ResponseWriter.Written()
+}
+
+// Size 流式输出时为写入缓冲区的字节数
+func (w *streamBuffer) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.streaming && !w.closed {
+		return w.size
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *streamBuffer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *streamBuffer) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	if w.guard != nil {
+		w.guard.checkErr(err)
+	}
+}
+
+// run 把缓冲区中的内容写给客户端，写入失败（包括写超时）后退出，之后的Write返回该错误
+func (w *streamBuffer) run() {
+	defer close(w.done)
+	rc := http.NewResponseController(w.ResponseWriter)
+	for {
+		w.mu.Lock()
+		if w.buf.Len() == 0 {
+			closed := w.closed
+			w.mu.Unlock()
+			if closed {
+				return
+			}
+			<-w.data
+			continue
+		}
+		chunk := make([]byte, w.buf.Len())
+		copy(chunk, w.buf.Bytes())
+		w.buf.Reset()
+		w.mu.Unlock()
+
+		// 不支持写超时（如gRPC、WebSocket转发的请求）时忽略，由Write等待空间的超时兜底
+		rc.SetWriteDeadline(time.Now().Add(w.timeout))
+		_, err := w.ResponseWriter.Write(chunk)
+		if err == nil {
+			w.ResponseWriter.Flush()
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			// 一次写入超过timeout，与缓冲区满时等待超时相同处理
+			getLogger(w.c).Warn("stream client too slow, closing the stream",
+				zap.Int("pending_bytes", len(chunk)), zap.Int("stream_buffer", w.limit), zap.Duration("timeout", w.timeout))
+			w.fail(errStreamClientTooSlow)
+		} else {
+			w.fail(err)
+		}
+
+		w.mu.Lock()
+		close(w.space)
+		w.space = make(chan struct{})
+		w.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// finish 等待缓冲区中的内容写完，去掉写超时，避免影响同一个连接上之后的请求
+func (w *streamBuffer) finish() {
+	w.mu.Lock()
+	streaming := w.streaming
+	w.closed = true
+	w.mu.Unlock()
+	if !streaming {
+		return
+	}
+	notify(w.data)
+	<-w.done
+	http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Time{})
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+	"sync/atomic"
+	"time"
+)
+
+// streamDurationLimiter 限制流式响应的总时长，到达时长后取消上游请求，并丢弃之后写入的分片
+type streamDurationLimiter struct {
+	gin.ResponseWriter
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	origReq context.Context
+	expired atomic.Bool
+}
+
+// newStreamDurationLimiter 替换c.Writer和c.Request的context，需要在请求上游结束后调用stop
+func newStreamDurationLimiter(c *gin.Context, maxDuration time.Duration) *streamDurationLimiter {
+	origCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(origCtx)
+	c.Request = c.Request.WithContext(ctx)
+
+	l := &streamDurationLimiter{ResponseWriter: c.Writer, cancel: cancel, origReq: origCtx}
+	l.timer = time.AfterFunc(maxDuration, func() {
+		l.expired.Store(true)
+		cancel()
+	})
+	c.Writer = l
+	return l
+}
+
+func (l *streamDurationLimiter) Write(data []byte) (int, error) {
+	if l.expired.Load() {
+		return len(data), nil
+	}
+	return l.ResponseWriter.Write(data)
+}
+
+func (l *streamDurationLimiter) WriteString(s string) (int, error) {
+	if l.expired.Load() {
+		return len(s), nil
+	}
+	return l.ResponseWriter.WriteString(s)
+}
+
+// stop 停止计时并恢复c.Writer和c.Request，返回是否已经到达时长
+func (l *streamDurationLimiter) stop(c *gin.Context) bool {
+	l.timer.Stop()
+	l.cancel()
+	c.Writer = l.ResponseWriter
+	c.Request = c.Request.WithContext(l.origReq)
+	return l.expired.Load()
+}
+
+// sendStreamLengthFinish 到达最大时长时发送finish_reason为length的结束分片
+func sendStreamLengthFinish(c *gin.Context, clientModel string) error {
+	chunk := openai.ChatCompletionStreamResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   clientModel,
+		Choices: []openai.ChatCompletionStreamChoice{{
+			Index:        0,
+			FinishReason: openai.FinishReasonLength,
+		}},
+	}
+	respData, err := json.Marshal(&chunk)
+	if err != nil {
+		return err
+	}
+	_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
+	return err
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func loadStreamErrorTestConfig(t *testing.T, upstream func(w http.ResponseWriter, r *http.Request)) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(upstream))
+	t.Cleanup(server.Close)
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [gpt-4o]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, server.URL))
+}
+
+const streamErrorTestRequest = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+// TestMidStreamErrorFraming 输出分片之后上游返回错误时，以一个error事件加上[DONE]结束，不再输出JSON的响应体
+func TestMidStreamErrorFraming(t *testing.T) {
+	loadStreamErrorTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}` + "\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`data: {"error":{"message":"The server had an error while processing your request.","type":"server_error","code":null}}` + "\n\n"))
+	})
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", streamErrorTestRequest)
+	want := `data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}` + "\n\n" +
+		`data: {"error":{"code":null,"message":"The server had an error while processing your request.","param":null,"type":"server_error"}}` + "\n\n" +
+		"data: [DONE]\n\n"
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 once the stream started", w.Code)
+	}
+	if got := w.Body.String(); got != want {
+		t.Fatalf("body =\n%q\nwant\n%q", got, want)
+	}
+}
+
+// TestStreamErrorBeforeFirstChunk 还没有输出时出错返回普通的JSON错误，去掉text/event-stream的响应头
+func TestStreamErrorBeforeFirstChunk(t *testing.T) {
+	loadStreamErrorTestConfig(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"Invalid 'messages': empty array.","type":"invalid_request_error","param":"messages","code":"empty_array"}}`))
+	})
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", streamErrorTestRequest)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	want := `{"error":{"code":"empty_array","message":"Invalid 'messages': empty array.","param":"messages","type":"invalid_request_error"}}`
+	if got := w.Body.String(); got != want {
+		t.Fatalf("body =\n%s\nwant\n%s", got, want)
+	}
+}
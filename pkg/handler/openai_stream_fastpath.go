@@ -0,0 +1,379 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/adapter"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+var (
+	streamDataPrefix  = []byte("data:")
+	streamDeltaKey    = []byte(`"delta"`)
+	streamRoleKey     = []byte(`"role"`)
+	streamDefaultRole = []byte(`"role":"assistant"`)
+	// streamIgnoredFields data以外的SSE字段，快速路径不需要处理
+	streamIgnoredFields = [][]byte{[]byte("event:"), []byte("id:"), []byte("retry:")}
+)
+
+// handleOpenAIOpenAIRawStreamRequest 流式请求的快速路径，直接转发上游的分片，只改写model字段，
+// 避免每个分片都完整的反序列化和序列化
+func handleOpenAIOpenAIRawStreamRequest(c *gin.Context, conf openai.ClientConfig, apiKey string, ctx context.Context, req *openai.ChatCompletionRequest, clientModel string, citations *citationCollector) error {
+	req.Stream = true
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.BaseURL+"/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	httpReq.Header.Set("Cache-Control", "no-cache")
+	httpReq.Header.Set("Connection", "keep-alive")
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	if conf.OrgID != "" {
+		httpReq.Header.Set("OpenAI-Organization", conf.OrgID)
+	}
+
+	utils.SetEventStreamHeaders(c)
+	resp, err := conf.HTTPClient.Do(httpReq)
+	if err != nil {
+		getLogger(c).Error("An error occurred", zap.Error(err))
+		return fmt.Errorf("ChatCompletionStream error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return readStreamErrorResponse(resp)
+	}
+
+	encodedModel, _ := json.Marshal(clientModel)
+
+	var errBuf bytes.Buffer
+	reader := bufio.NewReader(resp.Body)
+	for {
+		rawLine, readErr := reader.ReadBytes('\n')
+		line := bytes.TrimSpace(rawLine)
+
+		if len(line) > 0 && !isIgnoredStreamLine(line) {
+			if !bytes.HasPrefix(line, streamDataPrefix) {
+				// 非data行视为上游返回的错误信息
+				errBuf.Write(line)
+			} else {
+				payload := bytes.TrimSpace(line[len(streamDataPrefix):])
+				if string(payload) == "[DONE]" {
+					return citations.sendStreamChunk(c, clientModel)
+				}
+				if bytes.HasPrefix(payload, []byte(`{"error"`)) {
+					return parseStreamError(payload)
+				}
+
+				if !c.Writer.Written() {
+					setUpstreamModelHeaderFromChunk(c, payload)
+				}
+
+				newPayload, err := rewriteStreamChunk(payload, encodedModel)
+				if err != nil {
+					getLogger(c).Error("An error occurred", zap.Error(err))
+					return err
+				}
+
+				getLogger(c).Debug("Response data", zap.ByteString("resp_data", newPayload))
+
+				if _, err := c.Writer.WriteString("data: " + string(newPayload) + "\n\n"); err != nil {
+					getLogger(c).Error("An error occurred", zap.Error(err))
+					return err
+				}
+				c.Writer.(http.Flusher).Flush()
+			}
+		}
+
+		if readErr != nil {
+			if errBuf.Len() > 0 {
+				return parseStreamError(errBuf.Bytes())
+			}
+			if readErr == io.EOF {
+				return citations.sendStreamChunk(c, clientModel)
+			}
+			return readErr
+		}
+	}
+}
+
+// isIgnoredStreamLine 冒号开头的注释行（如 : keep-alive）以及event、id等字段行按SSE的规则忽略，不当作错误信息
+func isIgnoredStreamLine(line []byte) bool {
+	if line[0] == ':' {
+		return true
+	}
+	for _, field := range streamIgnoredFields {
+		if bytes.HasPrefix(line, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// setUpstreamModelHeaderFromChunk 从改写前的分片中取出上游返回的model
+func setUpstreamModelHeaderFromChunk(c *gin.Context, payload []byte) {
+	start, end, found, ok := findTopLevelValue(payload, "model")
+	if !ok || !found {
+		return
+	}
+	var model string
+	if err := json.Unmarshal(payload[start:end], &model); err == nil {
+		utils.SetUpstreamModelHeader(c, model)
+	}
+}
+
+func readStreamErrorResponse(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var errResp openai.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != nil {
+		errResp.Error.HTTPStatusCode = resp.StatusCode
+		return fmt.Errorf("ChatCompletionStream error: %w", errResp.Error)
+	}
+	return fmt.Errorf("ChatCompletionStream error: %w", &openai.RequestError{
+		HTTPStatusCode: resp.StatusCode,
+		Err:            fmt.Errorf("status code: %d, body: %s", resp.StatusCode, string(body)),
+	})
+}
+
+func parseStreamError(data []byte) error {
+	var errResp openai.ErrorResponse
+	if err := json.Unmarshal(data, &errResp); err == nil && errResp.Error != nil {
+		return fmt.Errorf("error, %w", errResp.Error)
+	}
+	return fmt.Errorf("error, %s", string(data))
+}
+
+// rewriteStreamChunk 只改写分片中顶层的model字段，并为没有role的delta补上assistant，
+// 与CheckOpenAIStreamRespone的处理保持一致。无法按JSON结构定位时退回到完整的反序列化
+func rewriteStreamChunk(payload []byte, encodedModel []byte) ([]byte, error) {
+	start, end, found, ok := findTopLevelValue(payload, "model")
+	if !ok {
+		return rewriteStreamChunkSlow(payload, encodedModel)
+	}
+
+	var result []byte
+	switch {
+	case found && bytes.Equal(payload[start:end], encodedModel):
+		result = payload
+	case found:
+		result = make([]byte, 0, len(payload)-(end-start)+len(encodedModel))
+		result = append(result, payload[:start]...)
+		result = append(result, encodedModel...)
+		result = append(result, payload[end:]...)
+	default:
+		// 没有model字段时插入到对象的开头
+		brace := bytes.IndexByte(payload, '{')
+		result = make([]byte, 0, len(payload)+len(encodedModel)+10)
+		result = append(result, payload[:brace+1]...)
+		result = append(result, `"model":`...)
+		result = append(result, encodedModel...)
+		if payload[skipSpaces(payload, brace+1)] != '}' {
+			result = append(result, ',')
+		}
+		result = append(result, payload[brace+1:]...)
+	}
+
+	if !bytes.Contains(result, streamRoleKey) {
+		result = fillDeltaRole(result)
+	}
+
+	return result, nil
+}
+
+// rewriteStreamChunkSlow 原有的完整反序列化的处理方式
+func rewriteStreamChunkSlow(payload []byte, encodedModel []byte) ([]byte, error) {
+	var response openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, err
+	}
+	adapter.CheckOpenAIStreamRespone(&response)
+	json.Unmarshal(encodedModel, &response.Model)
+	data, err := json.Marshal(&response)
+	if err != nil {
+		return nil, err
+	}
+	return setChoicesLogprobs(data, getChoicesLogprobs(payload)), nil
+}
+
+// fillDeltaRole 为每个 "delta":{...} 补上 "role":"assistant"。
+// JSON字符串中的引号都是转义的，所以未转义的 "delta" 后跟冒号只可能是key
+func fillDeltaRole(data []byte) []byte {
+	var result []byte
+	last := 0
+	for i := 0; i < len(data); {
+		idx := bytes.Index(data[i:], streamDeltaKey)
+		if idx < 0 {
+			break
+		}
+		pos := i + idx + len(streamDeltaKey)
+		i = pos
+
+		pos = skipSpaces(data, pos)
+		if pos >= len(data) || data[pos] != ':' {
+			continue
+		}
+		pos = skipSpaces(data, pos+1)
+		if pos >= len(data) || data[pos] != '{' {
+			continue
+		}
+		pos++
+
+		result = append(result, data[last:pos]...)
+		result = append(result, streamDefaultRole...)
+		if next := skipSpaces(data, pos); next < len(data) && data[next] != '}' {
+			result = append(result, ',')
+		}
+		last = pos
+		i = pos
+	}
+
+	if result == nil {
+		return data
+	}
+	return append(result, data[last:]...)
+}
+
+// findTopLevelValue 查找JSON对象顶层key对应值的范围，ok为false表示不是合法的JSON对象
+func findTopLevelValue(data []byte, key string) (start int, end int, found bool, ok bool) {
+	ok = forEachTopLevelValue(data, func(k []byte, valStart, valEnd int) bool {
+		if string(k) == key {
+			start, end, found = valStart, valEnd, true
+			return false
+		}
+		return true
+	})
+	return start, end, found, ok
+}
+
+// forEachTopLevelValue 依次对JSON对象顶层的每个key及其值的范围调用fn，fn返回false时停止，
+// 返回false表示不是合法的JSON对象
+func forEachTopLevelValue(data []byte, fn func(key []byte, start, end int) bool) bool {
+	i := skipSpaces(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return false
+	}
+	i++
+
+	for {
+		i = skipSpaces(data, i)
+		if i >= len(data) {
+			return false
+		}
+		if data[i] == '}' {
+			return true
+		}
+		if data[i] != '"' {
+			return false
+		}
+
+		keyStart := i
+		var ok bool
+		i, ok = skipString(data, i)
+		if !ok {
+			return false
+		}
+		keyEnd := i
+
+		i = skipSpaces(data, i)
+		if i >= len(data) || data[i] != ':' {
+			return false
+		}
+		i = skipSpaces(data, i+1)
+
+		valStart := i
+		i, ok = skipValue(data, i)
+		if !ok {
+			return false
+		}
+		if !fn(data[keyStart+1:keyEnd-1], valStart, i) {
+			return true
+		}
+
+		i = skipSpaces(data, i)
+		if i >= len(data) {
+			return false
+		}
+		switch data[i] {
+		case ',':
+			i++
+		case '}':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func skipSpaces(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipString data[i]为开头的引号，返回结尾引号之后的位置
+func skipString(data []byte, i int) (int, bool) {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		}
+	}
+	return i, false
+}
+
+// skipValue 跳过一个JSON值，返回值之后的位置
+func skipValue(data []byte, i int) (int, bool) {
+	if i >= len(data) {
+		return i, false
+	}
+
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				var ok bool
+				if i, ok = skipString(data, i); !ok {
+					return i, false
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, true
+				}
+			}
+			i++
+		}
+		return i, false
+	default:
+		start := i
+		for i < len(data) && !strings.ContainsRune(",}] \t\r\n", rune(data[i])) {
+			i++
+		}
+		return i, i > start
+	}
+}
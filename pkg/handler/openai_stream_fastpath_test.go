@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindTopLevelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		key   string
+		value string
+		found bool
+		ok    bool
+	}{
+		{"string", `{"id":"1","model":"gpt-4o","object":"chunk"}`, "model", `"gpt-4o"`, true, true},
+		{"spaces", `{ "id" : "1" , "model" :  "gpt-4o" }`, "model", `"gpt-4o"`, true, true},
+		{"nested only", `{"choices":[{"model":"inner"}],"id":"1"}`, "model", "", false, true},
+		{"nested before top level", `{"choices":[{"delta":{"model":"inner"}}],"model":"outer"}`, "model", `"outer"`, true, true},
+		{"key inside string", `{"content":"\"model\":\"x\"","model":"m"}`, "model", `"m"`, true, true},
+		{"escaped quote", `{"a":"x\\\"y","model":"m"}`, "model", `"m"`, true, true},
+		{"number", `{"created":1700000000,"model":null}`, "created", `1700000000`, true, true},
+		{"null", `{"created":1700000000,"model":null}`, "model", `null`, true, true},
+		{"empty object", `{}`, "model", "", false, true},
+		{"not an object", `[1,2]`, "model", "", false, false},
+		{"truncated", `{"id":"1","model":"gpt`, "model", "", false, false},
+		{"missing colon", `{"model" "x"}`, "model", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, found, ok := findTopLevelValue([]byte(tt.data), tt.key)
+			if found != tt.found || ok != tt.ok {
+				t.Fatalf("found, ok = %v, %v, want %v, %v", found, ok, tt.found, tt.ok)
+			}
+			if found && tt.data[start:end] != tt.value {
+				t.Fatalf("value = %s, want %s", tt.data[start:end], tt.value)
+			}
+		})
+	}
+}
+
+func TestRewriteStreamChunk(t *testing.T) {
+	model, _ := json.Marshal("client-model")
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{
+			"replace model",
+			`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"upstream","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}`,
+			`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"client-model","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}]}`,
+		},
+		{
+			"same model",
+			`{"model":"client-model","choices":[{"delta":{"role":"assistant"}}]}`,
+			`{"model":"client-model","choices":[{"delta":{"role":"assistant"}}]}`,
+		},
+		{
+			"insert model",
+			`{"id":"c1","choices":[{"delta":{"role":"assistant"}}]}`,
+			`{"model":"client-model","id":"c1","choices":[{"delta":{"role":"assistant"}}]}`,
+		},
+		{
+			"insert model into empty object",
+			`{}`,
+			`{"model":"client-model"}`,
+		},
+		{
+			"fill role",
+			`{"model":"upstream","choices":[{"index":0,"delta":{"content":"hi"}},{"index":1,"delta":{}}]}`,
+			`{"model":"client-model","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}},{"index":1,"delta":{"role":"assistant"}}]}`,
+		},
+		{
+			"delta inside content",
+			`{"model":"upstream","choices":[{"delta":{"content":"\"delta\":{"}}]}`,
+			`{"model":"client-model","choices":[{"delta":{"role":"assistant","content":"\"delta\":{"}}]}`,
+		},
+		{
+			"unknown fields kept",
+			`{"model":"upstream","choices":[{"delta":{"role":"assistant","reasoning_content":"think"}}],"x_extra":{"a":[1,2]}}`,
+			`{"model":"client-model","choices":[{"delta":{"role":"assistant","reasoning_content":"think"}}],"x_extra":{"a":[1,2]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteStreamChunk([]byte(tt.payload), model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRewriteStreamChunkFallback 无法按结构定位时退回到完整的反序列化，非法的JSON返回错误
+func TestRewriteStreamChunkFallback(t *testing.T) {
+	model, _ := json.Marshal("client-model")
+	got, err := rewriteStreamChunk([]byte(`{"id":"c1","choices":[{"index":0,"delta":{"content":"hi"`), model)
+	if err == nil {
+		t.Fatalf("expected an error for invalid JSON, got %s", got)
+	}
+
+	got, err = rewriteStreamChunkSlow([]byte(`{"id":"c1","model":"upstream","choices":[{"index":0,"delta":{"content":"hi"}}]}`), model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(got, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Model != "client-model" || chunk.Choices[0].Delta.Role != openai.ChatMessageRoleAssistant || chunk.Choices[0].Delta.Content != "hi" {
+		t.Fatalf("unexpected chunk %s", got)
+	}
+}
+
+func TestIsIgnoredStreamLine(t *testing.T) {
+	for line, want := range map[string]bool{
+		": keep-alive":     true,
+		":":                true,
+		"event: message":   true,
+		"id: 42":           true,
+		"retry: 1000":      true,
+		"data: {}":         false,
+		`{"error":"x"}`:    false,
+		"upstream failure": false,
+	} {
+		if got := isIgnoredStreamLine([]byte(line)); got != want {
+			t.Errorf("isIgnoredStreamLine(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+// TestRawStreamIgnoresCommentsAndFields 上游的注释行和event、id字段行不影响转发，也不被当作错误
+func TestRawStreamIgnoresCommentsAndFields(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": keep-alive\n\n" +
+			"event: message\nid: 1\ndata: {\"id\":\"c1\",\"model\":\"up\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"a\"}}]}\n\n" +
+			"retry: 1000\n: ping\n\n" +
+			"data: {\"id\":\"c1\",\"model\":\"up\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"b\"}}]}\n\n" +
+			"data: [DONE]\n\n"))
+	}))
+	defer upstream.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	conf := openai.DefaultConfig("sk-test")
+	conf.BaseURL = upstream.URL
+	req := &openai.ChatCompletionRequest{Model: "up"}
+	if err := handleOpenAIOpenAIRawStreamRequest(c, conf, "sk-test", context.Background(), req, "client", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "data: {\"id\":\"c1\",\"model\":\"client\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"a\"}}]}\n\n" +
+		"data: {\"id\":\"c1\",\"model\":\"client\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"b\"}}]}\n\n"
+	if w.Body.String() != want {
+		t.Fatalf("body =\n%s\nwant\n%s", w.Body.String(), want)
+	}
+}
+
+// TestRawStreamNonDataLineIsError data以外的内容仍然作为上游的错误信息返回
+func TestRawStreamNonDataLineIsError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`{"error":{"message":"quota exceeded","type":"insufficient_quota"}}` + "\n"))
+	}))
+	defer upstream.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	conf := openai.DefaultConfig("sk-test")
+	conf.BaseURL = upstream.URL
+	err := handleOpenAIOpenAIRawStreamRequest(c, conf, "sk-test", context.Background(), &openai.ChatCompletionRequest{Model: "up"}, "client", nil)
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("err = %v, want the upstream error", err)
+	}
+}
+
+var benchmarkStreamChunk = []byte(`{"id":"chatcmpl-9a8b7c6d5e4f","object":"chat.completion.chunk","created":1718000000,"model":"gpt-4o-2024-05-13","system_fingerprint":"fp_abc123","choices":[{"index":0,"delta":{"content":"The quick brown fox jumps over the lazy dog."},"logprobs":null,"finish_reason":null}]}`)
+
+func BenchmarkRewriteStreamChunk(b *testing.B) {
+	model, _ := json.Marshal("gpt-4o")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := rewriteStreamChunk(benchmarkStreamChunk, model); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRewriteStreamChunkSlow(b *testing.B) {
+	model, _ := json.Marshal("gpt-4o")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := rewriteStreamChunkSlow(benchmarkStreamChunk, model); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkOpenAIStreamHandler 完整的handler流程，normalized为上游已经是OpenAI格式的分片，
+// 不需要反序列化；missing_index的分片缺少index，每个分片都退回到反序列化处理
+func BenchmarkOpenAIStreamHandler(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		chunk string
+	}{
+		{"normalized", string(benchmarkStreamChunk)},
+		{"missing_index", strings.Replace(string(benchmarkStreamChunk), `"index":0,`, "", 1)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			body := strings.Repeat("data: "+bc.chunk+"\n\n", 200) + "data: [DONE]\n\n"
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte(body))
+			}))
+			defer upstream.Close()
+			loadTestConfig(b, fmt.Sprintf(`
+services:
+    openai:
+        - models: [gpt-4o]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+			reqBody := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", reqBody); w.Code != http.StatusOK {
+					b.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"sync/atomic"
+	"time"
+)
+
+var errStreamIdleTimeout = errors.New("upstream stream idle timeout")
+
+// streamIdleLimiter 上游超过空闲时长没有返回分片时取消上游请求，空闲时长按服务上进行中的流式请求数延长
+type streamIdleLimiter struct {
+	gin.ResponseWriter
+	s         *config.ModelDetails
+	timer     *time.Timer
+	cancel    context.CancelFunc
+	origReq   context.Context
+	lastWrite atomic.Int64
+	expired   atomic.Bool
+}
+
+// getStreamIdleTimeout 按当前的并发数计算空闲时长
+func getStreamIdleTimeout(s *config.ModelDetails) time.Duration {
+	conf := s.StreamIdleTimeout
+	threshold, factor, maxTimeout := conf.LoadThreshold, conf.LoadFactor, conf.MaxTimeout
+	if threshold <= 0 {
+		threshold = config.DefaultStreamIdleLoadThreshold
+	}
+	if factor <= 0 {
+		factor = config.DefaultStreamIdleLoadFactor
+	}
+	if maxTimeout <= 0 {
+		maxTimeout = conf.Timeout * config.DefaultStreamIdleMaxTimeoutFactor
+	}
+
+	timeout := float64(conf.Timeout)
+	if over := mycommon.GetServiceStreams(s.ServiceID) - int64(threshold); over > 0 {
+		timeout *= 1 + factor*float64(over)
+	}
+	if timeout > float64(maxTimeout) {
+		timeout = float64(maxTimeout)
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+// newStreamIdleLimiter 替换c.Writer和c.Request的context，需要在请求上游结束后调用stop
+func newStreamIdleLimiter(c *gin.Context, s *config.ModelDetails) *streamIdleLimiter {
+	origCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(origCtx)
+	c.Request = c.Request.WithContext(ctx)
+
+	mycommon.AcquireServiceStream(s.ServiceID)
+	l := &streamIdleLimiter{ResponseWriter: c.Writer, s: s, cancel: cancel, origReq: origCtx}
+	l.lastWrite.Store(time.Now().UnixNano())
+	l.timer = time.AfterFunc(getStreamIdleTimeout(s), l.check)
+	c.Writer = l
+	return l
+}
+
+// check 每次写入只记录时间，到时后按最新的并发数判断是否已经空闲超时，没有超时则继续计时
+func (l *streamIdleLimiter) check() {
+	idle := time.Since(time.Unix(0, l.lastWrite.Load()))
+	timeout := getStreamIdleTimeout(l.s)
+	if idle < timeout {
+		l.timer.Reset(timeout - idle)
+		return
+	}
+	l.expired.Store(true)
+	l.cancel()
+}
+
+func (l *streamIdleLimiter) Write(data []byte) (int, error) {
+	if l.expired.Load() {
+		return len(data), nil
+	}
+	l.lastWrite.Store(time.Now().UnixNano())
+	return l.ResponseWriter.Write(data)
+}
+
+func (l *streamIdleLimiter) WriteString(s string) (int, error) {
+	if l.expired.Load() {
+		return len(s), nil
+	}
+	l.lastWrite.Store(time.Now().UnixNano())
+	return l.ResponseWriter.WriteString(s)
+}
+
+// stop 停止计时并恢复c.Writer和c.Request，返回是否已经空闲超时
+func (l *streamIdleLimiter) stop(c *gin.Context) bool {
+	l.timer.Stop()
+	l.cancel()
+	mycommon.ReleaseServiceStream(l.s.ServiceID)
+	c.Writer = l.ResponseWriter
+	c.Request = c.Request.WithContext(l.origReq)
+	return l.expired.Load()
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/utils"
+)
+
+// decideUpstreamStream 预计输出较短时不使用流式，其他情况都使用流式请求上游。
+// 转换响应格式时不保留logprobs，请求logprobs时使用客户端的请求方式
+func decideUpstreamStream(conf *config.StreamDecisionConf, req *openai.ChatCompletionRequest) bool {
+	if isLogProbsRequested(req) {
+		return req.Stream
+	}
+	if conf.BatchMaxTokens > 0 && req.MaxTokens > 0 && req.MaxTokens <= conf.BatchMaxTokens {
+		return false
+	}
+	if conf.BatchMaxPromptChars > 0 && mycommon.CountMessagesChars(req.Messages) <= conf.BatchMaxPromptChars {
+		return false
+	}
+	return true
+}
+
+// withStreamDecision 上游的请求方式与客户端不同时，暂存上游的响应并转换为客户端要求的格式
+func withStreamDecision(next func(*gin.Context, *OAIRequestParam) error, conf *config.StreamDecisionConf) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		req := oaiReqParam.chatCompletionReq
+		clientStream := req.Stream
+		upstreamStream := decideUpstreamStream(conf, req)
+		if upstreamStream == clientStream {
+			return next(c, oaiReqParam)
+		}
+
+		getLogger(c).Info("stream decision", zap.String("model", req.Model), zap.Bool("client_stream", clientStream), zap.Bool("upstream_stream", upstreamStream))
+
+		origWriter := c.Writer
+		origStreamOptions := req.StreamOptions
+		req.Stream = upstreamStream
+		if !upstreamStream {
+			req.StreamOptions = nil
+		}
+		defer func() {
+			c.Writer = origWriter
+			req.Stream = clientStream
+			req.StreamOptions = origStreamOptions
+		}()
+
+		buf := newResponseBuffer(origWriter)
+		c.Writer = buf
+		if err := next(c, oaiReqParam); err != nil {
+			return err
+		}
+		if buf.Status() != http.StatusOK {
+			return buf.flushTo(origWriter)
+		}
+
+		if upstreamStream {
+			resp := aggregateStreamResponse(buf.body.Bytes())
+			if resp.Usage.TotalTokens == 0 && len(resp.Choices) > 0 {
+				resp.Usage.PromptTokens = mycommon.EstimateTokens(joinMessagesText(req.Messages))
+				resp.Usage.CompletionTokens = mycommon.EstimateTokens(resp.Choices[0].Message.Content)
+				resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+			}
+			c.Writer = origWriter
+			utils.ClearEventStreamHeaders(c)
+			c.JSON(http.StatusOK, resp)
+			return nil
+		}
+
+		resp, ok := buf.chatCompletionResponse()
+		if !ok {
+			return buf.flushTo(origWriter)
+		}
+		includeUsage := origStreamOptions != nil && origStreamOptions.IncludeUsage
+		c.Writer = origWriter
+		return writeResponseAsStream(c, resp, includeUsage)
+	}
+}
+
+// aggregateStreamResponse 将流式分片合并为非流式响应，tool_calls按index合并参数
+func aggregateStreamResponse(data []byte) *openai.ChatCompletionResponse {
+	agg := newStreamAggregator()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		agg.addLine(scanner.Bytes())
+	}
+	return agg.response()
+}
+
+// writeResponseAsStream 将非流式响应按流式分片输出，每个choice一个内容分片和一个结束分片，[DONE]由调用方发送
+func writeResponseAsStream(c *gin.Context, resp *openai.ChatCompletionResponse, includeUsage bool) error {
+	utils.SetEventStreamHeaders(c)
+
+	var chunks []openai.ChatCompletionStreamResponse
+	newChunk := func(choices []openai.ChatCompletionStreamChoice) openai.ChatCompletionStreamResponse {
+		return openai.ChatCompletionStreamResponse{
+			ID:                resp.ID,
+			Object:            "chat.completion.chunk",
+			Created:           resp.Created,
+			Model:             resp.Model,
+			SystemFingerprint: resp.SystemFingerprint,
+			Choices:           choices,
+		}
+	}
+
+	for _, choice := range resp.Choices {
+		toolCalls := make([]openai.ToolCall, len(choice.Message.ToolCalls))
+		for i := range choice.Message.ToolCalls {
+			toolCalls[i] = choice.Message.ToolCalls[i]
+			toolIndex := i
+			toolCalls[i].Index = &toolIndex
+		}
+		chunks = append(chunks, newChunk([]openai.ChatCompletionStreamChoice{{
+			Index: choice.Index,
+			Delta: openai.ChatCompletionStreamChoiceDelta{
+				Role:         openai.ChatMessageRoleAssistant,
+				Content:      choice.Message.Content,
+				FunctionCall: choice.Message.FunctionCall,
+				ToolCalls:    toolCalls,
+			},
+		}}))
+		chunks = append(chunks, newChunk([]openai.ChatCompletionStreamChoice{{
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+		}}))
+	}
+	if includeUsage {
+		usageChunk := newChunk([]openai.ChatCompletionStreamChoice{})
+		usageChunk.Usage = &resp.Usage
+		chunks = append(chunks, usageChunk)
+	}
+
+	for i := range chunks {
+		respData, err := json.Marshal(&chunks[i])
+		if err != nil {
+			return err
+		}
+		if _, err := c.Writer.WriteString("data: " + string(respData) + "\n\n"); err != nil {
+			return err
+		}
+	}
+	c.Writer.Flush()
+	return nil
+}
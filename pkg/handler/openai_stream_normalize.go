@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// finishReasonAliases 各家服务的结束原因对应的OpenAI的finish_reason，key为小写
+var finishReasonAliases = map[string]string{
+	"stop":               "stop",
+	"end_turn":           "stop",
+	"stop_sequence":      "stop",
+	"normal":             "stop",
+	"finish":             "stop",
+	"complete":           "stop",
+	"eos":                "stop",
+	"length":             "length",
+	"max_tokens":         "length",
+	"max_length":         "length",
+	"model_length":       "length",
+	"tool_calls":         "tool_calls",
+	"tool_call":          "tool_calls",
+	"tool_use":           "tool_calls",
+	"functioncall":       "tool_calls",
+	"function_call":      "function_call",
+	"content_filter":     "content_filter",
+	"sensitive":          "content_filter",
+	"safety":             "content_filter",
+	"recitation":         "content_filter",
+	"blocklist":          "content_filter",
+	"prohibited_content": "content_filter",
+	"spii":               "content_filter",
+}
+
+// normalizeFinishReason 空的finish_reason转换为null，无法识别的结束原因按stop处理，返回是否修改
+func normalizeFinishReason(choice map[string]json.RawMessage) bool {
+	raw, exists := choice["finish_reason"]
+	if !exists {
+		return false
+	}
+	var reason string
+	if err := json.Unmarshal(raw, &reason); err != nil {
+		return false
+	}
+
+	var normalized json.RawMessage
+	if reason == "" {
+		normalized = json.RawMessage("null")
+	} else {
+		target, ok := finishReasonAliases[strings.ToLower(reason)]
+		if !ok {
+			target = "stop"
+		}
+		normalized, _ = json.Marshal(target)
+	}
+	if bytes.Equal(raw, normalized) {
+		return false
+	}
+	choice["finish_reason"] = normalized
+	return true
+}
+
+// streamUsageSplitter 客户端设置了include_usage时，按OpenAI的格式usage放在[DONE]之前单独的分片中，choices为空数组；
+// 部分服务把usage放在最后一个内容分片中，从该分片中移除，在[DONE]之前补充
+type streamUsageSplitter struct {
+	usage   json.RawMessage
+	emitted bool
+	last    map[string]json.RawMessage
+}
+
+func (u *streamUsageSplitter) transformer() streamChunkTransformer {
+	return func(chunk map[string]json.RawMessage) bool {
+		u.last = chunk
+		usage, exists := chunk["usage"]
+		if !exists || bytes.Equal(bytes.TrimSpace(usage), []byte("null")) {
+			return false
+		}
+
+		var choices []json.RawMessage
+		json.Unmarshal(chunk["choices"], &choices)
+		if len(choices) == 0 {
+			u.emitted = true
+			u.usage = nil
+			return false
+		}
+		// 每个分片都带usage时取最后一次的值
+		u.usage = usage
+		delete(chunk, "usage")
+		return true
+	}
+}
+
+// beforeDone 返回需要在[DONE]之前写出的usage分片
+func (u *streamUsageSplitter) beforeDone() []byte {
+	if u.emitted || u.usage == nil || u.last == nil {
+		return nil
+	}
+	u.emitted = true
+
+	chunk := map[string]json.RawMessage{
+		"object":  json.RawMessage(`"chat.completion.chunk"`),
+		"choices": json.RawMessage("[]"),
+		"usage":   u.usage,
+	}
+	for _, key := range []string{"id", "created", "model", "system_fingerprint"} {
+		if v, exists := u.last[key]; exists {
+			chunk[key] = v
+		}
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return append(append([]byte("data: "), data...), '\n', '\n')
+}
@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sync"
+	"time"
+)
+
+// pacedStreamWriter 按stream_pacing平滑输出流式内容，只有内容的分片先放入队列，每隔interval输出一次，
+// 其他分片（finish_reason、usage、工具调用、错误等）输出前先把队列中的内容输出完
+type pacedStreamWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	interval time.Duration
+	maxLag   time.Duration
+
+	mu           sync.Mutex
+	pending      bytes.Buffer
+	queue        []rune
+	step         int
+	template     map[string]json.RawMessage
+	choice       map[string]json.RawMessage
+	role         json.RawMessage
+	roleSent     bool
+	swallowBlank bool
+	timer        *time.Timer
+	lastEmit     time.Time
+	closed       bool
+	err          error
+}
+
+func newPacedStreamWriter(c *gin.Context, conf *config.StreamPacingConf) *pacedStreamWriter {
+	interval, maxLag := conf.Interval, conf.MaxLag
+	if interval <= 0 {
+		interval = config.DefaultStreamPacingInterval
+	}
+	if maxLag <= 0 {
+		maxLag = config.DefaultStreamPacingMaxLag
+	}
+	if maxLag < interval {
+		maxLag = interval
+	}
+	return &pacedStreamWriter{
+		ResponseWriter: c.Writer,
+		ctx:            c.Request.Context(),
+		interval:       time.Duration(interval) * time.Millisecond,
+		maxLag:         time.Duration(maxLag) * time.Millisecond,
+	}
+}
+
+func (w *pacedStreamWriter) Write(data []byte) (int, error) {
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := make([]byte, idx+1)
+		w.pending.Read(line)
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *pacedStreamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *pacedStreamWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ResponseWriter.Flush()
+}
+
+func (w *pacedStreamWriter) writeLine(line []byte) error {
+	if len(bytes.TrimSpace(line)) == 0 {
+		w.mu.Lock()
+		swallow := w.swallowBlank
+		w.swallowBlank = false
+		w.mu.Unlock()
+		if swallow {
+			return nil
+		}
+	} else if chunk, choice, delta := parsePlainContentChunk(line); chunk != nil {
+		w.enqueue(chunk, choice, delta)
+		return nil
+	}
+
+	w.drain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	_, err := w.ResponseWriter.Write(line)
+	return err
+}
+
+// parsePlainContentChunk 判断是否是只有一个choice、delta只有content（和role）且没有结束的分片
+func parsePlainContentChunk(line []byte) (map[string]json.RawMessage, map[string]json.RawMessage, map[string]json.RawMessage) {
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return nil, nil, nil
+	}
+	payload := bytes.TrimSpace(line[len("data:"):])
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil, nil, nil
+	}
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil, nil, nil
+	}
+	if _, isErr := chunk["error"]; isErr || !isJSONNull(chunk["usage"]) {
+		return nil, nil, nil
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(chunk["choices"], &choices); err != nil || len(choices) != 1 {
+		return nil, nil, nil
+	}
+	choice := choices[0]
+	for key, value := range choice {
+		switch key {
+		case "index", "delta":
+		case "finish_reason", "logprobs":
+			if !isJSONNull(value) {
+				return nil, nil, nil
+			}
+		default:
+			return nil, nil, nil
+		}
+	}
+	var delta map[string]json.RawMessage
+	if err := json.Unmarshal(choice["delta"], &delta); err != nil {
+		return nil, nil, nil
+	}
+	for key := range delta {
+		if key != "content" && key != "role" {
+			return nil, nil, nil
+		}
+	}
+	var content string
+	if err := json.Unmarshal(delta["content"], &content); err != nil || content == "" {
+		return nil, nil, nil
+	}
+	return chunk, choice, delta
+}
+
+func isJSONNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(bytes.TrimSpace(raw)) == "null"
+}
+
+// enqueue 内容放入队列，按队列长度重新计算每次输出的字数，距离上次输出超过interval时立即输出
+func (w *pacedStreamWriter) enqueue(chunk, choice, delta map[string]json.RawMessage) {
+	var content string
+	json.Unmarshal(delta["content"], &content)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.swallowBlank = true
+	w.template, w.choice = chunk, choice
+	if role, exists := delta["role"]; exists && !w.roleSent {
+		w.role = role
+	}
+	w.queue = append(w.queue, []rune(content)...)
+	ticks := int(w.maxLag / w.interval)
+	w.step = (len(w.queue) + ticks - 1) / ticks
+
+	if wait := w.interval - time.Since(w.lastEmit); wait <= 0 {
+		w.emitLocked()
+		w.scheduleLocked(w.interval)
+	} else {
+		w.scheduleLocked(wait)
+	}
+}
+
+func (w *pacedStreamWriter) scheduleLocked(d time.Duration) {
+	if len(w.queue) == 0 || w.closed {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(d, w.tick)
+	} else {
+		w.timer.Reset(d)
+	}
+}
+
+func (w *pacedStreamWriter) tick() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.emitLocked()
+	w.scheduleLocked(w.interval)
+}
+
+// emitLocked 从队列中取出step个字作为一个分片输出，客户端断开或写入失败后丢弃队列
+func (w *pacedStreamWriter) emitLocked() {
+	if len(w.queue) == 0 {
+		return
+	}
+	if w.err != nil || w.ctx.Err() != nil {
+		w.queue = nil
+		return
+	}
+	n := w.step
+	if n <= 0 || n > len(w.queue) {
+		n = len(w.queue)
+	}
+	piece := string(w.queue[:n])
+	w.queue = w.queue[n:]
+
+	delta := map[string]json.RawMessage{}
+	delta["content"], _ = json.Marshal(piece)
+	if w.role != nil {
+		delta["role"] = w.role
+		w.role = nil
+		w.roleSent = true
+	}
+	choice := make(map[string]json.RawMessage, len(w.choice))
+	for key, value := range w.choice {
+		choice[key] = value
+	}
+	choice["delta"], _ = json.Marshal(delta)
+	chunk := make(map[string]json.RawMessage, len(w.template))
+	for key, value := range w.template {
+		chunk[key] = value
+	}
+	chunk["choices"], _ = json.Marshal([]map[string]json.RawMessage{choice})
+	payload, err := json.Marshal(chunk)
+	if err != nil {
+		mylog.Logger.Error("marshal paced stream chunk failed", zap.Error(err))
+		w.queue = nil
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	buf.Write(payload)
+	buf.WriteString("\n\n")
+	if _, err = w.ResponseWriter.Write(buf.Bytes()); err != nil {
+		w.err = err
+		w.queue = nil
+		return
+	}
+	w.ResponseWriter.Flush()
+	w.lastEmit = time.Now()
+}
+
+// drain 按interval把队列中的内容输出完，在输出其他分片和请求结束前调用
+func (w *pacedStreamWriter) drain() {
+	for {
+		w.mu.Lock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		if w.ctx.Err() != nil {
+			w.queue = nil
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		if wait := w.interval - time.Since(w.lastEmit); wait > 0 {
+			w.mu.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-w.ctx.Done():
+			}
+			continue
+		}
+		w.emitLocked()
+		w.mu.Unlock()
+	}
+}
+
+// finish 输出队列中的内容和剩余不完整的行，之后不再由计时器写入
+func (w *pacedStreamWriter) finish() {
+	w.drain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.pending.Len() > 0 && w.err == nil {
+		w.ResponseWriter.Write(w.pending.Bytes())
+		w.pending.Reset()
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mymoderation"
+	"simple-one-api/pkg/myplugin"
+	"strings"
+)
+
+// streamAggregator 逐个分片累加流式响应，content按choice拼接，function_call和tool_calls按index拼接参数
+type streamAggregator struct {
+	resp     openai.ChatCompletionResponse
+	contents map[int]*strings.Builder
+	indexes  []int
+	choices  map[int]*openai.ChatCompletionChoice
+	chunks   int
+}
+
+func newStreamAggregator() *streamAggregator {
+	return &streamAggregator{
+		resp:     openai.ChatCompletionResponse{Object: "chat.completion"},
+		contents: make(map[int]*strings.Builder),
+		choices:  make(map[int]*openai.ChatCompletionChoice),
+	}
+}
+
+// addLine 解析一行SSE，不是data行、[DONE]和无法解析的分片忽略
+func (a *streamAggregator) addLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	payload := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if len(payload) == 0 || string(payload) == "[DONE]" {
+		return
+	}
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return
+	}
+	a.add(&chunk)
+}
+
+func (a *streamAggregator) add(chunk *openai.ChatCompletionStreamResponse) {
+	a.chunks++
+	resp := &a.resp
+	if resp.ID == "" {
+		resp.ID = chunk.ID
+	}
+	if resp.Created == 0 {
+		resp.Created = chunk.Created
+	}
+	if chunk.Model != "" {
+		resp.Model = chunk.Model
+	}
+	if chunk.SystemFingerprint != "" {
+		resp.SystemFingerprint = chunk.SystemFingerprint
+	}
+	// 兼容部分服务在每个分片中都返回usage的情况，取最后一次的值
+	if chunk.Usage != nil {
+		resp.Usage = *chunk.Usage
+	}
+
+	for _, sc := range chunk.Choices {
+		choice, exists := a.choices[sc.Index]
+		if !exists {
+			choice = &openai.ChatCompletionChoice{Index: sc.Index, Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}}
+			a.choices[sc.Index] = choice
+			a.contents[sc.Index] = &strings.Builder{}
+			a.indexes = append(a.indexes, sc.Index)
+		}
+		a.contents[sc.Index].WriteString(sc.Delta.Content)
+		if sc.Delta.Role != "" {
+			choice.Message.Role = sc.Delta.Role
+		}
+		if sc.FinishReason != "" {
+			choice.FinishReason = sc.FinishReason
+		}
+		if sc.Delta.FunctionCall != nil {
+			if choice.Message.FunctionCall == nil {
+				choice.Message.FunctionCall = &openai.FunctionCall{}
+			}
+			choice.Message.FunctionCall.Name += sc.Delta.FunctionCall.Name
+			choice.Message.FunctionCall.Arguments += sc.Delta.FunctionCall.Arguments
+		}
+		for i, tc := range sc.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			for len(choice.Message.ToolCalls) <= toolIndex {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+			}
+			toolCall := &choice.Message.ToolCalls[toolIndex]
+			if tc.ID != "" {
+				toolCall.ID = tc.ID
+			}
+			if tc.Type != "" {
+				toolCall.Type = tc.Type
+			}
+			toolCall.Function.Name += tc.Function.Name
+			toolCall.Function.Arguments += tc.Function.Arguments
+		}
+	}
+}
+
+// response 返回目前为止拼接的非流式响应，choices按第一次出现的顺序排列
+func (a *streamAggregator) response() *openai.ChatCompletionResponse {
+	resp := a.resp
+	resp.Choices = make([]openai.ChatCompletionChoice, 0, len(a.indexes))
+	for _, index := range a.indexes {
+		choice := *a.choices[index]
+		choice.Message.Content = a.contents[index].String()
+		resp.Choices = append(resp.Choices, choice)
+	}
+	return &resp
+}
+
+// isStreamTranscriptEnabled 流式请求开启stream_transcript或者有插件注册了流式响应结束的钩子时拼接完整的回答
+func isStreamTranscriptEnabled(oaiReq *openai.ChatCompletionRequest) bool {
+	return oaiReq.Stream && (config.GetConf().StreamTranscript.Enable || myplugin.HasStreamCompleteHooks())
+}
+
+// finishStreamTranscript 流式响应结束后输出拼接结果的日志、审核完整的回答，并交给插件的钩子
+func finishStreamTranscript(c *gin.Context, hc *myplugin.HookContext, model string, recorder *responseRecorder) {
+	soaConf := config.GetConf()
+	if recorder.transcript == nil || recorder.Status() != http.StatusOK || recorder.transcript.chunks == 0 {
+		return
+	}
+	conf := &soaConf.StreamTranscript
+	resp := recorder.transcriptResponse()
+
+	if conf.Enable && conf.Log {
+		logStreamTranscript(c, conf, model, resp, recorder.transcript.chunks)
+	}
+	// moderation.output开启时流式回答已经分段审核过，不再重复审核
+	if moderation := &soaConf.Moderation; conf.Enable && conf.Moderate && !moderation.Output && isModerationModel(moderation, model) {
+		ctx := context.WithoutCancel(c.Request.Context())
+		for _, choice := range resp.Choices {
+			if choice.Message.Content == "" {
+				continue
+			}
+			res := mymoderation.Moderate(ctx, moderation, mymoderation.StageOutput, choice.Message.Content)
+			recordModerationViolations(c, mymoderation.StageOutput, model, res)
+		}
+	}
+	if myplugin.HasStreamCompleteHooks() {
+		myplugin.RunStreamCompleteHooks(hc, resp)
+	}
+}
+
+// logStreamTranscript 每个choice输出一条拼接后的日志，代替逐个分片的日志，content按max_chars截断并脱敏
+func logStreamTranscript(c *gin.Context, conf *config.StreamTranscriptConf, model string, resp *openai.ChatCompletionResponse, chunks int) {
+	maxChars := conf.MaxChars
+	if maxChars <= 0 {
+		maxChars = config.DefaultStreamTranscriptMaxChars
+	}
+	for _, choice := range resp.Choices {
+		content := choice.Message.Content
+		truncated := false
+		if runes := []rune(content); len(runes) > maxChars {
+			content = string(runes[:maxChars])
+			truncated = true
+		}
+		getLogger(c).Info("stream transcript",
+			zap.String("model", model),
+			zap.String("id", resp.ID),
+			zap.Int("index", choice.Index),
+			zap.String("finish_reason", string(choice.FinishReason)),
+			zap.String("content", mycommon.RedactSensitiveText(content)),
+			zap.Bool("truncated", truncated),
+			zap.Int("tool_calls", len(choice.Message.ToolCalls)),
+			zap.Int("chunks", chunks),
+			zap.Int("prompt_tokens", resp.Usage.PromptTokens),
+			zap.Int("completion_tokens", resp.Usage.CompletionTokens))
+	}
+}
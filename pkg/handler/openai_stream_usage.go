@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/mycommon"
+	"strings"
+	"time"
+)
+
+// streamUsageEstimator 记录流式响应的内容，上游没有返回usage时在[DONE]之前补充一个估算的usage分片
+type streamUsageEstimator struct {
+	seen       bool
+	id         string
+	created    int64
+	completion strings.Builder
+}
+
+func isStreamUsageRequested(req *openai.ChatCompletionRequest) bool {
+	return req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+}
+
+func (e *streamUsageEstimator) transformer() streamChunkTransformer {
+	return func(chunk map[string]json.RawMessage) bool {
+		if usage, exists := chunk["usage"]; exists && !bytes.Equal(bytes.TrimSpace(usage), []byte("null")) {
+			e.seen = true
+		}
+		if e.id == "" {
+			json.Unmarshal(chunk["id"], &e.id)
+		}
+		if e.created == 0 {
+			json.Unmarshal(chunk["created"], &e.created)
+		}
+
+		var choices []openai.ChatCompletionStreamChoice
+		if err := json.Unmarshal(chunk["choices"], &choices); err == nil {
+			for _, choice := range choices {
+				e.completion.WriteString(choice.Delta.Content)
+				if choice.Delta.FunctionCall != nil {
+					e.completion.WriteString(choice.Delta.FunctionCall.Name)
+					e.completion.WriteString(choice.Delta.FunctionCall.Arguments)
+				}
+				for _, tc := range choice.Delta.ToolCalls {
+					e.completion.WriteString(tc.Function.Name)
+					e.completion.WriteString(tc.Function.Arguments)
+				}
+			}
+		}
+		return false
+	}
+}
+
+// writeEstimatedUsage 上游已经返回usage时不做处理，按OpenAI的格式usage分片的choices为空数组
+func (e *streamUsageEstimator) writeEstimatedUsage(c *gin.Context, req *openai.ChatCompletionRequest, clientModel string) {
+	if e.seen {
+		return
+	}
+
+	usage := openai.Usage{
+		PromptTokens:     mycommon.EstimateTokens(joinMessagesText(req.Messages)),
+		CompletionTokens: mycommon.EstimateTokens(e.completion.String()),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	if e.created == 0 {
+		e.created = time.Now().Unix()
+	}
+	chunk := openai.ChatCompletionStreamResponse{
+		ID:      e.id,
+		Object:  "chat.completion.chunk",
+		Created: e.created,
+		Model:   clientModel,
+		Choices: []openai.ChatCompletionStreamChoice{},
+		Usage:   &usage,
+	}
+	data, err := json.Marshal(&chunk)
+	if err != nil {
+		return
+	}
+
+	getLogger(c).Info("stream usage estimated", zap.String("model", req.Model),
+		zap.Int("prompt_tokens", usage.PromptTokens), zap.Int("completion_tokens", usage.CompletionTokens))
+	c.Writer.WriteString("data: " + string(data) + "\n\n")
+}
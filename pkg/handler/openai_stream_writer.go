@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"time"
+)
+
+// streamChunkTransformer 处理一个流式分片，返回是否修改了分片
+type streamChunkTransformer func(chunk map[string]json.RawMessage) bool
+
+// streamWriter 按行拦截写给客户端的SSE数据，对每个 "data: {...}" 分片执行transformers
+type streamWriter struct {
+	gin.ResponseWriter
+	pending      bytes.Buffer
+	transformers []streamChunkTransformer
+	// identity 不为nil时统一分片的id、created等字段，没有其他transformers时直接改写字节，不做反序列化
+	identity *chunkIdentity
+
+	// trackDone 开启后只输出第一个[DONE]，写出[DONE]之前先写出beforeDone返回的内容
+	trackDone  bool
+	done       bool
+	beforeDone func() []byte
+}
+
+func newStreamWriter(w gin.ResponseWriter, transformers ...streamChunkTransformer) *streamWriter {
+	return &streamWriter{ResponseWriter: w, transformers: transformers}
+}
+
+// newIdentityStreamWriter 创建统一分片id、created、index和finish_reason的streamWriter
+func newIdentityStreamWriter(w gin.ResponseWriter, transformers ...streamChunkTransformer) *streamWriter {
+	sw := newStreamWriter(w, transformers...)
+	sw.identity = &chunkIdentity{}
+	return sw
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	w.pending.Write(data)
+	for {
+		idx := bytes.IndexByte(w.pending.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := make([]byte, idx+1)
+		w.pending.Read(line)
+		if _, err := w.ResponseWriter.Write(w.transformLine(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *streamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// finish 输出剩余不完整的行
+func (w *streamWriter) finish() {
+	if w.pending.Len() > 0 {
+		w.ResponseWriter.Write(w.transformLine(w.pending.Bytes()))
+		w.pending.Reset()
+	}
+}
+
+// ensureDone 输出剩余的内容，SSE响应没有以[DONE]结束时补充，客户端已经断开时不处理
+func (w *streamWriter) ensureDone(c *gin.Context) {
+	w.finish()
+	if w.done || !w.Written() || c.Request.Context().Err() != nil ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	w.WriteString("data: [DONE]\n\n")
+	w.Flush()
+}
+
+func isDoneLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("data:")) && string(bytes.TrimSpace(line[len("data:"):])) == "[DONE]"
+}
+
+func (w *streamWriter) transformLine(line []byte) []byte {
+	if w.trackDone && isDoneLine(line) {
+		if w.done {
+			return nil
+		}
+		w.done = true
+		if w.beforeDone != nil {
+			if extra := w.beforeDone(); len(extra) > 0 {
+				return append(extra, line...)
+			}
+		}
+		return line
+	}
+	if (len(w.transformers) == 0 && w.identity == nil) || !bytes.HasPrefix(line, []byte("data:")) {
+		return line
+	}
+
+	payload := bytes.TrimSpace(line[len("data:"):])
+	if len(payload) == 0 || payload[0] != '{' {
+		return line
+	}
+
+	if w.identity != nil && len(w.transformers) == 0 {
+		if newPayload, modified, ok := w.identity.rewrite(payload); ok {
+			if !modified {
+				return line
+			}
+			return buildStreamLine(line, newPayload)
+		}
+	}
+
+	var chunk map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return line
+	}
+	// 错误信息不做处理
+	if _, isErr := chunk["error"]; isErr {
+		return line
+	}
+
+	modified := w.identity != nil && w.identity.transform(chunk)
+	for _, t := range w.transformers {
+		if t(chunk) {
+			modified = true
+		}
+	}
+	if !modified {
+		return line
+	}
+
+	newPayload, err := json.Marshal(chunk)
+	if err != nil {
+		mylog.Logger.Error("marshal stream chunk failed", zap.Error(err))
+		return line
+	}
+	return buildStreamLine(line, newPayload)
+}
+
+// buildStreamLine 用新的分片替换line中的data，保留原来的换行
+func buildStreamLine(line []byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	buf.Write(payload)
+	buf.Write(line[len(line)-trailingNewlineLen(line):])
+	return buf.Bytes()
+}
+
+func trailingNewlineLen(line []byte) int {
+	n := 0
+	for i := len(line) - 1; i >= 0 && (line[i] == '\n' || line[i] == '\r'); i-- {
+		n++
+	}
+	return n
+}
+
+// chunkIdentity 保证同一个响应的所有分片id、created一致，choices的index连续，finish_reason使用OpenAI的取值
+type chunkIdentity struct {
+	id      json.RawMessage
+	created json.RawMessage
+}
+
+// pin 使用第一个分片的id和created，上游没有返回时生成
+func (ci *chunkIdentity) pin(rawID, rawCreated []byte) {
+	if ci.id == nil {
+		var upstreamID string
+		if err := json.Unmarshal(rawID, &upstreamID); err == nil && upstreamID != "" {
+			ci.id = append(json.RawMessage(nil), rawID...)
+		} else {
+			ci.id, _ = json.Marshal("chatcmpl-" + uuid.New().String())
+		}
+	}
+	if ci.created == nil {
+		var upstreamCreated int64
+		if err := json.Unmarshal(rawCreated, &upstreamCreated); err == nil && upstreamCreated > 0 {
+			ci.created = append(json.RawMessage(nil), rawCreated...)
+		} else {
+			ci.created, _ = json.Marshal(time.Now().Unix())
+		}
+	}
+}
+
+func (ci *chunkIdentity) transform(chunk map[string]json.RawMessage) bool {
+	modified := false
+
+	ci.pin(chunk["id"], chunk["created"])
+	if !bytes.Equal(chunk["id"], ci.id) {
+		chunk["id"] = ci.id
+		modified = true
+	}
+	if !bytes.Equal(chunk["created"], ci.created) {
+		chunk["created"] = ci.created
+		modified = true
+	}
+
+	if _, exists := chunk["object"]; !exists {
+		chunk["object"] = json.RawMessage(`"chat.completion.chunk"`)
+		modified = true
+	}
+
+	if rawChoices, exists := chunk["choices"]; exists {
+		var choices []map[string]json.RawMessage
+		if err := json.Unmarshal(rawChoices, &choices); err == nil {
+			choicesModified := false
+			for i := range choices {
+				if _, hasIndex := choices[i]["index"]; !hasIndex {
+					choices[i]["index"], _ = json.Marshal(i)
+					choicesModified = true
+				}
+				if normalizeFinishReason(choices[i]) {
+					choicesModified = true
+				}
+			}
+			if choicesModified {
+				chunk["choices"], _ = json.Marshal(choices)
+				modified = true
+			}
+		}
+	}
+
+	return modified
+}
+
+// rewrite 与transform的处理相同，只改写顶层的id、created和object，不做反序列化。
+// choices需要修改或者无法按JSON结构定位时ok为false，由调用方使用transform处理
+func (ci *chunkIdentity) rewrite(payload []byte) (result []byte, modified bool, ok bool) {
+	idStart, idEnd, createdStart, createdEnd := -1, -1, -1, -1
+	hasObject, hasError, empty := false, false, true
+	choicesOK := true
+	valid := forEachTopLevelValue(payload, func(key []byte, start, end int) bool {
+		empty = false
+		switch string(key) {
+		case "id":
+			idStart, idEnd = start, end
+		case "created":
+			createdStart, createdEnd = start, end
+		case "object":
+			hasObject = true
+		case "choices":
+			choicesOK = isChoicesNormalized(payload[start:end])
+		case "error":
+			hasError = true
+		}
+		return true
+	})
+	if !valid || !choicesOK {
+		return nil, false, false
+	}
+	// 错误信息不做处理
+	if hasError {
+		return payload, false, true
+	}
+
+	var rawID, rawCreated []byte
+	if idStart >= 0 {
+		rawID = payload[idStart:idEnd]
+	}
+	if createdStart >= 0 {
+		rawCreated = payload[createdStart:createdEnd]
+	}
+	ci.pin(rawID, rawCreated)
+
+	var inserted [][]byte
+	type byteEdit struct {
+		start, end int
+		data       []byte
+	}
+	var edits []byteEdit
+	if idStart < 0 {
+		inserted = append(inserted, append([]byte(`"id":`), ci.id...))
+	} else if !bytes.Equal(rawID, ci.id) {
+		edits = append(edits, byteEdit{idStart, idEnd, ci.id})
+	}
+	if createdStart < 0 {
+		inserted = append(inserted, append([]byte(`"created":`), ci.created...))
+	} else if !bytes.Equal(rawCreated, ci.created) {
+		edits = append(edits, byteEdit{createdStart, createdEnd, ci.created})
+	}
+	if !hasObject {
+		inserted = append(inserted, []byte(`"object":"chat.completion.chunk"`))
+	}
+	if len(inserted) == 0 && len(edits) == 0 {
+		return payload, false, true
+	}
+	if len(edits) == 2 && edits[1].start < edits[0].start {
+		edits[0], edits[1] = edits[1], edits[0]
+	}
+
+	// 缺少的字段插入到对象的开头
+	brace := skipSpaces(payload, 0) + 1
+	result = make([]byte, 0, len(payload)+96)
+	result = append(result, payload[:brace]...)
+	for i, field := range inserted {
+		if i > 0 {
+			result = append(result, ',')
+		}
+		result = append(result, field...)
+	}
+	if len(inserted) > 0 && !empty {
+		result = append(result, ',')
+	}
+	last := brace
+	for _, e := range edits {
+		result = append(result, payload[last:e.start]...)
+		result = append(result, e.data...)
+		last = e.end
+	}
+	result = append(result, payload[last:]...)
+	return result, true, true
+}
+
+// isChoicesNormalized choices的每一项都有index，finish_reason已经是OpenAI的取值时返回true
+func isChoicesNormalized(data []byte) bool {
+	if string(data) == "null" {
+		return true
+	}
+	if len(data) == 0 || data[0] != '[' {
+		return false
+	}
+	i := skipSpaces(data, 1)
+	if i < len(data) && data[i] == ']' {
+		return true
+	}
+	for {
+		if i >= len(data) || data[i] != '{' {
+			return false
+		}
+		end, ok := skipValue(data, i)
+		if !ok || !isChoiceNormalized(data[i:end]) {
+			return false
+		}
+		i = skipSpaces(data, end)
+		if i >= len(data) {
+			return false
+		}
+		switch data[i] {
+		case ',':
+			i = skipSpaces(data, i+1)
+		case ']':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func isChoiceNormalized(choice []byte) bool {
+	hasIndex, normalized := false, true
+	valid := forEachTopLevelValue(choice, func(key []byte, start, end int) bool {
+		switch string(key) {
+		case "index":
+			hasIndex = true
+		case "finish_reason":
+			if raw := choice[start:end]; string(raw) != "null" {
+				normalized = !normalizeFinishReason(map[string]json.RawMessage{"finish_reason": raw})
+			}
+		}
+		return true
+	})
+	return valid && hasIndex && normalized
+}
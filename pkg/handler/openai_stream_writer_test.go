@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testStreamChunk struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Choices []struct {
+		Index        *int    `json:"index"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+func parseTestStream(t *testing.T, body string) []testStreamChunk {
+	t.Helper()
+	var chunks []testStreamChunk
+	for _, line := range strings.Split(body, "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk testStreamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("unmarshal %s: %v", payload, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestChunkIdentityTransformer(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	sw := newIdentityStreamWriter(c.Writer)
+
+	// 不同的id、缺少created和index，分片被拆成多次写入
+	sw.WriteString(`data: {"id":"up-1","created":1700000000,"choices":[{"delta":{"content":"a"}}]}` + "\n\n")
+	sw.WriteString(`data: {"id":"up-2","choices":[{"delta":{"con`)
+	sw.WriteString(`tent":"b"}},{"delta":{"content":"c"}}]}` + "\n\n")
+	sw.WriteString(`data: {"id":"","created":0,"choices":[{"index":0,"delta":{},"finish_reason":"COMPLETE"}]}` + "\n\n")
+	sw.WriteString("data: [DONE]\n\n")
+	sw.finish()
+
+	chunks := parseTestStream(t, w.Body.String())
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, body = %s", len(chunks), w.Body.String())
+	}
+	for i, chunk := range chunks {
+		if chunk.ID != "up-1" || chunk.Created != 1700000000 || chunk.Object != "chat.completion.chunk" {
+			t.Errorf("chunk %d: id %q created %d object %q", i, chunk.ID, chunk.Created, chunk.Object)
+		}
+		for j, choice := range chunk.Choices {
+			if choice.Index == nil || *choice.Index != j {
+				t.Errorf("chunk %d choice %d: index %v", i, j, choice.Index)
+			}
+		}
+	}
+	if reason := chunks[2].Choices[0].FinishReason; reason == nil || *reason != "stop" {
+		t.Errorf("finish_reason = %v, want stop", reason)
+	}
+	if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("body does not end with [DONE]: %q", w.Body.String())
+	}
+}
+
+// TestChunkIdentityTransformerGeneratesID 上游没有id和created时生成一次，之后的分片保持一致
+func TestChunkIdentityTransformerGeneratesID(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	sw := newIdentityStreamWriter(c.Writer)
+	for i := 0; i < 3; i++ {
+		sw.WriteString(`data: {"choices":[{"index":0,"delta":{"content":"x"}}]}` + "\n\n")
+	}
+	sw.finish()
+
+	chunks := parseTestStream(t, w.Body.String())
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks", len(chunks))
+	}
+	if !strings.HasPrefix(chunks[0].ID, "chatcmpl-") || chunks[0].Created == 0 {
+		t.Fatalf("first chunk: id %q created %d", chunks[0].ID, chunks[0].Created)
+	}
+	for _, chunk := range chunks[1:] {
+		if chunk.ID != chunks[0].ID || chunk.Created != chunks[0].Created {
+			t.Errorf("chunk id %q created %d, want %q %d", chunk.ID, chunk.Created, chunks[0].ID, chunks[0].Created)
+		}
+	}
+}
+
+// TestStreamWriterKeepsErrorsAndComments 错误分片、注释行和非JSON的内容原样输出
+func TestStreamWriterKeepsErrorsAndComments(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	sw := newIdentityStreamWriter(c.Writer)
+	input := ": keep-alive\n\n" +
+		`data: {"error":{"message":"boom"}}` + "\n\n" +
+		"data: not json\n\n" +
+		"data: [DONE]\n\n"
+	sw.WriteString(input)
+	sw.finish()
+	if w.Body.String() != input {
+		t.Fatalf("body = %q, want %q", w.Body.String(), input)
+	}
+}
+
+// TestChunkIdentityRewriteMatchesTransform 直接改写字节的结果与反序列化的处理一致
+func TestChunkIdentityRewriteMatchesTransform(t *testing.T) {
+	first := `{"id":"up-1","object":"chat.completion.chunk","created":1700000000,"choices":[{"index":0,"delta":{"content":"a"},"finish_reason":null}]}`
+	cases := []struct {
+		name    string
+		payload string
+		ok      bool
+	}{
+		{"unchanged", `{"id":"up-1","object":"chat.completion.chunk","created":1700000000,"choices":[{"index":0,"delta":{"content":"b"},"finish_reason":null}]}`, true},
+		{"different id and created", `{"id":"up-2","object":"chat.completion.chunk","created":1700000001,"choices":[{"index":0,"delta":{}}]}`, true},
+		{"missing fields", `{"choices":[{"index":0,"delta":{},"finish_reason":"stop"},{"index":1,"delta":{}}]}`, true},
+		{"empty object", `{}`, true},
+		{"missing index", `{"id":"up-1","choices":[{"delta":{}}]}`, false},
+		{"finish_reason alias", `{"id":"up-1","choices":[{"index":0,"finish_reason":"COMPLETE"}]}`, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			byBytes, byMap := &chunkIdentity{}, &chunkIdentity{}
+			byBytes.rewrite([]byte(first))
+			var firstChunk map[string]json.RawMessage
+			json.Unmarshal([]byte(first), &firstChunk)
+			byMap.transform(firstChunk)
+
+			result, _, ok := byBytes.rewrite([]byte(tc.payload))
+			if ok != tc.ok {
+				t.Fatalf("ok = %v, want %v", ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			var got, want map[string]json.RawMessage
+			if err := json.Unmarshal(result, &got); err != nil {
+				t.Fatalf("rewrite produced invalid JSON %s: %v", result, err)
+			}
+			json.Unmarshal([]byte(tc.payload), &want)
+			byMap.transform(want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Fatalf("rewrite = %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
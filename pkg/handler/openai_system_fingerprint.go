@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"simple-one-api/pkg/config"
+	"sync"
+)
+
+var syntheticFingerprints sync.Map
+
+// getSyntheticFingerprint 根据服务、模型和配置生成稳定的指纹，凭证不参与计算，更换key不会改变指纹
+func getSyntheticFingerprint(s *config.ModelDetails, model string) string {
+	cacheKey := s.ServiceID + "_" + model
+	if fp, ok := syntheticFingerprints.Load(cacheKey); ok {
+		return fp.(string)
+	}
+
+	serviceModel := s.ServiceModel
+	serviceModel.Credentials = nil
+	serviceModel.CredentialList = nil
+	confData, _ := json.Marshal(serviceModel)
+
+	h := sha256.New()
+	h.Write([]byte(s.ServiceName + "\n" + model + "\n"))
+	h.Write(confData)
+	fp := "fp_" + hex.EncodeToString(h.Sum(nil))[:10]
+
+	syntheticFingerprints.Store(cacheKey, fp)
+	return fp
+}
+
+// newSystemFingerprintTransformer 上游没有返回system_fingerprint时填入生成的指纹，有则原样保留
+func newSystemFingerprintTransformer(fp string) streamChunkTransformer {
+	encoded, _ := json.Marshal(fp)
+	return func(chunk map[string]json.RawMessage) bool {
+		var upstream string
+		if err := json.Unmarshal(chunk["system_fingerprint"], &upstream); err == nil && upstream != "" {
+			return false
+		}
+		chunk["system_fingerprint"] = encoded
+		return true
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"simple-one-api/pkg/mycomdef"
+	"strconv"
+	"time"
+)
+
+// timingHeaderWriter 在响应头发送前写入耗时信息，流式请求中上游耗时为首个分片的耗时
+type timingHeaderWriter struct {
+	gin.ResponseWriter
+	trace   *requestTrace
+	written bool
+}
+
+func newTimingHeaderWriter(w gin.ResponseWriter, trace *requestTrace) *timingHeaderWriter {
+	return &timingHeaderWriter{ResponseWriter: w, trace: trace}
+}
+
+func (w *timingHeaderWriter) setTimingHeaders() {
+	if w.written {
+		return
+	}
+	w.written = true
+
+	var upstream time.Duration
+	if !w.trace.UpstreamStart.IsZero() {
+		upstream = time.Since(w.trace.UpstreamStart)
+	}
+
+	header := w.ResponseWriter.Header()
+	header.Set(mycomdef.KEYNAME_HEADER_TIME_QUEUE, strconv.FormatInt(w.trace.QueueDuration.Milliseconds(), 10))
+	header.Set(mycomdef.KEYNAME_HEADER_TIME_UPSTREAM, strconv.FormatInt(upstream.Milliseconds(), 10))
+	header.Set(mycomdef.KEYNAME_HEADER_TIME_TOTAL, strconv.FormatInt(time.Since(w.trace.StartTime).Milliseconds(), 10))
+}
+
+func (w *timingHeaderWriter) WriteHeaderNow() {
+	w.setTimingHeaders()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *timingHeaderWriter) Write(data []byte) (int, error) {
+	w.setTimingHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timingHeaderWriter) WriteString(s string) (int, error) {
+	w.setTimingHeaders()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *timingHeaderWriter) Flush() {
+	w.setTimingHeaders()
+	w.ResponseWriter.Flush()
+}
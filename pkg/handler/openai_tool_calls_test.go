@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type toolCallTestMessage struct {
+	Role       string  `json:"role"`
+	Content    *string `json:"content"`
+	Name       string  `json:"name"`
+	ToolCallID string  `json:"tool_call_id"`
+	ToolCalls  []struct {
+		ID       string `json:"id"`
+		Type     string `json:"type"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+}
+
+type toolCallTestRequest struct {
+	Tools      []json.RawMessage     `json:"tools"`
+	ToolChoice json.RawMessage       `json:"tool_choice"`
+	Messages   []toolCallTestMessage `json:"messages"`
+}
+
+type toolCallTestResponse struct {
+	Choices []struct {
+		Message      toolCallTestMessage `json:"message"`
+		FinishReason string              `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+// toolCallsUpstream 最后一条消息是tool时返回最终回答，否则返回一个工具调用
+func toolCallsUpstream(t *testing.T) (*httptest.Server, func() []toolCallTestRequest) {
+	var mu sync.Mutex
+	var requests []toolCallTestRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req toolCallTestRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("decode upstream request: %v, body = %s", err, body)
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == "tool" {
+			w.Write([]byte(`{"id":"r2","object":"chat.completion","created":1,"model":"gpt-4o",
+"choices":[{"index":0,"message":{"role":"assistant","content":"It is sunny in Paris."},"finish_reason":"stop"}],
+"usage":{"prompt_tokens":20,"completion_tokens":6,"total_tokens":26}}`))
+			return
+		}
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"gpt-4o",
+"choices":[{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":"tool_calls"}],
+"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	return server, func() []toolCallTestRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]toolCallTestRequest(nil), requests...)
+	}
+}
+
+func TestFunctionCallingRoundTrip(t *testing.T) {
+	upstream, upstreamRequests := toolCallsUpstream(t)
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    openai:
+        - models: [gpt-4o]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	const tools = `"tools":[{"type":"function","function":{"name":"get_weather","description":"Get the weather","parameters":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}}]`
+
+	// 第一轮：上游返回工具调用
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"gpt-4o",`+tools+`,"tool_choice":"auto","messages":[{"role":"user","content":"weather in Paris?"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first turn status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var first toolCallTestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Choices) != 1 || first.Choices[0].FinishReason != "tool_calls" {
+		t.Fatalf("first turn response = %s", w.Body.String())
+	}
+	call := first.Choices[0].Message
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" || call.ToolCalls[0].Type != "function" ||
+		call.ToolCalls[0].Function.Name != "get_weather" || call.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("tool call message = %s", w.Body.String())
+	}
+
+	// 第二轮：带上assistant的tool_calls和role为tool的结果，user消息的content使用对象，走备用的请求解析
+	w = serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o",`+tools+`,"messages":[
+{"role":"user","content":{"type":"text","text":"weather in Paris?"}},
+{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+{"role":"tool","tool_call_id":"call_1","name":"get_weather","content":"{\"weather\":\"sunny\"}"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("second turn status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var second toolCallTestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Choices) != 1 || second.Choices[0].Message.Content == nil || *second.Choices[0].Message.Content != "It is sunny in Paris." {
+		t.Fatalf("second turn response = %s", w.Body.String())
+	}
+
+	requests := upstreamRequests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream requests = %d, want 2", len(requests))
+	}
+	if len(requests[0].Tools) != 1 || string(requests[0].ToolChoice) != `"auto"` {
+		t.Errorf("first upstream request tools %d tool_choice %s", len(requests[0].Tools), requests[0].ToolChoice)
+	}
+	msgs := requests[1].Messages
+	if len(requests[1].Tools) != 1 || len(msgs) != 3 {
+		t.Fatalf("second upstream request = %+v", requests[1])
+	}
+	if msgs[0].Content == nil || *msgs[0].Content != "weather in Paris?" {
+		t.Errorf("user message = %+v", msgs[0])
+	}
+	if msgs[1].Role != "assistant" || len(msgs[1].ToolCalls) != 1 || msgs[1].ToolCalls[0].ID != "call_1" ||
+		msgs[1].ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("assistant message = %+v", msgs[1])
+	}
+	if msgs[2].Role != "tool" || msgs[2].ToolCallID != "call_1" || msgs[2].Content == nil || *msgs[2].Content != `{"weather":"sunny"}` {
+		t.Errorf("tool message = %+v", msgs[2])
+	}
+}
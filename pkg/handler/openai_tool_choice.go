@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"strings"
+)
+
+var defaultToolChoiceRequiredInstruction = "You must respond by calling one of the provided tools. Do not answer with plain text."
+var defaultToolChoiceRequiredCorrection = "You did not call any tool. You must call one of the provided tools."
+
+var errToolChoiceRequiredNotSupported = errors.New(`tool_choice "required" is not supported by this model`)
+var errToolCallMissing = errors.New(`tool_choice is "required" but the model did not return a tool call`)
+
+// isToolChoiceRequired 判断请求是否要求必须调用工具
+func isToolChoiceRequired(oaiReq *openai.ChatCompletionRequest) bool {
+	toolChoice, ok := oaiReq.ToolChoice.(string)
+	return ok && toolChoice == "required" && len(oaiReq.Tools) > 0
+}
+
+// injectToolChoiceInstruction 对不支持 tool_choice: "required" 的服务，去掉该参数并通过system消息要求调用工具
+func injectToolChoiceInstruction(oaiReq *openai.ChatCompletionRequest, conf *config.ToolChoiceRequiredConf) {
+	instruction := conf.Instruction
+	if instruction == "" {
+		instruction = defaultToolChoiceRequiredInstruction
+	}
+	oaiReq.ToolChoice = nil
+
+	if len(oaiReq.Messages) > 0 && strings.ToLower(oaiReq.Messages[0].Role) == openai.ChatMessageRoleSystem && len(oaiReq.Messages[0].MultiContent) == 0 {
+		oaiReq.Messages[0].Content = oaiReq.Messages[0].Content + "\n" + instruction
+		return
+	}
+
+	systemMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: instruction}
+	oaiReq.Messages = append([]openai.ChatCompletionMessage{systemMsg}, oaiReq.Messages...)
+}
+
+// withToolCallCheck 非流式请求检查响应中是否包含工具调用，没有时追加纠正消息重新请求，重试后仍没有则返回错误
+func withToolCallCheck(next func(*gin.Context, *OAIRequestParam) error) func(*gin.Context, *OAIRequestParam) error {
+	return func(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+		oaiReq := oaiReqParam.chatCompletionReq
+
+		maxRetries := oaiReqParam.modelDetails.ToolChoiceRequired.MaxRetries
+		if maxRetries <= 0 {
+			maxRetries = 1
+		}
+
+		origWriter := c.Writer
+		defer func() {
+			c.Writer = origWriter
+		}()
+
+		for attempt := 0; ; attempt++ {
+			buf := newResponseBuffer(origWriter)
+			c.Writer = buf
+			if err := next(c, oaiReqParam); err != nil {
+				return err
+			}
+
+			resp, ok := buf.chatCompletionResponse()
+			if !ok || len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) > 0 {
+				return buf.flushTo(origWriter)
+			}
+
+			if attempt >= maxRetries {
+				return errToolCallMissing
+			}
+
+			getLogger(c).Warn("tool call required but missing, retry",
+				zap.String("model", oaiReq.Model),
+				zap.Int("attempt", attempt+1))
+
+			oaiReq.Messages = append(oaiReq.Messages,
+				openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: resp.Choices[0].Message.Content},
+				openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: defaultToolChoiceRequiredCorrection},
+			)
+		}
+	}
+}
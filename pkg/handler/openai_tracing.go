@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mytrace"
+	"strings"
+)
+
+// TracingMiddleware 开启tracing时为每个请求生成server span，客户端传入traceparent时作为子span，
+// 请求日志加上trace_id字段，需要放在RequestIDMiddleware之后
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !mytrace.Enabled() {
+			c.Next()
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		// /v1/*path等通配的路由使用实际的路径作为span名称
+		name := route
+		if route == "" || strings.Contains(route, "*") {
+			name = c.Request.URL.Path
+		}
+		ctx, span := mytrace.Tracer().Start(ctx, c.Request.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				attribute.String("request_id", c.GetString(keyRequestID)),
+			))
+		defer span.End()
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = mylog.WithFields(ctx, zap.String("trace_id", sc.TraceID().String()))
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if model := getRequestTrace(c).Model; model != "" {
+			span.SetAttributes(attribute.String("soa.model", model))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// startAdapterSpan 为一次请求上游生成span，上游的HTTP请求span是它的子span，返回的函数恢复c.Request并结束span
+func startAdapterSpan(c *gin.Context, s *config.ModelDetails, oaiReqParam *OAIRequestParam, attempt int) func(err error) {
+	if !mytrace.Enabled() {
+		return func(error) {}
+	}
+	req := c.Request
+	ctx, span := mytrace.Tracer().Start(req.Context(), "adapter "+s.ServiceName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("soa.service_name", s.ServiceName),
+			attribute.String("soa.service_id", s.ServiceID),
+			attribute.String("soa.client_model", oaiReqParam.ClientModel),
+			attribute.String("soa.upstream_model", oaiReqParam.chatCompletionReq.Model),
+			attribute.Bool("soa.stream", oaiReqParam.chatCompletionReq.Stream),
+			attribute.Int("soa.attempt", attempt),
+		))
+	c.Request = req.WithContext(ctx)
+	return func(err error) {
+		c.Request = req
+		span.SetAttributes(semconv.HTTPResponseStatusCode(c.Writer.Status()))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"simple-one-api/pkg/mymetrics"
+	"time"
+)
+
+// upstreamMetricsWriter 统计一次上游流式请求的第一个分片时间和进行中的流式请求数，
+// 与metricsWriter不同，每次重试和切换服务都会单独统计
+type upstreamMetricsWriter struct {
+	gin.ResponseWriter
+	model      string
+	provider   string
+	start      time.Time
+	firstWrite bool
+}
+
+// newUpstreamMetricsWriter 替换c.Writer，需要在请求上游结束后调用stop
+func newUpstreamMetricsWriter(c *gin.Context, model, provider string, start time.Time) *upstreamMetricsWriter {
+	w := &upstreamMetricsWriter{ResponseWriter: c.Writer, model: model, provider: provider, start: start}
+	mymetrics.StreamStarted(model, provider)
+	c.Writer = w
+	return w
+}
+
+func (w *upstreamMetricsWriter) record(data []byte) {
+	if !w.firstWrite && len(bytes.TrimSpace(data)) > 0 {
+		w.firstWrite = true
+		mymetrics.ObserveUpstreamFirstToken(w.model, w.provider, time.Since(w.start))
+	}
+}
+
+func (w *upstreamMetricsWriter) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *upstreamMetricsWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// stop 恢复c.Writer
+func (w *upstreamMetricsWriter) stop(c *gin.Context) {
+	mymetrics.StreamFinished(w.model, w.provider)
+	c.Writer = w.ResponseWriter
+}
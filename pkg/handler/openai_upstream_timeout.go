@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"sync/atomic"
+	"time"
+)
+
+var errFirstTokenTimeout = errors.New("upstream first token timeout")
+
+// errUpstreamRequestTimeout 包含context.DeadlineExceeded，按504返回
+var errUpstreamRequestTimeout = fmt.Errorf("upstream request timeout: %w", context.DeadlineExceeded)
+
+// firstTokenLimiter 流式请求超过时长还没有写出第一个分片时取消上游请求，写出第一个分片后不再计时
+type firstTokenLimiter struct {
+	gin.ResponseWriter
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	origReq context.Context
+	state   atomic.Int32
+}
+
+// firstTokenLimiter的状态，只会从pending变为started或expired
+const (
+	firstTokenPending int32 = iota
+	firstTokenStarted
+	firstTokenExpired
+)
+
+// newFirstTokenLimiter 替换c.Writer和c.Request的context，需要在请求上游结束后调用stop
+func newFirstTokenLimiter(c *gin.Context, timeout time.Duration) *firstTokenLimiter {
+	origCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(origCtx)
+	c.Request = c.Request.WithContext(ctx)
+
+	l := &firstTokenLimiter{ResponseWriter: c.Writer, cancel: cancel, origReq: origCtx}
+	l.timer = time.AfterFunc(timeout, func() {
+		if l.state.CompareAndSwap(firstTokenPending, firstTokenExpired) {
+			cancel()
+		}
+	})
+	c.Writer = l
+	return l
+}
+
+// begin 第一次写入时停止计时，已经超时后写入的内容丢弃
+func (l *firstTokenLimiter) begin() bool {
+	if l.state.CompareAndSwap(firstTokenPending, firstTokenStarted) {
+		l.timer.Stop()
+		return true
+	}
+	return l.state.Load() == firstTokenStarted
+}
+
+func (l *firstTokenLimiter) Write(data []byte) (int, error) {
+	if !l.begin() {
+		return len(data), nil
+	}
+	return l.ResponseWriter.Write(data)
+}
+
+func (l *firstTokenLimiter) WriteString(s string) (int, error) {
+	if !l.begin() {
+		return len(s), nil
+	}
+	return l.ResponseWriter.WriteString(s)
+}
+
+// stop 停止计时并恢复c.Writer和c.Request，返回是否已经超时
+func (l *firstTokenLimiter) stop(c *gin.Context) bool {
+	l.timer.Stop()
+	l.cancel()
+	c.Writer = l.ResponseWriter
+	c.Request = c.Request.WithContext(l.origReq)
+	return l.state.Load() == firstTokenExpired
+}
+
+// upstreamContext 返回请求上游使用的context，超时由请求的context决定（X-Timeout-Seconds、request_timeout、model_timeouts中较早的），
+// 都没有设置时使用fallback
+func upstreamContext(c *gin.Context, fallback time.Duration) (context.Context, context.CancelFunc) {
+	ctx := c.Request.Context()
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, fallback)
+}
+
+// applyRequestTimeout 限制非流式请求上游的总时长，返回的函数恢复c.Request的context，并返回是否因为该时长超时。
+// 客户端通过X-Timeout-Seconds设置的截止时间更早时以客户端的为准，不再单独计时
+func applyRequestTimeout(c *gin.Context, timeout time.Duration) func() bool {
+	origCtx := c.Request.Context()
+	if deadline, ok := origCtx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return func() bool { return false }
+	}
+	ctx, cancel := context.WithTimeout(origCtx, timeout)
+	c.Request = c.Request.WithContext(ctx)
+	return func() bool {
+		expired := errors.Is(ctx.Err(), context.DeadlineExceeded) && origCtx.Err() == nil
+		cancel()
+		c.Request = c.Request.WithContext(origCtx)
+		return expired
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timeoutTestUpstream slow-model发送响应头后不返回内容，直到请求被取消；fast-model立即返回
+func timeoutTestUpstream(t *testing.T, canceled chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if req.Model == "slow-model" {
+			if req.Stream {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				close(canceled)
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(`data: {"id":"c1","object":"chat.completion.chunk","created":1,"model":"fast-model","choices":[{"index":0,"delta":{"role":"assistant","content":"fast"}}]}` + "\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"fast-model","choices":[{"index":0,"message":{"role":"assistant","content":"fast"},"finish_reason":"stop"}]}`))
+	}))
+}
+
+func loadTimeoutTestConfig(t *testing.T, upstreamURL string, fallback bool) {
+	t.Helper()
+	fallbacks := ""
+	if fallback {
+		fallbacks = "model_fallbacks:\n    slow-model: [fast-model]\n"
+	}
+	loadTestConfig(t, fmt.Sprintf(`%s
+services:
+    openai:
+        - models: [slow-model]
+          enabled: true
+          server_url: %s/v1
+          first_token_timeout: 1
+          request_timeout: 1
+          credentials:
+              api_key: sk-test
+        - models: [fast-model]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, fallbacks, upstreamURL, upstreamURL))
+}
+
+func assertUpstreamCanceled(t *testing.T, canceled <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled upstream request was not canceled")
+	}
+}
+
+func TestTimeoutReturns504(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   bool
+		wantCode string
+	}{
+		{"first token timeout", true, "first_token_timeout"},
+		{"request timeout", false, "upstream_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canceled := make(chan struct{})
+			upstream := timeoutTestUpstream(t, canceled)
+			defer upstream.Close()
+			loadTimeoutTestConfig(t, upstream.URL, false)
+
+			start := time.Now()
+			w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+				fmt.Sprintf(`{"model":"slow-model","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, tt.stream))
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("request took %v, want about 1s", elapsed)
+			}
+			if w.Code != http.StatusGatewayTimeout {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+				t.Errorf("Content-Type = %q, want a JSON error", w.Header().Get("Content-Type"))
+			}
+			var resp struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body = %s: %v", w.Body.String(), err)
+			}
+			if resp.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", resp.Error.Code, tt.wantCode)
+			}
+			assertUpstreamCanceled(t, canceled)
+		})
+	}
+}
+
+func TestTimeoutFailsOver(t *testing.T) {
+	for _, stream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			canceled := make(chan struct{})
+			upstream := timeoutTestUpstream(t, canceled)
+			defer upstream.Close()
+			loadTimeoutTestConfig(t, upstream.URL, true)
+
+			w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+				fmt.Sprintf(`{"model":"slow-model","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, `"fast"`) {
+				t.Errorf("body = %s, want the fallback response", body)
+			}
+			// 返回给客户端的模型名称保持不变
+			if !strings.Contains(body, `"model":"slow-model"`) {
+				t.Errorf("body = %s, want the client model", body)
+			}
+			if stream && strings.Count(body, "data: [DONE]") != 1 {
+				t.Errorf("body = %q, want exactly one [DONE]", body)
+			}
+			assertUpstreamCanceled(t, canceled)
+		})
+	}
+}
+
+// TestUpstreamContext 请求已有截止时间时不再使用固定的超时，即使该时间比fallback更晚
+func TestUpstreamContext(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	ctx, cancel := upstreamContext(c, time.Minute)
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(deadline) > time.Minute || time.Until(deadline) < 50*time.Second {
+		t.Errorf("deadline without request deadline = %v, want about 1m", time.Until(deadline))
+	}
+
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer reqCancel()
+	c.Request = c.Request.WithContext(reqCtx)
+	ctx, cancel = upstreamContext(c, time.Minute)
+	defer cancel()
+	want, _ := reqCtx.Deadline()
+	if got, ok := ctx.Deadline(); !ok || !got.Equal(want) {
+		t.Errorf("deadline = %v, want the request deadline %v", got, want)
+	}
+}
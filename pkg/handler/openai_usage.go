@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/myusage"
+	"time"
+)
+
+// recordKeyUsage 请求结束后按客户端key记录用量，上游没有返回用量时按内容估算，命中响应缓存的请求不记录
+func recordKeyUsage(c *gin.Context, trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) {
+	if !myusage.Enabled() || trace.CacheHit {
+		return
+	}
+
+	promptTokens, completionTokens, totalTokens, estimated := getRecordedUsage(trace, oaiReq, recorder)
+	cost, _ := mycommon.CalculateCost(trace.ClientModel, trace.Model, promptTokens, completionTokens)
+	myusage.AddRecord(&myusage.Record{
+		Timestamp:        trace.StartTime.Unix(),
+		RequestID:        c.GetString(keyRequestID),
+		KeyName:          trace.KeyName,
+		ClientModel:      trace.ClientModel,
+		Model:            trace.Model,
+		ServiceName:      trace.ServiceName,
+		Stream:           trace.Stream,
+		StatusCode:       recorder.Status(),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      totalTokens,
+		Estimated:        estimated,
+		LatencyMs:        time.Since(trace.StartTime).Milliseconds(),
+		Cost:             cost,
+	})
+}
+
+// getRecordedUsage 从记录的响应中获取用量，上游没有返回用量时按内容估算，失败的请求没有生成内容，用量为0
+func getRecordedUsage(trace *requestTrace, oaiReq *openai.ChatCompletionRequest, recorder *responseRecorder) (promptTokens, completionTokens, totalTokens int, estimated bool) {
+	resp := recorder.parse(trace.Stream)
+	if resp.ErrorMessage != "" {
+		return 0, 0, 0, false
+	}
+	if resp.TotalTokens > 0 {
+		return resp.PromptTokens, resp.CompletionTokens, resp.TotalTokens, false
+	}
+	promptTokens = mycommon.EstimateTokens(joinMessagesText(oaiReq.Messages))
+	completionTokens = mycommon.EstimateTokens(resp.Content)
+	return promptTokens, completionTokens, promptTokens + completionTokens, true
+}
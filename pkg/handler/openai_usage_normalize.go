@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// needUsageNormalization 配置了不为1的usage_factor时需要换算用量
+func needUsageNormalization(factor float64) bool {
+	return factor > 0 && factor != 1
+}
+
+// normalizeUsage 将上游返回的用量乘以换算系数得到统一的token数，原始用量保留在raw_usage字段中
+func normalizeUsage(resp map[string]json.RawMessage, factor float64) bool {
+	raw, exists := resp["usage"]
+	if !exists || string(raw) == "null" {
+		return false
+	}
+
+	var usage map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &usage); err != nil {
+		return false
+	}
+
+	scale := func(field string) (int, bool) {
+		var n float64
+		if err := json.Unmarshal(usage[field], &n); err != nil {
+			return 0, false
+		}
+		scaled := int(math.Round(n * factor))
+		usage[field], _ = json.Marshal(scaled)
+		return scaled, true
+	}
+
+	promptTokens, hasPrompt := scale("prompt_tokens")
+	completionTokens, hasCompletion := scale("completion_tokens")
+	if hasPrompt && hasCompletion {
+		// 分别取整后总数以两者之和为准
+		usage["total_tokens"], _ = json.Marshal(promptTokens + completionTokens)
+	} else {
+		_, hasTotal := scale("total_tokens")
+		if !hasTotal && !hasPrompt && !hasCompletion {
+			return false
+		}
+	}
+
+	newUsage, err := json.Marshal(usage)
+	if err != nil {
+		return false
+	}
+	resp["raw_usage"] = raw
+	resp["usage"] = newUsage
+	return true
+}
+
+// newUsageNormalizeTransformer 流式响应中换算带有usage的分片
+func newUsageNormalizeTransformer(factor float64) streamChunkTransformer {
+	return func(chunk map[string]json.RawMessage) bool {
+		return normalizeUsage(chunk, factor)
+	}
+}
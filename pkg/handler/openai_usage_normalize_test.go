@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestUsageNormalizeAfterFailover 切换到其他模型重新处理时，流式响应的用量只按usage_factor换算一次
+func TestUsageNormalizeAfterFailover(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		if req["model"] == "slow-model" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"message":"overloaded","type":"server_error"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"fast-model\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"id\":\"c1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"fast-model\",\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5,\"total_tokens\":15}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	defer upstream.Close()
+	loadTestConfig(t, fmt.Sprintf(`
+model_fallbacks:
+    slow-model: [fast-model]
+services:
+    openai:
+        - models: [slow-model, fast-model]
+          enabled: true
+          server_url: %s/v1
+          usage_factor: 2
+          credentials:
+              api_key: sk-test
+`, upstream.URL))
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"slow-model","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var usage map[string]int
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		payload := strings.TrimPrefix(line, "data: ")
+		if !strings.Contains(payload, `"usage":{`) {
+			continue
+		}
+		var chunk struct {
+			Usage map[string]int `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("decode chunk %s: %v", payload, err)
+		}
+		usage = chunk.Usage
+	}
+	if usage["prompt_tokens"] != 20 || usage["completion_tokens"] != 10 || usage["total_tokens"] != 30 {
+		t.Errorf("usage = %v, want the upstream usage scaled by 2 once\n%s", usage, w.Body.String())
+	}
+}
@@ -1,136 +1,102 @@
 package handler
 
 import (
-	"cloud.google.com/go/vertexai/genai"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"net/http"
+	"os"
 	"simple-one-api/pkg/config"
-	"simple-one-api/pkg/mylog"
 	"simple-one-api/pkg/utils"
+	"strings"
+	"sync"
 )
 
-var vertexAIUrlTemplate = "https://%s-aiplatform.googleapis.com/v1beta1/projects/%s/locations/%s/endpoints/openapi"
+// vertexAIUrlTemplate Vertex AI的Gemini接口地址，location为global时不带区域前缀
+var vertexAIUrlTemplate = "https://%saiplatform.googleapis.com/v1"
 
-func getVertexAIServerUrl(credentials map[string]interface{}) (string, string, string, error) {
+const vertexAIScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// vertexAITokenSources 按服务账号文件缓存的token，过期前复用
+var vertexAITokenSources sync.Map
+
+func getVertexAIServerUrl(s *config.ModelDetails, credentials map[string]interface{}, model string, stream bool) (string, error) {
 	projectID, _ := utils.GetStringFromMap(credentials, config.KEYNAME_GCP_PROJECT_ID)
 	location, _ := utils.GetStringFromMap(credentials, config.KEYNAME_GCP_LOCATION)
-	//modelID, _ := utils.GetStringFromMap(credentials, config.KEYNAME_GCP_MODEL_ID)
 
 	if projectID == "" || location == "" {
-		return "", "", "", errors.New("projectID or location is empty")
+		return "", errors.New("projectID or location is empty")
 	}
 
-	serverURL := fmt.Sprintf(vertexAIUrlTemplate, location, projectID, location)
-	return location, projectID, serverURL, nil
-}
-
-func OpenAI2VertexAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
-	req := oaiReqParam.chatCompletionReq
-	//s := oaiReqParam.modelDetails
-	credentials := oaiReqParam.creds
-
-	/*
-		var clientOption option.ClientOption
-		customTransport := &utils.SimpleCustomTransport{
-			Transport: http.DefaultTransport,
-		}
-		if oaiReqParam.httpTransport != nil {
-			//client.Client.WithHttpTransport(oaiReqParam.httpTransport)
-			customTransport.Transport = oaiReqParam.httpTransport
-		}
-
-		customHTTPClient := &http.Client{
-			Transport: customTransport,
-			Timeout:   30 * time.Second,
+	serverURL := s.ServerURL
+	if serverURL == "" {
+		prefix := location + "-"
+		if location == "global" {
+			prefix = ""
 		}
-		clientOption = option.WithHTTPClient(customHTTPClient)
-
-	*/
-
-	authJsonFile, _ := utils.GetStringFromMap(credentials, config.KEYNAME_GCP_JSON_FILE)
+		serverURL = fmt.Sprintf(vertexAIUrlTemplate, prefix)
+	}
 
-	authOption := option.WithCredentialsFile(authJsonFile)
+	method := "generateContent"
+	if stream {
+		method = "streamGenerateContent?alt=sse"
+	}
+	return fmt.Sprintf("%s/projects/%s/locations/%s/publishers/google/models/%s:%s",
+		strings.TrimRight(serverURL, "/"), projectID, location, model, method), nil
+}
 
-	restOption := genai.WithREST()
+// getVertexAIToken 使用json_file中的服务账号获取access token，获取token时使用服务的代理
+func getVertexAIToken(jsonFile string, transport http.RoundTripper) (*oauth2.Token, error) {
+	if ts, ok := vertexAITokenSources.Load(jsonFile); ok {
+		return ts.(oauth2.TokenSource).Token()
+	}
 
-	location, projectID, _, err := getVertexAIServerUrl(credentials)
+	data, err := os.ReadFile(jsonFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	mylog.Logger.Debug("OpenAI2VertexAIHandler", zap.String("projectID", projectID), zap.String("location", location),
-		zap.Any("authOption", authOption), zap.Any("restOption", restOption))
-
 	ctx := context.Background()
-	//client, err := genai.NewClient(ctx, projectID, location, clientOption, authOption, restOption)
-	client, err := genai.NewClient(ctx, projectID, location, authOption, restOption)
+	if transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, vertexAIScope)
 	if err != nil {
-		return fmt.Errorf("error creating client: %w", err)
+		return nil, err
 	}
+	ts, _ := vertexAITokenSources.LoadOrStore(jsonFile, creds.TokenSource)
+	return ts.(oauth2.TokenSource).Token()
+}
 
-	mylog.Logger.Debug("genai.NewClien", zap.Any("client", client))
-	modelCaller := client.GenerativeModel(req.Model)
+// OpenAI2VertexAIHandler 通过Vertex AI的REST接口调用Gemini，请求和响应的转换与Gemini相同
+func OpenAI2VertexAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	req := oaiReqParam.chatCompletionReq
+	s := oaiReqParam.modelDetails
+	credentials := oaiReqParam.creds
 
-	img := genai.FileData{
-		MIMEType: "image/jpeg",
-		FileURI:  "gs://generativeai-downloads/images/scones.jpg",
+	vertexURL, err := getVertexAIServerUrl(s, credentials, req.Model, req.Stream)
+	if err != nil {
+		return err
 	}
-	prompt := genai.Text("What is in this image?")
-
-	if req.Stream {
-		iter := modelCaller.GenerateContentStream(
-			ctx,
-			genai.FileData{
-				MIMEType: "video/mp4",
-				FileURI:  "gs://cloud-samples-data/generative-ai/video/animals.mp4",
-			},
-			genai.FileData{
-				MIMEType: "video/jpeg",
-				FileURI:  "gs://cloud-samples-data/generative-ai/image/character.jpg",
-			},
-			genai.Text("Are these video and image correlated?"),
-		)
-		for {
-			resp, err := iter.Next()
-			if err == iterator.Done {
-				mylog.Logger.Error("Done")
-				return nil
-			}
-			if err != nil {
-				mylog.Logger.Error("iter.Next", zap.Error(err))
-				return err
-			}
-
-			mylog.Logger.Info("iter.Next", zap.Any("resp", resp))
 
-			if resp != nil && (len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0) {
-				return errors.New("empty response from model")
-			}
-
-			fmt.Println("generated response: ")
-			for _, c := range resp.Candidates {
-				for _, p := range c.Content.Parts {
-					fmt.Printf("%s ", p)
-				}
-			}
-		}
-	} else {
-		resp, err := modelCaller.GenerateContent(ctx, img, prompt)
-		if err != nil {
-			return fmt.Errorf("error generating content: %w", err)
-		}
-		mylog.Logger.Debug("modelCaller.GenerateContent", zap.Any("resp", resp))
-		rb, err := json.MarshalIndent(resp, "", "  ")
-		if err != nil {
-			return fmt.Errorf("json.MarshalIndent: %w", err)
-		}
-		fmt.Println(string(rb))
-		return nil
+	authJsonFile, _ := utils.GetStringFromMap(credentials, config.KEYNAME_GCP_JSON_FILE)
+	if authJsonFile == "" {
+		return errors.New("json_file is empty")
 	}
+	var transport http.RoundTripper
+	if oaiReqParam.httpTransport != nil {
+		transport = oaiReqParam.httpTransport
+	}
+	token, err := getVertexAIToken(authJsonFile, transport)
+	if err != nil {
+		getLogger(c).Error("getVertexAIToken", zap.String("json_file", authJsonFile), zap.Error(err))
+		return fmt.Errorf("get vertex ai access token: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token.AccessToken)
+	return sendGeminiRequest(c, oaiReqParam, vertexURL, header)
 }
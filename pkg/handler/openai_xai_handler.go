@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"strings"
+)
+
+// https://docs.x.ai/docs/api-reference
+var xaiDefaultServerURL = "https://api.x.ai/v1"
+
+// xaiReasoningModelPrefixes 推理模型不支持presence_penalty、frequency_penalty和stop，传入时会报错
+var xaiReasoningModelPrefixes = []string{"grok-3-mini", "grok-4"}
+
+func isXAIReasoningModel(model string) bool {
+	model = strings.ToLower(model)
+	for _, prefix := range xaiReasoningModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func adjustXAIReq(req *openai.ChatCompletionRequest) {
+	req.LogitBias = nil
+	if isXAIReasoningModel(req.Model) {
+		req.PresencePenalty = 0
+		req.FrequencyPenalty = 0
+		req.Stop = nil
+	}
+}
+
+// newXAIStreamUsageTransformer Grok的流式响应每个分片都带有usage，客户端没有设置include_usage时去掉
+func newXAIStreamUsageTransformer() streamChunkTransformer {
+	return func(chunk map[string]json.RawMessage) bool {
+		if _, exists := chunk["usage"]; !exists {
+			return false
+		}
+		delete(chunk, "usage")
+		return true
+	}
+}
+
+// OpenAI2XAIHandler handles OpenAI to xAI Grok requests
+func OpenAI2XAIHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
+	req := oaiReqParam.chatCompletionReq
+	s := oaiReqParam.modelDetails
+	if s.ServerURL == "" {
+		details := *s
+		details.ServerURL = xaiDefaultServerURL
+		s = &details
+	}
+	conf, err := getConfig(c, s, oaiReqParam)
+	if err != nil {
+		return err
+	}
+
+	adjustXAIReq(req)
+
+	if req.Stream && (req.StreamOptions == nil || !req.StreamOptions.IncludeUsage) {
+		origWriter := c.Writer
+		sw := newStreamWriter(origWriter, newXAIStreamUsageTransformer())
+		c.Writer = sw
+		defer func() {
+			sw.finish()
+			c.Writer = origWriter
+		}()
+	}
+
+	return handleOpenAIOpenAIRequest(conf, c, oaiReqParam, nil)
+}
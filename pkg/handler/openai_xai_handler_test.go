@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func loadXAITestConfig(t *testing.T, serverURL string) {
+	loadTestConfig(t, fmt.Sprintf(`
+services:
+    xai:
+        - models: [grok-3, grok-3-mini, grok-2-vision-1212]
+          enabled: true
+          server_url: %s/v1
+          credentials:
+              api_key: sk-test
+`, serverURL))
+}
+
+func TestXAIToolCalling(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1700000000,"model":"grok-3",
+"choices":[{"index":0,"message":{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":"tool_calls"}],
+"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	})
+	defer upstream.Close()
+	loadXAITestConfig(t, upstream.URL)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", `{
+"model":"grok-3",
+"messages":[{"role":"user","content":"weather in Paris?"}],
+"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}],
+"tool_choice":"auto",
+"logit_bias":{"50256":-100}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	tools, _ := upstreamReq["tools"].([]interface{})
+	if len(tools) != 1 || upstreamReq["tool_choice"] != "auto" {
+		t.Errorf("tools not forwarded: %v", upstreamReq)
+	}
+	if _, exists := upstreamReq["logit_bias"]; exists {
+		t.Errorf("logit_bias should be removed for xAI: %v", upstreamReq["logit_bias"])
+	}
+
+	var resp struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				ToolCalls []struct {
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "grok-3" || len(resp.Choices) != 1 || resp.Choices[0].FinishReason != "tool_calls" {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+	calls := resp.Choices[0].Message.ToolCalls
+	if len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("tool_calls = %+v", calls)
+	}
+}
+
+// TestXAIReasoningModelDropsPenalties 推理模型不支持的参数在请求上游前去掉
+func TestXAIReasoningModelDropsPenalties(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"grok-3-mini","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	})
+	defer upstream.Close()
+	loadXAITestConfig(t, upstream.URL)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"grok-3-mini","messages":[{"role":"user","content":"hi"}],"presence_penalty":0.5,"frequency_penalty":0.5,"stop":["x"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	for _, key := range []string{"presence_penalty", "frequency_penalty", "stop"} {
+		if _, exists := upstreamReq[key]; exists {
+			t.Errorf("%s should be removed for grok-3-mini", key)
+		}
+	}
+}
+
+func TestXAIVisionRoundTrip(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"r1","object":"chat.completion","created":1,"model":"grok-2-vision-1212","choices":[{"index":0,"message":{"role":"assistant","content":"a cat"},"finish_reason":"stop"}]}`))
+	})
+	defer upstream.Close()
+	loadXAITestConfig(t, upstream.URL)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions", `{
+"model":"grok-2-vision-1212",
+"messages":[{"role":"user","content":[
+  {"type":"text","text":"what is this?"},
+  {"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo=","detail":"high"}}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	messages, _ := upstreamReq["messages"].([]interface{})
+	if len(messages) != 1 {
+		t.Fatalf("upstream messages = %v", upstreamReq["messages"])
+	}
+	parts, _ := messages[0].(map[string]interface{})["content"].([]interface{})
+	if len(parts) != 2 {
+		t.Fatalf("image content should be forwarded as parts: %v", messages[0])
+	}
+	image, _ := parts[1].(map[string]interface{})["image_url"].(map[string]interface{})
+	if parts[1].(map[string]interface{})["type"] != "image_url" || image["url"] != "data:image/png;base64,iVBORw0KGgo=" || image["detail"] != "high" {
+		t.Errorf("image part = %v", parts[1])
+	}
+	if !strings.Contains(w.Body.String(), `"a cat"`) {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+// TestXAIStreamDropsUsage 客户端没有设置include_usage时去掉Grok每个分片中的usage
+func TestXAIStreamDropsUsage(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	upstream := recordingChatUpstream(t, &upstreamReq, func(w http.ResponseWriter, req map[string]interface{}) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"id":"r1","object":"chat.completion.chunk","created":1,"model":"grok-3","choices":[{"index":0,"delta":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}` + "\n\n" +
+			`data: {"id":"r1","object":"chat.completion.chunk","created":1,"model":"grok-3","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}` + "\n\n" +
+			"data: [DONE]\n\n"))
+	})
+	defer upstream.Close()
+	loadXAITestConfig(t, upstream.URL)
+
+	w := serveTestRequest(OpenAIHandler, http.MethodPost, "/v1/chat/completions",
+		`{"model":"grok-3","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if strings.Contains(body, `"usage"`) {
+		t.Errorf("usage should be removed: %s", body)
+	}
+	if !strings.Contains(body, `"content":"hi"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("unexpected stream body: %s", body)
+	}
+}
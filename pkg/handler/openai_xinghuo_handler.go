@@ -1,15 +1,18 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/fruitbars/gosparkclient"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"simple-one-api/pkg/adapter"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mytrace"
 	"simple-one-api/pkg/utils"
 	"strings"
 )
@@ -52,14 +55,15 @@ func OpenAI2XingHuoHandler(c *gin.Context, oaiReqParam *OAIRequestParam) error {
 	//mycommon.GetCredentialsLimit()
 
 	client := gosparkclient.NewSparkClientWithOptions(appid, apiKey, apiSecret, serverUrl, domain)
-	if oaiReqParam.httpTransport != nil {
-		client.Transport = oaiReqParam.httpTransport
+	if transport := mytrace.BaseTransport(oaiReqParam.httpTransport); transport != nil {
+		client.Transport = transport
 	}
+	client.Transport = withContextDial(c.Request.Context(), client.Transport)
 
 	xhReq := adapter.OpenAIRequestToXingHuoRequest(oaiReq)
 
 	xhDataJson, _ := json.Marshal(xhReq)
-	mylog.Logger.Info(string(xhDataJson))
+	getLogger(c).Info(string(xhDataJson))
 
 	clientModel := oaiReqParam.ClientModel
 	if oaiReq.Stream {
@@ -98,17 +102,17 @@ func handleXingHuoStreamMode(c *gin.Context, client *gosparkclient.SparkClient,
 
 		respData, err := json.Marshal(&oaiRespStream)
 		if err != nil {
-			mylog.Logger.Error("Error marshaling response:", zap.Error(err))
+			getLogger(c).Error("Error marshaling response:", zap.Error(err))
 			return
 		}
 
 		// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-		mylog.Logger.Info("Response HTTP data",
+		getLogger(c).Debug("Response HTTP data",
 			zap.String("data", string(respData))) // 记录响应数据
 
 		if oaiRespStream.Error != nil {
 			// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Error("Error response",
+			getLogger(c).Error("Error response",
 				zap.Any("error", *oaiRespStream.Error)) // 记录错误对象
 
 			return
@@ -117,7 +121,7 @@ func handleXingHuoStreamMode(c *gin.Context, client *gosparkclient.SparkClient,
 		_, err = c.Writer.WriteString("data: " + string(respData) + "\n\n")
 		if err != nil {
 			// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-			mylog.Logger.Error("An error occurred",
+			getLogger(c).Error("An error occurred",
 				zap.Error(err)) // 记录错误对象
 
 			return
@@ -125,14 +129,21 @@ func handleXingHuoStreamMode(c *gin.Context, client *gosparkclient.SparkClient,
 		c.Writer.(http.Flusher).Flush()
 	})
 
+	// 连接被关闭时sdk只是结束读取，不返回错误
+	if ctxErr := c.Request.Context().Err(); err == nil && ctxErr != nil {
+		return ctxErr
+	}
 	return err
 }
 
 func handleXingHuoStandardMode(c *gin.Context, client *gosparkclient.SparkClient, xhReq *gosparkclient.SparkChatRequest, model string) error {
 	xhResp, err := client.SparkChatWithCallback(*xhReq, nil)
+	if ctxErr := c.Request.Context().Err(); err == nil && ctxErr != nil {
+		err = ctxErr
+	}
 	if err != nil {
 
-		mylog.Logger.Error("An error occurred", zap.String("appid", client.AppID),
+		getLogger(c).Error("An error occurred", zap.String("appid", client.AppID),
 			zap.String("apikey", client.ApiKey),
 			zap.Error(err))
 
@@ -143,9 +154,30 @@ func handleXingHuoStandardMode(c *gin.Context, client *gosparkclient.SparkClient
 	oaiResp.Model = model
 
 	// 假设 mylog.Logger 是一个已经配置好的 zap.Logger 实例
-	mylog.Logger.Info("Standard response",
+	getLogger(c).Info("Standard response",
 		zap.Any("response", *oaiResp)) // 记录响应对象
 
 	c.JSON(http.StatusOK, oaiResp)
 	return nil
 }
+
+// withContextDial sdk的websocket连接不支持context，建立连接后在ctx取消（如客户端断开）时关闭连接，中止上游的生成
+func withContextDial(ctx context.Context, transport *http.Transport) *http.Transport {
+	t := transport.Clone()
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		return conn, nil
+	}
+	return t
+}
@@ -5,7 +5,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"log"
 	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myaudit"
+	"simple-one-api/pkg/mybatch"
+	"simple-one-api/pkg/mycache"
+	"simple-one-api/pkg/mycommon"
+	"simple-one-api/pkg/mykeys"
 	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/mypublisher"
+	"simple-one-api/pkg/myredis"
+	"simple-one-api/pkg/mytrace"
+	"simple-one-api/pkg/myusage"
 	"sync"
 )
 
@@ -29,10 +38,65 @@ func Setup(configName string) error {
 
 		mylog.InitLog(config.LogLevel)
 		log.Println("config.LogLevel ok")
+
+		maxChars := config.GetConf().LogPrivacy.MaxChars
+		if maxChars <= 0 {
+			maxChars = config.DefaultLogPrivacyMaxChars
+		}
+		mylog.SetPrivacy(config.GetConf().LogPrivacy.Level, maxChars)
+
+		if err = myredis.Init(&config.GetConf().SharedState); err != nil {
+			log.Println("Error initializing shared state:", err)
+			return
+		}
+		if err = mytrace.Init(&config.GetConf().Tracing); err != nil {
+			log.Println("Error initializing tracing:", err)
+			return
+		}
+
+		if conf := &config.GetConf().ResponseCache; conf.Enable {
+			if err = mycache.InitResponseStore(conf); err != nil {
+				log.Println("Error initializing response cache:", err)
+				return
+			}
+		}
+
+		if err = mypublisher.Init(&config.GetConf().Publisher); err != nil {
+			log.Println("Error initializing publisher:", err)
+			return
+		}
+
+		if err = myusage.Init(&config.GetConf().Usage); err != nil {
+			log.Println("Error initializing usage:", err)
+			return
+		}
+
+		if err = mykeys.Init(&config.GetConf().KeyManagement); err != nil {
+			log.Println("Error initializing key management:", err)
+			return
+		}
+
+		if err = myaudit.Init(&config.GetConf().Audit); err != nil {
+			log.Println("Error initializing audit log:", err)
+			return
+		}
+
+		if err = mybatch.Init(&config.GetConf().Batch); err != nil {
+			log.Println("Error initializing batch:", err)
+			return
+		}
+
+		mycommon.StartServiceProbe()
+		config.StartConfigReload()
 	})
 	return err
 }
 
 func Cleanup() {
+	mypublisher.Close()
+	myusage.Close()
+	mykeys.Close()
+	myaudit.Close()
+	mytrace.Shutdown()
 	mylog.Logger.Sync() // Ensure all logs are flushed properly
 }
@@ -1,9 +1,45 @@
 package ds_com_request
 
-// Message 代表一个对话消息
+// Message 代表一个对话消息，role为tool的消息需要带上函数名name，
+// 多模态模型的content为ContentPart数组，其他模型为字符串
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"`
+	Name       string      `json:"name,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+}
+
+// ContentPart 多模态模型消息中的一项内容，图片为http链接或data URL
+type ContentPart struct {
+	Image string `json:"image,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+// ToolCall 代表assistant消息中的工具调用
+type ToolCall struct {
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall 代表调用的函数和参数
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Tool 代表可以调用的工具，格式与OpenAI一致
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition 代表函数的定义
+type FunctionDefinition struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
 }
 
 // Input 代表一个对话的输入部分
@@ -13,7 +49,9 @@ type Input struct {
 
 // Parameters 代表请求的参数
 type Parameters struct {
-	ResultFormat string `json:"result_format,omitempty"`
+	ResultFormat string      `json:"result_format,omitempty"`
+	Tools        []Tool      `json:"tools,omitempty"`
+	ToolChoice   interface{} `json:"tool_choice,omitempty"`
 }
 
 // ModelRequest 代表一个模型请求，包括模型名称、输入消息和参数
@@ -1,10 +1,50 @@
 package ds_com_resp
 
+import "encoding/json"
+
+// Content 消息内容，多模态模型返回[{"text": "..."}]数组，转换为拼接后的文本
+type Content string
+
+func (ct *Content) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*ct = Content(text)
+		return nil
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	text = ""
+	for _, part := range parts {
+		text += part.Text
+	}
+	*ct = Content(text)
+	return nil
+}
+
 // Message 代表返回的消息内容
 type Message struct {
-	Role        string `json:"role"`
-	ContentType string `json:"content_type"`
-	Content     string `json:"content"`
+	Role        string     `json:"role"`
+	ContentType string     `json:"content_type"`
+	Content     Content    `json:"content"`
+	ToolCalls   []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ToolCall 代表模型返回的工具调用，流式响应中每个分片都包含到目前为止完整的参数
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall 代表调用的函数和参数
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 // Choice 代表返回的一个选择项
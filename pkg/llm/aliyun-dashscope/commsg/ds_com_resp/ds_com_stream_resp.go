@@ -10,8 +10,9 @@ type StreamResponseChoice struct {
 }
 
 type StreamResponseMessage struct {
-	Content string `json:"content"`
-	Role    string `json:"role"`
+	Content   Content    `json:"content"`
+	Role      string     `json:"role"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type StreamResponseUsage struct {
@@ -0,0 +1,55 @@
+package aws_bedrock
+
+import (
+	"net/url"
+	"simple-one-api/pkg/llm/claude"
+	"strings"
+)
+
+const DefaultRegion = "us-east-1"
+
+// ClaudeAnthropicVersion Bedrock上的Claude使用messages接口，版本号放在请求体中
+const ClaudeAnthropicVersion = "bedrock-2023-05-31"
+
+// ClaudeRequest Bedrock上Claude的请求体，模型在地址中指定，不能带model和stream字段
+type ClaudeRequest struct {
+	AnthropicVersion string             `json:"anthropic_version"`
+	Messages         []claude.Message   `json:"messages"`
+	MaxTokens        int                `json:"max_tokens"`
+	System           string             `json:"system,omitempty"`
+	StopSequences    []string           `json:"stop_sequences,omitempty"`
+	Temperature      float32            `json:"temperature,omitempty"`
+	TopP             float32            `json:"top_p,omitempty"`
+	TopK             int                `json:"top_k,omitempty"`
+	Tools            []claude.Tool      `json:"tools,omitempty"`
+	ToolChoice       *claude.ToolChoice `json:"tool_choice,omitempty"`
+}
+
+// LlamaRequest Bedrock上Meta Llama的请求体，对话需要按Llama的模板拼成prompt
+type LlamaRequest struct {
+	Prompt      string  `json:"prompt"`
+	MaxGenLen   int     `json:"max_gen_len,omitempty"`
+	Temperature float32 `json:"temperature,omitempty"`
+	TopP        float32 `json:"top_p,omitempty"`
+}
+
+// IsClaudeModel 模型ID可能带有跨区域推理的前缀，如us.anthropic.claude-3-5-sonnet-20240620-v1:0
+func IsClaudeModel(modelID string) bool {
+	return strings.Contains(modelID, "anthropic.")
+}
+
+func IsLlamaModel(modelID string) bool {
+	return strings.Contains(modelID, "meta.llama")
+}
+
+// InvokeURL 返回调用模型的地址，baseURL为空时使用区域的bedrock-runtime地址，模型ID中的冒号需要编码
+func InvokeURL(baseURL, region, modelID string, stream bool) string {
+	if baseURL == "" {
+		baseURL = "https://bedrock-runtime." + region + ".amazonaws.com"
+	}
+	action := "invoke"
+	if stream {
+		action = "invoke-with-response-stream"
+	}
+	return strings.TrimRight(baseURL, "/") + "/model/" + strings.ReplaceAll(url.PathEscape(modelID), ":", "%3A") + "/" + action
+}
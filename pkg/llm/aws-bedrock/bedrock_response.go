@@ -0,0 +1,26 @@
+package aws_bedrock
+
+// InvocationMetrics 流式响应最后一个分片中的用量统计
+type InvocationMetrics struct {
+	InputTokenCount  int `json:"inputTokenCount"`
+	OutputTokenCount int `json:"outputTokenCount"`
+}
+
+// LlamaResponse Meta Llama的响应，流式响应的每个分片也是这个结构，StopReason为stop或length时结束
+type LlamaResponse struct {
+	Generation           string             `json:"generation"`
+	PromptTokenCount     int                `json:"prompt_token_count"`
+	GenerationTokenCount int                `json:"generation_token_count"`
+	StopReason           *string            `json:"stop_reason"`
+	InvocationMetrics    *InvocationMetrics `json:"amazon-bedrock-invocationMetrics,omitempty"`
+}
+
+// ChunkPayload invoke-with-response-stream中chunk事件的内容，bytes为模型原始分片的base64
+type ChunkPayload struct {
+	Bytes []byte `json:"bytes"`
+}
+
+// ExceptionPayload 流式响应中exception事件的内容
+type ExceptionPayload struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,135 @@
+package aws_bedrock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// maxEventSize 单个事件的大小上限，避免数据错误时分配过大的内存
+const maxEventSize = 16 << 20
+
+// Event application/vnd.amazon.eventstream中的一个消息
+type Event struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// MessageType 为event或exception
+func (e *Event) MessageType() string {
+	return e.Headers[":message-type"]
+}
+
+// EventType event的类型，invoke-with-response-stream中为chunk
+func (e *Event) EventType() string {
+	return e.Headers[":event-type"]
+}
+
+// Err exception事件转换为错误，其他事件返回nil
+func (e *Event) Err() error {
+	if e.MessageType() != "exception" && e.MessageType() != "error" {
+		return nil
+	}
+	exceptionType := e.Headers[":exception-type"]
+	if exceptionType == "" {
+		exceptionType = e.Headers[":error-code"]
+	}
+	var payload ExceptionPayload
+	if err := json.Unmarshal(e.Payload, &payload); err != nil || payload.Message == "" {
+		payload.Message = string(e.Payload)
+	}
+	return fmt.Errorf("bedrock stream %s: %s", exceptionType, payload.Message)
+}
+
+// EventStreamReader 读取二进制的事件流，每个消息的格式为：
+// 总长度(4) 头部长度(4) 前导CRC(4) 头部 内容 消息CRC(4)
+type EventStreamReader struct {
+	r *bufio.Reader
+}
+
+func NewEventStreamReader(r io.Reader) *EventStreamReader {
+	return &EventStreamReader{r: bufio.NewReader(r)}
+}
+
+// Next 读取下一个消息，流结束时返回io.EOF
+func (er *EventStreamReader) Next() (*Event, error) {
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(er.r, prelude); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("truncated event stream prelude")
+		}
+		return nil, err
+	}
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[0:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if totalLen < 16 || totalLen > maxEventSize || headersLen > totalLen-16 {
+		return nil, fmt.Errorf("invalid event stream message length: %d", totalLen)
+	}
+
+	msg := make([]byte, totalLen)
+	copy(msg, prelude)
+	if _, err := io.ReadFull(er.r, msg[12:]); err != nil {
+		return nil, fmt.Errorf("truncated event stream message: %w", err)
+	}
+	if crc32.ChecksumIEEE(msg[:totalLen-4]) != binary.BigEndian.Uint32(msg[totalLen-4:]) {
+		return nil, errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := parseEventHeaders(msg[12 : 12+headersLen])
+	if err != nil {
+		return nil, err
+	}
+	return &Event{Headers: headers, Payload: msg[12+headersLen : totalLen-4]}, nil
+}
+
+// parseEventHeaders 解析头部，只保留字符串类型的值，其他类型跳过
+func parseEventHeaders(b []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(b) > 0 {
+		nameLen := int(b[0])
+		if len(b) < 1+nameLen+1 {
+			return nil, errors.New("invalid event stream header")
+		}
+		name := string(b[1 : 1+nameLen])
+		valueType := b[1+nameLen]
+		b = b[2+nameLen:]
+
+		var size int
+		switch valueType {
+		case 0, 1: // bool
+			size = 0
+		case 2: // byte
+			size = 1
+		case 3: // short
+			size = 2
+		case 4: // int
+			size = 4
+		case 5, 8: // long, timestamp
+			size = 8
+		case 9: // uuid
+			size = 16
+		case 6, 7: // bytes, string
+			if len(b) < 2 {
+				return nil, errors.New("invalid event stream header")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(b))
+		default:
+			return nil, fmt.Errorf("unknown event stream header type: %d", valueType)
+		}
+		if len(b) < size {
+			return nil, errors.New("invalid event stream header")
+		}
+		if valueType == 7 {
+			headers[name] = string(b[2:size])
+		}
+		b = b[size:]
+	}
+	return headers, nil
+}
@@ -3,6 +3,7 @@ package baidu_qianfan
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,87 +14,123 @@ import (
 	"strings"
 )
 
-func QianFanCall(client *http.Client, api_key, secret_key, model string, qfReq *QianFanRequest) (*QianFanResponse, error) {
-	mylog.Logger.Info("QianFanCall", zap.String("api_key", api_key), zap.String("secret_key", secret_key), zap.String("model", model), zap.Any("qfReq", qfReq))
+// DefaultBaseURL 千帆接口的地址，服务配置了server_url时替换
+const DefaultBaseURL = "https://aip.baidubce.com"
 
-	accessToken := GetAccessToken(api_key, secret_key)
-	if accessToken == "" {
-		err := errors.New("Failed to get access token")
-		mylog.Logger.Error(err.Error())
-		return nil, err
+// errAccessTokenInvalid 流式请求还没有返回内容时access token已经失效，重新获取后重试
+var errAccessTokenInvalid = errors.New("qianfan access token invalid")
+
+func chatURL(baseURL, accessToken, model string) string {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
 	}
+	return strings.TrimRight(baseURL, "/") + "/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/" + qianfanModelName2Address(model) + "?access_token=" + accessToken
+}
+
+// QianFanCall 非流式请求，access token失效时重新获取并重试一次
+func QianFanCall(ctx context.Context, client *http.Client, baseURL, apiKey, secretKey, model string, qfReq *QianFanRequest) (*QianFanResponse, error) {
+	mylog.Logger.Info("QianFanCall", zap.String("model", model), zap.Any("qfReq", qfReq))
+
+	for attempt := 0; ; attempt++ {
+		accessToken, err := GetAccessToken(ctx, client, baseURL, apiKey, secretKey)
+		if err != nil {
+			mylog.Logger.Error(err.Error())
+			return nil, err
+		}
 
-	return SendChatRequest(client, accessToken, model, qfReq)
+		resp, err := SendChatRequest(ctx, client, baseURL, accessToken, model, qfReq)
+		if err == nil && isAccessTokenError(resp.ErrorCode) && attempt == 0 {
+			mylog.Logger.Warn("qianfan access token invalid, refresh", zap.Int("error_code", resp.ErrorCode), zap.String("error_msg", resp.ErrorMsg))
+			InvalidateAccessToken(baseURL, apiKey, secretKey)
+			continue
+		}
+		return resp, err
+	}
 }
 
-func QianFanCallSSE(client *http.Client, api_key, secret_key, model string, qfReq *QianFanRequest, callback func(qfResp *QianFanResponse)) error {
-	mylog.Logger.Info("QianFanCall", zap.String("api_key", api_key), zap.String("secret_key", secret_key), zap.String("model", model), zap.Any("qfReq", qfReq))
-	accessToken := GetAccessToken(api_key, secret_key)
-	if accessToken == "" {
-		err := errors.New("Failed to get access token")
-		mylog.Logger.Error(err.Error())
+// QianFanCallSSE 流式请求，还没有返回内容时access token失效，重新获取并重试一次
+func QianFanCallSSE(ctx context.Context, client *http.Client, baseURL, apiKey, secretKey, model string, qfReq *QianFanRequest, callback func(qfResp *QianFanResponse)) error {
+	mylog.Logger.Info("QianFanCallSSE", zap.String("model", model), zap.Any("qfReq", qfReq))
+
+	for attempt := 0; ; attempt++ {
+		accessToken, err := GetAccessToken(ctx, client, baseURL, apiKey, secretKey)
+		if err != nil {
+			mylog.Logger.Error(err.Error())
+			return err
+		}
+
+		err = SendChatRequestWithSSE(ctx, client, baseURL, accessToken, model, qfReq, callback)
+		if errors.Is(err, errAccessTokenInvalid) && attempt == 0 {
+			mylog.Logger.Warn("qianfan access token invalid, refresh")
+			InvalidateAccessToken(baseURL, apiKey, secretKey)
+			continue
+		}
 		return err
 	}
-
-	return SendChatRequestWithSSE(client, accessToken, model, qfReq, callback)
 }
 
-// SendChatRequestWithSSE 发送 SSE 请求并处理响应
-func SendChatRequestWithSSE(client *http.Client, accessToken, model string, qfReq *QianFanRequest, callback func(qfResp *QianFanResponse)) error {
-	address := qianfanModelName2Address(model)
-	url := "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/" + address + "?access_token=" + accessToken
-
+func newChatRequest(ctx context.Context, baseURL, accessToken, model string, qfReq *QianFanRequest) (*http.Request, error) {
 	jsonData, err := json.Marshal(qfReq)
 	if err != nil {
-		mylog.Logger.Error(err.Error())
-		return err
+		return nil, err
 	}
+	mylog.Logger.Debug(string(jsonData))
 
-	mylog.Logger.Info(string(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, chatURL(baseURL, accessToken, model), bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
 
-	//client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+// SendChatRequestWithSSE 发送流式请求，每个分片调用一次callback。出错时千帆返回的是一行JSON而不是SSE，同样交给callback处理
+func SendChatRequestWithSSE(ctx context.Context, client *http.Client, baseURL, accessToken, model string, qfReq *QianFanRequest, callback func(qfResp *QianFanResponse)) error {
+	req, err := newChatRequest(ctx, baseURL, accessToken, model, qfReq)
 	if err != nil {
 		mylog.Logger.Error(err.Error())
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
 
 	res, err := client.Do(req)
 	if err != nil {
 		mylog.Logger.Error(err.Error())
 		return err
 	}
-
-	mylog.Logger.Debug(url)
-
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		mylog.Logger.Error("received non-200 response code:", zap.Int("StatusCode", res.StatusCode))
-		return fmt.Errorf("received non-200 response code: %d", res.StatusCode)
+		body, _ := io.ReadAll(res.Body)
+		mylog.Logger.Error("received non-200 response code:", zap.Int("StatusCode", res.StatusCode), zap.String("body", string(body)))
+		return fmt.Errorf("received non-200 response code: %d, body: %s", res.StatusCode, body)
 	}
 
-	// 使用 bufio.Scanner 解析 SSE 响应
 	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	received := false
 	for scanner.Scan() {
-		line := scanner.Text()
-		//log.Println(line)
-		if strings.HasPrefix(line, "data:") || len(line) > 0 {
-			data := strings.TrimPrefix(line, "data:")
-
-			mylog.Logger.Debug(string(data))
-
-			var response QianFanResponse
-			err = json.Unmarshal([]byte(data), &response)
-			if err != nil {
-				mylog.Logger.Error(err.Error())
-
-			} else {
-				mylog.Logger.Debug("execute callback")
-				callback(&response)
-			}
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "data:") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		} else if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		if line == "" {
+			continue
 		}
+
+		mylog.Logger.Debug(line)
+
+		var response QianFanResponse
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			mylog.Logger.Error(err.Error())
+			continue
+		}
+		if !received && isAccessTokenError(response.ErrorCode) {
+			return errAccessTokenInvalid
+		}
+		received = true
+		callback(&response)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -104,25 +141,12 @@ func SendChatRequestWithSSE(client *http.Client, accessToken, model string, qfRe
 	return nil
 }
 
-func SendChatRequest(client *http.Client, accessToken, model string, qfReq *QianFanRequest) (*QianFanResponse, error) {
-	address := qianfanModelName2Address(model)
-	url := "https://aip.baidubce.com/rpc/2.0/ai_custom/v1/wenxinworkshop/chat/" + address + "?access_token=" + accessToken
-
-	jsonData, err := json.Marshal(qfReq)
-	if err != nil {
-		mylog.Logger.Error(err.Error())
-		return nil, err
-	}
-
-	mylog.Logger.Info(string(jsonData))
-
-	//client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+func SendChatRequest(ctx context.Context, client *http.Client, baseURL, accessToken, model string, qfReq *QianFanRequest) (*QianFanResponse, error) {
+	req, err := newChatRequest(ctx, baseURL, accessToken, model, qfReq)
 	if err != nil {
 		mylog.Logger.Error(err.Error())
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -139,12 +163,11 @@ func SendChatRequest(client *http.Client, accessToken, model string, qfReq *Qian
 
 	if res.StatusCode != http.StatusOK {
 		mylog.Logger.Error("received non-200 response code:", zap.Int("StatusCode", res.StatusCode), zap.String("body", string(body)))
-		return nil, fmt.Errorf("received non-200 response code: %d", res.StatusCode)
+		return nil, fmt.Errorf("received non-200 response code: %d, body: %s", res.StatusCode, body)
 	}
 
 	var response QianFanResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
+	if err := json.Unmarshal(body, &response); err != nil {
 		mylog.Logger.Error(err.Error())
 		return nil, err
 	}
@@ -167,38 +190,3 @@ func qianfanModelName2Address(modelName string) string {
 
 	return address
 }
-
-// GetAccessToken 使用 AK，SK 生成鉴权签名（Access Token）
-func GetAccessToken(api_key, secret_key string) string {
-	url := "https://aip.baidubce.com/oauth/2.0/token"
-	postData := fmt.Sprintf("grant_type=client_credentials&client_id=%s&client_secret=%s", api_key, secret_key)
-	resp, err := http.Post(url, "application/x-www-form-urlencoded", strings.NewReader(postData))
-	if err != nil {
-		mylog.Logger.Error(err.Error())
-		return ""
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		mylog.Logger.Error(err.Error())
-		return ""
-	}
-
-	//	log.Printf("AccessToken response body: %s", body)
-
-	var accessTokenObj map[string]interface{}
-	if err := json.Unmarshal(body, &accessTokenObj); err != nil {
-		mylog.Logger.Error(err.Error())
-		return ""
-	}
-
-	if token, ok := accessTokenObj["access_token"].(string); ok {
-		return token
-	} else if errDesc, ok := accessTokenObj["error_description"].(string); ok {
-		mylog.Logger.Error("Error in getting access token:", zap.String("errDesc", errDesc))
-	} else {
-		mylog.Logger.Error("Unknown error in access token response")
-	}
-	return ""
-}
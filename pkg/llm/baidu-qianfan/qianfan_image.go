@@ -0,0 +1,185 @@
+package baidu_qianfan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultImageBaseURL = DefaultBaseURL
+
+// ernieVilgPollInterval ERNIE-ViLG是异步接口，提交任务后按这个间隔查询结果
+var ernieVilgPollInterval = 2 * time.Second
+
+// Text2ImageRequest 千帆文生图接口的请求，如Stable-Diffusion-XL
+type Text2ImageRequest struct {
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Size           string `json:"size,omitempty"`
+	N              int    `json:"n,omitempty"`
+	Style          string `json:"style,omitempty"`
+	UserID         string `json:"user_id,omitempty"`
+}
+
+// Text2ImageResponse 千帆文生图接口的响应，图片只以base64返回
+type Text2ImageResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object,omitempty"`
+	Created int64  `json:"created,omitempty"`
+	Data    []struct {
+		Object   string `json:"object"`
+		B64Image string `json:"b64_image"`
+		Index    int    `json:"index"`
+	} `json:"data"`
+	Usage Usage `json:"usage,omitempty"`
+
+	ErrorCode int    `json:"error_code,omitempty"`
+	ErrorMsg  string `json:"error_msg,omitempty"`
+}
+
+// ErnieVilgRequest ERNIE-ViLG 2.0提交任务的请求
+type ErnieVilgRequest struct {
+	Prompt   string `json:"prompt"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	ImageNum int    `json:"image_num,omitempty"`
+}
+
+type ernieVilgSubmitResponse struct {
+	Data struct {
+		TaskID int64 `json:"task_id"`
+	} `json:"data"`
+	ErrorCode int    `json:"error_code,omitempty"`
+	ErrorMsg  string `json:"error_msg,omitempty"`
+}
+
+type ernieVilgResultResponse struct {
+	Data struct {
+		TaskStatus        string `json:"task_status"`
+		SubTaskResultList []struct {
+			SubTaskStatus    string `json:"sub_task_status"`
+			SubTaskErrorCode int    `json:"sub_task_error_code"`
+			FinalImageList   []struct {
+				ImgURL string `json:"img_url"`
+			} `json:"final_image_list"`
+		} `json:"sub_task_result_list"`
+	} `json:"data"`
+	ErrorCode int    `json:"error_code,omitempty"`
+	ErrorMsg  string `json:"error_msg,omitempty"`
+}
+
+// IsErnieVilgModel ERNIE-ViLG使用单独的异步接口，其他模型使用千帆的文生图接口
+func IsErnieVilgModel(model string) bool {
+	return strings.Contains(strings.ToLower(model), "vilg")
+}
+
+func text2ImageModel2Address(model string) string {
+	switch strings.ToLower(model) {
+	case "stable-diffusion-xl", "sd-xl":
+		return "sd_xl"
+	}
+	return strings.ToLower(model)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, reqBody interface{}, respBody interface{}) error {
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-200 response code: %d, body: %s", res.StatusCode, body)
+	}
+	return json.Unmarshal(body, respBody)
+}
+
+// Text2Image 调用千帆文生图接口，baseURL为空时使用DefaultImageBaseURL
+func Text2Image(ctx context.Context, client *http.Client, baseURL, accessToken, model string, req *Text2ImageRequest) (*Text2ImageResponse, error) {
+	if baseURL == "" {
+		baseURL = DefaultImageBaseURL
+	}
+	url := strings.TrimRight(baseURL, "/") + "/rpc/2.0/ai_custom/v1/wenxinworkshop/text2image/" + text2ImageModel2Address(model) + "?access_token=" + accessToken
+
+	var resp Text2ImageResponse
+	if err := postJSON(ctx, client, url, req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ErrorCode != 0 {
+		return nil, fmt.Errorf("qianfan text2image error, code: %d, message: %s", resp.ErrorCode, resp.ErrorMsg)
+	}
+	return &resp, nil
+}
+
+// ErnieVilg 提交ERNIE-ViLG 2.0任务并等待完成，返回生成的图片地址
+func ErnieVilg(ctx context.Context, client *http.Client, baseURL, accessToken string, req *ErnieVilgRequest) ([]string, error) {
+	if baseURL == "" {
+		baseURL = DefaultImageBaseURL
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
+
+	var submitResp ernieVilgSubmitResponse
+	if err := postJSON(ctx, client, baseURL+"/rpc/2.0/ernievilg/v1/txt2imgv2?access_token="+accessToken, req, &submitResp); err != nil {
+		return nil, err
+	}
+	if submitResp.ErrorCode != 0 {
+		return nil, fmt.Errorf("ernie-vilg error, code: %d, message: %s", submitResp.ErrorCode, submitResp.ErrorMsg)
+	}
+
+	resultURL := baseURL + "/rpc/2.0/ernievilg/v1/getImgv2?access_token=" + accessToken
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(ernieVilgPollInterval):
+		}
+
+		var resultResp ernieVilgResultResponse
+		if err := postJSON(ctx, client, resultURL, map[string]int64{"task_id": submitResp.Data.TaskID}, &resultResp); err != nil {
+			return nil, err
+		}
+		if resultResp.ErrorCode != 0 {
+			return nil, fmt.Errorf("ernie-vilg error, code: %d, message: %s", resultResp.ErrorCode, resultResp.ErrorMsg)
+		}
+
+		switch resultResp.Data.TaskStatus {
+		case "SUCCESS":
+			var urls []string
+			for _, sub := range resultResp.Data.SubTaskResultList {
+				for _, img := range sub.FinalImageList {
+					urls = append(urls, img.ImgURL)
+				}
+			}
+			if len(urls) == 0 {
+				return nil, errors.New("ernie-vilg task succeeded without images")
+			}
+			return urls, nil
+		case "FAILED":
+			code := 0
+			if len(resultResp.Data.SubTaskResultList) > 0 {
+				code = resultResp.Data.SubTaskResultList[0].SubTaskErrorCode
+			}
+			return nil, fmt.Errorf("ernie-vilg task failed, code: %d", code)
+		}
+	}
+}
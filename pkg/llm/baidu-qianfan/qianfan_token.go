@@ -0,0 +1,117 @@
+package baidu_qianfan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"net/url"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access token的有效期一般为30天，提前刷新，避免请求时刚好过期
+const accessTokenRefreshBefore = time.Hour
+
+// 上游返回这些错误码时access token已经失效，需要重新获取
+const (
+	errCodeInvalidAccessToken = 110
+	errCodeExpiredAccessToken = 111
+)
+
+type accessToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+var (
+	accessTokens      = make(map[string]*accessToken)
+	accessTokensMu    sync.Mutex
+	accessTokenFlight singleflight.Group
+)
+
+type accessTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func accessTokenKey(baseURL, apiKey, secretKey string) string {
+	return baseURL + "|" + apiKey + "|" + secretKey
+}
+
+// GetAccessToken 使用AK、SK换取access token，按AK、SK缓存到过期前一小时，同一组AK、SK并发请求时只获取一次
+func GetAccessToken(ctx context.Context, client *http.Client, baseURL, apiKey, secretKey string) (string, error) {
+	if apiKey == "" || secretKey == "" {
+		return "", errors.New("qianfan api_key or secret_key is empty")
+	}
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	key := accessTokenKey(baseURL, apiKey, secretKey)
+
+	accessTokensMu.Lock()
+	t, exists := accessTokens[key]
+	accessTokensMu.Unlock()
+	if exists && time.Now().Before(t.expiresAt) {
+		return t.token, nil
+	}
+
+	v, err, _ := accessTokenFlight.Do(key, func() (interface{}, error) {
+		return fetchAccessToken(ctx, client, baseURL, apiKey, secretKey)
+	})
+	if err != nil {
+		return "", err
+	}
+	t = v.(*accessToken)
+
+	accessTokensMu.Lock()
+	accessTokens[key] = t
+	accessTokensMu.Unlock()
+	return t.token, nil
+}
+
+// InvalidateAccessToken 删除缓存的access token，下次请求时重新获取
+func InvalidateAccessToken(baseURL, apiKey, secretKey string) {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	accessTokensMu.Lock()
+	delete(accessTokens, accessTokenKey(baseURL, apiKey, secretKey))
+	accessTokensMu.Unlock()
+}
+
+func isAccessTokenError(code int) bool {
+	return code == errCodeInvalidAccessToken || code == errCodeExpiredAccessToken
+}
+
+func fetchAccessToken(ctx context.Context, client *http.Client, baseURL, apiKey, secretKey string) (*accessToken, error) {
+	tokenURL := strings.TrimRight(baseURL, "/") + "/oauth/2.0/token?" + url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {apiKey},
+		"client_secret": {secretKey},
+	}.Encode()
+
+	var resp accessTokenResponse
+	if err := postJSON(ctx, client, tokenURL, struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		mylog.Logger.Error("qianfan get access token failed", zap.String("error", resp.Error), zap.String("error_description", resp.ErrorDescription))
+		return nil, fmt.Errorf("qianfan get access token failed: %s %s", resp.Error, resp.ErrorDescription)
+	}
+
+	expiresIn := time.Duration(resp.ExpiresIn) * time.Second
+	if expiresIn > 2*accessTokenRefreshBefore {
+		expiresIn -= accessTokenRefreshBefore
+	} else {
+		expiresIn /= 2
+	}
+	mylog.Logger.Info("qianfan access token refreshed", zap.Duration("expires_in", expiresIn))
+	return &accessToken{token: resp.AccessToken, expiresAt: time.Now().Add(expiresIn)}, nil
+}
@@ -1,6 +1,9 @@
 package claude
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+)
 
 // MarshalJSON 自定义JSON序列化
 func (m Message) MarshalJSON() ([]byte, error) {
@@ -22,23 +25,75 @@ func (m Message) MarshalJSON() ([]byte, error) {
 	}
 }
 
-// ContentBlock 定义内容块结构体
-type ContentBlock struct {
-	Type  string `json:"type"`
-	Text  string `json:"text,omitempty"`
-	Image *Image `json:"image,omitempty"`
+// UnmarshalJSON content可以是字符串或者内容块数组，数组放在MultiContent中
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	if len(raw.Content) > 0 && raw.Content[0] == '[' {
+		return json.Unmarshal(raw.Content, &m.MultiContent)
+	}
+	if len(raw.Content) > 0 && string(raw.Content) != "null" {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+	return nil
 }
 
-// Image 定义图像结构体
-type Image struct {
-	Source ImageSource `json:"source"`
+// UnmarshalJSON tool_result的content可以是字符串或者内容块数组，数组中的文本合并到Content中
+func (b *ContentBlock) UnmarshalJSON(data []byte) error {
+	type Alias ContentBlock
+	aux := &struct {
+		*Alias
+		Content json.RawMessage `json:"content,omitempty"`
+	}{Alias: (*Alias)(b)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	b.Content = ""
+	if len(aux.Content) == 0 || string(aux.Content) == "null" {
+		return nil
+	}
+	if aux.Content[0] != '[' {
+		return json.Unmarshal(aux.Content, &b.Content)
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(aux.Content, &blocks); err != nil {
+		return err
+	}
+	var texts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	b.Content = strings.Join(texts, "\n")
+	return nil
 }
 
-// ImageSource 定义图像源结构体
+// ContentBlock 定义内容块结构体，图片的Type为image，图片数据放在Source中；
+// 工具调用的Type为tool_use，工具结果的Type为tool_result，结果文本放在Content中
+type ContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Source    *ImageSource    `json:"source,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+// ImageSource 定义图像源结构体，Type为base64时图片数据放在Data中，为url时放在URL中
 type ImageSource struct {
 	Type      string `json:"type"`
 	MediaType string `json:"media_type"`
 	Data      string `json:"data"`
+	URL       string `json:"url,omitempty"`
 }
 
 // Message 定义消息结构体
@@ -59,16 +114,20 @@ type ToolInputSchema struct {
 	Required   []string               `json:"required,omitempty"`
 }
 
+// Tool 定义工具，InputSchema直接使用OpenAI function的parameters，为空时使用ToolInputSchema；
+// Type为空或者custom时为自定义工具，其他为Anthropic提供的服务端工具
 type Tool struct {
-	Name        string          `json:"name"`
-	Description string          `json:"description,omitempty"`
-	InputSchema ToolInputSchema `json:"input_schema"`
+	Type        string      `json:"type,omitempty"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	InputSchema interface{} `json:"input_schema"`
 }
 
 // ToolChoice 定义工具选择结构体
 type ToolChoice struct {
-	Type string `json:"type"` // 可选值："tool"
-	Name string `json:"name"` // 工具名称
+	Type                   string `json:"type"`                                // 可选值：auto、any、tool、none
+	Name                   string `json:"name,omitempty"`                      // 工具名称，Type为tool时必填
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"` // 只允许调用一个工具
 }
 
 // RequestBody 定义请求体结构体
@@ -80,9 +139,15 @@ type RequestBody struct {
 	StopSequences []string    `json:"stop_sequences,omitempty"`
 	Stream        bool        `json:"stream"`
 	System        string      `json:"system,omitempty"`
-	Temperature   float32     `json:"temperature"`
+	Temperature   float32     `json:"temperature,omitempty"`
 	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
 	Tools         []Tool      `json:"tools,omitempty"`
 	TopK          int         `json:"top_k,omitempty"`
 	TopP          float32     `json:"top_p,omitempty"`
 }
+
+// MessagesRequest 客户端按Anthropic格式请求/v1/messages的请求体，system可以是字符串或者内容块数组
+type MessagesRequest struct {
+	RequestBody
+	System json.RawMessage `json:"system,omitempty"`
+}
@@ -1,5 +1,7 @@
 package claude
 
+import "encoding/json"
+
 type StopReasonType string
 
 const (
@@ -9,9 +11,13 @@ const (
 	ToolUse      StopReasonType = "tool_use"
 )
 
+// RespContent 响应的内容块，Type为tool_use时ID、Name和Input为工具调用
 type RespContent struct {
-	Type string `json:"type"`
-	Text string `json:"text,omitempty"`
+	Type  string          `json:"type"`
+	Text  string          `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
 }
 
 type ResponseBody struct {
@@ -3,6 +3,7 @@ package baidu_agentbuilder
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -102,8 +103,8 @@ func fetchAccessTokenFromAPI(clientID, clientSecret string) (*AccessToken, error
 	}, nil
 }
 
-// getAnswer 函数实现
-func GetAnswer(agentID, secretKey, question string) (*GetAnswerResponse, error) {
+// getAnswer 函数实现，client为nil时使用默认的http.Client
+func GetAnswer(ctx context.Context, client *http.Client, agentID, secretKey, question string) (*GetAnswerResponse, error) {
 	url := fmt.Sprintf("https://agentapi.baidu.com/assistant/getAnswer?appId=%s&secretKey=%s", agentID, secretKey)
 
 	// 构建请求内容
@@ -128,24 +129,26 @@ func GetAnswer(agentID, secretKey, question string) (*GetAnswerResponse, error)
 	}
 
 	// 创建 POST 请求
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// 发送请求
-	client := &http.Client{}
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// 读取响应
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	// 解析响应 JSON
@@ -163,8 +166,8 @@ func GetAnswer(agentID, secretKey, question string) (*GetAnswerResponse, error)
 	return &response, nil
 }
 
-// conversation 函数实现
-func Conversation(agentID, secretKey, question string, callBack func(data string)) error {
+// conversation 函数实现，client为nil时使用默认的http.Client
+func Conversation(ctx context.Context, client *http.Client, agentID, secretKey, question string, callBack func(data string)) error {
 	url := fmt.Sprintf("https://agentapi.baidu.com/assistant/conversation?appId=%s&secretKey=%s", agentID, secretKey)
 
 	requestBody := ConversationRequest{
@@ -186,16 +189,18 @@ func Conversation(agentID, secretKey, question string, callBack func(data string
 		return fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -210,7 +215,7 @@ func Conversation(agentID, secretKey, question string, callBack func(data string
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading stream: %v", err)
+		return fmt.Errorf("error reading stream: %w", err)
 	}
 
 	return nil
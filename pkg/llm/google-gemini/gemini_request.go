@@ -1,10 +1,35 @@
 package google_gemini
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
+// Part 内容的一部分，文本、内嵌数据、文件、函数调用和函数结果只有一个不为空
 type Part struct {
-	Text       string `json:"text,omitempty"`
-	InlineData *Blob  `json:"inlineData,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// FileData 通过URI引用的文件
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+// FunctionCall 模型返回的函数调用，Args为JSON对象
+type FunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// FunctionResponse 客户端返回的函数执行结果
+type FunctionResponse struct {
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response,omitempty"`
 }
 
 // Blob 表示内嵌的媒体字节数据
@@ -15,7 +40,7 @@ type Blob struct {
 
 // Entry represents a single entry in the conversation.
 type ContentEntity struct {
-	Role  string `json:"role"`
+	Role  string `json:"role,omitempty"`
 	Parts []Part `json:"parts"`
 }
 
@@ -30,12 +55,40 @@ type GenerationConfig struct {
 	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
 	TopP            float32  `json:"topP,omitempty"`
 	TopK            int      `json:"topK,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"`
+	// ResponseMimeType 为application/json时要求输出JSON
+	ResponseMimeType string `json:"responseMimeType,omitempty"`
+}
+
+// FunctionDeclaration 函数的定义，Parameters为OpenAPI格式的schema，type为大写
+type FunctionDeclaration struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+// FunctionCallingConfig Mode为AUTO、ANY或NONE，ANY时只能调用AllowedFunctionNames中的函数
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
 }
 
+// GeminiRequest generateContent的请求体，system消息放在SystemInstruction中，其Role为空
 type GeminiRequest struct {
-	Contents         []ContentEntity  `json:"contents"`
-	SafetySettings   []SafetySetting  `json:"safetySettings,omitempty"`
-	GenerationConfig GenerationConfig `json:"generationConfig,omitempty"`
+	Contents          []ContentEntity  `json:"contents"`
+	SystemInstruction *ContentEntity   `json:"systemInstruction,omitempty"`
+	SafetySettings    []SafetySetting  `json:"safetySettings,omitempty"`
+	GenerationConfig  GenerationConfig `json:"generationConfig,omitempty"`
+	Tools             []Tool           `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig      `json:"toolConfig,omitempty"`
 }
 
 func (b Blob) GoString() string {
@@ -21,8 +21,16 @@ type UsageMetadata struct {
 	TotalTokenCount      int `json:"totalTokenCount"`
 }
 
-// GeminiResponse 定义总体响应结构
+// PromptFeedback 输入被安全策略拦截时BlockReason不为空，此时没有Candidates
+type PromptFeedback struct {
+	BlockReason   string         `json:"blockReason,omitempty"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
+}
+
+// GeminiResponse 定义总体响应结构，流式响应的每个分片也是这个结构，UsageMetadata为累计值
 type GeminiResponse struct {
-	Candidates    []Candidate   `json:"candidates"`
-	UsageMetadata UsageMetadata `json:"usageMetadata"`
+	Candidates     []Candidate     `json:"candidates"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  UsageMetadata   `json:"usageMetadata"`
+	ModelVersion   string          `json:"modelVersion,omitempty"`
 }
@@ -1,12 +1,44 @@
 package ollama
 
+import "encoding/json"
+
+// ChatRequest /api/chat的请求，KeepAlive可以是"10m"这样的时长或者秒数，
+// ExtraOptions为AdvancedModelOptions之外的模型参数，序列化时合并到options中
 type ChatRequest struct {
-	Model     string               `json:"model"`
-	Messages  []Message            `json:"messages"`
-	Stream    bool                 `json:"stream"`
-	Format    string               `json:"format,omitempty"`
-	Options   AdvancedModelOptions `json:"options,omitempty"`
-	KeepAlive string               `json:"keep_alive,omitempty"`
+	Model        string                 `json:"model"`
+	Messages     []Message              `json:"messages"`
+	Stream       bool                   `json:"stream"`
+	Format       interface{}            `json:"format,omitempty"` // "json"或者JSON Schema对象
+	Options      AdvancedModelOptions   `json:"options,omitempty"`
+	KeepAlive    interface{}            `json:"keep_alive,omitempty"`
+	ExtraOptions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON 自定义JSON序列化，Options中已经设置的参数优先
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	type Alias ChatRequest
+	if len(r.ExtraOptions) == 0 {
+		return json.Marshal((Alias)(r))
+	}
+
+	data, err := json.Marshal(r.Options)
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]interface{}, len(r.ExtraOptions))
+	for k, v := range r.ExtraOptions {
+		options[k] = v
+	}
+	if err = json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&struct {
+		Alias
+		Options map[string]interface{} `json:"options,omitempty"`
+	}{
+		Alias:   (Alias)(r),
+		Options: options,
+	})
 }
 
 type Message struct {
@@ -16,17 +48,17 @@ type Message struct {
 }
 
 type AdvancedModelOptions struct {
-	Temperature   float32 `json:"temperature,omitempty"`
-	Seed          int     `json:"seed,omitempty"`
-	Mirostat      int     `json:"mirostat,omitempty"`
-	MirostatEta   float32 `json:"mirostat_eta,omitempty"`
-	MirostatTau   float32 `json:"mirostat_tau,omitempty"`
-	NumCtx        int     `json:"num_ctx,omitempty"`
-	RepeatLastN   int     `json:"repeat_last_n,omitempty"`
-	RepeatPenalty float32 `json:"repeat_penalty,omitempty"`
-	Stop          string  `json:"stop,omitempty"`
-	TfsZ          float32 `json:"tfs_z,omitempty"`
-	NumPredict    int     `json:"num_predict,omitempty"`
-	TopK          int     `json:"top_k,omitempty"`
-	TopP          float32 `json:"top_p,omitempty"`
+	Temperature   float32  `json:"temperature,omitempty"`
+	Seed          int      `json:"seed,omitempty"`
+	Mirostat      int      `json:"mirostat,omitempty"`
+	MirostatEta   float32  `json:"mirostat_eta,omitempty"`
+	MirostatTau   float32  `json:"mirostat_tau,omitempty"`
+	NumCtx        int      `json:"num_ctx,omitempty"`
+	RepeatLastN   int      `json:"repeat_last_n,omitempty"`
+	RepeatPenalty float32  `json:"repeat_penalty,omitempty"`
+	Stop          []string `json:"stop,omitempty"`
+	TfsZ          float32  `json:"tfs_z,omitempty"`
+	NumPredict    int      `json:"num_predict,omitempty"`
+	TopK          int      `json:"top_k,omitempty"`
+	TopP          float32  `json:"top_p,omitempty"`
 }
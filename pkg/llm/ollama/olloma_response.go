@@ -5,12 +5,14 @@ type ChatResponse struct {
 	CreatedAt          string      `json:"created_at"`
 	Message            ChatMessage `json:"message"`
 	Done               bool        `json:"done"`
+	DoneReason         string      `json:"done_reason,omitempty"`
 	TotalDuration      int64       `json:"total_duration"`
 	LoadDuration       int64       `json:"load_duration"`
 	PromptEvalCount    int         `json:"prompt_eval_count"`
 	PromptEvalDuration int64       `json:"prompt_eval_duration"`
 	EvalCount          int         `json:"eval_count"`
 	EvalDuration       int64       `json:"eval_duration"`
+	Error              string      `json:"error,omitempty"`
 }
 
 type ChatMessage struct {
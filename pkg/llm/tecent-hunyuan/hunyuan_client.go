@@ -0,0 +1,149 @@
+package tecent_hunyuan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	hunyuan "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/hunyuan/v20230901"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultServerURL 混元接口的地址，服务配置了server_url时替换
+const DefaultServerURL = "https://hunyuan.tencentcloudapi.com"
+
+const (
+	apiVersion            = "2023-09-01"
+	actionChatCompletions = "ChatCompletions"
+)
+
+// ResponseError 腾讯云API返回的错误，如AuthFailure.SignatureFailure
+type ResponseError struct {
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("hunyuan error, code: %s, message: %s, request_id: %s", e.Code, e.Message, e.RequestID)
+}
+
+type errorResponse struct {
+	Response struct {
+		Error     *HunYuannResponseError `json:"Error"`
+		RequestID string                 `json:"RequestId"`
+	} `json:"Response"`
+}
+
+// parseError 返回响应中的错误，没有错误时返回nil
+func parseError(body []byte) error {
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Response.Error == nil {
+		return nil
+	}
+	return &ResponseError{Code: errResp.Response.Error.Code, Message: errResp.Response.Error.Message, RequestID: errResp.Response.RequestID}
+}
+
+// sendRequest 调用ChatCompletions，签名由client的Transport完成
+func sendRequest(ctx context.Context, client *http.Client, serverURL string, req *hunyuan.ChatCompletionsRequest) (*http.Response, error) {
+	if serverURL == "" {
+		serverURL = DefaultServerURL
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-TC-Action", actionChatCompletions)
+	httpReq.Header.Set("X-TC-Version", apiVersion)
+	return client.Do(httpReq)
+}
+
+// ChatCompletions 非流式请求
+func ChatCompletions(ctx context.Context, client *http.Client, serverURL string, req *hunyuan.ChatCompletionsRequest) (*hunyuan.ChatCompletionsResponse, error) {
+	res, err := sendRequest(ctx, client, serverURL, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseError(body); err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response code: %d, body: %s", res.StatusCode, body)
+	}
+
+	var resp hunyuan.ChatCompletionsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Response == nil {
+		return nil, fmt.Errorf("invalid hunyuan response: %s", body)
+	}
+	return &resp, nil
+}
+
+// ChatCompletionsStream 流式请求，每个SSE事件调用一次callback，callback返回错误时停止读取。
+// 请求出错时返回的是JSON而不是SSE
+func ChatCompletionsStream(ctx context.Context, client *http.Client, serverURL string, req *hunyuan.ChatCompletionsRequest, callback func(id string, data []byte) error) error {
+	res, err := sendRequest(ctx, client, serverURL, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if err := parseError(body); err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected hunyuan stream response, status: %d, body: %s", res.StatusCode, body)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var id string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if err := callback(id, data); err != nil {
+					return err
+				}
+			}
+			id, data = "", nil
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return callback(id, data)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package xunfei_speech
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTTSURL = "wss://tts-api.xfyun.cn/v2/tts"
+	DefaultIATURL = "wss://iat-api.xfyun.cn/v2/iat"
+)
+
+// 讯飞接口中数据帧的状态
+const (
+	statusFirst    = 0
+	statusContinue = 1
+	statusLast     = 2
+)
+
+// iat建议每40ms发送1280字节（16k采样率16bit的40ms音频）
+const (
+	iatFrameSize     = 1280
+	iatFrameInterval = 40 * time.Millisecond
+)
+
+// Client 讯飞语音合成和语音听写的websocket客户端，与星火大模型使用同一组appid、api_key和api_secret
+type Client struct {
+	AppID     string
+	APIKey    string
+	APISecret string
+	Transport *http.Transport
+}
+
+// Error 讯飞接口返回的错误
+type Error struct {
+	Code    int
+	Message string
+	SID     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("xunfei error, code: %d, message: %s, sid: %s", e.Code, e.Message, e.SID)
+}
+
+// assembleAuthURL 按讯飞的鉴权规则对host、date和request-line签名，签名结果放在URL的查询参数中
+func (c *Client) assembleAuthURL(hostURL string) (string, error) {
+	u, err := url.Parse(hostURL)
+	if err != nil {
+		return "", err
+	}
+	date := time.Now().UTC().Format(time.RFC1123)
+	signString := "host: " + u.Host + "\ndate: " + date + "\nGET " + u.Path + " HTTP/1.1"
+	mac := hmac.New(sha256.New, []byte(c.APISecret))
+	mac.Write([]byte(signString))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	authorization := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`api_key="%s", algorithm="hmac-sha256", headers="host date request-line", signature="%s"`, c.APIKey, signature)))
+
+	v := url.Values{}
+	v.Add("host", u.Host)
+	v.Add("date", date)
+	v.Add("authorization", authorization)
+	return hostURL + "?" + v.Encode(), nil
+}
+
+func (c *Client) dial(ctx context.Context, hostURL string) (*websocket.Conn, error) {
+	authURL, err := c.assembleAuthURL(hostURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	if c.Transport != nil {
+		dialer.Proxy = c.Transport.Proxy
+		// 共用的Transport开启HTTP/2后NextProtos中有h2，websocket只能使用http/1.1
+		if tlsConfig := c.Transport.TLSClientConfig; tlsConfig != nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = nil
+			dialer.TLSClientConfig = tlsConfig
+		}
+	}
+	conn, resp, err := dialer.DialContext(ctx, authURL, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("xunfei handshake failed, status code: %d: %w", resp.StatusCode, err)
+		}
+		return nil, err
+	}
+
+	// context取消时关闭连接，结束阻塞的读写
+	context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, nil
+}
+
+// TTSRequest 语音合成的参数，Speed、Volume、Pitch为0-100，为0时使用默认值50
+type TTSRequest struct {
+	Text   string
+	Voice  string
+	Speed  int
+	Volume int
+	Pitch  int
+	// Encoding raw为16k采样率16bit的pcm，lame为mp3
+	Encoding string
+}
+
+type ttsResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	SID     string `json:"sid"`
+	Data    *struct {
+		Audio  string `json:"audio"`
+		Status int    `json:"status"`
+	} `json:"data"`
+}
+
+func defaultLevel(v int) int {
+	if v <= 0 {
+		return 50
+	}
+	return min(v, 100)
+}
+
+// Synthesize 合成语音，每收到一段音频调用一次onAudio，返回第一个分片前出错时没有调用过onAudio
+func (c *Client) Synthesize(ctx context.Context, serverURL string, req *TTSRequest, onAudio func([]byte) error) error {
+	if serverURL == "" {
+		serverURL = DefaultTTSURL
+	}
+	conn, err := c.dial(ctx, serverURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	business := map[string]interface{}{
+		"aue":    req.Encoding,
+		"auf":    "audio/L16;rate=16000",
+		"vcn":    req.Voice,
+		"speed":  defaultLevel(req.Speed),
+		"volume": defaultLevel(req.Volume),
+		"pitch":  defaultLevel(req.Pitch),
+		"tte":    "UTF8",
+	}
+	if req.Encoding == "lame" {
+		business["sfl"] = 1
+	}
+	frame := map[string]interface{}{
+		"common":   map[string]string{"app_id": c.AppID},
+		"business": business,
+		"data": map[string]interface{}{
+			"status": statusLast,
+			"text":   base64.StdEncoding.EncodeToString([]byte(req.Text)),
+		},
+	}
+	if err = conn.WriteJSON(frame); err != nil {
+		return err
+	}
+
+	for {
+		var resp ttsResponse
+		if err = conn.ReadJSON(&resp); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if resp.Code != 0 {
+			return &Error{Code: resp.Code, Message: resp.Message, SID: resp.SID}
+		}
+		if resp.Data == nil {
+			continue
+		}
+		if resp.Data.Audio != "" {
+			audio, err := base64.StdEncoding.DecodeString(resp.Data.Audio)
+			if err != nil {
+				return err
+			}
+			if err = onAudio(audio); err != nil {
+				return err
+			}
+		}
+		if resp.Data.Status == statusLast {
+			return nil
+		}
+	}
+}
+
+// IATRequest 语音听写的参数
+type IATRequest struct {
+	Audio []byte
+	// Format 如audio/L16;rate=16000，Encoding raw为pcm，lame为mp3
+	Format   string
+	Encoding string
+	// Language zh_cn或en_us
+	Language string
+}
+
+type iatResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	SID     string `json:"sid"`
+	Data    *struct {
+		Status int `json:"status"`
+		Result *struct {
+			SN int `json:"sn"`
+			WS []struct {
+				CW []struct {
+					W string `json:"w"`
+				} `json:"cw"`
+			} `json:"ws"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// Recognize 识别一段音频，返回识别出的文本，讯飞按实时音频处理，音频时长不超过60秒
+func (c *Client) Recognize(ctx context.Context, serverURL string, req *IATRequest) (string, error) {
+	if serverURL == "" {
+		serverURL = DefaultIATURL
+	}
+	conn, err := c.dial(ctx, serverURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	language := req.Language
+	if language == "" {
+		language = "zh_cn"
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- c.sendAudio(ctx, conn, req, language)
+	}()
+
+	var sb strings.Builder
+	for {
+		var resp iatResponse
+		if err = conn.ReadJSON(&resp); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			select {
+			case e := <-sendErr:
+				if e != nil {
+					return "", e
+				}
+			default:
+			}
+			return "", err
+		}
+		if resp.Code != 0 {
+			return "", &Error{Code: resp.Code, Message: resp.Message, SID: resp.SID}
+		}
+		if resp.Data == nil {
+			continue
+		}
+		if resp.Data.Result != nil {
+			for _, ws := range resp.Data.Result.WS {
+				if len(ws.CW) > 0 {
+					sb.WriteString(ws.CW[0].W)
+				}
+			}
+		}
+		if resp.Data.Status == statusLast {
+			return sb.String(), nil
+		}
+	}
+}
+
+// sendAudio 按讯飞建议的帧大小和间隔发送音频，第一帧带上common和business参数
+func (c *Client) sendAudio(ctx context.Context, conn *websocket.Conn, req *IATRequest, language string) error {
+	audio := req.Audio
+	if len(audio) == 0 {
+		return errors.New("audio is empty")
+	}
+
+	for status := statusFirst; ; status = statusContinue {
+		n := min(iatFrameSize, len(audio))
+		data := map[string]interface{}{
+			"status":   status,
+			"format":   req.Format,
+			"encoding": req.Encoding,
+			"audio":    base64.StdEncoding.EncodeToString(audio[:n]),
+		}
+		audio = audio[n:]
+
+		frame := map[string]interface{}{"data": data}
+		if status == statusFirst {
+			frame["common"] = map[string]string{"app_id": c.AppID}
+			frame["business"] = map[string]interface{}{"language": language, "domain": "iat", "accent": "mandarin"}
+		}
+		if err := conn.WriteJSON(frame); err != nil {
+			return err
+		}
+		if len(audio) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(iatFrameInterval):
+		}
+	}
+
+	return conn.WriteJSON(map[string]interface{}{
+		"data": map[string]interface{}{"status": statusLast, "format": req.Format, "encoding": req.Encoding, "audio": ""},
+	})
+}
@@ -0,0 +1,208 @@
+package myaudit
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sync"
+	"time"
+)
+
+// Record 一次请求的审计记录，Prompt和Response只在include_content开启时保存
+type Record struct {
+	ID               int64  `json:"id"`
+	Timestamp        int64  `json:"timestamp"`
+	RequestID        string `json:"request_id"`
+	KeyName          string `json:"key_name"`
+	ClientModel      string `json:"client_model"`
+	Model            string `json:"model"`
+	ServiceName      string `json:"service_name"`
+	Stream           bool   `json:"stream"`
+	StatusCode       int    `json:"status_code"`
+	LatencyMs        int64  `json:"latency_ms"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	Prompt           string `json:"prompt,omitempty"`
+	Response         string `json:"response,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Query 查询条件，Start和End为unix时间戳（秒），为0时不限制；Keyword在prompt、response和error中查找
+type Query struct {
+	Start       int64
+	End         int64
+	KeyName     string
+	Model       string
+	ServiceName string
+	StatusCode  int
+	Keyword     string
+	Page        int
+	PageSize    int
+}
+
+// Store 审计记录的持久化存储，Query按时间倒序返回一页记录和符合条件的总数
+type Store interface {
+	Insert(ctx context.Context, records []*Record) error
+	Query(ctx context.Context, q *Query) ([]*Record, int, error)
+	Close() error
+}
+
+const (
+	writeBatchSize     = 100
+	writeFlushInterval = time.Second
+	writeTimeout       = 10 * time.Second
+)
+
+var (
+	store          Store
+	auditConf      *config.AuditConf
+	redactPatterns []*regexp.Regexp
+	writeCh        chan *Record
+	writeMu        sync.RWMutex
+	writeWg        sync.WaitGroup
+)
+
+// Enabled 是否开启了审计日志
+func Enabled() bool {
+	return store != nil
+}
+
+// IncludeContent 是否保存完整的请求和响应
+func IncludeContent() bool {
+	return auditConf != nil && auditConf.IncludeContent
+}
+
+// Init 按配置打开存储，记录异步写入
+func Init(conf *config.AuditConf) error {
+	if conf == nil || !conf.Enable {
+		return nil
+	}
+
+	var patterns []*regexp.Regexp
+	for _, p := range conf.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid audit redact pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	s, err := newStore(conf)
+	if err != nil {
+		return err
+	}
+
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = config.DefaultAuditQueueSize
+	}
+	store = s
+	auditConf = conf
+	redactPatterns = patterns
+	writeCh = make(chan *Record, queueSize)
+
+	writeWg.Add(1)
+	go runWriter()
+
+	mylog.Logger.Info("audit log enabled", zap.String("store", conf.Store), zap.Bool("include_content", conf.IncludeContent))
+	return nil
+}
+
+// Redact 按redact_patterns替换内容，并按max_content_length截断
+func Redact(s string) string {
+	for _, re := range redactPatterns {
+		s = re.ReplaceAllString(s, "[REDACTED]")
+	}
+	if maxLen := auditConf.MaxContentLength; maxLen > 0 {
+		if runes := []rune(s); len(runes) > maxLen {
+			s = string(runes[:maxLen]) + "...(truncated)"
+		}
+	}
+	return s
+}
+
+// AddRecord 队列满时丢弃并记录日志
+func AddRecord(r *Record) {
+	writeMu.RLock()
+	defer writeMu.RUnlock()
+	if writeCh == nil {
+		return
+	}
+
+	select {
+	case writeCh <- r:
+	default:
+		mylog.Logger.Warn("audit queue is full, record dropped", zap.String("request_id", r.RequestID), zap.String("model", r.ClientModel))
+	}
+}
+
+// runWriter 攒够一批或者每秒写入一次
+func runWriter() {
+	defer writeWg.Done()
+
+	ticker := time.NewTicker(writeFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Record, 0, writeBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		if err := store.Insert(ctx, batch); err != nil {
+			mylog.Logger.Error("write audit records failed", zap.Int("records", len(batch)), zap.Error(err))
+		}
+		cancel()
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case r, ok := <-writeCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= writeBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// QueryRecords 查询审计记录，page从1开始，page_size默认为20，最大为200
+func QueryRecords(ctx context.Context, q *Query) ([]*Record, int, error) {
+	if q.Page <= 0 {
+		q.Page = 1
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = config.DefaultAuditPageSize
+	}
+	if q.PageSize > config.DefaultAuditMaxPageSize {
+		q.PageSize = config.DefaultAuditMaxPageSize
+	}
+	return store.Query(ctx, q)
+}
+
+// Close 写入队列中剩余的记录后关闭存储
+func Close() {
+	writeMu.Lock()
+	if writeCh == nil {
+		writeMu.Unlock()
+		return
+	}
+	close(writeCh)
+	writeCh = nil
+	writeMu.Unlock()
+	writeWg.Wait()
+
+	if err := store.Close(); err != nil {
+		mylog.Logger.Error("close audit store failed", zap.Error(err))
+	}
+}
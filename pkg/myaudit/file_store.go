@@ -0,0 +1,161 @@
+package myaudit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"strings"
+	"sync"
+)
+
+func newStore(conf *config.AuditConf) (Store, error) {
+	switch strings.ToLower(conf.Store) {
+	case "", "file":
+		path := conf.Path
+		if path == "" {
+			path = config.DefaultAuditPath
+		}
+		return newFileStore(path)
+	case "sqlite", "mysql", "postgres":
+		return newSQLStore(conf)
+	}
+	return nil, errors.New("unsupported audit store: " + conf.Store)
+}
+
+// fileStore 每条记录一行json追加写入文件，查询时从头读取整个文件，适合记录量不大的场景
+type fileStore struct {
+	path   string
+	mu     sync.Mutex
+	file   *os.File
+	nextID int64
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &fileStore{path: path, nextID: 1}
+
+	// 继续使用已有文件中最大的id
+	err := s.scan(func(r *Record) {
+		if r.ID >= s.nextID {
+			s.nextID = r.ID + 1
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *fileStore) Insert(ctx context.Context, records []*Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sb strings.Builder
+	for _, r := range records {
+		r.ID = s.nextID
+		s.nextID++
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		sb.Write(data)
+		sb.WriteByte('\n')
+	}
+	_, err := s.file.WriteString(sb.String())
+	return err
+}
+
+func (s *fileStore) Query(ctx context.Context, q *Query) ([]*Record, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []*Record
+	err := s.scan(func(r *Record) {
+		if matchQuery(r, q) {
+			matched = append(matched, r)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 文件中按写入顺序保存，倒序后分页
+	total := len(matched)
+	start := total - (q.Page-1)*q.PageSize
+	end := start - q.PageSize
+	if end < 0 {
+		end = 0
+	}
+	var list []*Record
+	for i := start - 1; i >= end; i-- {
+		list = append(list, matched[i])
+	}
+	return list, total, nil
+}
+
+// scan 依次读取文件中的记录，文件不存在时不返回错误，无法解析的行跳过
+func (s *fileStore) scan(fn func(r *Record)) error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if json.Unmarshal(scanner.Bytes(), &r) == nil {
+			fn(&r)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func matchQuery(r *Record, q *Query) bool {
+	if q.Start > 0 && r.Timestamp < q.Start {
+		return false
+	}
+	if q.End > 0 && r.Timestamp > q.End {
+		return false
+	}
+	if q.KeyName != "" && r.KeyName != q.KeyName {
+		return false
+	}
+	if q.Model != "" && r.ClientModel != q.Model && r.Model != q.Model {
+		return false
+	}
+	if q.ServiceName != "" && r.ServiceName != q.ServiceName {
+		return false
+	}
+	if q.StatusCode != 0 && r.StatusCode != q.StatusCode {
+		return false
+	}
+	if q.Keyword != "" && !strings.Contains(r.Prompt, q.Keyword) && !strings.Contains(r.Response, q.Keyword) && !strings.Contains(r.Error, q.Keyword) {
+		return false
+	}
+	return true
+}
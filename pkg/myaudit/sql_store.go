@@ -0,0 +1,189 @@
+package myaudit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"strconv"
+	"strings"
+)
+
+// defaultSQLDrivers 各类型默认使用的database/sql驱动名，程序中需要引入对应的驱动，
+// 如 _ "github.com/mattn/go-sqlite3"、_ "github.com/go-sql-driver/mysql" 或 _ "github.com/lib/pq"
+var defaultSQLDrivers = map[string]string{
+	"sqlite":   "sqlite3",
+	"mysql":    "mysql",
+	"postgres": "postgres",
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+const auditColumns = `created_at, request_id, key_name, client_model, model, service_name, stream, status_code,
+	latency_ms, prompt_tokens, completion_tokens, prompt, response, error`
+
+type sqlStore struct {
+	db       *sql.DB
+	table    string
+	postgres bool
+}
+
+func newSQLStore(conf *config.AuditConf) (Store, error) {
+	storeType := strings.ToLower(conf.Store)
+	driver := conf.Driver
+	if driver == "" {
+		driver = defaultSQLDrivers[storeType]
+	}
+	table := conf.Table
+	if table == "" {
+		table = config.DefaultAuditTable
+	}
+	if !tableNameRegexp.MatchString(table) {
+		return nil, fmt.Errorf("invalid audit table name: %s", table)
+	}
+
+	db, err := sql.Open(driver, conf.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open audit database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect audit database: %w", err)
+	}
+
+	id, text := "id INTEGER PRIMARY KEY AUTOINCREMENT", "TEXT"
+	switch storeType {
+	case "mysql":
+		id, text = "id BIGINT PRIMARY KEY AUTO_INCREMENT", "MEDIUMTEXT"
+	case "postgres":
+		id = "id BIGSERIAL PRIMARY KEY"
+	}
+	createStmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	%s,
+	created_at BIGINT NOT NULL,
+	request_id VARCHAR(128),
+	key_name VARCHAR(128),
+	client_model VARCHAR(128),
+	model VARCHAR(128),
+	service_name VARCHAR(64),
+	stream BOOLEAN,
+	status_code INT,
+	latency_ms BIGINT,
+	prompt_tokens INT,
+	completion_tokens INT,
+	prompt %s,
+	response %s,
+	error %s
+)`, table, id, text, text, text)
+	if _, err = db.Exec(createStmt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create audit table: %w", err)
+	}
+	// 按时间查询最常用，索引已存在时部分数据库会报错，忽略
+	db.Exec(fmt.Sprintf(`CREATE INDEX idx_%s_created_at ON %s (created_at)`, table, table))
+
+	return &sqlStore{db: db, table: table, postgres: storeType == "postgres"}, nil
+}
+
+// rebind postgres的占位符为$1、$2
+func (s *sqlStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
+
+// Insert 一个批次在同一个事务中写入
+func (s *sqlStore) Insert(ctx context.Context, records []*Record) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, s.rebind(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, s.table, auditColumns)))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err = stmt.ExecContext(ctx, r.Timestamp, r.RequestID, r.KeyName, r.ClientModel, r.Model, r.ServiceName, r.Stream, r.StatusCode,
+			r.LatencyMs, r.PromptTokens, r.CompletionTokens, r.Prompt, r.Response, r.Error); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Query(ctx context.Context, q *Query) ([]*Record, int, error) {
+	var conds []string
+	var args []interface{}
+	if q.Start > 0 {
+		conds, args = append(conds, "created_at >= ?"), append(args, q.Start)
+	}
+	if q.End > 0 {
+		conds, args = append(conds, "created_at <= ?"), append(args, q.End)
+	}
+	if q.KeyName != "" {
+		conds, args = append(conds, "key_name = ?"), append(args, q.KeyName)
+	}
+	if q.Model != "" {
+		conds, args = append(conds, "(client_model = ? OR model = ?)"), append(args, q.Model, q.Model)
+	}
+	if q.ServiceName != "" {
+		conds, args = append(conds, "service_name = ?"), append(args, q.ServiceName)
+	}
+	if q.StatusCode != 0 {
+		conds, args = append(conds, "status_code = ?"), append(args, q.StatusCode)
+	}
+	if q.Keyword != "" {
+		like := "%" + q.Keyword + "%"
+		conds, args = append(conds, "(prompt LIKE ? OR response LIKE ? OR error LIKE ?)"), append(args, like, like, like)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM `+s.table+where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(fmt.Sprintf(`SELECT id, %s FROM %s%s ORDER BY id DESC LIMIT ? OFFSET ?`, auditColumns, s.table, where)),
+		append(args, q.PageSize, (q.Page-1)*q.PageSize)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var list []*Record
+	for rows.Next() {
+		var r Record
+		var requestID, keyName, clientModel, model, serviceName, prompt, response, errMsg sql.NullString
+		if err = rows.Scan(&r.ID, &r.Timestamp, &requestID, &keyName, &clientModel, &model, &serviceName, &r.Stream, &r.StatusCode,
+			&r.LatencyMs, &r.PromptTokens, &r.CompletionTokens, &prompt, &response, &errMsg); err != nil {
+			return nil, 0, err
+		}
+		r.RequestID, r.KeyName, r.ClientModel, r.Model, r.ServiceName = requestID.String, keyName.String, clientModel.String, model.String, serviceName.String
+		r.Prompt, r.Response, r.Error = prompt.String, response.String, errMsg.String
+		list = append(list, &r)
+	}
+	return list, total, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
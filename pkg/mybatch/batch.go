@@ -0,0 +1,148 @@
+package mybatch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxMetadataPairs 与OpenAI一致，metadata最多16个键值对
+const maxMetadataPairs = 16
+
+// job 等待执行或者正在执行的任务，api key只保存在内存中，用于在服务内部发送每一行请求
+type job struct {
+	apikey string
+	cancel context.CancelFunc
+}
+
+var (
+	jobs    = make(map[string]*job)
+	pending []string
+	wake    = make(chan struct{}, 1)
+)
+
+func unixPtr(t time.Time) *int64 {
+	v := t.Unix()
+	return &v
+}
+
+// CreateBatch 创建任务并加入队列，apikey为创建任务的请求使用的key，执行每一行请求时使用同一个key
+func CreateBatch(owner string, apikey string, req *CreateBatchRequest) (*Batch, error) {
+	if !SupportedEndpoints[req.Endpoint] {
+		return nil, fmt.Errorf("unsupported endpoint %q, supported endpoints are /v1/chat/completions and /v1/embeddings", req.Endpoint)
+	}
+	if req.CompletionWindow == "" {
+		req.CompletionWindow = CompletionWindow
+	}
+	if req.CompletionWindow != CompletionWindow {
+		return nil, fmt.Errorf("completion_window must be %s", CompletionWindow)
+	}
+	if len(req.Metadata) > maxMetadataPairs {
+		return nil, fmt.Errorf("metadata can have at most %d pairs", maxMetadataPairs)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	f, exists := files[req.InputFileID]
+	if !exists || f.Owner != owner {
+		return nil, ErrFileNotFound
+	}
+	if f.Purpose != PurposeBatch {
+		return nil, fmt.Errorf("file %s must be uploaded with purpose %s", f.ID, PurposeBatch)
+	}
+
+	now := time.Now()
+	b := &Batch{
+		ID:               newID("batch_"),
+		Object:           "batch",
+		Endpoint:         req.Endpoint,
+		InputFileID:      req.InputFileID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           StatusValidating,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+		Metadata:         req.Metadata,
+		Owner:            owner,
+	}
+	batches[b.ID] = b
+	saveBatch(b)
+
+	jobs[b.ID] = &job{apikey: apikey}
+	pending = append(pending, b.ID)
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+
+	cp := *b
+	return &cp, nil
+}
+
+// GetBatch 返回owner的任务
+func GetBatch(owner string, id string) (*Batch, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	b, exists := batches[id]
+	if !exists || b.Owner != owner {
+		return nil, ErrBatchNotFound
+	}
+	cp := *b
+	return &cp, nil
+}
+
+// ListBatches 按创建时间从新到旧返回owner的任务，after为上一页最后一个任务的id
+func ListBatches(owner string, after string, limit int) ([]*Batch, bool) {
+	mu.Lock()
+	list := make([]*Batch, 0)
+	for _, b := range batches {
+		if b.Owner == owner {
+			cp := *b
+			list = append(list, &cp)
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID > list[j].ID
+	})
+	if after != "" {
+		for i, b := range list {
+			if b.ID == after {
+				list = list[i+1:]
+				break
+			}
+		}
+	}
+	if len(list) > limit {
+		return list[:limit], true
+	}
+	return list, false
+}
+
+// CancelBatch 取消任务，已经发送的请求执行完后任务状态变为cancelled，已完成的结果仍然可以下载
+func CancelBatch(owner string, id string) (*Batch, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	b, exists := batches[id]
+	if !exists || b.Owner != owner {
+		return nil, ErrBatchNotFound
+	}
+	switch b.Status {
+	case StatusValidating, StatusInProgress:
+		b.Status = StatusCancelling
+		b.CancellingAt = unixPtr(time.Now())
+		saveBatch(b)
+		if j := jobs[id]; j != nil && j.cancel != nil {
+			j.cancel()
+		}
+	case StatusCancelling:
+	default:
+		return nil, fmt.Errorf("batch %s is %s and can not be cancelled", id, b.Status)
+	}
+	cp := *b
+	return &cp, nil
+}
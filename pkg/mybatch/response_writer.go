@@ -0,0 +1,41 @@
+package mybatch
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseWriter 保存HTTP处理函数返回的状态码和响应，任务中的请求都是非流式的
+type responseWriter struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func newResponseWriter() *responseWriter {
+	return &responseWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = statusCode
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(data)
+}
+
+func (rw *responseWriter) Flush() {}
+
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	return make(chan bool, 1)
+}
@@ -0,0 +1,326 @@
+package mybatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFileNotFound  = errors.New("file not found")
+	ErrBatchNotFound = errors.New("batch not found")
+	ErrFileTooLarge  = errors.New("file is too large")
+)
+
+// fileRecord、batchRecord 保存到磁盘的格式，比接口返回的对象多了owner
+type fileRecord struct {
+	File
+	Owner string `json:"owner"`
+}
+
+type batchRecord struct {
+	Batch
+	Owner string `json:"owner"`
+}
+
+var (
+	enabled     bool
+	baseDir     string
+	concurrency int
+	maxFileSize int64
+
+	mu      sync.Mutex
+	files   = make(map[string]*File)
+	batches = make(map[string]*Batch)
+)
+
+// Enabled 是否开启了Batch API
+func Enabled() bool {
+	return enabled
+}
+
+// Init 按配置创建目录并加载已有的文件和任务，上次退出时没有结束的任务在Start时处理
+func Init(conf *config.BatchConf) error {
+	if conf == nil || !conf.Enable {
+		return nil
+	}
+
+	baseDir = conf.Dir
+	if baseDir == "" {
+		baseDir = config.DefaultBatchDir
+	}
+	concurrency = conf.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.DefaultBatchConcurrency
+	}
+	size := conf.MaxFileSize
+	if size <= 0 {
+		size = config.DefaultBatchMaxFileSize
+	}
+	maxFileSize = int64(size) << 20
+
+	for _, dir := range []string{filesDir(), batchesDir()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err := loadFiles(); err != nil {
+		return err
+	}
+	if err := loadBatches(); err != nil {
+		return err
+	}
+	enabled = true
+	return nil
+}
+
+func filesDir() string {
+	return filepath.Join(baseDir, "files")
+}
+
+func batchesDir() string {
+	return filepath.Join(baseDir, "batches")
+}
+
+func fileContentPath(id string) string {
+	return filepath.Join(filesDir(), id)
+}
+
+func fileMetaPath(id string) string {
+	return filepath.Join(filesDir(), id+".json")
+}
+
+func batchPath(id string) string {
+	return filepath.Join(batchesDir(), id+".json")
+}
+
+// batchResultPath 任务执行过程中追加写入结果的临时文件，任务结束时转为结果文件
+func batchResultPath(id string, kind string) string {
+	return filepath.Join(batchesDir(), id+"."+kind+".jsonl")
+}
+
+func newID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+func loadFiles() error {
+	paths, err := filepath.Glob(filepath.Join(filesDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var rec fileRecord
+		if err = readJSON(path, &rec); err != nil {
+			mylog.Logger.Warn("skip invalid batch file meta", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		f := rec.File
+		f.Owner = rec.Owner
+		files[f.ID] = &f
+	}
+	return nil
+}
+
+func loadBatches() error {
+	paths, err := filepath.Glob(filepath.Join(batchesDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var rec batchRecord
+		if err = readJSON(path, &rec); err != nil {
+			mylog.Logger.Warn("skip invalid batch", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		b := rec.Batch
+		b.Owner = rec.Owner
+		batches[b.ID] = &b
+	}
+	return nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON 先写入临时文件再替换，避免进程退出时留下写了一半的状态
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func saveFile(f *File) error {
+	return writeJSON(fileMetaPath(f.ID), &fileRecord{File: *f, Owner: f.Owner})
+}
+
+// saveBatch 调用时需要持有mu
+func saveBatch(b *Batch) {
+	if err := writeJSON(batchPath(b.ID), &batchRecord{Batch: *b, Owner: b.Owner}); err != nil {
+		mylog.Logger.Error("save batch", zap.String("batch_id", b.ID), zap.Error(err))
+	}
+}
+
+// CreateFile 保存上传的文件，超过max_file_size时返回ErrFileTooLarge
+func CreateFile(owner string, filename string, purpose string, r io.Reader) (*File, error) {
+	if purpose != PurposeBatch {
+		return nil, fmt.Errorf("purpose must be %s", PurposeBatch)
+	}
+	f := &File{
+		ID:        newID("file-"),
+		Object:    "file",
+		CreatedAt: time.Now().Unix(),
+		Filename:  filepath.Base(filename),
+		Purpose:   purpose,
+		Owner:     owner,
+	}
+
+	out, err := os.OpenFile(fileContentPath(f.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, maxFileSize+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > maxFileSize {
+		err = ErrFileTooLarge
+	}
+	if err == nil {
+		f.Bytes = n
+		err = saveFile(f)
+	}
+	if err != nil {
+		os.Remove(fileContentPath(f.ID))
+		return nil, err
+	}
+
+	mu.Lock()
+	files[f.ID] = f
+	mu.Unlock()
+	return f, nil
+}
+
+// createResultFile 把任务的临时结果文件转为可以下载的文件，没有内容时返回nil，调用时需要持有mu
+func createResultFile(b *Batch, kind string) *string {
+	path := batchResultPath(b.ID, kind)
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() == 0 {
+		os.Remove(path)
+		return nil
+	}
+	f := &File{
+		ID:        newID("file-"),
+		Object:    "file",
+		Bytes:     fi.Size(),
+		CreatedAt: time.Now().Unix(),
+		Filename:  b.ID + "_" + kind + ".jsonl",
+		Purpose:   PurposeBatchOutput,
+		Owner:     b.Owner,
+	}
+	if err = os.Rename(path, fileContentPath(f.ID)); err == nil {
+		err = saveFile(f)
+	}
+	if err != nil {
+		mylog.Logger.Error("create batch result file", zap.String("batch_id", b.ID), zap.String("kind", kind), zap.Error(err))
+		return nil
+	}
+	files[f.ID] = f
+	return &f.ID
+}
+
+// GetFile 返回owner的文件
+func GetFile(owner string, id string) (*File, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	f, exists := files[id]
+	if !exists || f.Owner != owner {
+		return nil, ErrFileNotFound
+	}
+	cp := *f
+	return &cp, nil
+}
+
+// ListFiles 按创建时间从新到旧返回owner的文件，purpose为空时返回所有文件
+func ListFiles(owner string, purpose string) []*File {
+	mu.Lock()
+	result := make([]*File, 0)
+	for _, f := range files {
+		if f.Owner == owner && (purpose == "" || f.Purpose == purpose) {
+			cp := *f
+			result = append(result, &cp)
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CreatedAt != result[j].CreatedAt {
+			return result[i].CreatedAt > result[j].CreatedAt
+		}
+		return result[i].ID > result[j].ID
+	})
+	return result
+}
+
+// OpenFileContent 打开owner的文件内容
+func OpenFileContent(owner string, id string) (*File, *os.File, error) {
+	f, err := GetFile(owner, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := os.Open(fileContentPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, content, nil
+}
+
+// DeleteFile 删除owner的文件，还没有结束的任务的输入文件不能删除
+func DeleteFile(owner string, id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	f, exists := files[id]
+	if !exists || f.Owner != owner {
+		return ErrFileNotFound
+	}
+	for _, b := range batches {
+		if b.InputFileID == id && b.isActive() {
+			return fmt.Errorf("file %s is used by batch %s which is still %s", id, b.ID, b.Status)
+		}
+	}
+	if err := os.Remove(fileMetaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(fileContentPath(id))
+	delete(files, id)
+	return nil
+}
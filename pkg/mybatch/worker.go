@@ -0,0 +1,356 @@
+package mybatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mylog"
+	"sync"
+	"time"
+)
+
+// maxValidationErrors 输入文件校验失败时最多返回的错误数
+const maxValidationErrors = 100
+
+// saveInterval 执行过程中保存请求数的最小间隔
+const saveInterval = time.Second
+
+var engine http.Handler
+
+// Start 开始依次执行队列中的任务，handler为HTTP服务的路由，每一行请求都交给它处理，鉴权、限流、路由和模型适配与HTTP接口一致。
+// api key没有保存到磁盘，上次退出时没有结束的任务无法继续执行，按失败处理，已完成的结果仍然可以下载
+func Start(handler http.Handler) {
+	if !enabled {
+		return
+	}
+	engine = handler
+
+	mu.Lock()
+	for _, b := range batches {
+		if b.isActive() && jobs[b.ID] == nil {
+			mylog.Logger.Warn("batch interrupted by restart", zap.String("batch_id", b.ID), zap.String("status", b.Status))
+			b.RequestCounts.Completed = countLines(batchResultPath(b.ID, "output"))
+			b.RequestCounts.Failed = countLines(batchResultPath(b.ID, "error"))
+			b.Errors = &BatchErrors{Object: "list", Data: []BatchError{{
+				Code:    "batch_interrupted",
+				Message: "the service restarted before the batch finished",
+			}}}
+			finishBatch(b, StatusFailed)
+		}
+	}
+	mu.Unlock()
+
+	go runJobs()
+}
+
+func countLines(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// finishBatch 生成结果文件并把任务设置为结束的状态，调用时需要持有mu
+func finishBatch(b *Batch, status string) {
+	b.OutputFileID = createResultFile(b, "output")
+	b.ErrorFileID = createResultFile(b, "error")
+	b.Status = status
+	now := unixPtr(time.Now())
+	switch status {
+	case StatusCompleted:
+		b.CompletedAt = now
+	case StatusFailed:
+		b.FailedAt = now
+	case StatusExpired:
+		b.ExpiredAt = now
+	case StatusCancelled:
+		b.CancelledAt = now
+	}
+	delete(jobs, b.ID)
+	saveBatch(b)
+	mylog.Logger.Info("batch finished", zap.String("batch_id", b.ID), zap.String("status", status),
+		zap.Int("total", b.RequestCounts.Total), zap.Int("completed", b.RequestCounts.Completed), zap.Int("failed", b.RequestCounts.Failed))
+}
+
+func runJobs() {
+	for {
+		runJob(nextJob())
+	}
+}
+
+func nextJob() string {
+	for {
+		mu.Lock()
+		if len(pending) > 0 {
+			id := pending[0]
+			pending = pending[1:]
+			mu.Unlock()
+			return id
+		}
+		mu.Unlock()
+		<-wake
+	}
+}
+
+func runJob(id string) {
+	mu.Lock()
+	b, j := batches[id], jobs[id]
+	if b == nil || j == nil {
+		mu.Unlock()
+		return
+	}
+	if b.Status == StatusCancelling {
+		finishBatch(b, StatusCancelled)
+		mu.Unlock()
+		return
+	}
+	deadline := time.Unix(b.ExpiresAt, 0)
+	if time.Now().After(deadline) {
+		finishBatch(b, StatusExpired)
+		mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	j.cancel = cancel
+	inputFileID, endpoint := b.InputFileID, b.Endpoint
+	mu.Unlock()
+
+	lines, errs := validateInput(inputFileID, endpoint)
+
+	mu.Lock()
+	if b.Status == StatusCancelling {
+		finishBatch(b, StatusCancelled)
+		mu.Unlock()
+		return
+	}
+	if len(errs) > 0 {
+		b.Errors = &BatchErrors{Object: "list", Data: errs}
+		finishBatch(b, StatusFailed)
+		mu.Unlock()
+		return
+	}
+	b.Status = StatusInProgress
+	b.InProgressAt = unixPtr(time.Now())
+	b.RequestCounts.Total = len(lines)
+	saveBatch(b)
+	mu.Unlock()
+
+	mylog.Logger.Info("batch started", zap.String("batch_id", id), zap.Int("total", len(lines)))
+	finished := processLines(ctx, b, j.apikey, lines)
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case b.Status == StatusCancelling:
+		finishBatch(b, StatusCancelled)
+	case !finished:
+		finishBatch(b, StatusExpired)
+	default:
+		b.Status = StatusFinalizing
+		b.FinalizingAt = unixPtr(time.Now())
+		saveBatch(b)
+		finishBatch(b, StatusCompleted)
+	}
+}
+
+// validateInput 读取并校验输入文件，每行需要有唯一的custom_id，method为POST，url与任务的endpoint一致，body中有model
+func validateInput(fileID string, endpoint string) ([]*inputLine, []BatchError) {
+	f, err := os.Open(fileContentPath(fileID))
+	if err != nil {
+		return nil, []BatchError{{Code: "file_not_found", Message: fmt.Sprintf("input file %s not found", fileID)}}
+	}
+	defer f.Close()
+
+	var lines []*inputLine
+	var errs []BatchError
+	addError := func(lineNo int, code string, param string, message string) {
+		if len(errs) < maxValidationErrors {
+			errs = append(errs, BatchError{Code: code, Message: message, Param: param, Line: lineNo})
+		}
+	}
+
+	seen := make(map[string]bool)
+	reader := bufio.NewReader(f)
+	lineNo := 0
+	for {
+		data, readErr := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			lineNo++
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var line inputLine
+			switch err = json.Unmarshal(data, &line); {
+			case err != nil:
+				addError(lineNo, "invalid_json_line", "", "this line is not valid JSON: "+err.Error())
+			case line.CustomID == "":
+				addError(lineNo, "missing_required_parameter", "custom_id", "custom_id is required")
+			case seen[line.CustomID]:
+				addError(lineNo, "duplicate_custom_id", "custom_id", "custom_id "+line.CustomID+" is duplicated")
+			case line.Method != http.MethodPost:
+				addError(lineNo, "invalid_method", "method", "method must be POST")
+			case line.URL != endpoint:
+				addError(lineNo, "mismatched_endpoint", "url", "url must be the same as the batch endpoint "+endpoint)
+			case line.Body == nil:
+				addError(lineNo, "missing_required_parameter", "body", "body is required")
+			default:
+				if model, _ := line.Body["model"].(string); model == "" {
+					addError(lineNo, "missing_required_parameter", "body.model", "body.model is required")
+					break
+				}
+				seen[line.CustomID] = true
+				lines = append(lines, &line)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, []BatchError{{Code: "file_read_error", Message: readErr.Error()}}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(lines) == 0 {
+		return nil, []BatchError{{Code: "empty_file", Message: "input file contains no requests"}}
+	}
+	if len(lines) > config.DefaultBatchMaxRequests {
+		return nil, []BatchError{{Code: "too_many_requests", Message: fmt.Sprintf("input file can contain at most %d requests", config.DefaultBatchMaxRequests)}}
+	}
+	return lines, nil
+}
+
+// processLines 同时发送concurrency个请求，成功的结果写入output，失败的写入error；
+// 取消或者超过completion_window后不再发送新的请求，返回是否所有请求都已完成
+func processLines(ctx context.Context, b *Batch, apikey string, lines []*inputLine) bool {
+	output, err := os.OpenFile(batchResultPath(b.ID, "output"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		mylog.Logger.Error("open batch output", zap.String("batch_id", b.ID), zap.Error(err))
+		return false
+	}
+	defer output.Close()
+	errOutput, err := os.OpenFile(batchResultPath(b.ID, "error"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		mylog.Logger.Error("open batch error output", zap.String("batch_id", b.ID), zap.Error(err))
+		return false
+	}
+	defer errOutput.Close()
+
+	var wg sync.WaitGroup
+	var writeMu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	lastSave := time.Now()
+	dispatched := 0
+
+dispatch:
+	for _, line := range lines {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		dispatched++
+		wg.Add(1)
+		go func(line *inputLine) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, ok := doRequest(apikey, line)
+			data, _ := json.Marshal(result)
+			w := output
+			if !ok {
+				w = errOutput
+			}
+			writeMu.Lock()
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				mylog.Logger.Error("write batch result", zap.String("batch_id", b.ID), zap.String("custom_id", line.CustomID), zap.Error(err))
+			}
+			writeMu.Unlock()
+
+			mu.Lock()
+			if ok {
+				b.RequestCounts.Completed++
+			} else {
+				b.RequestCounts.Failed++
+			}
+			if time.Since(lastSave) >= saveInterval {
+				saveBatch(b)
+				lastSave = time.Now()
+			}
+			mu.Unlock()
+		}(line)
+	}
+	wg.Wait()
+	return dispatched == len(lines)
+}
+
+// doRequest 在服务内部发送一行请求，返回结果和是否成功，对话请求总是使用非流式
+func doRequest(apikey string, line *inputLine) (*outputLine, bool) {
+	result := &outputLine{ID: newID("batch_req_"), CustomID: line.CustomID}
+
+	if line.URL == "/v1/chat/completions" {
+		delete(line.Body, "stream")
+		delete(line.Body, "stream_options")
+	}
+	body, err := json.Marshal(line.Body)
+	if err == nil {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, line.URL, bytes.NewReader(body)); err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(mycomdef.KEYNAME_HEADER_REQUEST_ID, result.ID)
+			if apikey != "" {
+				req.Header.Set("Authorization", "Bearer "+apikey)
+			}
+
+			rw := newResponseWriter()
+			engine.ServeHTTP(rw, req)
+
+			var respBody interface{}
+			if json.Unmarshal(rw.body.Bytes(), &respBody) != nil {
+				respBody = rw.body.String()
+			}
+			result.Response = &outputResponse{
+				StatusCode: rw.status,
+				RequestID:  rw.header.Get(mycomdef.KEYNAME_HEADER_REQUEST_ID),
+				Body:       respBody,
+			}
+			if rw.status >= http.StatusOK && rw.status < http.StatusMultipleChoices {
+				return result, true
+			}
+			result.Error = responseError(rw.status, respBody)
+			return result, false
+		}
+	}
+	result.Error = &outputError{Code: "invalid_request", Message: err.Error()}
+	return result, false
+}
+
+// responseError 按OpenAI的错误格式取出code和message，没有code时使用状态码
+func responseError(status int, body interface{}) *outputError {
+	e := &outputError{Code: fmt.Sprintf("http_%d", status), Message: http.StatusText(status)}
+	m, _ := body.(map[string]interface{})
+	errObj, _ := m["error"].(map[string]interface{})
+	if code, ok := errObj["code"].(string); ok && code != "" {
+		e.Code = code
+	}
+	if message, ok := errObj["message"].(string); ok && message != "" {
+		e.Message = message
+	} else if message, ok := m["error"].(string); ok && message != "" {
+		e.Message = message
+	}
+	return e
+}
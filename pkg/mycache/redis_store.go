@@ -0,0 +1,50 @@
+package mycache
+
+import (
+	"go.uber.org/zap"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/myredis"
+	"strconv"
+	"time"
+)
+
+const ResponseStoreRedis = "redis"
+
+// RedisStore 使用Redis保存响应，多个实例可以共用同一份缓存，使用GET和SET PX命令，
+// Redis不可用时按未命中处理并输出日志，不影响请求
+type RedisStore struct {
+	client    *myredis.Client
+	keyPrefix string
+}
+
+func NewRedisStore(addr, password string, db int, keyPrefix string) *RedisStore {
+	return &RedisStore{
+		client:    myredis.NewClient(addr, password, db),
+		keyPrefix: keyPrefix,
+	}
+}
+
+// Ping 检查Redis是否可以连接，初始化时调用，配置错误时尽早发现
+func (s *RedisStore) Ping() error {
+	return s.client.Ping()
+}
+
+func (s *RedisStore) Get(key string) ([]byte, bool) {
+	v, err := s.client.Do("GET", s.keyPrefix+key)
+	if err != nil {
+		mylog.Logger.Warn("redis response cache get", zap.String("addr", s.client.Addr()), zap.Error(err))
+		return nil, false
+	}
+	data, ok := v.([]byte)
+	return data, ok
+}
+
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return
+	}
+	if _, err := s.client.Do("SET", s.keyPrefix+key, string(value), "PX", strconv.FormatInt(ms, 10)); err != nil {
+		mylog.Logger.Warn("redis response cache set", zap.String("addr", s.client.Addr()), zap.Error(err))
+	}
+}
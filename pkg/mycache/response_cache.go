@@ -0,0 +1,64 @@
+package mycache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/config"
+	"time"
+)
+
+// CachedResponse 缓存的一次成功响应
+type CachedResponse struct {
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	CreatedAt        time.Time
+}
+
+// responseCache 上游失败时返回的响应，max_age较长，超过DefaultStaleOnErrorMaxEntries时淘汰最久没有访问的
+var responseCache = NewLRUStore(config.DefaultStaleOnErrorMaxEntries)
+
+// GetRequestKey 根据租户、实际查找服务的模型以及请求内容生成缓存的key，不同租户、使用不同服务的请求不共用缓存，是否流式不影响key
+func GetRequestKey(req *openai.ChatCompletionRequest, tenant string, serviceModel string) string {
+	keyReq := *req
+	keyReq.Stream = false
+	keyReq.StreamOptions = nil
+
+	data, err := json.Marshal(keyReq)
+	if err != nil {
+		return ""
+	}
+	scope, _ := json.Marshal([]string{tenant, serviceModel})
+	sum := sha256.Sum256(append(append(scope, '\n'), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+func SetResponse(key string, resp *CachedResponse, ttl time.Duration) {
+	if key == "" {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	responseCache.Set(key, data, ttl)
+}
+
+func GetResponse(key string) (*CachedResponse, bool) {
+	if key == "" {
+		return nil, false
+	}
+	data, found := responseCache.Get(key)
+	if !found {
+		return nil, false
+	}
+	var resp CachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
@@ -0,0 +1,107 @@
+package mycache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"simple-one-api/pkg/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseStore 缓存完整响应体的存储，默认使用内存中的LRU，其他存储（如Redis）实现该接口即可
+type ResponseStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+const ResponseStoreMemory = "memory"
+
+var responseStore ResponseStore
+
+// InitResponseStore 按backend创建响应缓存的存储，backend为空时使用内存
+func InitResponseStore(conf *config.ResponseCacheConf) error {
+	switch strings.ToLower(conf.Backend) {
+	case "", ResponseStoreMemory:
+		maxEntries := conf.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = config.DefaultResponseCacheMaxEntries
+		}
+		responseStore = NewLRUStore(maxEntries)
+		return nil
+	case ResponseStoreRedis:
+		if conf.Redis.Addr == "" {
+			return errors.New("response cache redis addr is empty")
+		}
+		keyPrefix := conf.Redis.KeyPrefix
+		if keyPrefix == "" {
+			keyPrefix = config.DefaultResponseCacheRedisKeyPrefix
+		}
+		store := NewRedisStore(conf.Redis.Addr, conf.Redis.Password, conf.Redis.DB, keyPrefix)
+		if err := store.Ping(); err != nil {
+			return fmt.Errorf("connect response cache redis: %w", err)
+		}
+		responseStore = store
+		return nil
+	}
+	return fmt.Errorf("unsupported response cache backend: %s", conf.Backend)
+}
+
+// GetResponseStore 获取响应缓存的存储，没有初始化时返回nil
+func GetResponseStore() ResponseStore {
+	return responseStore
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// LRUStore 超过maxEntries时淘汰最久没有访问的响应，过期的响应在读取时删除
+type LRUStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewLRUStore(maxEntries int) *LRUStore {
+	return &LRUStore{maxEntries: maxEntries, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *LRUStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, exists := s.items[key]
+	if !exists {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.ll.Remove(elem)
+		delete(s.items, key)
+		return nil, false
+	}
+	s.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (s *LRUStore) Set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt := time.Now().Add(ttl)
+	if elem, exists := s.items[key]; exists {
+		entry := elem.Value.(*lruEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		s.ll.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.ll.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for s.maxEntries > 0 && s.ll.Len() > s.maxEntries {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,443 @@
+package mychatws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chatCompletionsPath = "/v1/chat/completions"
+
+const (
+	FrameTypeRequest  = "request"
+	FrameTypeCancel   = "cancel"
+	FrameTypeChunk    = "chunk"
+	FrameTypeResponse = "response"
+	FrameTypeDone     = "done"
+	FrameTypeError    = "error"
+)
+
+// writeTimeout 写入一帧的最长时间，客户端长时间不读取时断开连接
+const writeTimeout = 10 * time.Second
+
+// 客户端使用Authorization请求头鉴权，不依赖Cookie，允许所有来源
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// sessions 当前的连接，关闭服务时等待这些连接上的请求结束
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[*session]struct{})
+	draining   bool
+)
+
+// 不转发给对话接口的请求头，每个请求单独生成X-Request-ID，在返回的帧中作为request_id
+var skipHeaders = map[string]bool{
+	"Connection":      true,
+	"Upgrade":         true,
+	"Content-Length":  true,
+	"Content-Type":    true,
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"X-Request-Id":    true,
+}
+
+// clientFrame 客户端发送的帧，type为request（默认）时request为对话接口的请求体，type为cancel时取消id对应的请求
+type clientFrame struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Request json.RawMessage `json:"request"`
+}
+
+// serverFrame 返回给客户端的帧，流式请求的每个分片为chunk，结束时为done；非流式请求为response；失败时为error
+type serverFrame struct {
+	Type      string      `json:"type"`
+	ID        string      `json:"id"`
+	RequestID string      `json:"request_id,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     interface{} `json:"error,omitempty"`
+}
+
+// session 一个WebSocket连接，同一连接上可以同时进行多个请求，按id区分
+type session struct {
+	conn    *websocket.Conn
+	handler http.Handler
+	header  http.Header
+	remote  string
+	ctx     context.Context
+	limit   int
+	// idleTimeout 超过这个时间没有收到任何消息（包括pong）时断开连接
+	idleTimeout time.Duration
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// Handler 返回/v1/chat/ws的处理函数，每个请求转换为HTTP请求交给handler（HTTP服务的路由）处理，
+// 鉴权、限流、审核、路由和模型适配与HTTP接口完全一致
+func Handler(handler http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isDraining() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": gin.H{"message": "server is shutting down", "type": "server_error"}})
+			return
+		}
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			mylog.Logger.Warn("chat ws upgrade failed", zap.Error(err))
+			return
+		}
+		defer conn.Close()
+
+		conf := &config.GetConf().ChatWS
+		maxMessageSize := conf.MaxMessageSize
+		if maxMessageSize <= 0 {
+			maxMessageSize = config.DefaultChatWSMaxMessageSize
+		}
+		limit := conf.MaxConcurrency
+		if limit <= 0 {
+			limit = config.DefaultChatWSMaxConcurrency
+		}
+		pingInterval := conf.PingInterval
+		if pingInterval <= 0 {
+			pingInterval = config.DefaultChatWSPingInterval
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &session{
+			conn:        conn,
+			handler:     handler,
+			header:      c.Request.Header.Clone(),
+			remote:      c.Request.RemoteAddr,
+			ctx:         ctx,
+			limit:       limit,
+			idleTimeout: 2 * time.Duration(pingInterval) * time.Second,
+			running:     make(map[string]context.CancelFunc),
+		}
+		sessionsMu.Lock()
+		sessions[s] = struct{}{}
+		sessionsMu.Unlock()
+		defer func() {
+			sessionsMu.Lock()
+			delete(sessions, s)
+			sessionsMu.Unlock()
+			cancel()
+			s.wg.Wait()
+		}()
+
+		conn.SetReadLimit(maxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		})
+		go s.keepAlive(time.Duration(pingInterval) * time.Second)
+
+		mylog.Logger.Info("chat ws connected", zap.String("remote_addr", s.remote))
+		s.readLoop()
+		mylog.Logger.Info("chat ws disconnected", zap.String("remote_addr", s.remote))
+	}
+}
+
+func isDraining() bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return draining
+}
+
+// Shutdown 不再接受新的连接和请求，等待进行中的请求结束或ctx结束后关闭所有连接，未完成的请求被取消
+func Shutdown(ctx context.Context) {
+	sessionsMu.Lock()
+	draining = true
+	sessionsMu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for activeRequests() > 0 {
+		select {
+		case <-ctx.Done():
+			mylog.Logger.Warn("chat ws drain timeout", zap.Int("active_requests", activeRequests()))
+			closeSessions()
+			return
+		case <-ticker.C:
+		}
+	}
+	closeSessions()
+}
+
+func activeRequests() int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	n := 0
+	for s := range sessions {
+		s.mu.Lock()
+		n += len(s.running)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// closeSessions 通知客户端服务关闭后断开连接，readLoop退出后取消剩余的请求
+func closeSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	for s := range sessions {
+		s.writeMu.Lock()
+		s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		s.writeMu.Unlock()
+		s.conn.Close()
+	}
+}
+
+// keepAlive 定期发送ping，避免代理关闭空闲连接，客户端没有响应时由读取超时断开连接
+func (s *session) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *session) readLoop() {
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				mylog.Logger.Debug("chat ws read", zap.String("remote_addr", s.remote), zap.Error(err))
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+
+		var frame clientFrame
+		if err := json.Unmarshal(message, &frame); err != nil {
+			s.sendError("", http.StatusBadRequest, "invalid frame: "+err.Error())
+			continue
+		}
+		switch frame.Type {
+		case "", FrameTypeRequest:
+			s.startRequest(&frame)
+		case FrameTypeCancel:
+			s.cancelRequest(frame.ID)
+		default:
+			s.sendError(frame.ID, http.StatusBadRequest, "unknown frame type: "+frame.Type)
+		}
+	}
+}
+
+func (s *session) startRequest(frame *clientFrame) {
+	if len(frame.Request) == 0 || frame.Request[0] != '{' {
+		s.sendError(frame.ID, http.StatusBadRequest, "request is required")
+		return
+	}
+	id := frame.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if isDraining() {
+		s.sendError(id, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.running[id]; exists {
+		s.mu.Unlock()
+		s.sendError(id, http.StatusBadRequest, "request id is already in use")
+		return
+	}
+	if len(s.running) >= s.limit {
+		s.mu.Unlock()
+		s.sendError(id, http.StatusTooManyRequests, "too many concurrent requests on this connection")
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.running[id] = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, id)
+			s.mu.Unlock()
+			cancel()
+		}()
+		s.serveRequest(ctx, id, frame.Request)
+	}()
+}
+
+func (s *session) cancelRequest(id string) {
+	s.mu.Lock()
+	cancel, exists := s.running[id]
+	s.mu.Unlock()
+	if !exists {
+		s.sendError(id, http.StatusNotFound, "request not found")
+		return
+	}
+	cancel()
+}
+
+// serveRequest 交给对话接口处理，流式响应按行解析SSE，每个分片作为一帧返回
+func (s *session) serveRequest(ctx context.Context, id string, body []byte) {
+	var params struct {
+		Stream bool `json:"stream"`
+	}
+	json.Unmarshal(body, &params)
+
+	requestID := uuid.New().String()
+	httpReq, err := s.newHTTPRequest(ctx, body, params.Stream, requestID)
+	if err != nil {
+		s.sendError(id, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	w := newResponseWriter(ctx, pw)
+	go func() {
+		defer pw.Close()
+		s.handler.ServeHTTP(w, httpReq)
+	}()
+
+	var buf bytes.Buffer
+	reader := bufio.NewReaderSize(pr, 64*1024)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			// 出错和非流式时返回的是JSON而不是SSE，读取完整的内容
+			if status := w.getStatus(); status >= http.StatusBadRequest || !params.Stream {
+				buf.Write(line)
+			} else if done := s.sendEvent(id, requestID, line); done {
+				io.Copy(io.Discard, reader)
+				return
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	if status := w.getStatus(); status >= http.StatusBadRequest {
+		s.send(&serverFrame{Type: FrameTypeError, ID: id, RequestID: requestID, Status: status, Error: getErrorObject(buf.Bytes())})
+		return
+	}
+	if ctx.Err() != nil {
+		s.send(&serverFrame{Type: FrameTypeError, ID: id, RequestID: requestID, Error: gin.H{"message": "request cancelled", "type": "request_cancelled"}})
+		return
+	}
+	if !params.Stream {
+		s.send(&serverFrame{Type: FrameTypeResponse, ID: id, RequestID: requestID, Data: json.RawMessage(bytes.TrimSpace(buf.Bytes()))})
+		return
+	}
+	s.send(&serverFrame{Type: FrameTypeDone, ID: id, RequestID: requestID})
+}
+
+// sendEvent 处理一行SSE，收到[DONE]或错误事件时发送结束帧并返回true
+func (s *session) sendEvent(id string, requestID string, line []byte) bool {
+	data := bytes.TrimSpace(line)
+	if !bytes.HasPrefix(data, []byte("data:")) {
+		return false
+	}
+	data = bytes.TrimSpace(data[len("data:"):])
+	if string(data) == "[DONE]" {
+		s.send(&serverFrame{Type: FrameTypeDone, ID: id, RequestID: requestID})
+		return true
+	}
+	if !json.Valid(data) {
+		mylog.Logger.Warn("chat ws skip invalid stream event", zap.ByteString("data", data))
+		return false
+	}
+	if bytes.HasPrefix(data, []byte(`{"error"`)) {
+		s.send(&serverFrame{Type: FrameTypeError, ID: id, RequestID: requestID, Status: http.StatusInternalServerError, Error: getErrorObject(data)})
+		return true
+	}
+	s.send(&serverFrame{Type: FrameTypeChunk, ID: id, Data: json.RawMessage(data)})
+	return false
+}
+
+// getErrorObject 取出错误响应中的error对象，不是JSON时作为message
+func getErrorObject(body []byte) interface{} {
+	var errResp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && len(errResp.Error) > 0 && errResp.Error[0] == '{' {
+		return errResp.Error
+	}
+	return gin.H{"message": strings.TrimSpace(string(body))}
+}
+
+func (s *session) newHTTPRequest(ctx context.Context, body []byte, stream bool, requestID string) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, chatCompletionsPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// 升级请求的请求头按对话请求的请求头处理，例如Authorization、X-Conversation-ID
+	for key, values := range s.header {
+		if skipHeaders[key] || strings.HasPrefix(key, "Sec-Websocket-") {
+			continue
+		}
+		for _, v := range values {
+			httpReq.Header.Add(key, v)
+		}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(mycomdef.KEYNAME_HEADER_REQUEST_ID, requestID)
+	if stream {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	} else {
+		httpReq.Header.Set("Accept", "application/json")
+	}
+	httpReq.RemoteAddr = s.remote
+	return httpReq, nil
+}
+
+func (s *session) sendError(id string, status int, message string) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+	s.send(&serverFrame{Type: FrameTypeError, ID: id, Status: status, Error: gin.H{"message": message, "type": errType}})
+}
+
+// send 同一连接同时只能有一个写入
+func (s *session) send(frame *serverFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		mylog.Logger.Error("chat ws marshal frame", zap.Error(err))
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		mylog.Logger.Debug("chat ws write", zap.String("remote_addr", s.remote), zap.Error(err))
+	}
+}
@@ -0,0 +1,62 @@
+package mychatws
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// responseWriter 把HTTP处理函数的输出写入w，实现gin流式输出需要的Flusher和CloseNotifier，请求取消或连接断开时通知处理函数
+type responseWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	header http.Header
+
+	mu          sync.Mutex
+	status      int
+	wroteHeader bool
+}
+
+func newResponseWriter(ctx context.Context, w io.Writer) *responseWriter {
+	return &responseWriter{ctx: ctx, w: w, header: http.Header{}}
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = statusCode
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.w.Write(data)
+}
+
+func (rw *responseWriter) getStatus() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if !rw.wroteHeader {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+func (rw *responseWriter) Flush() {}
+
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		<-rw.ctx.Done()
+		ch <- true
+	}()
+	return ch
+}
@@ -14,3 +14,42 @@ const KEYNAME_RAND = "rand"
 const KEYNAME_ROUND_ROBIN = "round-robin"
 const KEYNAME_RR = "rr"
 const KEYNAME_HASH = "hash"
+const KEYNAME_LEAST_ACTIVE = "least_active"
+const KEYNAME_COST_LATENCY = "cost_latency"
+const KEYNAME_WEIGHTED = "weighted"
+
+const KEYNAME_HEADER_TIMEOUT = "X-Timeout-Seconds"
+
+// KEYNAME_HEADER_REQUEST_ID 请求中带有该字段时使用其值作为请求ID，否则生成一个新的，并在响应中返回
+const KEYNAME_HEADER_REQUEST_ID = "X-Request-ID"
+
+const KEYNAME_HEADER_TIME_QUEUE = "X-Time-Queue"
+const KEYNAME_HEADER_TIME_UPSTREAM = "X-Time-Upstream"
+const KEYNAME_HEADER_TIME_TOTAL = "X-Time-Total"
+
+const KEYNAME_HEADER_CACHE = "X-Cache"
+const KEYNAME_CACHE_STALE = "STALE"
+
+const KEYNAME_HEADER_RESPONSE_CACHE = "X-SimpleOneAPI-Cache"
+const KEYNAME_CACHE_HIT = "HIT"
+const KEYNAME_CACHE_MISS = "MISS"
+const KEYNAME_CACHE_BYPASS = "BYPASS"
+
+const KEYNAME_HEADER_BACKEND_PREFERENCE = "X-Backend-Preference"
+
+const KEYNAME_HEADER_UPSTREAM_MODEL = "X-Upstream-Model"
+
+const KEYNAME_HEADER_CONVERSATION_ID = "X-Conversation-ID"
+
+// KEYNAME_HEADER_DEBUG 开启debug模式时，请求头中带有该字段会在响应中返回发送给上游的请求
+const KEYNAME_HEADER_DEBUG = "X-Debug"
+
+// 与OpenAI一致的限流响应头，只在客户端key配置了rpm或tpm时返回
+const KEYNAME_HEADER_RATELIMIT_LIMIT_REQUESTS = "X-Ratelimit-Limit-Requests"
+const KEYNAME_HEADER_RATELIMIT_REMAINING_REQUESTS = "X-Ratelimit-Remaining-Requests"
+const KEYNAME_HEADER_RATELIMIT_LIMIT_TOKENS = "X-Ratelimit-Limit-Tokens"
+const KEYNAME_HEADER_RATELIMIT_REMAINING_TOKENS = "X-Ratelimit-Remaining-Tokens"
+
+// KEYNAME_HEADER_COST 配置了pricing时返回按模型价格计算的费用，流式响应通过trailer返回
+const KEYNAME_HEADER_COST = "X-Simple-One-Api-Cost"
+const KEYNAME_HEADER_COST_CURRENCY = "X-Simple-One-Api-Cost-Currency"
@@ -0,0 +1,136 @@
+package mycommon
+
+import (
+	"container/list"
+	"simple-one-api/pkg/config"
+	"sync"
+	"time"
+)
+
+// ModelUsage 一个模型累计的token用量
+type ModelUsage struct {
+	Requests         int `json:"requests"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ConversationUsage 一个会话累计的token用量，Models按实际使用的模型拆分
+type ConversationUsage struct {
+	ConversationID string                 `json:"conversation_id"`
+	Total          ModelUsage             `json:"total"`
+	Models         map[string]*ModelUsage `json:"models"`
+	UpdatedAt      int64                  `json:"updated_at"`
+}
+
+// conversationUsages 中的元素按更新时间排列在conversationUsageList中，最近更新的在前面
+var (
+	conversationUsages    = make(map[string]*list.Element)
+	conversationUsageList = list.New()
+	conversationUsagesMu  sync.Mutex
+	lastUsageSweep        time.Time
+)
+
+func getConversationUsageTTL() time.Duration {
+	ttl := config.GetConf().ConversationUsage.TTL
+	if ttl <= 0 {
+		ttl = config.DefaultConversationUsageTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func getConversationUsageMaxEntries() int {
+	maxEntries := config.GetConf().ConversationUsage.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = config.DefaultConversationUsageMaxEntries
+	}
+	return maxEntries
+}
+
+// RecordConversationUsage 累加会话在某个模型上的用量，会话数超过max_entries时删除最久没有更新的会话
+func RecordConversationUsage(conversationID, model string, promptTokens, completionTokens, totalTokens int) {
+	if conversationID == "" {
+		return
+	}
+
+	conversationUsagesMu.Lock()
+	defer conversationUsagesMu.Unlock()
+
+	now := time.Now()
+	sweepConversationUsages(now)
+
+	var usage *ConversationUsage
+	if elem, exists := conversationUsages[conversationID]; exists {
+		usage = elem.Value.(*ConversationUsage)
+		conversationUsageList.MoveToFront(elem)
+	} else {
+		usage = &ConversationUsage{ConversationID: conversationID, Models: make(map[string]*ModelUsage)}
+		conversationUsages[conversationID] = conversationUsageList.PushFront(usage)
+		for maxEntries := getConversationUsageMaxEntries(); conversationUsageList.Len() > maxEntries; {
+			removeConversationUsage(conversationUsageList.Back())
+		}
+	}
+	modelUsage, exists := usage.Models[model]
+	if !exists {
+		modelUsage = &ModelUsage{}
+		usage.Models[model] = modelUsage
+	}
+
+	for _, u := range []*ModelUsage{modelUsage, &usage.Total} {
+		u.Requests++
+		u.PromptTokens += promptTokens
+		u.CompletionTokens += completionTokens
+		u.TotalTokens += totalTokens
+	}
+	usage.UpdatedAt = now.Unix()
+}
+
+// GetConversationUsage 返回会话累计用量的副本，超过保留时间未更新的会话视为不存在
+func GetConversationUsage(conversationID string) (*ConversationUsage, bool) {
+	conversationUsagesMu.Lock()
+	defer conversationUsagesMu.Unlock()
+
+	elem, exists := conversationUsages[conversationID]
+	if !exists {
+		return nil, false
+	}
+	usage := elem.Value.(*ConversationUsage)
+	if time.Since(time.Unix(usage.UpdatedAt, 0)) > getConversationUsageTTL() {
+		return nil, false
+	}
+
+	result := &ConversationUsage{
+		ConversationID: usage.ConversationID,
+		Total:          usage.Total,
+		Models:         make(map[string]*ModelUsage, len(usage.Models)),
+		UpdatedAt:      usage.UpdatedAt,
+	}
+	for model, u := range usage.Models {
+		modelUsage := *u
+		result.Models[model] = &modelUsage
+	}
+	return result, true
+}
+
+// sweepConversationUsages 每分钟最多清理一次过期的会话，需要持有锁
+func sweepConversationUsages(now time.Time) {
+	if now.Sub(lastUsageSweep) < time.Minute {
+		return
+	}
+	lastUsageSweep = now
+
+	// 从最久没有更新的会话开始，遇到未过期的会话即可停止
+	ttl := getConversationUsageTTL()
+	for elem := conversationUsageList.Back(); elem != nil; elem = conversationUsageList.Back() {
+		if now.Sub(time.Unix(elem.Value.(*ConversationUsage).UpdatedAt, 0)) <= ttl {
+			break
+		}
+		removeConversationUsage(elem)
+	}
+}
+
+// removeConversationUsage 需要持有锁
+func removeConversationUsage(elem *list.Element) {
+	conversationUsageList.Remove(elem)
+	delete(conversationUsages, elem.Value.(*ConversationUsage).ConversationID)
+}
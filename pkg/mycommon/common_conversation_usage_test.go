@@ -0,0 +1,42 @@
+package mycommon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"testing"
+)
+
+func TestConversationUsageMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	conf := "conversation_usage:\n    enable: true\n    max_entries: 3\nservices:\n    openai:\n        - models: [gpt-4o]\n          enabled: true\n"
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.InitConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		RecordConversationUsage(fmt.Sprintf("c%d", i), "gpt-4o", 1, 1, 2)
+	}
+	// c0更新后c1成为最久没有更新的会话
+	RecordConversationUsage("c0", "gpt-4o", 1, 1, 2)
+	RecordConversationUsage("c3", "gpt-4o", 1, 1, 2)
+
+	if _, exists := GetConversationUsage("c1"); exists {
+		t.Error("c1 should be evicted")
+	}
+	for _, id := range []string{"c0", "c2", "c3"} {
+		if _, exists := GetConversationUsage(id); !exists {
+			t.Errorf("%s should be kept", id)
+		}
+	}
+	if usage, _ := GetConversationUsage("c0"); usage == nil || usage.Total.Requests != 2 {
+		t.Errorf("c0 usage = %+v", usage)
+	}
+	if len(conversationUsages) != 3 || conversationUsageList.Len() != 3 {
+		t.Errorf("entries = %d, list = %d, want 3", len(conversationUsages), conversationUsageList.Len())
+	}
+}
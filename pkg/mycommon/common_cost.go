@@ -0,0 +1,22 @@
+package mycommon
+
+import (
+	"math"
+	"simple-one-api/pkg/config"
+	"strconv"
+)
+
+// CalculateCost 按pricing中每1000个token的价格计算费用，先按客户端请求的模型查找价格，找不到时按上游的模型，
+// 都没有配置价格时返回false
+func CalculateCost(clientModel, model string, promptTokens, completionTokens int) (float64, bool) {
+	price := config.GetModelPrice(clientModel, model)
+	if price == nil {
+		return 0, false
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1000, true
+}
+
+// FormatCost 费用最多保留8位小数，用于响应头
+func FormatCost(cost float64) string {
+	return strconv.FormatFloat(math.Round(cost*1e8)/1e8, 'f', -1, 64)
+}
@@ -1,9 +1,13 @@
 package mycommon
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/mycomdef"
-	"strconv"
+	"strings"
+	"sync"
 )
 
 // GetACredentials 根据模型名从ModelDetails中选择合适的凭证
@@ -13,13 +17,126 @@ func GetACredentials(s *config.ModelDetails, model string) (map[string]interface
 	if s.CredentialList != nil && len(s.CredentialList) > 0 {
 		key := s.ServiceID + "credentials"
 
-		index := config.GetLBIndex(config.LoadBalancingStrategy, key, len(s.CredentialList))
-		credID = s.ServiceID + "_credentials_" + strconv.Itoa(index)
+		// 跳过处于隔离期的凭证，全部被隔离时仍从所有凭证中选择
+		var candidates []int
+		for i := range s.CredentialList {
+			if !IsCredentialQuarantined(getCredentialID(s, i)) {
+				candidates = append(candidates, i)
+			}
+		}
+		if len(candidates) == 0 {
+			for i := range s.CredentialList {
+				candidates = append(candidates, i)
+			}
+		}
+
+		lbStrategy := getCredentialLBStrategy(s)
+		var index int
+		switch strings.ToLower(lbStrategy) {
+		case mycomdef.KEYNAME_LEAST_ACTIVE:
+			index = getLeastActiveIndex(s, candidates)
+		case mycomdef.KEYNAME_WEIGHTED:
+			index = getWeightedCredentialIndex(s, key, candidates)
+		default:
+			index = candidates[config.GetLBIndex(lbStrategy, key, len(candidates))]
+		}
+
+		credID = getCredentialID(s, index)
 		return s.CredentialList[index], credID
 	}
 	return s.Credentials, credID
 }
 
+// IsServiceQuarantined 服务配置的所有凭证都处于隔离期时视为不可用
+func IsServiceQuarantined(s *config.ModelDetails) bool {
+	if len(s.CredentialList) == 0 {
+		return false
+	}
+	for i := range s.CredentialList {
+		if !IsCredentialQuarantined(getCredentialID(s, i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// getCredentialID 凭证状态的key，ServiceID和凭证的顺序在重新加载配置后都会变化，
+// 改为按服务名、server_url、模型列表和凭证的key计算
+func getCredentialID(s *config.ModelDetails, index int) string {
+	creds := s.CredentialList[index]
+	credKey := GetCredentialKey(creds)
+	if credKey == "" {
+		data, _ := json.Marshal(creds)
+		credKey = string(data)
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{s.ServiceName, s.ServerURL, strings.Join(s.Models, ","), credKey}, "|")))
+	return s.ServiceName + "_" + hex.EncodeToString(sum[:8])
+}
+
+func getCredentialLBStrategy(s *config.ModelDetails) string {
+	if s.CredentialLoadBalancing != "" {
+		return s.CredentialLoadBalancing
+	}
+	return config.GetLoadBalancingStrategy()
+}
+
+// getLeastActiveIndex 选择进行中请求数最少的凭证
+func getLeastActiveIndex(s *config.ModelDetails, candidates []int) int {
+	index := candidates[0]
+	minInFlight := GetCredentialInFlight(getCredentialID(s, index))
+	for _, i := range candidates[1:] {
+		if n := GetCredentialInFlight(getCredentialID(s, i)); n < minInFlight {
+			index = i
+			minInFlight = n
+		}
+	}
+	return index
+}
+
+// getCredentialWeight 获取凭证中配置的weight，没有配置时为1
+func getCredentialWeight(credentials map[string]interface{}) int {
+	switch w := credentials[config.KEYNAME_WEIGHT].(type) {
+	case float64:
+		if w > 0 {
+			return int(w)
+		}
+	case int:
+		if w > 0 {
+			return w
+		}
+	}
+	return config.DefaultServiceWeight
+}
+
+var (
+	credCurrentWeights   = make(map[string][]int)
+	credCurrentWeightsMu sync.Mutex
+)
+
+// getWeightedCredentialIndex 平滑加权轮询，按weight的比例依次选择凭证，权重高的凭证不会被连续选中
+func getWeightedCredentialIndex(s *config.ModelDetails, key string, candidates []int) int {
+	credCurrentWeightsMu.Lock()
+	defer credCurrentWeightsMu.Unlock()
+
+	current, exists := credCurrentWeights[key]
+	if !exists || len(current) != len(s.CredentialList) {
+		current = make([]int, len(s.CredentialList))
+		credCurrentWeights[key] = current
+	}
+
+	best, total := candidates[0], 0
+	for _, i := range candidates {
+		weight := getCredentialWeight(s.CredentialList[i])
+		current[i] += weight
+		total += weight
+		if current[i] > current[best] {
+			best = i
+		}
+	}
+	current[best] -= total
+	return best
+}
+
 func GetCredentialLimit(credentials map[string]interface{}) (limitType string, limitn float64, timeout int) {
 	// 假设'limit'键下是一个JSON表示的map
 	limitData, ok := credentials["limit"].(map[string]interface{})
@@ -46,3 +163,27 @@ func GetCredentialLimit(credentials map[string]interface{}) (limitType string, l
 
 	return "", 0, 0 // 默认返回
 }
+
+// 用于标识凭证的字段，按优先级查找
+var credentialKeyNames = []string{config.KEYNAME_API_KEY, config.KEYNAME_SECRET_ID, config.KEYNAME_ACCESS_KEY, config.KEYNAME_TOKEN, config.KEYNAME_APPID}
+
+// GetCredentialKey 获取凭证中用于标识的key
+func GetCredentialKey(credentials map[string]interface{}) string {
+	for _, name := range credentialKeyNames {
+		if v, ok := credentials[name].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// MaskKey 对key进行掩码处理，只保留首尾少量字符
+func MaskKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "****" + key[len(key)-4:]
+}
@@ -0,0 +1,116 @@
+package mycommon
+
+import (
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	credInFlight     = make(map[string]*int64)
+	credInFlightMu   sync.Mutex
+	credQuarantine   = make(map[string]time.Time)
+	credQuarantineMu sync.RWMutex
+	credRevoked      = make(map[string]bool)
+)
+
+func init() {
+	config.OnReload(pruneCredentialStates)
+}
+
+// pruneCredentialStates 重新加载配置后删除已经不在配置中的凭证状态，并解除所有永久隔离。
+// 进行中请求数不为0的凭证保留计数，请求结束时仍然需要释放
+func pruneCredentialStates() {
+	configured := make(map[string]bool)
+	for _, services := range config.GetModelToService() {
+		for i := range services {
+			for j := range services[i].CredentialList {
+				configured[getCredentialID(&services[i], j)] = true
+			}
+		}
+	}
+
+	credInFlightMu.Lock()
+	for credID, counter := range credInFlight {
+		if !configured[credID] && atomic.LoadInt64(counter) <= 0 {
+			delete(credInFlight, credID)
+		}
+	}
+	credInFlightMu.Unlock()
+
+	credQuarantineMu.Lock()
+	for credID, until := range credQuarantine {
+		if !configured[credID] || time.Now().After(until) {
+			delete(credQuarantine, credID)
+		}
+	}
+	credRevoked = make(map[string]bool)
+	credQuarantineMu.Unlock()
+
+	// 加权轮询按ServiceID保存，重新加载后ServiceID都会变化
+	credCurrentWeightsMu.Lock()
+	credCurrentWeights = make(map[string][]int)
+	credCurrentWeightsMu.Unlock()
+}
+
+func getCredInFlightCounter(credID string) *int64 {
+	credInFlightMu.Lock()
+	defer credInFlightMu.Unlock()
+	counter, exists := credInFlight[credID]
+	if !exists {
+		counter = new(int64)
+		credInFlight[credID] = counter
+	}
+	return counter
+}
+
+// AcquireCredential 记录凭证上的进行中请求数
+func AcquireCredential(credID string) {
+	atomic.AddInt64(getCredInFlightCounter(credID), 1)
+}
+
+// ReleaseCredential 请求结束后释放凭证上的进行中请求数
+func ReleaseCredential(credID string) {
+	atomic.AddInt64(getCredInFlightCounter(credID), -1)
+}
+
+// GetCredentialInFlight 获取凭证上的进行中请求数
+func GetCredentialInFlight(credID string) int64 {
+	return atomic.LoadInt64(getCredInFlightCounter(credID))
+}
+
+// QuarantineCredential 将凭证隔离一段时间，隔离期间不会被选择
+func QuarantineCredential(credID string, d time.Duration) {
+	if credID == "" || d <= 0 {
+		return
+	}
+	credQuarantineMu.Lock()
+	credQuarantine[credID] = time.Now().Add(d)
+	credQuarantineMu.Unlock()
+
+	mylog.Logger.Warn("credential quarantined", zap.String("cred_id", credID), zap.Duration("duration", d))
+}
+
+// RevokeCredential 永久隔离无效的凭证，直到重新加载配置
+func RevokeCredential(credID string, reason error) {
+	if credID == "" {
+		return
+	}
+	credQuarantineMu.Lock()
+	credRevoked[credID] = true
+	credQuarantineMu.Unlock()
+
+	mylog.Logger.Error("credential revoked, quarantined until config reload", zap.String("cred_id", credID), zap.Error(reason))
+}
+
+// IsCredentialQuarantined 判断凭证是否处于隔离期或已被永久隔离
+func IsCredentialQuarantined(credID string) bool {
+	credQuarantineMu.RLock()
+	until, exists := credQuarantine[credID]
+	revoked := credRevoked[credID]
+	credQuarantineMu.RUnlock()
+	return revoked || (exists && time.Now().Before(until))
+}
@@ -0,0 +1,93 @@
+package mycommon
+
+import (
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"testing"
+	"time"
+)
+
+func writeCredentialTestConfig(t *testing.T, path string, keys ...string) {
+	t.Helper()
+	conf := "services:\n    openai:\n        - models: [gpt-4o]\n          enabled: true\n          credential_list:\n"
+	for _, key := range keys {
+		conf += "              - api_key: " + key + "\n"
+	}
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestModelDetails(t *testing.T) *config.ModelDetails {
+	t.Helper()
+	s, err := config.GetModelService("gpt-4o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestCredentialStateAfterReload 凭证状态按凭证而不是位置保存，重新加载后删除的凭证的状态被清理
+func TestCredentialStateAfterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeCredentialTestConfig(t, path, "sk-aaaa-0001", "sk-bbbb-0002")
+	if err := config.InitConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	s := getTestModelDetails(t)
+	idA, idB := getCredentialID(s, 0), getCredentialID(s, 1)
+	if idA == idB {
+		t.Fatalf("credential ids should differ: %s", idA)
+	}
+	QuarantineCredential(idA, time.Minute)
+	QuarantineCredential(idB, time.Minute)
+	AcquireCredential(idA)
+	ReleaseCredential(idA)
+
+	// B移到第一个，A被删除
+	writeCredentialTestConfig(t, path, "sk-bbbb-0002", "sk-cccc-0003")
+	if err := config.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	s = getTestModelDetails(t)
+	if got := getCredentialID(s, 0); got != idB {
+		t.Errorf("id of the moved credential = %s, want %s", got, idB)
+	}
+	if !IsCredentialQuarantined(getCredentialID(s, 0)) {
+		t.Error("quarantine of the moved credential should be kept")
+	}
+	if IsCredentialQuarantined(getCredentialID(s, 1)) {
+		t.Error("the new credential should not be quarantined")
+	}
+
+	credQuarantineMu.RLock()
+	_, quarantined := credQuarantine[idA]
+	credQuarantineMu.RUnlock()
+	credInFlightMu.Lock()
+	_, counted := credInFlight[idA]
+	credInFlightMu.Unlock()
+	if quarantined || counted {
+		t.Errorf("state of the removed credential should be pruned, quarantine %v, in flight %v", quarantined, counted)
+	}
+}
+
+// TestCredentialRevokedUntilReload 永久隔离在重新加载配置后解除
+func TestCredentialRevokedUntilReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeCredentialTestConfig(t, path, "sk-aaaa-0001")
+	if err := config.InitConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	id := getCredentialID(getTestModelDetails(t), 0)
+	RevokeCredential(id, nil)
+	if !IsCredentialQuarantined(id) {
+		t.Fatal("revoked credential should be quarantined")
+	}
+	if err := config.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if IsCredentialQuarantined(id) {
+		t.Error("revocation should be cleared after reload")
+	}
+}
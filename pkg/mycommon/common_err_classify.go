@@ -0,0 +1,347 @@
+package mycommon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 通用的上下文超长错误关键字
+var commonContextLengthErrorPatterns = []string{
+	"context_length_exceeded",
+	"maximum context length",
+	"context length",
+	"context window",
+	"prompt is too long",
+	"input is too long",
+	"too many tokens",
+	"reduce the length",
+}
+
+// 各服务特有的上下文超长错误关键字
+var serviceContextLengthErrorPatterns = map[string][]string{
+	"qianfan":   {"prompt tokens too long"},
+	"hunyuan":   {"exceeds max length", "超过最大长度"},
+	"xinghuo":   {"token数量超过上限"},
+	"minimax":   {"token limit"},
+	"dashscope": {"range of input length"},
+	"zhipu":     {"prompt 超长"},
+	"gemini":    {"exceeds the maximum number of tokens"},
+	"claude":    {"prompt is too long"},
+}
+
+// 各服务上下文超长的错误码，与上游错误中的code、error_code等字段比较，不在错误信息中查找
+var serviceContextLengthErrorCodes = map[string][]string{
+	"qianfan": {"336007"},
+	"xinghuo": {"10907"},
+	"minimax": {"1039"},
+	"zhipu":   {"1261"},
+}
+
+// IsContextLengthError 判断错误是否为输入超出模型上下文长度
+func IsContextLengthError(serviceName string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	serviceName = strings.ToLower(serviceName)
+	if codes := serviceContextLengthErrorCodes[serviceName]; len(codes) > 0 {
+		if apiErr := getUpstreamAPIError(err); apiErr != nil && apiErr.Code != nil {
+			code := fmt.Sprint(apiErr.Code)
+			for _, c := range codes {
+				if code == c {
+					return true
+				}
+			}
+		}
+	}
+
+	errMsg := strings.ToLower(err.Error())
+	for _, p := range serviceContextLengthErrorPatterns[serviceName] {
+		if strings.Contains(errMsg, strings.ToLower(p)) {
+			return true
+		}
+	}
+	for _, p := range commonContextLengthErrorPatterns {
+		if strings.Contains(errMsg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamError 按错误类型统一后的上游错误
+type UpstreamError struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+}
+
+type upstreamErrorKind struct {
+	UpstreamError
+	patterns        []string
+	servicePatterns map[string][]string
+}
+
+// 按顺序匹配，额度不足和限流都可能是429，额度不足需要先判断
+var upstreamErrorKinds = []upstreamErrorKind{
+	{
+		UpstreamError:   UpstreamError{Status: 401, Type: "invalid_request_error", Code: "invalid_api_key", Message: "The upstream API key is invalid or has expired."},
+		patterns:        []string{"invalid_api_key", "invalid api key", "incorrect api key", "api key not valid", "invalid authentication", "unauthorized", "authentication fail"},
+		servicePatterns: map[string][]string{"qianfan": {"access token invalid"}, "xinghuo": {"11200", "hmac signature"}, "zhipu": {"1000", "1001", "1002"}, "hunyuan": {"authfailure"}, "dashscope": {"invalidapikey"}},
+	},
+	{
+		UpstreamError:   UpstreamError{Status: 429, Type: "insufficient_quota", Code: "insufficient_quota", Message: "The upstream account has insufficient quota or balance."},
+		patterns:        []string{"insufficient_quota", "exceeded your current quota", "insufficient balance", "quota exceeded", "余额不足", "欠费"},
+		servicePatterns: map[string][]string{"zhipu": {"1113"}, "minimax": {"1008"}, "dashscope": {"arrearage"}},
+	},
+	{
+		UpstreamError:   UpstreamError{Status: 404, Type: "invalid_request_error", Code: "model_not_found", Message: "The requested model does not exist on the upstream service."},
+		patterns:        []string{"model_not_found", "model not found", "no such model", "model does not exist", "模型不存在"},
+		servicePatterns: map[string][]string{"zhipu": {"1211"}, "dashscope": {"model.accessdenied"}, "ollama": {"not found, try pulling it first"}},
+	},
+	{
+		UpstreamError:   UpstreamError{Status: 400, Type: "invalid_request_error", Code: "content_filter", Message: "The request was rejected by the upstream content filter."},
+		patterns:        []string{"content_filter", "content management policy", "content policy", "safety", "sensitive", "敏感", "违规"},
+		servicePatterns: map[string][]string{"zhipu": {"1301"}, "dashscope": {"datainspectionfailed", "data_inspection_failed"}, "qianfan": {"336003"}, "xinghuo": {"10013", "10014"}},
+	},
+	{
+		UpstreamError:   UpstreamError{Status: 429, Type: "requests", Code: "rate_limit_exceeded", Message: "The upstream service is rate limiting requests, please retry later."},
+		patterns:        []string{"rate_limit", "rate limit", "too many requests", "qps", "请求过于频繁", "并发"},
+		servicePatterns: map[string][]string{"zhipu": {"1302", "1303"}, "qianfan": {"336501", "336502", "request limit reached"}, "xinghuo": {"11202", "11203"}, "dashscope": {"throttling"}},
+	},
+	{
+		UpstreamError: UpstreamError{Status: 504, Type: "timeout", Code: "upstream_timeout", Message: "The upstream service stopped responding, please retry later."},
+		patterns:      []string{"stream idle timeout"},
+	},
+	{
+		UpstreamError: UpstreamError{Status: 504, Type: "gateway_timeout", Code: "first_token_timeout", Message: "The upstream service did not return the first token in time, please retry later."},
+		patterns:      []string{"first token timeout"},
+	},
+}
+
+// ClassifyUpstreamError 将各服务的错误归类为无效密钥、额度不足、模型不存在、内容过滤、限流等统一的错误，无法归类时返回false
+func ClassifyUpstreamError(serviceName string, err error) (*UpstreamError, bool) {
+	if err == nil {
+		return nil, false
+	}
+
+	errMsg := strings.ToLower(err.Error())
+	serviceName = strings.ToLower(serviceName)
+	for _, kind := range upstreamErrorKinds {
+		for _, p := range kind.servicePatterns[serviceName] {
+			if containsErrorPattern(errMsg, strings.ToLower(p)) {
+				result := kind.UpstreamError
+				return &result, true
+			}
+		}
+		for _, p := range kind.patterns {
+			if strings.Contains(errMsg, p) {
+				result := kind.UpstreamError
+				return &result, true
+			}
+		}
+	}
+
+	// 按状态码兜底
+	switch GetErrorStatusCode(err) {
+	case 401, 403:
+		result := upstreamErrorKinds[0].UpstreamError
+		return &result, true
+	case 429:
+		result := upstreamErrorKinds[4].UpstreamError
+		return &result, true
+	}
+	return nil, false
+}
+
+var upstreamURLRe = regexp.MustCompile(`(?i)(https?|wss?)://[^\s"'<>]+`)
+
+// TranslateUpstreamError 无法归类的错误按上游返回的状态码和OpenAI格式的错误返回，没有状态码时按内部错误处理，
+// 返回的错误信息中去掉上游地址和密钥
+func TranslateUpstreamError(err error) *UpstreamError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		result := upstreamErrorKinds[5].UpstreamError
+		return &result
+	}
+
+	// 流式响应中途返回的错误没有状态码，按500返回上游的错误信息
+	status := GetErrorStatusCode(err)
+	apiErr := getUpstreamAPIError(err)
+	if status < 400 {
+		if apiErr == nil {
+			return &UpstreamError{Status: http.StatusInternalServerError, Type: "internal_error", Message: "An internal error occurred while processing the request."}
+		}
+		status = http.StatusInternalServerError
+	}
+
+	result := &UpstreamError{Status: status, Type: "invalid_request_error", Message: http.StatusText(status)}
+	if status >= 500 {
+		result.Type = "server_error"
+	}
+	if apiErr != nil {
+		if apiErr.Message != "" {
+			result.Message = apiErr.Message
+		}
+		if apiErr.Type != "" {
+			result.Type = apiErr.Type
+		}
+		// go-openai把"code":null解析为0
+		if apiErr.Code != nil && apiErr.Code != 0 {
+			result.Code = fmt.Sprint(apiErr.Code)
+		}
+		if apiErr.Param != nil {
+			result.Param = *apiErr.Param
+		}
+	}
+	result.Message = SanitizeErrorMessage(result.Message)
+	return result
+}
+
+// getUpstreamAPIError 取出go-openai的APIError，其他错误从错误信息中的JSON按各服务的错误格式解析
+func getUpstreamAPIError(err error) *openai.APIError {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return ParseUpstreamErrorBody(err.Error())
+}
+
+// ParseUpstreamErrorBody 从错误信息中取出第一个{到最后一个}之间的JSON，依次按以下格式解析：
+// OpenAI、Claude、Gemini、智谱、Ollama的error字段，混元的Response.Error，星火的header，MiniMax的base_resp，
+// 千帆的error_code和error_msg，DashScope、Bedrock顶层的code和message
+func ParseUpstreamErrorBody(errMsg string) *openai.APIError {
+	start := strings.Index(errMsg, "{")
+	end := strings.LastIndex(errMsg, "}")
+	if start < 0 || end < start {
+		return nil
+	}
+	var body map[string]interface{}
+	if json.Unmarshal([]byte(errMsg[start:end+1]), &body) != nil {
+		return nil
+	}
+
+	if errObj, ok := body["error"]; ok {
+		switch v := errObj.(type) {
+		case string:
+			return &openai.APIError{Message: v}
+		case map[string]interface{}:
+			apiErr := &openai.APIError{Message: getErrorField(v, "message"), Type: getErrorField(v, "type")}
+			// Gemini的code是HTTP状态码，status才是错误码
+			if status := getErrorField(v, "status"); status != "" {
+				apiErr.Code = strings.ToLower(status)
+			} else if code := getErrorField(v, "code"); code != "" {
+				apiErr.Code = code
+			}
+			if param := getErrorField(v, "param"); param != "" {
+				apiErr.Param = &param
+			}
+			if apiErr.Message != "" {
+				return apiErr
+			}
+		}
+	}
+
+	nested := []struct {
+		path         []string
+		code, msg    string
+		skipZeroCode bool
+	}{
+		{path: []string{"Response", "Error"}, code: "Code", msg: "Message"},
+		{path: []string{"header"}, code: "code", msg: "message", skipZeroCode: true},
+		{path: []string{"base_resp"}, code: "status_code", msg: "status_msg", skipZeroCode: true},
+		{code: "error_code", msg: "error_msg"},
+		{code: "code", msg: "message"},
+		{code: "Code", msg: "Message"},
+	}
+	for _, n := range nested {
+		m := body
+		for _, key := range n.path {
+			m, _ = m[key].(map[string]interface{})
+		}
+		if m == nil {
+			continue
+		}
+		code, msg := getErrorField(m, n.code), getErrorField(m, n.msg)
+		// 星火和MiniMax在成功时也带有code为0的头部
+		if msg == "" || (n.skipZeroCode && (code == "0" || code == "")) {
+			continue
+		}
+		apiErr := &openai.APIError{Message: msg}
+		if code != "" {
+			apiErr.Code = code
+		}
+		return apiErr
+	}
+
+	if msg := getErrorField(body, "message"); msg != "" {
+		return &openai.APIError{Message: msg}
+	}
+	return nil
+}
+
+// getErrorField 取出字符串或数字类型的字段，数字转换为整数形式的字符串
+func getErrorField(m map[string]interface{}, key string) string {
+	switch v := m[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// SanitizeErrorMessage 去掉错误信息中的地址和密钥等信息
+func SanitizeErrorMessage(msg string) string {
+	return RedactSensitiveText(upstreamURLRe.ReplaceAllString(msg, "[upstream]"))
+}
+
+var errorCodeBoundary = `[^0-9a-z_.]`
+
+// containsErrorPattern 纯数字的错误码需要前后都不是数字或字母，避免误判
+func containsErrorPattern(errMsg string, pattern string) bool {
+	if _, err := strconv.Atoi(pattern); err != nil {
+		return strings.Contains(errMsg, pattern)
+	}
+	re := regexp.MustCompile(`(^|` + errorCodeBoundary + `)` + pattern + `($|` + errorCodeBoundary + `)`)
+	return re.MatchString(errMsg)
+}
+
+var statusCodeErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`status code: (\d{3})`),
+	regexp.MustCompile(`HTTP error: (\d{3})`),
+	regexp.MustCompile(`status (\d{3}):`),
+}
+
+// GetErrorStatusCode 从上游错误中解析HTTP状态码，解析不到时返回0
+func GetErrorStatusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPStatusCode > 0 {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) && reqErr.HTTPStatusCode > 0 {
+		return reqErr.HTTPStatusCode
+	}
+
+	errMsg := err.Error()
+	for _, re := range statusCodeErrorPatterns {
+		if submatch := re.FindStringSubmatch(errMsg); len(submatch) == 2 {
+			code, _ := strconv.Atoi(submatch[1])
+			return code
+		}
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+package mycommon
+
+import (
+	"errors"
+	"github.com/sashabaranov/go-openai"
+	"testing"
+)
+
+func TestIsContextLengthError(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		err     error
+		want    bool
+	}{
+		{"openai code", "openai", errors.New(`{"error":{"message":"This model's maximum context length is 8192 tokens","code":"context_length_exceeded"}}`), true},
+		{"zhipu api error code", "zhipu", &openai.APIError{Code: "1261", Message: "Prompt exceeds max length"}, true},
+		{"zhipu body code", "zhipu", errors.New(`error, {"error":{"code":"1261","message":"prompt too long"}}`), true},
+		{"qianfan error_code", "qianfan", errors.New(`{"error_code":336007,"error_msg":"the max length of current question is 11200"}`), true},
+		{"xinghuo header code", "xinghuo", errors.New(`{"header":{"code":10907,"message":"token limit"}}`), true},
+		{"minimax base_resp", "minimax", errors.New(`{"base_resp":{"status_code":1039,"status_msg":"exceeded"}}`), true},
+		{"code number in message", "zhipu", &openai.APIError{Code: "1301", Message: "request 1261 blocked"}, false},
+		{"code number in id", "qianfan", errors.New(`{"id":"as-336007ab","error_code":336003,"error_msg":"invalid"}`), false},
+		{"code of other service", "minimax", &openai.APIError{Code: "1261", Message: "error"}, false},
+		{"nil", "zhipu", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsContextLengthError(tt.service, tt.err); got != tt.want {
+				t.Errorf("IsContextLengthError(%s, %v) = %v, want %v", tt.service, tt.err, got, tt.want)
+			}
+		})
+	}
+}
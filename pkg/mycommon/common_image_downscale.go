@@ -0,0 +1,168 @@
+package mycommon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"simple-one-api/pkg/utils"
+	"strings"
+)
+
+// DownscaleImages 将消息中长边超过max_dimension的图片按比例缩小后重新编码为data URL，返回处理的图片数
+func DownscaleImages(messages []openai.ChatCompletionMessage, conf *config.ImageDownscaleConf) int {
+	if conf.MaxDimension <= 0 {
+		return 0
+	}
+
+	count := 0
+	for i := range messages {
+		for j := range messages[i].MultiContent {
+			part := &messages[i].MultiContent[j]
+			if part.Type != openai.ChatMessagePartTypeImageURL || part.ImageURL == nil {
+				continue
+			}
+
+			newURL, resized, err := downscaleImageURL(part.ImageURL.URL, conf)
+			if err != nil {
+				mylog.Logger.Warn("downscale image failed", zap.Error(err))
+				continue
+			}
+			if resized {
+				part.ImageURL.URL = newURL
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func downscaleImageURL(url string, conf *config.ImageDownscaleConf) (string, bool, error) {
+	maxBytes := conf.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = config.DefaultImageMaxBytes
+	}
+	maxPixels := conf.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = config.DefaultImageMaxPixels
+	}
+
+	base64Data, _, err := GetImageURLData(url)
+	if err != nil {
+		return url, false, err
+	}
+	if size := base64.StdEncoding.DecodedLen(len(base64Data)); size > maxBytes {
+		return url, false, fmt.Errorf("image size %d exceeds max_bytes %d", size, maxBytes)
+	}
+	data, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return url, false, err
+	}
+
+	// 先只读取尺寸，不需要缩小时不做完整的解码
+	imgConf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return url, false, err
+	}
+	if imgConf.Width <= conf.MaxDimension && imgConf.Height <= conf.MaxDimension {
+		return url, false, nil
+	}
+	// 压缩后很小的图片解码后可能占用大量内存，像素数超过限制时不解码
+	if int64(imgConf.Width)*int64(imgConf.Height) > int64(maxPixels) {
+		return url, false, fmt.Errorf("image %dx%d exceeds max_pixels %d", imgConf.Width, imgConf.Height, maxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return url, false, err
+	}
+
+	width, height := imgConf.Width, imgConf.Height
+	if width >= height {
+		height = utils.Max(1, height*conf.MaxDimension/width)
+		width = conf.MaxDimension
+	} else {
+		width = utils.Max(1, width*conf.MaxDimension/height)
+		height = conf.MaxDimension
+	}
+	resized := resizeImage(img, width, height)
+
+	outFormat := strings.ToLower(conf.Format)
+	if outFormat != config.ImageFormatJPEG && outFormat != config.ImageFormatPNG {
+		// 未指定时png保持png以保留透明通道，其余编码为jpeg
+		outFormat = config.ImageFormatJPEG
+		if format == config.ImageFormatPNG {
+			outFormat = config.ImageFormatPNG
+		}
+	}
+
+	var buf bytes.Buffer
+	mime := "image/" + outFormat
+	if outFormat == config.ImageFormatPNG {
+		err = png.Encode(&buf, resized)
+	} else {
+		quality := conf.Quality
+		if quality <= 0 || quality > 100 {
+			quality = config.DefaultImageQuality
+		}
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return url, false, fmt.Errorf("encode image error: %w", err)
+	}
+
+	mylog.Logger.Info("image downscaled",
+		zap.Int("width", imgConf.Width), zap.Int("height", imgConf.Height),
+		zap.Int("new_width", width), zap.Int("new_height", height),
+		zap.Int("size", len(data)), zap.Int("new_size", buf.Len()))
+
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), true, nil
+}
+
+// resizeImage 按区域平均的方式缩小图片
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcW, srcH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	srcMin := rgba.Bounds().Min
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, utils.Max((y+1)*srcH/height, y*srcH/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, utils.Max((x+1)*srcW/width, x*srcW/width+1)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				offset := rgba.PixOffset(srcMin.X+x0, srcMin.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(rgba.Pix[offset])
+					g += uint32(rgba.Pix[offset+1])
+					b += uint32(rgba.Pix[offset+2])
+					a += uint32(rgba.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,57 @@
+package mycommon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"simple-one-api/pkg/config"
+	"strings"
+	"testing"
+)
+
+func testPNGDataURL(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestDownscaleImageURL(t *testing.T) {
+	url := testPNGDataURL(t, 800, 400)
+
+	newURL, resized, err := downscaleImageURL(url, &config.ImageDownscaleConf{MaxDimension: 200})
+	if err != nil || !resized {
+		t.Fatalf("resized = %v, err = %v", resized, err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(newURL, "data:image/png;base64,"))
+	imgConf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || imgConf.Width != 200 || imgConf.Height != 100 {
+		t.Errorf("downscaled image = %dx%d, err = %v", imgConf.Width, imgConf.Height, err)
+	}
+}
+
+// TestDownscaleImageURLLimits 像素数或字节数超过限制时不解码，原样返回
+func TestDownscaleImageURLLimits(t *testing.T) {
+	url := testPNGDataURL(t, 800, 400)
+	tests := []struct {
+		name string
+		conf config.ImageDownscaleConf
+	}{
+		{"max_pixels", config.ImageDownscaleConf{MaxDimension: 200, MaxPixels: 800*400 - 1}},
+		{"max_bytes", config.ImageDownscaleConf{MaxDimension: 200, MaxBytes: 16}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newURL, resized, err := downscaleImageURL(url, &tt.conf)
+			if err == nil || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("err = %v, want a %s error", err, tt.name)
+			}
+			if resized || newURL != url {
+				t.Error("image over the limit should be left unchanged")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package mycommon
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RepairJSONContent 尝试从模型的回答中修复出合法的JSON，依次去掉代码块标记、截取第一个对象或数组，无法修复时返回false
+func RepairJSONContent(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if json.Valid([]byte(content)) {
+		return content, true
+	}
+
+	if strings.HasPrefix(content, "```") {
+		content = strings.TrimPrefix(content, "```")
+		if idx := strings.Index(content, "\n"); idx >= 0 {
+			content = content[idx+1:]
+		}
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+		if json.Valid([]byte(content)) {
+			return content, true
+		}
+	}
+
+	start := strings.IndexAny(content, "{[")
+	if start < 0 {
+		return content, false
+	}
+	closing := "}"
+	if content[start] == '[' {
+		closing = "]"
+	}
+	end := strings.LastIndex(content, closing)
+	if end <= start {
+		return content, false
+	}
+
+	candidate := content[start : end+1]
+	if json.Valid([]byte(candidate)) {
+		return candidate, true
+	}
+	return content, false
+}
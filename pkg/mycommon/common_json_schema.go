@@ -0,0 +1,139 @@
+package mycommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// ValidateJSONSchema 按JSON Schema校验JSON内容，只支持常用的type、properties、required、additionalProperties、
+// items、enum、anyOf，其他关键字忽略，用于在不支持结构化输出的服务上检查回答
+func ValidateJSONSchema(content string, schema json.RawMessage) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return fmt.Errorf("invalid json: %v", err)
+	}
+	var s map[string]interface{}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	return validateSchemaValue(value, s, "$")
+}
+
+func validateSchemaValue(value interface{}, schema map[string]interface{}, path string) error {
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && len(anyOf) > 0 {
+		var firstErr error
+		for _, sub := range anyOf {
+			subSchema, _ := sub.(map[string]interface{})
+			err := validateSchemaValue(value, subSchema, path)
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		matched := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value is not one of enum", path)
+		}
+	}
+
+	if t, exists := schema["type"]; exists && !matchSchemaType(value, t) {
+		return fmt.Errorf("%s: expected type %v", path, t)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, exists := v[name]; !exists {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		// 按名称排序，保证返回的错误稳定
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propSchema, defined := props[name].(map[string]interface{})
+			if !defined {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := validateSchemaValue(v[name], propSchema, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchemaValue(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchSchemaType type可以是单个类型或者类型数组
+func matchSchemaType(value interface{}, t interface{}) bool {
+	switch tv := t.(type) {
+	case string:
+		return matchSingleSchemaType(value, tv)
+	case []interface{}:
+		for _, item := range tv {
+			if name, ok := item.(string); ok && matchSingleSchemaType(value, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchSingleSchemaType(value interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package mycommon
+
+import (
+	"strings"
+	"unicode"
+)
+
+// 语言代码对应的主要文字，与config.ForceLanguagePostCheckLanguages一致
+var languageScripts = map[string]*unicode.RangeTable{
+	"zh": unicode.Han,
+	"ja": unicode.Hiragana,
+	"ko": unicode.Hangul,
+	"ru": unicode.Cyrillic,
+	"ar": unicode.Arabic,
+	"th": unicode.Thai,
+}
+
+// 判断为目标语言时，目标文字在所有字母中的最低占比
+const languageScriptMinRatio = 0.3
+
+// normalizeLanguageCode 将 zh-CN、zh_TW 等转换为 zh
+func normalizeLanguageCode(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+	return lang
+}
+
+// IsLanguageCheckable 判断是否支持对该语言进行启发式检测
+func IsLanguageCheckable(lang string) bool {
+	_, exists := languageScripts[normalizeLanguageCode(lang)]
+	return exists
+}
+
+// IsTextInLanguage 根据文字占比粗略判断文本是否为指定语言，无法判断时返回true
+func IsTextInLanguage(text string, lang string) bool {
+	lang = normalizeLanguageCode(lang)
+	script, exists := languageScripts[lang]
+	if !exists {
+		return true
+	}
+
+	var letters, matched, han, kana int
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(script, r) {
+			matched++
+		}
+		if unicode.Is(unicode.Han, r) {
+			han++
+		}
+		if unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) {
+			kana++
+		}
+	}
+
+	if letters == 0 {
+		return true
+	}
+
+	switch lang {
+	case "ja":
+		// 日文中同时包含汉字和假名
+		return float64(kana+han)/float64(letters) >= languageScriptMinRatio && kana > 0
+	case "zh":
+		// 大量假名时判断为日文
+		return float64(matched)/float64(letters) >= languageScriptMinRatio && kana*10 < han
+	}
+
+	return float64(matched)/float64(letters) >= languageScriptMinRatio
+}
@@ -0,0 +1,19 @@
+package mycommon
+
+import (
+	"math/rand"
+	"simple-one-api/pkg/config"
+)
+
+// ShouldSamplePromptLog 按模型配置的采样率决定是否记录完整的请求和响应，模型没有单独配置时使用全局的rate
+func ShouldSamplePromptLog(model string) bool {
+	conf := config.GetConf().PromptLogSampling
+	rate := conf.Rate
+	if modelRate, exists := conf.Models[model]; exists {
+		rate = modelRate
+	}
+	if rate <= 0 {
+		return false
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
@@ -0,0 +1,24 @@
+package mycommon
+
+import (
+	"regexp"
+)
+
+var redactPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`sk-[A-Za-z0-9_\-]{8,}`), "sk-***"},
+	{regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._\-]{8,}`), "Bearer ***"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`), "***@***"},
+	{regexp.MustCompile(`\b1[3-9]\d{9}\b`), "1**********"},
+	{regexp.MustCompile(`\b\d{17}[\dXx]\b`), "******************"},
+}
+
+// RedactSensitiveText 脱敏文本中的密钥、邮箱、手机号、身份证号等敏感信息
+func RedactSensitiveText(text string) string {
+	for _, p := range redactPatterns {
+		text = p.re.ReplaceAllString(text, p.replacement)
+	}
+	return text
+}
@@ -0,0 +1,137 @@
+package mycommon
+
+import (
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"strconv"
+	"strings"
+)
+
+const redactedValue = "***"
+
+// splitRedactPath 将 $.a.b[0].c 形式的路径拆分为 a、b、0、c，*匹配任意key或数组元素
+func splitRedactPath(path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+
+	var parts []string
+	for _, p := range strings.Split(path, ".") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func redactValue(v interface{}, parts []string) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	key, rest := parts[0], parts[1:]
+
+	redacted := false
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if key != "*" && key != k {
+				continue
+			}
+			if len(rest) == 0 {
+				node[k] = redactedValue
+				redacted = true
+			} else if redactValue(child, rest) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			if len(rest) == 0 {
+				node[i] = redactedValue
+				redacted = true
+			} else if redactValue(child, rest) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// RedactJSONPaths 内容为JSON时将指定路径的值替换为***，不是JSON或没有匹配的路径时原样返回
+func RedactJSONPaths(data string, paths []string) (string, bool) {
+	trimmed := strings.TrimSpace(data)
+	if len(paths) == 0 || trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return data, false
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(trimmed), &v); err != nil {
+		return data, false
+	}
+
+	redacted := false
+	for _, p := range paths {
+		if redactValue(v, splitRedactPath(p)) {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return data, false
+	}
+
+	result, err := json.Marshal(v)
+	if err != nil {
+		return data, false
+	}
+	return string(result), true
+}
+
+// RedactRequestPaths 脱敏消息内容和工具参数中的指定路径，需要修改时返回副本，原请求不变
+func RedactRequestPaths(request *openai.ChatCompletionRequest, paths []string) *openai.ChatCompletionRequest {
+	if request == nil || len(paths) == 0 {
+		return request
+	}
+
+	var redactedRequest *openai.ChatCompletionRequest
+	getMessage := func(i int) *openai.ChatCompletionMessage {
+		if redactedRequest == nil {
+			copied := DeepCopyChatCompletionRequest(*request)
+			redactedRequest = &copied
+		}
+		return &redactedRequest.Messages[i]
+	}
+
+	for i, message := range request.Messages {
+		if content, ok := RedactJSONPaths(message.Content, paths); ok {
+			getMessage(i).Content = content
+		}
+		for j, part := range message.MultiContent {
+			if part.Type != openai.ChatMessagePartTypeText {
+				continue
+			}
+			if text, ok := RedactJSONPaths(part.Text, paths); ok {
+				getMessage(i).MultiContent[j].Text = text
+			}
+		}
+		for j, toolCall := range message.ToolCalls {
+			if args, ok := RedactJSONPaths(toolCall.Function.Arguments, paths); ok {
+				getMessage(i).ToolCalls[j].Function.Arguments = args
+			}
+		}
+		if message.FunctionCall != nil {
+			if args, ok := RedactJSONPaths(message.FunctionCall.Arguments, paths); ok {
+				msg := getMessage(i)
+				functionCall := *msg.FunctionCall
+				functionCall.Arguments = args
+				msg.FunctionCall = &functionCall
+			}
+		}
+	}
+
+	if redactedRequest == nil {
+		return request
+	}
+	return redactedRequest
+}
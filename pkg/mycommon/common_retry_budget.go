@@ -0,0 +1,156 @@
+package mycommon
+
+import (
+	"go.uber.org/zap"
+	"math"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retryBudgetBucket 一秒内的请求数和重试数
+type retryBudgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// retryBudget 一个服务在滑动窗口内的请求数和重试数，按秒分桶
+type retryBudget struct {
+	serviceName string
+	buckets     []retryBudgetBucket
+	exhausted   int
+}
+
+type RetryBudgetStat struct {
+	ServiceName string `json:"service_name"`
+	ServiceID   string `json:"service_id"`
+	Requests    int    `json:"requests"`
+	Retries     int    `json:"retries"`
+	MaxRetries  int    `json:"max_retries"`
+	Exhausted   int    `json:"exhausted"`
+}
+
+var (
+	retryBudgets   = make(map[string]*retryBudget)
+	retryBudgetsMu sync.Mutex
+)
+
+func getRetryBudgetConf() (float64, int, int) {
+	conf := config.GetConf().RetryBudget
+	ratio, window, minRetries := conf.Ratio, conf.Window, conf.MinRetries
+	if ratio <= 0 {
+		ratio = config.DefaultRetryBudgetRatio
+	}
+	if window <= 0 {
+		window = config.DefaultRetryBudgetWindow
+	}
+	if minRetries <= 0 {
+		minRetries = config.DefaultRetryBudgetMinRetries
+	}
+	return ratio, window, minRetries
+}
+
+// getRetryBudget 获取服务的计数，需要持有锁
+func getRetryBudget(s *config.ModelDetails, window int) *retryBudget {
+	b, exists := retryBudgets[s.ServiceID]
+	if !exists || len(b.buckets) != window {
+		b = &retryBudget{serviceName: s.ServiceName, buckets: make([]retryBudgetBucket, window)}
+		retryBudgets[s.ServiceID] = b
+	}
+	return b
+}
+
+// bucket 返回当前秒的分桶，过期的分桶会被重置
+func (b *retryBudget) bucket(now int64) *retryBudgetBucket {
+	bucket := &b.buckets[now%int64(len(b.buckets))]
+	if bucket.second != now {
+		*bucket = retryBudgetBucket{second: now}
+	}
+	return bucket
+}
+
+// counts 返回窗口内的请求数和重试数
+func (b *retryBudget) counts(now int64) (int, int) {
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if now-bucket.second < int64(len(b.buckets)) {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+func maxRetries(requests int, ratio float64, minRetries int) int {
+	return int(math.Max(float64(minRetries), math.Floor(float64(requests)*ratio)))
+}
+
+// RecordRetryBudgetRequest 记录服务收到的一次首次请求
+func RecordRetryBudgetRequest(s *config.ModelDetails) {
+	if !config.GetConf().RetryBudget.Enable {
+		return
+	}
+	_, window, _ := getRetryBudgetConf()
+
+	retryBudgetsMu.Lock()
+	defer retryBudgetsMu.Unlock()
+	getRetryBudget(s, window).bucket(time.Now().Unix()).requests++
+}
+
+// AcquireRetryBudget 服务请求失败后是否允许重试或切换，预算用完时返回false，未开启时总是允许
+func AcquireRetryBudget(s *config.ModelDetails) bool {
+	if !config.GetConf().RetryBudget.Enable {
+		return true
+	}
+	ratio, window, minRetries := getRetryBudgetConf()
+
+	retryBudgetsMu.Lock()
+	defer retryBudgetsMu.Unlock()
+
+	now := time.Now().Unix()
+	b := getRetryBudget(s, window)
+	requests, retries := b.counts(now)
+	if limit := maxRetries(requests, ratio, minRetries); retries >= limit {
+		b.exhausted++
+		mylog.Logger.Warn("retry budget exhausted, fail fast",
+			zap.String("service_name", s.ServiceName),
+			zap.Int("requests", requests),
+			zap.Int("retries", retries),
+			zap.Int("max_retries", limit))
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// GetRetryBudgetStats 返回各服务当前窗口内的预算使用情况
+func GetRetryBudgetStats() []RetryBudgetStat {
+	ratio, _, minRetries := getRetryBudgetConf()
+
+	retryBudgetsMu.Lock()
+	defer retryBudgetsMu.Unlock()
+
+	now := time.Now().Unix()
+	stats := make([]RetryBudgetStat, 0, len(retryBudgets))
+	for id, b := range retryBudgets {
+		requests, retries := b.counts(now)
+		stats = append(stats, RetryBudgetStat{
+			ServiceName: b.serviceName,
+			ServiceID:   id,
+			Requests:    requests,
+			Retries:     retries,
+			MaxRetries:  maxRetries(requests, ratio, minRetries),
+			Exhausted:   b.exhausted,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ServiceName != stats[j].ServiceName {
+			return stats[i].ServiceName < stats[j].ServiceName
+		}
+		return stats[i].ServiceID < stats[j].ServiceID
+	})
+	return stats
+}
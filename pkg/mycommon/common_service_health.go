@@ -0,0 +1,194 @@
+package mycommon
+
+import (
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CircuitStateClosed   = "closed"
+	CircuitStateOpen     = "open"
+	CircuitStateHalfOpen = "half_open"
+)
+
+// serviceHealth 记录服务连续失败的次数和熔断结束的时间，openUntil不为零且已经过去时处于半开状态
+type serviceHealth struct {
+	failures      int
+	openUntil     time.Time
+	lastError     string
+	lastFailureAt time.Time
+}
+
+// ServiceCircuitStatus 服务的熔断状态
+type ServiceCircuitStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+}
+
+var (
+	serviceInFlight   = make(map[string]*int64)
+	serviceInFlightMu sync.Mutex
+	serviceHealths    = make(map[string]*serviceHealth)
+	serviceHealthMu   sync.Mutex
+)
+
+func getServiceInFlightCounter(serviceID string) *int64 {
+	serviceInFlightMu.Lock()
+	defer serviceInFlightMu.Unlock()
+	counter, exists := serviceInFlight[serviceID]
+	if !exists {
+		counter = new(int64)
+		serviceInFlight[serviceID] = counter
+	}
+	return counter
+}
+
+// AcquireService 记录服务上的进行中请求数
+func AcquireService(serviceID string) {
+	atomic.AddInt64(getServiceInFlightCounter(serviceID), 1)
+}
+
+// ReleaseService 请求结束后释放服务上的进行中请求数
+func ReleaseService(serviceID string) {
+	atomic.AddInt64(getServiceInFlightCounter(serviceID), -1)
+}
+
+// GetServiceInFlight 获取服务上的进行中请求数
+func GetServiceInFlight(serviceID string) int64 {
+	return atomic.LoadInt64(getServiceInFlightCounter(serviceID))
+}
+
+func getCircuitBreakerConf() (int, time.Duration, float64) {
+	conf := config.GetConf().CircuitBreaker
+	threshold, cooldown, factor := conf.FailureThreshold, conf.Cooldown, conf.WeightFactor
+	if threshold <= 0 {
+		threshold = config.DefaultCircuitBreakerFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = config.DefaultCircuitBreakerCooldown
+	}
+	if factor <= 0 {
+		factor = config.DefaultCircuitBreakerWeightFactor
+	}
+	return threshold, time.Duration(cooldown) * time.Second, factor
+}
+
+// isCircuitOpenMode circuit_breaker.mode为open时熔断期间不再选择该服务，否则只降低权重
+func isCircuitOpenMode() bool {
+	return strings.ToLower(config.GetConf().CircuitBreaker.Mode) == config.CircuitBreakerModeOpen
+}
+
+// RecordServiceFailure 记录服务的一次失败，连续失败达到阈值或者半开状态下失败时进入熔断期
+func RecordServiceFailure(s *config.ModelDetails, err error) {
+	threshold, cooldown, _ := getCircuitBreakerConf()
+	now := time.Now()
+
+	serviceHealthMu.Lock()
+	h, exists := serviceHealths[s.ServiceID]
+	if !exists {
+		h = &serviceHealth{}
+		serviceHealths[s.ServiceID] = h
+	}
+	halfOpen := !h.openUntil.IsZero() && !now.Before(h.openUntil)
+	h.failures++
+	h.lastFailureAt = now
+	if err != nil {
+		h.lastError = err.Error()
+	}
+	opened := h.failures >= threshold || halfOpen
+	if opened {
+		h.openUntil = now.Add(cooldown)
+	}
+	serviceHealthMu.Unlock()
+
+	if opened {
+		msg := "service circuit open, weight reduced"
+		if isCircuitOpenMode() {
+			msg = "service circuit open, service skipped"
+		}
+		mylog.Logger.Warn(msg,
+			zap.String("service_name", s.ServiceName),
+			zap.String("service_id", s.ServiceID),
+			zap.Bool("half_open", halfOpen),
+			zap.Duration("cooldown", cooldown))
+	}
+}
+
+// RecordServiceSuccess 服务请求成功后清空连续失败的次数，半开状态下成功时关闭熔断
+func RecordServiceSuccess(s *config.ModelDetails) {
+	closed := false
+	serviceHealthMu.Lock()
+	if h, exists := serviceHealths[s.ServiceID]; exists {
+		h.failures = 0
+		if !h.openUntil.IsZero() && !time.Now().Before(h.openUntil) {
+			h.openUntil = time.Time{}
+			closed = true
+		}
+	}
+	serviceHealthMu.Unlock()
+	clearServiceProbeFailure(s)
+
+	if closed {
+		mylog.Logger.Info("service circuit closed", zap.String("service_name", s.ServiceName), zap.String("service_id", s.ServiceID))
+	}
+}
+
+// GetServiceCircuitStatus 返回服务当前的熔断状态
+func GetServiceCircuitStatus(s *config.ModelDetails) ServiceCircuitStatus {
+	serviceHealthMu.Lock()
+	defer serviceHealthMu.Unlock()
+	status := ServiceCircuitStatus{State: CircuitStateClosed}
+	h, exists := serviceHealths[s.ServiceID]
+	if !exists {
+		return status
+	}
+	status.ConsecutiveFailures = h.failures
+	status.LastError = h.lastError
+	if !h.lastFailureAt.IsZero() {
+		lastFailureAt := h.lastFailureAt
+		status.LastFailureAt = &lastFailureAt
+	}
+	if !h.openUntil.IsZero() {
+		openUntil := h.openUntil
+		status.OpenUntil = &openUntil
+		status.State = CircuitStateHalfOpen
+		if time.Now().Before(h.openUntil) {
+			status.State = CircuitStateOpen
+		}
+	}
+	return status
+}
+
+// IsServiceCircuitOpen 判断服务是否处于熔断期
+func IsServiceCircuitOpen(s *config.ModelDetails) bool {
+	serviceHealthMu.Lock()
+	defer serviceHealthMu.Unlock()
+	h, exists := serviceHealths[s.ServiceID]
+	return exists && time.Now().Before(h.openUntil)
+}
+
+// GetServiceWeight 获取服务配置的权重，没有配置时为1
+func GetServiceWeight(s *config.ModelDetails) int {
+	if s.Weight <= 0 {
+		return config.DefaultServiceWeight
+	}
+	return s.Weight
+}
+
+// GetServiceEffectiveWeight 获取服务当前的有效权重，熔断期间按weight_factor降低权重
+func GetServiceEffectiveWeight(s *config.ModelDetails) float64 {
+	weight := float64(GetServiceWeight(s))
+	if IsServiceCircuitOpen(s) {
+		_, _, factor := getCircuitBreakerConf()
+		weight *= factor
+	}
+	return weight
+}
@@ -0,0 +1,331 @@
+package mycommon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"net/url"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProbeStatusHealthy   = "healthy"
+	ProbeStatusUnhealthy = "unhealthy"
+	ProbeStatusSkipped   = "skipped"
+)
+
+// ServiceProbeResult 一个上游服务的探测结果
+type ServiceProbeResult struct {
+	ServiceName string    `json:"service_name"`
+	Models      []string  `json:"models,omitempty"`
+	Status      string    `json:"status"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	LatencyMs   int64     `json:"latency_ms"`
+	Error       string    `json:"error,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// probeTarget 相同服务名、server_url和凭证的配置只探测一次
+type probeTarget struct {
+	key     string
+	service *config.ModelDetails
+	models  []string
+}
+
+var (
+	serviceProbes   = make(map[string]*ServiceProbeResult)
+	serviceProbesMu sync.Mutex
+	serviceProbeSF  singleflight.Group
+
+	// completionProbe health_check.mode为completion时发送对话请求，返回状态码，由handler注册
+	completionProbe func(ctx context.Context, s *config.ModelDetails, model string) (int, error)
+)
+
+// SetCompletionProbe 注册completion模式的探测函数
+func SetCompletionProbe(fn func(ctx context.Context, s *config.ModelDetails, model string) (int, error)) {
+	completionProbe = fn
+}
+
+func isCompletionProbeMode() bool {
+	return strings.ToLower(config.GetConf().HealthCheck.Mode) == config.HealthCheckModeCompletion && completionProbe != nil
+}
+
+func getHealthCheckConf() (time.Duration, time.Duration, time.Duration) {
+	conf := config.GetConf().HealthCheck
+	cacheTTL, timeout := conf.CacheTTL, conf.Timeout
+	if cacheTTL <= 0 {
+		cacheTTL = config.DefaultHealthCheckCacheTTL
+	}
+	if timeout <= 0 {
+		timeout = config.DefaultHealthCheckTimeout
+	}
+	return time.Duration(conf.Interval) * time.Second, time.Duration(cacheTTL) * time.Second, time.Duration(timeout) * time.Second
+}
+
+func getProbeKey(s *config.ModelDetails) string {
+	creds := s.Credentials
+	if len(s.CredentialList) > 0 {
+		creds = s.CredentialList[0]
+	}
+	return s.ServiceName + "|" + s.ServerURL + "|" + GetCredentialKey(creds)
+}
+
+func getProbeTargets() []*probeTarget {
+	targets := make(map[string]*probeTarget)
+	for model, services := range config.GetModelToService() {
+		for i := range services {
+			sd := &services[i]
+			if !sd.Enabled {
+				continue
+			}
+			key := getProbeKey(sd)
+			t, exists := targets[key]
+			if !exists {
+				t = &probeTarget{key: key, service: sd}
+				targets[key] = t
+			}
+			t.models = append(t.models, model)
+		}
+	}
+
+	list := make([]*probeTarget, 0, len(targets))
+	for _, t := range targets {
+		sort.Strings(t.models)
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].service.ServiceName != list[j].service.ServiceName {
+			return list[i].service.ServiceName < list[j].service.ServiceName
+		}
+		if list[i].models[0] != list[j].models[0] {
+			return list[i].models[0] < list[j].models[0]
+		}
+		return list[i].key < list[j].key
+	})
+	return list
+}
+
+// getProbeRequest OpenAI兼容的服务请求models接口，需要凭证正确；其他服务只对server_url发送HEAD请求，能连通即可
+func getProbeRequest(ctx context.Context, s *config.ModelDetails) (*http.Request, bool, error) {
+	serverURL := strings.TrimSuffix(s.ServerURL, "/")
+	if strings.ToLower(s.ServiceName) != "openai" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, serverURL, nil)
+		return req, false, err
+	}
+
+	serverURL = strings.TrimSuffix(serverURL, "/chat/completions")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/models", nil)
+	if err != nil {
+		return nil, true, err
+	}
+	creds := s.Credentials
+	if len(s.CredentialList) > 0 {
+		creds = s.CredentialList[0]
+	}
+	if key := GetCredentialKey(creds); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return req, true, nil
+}
+
+// probeServiceCompletion 用服务的第一个模型发送一个很短的对话请求，请求失败或者返回错误状态码时不健康
+func probeServiceCompletion(ctx context.Context, s *config.ModelDetails, model string, result *ServiceProbeResult) *ServiceProbeResult {
+	start := time.Now()
+	statusCode, err := completionProbe(ctx, s, model)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.StatusCode = statusCode
+	result.Status = ProbeStatusHealthy
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		result.Status = ProbeStatusUnhealthy
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func probeService(s *config.ModelDetails, model string, timeout time.Duration) *ServiceProbeResult {
+	result := &ServiceProbeResult{ServiceName: s.ServiceName, CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if isCompletionProbeMode() {
+		return probeServiceCompletion(ctx, s, model, result)
+	}
+
+	if s.ServerURL == "" {
+		result.Status = ProbeStatusSkipped
+		result.Error = "server_url is not configured"
+		return result
+	}
+
+	req, checkAuth, err := getProbeRequest(ctx, s)
+	if err != nil {
+		result.Status = ProbeStatusUnhealthy
+		result.Error = err.Error()
+		return result
+	}
+
+	client := &http.Client{}
+	_, transport, err := config.GetServiceTransport(s)
+	if err != nil {
+		result.Status = ProbeStatusUnhealthy
+		result.Error = err.Error()
+		return result
+	}
+	if transport != nil {
+		client.Transport = transport
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		// url.Error中带有请求地址，只返回原始错误
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		result.Status = ProbeStatusUnhealthy
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Status = ProbeStatusHealthy
+	if resp.StatusCode >= http.StatusInternalServerError ||
+		(checkAuth && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)) {
+		result.Status = ProbeStatusUnhealthy
+		result.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+	}
+	return result
+}
+
+func saveServiceProbe(key string, result *ServiceProbeResult) {
+	serviceProbesMu.Lock()
+	prev := serviceProbes[key]
+	serviceProbes[key] = result
+	serviceProbesMu.Unlock()
+
+	wasUnhealthy := prev != nil && prev.Status == ProbeStatusUnhealthy
+	if result.Status == ProbeStatusUnhealthy && !wasUnhealthy {
+		mylog.Logger.Warn("service probe failed, marked unhealthy",
+			zap.String("service_name", result.ServiceName),
+			zap.Int("status_code", result.StatusCode),
+			zap.String("error", result.Error))
+	} else if result.Status == ProbeStatusHealthy && wasUnhealthy {
+		mylog.Logger.Info("service probe recovered", zap.String("service_name", result.ServiceName))
+	}
+}
+
+// ProbeServices 探测所有启用的上游服务，cache_ttl内已有的结果直接返回，force为true时重新探测
+func ProbeServices(force bool) []ServiceProbeResult {
+	_, cacheTTL, timeout := getHealthCheckConf()
+	targets := getProbeTargets()
+	results := make([]ServiceProbeResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		serviceProbesMu.Lock()
+		cached := serviceProbes[t.key]
+		serviceProbesMu.Unlock()
+		if !force && cached != nil && time.Since(cached.CheckedAt) < cacheTTL {
+			results[i] = *cached
+			results[i].Models = t.models
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, t *probeTarget) {
+			defer wg.Done()
+			v, _, _ := serviceProbeSF.Do(t.key, func() (interface{}, error) {
+				result := probeService(t.service, t.models[0], timeout)
+				saveServiceProbe(t.key, result)
+				return result, nil
+			})
+			results[i] = *v.(*ServiceProbeResult)
+			results[i].Models = t.models
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// StartServiceProbe health_check.interval大于0时在后台定时探测上游服务
+func StartServiceProbe() {
+	interval, _, _ := getHealthCheckConf()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ProbeServices(true)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ProbeServices(true)
+		}
+	}()
+}
+
+// IsServiceProbeUnhealthy 服务最近一次探测失败时视为不健康，结果超过cache_ttl和探测间隔后不再生效
+func IsServiceProbeUnhealthy(s *config.ModelDetails) bool {
+	serviceProbesMu.Lock()
+	result := serviceProbes[getProbeKey(s)]
+	serviceProbesMu.Unlock()
+	if result == nil || result.Status != ProbeStatusUnhealthy {
+		return false
+	}
+	interval, cacheTTL, _ := getHealthCheckConf()
+	return time.Since(result.CheckedAt) < max(cacheTTL, interval)
+}
+
+// clearServiceProbeFailure 服务请求成功时说明已经恢复，不等下次探测
+func clearServiceProbeFailure(s *config.ModelDetails) {
+	key := getProbeKey(s)
+	serviceProbesMu.Lock()
+	if result, exists := serviceProbes[key]; exists && result.Status == ProbeStatusUnhealthy {
+		delete(serviceProbes, key)
+	}
+	serviceProbesMu.Unlock()
+}
+
+// IsServiceUnavailable 所有凭证都处于隔离期、探测不健康或者circuit_breaker.mode为open时处于熔断期的服务，选择服务时跳过
+func IsServiceUnavailable(s *config.ModelDetails) bool {
+	return IsServiceQuarantined(s) || isServiceDown(s)
+}
+
+// isServiceDown 探测不健康或者circuit_breaker.mode为open时处于熔断期
+func isServiceDown(s *config.ModelDetails) bool {
+	return IsServiceProbeUnhealthy(s) || (isCircuitOpenMode() && IsServiceCircuitOpen(s))
+}
+
+// GetProbedModelService 与config.GetModelService一致按负载均衡策略选择服务，选中的服务探测不健康或者熔断时改为从其他服务中选择
+func GetProbedModelService(modelName string) (*config.ModelDetails, error) {
+	s, err := config.GetModelService(modelName)
+	if err != nil || !isServiceDown(s) {
+		return s, err
+	}
+
+	var healthy []*config.ModelDetails
+	services := config.GetModelToService()[modelName]
+	for i := range services {
+		if sd := &services[i]; sd.Enabled && !isServiceDown(sd) {
+			healthy = append(healthy, sd)
+		}
+	}
+	if len(healthy) == 0 {
+		return s, nil
+	}
+	index := config.GetLBIndex(config.GetLoadBalancingStrategy(), modelName+"_healthy", len(healthy))
+	return copyModelDetails(healthy[index]), nil
+}
@@ -0,0 +1,120 @@
+package mycommon
+
+import (
+	"fmt"
+	"simple-one-api/pkg/config"
+	"sync"
+	"time"
+)
+
+// 耗时的指数加权平均系数，越大越偏向最近的请求
+const latencyEWMAAlpha = 0.3
+
+var (
+	serviceLatency   = make(map[string]float64)
+	serviceLatencyMu sync.RWMutex
+)
+
+type ServiceScore struct {
+	ServiceName string  `json:"service_name"`
+	ServiceID   string  `json:"service_id"`
+	Cost        float64 `json:"cost"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Score       float64 `json:"score"`
+	Healthy     bool    `json:"healthy"`
+}
+
+// RecordServiceLatency 记录服务成功请求的耗时
+func RecordServiceLatency(serviceID string, d time.Duration) {
+	ms := float64(d.Milliseconds())
+	serviceLatencyMu.Lock()
+	defer serviceLatencyMu.Unlock()
+	if old, exists := serviceLatency[serviceID]; exists {
+		ms = latencyEWMAAlpha*ms + (1-latencyEWMAAlpha)*old
+	}
+	serviceLatency[serviceID] = ms
+}
+
+// GetServiceLatency 获取服务的平均耗时，没有记录时返回0
+func GetServiceLatency(serviceID string) float64 {
+	serviceLatencyMu.RLock()
+	defer serviceLatencyMu.RUnlock()
+	return serviceLatency[serviceID]
+}
+
+// GetCostLatencyWeights 获取成本和耗时的权重，都没有配置时使用默认值
+func GetCostLatencyWeights() (float64, float64) {
+	conf := config.GetConf().CostLatency
+	if conf.CostWeight <= 0 && conf.LatencyWeight <= 0 {
+		return config.DefaultCostWeight, config.DefaultLatencyWeight
+	}
+	return conf.CostWeight, conf.LatencyWeight
+}
+
+// ScoreModelServices 计算模型每个启用服务的得分，成本和耗时按所有服务中的最大值归一化后加权，得分越低越好。
+// 还没有耗时记录的服务耗时按0计算，优先被选择以获得耗时数据
+func ScoreModelServices(modelName string) []ServiceScore {
+	var scores []ServiceScore
+	var maxCost, maxLatency float64
+	for _, sd := range config.GetModelToService()[modelName] {
+		if !sd.Enabled {
+			continue
+		}
+		score := ServiceScore{
+			ServiceName: sd.ServiceName,
+			ServiceID:   sd.ServiceID,
+			Cost:        sd.Cost,
+			LatencyMs:   GetServiceLatency(sd.ServiceID),
+			Healthy:     !IsServiceUnavailable(&sd),
+		}
+		if score.Cost > maxCost {
+			maxCost = score.Cost
+		}
+		if score.LatencyMs > maxLatency {
+			maxLatency = score.LatencyMs
+		}
+		scores = append(scores, score)
+	}
+
+	costWeight, latencyWeight := GetCostLatencyWeights()
+	for i := range scores {
+		if maxCost > 0 {
+			scores[i].Score += costWeight * scores[i].Cost / maxCost
+		}
+		if maxLatency > 0 {
+			scores[i].Score += latencyWeight * scores[i].LatencyMs / maxLatency
+		}
+	}
+
+	return scores
+}
+
+// GetBestScoredModelService 选择得分最低的可用服务，所有服务都不可用时从全部服务中选择
+func GetBestScoredModelService(modelName string) (*config.ModelDetails, error) {
+	scores := ScoreModelServices(modelName)
+	if len(scores) == 0 {
+		return nil, fmt.Errorf("no enabled model %s found in the configuration", modelName)
+	}
+
+	best := -1
+	for _, healthyOnly := range []bool{true, false} {
+		for i, score := range scores {
+			if healthyOnly && !score.Healthy {
+				continue
+			}
+			if best < 0 || score.Score < scores[best].Score {
+				best = i
+			}
+		}
+		if best >= 0 {
+			break
+		}
+	}
+
+	for _, sd := range config.GetModelToService()[modelName] {
+		if sd.ServiceID == scores[best].ServiceID {
+			return &sd, nil
+		}
+	}
+	return nil, fmt.Errorf("no enabled model %s found in the configuration", modelName)
+}
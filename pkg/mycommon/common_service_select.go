@@ -0,0 +1,75 @@
+package mycommon
+
+import (
+	"fmt"
+	"math/rand"
+	"simple-one-api/pkg/config"
+)
+
+// getSelectableServices 获取模型启用的服务，跳过所有凭证都处于隔离期或探测不健康的服务，全部不可用时返回所有启用的服务
+func getSelectableServices(modelName string) []*config.ModelDetails {
+	var enabled, healthy []*config.ModelDetails
+	services := config.GetModelToService()[modelName]
+	for i := range services {
+		sd := &services[i]
+		if !sd.Enabled {
+			continue
+		}
+		enabled = append(enabled, sd)
+		if !IsServiceUnavailable(sd) {
+			healthy = append(healthy, sd)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return enabled
+}
+
+// GetWeightedModelService 按有效权重随机选择服务，熔断中的服务权重会被降低
+func GetWeightedModelService(modelName string) (*config.ModelDetails, error) {
+	services := getSelectableServices(modelName)
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no enabled model %s found in the configuration", modelName)
+	}
+
+	weights := make([]float64, len(services))
+	var total float64
+	for i, sd := range services {
+		weights[i] = GetServiceEffectiveWeight(sd)
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return copyModelDetails(services[i]), nil
+		}
+		r -= w
+	}
+	return copyModelDetails(services[len(services)-1]), nil
+}
+
+// GetLeastInFlightModelService 选择进行中请求数按有效权重折算后最少的服务，相同时选择权重高的
+func GetLeastInFlightModelService(modelName string) (*config.ModelDetails, error) {
+	services := getSelectableServices(modelName)
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no enabled model %s found in the configuration", modelName)
+	}
+
+	best, bestLoad, bestWeight := services[0], 0.0, 0.0
+	for i, sd := range services {
+		weight := GetServiceEffectiveWeight(sd)
+		load := float64(GetServiceInFlight(sd.ServiceID)+1) / weight
+		if i == 0 || load < bestLoad || (load == bestLoad && weight > bestWeight) {
+			best, bestLoad, bestWeight = sd, load, weight
+		}
+	}
+	return copyModelDetails(best), nil
+}
+
+// copyModelDetails 与config.GetModelService一致，返回配置的副本
+func copyModelDetails(s *config.ModelDetails) *config.ModelDetails {
+	sd := *s
+	return &sd
+}
@@ -0,0 +1,100 @@
+package mycommon
+
+import (
+	"simple-one-api/pkg/config"
+	"sort"
+)
+
+const (
+	UpstreamStatusHealthy  = "healthy"
+	UpstreamStatusDegraded = "degraded"
+)
+
+// UpstreamStatus 一个上游服务当前的状态，只使用已有的熔断、探测和凭证隔离记录，不会访问上游
+type UpstreamStatus struct {
+	ServiceName            string               `json:"service_name"`
+	ServiceID              string               `json:"service_id"`
+	ServerURL              string               `json:"server_url,omitempty"`
+	Models                 []string             `json:"models"`
+	Status                 string               `json:"status"`
+	Reasons                []string             `json:"reasons,omitempty"`
+	Circuit                ServiceCircuitStatus `json:"circuit"`
+	Probe                  *ServiceProbeResult  `json:"probe,omitempty"`
+	Credentials            int                  `json:"credentials"`
+	QuarantinedCredentials int                  `json:"quarantined_credentials"`
+	InFlight               int64                `json:"in_flight"`
+}
+
+// GetUpstreamStatuses 返回所有启用的服务的状态，处于熔断期或半开状态、探测不健康、所有凭证都被隔离时为degraded
+func GetUpstreamStatuses() []UpstreamStatus {
+	statuses := make(map[string]*UpstreamStatus)
+	for model, services := range config.GetModelToService() {
+		for i := range services {
+			sd := &services[i]
+			if !sd.Enabled {
+				continue
+			}
+			if st, exists := statuses[sd.ServiceID]; exists {
+				st.Models = append(st.Models, model)
+				continue
+			}
+			statuses[sd.ServiceID] = getUpstreamStatus(sd, model)
+		}
+	}
+
+	list := make([]UpstreamStatus, 0, len(statuses))
+	for _, st := range statuses {
+		sort.Strings(st.Models)
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ServiceName != list[j].ServiceName {
+			return list[i].ServiceName < list[j].ServiceName
+		}
+		return list[i].ServiceID < list[j].ServiceID
+	})
+	return list
+}
+
+func getUpstreamStatus(s *config.ModelDetails, model string) *UpstreamStatus {
+	st := &UpstreamStatus{
+		ServiceName: s.ServiceName,
+		ServiceID:   s.ServiceID,
+		ServerURL:   s.ServerURL,
+		Models:      []string{model},
+		Status:      UpstreamStatusHealthy,
+		Circuit:     GetServiceCircuitStatus(s),
+		Credentials: len(s.CredentialList),
+		InFlight:    GetServiceInFlight(s.ServiceID),
+	}
+	if st.Credentials == 0 {
+		st.Credentials = 1
+	}
+	for i := range s.CredentialList {
+		if IsCredentialQuarantined(getCredentialID(s, i)) {
+			st.QuarantinedCredentials++
+		}
+	}
+
+	serviceProbesMu.Lock()
+	if result, exists := serviceProbes[getProbeKey(s)]; exists {
+		probe := *result
+		probe.Models = nil
+		st.Probe = &probe
+	}
+	serviceProbesMu.Unlock()
+
+	if st.Circuit.State != CircuitStateClosed {
+		st.Reasons = append(st.Reasons, "circuit_"+st.Circuit.State)
+	}
+	if IsServiceProbeUnhealthy(s) {
+		st.Reasons = append(st.Reasons, "probe_unhealthy")
+	}
+	if IsServiceQuarantined(s) {
+		st.Reasons = append(st.Reasons, "credentials_quarantined")
+	}
+	if len(st.Reasons) > 0 {
+		st.Status = UpstreamStatusDegraded
+	}
+	return st
+}
@@ -0,0 +1,123 @@
+package mycommon
+
+import (
+	"simple-one-api/pkg/config"
+	"sync"
+	"time"
+)
+
+// sessionAffinity 会话上次使用的服务和凭证
+type sessionAffinity struct {
+	serviceID string
+	credID    string
+	expiresAt time.Time
+}
+
+var (
+	sessionAffinities   = make(map[string]*sessionAffinity)
+	sessionAffinitiesMu sync.Mutex
+	lastAffinitySweep   time.Time
+)
+
+func getSessionAffinityTTL() time.Duration {
+	ttl := config.GetConf().SessionAffinity.TTL
+	if ttl <= 0 {
+		ttl = config.DefaultSessionAffinityTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func getSessionAffinity(sessionKey string) (*sessionAffinity, bool) {
+	sessionAffinitiesMu.Lock()
+	defer sessionAffinitiesMu.Unlock()
+
+	a, exists := sessionAffinities[sessionKey]
+	if !exists || time.Now().After(a.expiresAt) {
+		return nil, false
+	}
+	return a, true
+}
+
+// GetAffinityService 返回会话上次使用的服务，服务已经不在配置中、被禁用或者不可用时返回nil
+func GetAffinityService(sessionKey, model string) *config.ModelDetails {
+	a, ok := getSessionAffinity(sessionKey)
+	if !ok {
+		return nil
+	}
+	for _, sd := range config.GetModelToService()[model] {
+		if sd.ServiceID != a.serviceID || !sd.Enabled {
+			continue
+		}
+		if IsServiceUnavailable(&sd) || IsServiceCircuitOpen(&sd) {
+			return nil
+		}
+		return &sd
+	}
+	return nil
+}
+
+// GetAffinityCredentials 返回会话上次在服务s上使用的凭证，凭证处于隔离期或者已经不在配置中时返回false
+func GetAffinityCredentials(sessionKey string, s *config.ModelDetails) (map[string]interface{}, string, bool) {
+	a, ok := getSessionAffinity(sessionKey)
+	if !ok || a.serviceID != s.ServiceID || a.credID == "" {
+		return nil, "", false
+	}
+	for i := range s.CredentialList {
+		if credID := getCredentialID(s, i); credID == a.credID {
+			if IsCredentialQuarantined(credID) {
+				return nil, "", false
+			}
+			return s.CredentialList[i], credID, true
+		}
+	}
+	return nil, "", false
+}
+
+// SetSessionAffinity 记录会话使用的服务和凭证，每次请求都会延长保持时间；超过max_entries时先清理过期的会话，
+// 仍然超过时丢弃最早过期的会话
+func SetSessionAffinity(sessionKey, serviceID, credID string) {
+	sessionAffinitiesMu.Lock()
+	defer sessionAffinitiesMu.Unlock()
+
+	now := time.Now()
+	sweepSessionAffinities(now, false)
+
+	if _, exists := sessionAffinities[sessionKey]; !exists {
+		maxEntries := config.GetConf().SessionAffinity.MaxEntries
+		if maxEntries <= 0 {
+			maxEntries = config.DefaultSessionAffinityMaxEntries
+		}
+		if len(sessionAffinities) >= maxEntries {
+			sweepSessionAffinities(now, true)
+		}
+		if len(sessionAffinities) >= maxEntries {
+			evictOldestSessionAffinity()
+		}
+	}
+	sessionAffinities[sessionKey] = &sessionAffinity{serviceID: serviceID, credID: credID, expiresAt: now.Add(getSessionAffinityTTL())}
+}
+
+// sweepSessionAffinities 每分钟最多清理一次过期的会话，force为true时立即清理，需要持有锁
+func sweepSessionAffinities(now time.Time, force bool) {
+	if !force && now.Sub(lastAffinitySweep) < time.Minute {
+		return
+	}
+	lastAffinitySweep = now
+
+	for key, a := range sessionAffinities {
+		if now.After(a.expiresAt) {
+			delete(sessionAffinities, key)
+		}
+	}
+}
+
+func evictOldestSessionAffinity() {
+	var oldestKey string
+	var oldest time.Time
+	for key, a := range sessionAffinities {
+		if oldestKey == "" || a.expiresAt.Before(oldest) {
+			oldestKey, oldest = key, a.expiresAt
+		}
+	}
+	delete(sessionAffinities, oldestKey)
+}
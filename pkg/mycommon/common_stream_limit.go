@@ -0,0 +1,62 @@
+package mycommon
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	activeStreams   = make(map[string]int)
+	activeStreamsMu sync.Mutex
+
+	serviceStreams   = make(map[string]*int64)
+	serviceStreamsMu sync.Mutex
+)
+
+// AcquireStream 占用key的一个流式请求名额，已达到上限时返回false，limit<=0表示不限制
+func AcquireStream(apikey string, limit int) bool {
+	activeStreamsMu.Lock()
+	defer activeStreamsMu.Unlock()
+	if limit > 0 && activeStreams[apikey] >= limit {
+		return false
+	}
+	activeStreams[apikey]++
+	return true
+}
+
+// ReleaseStream 流式请求结束或客户端断开后释放名额
+func ReleaseStream(apikey string) {
+	activeStreamsMu.Lock()
+	defer activeStreamsMu.Unlock()
+	if activeStreams[apikey] <= 1 {
+		delete(activeStreams, apikey)
+		return
+	}
+	activeStreams[apikey]--
+}
+
+func getServiceStreamsCounter(serviceID string) *int64 {
+	serviceStreamsMu.Lock()
+	defer serviceStreamsMu.Unlock()
+	counter, exists := serviceStreams[serviceID]
+	if !exists {
+		counter = new(int64)
+		serviceStreams[serviceID] = counter
+	}
+	return counter
+}
+
+// AcquireServiceStream 记录服务上进行中的流式请求数
+func AcquireServiceStream(serviceID string) {
+	atomic.AddInt64(getServiceStreamsCounter(serviceID), 1)
+}
+
+// ReleaseServiceStream 流式请求结束后释放服务上进行中的流式请求数
+func ReleaseServiceStream(serviceID string) {
+	atomic.AddInt64(getServiceStreamsCounter(serviceID), -1)
+}
+
+// GetServiceStreams 获取服务上进行中的流式请求数
+func GetServiceStreams(serviceID string) int64 {
+	return atomic.LoadInt64(getServiceStreamsCounter(serviceID))
+}
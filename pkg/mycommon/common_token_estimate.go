@@ -0,0 +1,17 @@
+package mycommon
+
+import "unicode"
+
+// EstimateTokens 粗略估算文本的token数，中日韩字符按每个1个token，其他字符按每4个1个token
+func EstimateTokens(text string) int {
+	cjk := 0
+	others := 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			cjk++
+		} else {
+			others++
+		}
+	}
+	return cjk + (others+3)/4
+}
@@ -0,0 +1,13 @@
+package mycommon
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"simple-one-api/pkg/mylog"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	mylog.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
@@ -1,6 +1,7 @@
 package mycommon
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -8,9 +9,12 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"regexp"
+	"simple-one-api/pkg/config"
 	"simple-one-api/pkg/mylog"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 func GetSystemMessage(oaiReqMessage []openai.ChatCompletionMessage) string {
@@ -68,6 +72,27 @@ func IsMultiContentMessage(oaiReqMessage []openai.ChatCompletionMessage) bool {
 	return false
 }
 
+// HasImageContent 判断消息中是否包含图片
+func HasImageContent(oaiReqMessage []openai.ChatCompletionMessage) bool {
+	for _, msg := range oaiReqMessage {
+		for _, part := range msg.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CountMessagesChars 统计所有消息文本内容的字符数
+func CountMessagesChars(oaiReqMessage []openai.ChatCompletionMessage) int {
+	count := 0
+	for _, msg := range oaiReqMessage {
+		count += utf8.RuneCountInString(GetMessageText(msg))
+	}
+	return count
+}
+
 // ProcessMessages 根据消息的角色处理聊天历史。
 func ConvertSystemMessages2NoSystem(oaiReqMessage []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
 	var systemQuery string
@@ -86,7 +111,7 @@ func ConvertSystemMessages2NoSystem(oaiReqMessage []openai.ChatCompletionMessage
 		}
 	}
 
-	mylog.Logger.Debug("ConvertSystemMessages2NoSystem", zap.Any("oaiReqMessage", oaiReqMessage))
+	mylog.Logger.Debug("ConvertSystemMessages2NoSystem", zap.String("oaiReqMessage", ElideBase64JSON(oaiReqMessage)))
 
 	return oaiReqMessage
 }
@@ -142,7 +167,11 @@ func GetImageURLData(dataStr string) (string, string, error) {
 		if sepIndex == -1 {
 			return "", "", fmt.Errorf("invalid data URL format")
 		}
+		// data:image/png;base64,xxx 中只取image/png
 		mime := dataStr[5:sepIndex]
+		if idx := strings.Index(mime, ";"); idx >= 0 {
+			mime = mime[:idx]
+		}
 		base64Data := dataStr[sepIndex+1:]
 		return base64Data, mime, nil
 	} else if strings.HasPrefix(dataStr, "http") {
@@ -163,12 +192,13 @@ func GetImageURLData(dataStr string) (string, string, error) {
 		// 通过 base64.NewEncoder 创建一个写入器，直接将数据编码为 base64
 		var base64Writer strings.Builder
 		encoder := base64.NewEncoder(base64.StdEncoding, &base64Writer)
-		defer encoder.Close()
 
 		// 从 response.Body 直接流式读取数据到 base64 编码器
 		if _, err := io.Copy(encoder, response.Body); err != nil {
 			return "", "", fmt.Errorf("error encoding image data to base64: %v", err)
 		}
+		// Close 之后才会写入最后不足一组的数据
+		encoder.Close()
 
 		mimeType := response.Header.Get("Content-Type")
 		return base64Writer.String(), mimeType, nil
@@ -209,72 +239,137 @@ func DeepCopyChatCompletionRequest(r openai.ChatCompletionRequest) openai.ChatCo
 				}
 			}
 		}
+		if len(message.ToolCalls) > 0 {
+			newRequest.Messages[i].ToolCalls = append([]openai.ToolCall(nil), message.ToolCalls...)
+		}
 	}
 	return newRequest
 }
 
-// LogChatCompletionRequest 记录ChatCompletionRequest到日志中
-func LogChatCompletionRequest(request openai.ChatCompletionRequest) {
-	mylog.Logger.Debug("LogChatCompletionRequest", zap.Any("req", request))
-	// 创建请求的深度副本
-	filteredRequest := DeepCopyChatCompletionRequest(request)
-
-	// 过滤MultiContent中的ImageURL
-	for i, message := range filteredRequest.Messages {
-		if len(message.MultiContent) > 0 {
-			for j, part := range message.MultiContent {
-				if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
-					if !strings.HasPrefix(part.ImageURL.URL, "http") {
-						// 如果URL不是http开头，移除该ImageURL
-						d := "..."
-						filteredRequest.Messages[i].MultiContent[j].ImageURL.URL = d
-					}
-				}
+// ElideBase64Images 返回用于记录日志的请求，base64图片数据替换为占位符，原请求不变
+func ElideBase64Images(request *openai.ChatCompletionRequest) *openai.ChatCompletionRequest {
+	if request == nil || (config.GetConf() != nil && config.GetConf().LogBase64Images) {
+		return request
+	}
+
+	var filteredRequest *openai.ChatCompletionRequest
+	for i, message := range request.Messages {
+		for j, part := range message.MultiContent {
+			if part.Type != openai.ChatMessagePartTypeImageURL || part.ImageURL == nil || strings.HasPrefix(part.ImageURL.URL, "http") {
+				continue
+			}
+			if filteredRequest == nil {
+				copied := DeepCopyChatCompletionRequest(*request)
+				filteredRequest = &copied
+			}
+			data := part.ImageURL.URL
+			if idx := strings.Index(data, ","); strings.HasPrefix(data, "data:") && idx >= 0 {
+				data = data[idx+1:]
 			}
+			filteredRequest.Messages[i].MultiContent[j].ImageURL.URL = fmt.Sprintf("[base64 image, %d bytes]", len(data))
 		}
 	}
 
-	mylog.Logger.Debug("LogChatCompletionRequest", zap.Any("filteredRequest", filteredRequest))
+	if filteredRequest == nil {
+		return request
+	}
+	return filteredRequest
+}
+
+var longBase64Re = regexp.MustCompile(`"(data:[^";,]*;base64,)?[A-Za-z0-9+/=]{1000,}"`)
+
+// ElideBase64JSON 将对象序列化为JSON，并把其中较长的base64数据替换为长度说明，用于记录各家协议的请求日志
+func ElideBase64JSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	if config.GetConf() != nil && config.GetConf().LogBase64Images {
+		return string(data)
+	}
+	return string(longBase64Re.ReplaceAllFunc(data, func(m []byte) []byte {
+		return []byte(fmt.Sprintf(`"[base64 data, %d bytes]"`, len(m)-2))
+	}))
+}
+
+// LogChatCompletionRequest 记录ChatCompletionRequest到日志中
+func LogChatCompletionRequest(ctx context.Context, request openai.ChatCompletionRequest) {
+	logger := mylog.FromContext(ctx)
+	filteredRequest := RedactRequestPaths(ElideBase64Images(&request), config.GetRedactPaths(request.Model))
+
+	logger.Debug("LogChatCompletionRequest", zap.Any("filteredRequest", filteredRequest))
 	// 将结构体转换为JSON字符串
 	jsonData, err := json.Marshal(filteredRequest)
 	if err != nil {
-		mylog.Logger.Error("LogChatCompletionRequest|Marshal", zap.Error(err))
+		logger.Error("LogChatCompletionRequest|Marshal", zap.Error(err))
 		return
 	}
 
-	mylog.Logger.Info("LogChatCompletionRequest", zap.String("request", string(jsonData)))
+	logger.Info("LogChatCompletionRequest", zap.String("request", string(jsonData)))
 
 }
 
 func ParseChatCompletionRequest(data []byte) (*openai.ChatCompletionRequest, error) {
-	var rawRequest struct {
-		Model       string            `json:"model"`
-		Messages    []json.RawMessage `json:"messages"`
-		Temperature float32           `json:"temperature,omitempty"`
-		Stream      bool              `json:"stream,omitempty"`
-	}
-
+	var rawRequest map[string]json.RawMessage
 	if err := json.Unmarshal(data, &rawRequest); err != nil {
 		return nil, err
 	}
 
-	request := &openai.ChatCompletionRequest{
-		Model:       rawRequest.Model,
-		Temperature: rawRequest.Temperature,
-		Stream:      rawRequest.Stream,
+	var rawMessages []json.RawMessage
+	if msgs, exists := rawRequest["messages"]; exists {
+		if err := json.Unmarshal(msgs, &rawMessages); err != nil {
+			return nil, err
+		}
+		delete(rawRequest, "messages")
+	}
+
+	// messages以外的字段（包括tools、tool_choice等）按go-openai的定义解析，解析失败时只保留基本字段
+	otherData, err := json.Marshal(rawRequest)
+	if err != nil {
+		return nil, err
+	}
+	request := &openai.ChatCompletionRequest{}
+	if err := json.Unmarshal(otherData, request); err != nil {
+		var basic struct {
+			Model       string  `json:"model"`
+			Temperature float32 `json:"temperature,omitempty"`
+			Stream      bool    `json:"stream,omitempty"`
+		}
+		if err := json.Unmarshal(otherData, &basic); err != nil {
+			return nil, err
+		}
+		request = &openai.ChatCompletionRequest{
+			Model:       basic.Model,
+			Temperature: basic.Temperature,
+			Stream:      basic.Stream,
+		}
 	}
 
-	for _, rawMsg := range rawRequest.Messages {
+	for _, rawMsg := range rawMessages {
 		var rawMessage struct {
-			Role    string          `json:"role"`
-			Content json.RawMessage `json:"content"`
+			Role         string               `json:"role"`
+			Content      json.RawMessage      `json:"content"`
+			Name         string               `json:"name,omitempty"`
+			FunctionCall *openai.FunctionCall `json:"function_call,omitempty"`
+			ToolCalls    []openai.ToolCall    `json:"tool_calls,omitempty"`
+			ToolCallID   string               `json:"tool_call_id,omitempty"`
 		}
 		if err := json.Unmarshal(rawMsg, &rawMessage); err != nil {
 			return nil, err
 		}
 
 		message := openai.ChatCompletionMessage{
-			Role: rawMessage.Role,
+			Role:         rawMessage.Role,
+			Name:         rawMessage.Name,
+			FunctionCall: rawMessage.FunctionCall,
+			ToolCalls:    rawMessage.ToolCalls,
+			ToolCallID:   rawMessage.ToolCallID,
+		}
+
+		// 调用工具的assistant消息content可以为空
+		if len(rawMessage.Content) == 0 || string(rawMessage.Content) == "null" {
+			request.Messages = append(request.Messages, message)
+			continue
 		}
 
 		// 尝试将 Content 解析为字符串
@@ -313,3 +408,347 @@ func ParseChatCompletionRequest(data []byte) (*openai.ChatCompletionRequest, err
 
 	return request, nil
 }
+
+// FoldSystemMessages 将所有system消息合并到第一条user消息前，用于不支持system角色的服务
+func FoldSystemMessages(oaiReqMessage []openai.ChatCompletionMessage, separator string, template string) []openai.ChatCompletionMessage {
+	var systemParts []string
+	var messages []openai.ChatCompletionMessage
+	for _, msg := range oaiReqMessage {
+		if strings.ToLower(msg.Role) == openai.ChatMessageRoleSystem {
+			text := GetMessageText(msg)
+			if text != "" {
+				systemParts = append(systemParts, text)
+			}
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(systemParts) == 0 {
+		return oaiReqMessage
+	}
+
+	systemText := strings.Join(systemParts, separator)
+	if template != "" {
+		// 只替换第一个%s占位符，模板中其它的%原样保留
+		if strings.Contains(template, "%s") {
+			systemText = strings.Replace(template, "%s", systemText, 1)
+		} else {
+			systemText = template + systemText
+		}
+	}
+
+	for i := range messages {
+		if strings.ToLower(messages[i].Role) != openai.ChatMessageRoleUser {
+			continue
+		}
+		if len(messages[i].MultiContent) > 0 {
+			parts := make([]openai.ChatMessagePart, 0, len(messages[i].MultiContent)+1)
+			parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: systemText + separator})
+			messages[i].MultiContent = append(parts, messages[i].MultiContent...)
+		} else {
+			messages[i].Content = systemText + separator + messages[i].Content
+		}
+
+		mylog.Logger.Debug("FoldSystemMessages", zap.Int("system_count", len(systemParts)), zap.Int("user_index", i))
+		return messages
+	}
+
+	// 没有user消息时，system内容作为一条user消息
+	userMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: systemText}
+	return append([]openai.ChatCompletionMessage{userMsg}, messages...)
+}
+
+// SplitSystemPrompt system消息总长度超过maxChars时，只保留前maxChars个字符，
+// 超出的部分合并到第一条user消息前，truncate为true时直接丢弃，返回处理后的消息及超出的字符数
+func SplitSystemPrompt(oaiReqMessage []openai.ChatCompletionMessage, maxChars int, truncate bool, separator string) ([]openai.ChatCompletionMessage, int) {
+	if maxChars <= 0 {
+		return oaiReqMessage, 0
+	}
+
+	remain := maxChars
+	var overflowParts []string
+	overflowChars := 0
+	messages := make([]openai.ChatCompletionMessage, 0, len(oaiReqMessage))
+	for _, msg := range oaiReqMessage {
+		if strings.ToLower(msg.Role) != openai.ChatMessageRoleSystem {
+			messages = append(messages, msg)
+			continue
+		}
+
+		text := GetMessageText(msg)
+		runes := []rune(text)
+		if len(runes) <= remain {
+			remain -= len(runes)
+			messages = append(messages, msg)
+			continue
+		}
+
+		kept := splitPromptAt(runes, remain)
+		overflowChars += len(runes) - kept
+		overflowParts = append(overflowParts, strings.TrimLeft(string(runes[kept:]), "\n"))
+		remain = 0
+		if kept == 0 {
+			continue
+		}
+		msg.Content = strings.TrimRight(string(runes[:kept]), "\n")
+		msg.MultiContent = nil
+		messages = append(messages, msg)
+	}
+
+	if overflowChars == 0 {
+		return oaiReqMessage, 0
+	}
+	if truncate {
+		return messages, overflowChars
+	}
+
+	overflowText := strings.Join(overflowParts, separator)
+	for i := range messages {
+		if strings.ToLower(messages[i].Role) != openai.ChatMessageRoleUser {
+			continue
+		}
+		if len(messages[i].MultiContent) > 0 {
+			parts := make([]openai.ChatMessagePart, 0, len(messages[i].MultiContent)+1)
+			parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: overflowText + separator})
+			messages[i].MultiContent = append(parts, messages[i].MultiContent...)
+		} else {
+			messages[i].Content = overflowText + separator + messages[i].Content
+		}
+		return messages, overflowChars
+	}
+
+	// 没有user消息时，超出的部分作为一条user消息放在system消息之后
+	userMsg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: overflowText}
+	insertAt := 0
+	for insertAt < len(messages) && strings.ToLower(messages[insertAt].Role) == openai.ChatMessageRoleSystem {
+		insertAt++
+	}
+	result := make([]openai.ChatCompletionMessage, 0, len(messages)+1)
+	result = append(result, messages[:insertAt]...)
+	result = append(result, userMsg)
+	return append(result, messages[insertAt:]...), overflowChars
+}
+
+// splitPromptAt 在limit以内找拆分的位置，后半部分有换行时从换行处拆分，避免截断句子
+func splitPromptAt(runes []rune, limit int) int {
+	for i := limit; i > limit/2; i-- {
+		if runes[i-1] == '\n' {
+			return i
+		}
+	}
+	return limit
+}
+
+// GetMessageText 获取消息中的文本内容
+func GetMessageText(msg openai.ChatCompletionMessage) string {
+	if len(msg.MultiContent) == 0 {
+		return msg.Content
+	}
+
+	var texts []string
+	for _, part := range msg.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// DedupConsecutiveMessages 合并相邻的、角色和内容完全相同的重复消息，返回处理后的消息及移除的数量
+func DedupConsecutiveMessages(oaiReqMessage []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, int) {
+	if len(oaiReqMessage) < 2 {
+		return oaiReqMessage, 0
+	}
+
+	dedupMessages := make([]openai.ChatCompletionMessage, 0, len(oaiReqMessage))
+	removed := 0
+	for i, msg := range oaiReqMessage {
+		if i > 0 && isSameMessage(oaiReqMessage[i-1], msg) {
+			removed++
+			continue
+		}
+		dedupMessages = append(dedupMessages, msg)
+	}
+
+	return dedupMessages, removed
+}
+
+func isSameMessage(a, b openai.ChatCompletionMessage) bool {
+	if strings.ToLower(a.Role) != strings.ToLower(b.Role) {
+		return false
+	}
+	// tool调用相关的消息不做合并
+	if len(a.ToolCalls) > 0 || len(b.ToolCalls) > 0 || a.ToolCallID != "" || b.ToolCallID != "" {
+		return false
+	}
+	if a.Content != b.Content || len(a.MultiContent) != len(b.MultiContent) {
+		return false
+	}
+	for i := range a.MultiContent {
+		pa, pb := a.MultiContent[i], b.MultiContent[i]
+		if pa.Type != pb.Type || pa.Text != pb.Text {
+			return false
+		}
+		if (pa.ImageURL == nil) != (pb.ImageURL == nil) {
+			return false
+		}
+		if pa.ImageURL != nil && pa.ImageURL.URL != pb.ImageURL.URL {
+			return false
+		}
+	}
+	return true
+}
+
+const DefaultTruncatedSuffix = "..."
+
+// TruncateAssistantHistory 将历史assistant消息截断到maxChars个字符，最近的keepRecent条assistant消息保持不变，返回处理后的消息及估算节省的token数
+func TruncateAssistantHistory(oaiReqMessage []openai.ChatCompletionMessage, maxChars int, keepRecent int) ([]openai.ChatCompletionMessage, int) {
+	if maxChars <= 0 {
+		return oaiReqMessage, 0
+	}
+
+	savedTokens := 0
+	kept := 0
+	for i := len(oaiReqMessage) - 1; i >= 0; i-- {
+		msg := &oaiReqMessage[i]
+		if strings.ToLower(msg.Role) != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		if kept < keepRecent {
+			kept++
+			continue
+		}
+		// 只处理纯文本内容
+		if len(msg.MultiContent) > 0 {
+			continue
+		}
+
+		runes := []rune(msg.Content)
+		if len(runes) <= maxChars {
+			continue
+		}
+		savedTokens += EstimateTokens(string(runes[maxChars:]))
+		msg.Content = string(runes[:maxChars]) + DefaultTruncatedSuffix
+	}
+
+	return oaiReqMessage, savedTokens
+}
+
+const DefaultMergeSeparator = "\n\n"
+
+// MergeConsecutiveRoleMessages 将相邻的同角色user或assistant消息按顺序合并为一条，用于要求角色严格交替的服务
+func MergeConsecutiveRoleMessages(oaiReqMessage []openai.ChatCompletionMessage, separator string) []openai.ChatCompletionMessage {
+	if len(oaiReqMessage) < 2 {
+		return oaiReqMessage
+	}
+
+	mergedMessages := make([]openai.ChatCompletionMessage, 0, len(oaiReqMessage))
+	for _, msg := range oaiReqMessage {
+		n := len(mergedMessages)
+		if n > 0 && isMergeableRole(msg) && isMergeableRole(mergedMessages[n-1]) &&
+			strings.ToLower(mergedMessages[n-1].Role) == strings.ToLower(msg.Role) {
+			mergedMessages[n-1] = mergeMessages(mergedMessages[n-1], msg, separator)
+			continue
+		}
+		mergedMessages = append(mergedMessages, msg)
+	}
+
+	if len(mergedMessages) != len(oaiReqMessage) {
+		mylog.Logger.Debug("MergeConsecutiveRoleMessages", zap.Int("before", len(oaiReqMessage)), zap.Int("after", len(mergedMessages)))
+	}
+
+	return mergedMessages
+}
+
+func isMergeableRole(msg openai.ChatCompletionMessage) bool {
+	role := strings.ToLower(msg.Role)
+	if role != openai.ChatMessageRoleUser && role != openai.ChatMessageRoleAssistant {
+		return false
+	}
+	return len(msg.ToolCalls) == 0 && msg.ToolCallID == ""
+}
+
+func mergeMessages(a, b openai.ChatCompletionMessage, separator string) openai.ChatCompletionMessage {
+	if len(a.MultiContent) == 0 && len(b.MultiContent) == 0 {
+		a.Content = a.Content + separator + b.Content
+		return a
+	}
+
+	parts := toMessageParts(a)
+	parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: separator})
+	parts = append(parts, toMessageParts(b)...)
+	a.Content = ""
+	a.MultiContent = parts
+	return a
+}
+
+func toMessageParts(msg openai.ChatCompletionMessage) []openai.ChatMessagePart {
+	if len(msg.MultiContent) > 0 {
+		return append([]openai.ChatMessagePart{}, msg.MultiContent...)
+	}
+	return []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: msg.Content}}
+}
+
+// estimateMessageTokens 估算一条消息的token数，与按"role: content"拼接后估算的结果一致
+func estimateMessageTokens(msg openai.ChatCompletionMessage) int {
+	return EstimateTokens(msg.Role + ": " + GetMessageText(msg) + "\n")
+}
+
+// DropOldestMessages 从最早的非system消息开始删除，直到估算的token数不超过maxTokens，system消息和最近的keepRecent条消息保留；
+// tool消息与前面调用它的assistant消息一起删除，删除后对话以user消息开始。返回保留的消息和删除的消息
+func DropOldestMessages(oaiReqMessage []openai.ChatCompletionMessage, maxTokens int, keepRecent int) ([]openai.ChatCompletionMessage, []openai.ChatCompletionMessage) {
+	total := 0
+	for _, msg := range oaiReqMessage {
+		total += estimateMessageTokens(msg)
+	}
+	if total <= maxTokens {
+		return oaiReqMessage, nil
+	}
+
+	// 最近的keepRecent条非system消息的位置之后都不能删除
+	protectFrom := len(oaiReqMessage)
+	for i, kept := len(oaiReqMessage)-1, 0; i >= 0 && kept < keepRecent; i-- {
+		if strings.ToLower(oaiReqMessage[i].Role) != openai.ChatMessageRoleSystem {
+			protectFrom = i
+			kept++
+		}
+	}
+
+	drop := make([]bool, len(oaiReqMessage))
+	var dropped []openai.ChatCompletionMessage
+	for i := 0; i < protectFrom; {
+		role := strings.ToLower(oaiReqMessage[i].Role)
+		if role == openai.ChatMessageRoleSystem {
+			i++
+			continue
+		}
+		if total <= maxTokens && role == openai.ChatMessageRoleUser {
+			break
+		}
+		// assistant消息和它后面的tool消息作为一个整体
+		end := i + 1
+		for end < len(oaiReqMessage) && strings.ToLower(oaiReqMessage[end].Role) == openai.ChatMessageRoleTool {
+			end++
+		}
+		if end > protectFrom {
+			break
+		}
+		for ; i < end; i++ {
+			drop[i] = true
+			total -= estimateMessageTokens(oaiReqMessage[i])
+			dropped = append(dropped, oaiReqMessage[i])
+		}
+	}
+
+	if len(dropped) == 0 {
+		return oaiReqMessage, nil
+	}
+	kept := make([]openai.ChatCompletionMessage, 0, len(oaiReqMessage)-len(dropped))
+	for i, msg := range oaiReqMessage {
+		if !drop[i] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, dropped
+}
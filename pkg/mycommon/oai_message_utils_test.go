@@ -0,0 +1,49 @@
+package mycommon
+
+import (
+	"github.com/sashabaranov/go-openai"
+	"testing"
+)
+
+// TestParseChatCompletionRequestToolCalls 标准解析失败时的备用解析保留tools以及工具调用相关的消息字段
+func TestParseChatCompletionRequestToolCalls(t *testing.T) {
+	data := []byte(`{
+"model":"gpt-4o",
+"temperature":0.2,
+"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}],
+"tool_choice":"auto",
+"messages":[
+  {"role":"user","content":{"type":"text","text":"weather in Paris?"}},
+  {"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+  {"role":"tool","tool_call_id":"call_1","name":"get_weather","content":"sunny"},
+  {"role":"assistant","function_call":{"name":"legacy","arguments":"{}"}}
+]}`)
+	req, err := ParseChatCompletionRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Model != "gpt-4o" || req.Temperature != 0.2 || req.ToolChoice != "auto" {
+		t.Errorf("model %q temperature %v tool_choice %v", req.Model, req.Temperature, req.ToolChoice)
+	}
+	if len(req.Tools) != 1 || req.Tools[0].Function == nil || req.Tools[0].Function.Name != "get_weather" {
+		t.Fatalf("tools = %+v", req.Tools)
+	}
+	if len(req.Messages) != 4 {
+		t.Fatalf("got %d messages", len(req.Messages))
+	}
+	if req.Messages[0].Content != "weather in Paris?" {
+		t.Errorf("user content = %q", req.Messages[0].Content)
+	}
+	call := req.Messages[1]
+	if call.Role != openai.ChatMessageRoleAssistant || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" ||
+		call.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("assistant tool call message = %+v", call)
+	}
+	result := req.Messages[2]
+	if result.Role != openai.ChatMessageRoleTool || result.ToolCallID != "call_1" || result.Name != "get_weather" || result.Content != "sunny" {
+		t.Errorf("tool message = %+v", result)
+	}
+	if fc := req.Messages[3].FunctionCall; fc == nil || fc.Name != "legacy" {
+		t.Errorf("function_call = %+v", fc)
+	}
+}
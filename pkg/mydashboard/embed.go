@@ -0,0 +1,19 @@
+package mydashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// FileSystem 控制台的页面，编译时打包进程序，不依赖运行目录下的static文件夹
+func FileSystem() http.FileSystem {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
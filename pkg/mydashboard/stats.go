@@ -0,0 +1,194 @@
+package mydashboard
+
+import (
+	"net/http"
+	"simple-one-api/pkg/mymetrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WindowSeconds 吞吐量曲线和最近错误率统计的时长
+const WindowSeconds = 300
+
+type counts struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	durationMs       int64
+}
+
+func (c *counts) add(r *mymetrics.RequestRecord) {
+	c.Requests++
+	if r.Status >= http.StatusBadRequest {
+		c.Errors++
+	}
+	c.PromptTokens += int64(r.PromptTokens)
+	c.CompletionTokens += int64(r.CompletionTokens)
+	c.Cost += r.Cost
+	c.durationMs += r.Duration.Milliseconds()
+}
+
+// bucket 一秒内的请求数，按服务分别统计用于计算最近的错误率
+type bucket struct {
+	second    int64
+	total     counts
+	providers map[string]*counts
+}
+
+type collector struct {
+	mu        sync.Mutex
+	startTime time.Time
+	buckets   [WindowSeconds]bucket
+	providers map[string]*counts
+	keys      map[string]*counts
+	models    map[string]*counts
+	total     counts
+}
+
+var stats = newCollector()
+
+func newCollector() *collector {
+	return &collector{
+		startTime: time.Now(),
+		providers: make(map[string]*counts),
+		keys:      make(map[string]*counts),
+		models:    make(map[string]*counts),
+	}
+}
+
+func getCounts(m map[string]*counts, name string) *counts {
+	c, exists := m[name]
+	if !exists {
+		c = &counts{}
+		m[name] = c
+	}
+	return c
+}
+
+// Record 请求结束后记录一次请求，只保存在内存中，重启后清空
+func Record(r *mymetrics.RequestRecord) {
+	stats.record(r, time.Now())
+}
+
+func (s *collector) record(r *mymetrics.RequestRecord, now time.Time) {
+	second := now.Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &s.buckets[second%WindowSeconds]
+	if b.second != second {
+		*b = bucket{second: second, providers: make(map[string]*counts)}
+	}
+	b.total.add(r)
+	getCounts(b.providers, r.Provider).add(r)
+
+	s.total.add(r)
+	getCounts(s.providers, r.Provider).add(r)
+	getCounts(s.keys, r.Key).add(r)
+	getCounts(s.models, r.Model).add(r)
+}
+
+// ThroughputPoint 每秒的请求数和错误数
+type ThroughputPoint struct {
+	Time     int64 `json:"time"`
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
+// GroupStats 按服务、key或模型汇总的统计，Recent开头的字段为最近WindowSeconds秒内的数据，只统计总数和服务
+type GroupStats struct {
+	Name string `json:"name"`
+	counts
+	ErrorRate       float64 `json:"error_rate"`
+	AvgLatencyMs    int64   `json:"avg_latency_ms"`
+	RecentRequests  int64   `json:"recent_requests,omitempty"`
+	RecentErrors    int64   `json:"recent_errors,omitempty"`
+	RecentErrorRate float64 `json:"recent_error_rate,omitempty"`
+}
+
+// Snapshot 控制台展示的统计数据
+type Snapshot struct {
+	StartTime     time.Time         `json:"start_time"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	WindowSeconds int               `json:"window_seconds"`
+	Total         GroupStats        `json:"total"`
+	Throughput    []ThroughputPoint `json:"throughput"`
+	Providers     []GroupStats      `json:"providers"`
+	Keys          []GroupStats      `json:"keys"`
+	Models        []GroupStats      `json:"models"`
+	// Currency 配置了pricing时费用的货币单位
+	Currency string `json:"currency,omitempty"`
+}
+
+// GetSnapshot 返回当前的统计数据，各分组按请求数从多到少排序
+func GetSnapshot() *Snapshot {
+	return stats.snapshot(time.Now())
+}
+
+func (s *collector) snapshot(now time.Time) *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &Snapshot{
+		StartTime:     s.startTime,
+		UptimeSeconds: int64(now.Sub(s.startTime).Seconds()),
+		WindowSeconds: WindowSeconds,
+		Throughput:    make([]ThroughputPoint, 0, WindowSeconds),
+	}
+
+	var recentTotal counts
+	recentProviders := make(map[string]*counts)
+	current := now.Unix()
+	for second := current - WindowSeconds + 1; second <= current; second++ {
+		point := ThroughputPoint{Time: second}
+		if b := &s.buckets[second%WindowSeconds]; b.second == second {
+			point.Requests, point.Errors = b.total.Requests, b.total.Errors
+			recentTotal.Requests += b.total.Requests
+			recentTotal.Errors += b.total.Errors
+			for name, c := range b.providers {
+				rc := getCounts(recentProviders, name)
+				rc.Requests += c.Requests
+				rc.Errors += c.Errors
+			}
+		}
+		snap.Throughput = append(snap.Throughput, point)
+	}
+
+	snap.Total = newGroupStats("", &s.total, &recentTotal)
+	snap.Providers = groupStats(s.providers, recentProviders)
+	snap.Keys = groupStats(s.keys, nil)
+	snap.Models = groupStats(s.models, nil)
+	return snap
+}
+
+func newGroupStats(name string, c *counts, recent *counts) GroupStats {
+	g := GroupStats{Name: name, counts: *c}
+	if c.Requests > 0 {
+		g.ErrorRate = float64(c.Errors) / float64(c.Requests)
+		g.AvgLatencyMs = c.durationMs / c.Requests
+	}
+	if recent != nil {
+		g.RecentRequests, g.RecentErrors = recent.Requests, recent.Errors
+		if recent.Requests > 0 {
+			g.RecentErrorRate = float64(recent.Errors) / float64(recent.Requests)
+		}
+	}
+	return g
+}
+
+func groupStats(m map[string]*counts, recent map[string]*counts) []GroupStats {
+	result := make([]GroupStats, 0, len(m))
+	for name, c := range m {
+		result = append(result, newGroupStats(name, c, recent[name]))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,155 @@
+package mygrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sashabaranov/go-openai"
+	"simple-one-api/pkg/mygrpc/chatpb"
+)
+
+// buildRequestBody 把gRPC请求转换为/v1/chat/completions的请求体，extra_json中的参数先写入，再由请求中的字段覆盖
+func buildRequestBody(req *chatpb.ChatCompletionRequest, stream bool) ([]byte, error) {
+	body := make(map[string]interface{})
+	if req.ExtraJson != "" {
+		if err := json.Unmarshal([]byte(req.ExtraJson), &body); err != nil {
+			return nil, errors.New("extra_json must be a json object: " + err.Error())
+		}
+	}
+
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		messages = append(messages, toOpenAIMessage(m))
+	}
+	body["model"] = req.Model
+	body["messages"] = messages
+	body["stream"] = stream
+	if req.Temperature != nil {
+		body["temperature"] = req.GetTemperature()
+	}
+	if req.TopP != nil {
+		body["top_p"] = req.GetTopP()
+	}
+	if req.MaxTokens > 0 {
+		body["max_tokens"] = req.MaxTokens
+	}
+	if len(req.Stop) > 0 {
+		body["stop"] = req.Stop
+	}
+	if req.User != "" {
+		body["user"] = req.User
+	}
+	if req.N > 0 {
+		body["n"] = req.N
+	}
+	if stream && req.IncludeUsage {
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	return json.Marshal(body)
+}
+
+func toOpenAIMessage(m *chatpb.ChatMessage) openai.ChatCompletionMessage {
+	msg := openai.ChatCompletionMessage{
+		Role:       m.Role,
+		Name:       m.Name,
+		ToolCallID: m.ToolCallId,
+	}
+	if len(m.ContentParts) > 0 {
+		for _, p := range m.ContentParts {
+			part := openai.ChatMessagePart{Type: openai.ChatMessagePartType(p.Type), Text: p.Text}
+			if p.ImageUrl != "" {
+				part.ImageURL = &openai.ChatMessageImageURL{URL: p.ImageUrl, Detail: openai.ImageURLDetail(p.Detail)}
+			}
+			msg.MultiContent = append(msg.MultiContent, part)
+		}
+	} else {
+		msg.Content = m.Content
+	}
+	for _, tc := range m.ToolCalls {
+		msg.ToolCalls = append(msg.ToolCalls, toOpenAIToolCall(tc))
+	}
+	return msg
+}
+
+func toOpenAIToolCall(tc *chatpb.ToolCall) openai.ToolCall {
+	call := openai.ToolCall{ID: tc.Id, Type: openai.ToolType(tc.Type)}
+	if call.Type == "" {
+		call.Type = openai.ToolTypeFunction
+	}
+	if tc.Function != nil {
+		call.Function = openai.FunctionCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments}
+	}
+	return call
+}
+
+func toPBToolCalls(calls []openai.ToolCall) []*chatpb.ToolCall {
+	var list []*chatpb.ToolCall
+	for i, tc := range calls {
+		call := &chatpb.ToolCall{
+			Index:    int32(i),
+			Id:       tc.ID,
+			Type:     string(tc.Type),
+			Function: &chatpb.FunctionCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments},
+		}
+		if tc.Index != nil {
+			call.Index = int32(*tc.Index)
+		}
+		list = append(list, call)
+	}
+	return list
+}
+
+func toPBUsage(u *openai.Usage) *chatpb.Usage {
+	if u == nil || (u.PromptTokens == 0 && u.CompletionTokens == 0 && u.TotalTokens == 0) {
+		return nil
+	}
+	return &chatpb.Usage{
+		PromptTokens:     int32(u.PromptTokens),
+		CompletionTokens: int32(u.CompletionTokens),
+		TotalTokens:      int32(u.TotalTokens),
+	}
+}
+
+func toPBResponse(resp *openai.ChatCompletionResponse) *chatpb.ChatCompletionResponse {
+	out := &chatpb.ChatCompletionResponse{
+		Id:                resp.ID,
+		Model:             resp.Model,
+		Created:           resp.Created,
+		Usage:             toPBUsage(&resp.Usage),
+		SystemFingerprint: resp.SystemFingerprint,
+	}
+	for _, c := range resp.Choices {
+		out.Choices = append(out.Choices, &chatpb.Choice{
+			Index: int32(c.Index),
+			Message: &chatpb.ChatMessage{
+				Role:       c.Message.Role,
+				Content:    c.Message.Content,
+				Name:       c.Message.Name,
+				ToolCallId: c.Message.ToolCallID,
+				ToolCalls:  toPBToolCalls(c.Message.ToolCalls),
+			},
+			FinishReason: string(c.FinishReason),
+		})
+	}
+	return out
+}
+
+func toPBChunk(resp *openai.ChatCompletionStreamResponse) *chatpb.ChatCompletionChunk {
+	out := &chatpb.ChatCompletionChunk{
+		Id:      resp.ID,
+		Model:   resp.Model,
+		Created: resp.Created,
+		Usage:   toPBUsage(resp.Usage),
+	}
+	for _, c := range resp.Choices {
+		out.Choices = append(out.Choices, &chatpb.ChunkChoice{
+			Index: int32(c.Index),
+			Delta: &chatpb.ChatMessage{
+				Role:      c.Delta.Role,
+				Content:   c.Delta.Content,
+				ToolCalls: toPBToolCalls(c.Delta.ToolCalls),
+			},
+			FinishReason: string(c.FinishReason),
+		})
+	}
+	return out
+}
@@ -0,0 +1,249 @@
+package mygrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mygrpc/chatpb"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+)
+
+const chatCompletionsPath = "/v1/chat/completions"
+
+// 请求中可能包含base64图片，放宽默认4MB的限制
+const maxRecvMsgSize = 32 << 20
+
+// chatServer 把gRPC请求转换为HTTP请求，交给同一个gin路由处理，鉴权、限流、审核、路由和模型适配与HTTP接口完全一致
+type chatServer struct {
+	chatpb.UnimplementedChatServiceServer
+	handler http.Handler
+}
+
+var (
+	grpcServer   *grpc.Server
+	grpcServerMu sync.Mutex
+)
+
+// Start 在配置的地址上启动gRPC服务，handler为HTTP服务的路由
+func Start(handler http.Handler) error {
+	addr := config.GetConf().GRPC.ListenAddr
+	if addr == "" {
+		addr = config.DefaultGRPCListenAddr
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(maxRecvMsgSize))
+	chatpb.RegisterChatServiceServer(s, &chatServer{handler: handler})
+
+	grpcServerMu.Lock()
+	grpcServer = s
+	grpcServerMu.Unlock()
+
+	mylog.Logger.Info("grpc server started", zap.String("listen_addr", addr))
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			mylog.Logger.Error("grpc server", zap.String("listen_addr", addr), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Shutdown 等待进行中的请求结束后关闭gRPC服务，ctx结束时直接断开剩余的连接
+func Shutdown(ctx context.Context) {
+	grpcServerMu.Lock()
+	s := grpcServer
+	grpcServer = nil
+	grpcServerMu.Unlock()
+	if s == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Stop()
+		<-done
+	}
+}
+
+func (s *chatServer) CreateChatCompletion(ctx context.Context, req *chatpb.ChatCompletionRequest) (*chatpb.ChatCompletionResponse, error) {
+	httpReq, err := newHTTPRequest(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := newResponseWriter(ctx, &buf)
+	s.handler.ServeHTTP(w, httpReq)
+
+	if code := w.getStatus(); code >= http.StatusBadRequest {
+		return nil, toStatusError(code, buf.Bytes())
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid response: %v", err)
+	}
+	return toPBResponse(&resp), nil
+}
+
+func (s *chatServer) StreamChatCompletion(req *chatpb.ChatCompletionRequest, stream chatpb.ChatService_StreamChatCompletionServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	httpReq, err := newHTTPRequest(ctx, req, true)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	w := newResponseWriter(ctx, pw)
+	go func() {
+		defer pw.Close()
+		s.handler.ServeHTTP(w, httpReq)
+	}()
+
+	reader := bufio.NewReaderSize(pr, 64*1024)
+	var body bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			// 出错时返回的是JSON而不是SSE，读取完整的内容后转换为gRPC的错误
+			if code := w.getStatus(); code >= http.StatusBadRequest {
+				body.Write(line)
+				rest, _ := io.ReadAll(reader)
+				body.Write(rest)
+				return toStatusError(code, body.Bytes())
+			}
+			if sendErr := sendEvent(stream, line); sendErr != nil {
+				if sendErr == io.EOF {
+					return nil
+				}
+				return sendErr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+}
+
+// sendEvent 处理一行SSE，收到[DONE]时返回io.EOF，收到错误事件时返回对应的gRPC错误
+func sendEvent(stream chatpb.ChatService_StreamChatCompletionServer, line []byte) error {
+	data := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(data, "data:") {
+		return nil
+	}
+	data = strings.TrimSpace(strings.TrimPrefix(data, "data:"))
+	if data == "[DONE]" {
+		return io.EOF
+	}
+	if strings.HasPrefix(data, `{"error"`) {
+		return toStatusError(http.StatusInternalServerError, []byte(data))
+	}
+
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		mylog.Logger.Warn("grpc skip invalid stream event", zap.String("data", data), zap.Error(err))
+		return nil
+	}
+	return stream.Send(toPBChunk(&chunk))
+}
+
+// 由gRPC自己处理的metadata，不作为请求头转发
+var skipMetadata = map[string]bool{
+	"content-type": true,
+	"accept":       true,
+	"te":           true,
+}
+
+func newHTTPRequest(ctx context.Context, req *chatpb.ChatCompletionRequest, stream bool) (*http.Request, error) {
+	body, err := buildRequestBody(req, stream)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, chatCompletionsPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// metadata按请求头处理，例如authorization、x-conversation-id
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || skipMetadata[key] {
+			continue
+		}
+		for _, v := range values {
+			httpReq.Header.Add(key, v)
+		}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		httpReq.RemoteAddr = p.Addr.String()
+	}
+	return httpReq, nil
+}
+
+// toStatusError 把HTTP的错误响应转换为gRPC的错误，message使用响应中的error.message
+func toStatusError(httpCode int, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+		msg = errResp.Error.Message
+	}
+	if msg == "" {
+		msg = http.StatusText(httpCode)
+	}
+	return status.Error(toGRPCCode(httpCode), msg)
+}
+
+func toGRPCCode(httpCode int) codes.Code {
+	switch httpCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	}
+	return codes.Internal
+}
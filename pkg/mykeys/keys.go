@@ -0,0 +1,216 @@
+package mykeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myredis"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyPrefix 生成的虚拟key的前缀，便于和上游的key区分
+const keyPrefix = "sk-soa-"
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrRevokedAPIKey = errors.New("API key has been revoked")
+)
+
+// VirtualKey 通过管理接口创建的客户端key，只保存key的sha256，原始的key只在创建时返回一次
+type VirtualKey struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	KeyHash       string     `json:"key_hash"`
+	KeyPrefix     string     `json:"key_prefix"`
+	AllowedModels []string   `json:"allowed_models,omitempty"` // 支持通配符，如glm-*，为空时可以使用所有模型
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateRequest 创建虚拟key的参数
+type CreateRequest struct {
+	Name          string     `json:"name"`
+	AllowedModels []string   `json:"allowed_models"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+}
+
+var (
+	keys    = make(map[string]*VirtualKey) // key为KeyHash
+	keysMu  sync.RWMutex
+	store   Store
+	enabled bool
+)
+
+// Enabled 是否开启了key管理
+func Enabled() bool {
+	return enabled
+}
+
+// Init 按配置打开存储并加载已有的虚拟key
+func Init(conf *config.KeyManagementConf) error {
+	if conf == nil || !conf.Enable {
+		return nil
+	}
+
+	s, err := newStore(conf)
+	if err != nil {
+		return err
+	}
+	list, err := s.Load()
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	keysMu.Lock()
+	for _, k := range list {
+		keys[k.KeyHash] = k
+	}
+	keysMu.Unlock()
+
+	store = s
+	enabled = true
+	initShared()
+	return nil
+}
+
+// Close 关闭存储
+func Close() {
+	if store != nil {
+		store.Close()
+	}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return keyPrefix + hex.EncodeToString(b), nil
+}
+
+// Create 创建一个虚拟key并保存，返回key的信息和原始的key
+func Create(req *CreateRequest) (*VirtualKey, string, error) {
+	key, err := generateKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	k := &VirtualKey{
+		ID:            uuid.NewString(),
+		Name:          req.Name,
+		KeyHash:       hashKey(key),
+		KeyPrefix:     key[:len(keyPrefix)+4],
+		AllowedModels: req.AllowedModels,
+		ExpiresAt:     req.ExpiresAt,
+		CreatedAt:     time.Now(),
+	}
+	if err = store.Save(k); err != nil {
+		return nil, "", err
+	}
+	saveShared(k)
+
+	keysMu.Lock()
+	keys[k.KeyHash] = k
+	keysMu.Unlock()
+	return k, key, nil
+}
+
+// Revoke 吊销虚拟key，吊销后的key保留在存储中，不能再使用
+func Revoke(id string) (*VirtualKey, error) {
+	syncShared()
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	for _, k := range keys {
+		if k.ID != id {
+			continue
+		}
+		if k.RevokedAt != nil {
+			return k, nil
+		}
+		revoked := *k
+		now := time.Now()
+		revoked.RevokedAt = &now
+		if err := store.Save(&revoked); err != nil {
+			return nil, err
+		}
+		saveShared(&revoked)
+		keys[k.KeyHash] = &revoked
+		return &revoked, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Get 按ID获取虚拟key
+func Get(id string) (*VirtualKey, bool) {
+	syncShared()
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	for _, k := range keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// List 返回所有虚拟key，按创建时间排序
+func List() []*VirtualKey {
+	syncShared()
+	keysMu.RLock()
+	list := make([]*VirtualKey, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, k)
+	}
+	keysMu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Authenticate 校验虚拟key，返回对应的key配置，不是虚拟key时返回ErrKeyNotFound；配置了shared_state时以Redis中的key为准
+func Authenticate(key string) (*config.APIKeyConfig, error) {
+	keyHash := hashKey(key)
+	keysMu.RLock()
+	k, exists := keys[keyHash]
+	keysMu.RUnlock()
+	if myredis.Shared() != nil {
+		if sk, err := getShared(keyHash); err != nil {
+			myredis.LogError("authenticate virtual key", err)
+		} else if sk != nil {
+			k, exists = sk, true
+			keysMu.Lock()
+			keys[keyHash] = sk
+			keysMu.Unlock()
+		}
+	}
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	if k.RevokedAt != nil {
+		return nil, ErrRevokedAPIKey
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, config.ErrExpiredAPIKey
+	}
+
+	name := k.Name
+	if name == "" {
+		name = k.KeyPrefix + "..."
+	}
+	return &config.APIKeyConfig{Name: name, AllowedModels: k.AllowedModels}, nil
+}
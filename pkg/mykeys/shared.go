@@ -0,0 +1,93 @@
+package mykeys
+
+import (
+	"encoding/json"
+	"simple-one-api/pkg/myredis"
+)
+
+// 配置了shared_state时虚拟key同时保存在Redis的hash中，字段为KeyHash，其他实例创建和吊销的key立即生效；
+// Redis出错时使用本实例加载的key
+
+func sharedKeysName() string {
+	return myredis.Key("keys")
+}
+
+// saveShared 保存到Redis中，失败时只输出日志，本实例的存储已经保存成功
+func saveShared(k *VirtualKey) {
+	if myredis.Shared() == nil {
+		return
+	}
+	data, err := json.Marshal(k)
+	if err == nil {
+		_, err = myredis.Shared().Do("HSET", sharedKeysName(), k.KeyHash, string(data))
+	}
+	if err != nil {
+		myredis.LogError("save virtual key", err)
+	}
+}
+
+// getShared 从Redis中读取一个key，不存在时返回nil
+func getShared(keyHash string) (*VirtualKey, error) {
+	v, err := myredis.Shared().Do("HGET", sharedKeysName(), keyHash)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, nil
+	}
+	var k VirtualKey
+	if err = json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// initShared 启动时把本实例已有的key写入Redis（已经存在的不覆盖），再合并其他实例的key
+func initShared() {
+	if myredis.Shared() == nil {
+		return
+	}
+	keysMu.RLock()
+	list := make([]*VirtualKey, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, k)
+	}
+	keysMu.RUnlock()
+
+	for _, k := range list {
+		data, err := json.Marshal(k)
+		if err == nil {
+			_, err = myredis.Shared().Do("HSETNX", sharedKeysName(), k.KeyHash, string(data))
+		}
+		if err != nil {
+			myredis.LogError("init virtual keys", err)
+			return
+		}
+	}
+	syncShared()
+}
+
+// syncShared 把Redis中的key合并到本实例，吊销状态以Redis为准
+func syncShared() {
+	if myredis.Shared() == nil {
+		return
+	}
+	v, err := myredis.Shared().Do("HGETALL", sharedKeysName())
+	if err != nil {
+		myredis.LogError("sync virtual keys", err)
+		return
+	}
+	items, _ := v.([]interface{})
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	for i := 1; i < len(items); i += 2 {
+		data, _ := items[i].([]byte)
+		var k VirtualKey
+		if json.Unmarshal(data, &k) != nil {
+			continue
+		}
+		keys[k.KeyHash] = &k
+	}
+}
@@ -0,0 +1,122 @@
+package mykeys
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"simple-one-api/pkg/config"
+	"strings"
+	"time"
+)
+
+// defaultSQLDrivers 各类型默认使用的database/sql驱动名，程序中需要引入对应的驱动，
+// 如 _ "github.com/mattn/go-sqlite3" 或 _ "github.com/go-sql-driver/mysql"
+var defaultSQLDrivers = map[string]string{
+	"sqlite": "sqlite3",
+	"mysql":  "mysql",
+}
+
+const keysTable = "virtual_keys"
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+func newSQLStore(conf *config.KeyManagementConf) (Store, error) {
+	driver := conf.Driver
+	if driver == "" {
+		driver = defaultSQLDrivers[strings.ToLower(conf.Store)]
+	}
+
+	db, err := sql.Open(driver, conf.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open key database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect key database: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + keysTable + ` (
+	id VARCHAR(64) PRIMARY KEY,
+	name VARCHAR(128),
+	key_hash VARCHAR(64) NOT NULL UNIQUE,
+	key_prefix VARCHAR(32),
+	allowed_models TEXT,
+	expires_at BIGINT,
+	created_at BIGINT NOT NULL,
+	revoked_at BIGINT
+)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create key table: %w", err)
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func toUnix(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+func fromUnix(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0)
+	return &t
+}
+
+func (s *sqlStore) Load() ([]*VirtualKey, error) {
+	rows, err := s.db.Query(`SELECT id, name, key_hash, key_prefix, allowed_models, expires_at, created_at, revoked_at FROM ` + keysTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*VirtualKey
+	for rows.Next() {
+		var k VirtualKey
+		var models sql.NullString
+		var expiresAt, revokedAt sql.NullInt64
+		var createdAt int64
+		if err = rows.Scan(&k.ID, &k.Name, &k.KeyHash, &k.KeyPrefix, &models, &expiresAt, &createdAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if models.String != "" {
+			if err = json.Unmarshal([]byte(models.String), &k.AllowedModels); err != nil {
+				return nil, fmt.Errorf("invalid allowed_models of key %s: %w", k.ID, err)
+			}
+		}
+		k.ExpiresAt = fromUnix(expiresAt)
+		k.RevokedAt = fromUnix(revokedAt)
+		k.CreatedAt = time.Unix(createdAt, 0)
+		list = append(list, &k)
+	}
+	return list, rows.Err()
+}
+
+// Save 已有的key只会更新吊销时间，先更新不存在时再插入，sqlite和mysql都可以使用
+func (s *sqlStore) Save(k *VirtualKey) error {
+	result, err := s.db.Exec(`UPDATE `+keysTable+` SET revoked_at = ? WHERE id = ?`, toUnix(k.RevokedAt), k.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	models, err := json.Marshal(k.AllowedModels)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO `+keysTable+` (id, name, key_hash, key_prefix, allowed_models, expires_at, created_at, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.KeyHash, k.KeyPrefix, string(models), toUnix(k.ExpiresAt), k.CreatedAt.Unix(), toUnix(k.RevokedAt))
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,110 @@
+package mykeys
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"simple-one-api/pkg/config"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store 虚拟key的持久化存储，Save按ID新增或更新
+type Store interface {
+	Load() ([]*VirtualKey, error)
+	Save(k *VirtualKey) error
+	Close() error
+}
+
+func newStore(conf *config.KeyManagementConf) (Store, error) {
+	switch strings.ToLower(conf.Store) {
+	case "", "file":
+		path := conf.Path
+		if path == "" {
+			path = config.DefaultKeyManagementPath
+		}
+		return newFileStore(path), nil
+	case "sqlite", "mysql":
+		return newSQLStore(conf)
+	}
+	return nil, errors.New("unsupported key management store: " + conf.Store)
+}
+
+// fileStore 将所有虚拟key保存为一个json文件，每次修改后先写入临时文件再替换，避免写入中断时文件损坏
+type fileStore struct {
+	path string
+	mu   sync.Mutex
+	keys map[string]*VirtualKey
+}
+
+func newFileStore(path string) *fileStore {
+	return &fileStore{path: path, keys: make(map[string]*VirtualKey)}
+}
+
+func (s *fileStore) Load() ([]*VirtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*VirtualKey
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, k := range list {
+		s.keys[k.ID] = k
+	}
+	return list, nil
+}
+
+func (s *fileStore) Save(k *VirtualKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.keys[k.ID]
+	s.keys[k.ID] = k
+	if err := s.write(); err != nil {
+		if prev != nil {
+			s.keys[k.ID] = prev
+		} else {
+			delete(s.keys, k.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) write() error {
+	list := make([]*VirtualKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package mylimiter
+
+import (
+	"simple-one-api/pkg/myredis"
+	"sync"
+	"time"
+)
+
+const (
+	KeyLimitRPM   = "rpm"
+	KeyLimitTPM   = "tpm"
+	KeyLimitQuota = "quota"
+)
+
+// tokenRecord 一个请求完成时使用的token数
+type tokenRecord struct {
+	time   time.Time
+	tokens int
+}
+
+// keyUsage 一个客户端key最近一分钟的请求和token，以及当月的token用量。
+// 限制值在检查时传入，配置热加载后立即生效，已有的用量不受影响
+type keyUsage struct {
+	mu          sync.Mutex
+	requests    []time.Time
+	tokens      []tokenRecord
+	minuteTotal int
+	month       string
+	monthTotal  int64
+}
+
+// KeyUsage key当前的用量
+type KeyUsage struct {
+	MinuteRequests int
+	MinuteTokens   int
+	MonthTokens    int64
+}
+
+var (
+	keyUsages   = make(map[string]*keyUsage)
+	keyUsagesMu sync.Mutex
+)
+
+func getKeyUsage(key string) *keyUsage {
+	keyUsagesMu.Lock()
+	defer keyUsagesMu.Unlock()
+	u, exists := keyUsages[key]
+	if !exists {
+		u = &keyUsage{}
+		keyUsages[key] = u
+	}
+	return u
+}
+
+// expire 移除一分钟之前的记录，并在跨月时重置当月用量，需要持有锁
+func (u *keyUsage) expire(now time.Time) {
+	windowStart := now.Add(-time.Minute)
+	i := 0
+	for ; i < len(u.requests) && u.requests[i].Before(windowStart); i++ {
+	}
+	u.requests = u.requests[i:]
+
+	i = 0
+	for ; i < len(u.tokens) && u.tokens[i].time.Before(windowStart); i++ {
+		u.minuteTotal -= u.tokens[i].tokens
+	}
+	u.tokens = u.tokens[i:]
+
+	if month := now.Format("2006-01"); month != u.month {
+		u.month = month
+		u.monthTotal = 0
+	}
+}
+
+// retryAfterTokens 返回最近一分钟的token数降到limit以下还需要的时间，需要持有锁
+func (u *keyUsage) retryAfterTokens(now time.Time, limit int) time.Duration {
+	total := u.minuteTotal
+	for _, r := range u.tokens {
+		total -= r.tokens
+		if total < limit {
+			return r.time.Add(time.Minute).Sub(now)
+		}
+	}
+	return 0
+}
+
+// AllowKey 检查key是否超过每分钟请求数、每分钟token数和每月token配额，没有超过时计入一次请求；
+// 超过时返回超过的限制和需要等待的时间。token在请求完成后才能确定，只检查已经使用的token数，limit<=0表示不限制。
+// 配置了shared_state时用量保存在Redis中，所有实例共用，Redis出错时使用本实例的用量
+func AllowKey(key string, rpm, tpm int, monthlyQuota int64) (exceeded string, retryAfter time.Duration, usage KeyUsage) {
+	if myredis.Shared() != nil {
+		var err error
+		if exceeded, retryAfter, usage, err = allowSharedKey(key, rpm, tpm, monthlyQuota); err == nil {
+			return exceeded, retryAfter, usage
+		}
+		myredis.LogError("key limit allow", err)
+	}
+
+	u := getKeyUsage(key)
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(now)
+	usage = KeyUsage{MinuteRequests: len(u.requests), MinuteTokens: u.minuteTotal, MonthTokens: u.monthTotal}
+
+	if monthlyQuota > 0 && u.monthTotal >= monthlyQuota {
+		nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+		return KeyLimitQuota, nextMonth.Sub(now), usage
+	}
+	if rpm > 0 && len(u.requests) >= rpm {
+		return KeyLimitRPM, u.requests[len(u.requests)-rpm].Add(time.Minute).Sub(now), usage
+	}
+	if tpm > 0 && u.minuteTotal >= tpm {
+		return KeyLimitTPM, u.retryAfterTokens(now, tpm), usage
+	}
+
+	u.requests = append(u.requests, now)
+	usage.MinuteRequests++
+	return "", 0, usage
+}
+
+// AddKeyTokens 请求完成后记录key使用的token数，与AllowKey一致配置了shared_state时记录到Redis中
+func AddKeyTokens(key string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	if myredis.Shared() != nil {
+		err := addSharedKeyTokens(key, tokens)
+		if err == nil {
+			return
+		}
+		myredis.LogError("key limit add tokens", err)
+	}
+	u := getKeyUsage(key)
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(now)
+	u.tokens = append(u.tokens, tokenRecord{time: now, tokens: tokens})
+	u.minuteTotal += tokens
+	u.monthTotal += int64(tokens)
+}
@@ -2,11 +2,14 @@ package mylimiter
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
 	"simple-one-api/pkg/mycomdef"
+	"simple-one-api/pkg/myredis"
 	"sync"
 )
 
@@ -14,8 +17,20 @@ type Limiter struct {
 	QPSLimiter         *rate.Limiter
 	QPMLimiter         *SlidingWindowLimiter
 	ConcurrencyLimiter *semaphore.Weighted
+
+	qps         float64
+	concurrency int64
+	inflight    atomic.Int64
+	waiting     atomic.Int64
+
+	// sharedQPS、sharedQPM 配置了shared_state时多个实例共用的窗口，Redis出错时改用本地的限流器；并发数总是按实例限制
+	sharedQPS *sharedWindow
+	sharedQPM *sharedWindow
 }
 
+// ErrQueueFull 排队等待并发许可的请求数已经达到上限
+var ErrQueueFull = errors.New("limiter queue is full")
+
 type SlidingWindowLimiter struct {
 	mu          sync.Mutex
 	maxRequests int
@@ -57,6 +72,31 @@ func (l *SlidingWindowLimiter) Allow() bool {
 	return false
 }
 
+// Usage 返回当前窗口内的请求数
+func (l *SlidingWindowLimiter) Usage() int {
+	windowStart := time.Now().Add(-l.interval)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, t := range l.requests {
+		if !t.Before(windowStart) {
+			n++
+		}
+	}
+	return n
+}
+
+// RetryAfter 返回距离窗口内最早的请求过期还需要的时间
+func (l *SlidingWindowLimiter) RetryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.requests) < l.maxRequests || len(l.requests) == 0 {
+		return 0
+	}
+	return time.Until(l.requests[0].Add(l.interval))
+}
+
 func (l *SlidingWindowLimiter) Wait(ctx context.Context) error {
 	waitTime := 10 * time.Millisecond // 初始等待时间
 
@@ -92,48 +132,191 @@ func (l *SlidingWindowLimiter) Wait(ctx context.Context) error {
 
 // NewLimiter 创建一个新的限流器，根据指定的类型和限制值进行配置
 func NewLimiter(limitType string, limitn float64) *Limiter {
-	lim := &Limiter{}
 	switch limitType {
 	case mycomdef.KEYNAME_QPS:
-		lim.QPSLimiter = rate.NewLimiter(rate.Limit(limitn), int(limitn))
+		return NewCombinedLimiter(limitn, 0, 0)
 	case mycomdef.KEYNAME_QPM, mycomdef.KEYNAME_RPM:
-		lim.QPMLimiter = NewSlidingWindowLimiter(int(limitn))
+		return NewCombinedLimiter(0, limitn, 0)
 	case mycomdef.KEYNAME_CONCURRENCY:
-		lim.ConcurrencyLimiter = semaphore.NewWeighted(int64(limitn))
+		return NewCombinedLimiter(0, 0, limitn)
 	default:
 		// 对无效类型无操作，或者可以抛出错误
 	}
+	return &Limiter{}
+}
+
+// NewCombinedLimiter 同时按QPS、每分钟请求数和并发数限流，值小于等于0的限制不生效
+func NewCombinedLimiter(qps float64, qpm float64, concurrency float64) *Limiter {
+	lim := &Limiter{qps: qps, concurrency: int64(concurrency)}
+	if qps > 0 {
+		burst := int(qps)
+		if burst < 1 {
+			burst = 1
+		}
+		lim.QPSLimiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+	if qpm > 0 {
+		lim.QPMLimiter = NewSlidingWindowLimiter(int(qpm))
+	}
+	if lim.concurrency > 0 {
+		lim.ConcurrencyLimiter = semaphore.NewWeighted(lim.concurrency)
+	}
 	return lim
 }
 
-// Wait 使用QPS限流器等待直到获得令牌
+// Wait 使用QPS限流器和每分钟请求数限流器等待直到获得令牌
 func (l *Limiter) Wait(ctx context.Context) error {
 	if l.QPSLimiter != nil {
-		return l.QPSLimiter.Wait(ctx)
+		if shared, err := waitShared(ctx, l.sharedQPS); err != nil {
+			return err
+		} else if !shared {
+			if err = l.QPSLimiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
 	}
 	if l.QPMLimiter != nil {
+		if shared, err := waitShared(ctx, l.sharedQPM); shared || err != nil {
+			return err
+		}
 		return l.QPMLimiter.Wait(ctx)
 	}
 	return nil
 }
 
-// Acquire 尝试获取并发限制的许可，如果设置了超时则可以被中断
-func (l *Limiter) Acquire(ctx context.Context) error {
-	if l.ConcurrencyLimiter != nil {
-		return l.ConcurrencyLimiter.Acquire(ctx, 1)
+// waitShared 使用共享的窗口等待，没有共享的窗口或者Redis出错时返回false，由调用方改用本地的限流器
+func waitShared(ctx context.Context, w *sharedWindow) (bool, error) {
+	if w == nil {
+		return false, nil
+	}
+	err := w.wait(ctx)
+	if err != nil && ctx.Err() == nil {
+		myredis.LogError("rate limit wait", err)
+		return false, nil
+	}
+	return true, err
+}
+
+// allowShared 使用共享的窗口检查，没有共享的窗口或者Redis出错时使用本地的限流器
+func allowShared(w *sharedWindow, local func() bool) bool {
+	if w == nil {
+		return local()
+	}
+	allowed, _, err := w.allow()
+	if err != nil {
+		myredis.LogError("rate limit allow", err)
+		return local()
+	}
+	return allowed
+}
+
+// Acquire 尝试获取并发限制的许可，如果设置了超时则可以被中断；maxQueue大于0时，
+// 已经有maxQueue个请求在排队则不再等待，返回ErrQueueFull
+func (l *Limiter) Acquire(ctx context.Context, maxQueue int) error {
+	if l.ConcurrencyLimiter != nil && !l.ConcurrencyLimiter.TryAcquire(1) {
+		if n := l.waiting.Add(1); maxQueue > 0 && n > int64(maxQueue) {
+			l.waiting.Add(-1)
+			return ErrQueueFull
+		}
+		err := l.ConcurrencyLimiter.Acquire(ctx, 1)
+		l.waiting.Add(-1)
+		if err != nil {
+			return err
+		}
 	}
+	l.inflight.Add(1)
 	return nil
 }
 
+// TryAcquire 不等待，并发数和请求频率都没有超过限制时返回true，需要调用Release释放
+func (l *Limiter) TryAcquire() bool {
+	if l.ConcurrencyLimiter != nil && !l.ConcurrencyLimiter.TryAcquire(1) {
+		return false
+	}
+	if (l.QPSLimiter != nil && !allowShared(l.sharedQPS, l.QPSLimiter.Allow)) || (l.QPMLimiter != nil && !allowShared(l.sharedQPM, l.QPMLimiter.Allow)) {
+		if l.ConcurrencyLimiter != nil {
+			l.ConcurrencyLimiter.Release(1)
+		}
+		return false
+	}
+	l.inflight.Add(1)
+	return true
+}
+
 // Release 释放并发限制的一个许可
 func (l *Limiter) Release() {
+	l.inflight.Add(-1)
 	if l.ConcurrencyLimiter != nil {
 		l.ConcurrencyLimiter.Release(1)
 	}
 }
 
-// GetLimiter 根据键获取或创建对应的限流器，支持线程安全操作
-func GetLimiter(key string, limitType string, limitn float64) *Limiter {
+// Usage 返回一分钟内的请求数、进行中的请求数和排队等待并发许可的请求数，用于日志
+func (l *Limiter) Usage() (windowRequests int, inflight int64, waiting int64) {
+	if l.QPMLimiter != nil {
+		windowRequests = l.QPMLimiter.Usage()
+		if l.sharedQPM != nil {
+			if n, _, err := l.sharedQPM.usage(); err == nil {
+				windowRequests = n
+			}
+		}
+	}
+	return windowRequests, l.inflight.Load(), l.waiting.Load()
+}
+
+// RetryAfter 估计多久之后可以重新请求
+func (l *Limiter) RetryAfter() time.Duration {
+	var d time.Duration
+	if l.QPMLimiter != nil {
+		d = l.QPMLimiter.RetryAfter()
+		if l.sharedQPM != nil {
+			if _, retryAfter, err := l.sharedQPM.usage(); err == nil {
+				d = retryAfter
+			}
+		}
+	}
+	if l.QPSLimiter != nil && l.qps > 0 {
+		if qpsWait := time.Duration(float64(time.Second) / l.qps); qpsWait > d {
+			d = qpsWait
+		}
+	}
+	if d <= 0 {
+		d = time.Second
+	}
+	return d
+}
+
+// GetLimiter 根据键获取或创建对应的限流器，支持线程安全操作；sharedKey不为空并且配置了shared_state时，
+// QPS和每分钟请求数由使用相同sharedKey的实例共享
+func GetLimiter(key string, sharedKey string, limitType string, limitn float64) *Limiter {
+	return getOrCreateLimiter(key, func() *Limiter {
+		// 只有一种限制，按类型只会创建QPS或者每分钟请求数中的一个
+		return shareLimiter(NewLimiter(limitType, limitn), sharedKey, limitn, limitn)
+	})
+}
+
+// GetCombinedLimiter 根据键获取或创建同时限制QPS、每分钟请求数和并发数的限流器，sharedKey与GetLimiter一致
+func GetCombinedLimiter(key string, sharedKey string, qps float64, qpm float64, concurrency float64) *Limiter {
+	return getOrCreateLimiter(key, func() *Limiter {
+		return shareLimiter(NewCombinedLimiter(qps, qpm, concurrency), sharedKey, qps, qpm)
+	})
+}
+
+// shareLimiter 配置了shared_state时为限流器创建共享的QPS和每分钟请求数窗口
+func shareLimiter(lim *Limiter, sharedKey string, qps float64, qpm float64) *Limiter {
+	if sharedKey == "" || myredis.Shared() == nil {
+		return lim
+	}
+	if lim.QPSLimiter != nil {
+		lim.sharedQPS = newSharedQPSWindow(myredis.Key("limit", sharedKey, "qps"), qps)
+	}
+	if lim.QPMLimiter != nil {
+		lim.sharedQPM = &sharedWindow{key: myredis.Key("limit", sharedKey, "qpm"), window: time.Minute, limit: max(int(qpm), 1)}
+	}
+	return lim
+}
+
+func getOrCreateLimiter(key string, create func() *Limiter) *Limiter {
 	mapMutex.RLock()
 	if lim, exists := limiterMap[key]; exists {
 		mapMutex.RUnlock()
@@ -148,7 +331,7 @@ func GetLimiter(key string, limitType string, limitn float64) *Limiter {
 		return lim
 	}
 
-	lim := NewLimiter(limitType, limitn)
+	lim := create()
 	limiterMap[key] = lim
 	return lim
 }
@@ -0,0 +1,99 @@
+package mylimiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"simple-one-api/pkg/myredis"
+	"strconv"
+	"time"
+)
+
+// keyMonthTTL 当月用量的过期时间，跨月后不再使用
+const keyMonthTTL = 40 * 24 * time.Hour
+
+// allowKeyScript 与AllowKey一致，KEYS为最近一分钟的请求、最近一分钟的token（成员为id:tokens）和当月的token数，
+// 返回超过的限制（0表示没有超过，1为rpm，2为tpm，3为配额）、需要等待的毫秒数、请求数、token数和当月的token数
+const allowKeyScript = `
+local now = tonumber(ARGV[1])
+local rpm = tonumber(ARGV[2])
+local tpm = tonumber(ARGV[3])
+local quota = tonumber(ARGV[4])
+local start = now - 60000
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', start)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', start)
+local reqs = redis.call('ZCARD', KEYS[1])
+local entries = redis.call('ZRANGE', KEYS[2], 0, -1, 'WITHSCORES')
+local tokens = 0
+for i = 1, #entries, 2 do
+  tokens = tokens + tonumber(string.match(entries[i], ':(%d+)$'))
+end
+local month = tonumber(redis.call('GET', KEYS[3]) or '0')
+if quota > 0 and month >= quota then
+  return {3, tonumber(ARGV[6]) - now, reqs, tokens, month}
+end
+if rpm > 0 and reqs >= rpm then
+  local r = redis.call('ZRANGE', KEYS[1], reqs - rpm, reqs - rpm, 'WITHSCORES')
+  return {1, tonumber(r[2]) + 60000 - now, reqs, tokens, month}
+end
+if tpm > 0 and tokens >= tpm then
+  local total = tokens
+  for i = 1, #entries, 2 do
+    total = total - tonumber(string.match(entries[i], ':(%d+)$'))
+    if total < tpm then
+      return {2, tonumber(entries[i + 1]) + 60000 - now, reqs, tokens, month}
+    end
+  end
+  return {2, 0, reqs, tokens, month}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[5])
+redis.call('PEXPIRE', KEYS[1], 60000)
+return {0, 0, reqs + 1, tokens, month}
+`
+
+// addKeyTokensScript 记录一次请求的token数
+const addKeyTokensScript = `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2] .. ':' .. ARGV[3])
+redis.call('PEXPIRE', KEYS[1], 60000)
+redis.call('INCRBY', KEYS[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return 1
+`
+
+var sharedKeyLimits = []string{"", KeyLimitRPM, KeyLimitTPM, KeyLimitQuota}
+
+// sharedKeyNames Redis中使用key的sha256，不保存原始的key
+func sharedKeyNames(key string, now time.Time) []string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:16])
+	return []string{
+		myredis.Key("keylimit", h, "rpm"),
+		myredis.Key("keylimit", h, "tpm"),
+		myredis.Key("keylimit", h, "month", now.Format("2006-01")),
+	}
+}
+
+func allowSharedKey(key string, rpm, tpm int, monthlyQuota int64) (exceeded string, retryAfter time.Duration, usage KeyUsage, err error) {
+	now := time.Now()
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	v, err := myredis.Shared().Eval(allowKeyScript, sharedKeyNames(key, now),
+		strconv.FormatInt(now.UnixMilli(), 10), strconv.Itoa(rpm), strconv.Itoa(tpm), strconv.FormatInt(monthlyQuota, 10),
+		uuid.NewString(), strconv.FormatInt(nextMonth.UnixMilli(), 10))
+	if err != nil {
+		return "", 0, usage, err
+	}
+	r := myredis.Int64s(v)
+	if len(r) != 5 || r[0] < 0 || int(r[0]) >= len(sharedKeyLimits) {
+		return "", 0, usage, myredis.Error("unexpected key limit reply")
+	}
+	usage = KeyUsage{MinuteRequests: int(r[2]), MinuteTokens: int(r[3]), MonthTokens: r[4]}
+	return sharedKeyLimits[r[0]], time.Duration(r[1]) * time.Millisecond, usage, nil
+}
+
+func addSharedKeyTokens(key string, tokens int) error {
+	now := time.Now()
+	names := sharedKeyNames(key, now)
+	_, err := myredis.Shared().Eval(addKeyTokensScript, names[1:],
+		strconv.FormatInt(now.UnixMilli(), 10), uuid.NewString(), strconv.Itoa(tokens), strconv.FormatInt(keyMonthTTL.Milliseconds(), 10))
+	return err
+}
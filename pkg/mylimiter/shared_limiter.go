@@ -0,0 +1,88 @@
+package mylimiter
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"simple-one-api/pkg/myredis"
+	"strconv"
+	"time"
+)
+
+// slidingWindowScript 移除窗口外的请求，ARGV[4]不为空并且没有超过limit时计入本次请求；
+// 返回是否允许、窗口内的请求数和距离可以再次请求的毫秒数
+const slidingWindowScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+if n < limit then
+  if ARGV[4] ~= '' then
+    redis.call('ZADD', KEYS[1], now, ARGV[4])
+    redis.call('PEXPIRE', KEYS[1], window)
+    n = n + 1
+  end
+  return {1, n, 0}
+end
+local oldest = redis.call('ZRANGE', KEYS[1], n - limit, n - limit, 'WITHSCORES')
+return {0, n, tonumber(oldest[2]) + window - now}
+`
+
+// sharedWindow 保存在Redis中的滑动窗口，多个实例共用
+type sharedWindow struct {
+	key    string
+	window time.Duration
+	limit  int
+}
+
+// newSharedQPSWindow 按QPS换算为窗口，QPS小于1时窗口大于1秒，允许的突发请求数与本地的令牌桶一致
+func newSharedQPSWindow(key string, qps float64) *sharedWindow {
+	burst := int(qps)
+	if burst < 1 {
+		burst = 1
+	}
+	return &sharedWindow{key: key, window: time.Duration(float64(burst) / qps * float64(time.Second)), limit: burst}
+}
+
+func (w *sharedWindow) eval(member string) (allowed bool, count int, retryAfter time.Duration, err error) {
+	v, err := myredis.Shared().Eval(slidingWindowScript, []string{w.key},
+		strconv.FormatInt(time.Now().UnixMilli(), 10), strconv.FormatInt(w.window.Milliseconds(), 10), strconv.Itoa(w.limit), member)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	r := myredis.Int64s(v)
+	if len(r) != 3 {
+		return false, 0, 0, myredis.Error("unexpected sliding window reply")
+	}
+	return r[0] == 1, int(r[1]), time.Duration(r[2]) * time.Millisecond, nil
+}
+
+// allow 没有超过限制时计入一次请求
+func (w *sharedWindow) allow() (bool, time.Duration, error) {
+	allowed, _, retryAfter, err := w.eval(uuid.NewString())
+	return allowed, retryAfter, err
+}
+
+// usage 返回窗口内的请求数和距离可以再次请求的时间，不计入请求
+func (w *sharedWindow) usage() (int, time.Duration, error) {
+	_, count, retryAfter, err := w.eval("")
+	return count, retryAfter, err
+}
+
+// wait 等待直到窗口内的请求数低于限制
+func (w *sharedWindow) wait(ctx context.Context) error {
+	for {
+		allowed, retryAfter, err := w.allow()
+		if err != nil || allowed {
+			return err
+		}
+		if retryAfter <= 0 || retryAfter > time.Second {
+			retryAfter = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
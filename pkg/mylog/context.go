@@ -0,0 +1,47 @@
+package mylog
+
+import (
+	"context"
+	"go.uber.org/zap"
+)
+
+type requestLogKey struct{}
+
+type requestLog struct {
+	requestID string
+	logger    *zap.Logger
+}
+
+// NewContext 返回带有请求ID的context，通过FromContext获取的日志都会带上request_id字段
+func NewContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{
+		requestID: requestID,
+		logger:    Logger.With(zap.String("request_id", requestID)),
+	})
+}
+
+// FromContext 获取请求对应的日志，context中没有请求ID时返回全局的Logger
+func FromContext(ctx context.Context) *zap.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return Logger
+}
+
+// RequestIDFromContext 获取context中的请求ID，没有时返回空字符串
+func RequestIDFromContext(ctx context.Context) string {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.requestID
+	}
+	return ""
+}
+
+// WithFields 返回请求日志加上fields的context，context中没有请求日志时基于全局的Logger
+func WithFields(ctx context.Context, fields ...zap.Field) context.Context {
+	rl := &requestLog{logger: Logger}
+	if cur, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.requestID, rl.logger = cur.requestID, cur.logger
+	}
+	rl.logger = rl.logger.With(fields...)
+	return context.WithValue(ctx, requestLogKey{}, rl)
+}
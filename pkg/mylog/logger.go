@@ -55,5 +55,5 @@ func InitLog(mode string) {
 	)
 
 	// 构建日志器
-	Logger = zap.New(core, zap.AddCaller())
+	Logger = zap.New(&sanitizeCore{Core: core}, zap.AddCaller())
 }
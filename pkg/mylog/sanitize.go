@@ -0,0 +1,232 @@
+package mylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// 日志中消息内容的记录方式
+const (
+	PrivacyFull      = "full"
+	PrivacyTruncated = "truncated"
+	PrivacyMetadata  = "metadata"
+)
+
+type privacyConf struct {
+	level    string
+	maxChars int
+}
+
+var privacy atomic.Pointer[privacyConf]
+
+// 值需要掩码的字段名，日志字段和JSON中的字段都按小写匹配
+var sensitiveKeys = map[string]bool{
+	"apikey": true, "api_key": true, "api_keys": true, "secret_key": true, "secret_id": true,
+	"access_key": true, "secret_access_key": true, "api_secret": true, "token": true,
+	"access_token": true, "authorization": true, "password": true, "x-api-key": true, "api-key": true,
+}
+
+// 值为消息内容的字段名
+var contentKeys = map[string]bool{
+	"content": true, "text": true, "arguments": true, "reasoning_content": true,
+	"prompt": true, "input": true, "query": true,
+}
+
+// SetPrivacy 设置日志中消息内容的记录方式：full完整记录，truncated每段内容只保留前maxChars个字符，metadata不记录内容
+func SetPrivacy(level string, maxChars int) {
+	privacy.Store(&privacyConf{level: strings.ToLower(level), maxChars: maxChars})
+}
+
+func getPrivacy() *privacyConf {
+	if conf := privacy.Load(); conf != nil {
+		return conf
+	}
+	return &privacyConf{level: PrivacyFull}
+}
+
+// MaskSecret 只保留首尾各4个字符，Bearer前缀保持不变
+func MaskSecret(v string) string {
+	prefix := ""
+	if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+		prefix, v = v[:7], v[7:]
+	}
+	if v == "" {
+		return prefix
+	}
+	if len(v) <= 8 {
+		return prefix + "****"
+	}
+	return prefix + v[:4] + "****" + v[len(v)-4:]
+}
+
+func sanitizeContent(s string, conf *privacyConf) string {
+	n := utf8.RuneCountInString(s)
+	switch conf.level {
+	case PrivacyMetadata:
+		return fmt.Sprintf("[%d chars]", n)
+	case PrivacyTruncated:
+		if n <= conf.maxChars {
+			return s
+		}
+		runes := []rune(s)
+		return fmt.Sprintf("%s...[%d chars]", string(runes[:conf.maxChars]), n)
+	}
+	return s
+}
+
+func sanitizeJSONValue(v interface{}, conf *privacyConf) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			key := strings.ToLower(k)
+			if s, ok := val.(string); ok {
+				if sensitiveKeys[key] {
+					t[k] = MaskSecret(s)
+				} else if contentKeys[key] {
+					t[k] = sanitizeContent(s, conf)
+				}
+				continue
+			}
+			t[k] = sanitizeJSONValue(val, conf)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = sanitizeJSONValue(t[i], conf)
+		}
+	}
+	return v
+}
+
+func looksLikeJSON(s string) bool {
+	s = strings.TrimSpace(s)
+	return len(s) > 1 && (s[0] == '{' || s[0] == '[')
+}
+
+// sanitizeJSON 处理JSON中的内容和密钥，不是合法的JSON时返回false
+func sanitizeJSON(data []byte, conf *privacyConf) ([]byte, bool) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	out, err := json.Marshal(sanitizeJSONValue(v, conf))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// 请求头名称中包含这些词时也认为是密钥，如X-Tenant-Token、Proxy-Authorization
+var sensitiveHeaderWords = []string{"key", "token", "secret", "auth", "password", "signature", "cookie"}
+
+// isSensitiveHeader 请求头的名称像密钥，或者值以Bearer、sk-开头时需要掩码
+func isSensitiveHeader(name, value string) bool {
+	name = strings.ToLower(name)
+	if sensitiveKeys[name] {
+		return true
+	}
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	value = strings.ToLower(value)
+	return strings.HasPrefix(value, "bearer ") || strings.HasPrefix(value, "sk-")
+}
+
+func maskHeader(h http.Header) http.Header {
+	masked := h.Clone()
+	for k, values := range masked {
+		for i := range values {
+			if isSensitiveHeader(k, values[i]) {
+				values[i] = MaskSecret(values[i])
+			}
+		}
+	}
+	return masked
+}
+
+func sanitizeField(f zapcore.Field, conf *privacyConf) zapcore.Field {
+	key := strings.ToLower(f.Key)
+	switch f.Type {
+	case zapcore.StringType:
+		if sensitiveKeys[key] {
+			f.String = MaskSecret(f.String)
+			return f
+		}
+		if conf.level == PrivacyFull {
+			return f
+		}
+		if contentKeys[key] {
+			f.String = sanitizeContent(f.String, conf)
+		} else if looksLikeJSON(f.String) {
+			if out, ok := sanitizeJSON([]byte(f.String), conf); ok {
+				f.String = string(out)
+			}
+		}
+	case zapcore.ByteStringType:
+		if conf.level == PrivacyFull {
+			return f
+		}
+		if data, ok := f.Interface.([]byte); ok && looksLikeJSON(string(data)) {
+			if out, ok := sanitizeJSON(data, conf); ok {
+				return zap.ByteString(f.Key, out)
+			}
+		}
+	case zapcore.ReflectType:
+		if h, ok := f.Interface.(http.Header); ok {
+			return zap.Any(f.Key, maskHeader(h))
+		}
+		if conf.level == PrivacyFull || f.Interface == nil {
+			return f
+		}
+		data, err := json.Marshal(f.Interface)
+		if err != nil {
+			return f
+		}
+		if out, ok := sanitizeJSON(data, conf); ok {
+			return zap.Reflect(f.Key, json.RawMessage(out))
+		}
+	}
+	return f
+}
+
+// sanitizeCore 输出日志前掩码密钥，并按日志隐私级别处理请求和响应中的消息内容
+type sanitizeCore struct {
+	zapcore.Core
+}
+
+func (c *sanitizeCore) With(fields []zapcore.Field) zapcore.Core {
+	return &sanitizeCore{Core: c.Core.With(sanitizeFields(fields))}
+}
+
+func (c *sanitizeCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sanitizeCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	conf := getPrivacy()
+	if conf.level != PrivacyFull && looksLikeJSON(ent.Message) {
+		if out, ok := sanitizeJSON([]byte(ent.Message), conf); ok {
+			ent.Message = string(out)
+		}
+	}
+	return c.Core.Write(ent, sanitizeFields(fields))
+}
+
+func sanitizeFields(fields []zapcore.Field) []zapcore.Field {
+	conf := getPrivacy()
+	sanitized := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		sanitized[i] = sanitizeField(f, conf)
+	}
+	return sanitized
+}
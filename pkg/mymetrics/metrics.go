@@ -0,0 +1,227 @@
+package mymetrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const namespace = "simple_one_api"
+
+// DefaultBuckets 延迟直方图的分桶（秒），覆盖短请求到长时间的流式输出
+var DefaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: namespace + "_" + name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{counterVec{name: namespace + "_" + name, help: help, labels: labels, values: make(map[string]float64)}}
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: namespace + "_" + name, help: help, labels: labels, buckets: DefaultBuckets, values: make(map[string]*histogram)}
+}
+
+// labelKey 按标签的顺序生成 key="value" 形式的字符串，同时作为map的键
+func labelKey(names []string, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, exists := h.values[key]
+	if !exists {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *counterVec) write(sb *strings.Builder) {
+	c.writeType(sb, "counter")
+}
+
+func (c *counterVec) writeType(sb *strings.Builder, metricType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, metricType)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(sb, "%s{%s} %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+func (g *gaugeVec) write(sb *strings.Builder) {
+	g.writeType(sb, "gauge")
+}
+
+func (h *histogramVec) write(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(sb, "%s_bucket{%s,le=%q} %d\n", h.name, key, formatFloat(upper), hist.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, key, hist.count)
+		fmt.Fprintf(sb, "%s_sum{%s} %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(sb, "%s_count{%s} %d\n", h.name, key, hist.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	requestsTotal    = newCounterVec("requests_total", "Total number of chat completion requests.", "model", "provider", "key", "status")
+	requestDuration  = newHistogramVec("request_duration_seconds", "Chat completion request duration in seconds, streaming requests until the stream is closed.", "model", "provider")
+	timeToFirstToken = newHistogramVec("time_to_first_token_seconds", "Time from request to the first streamed chunk in seconds.", "model", "provider")
+	promptTokens     = newCounterVec("prompt_tokens_total", "Prompt tokens reported in response usage.", "model", "provider", "key")
+	completionTokens = newCounterVec("completion_tokens_total", "Completion tokens reported in response usage.", "model", "provider", "key")
+
+	upstreamRequests         = newCounterVec("upstream_requests_total", "Total number of upstream attempts, including retries and failover.", "model", "provider", "status")
+	upstreamDuration         = newHistogramVec("upstream_request_duration_seconds", "Upstream attempt duration in seconds.", "model", "provider")
+	upstreamTimeToFirstToken = newHistogramVec("upstream_time_to_first_token_seconds", "Time from sending the upstream request to its first streamed chunk in seconds.", "model", "provider")
+	activeStreams            = newGaugeVec("active_streams", "Number of streaming upstream attempts in progress.", "model", "provider")
+
+	moderationViolations = newCounterVec("moderation_violations_total", "Content moderation hits by stage, provider and action.", "stage", "provider", "action")
+)
+
+// RequestRecord 一次请求结束后需要统计的信息
+type RequestRecord struct {
+	Model            string
+	Provider         string
+	Key              string
+	Status           int
+	Stream           bool
+	Duration         time.Duration
+	TimeToFirstToken time.Duration
+	PromptTokens     int
+	CompletionTokens int
+	// Cost 按pricing计算的费用，没有配置价格时为0
+	Cost float64
+}
+
+// ObserveRequest 记录一次请求
+func ObserveRequest(r *RequestRecord) {
+	requestsTotal.add(1, r.Model, r.Provider, r.Key, strconv.Itoa(r.Status))
+	requestDuration.observe(r.Duration.Seconds(), r.Model, r.Provider)
+	if r.Stream && r.TimeToFirstToken > 0 {
+		timeToFirstToken.observe(r.TimeToFirstToken.Seconds(), r.Model, r.Provider)
+	}
+	if r.PromptTokens > 0 {
+		promptTokens.add(float64(r.PromptTokens), r.Model, r.Provider, r.Key)
+	}
+	if r.CompletionTokens > 0 {
+		completionTokens.add(float64(r.CompletionTokens), r.Model, r.Provider, r.Key)
+	}
+}
+
+// ObserveUpstreamAttempt 记录一次上游请求，重试和切换服务的每次请求都会记录
+func ObserveUpstreamAttempt(model, provider string, status int, duration time.Duration) {
+	upstreamRequests.add(1, model, provider, strconv.Itoa(status))
+	upstreamDuration.observe(duration.Seconds(), model, provider)
+}
+
+// ObserveUpstreamFirstToken 记录上游流式请求返回第一个分片的时间
+func ObserveUpstreamFirstToken(model, provider string, d time.Duration) {
+	upstreamTimeToFirstToken.observe(d.Seconds(), model, provider)
+}
+
+// StreamStarted 上游流式请求开始，结束后需要调用StreamFinished
+func StreamStarted(model, provider string) {
+	activeStreams.add(1, model, provider)
+}
+
+func StreamFinished(model, provider string) {
+	activeStreams.add(-1, model, provider)
+}
+
+// ObserveModerationViolation 记录一次内容审核命中
+func ObserveModerationViolation(stage, provider, action string) {
+	moderationViolations.add(1, stage, provider, action)
+}
+
+// Handler 按Prometheus的文本格式输出所有指标
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sb strings.Builder
+		requestsTotal.write(&sb)
+		requestDuration.write(&sb)
+		timeToFirstToken.write(&sb)
+		promptTokens.write(&sb)
+		completionTokens.write(&sb)
+		upstreamRequests.write(&sb)
+		upstreamDuration.write(&sb)
+		upstreamTimeToFirstToken.write(&sb)
+		activeStreams.write(&sb)
+		moderationViolations.write(&sb)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(sb.String()))
+	})
+}
@@ -0,0 +1,217 @@
+package mymoderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+// regexFilter keyword和regex类型的过滤器，在本地匹配，命中时把匹配的内容替换为mask
+type regexFilter struct {
+	category string
+	patterns []*regexp.Regexp
+	mask     string
+}
+
+func (f *regexFilter) Check(ctx context.Context, stage string, text string) (*Verdict, error) {
+	v := &Verdict{Content: text}
+	for _, re := range f.patterns {
+		if re.MatchString(v.Content) {
+			v.Flagged = true
+			v.Content = re.ReplaceAllLiteralString(v.Content, f.mask)
+		}
+	}
+	if v.Flagged {
+		v.Categories = []string{f.category}
+	}
+	return v, nil
+}
+
+func getMask(conf *config.ModerationProviderConf) string {
+	if conf.Mask == "" {
+		return config.DefaultModerationMask
+	}
+	return conf.Mask
+}
+
+func newKeywordFilter(conf *config.ModerationProviderConf) (Filter, error) {
+	keywords := make([]string, 0, len(conf.Keywords))
+	for _, k := range conf.Keywords {
+		if k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	if len(keywords) == 0 {
+		return nil, errors.New("moderation keyword provider requires keywords")
+	}
+	// 长的关键词优先，避免只替换了其中较短的部分
+	sort.Slice(keywords, func(i, j int) bool {
+		return len(keywords[i]) > len(keywords[j])
+	})
+	quoted := make([]string, len(keywords))
+	for i, k := range keywords {
+		quoted[i] = regexp.QuoteMeta(k)
+	}
+	expr := strings.Join(quoted, "|")
+	if conf.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	return &regexFilter{category: "keyword", patterns: []*regexp.Regexp{regexp.MustCompile(expr)}, mask: getMask(conf)}, nil
+}
+
+func newRegexFilter(conf *config.ModerationProviderConf) (Filter, error) {
+	if len(conf.Patterns) == 0 {
+		return nil, errors.New("moderation regex provider requires patterns")
+	}
+	f := &regexFilter{category: "regex", mask: getMask(conf)}
+	for _, p := range conf.Patterns {
+		if conf.IgnoreCase {
+			p = "(?i)" + p
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid moderation pattern %q: %w", p, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+func newHTTPClient(conf *config.ModerationProviderConf) *http.Client {
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultModerationTimeout
+	}
+	return &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("moderation request failed: status %d, %s", resp.StatusCode, respData)
+	}
+	return json.Unmarshal(respData, out)
+}
+
+// openaiFilter 使用OpenAI的moderations接口，配置了categories时只在这些分类命中时拦截
+type openaiFilter struct {
+	client     *http.Client
+	url        string
+	apiKey     string
+	model      string
+	categories []string
+}
+
+func newOpenAIFilter(conf *config.ModerationProviderConf) (Filter, error) {
+	f := &openaiFilter{
+		client:     newHTTPClient(conf),
+		url:        conf.ServerURL,
+		apiKey:     conf.APIKey,
+		model:      conf.Model,
+		categories: conf.Categories,
+	}
+	if f.url == "" {
+		f.url = config.DefaultOpenAIModerationURL
+	}
+	if f.model == "" {
+		f.model = config.DefaultOpenAIModerationModel
+	}
+	return f, nil
+}
+
+func (f *openaiFilter) Check(ctx context.Context, stage string, text string) (*Verdict, error) {
+	var resp struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	headers := map[string]string{"Authorization": "Bearer " + f.apiKey}
+	if err := postJSON(ctx, f.client, f.url, headers, map[string]interface{}{"model": f.model, "input": text}, &resp); err != nil {
+		return nil, err
+	}
+
+	v := &Verdict{}
+	for _, r := range resp.Results {
+		for name, hit := range r.Categories {
+			if hit && (len(f.categories) == 0 || containsString(f.categories, name)) {
+				v.Categories = append(v.Categories, name)
+			}
+		}
+		if len(f.categories) == 0 && r.Flagged {
+			v.Flagged = true
+		}
+	}
+	sort.Strings(v.Categories)
+	if len(v.Categories) > 0 {
+		v.Flagged = true
+	}
+	return v, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookFilter 把内容发送给server_url，请求为{"stage": "...", "text": "..."}，
+// 返回{"flagged": true, "categories": [...], "content": "..."}，content不为空时mask使用其中的内容
+type webhookFilter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func newWebhookFilter(conf *config.ModerationProviderConf) (Filter, error) {
+	if conf.ServerURL == "" {
+		return nil, errors.New("moderation webhook provider requires server_url")
+	}
+	return &webhookFilter{client: newHTTPClient(conf), url: conf.ServerURL, headers: conf.Headers}, nil
+}
+
+func (f *webhookFilter) Check(ctx context.Context, stage string, text string) (*Verdict, error) {
+	var resp struct {
+		Flagged    bool     `json:"flagged"`
+		Categories []string `json:"categories"`
+		Content    string   `json:"content"`
+	}
+	if err := postJSON(ctx, f.client, f.url, f.headers, map[string]string{"stage": stage, "text": text}, &resp); err != nil {
+		return nil, err
+	}
+	return &Verdict{Flagged: resp.Flagged, Categories: resp.Categories, Content: resp.Content}, nil
+}
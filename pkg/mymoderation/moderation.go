@@ -0,0 +1,170 @@
+package mymoderation
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+)
+
+// 审核的阶段
+const (
+	StageInput  = "input"
+	StageOutput = "output"
+)
+
+// Verdict 一个过滤器的审核结果，Content不为空时为过滤器替换命中内容后的文本
+type Verdict struct {
+	Flagged    bool
+	Categories []string
+	Content    string
+}
+
+// Filter 审核过滤器，Check不修改传入的文本
+type Filter interface {
+	Check(ctx context.Context, stage string, text string) (*Verdict, error)
+}
+
+// Factory 根据配置创建Filter
+type Factory func(conf *config.ModerationProviderConf) (Filter, error)
+
+// Violation 一次命中，Action为block、mask，审核服务出错并且开启fail_closed时为error
+type Violation struct {
+	Provider   string
+	Action     string
+	Categories []string
+}
+
+// Result 按顺序执行所有过滤器的结果，Content为mask后的文本，Blocked为true时Content不可用
+type Result struct {
+	Content    string
+	Blocked    bool
+	Violations []Violation
+}
+
+var (
+	factories = map[string]Factory{
+		"keyword": newKeywordFilter,
+		"regex":   newRegexFilter,
+		"openai":  newOpenAIFilter,
+		"webhook": newWebhookFilter,
+	}
+	factoriesMu sync.RWMutex
+)
+
+// Register 注册一种过滤器实现，type与内置的类型相同时替换内置的实现
+func Register(filterType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(filterType)] = factory
+}
+
+type namedFilter struct {
+	name   string
+	action string
+	mask   string
+	filter Filter
+}
+
+// 按配置创建的过滤器，配置重新加载后conf的地址改变，重新创建
+var (
+	filtersMu   sync.Mutex
+	filtersConf *config.ModerationConf
+	filters     []namedFilter
+	filtersErr  error
+)
+
+func getFilters(conf *config.ModerationConf) ([]namedFilter, error) {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	if filtersConf == conf {
+		return filters, filtersErr
+	}
+
+	filtersConf = conf
+	filters, filtersErr = buildFilters(conf)
+	if filtersErr != nil {
+		mylog.Logger.Error("create moderation filters failed", zap.Error(filtersErr))
+	}
+	return filters, filtersErr
+}
+
+func buildFilters(conf *config.ModerationConf) ([]namedFilter, error) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	var list []namedFilter
+	for i := range conf.Providers {
+		p := &conf.Providers[i]
+		factory, exists := factories[strings.ToLower(p.Type)]
+		if !exists {
+			return nil, errors.New("unsupported moderation provider type: " + p.Type)
+		}
+		f, err := factory(p)
+		if err != nil {
+			return nil, err
+		}
+
+		nf := namedFilter{name: p.Name, action: strings.ToLower(p.Action), mask: p.Mask, filter: f}
+		if nf.name == "" {
+			nf.name = strings.ToLower(p.Type)
+		}
+		if nf.action == "" {
+			nf.action = config.ModerationActionBlock
+		}
+		if nf.mask == "" {
+			nf.mask = config.DefaultModerationMask
+		}
+		list = append(list, nf)
+	}
+	return list, nil
+}
+
+// Moderate 按顺序执行过滤器，命中block时停止；mask的过滤器没有返回替换后的内容时整段替换为mask。
+// 审核服务出错时默认跳过该过滤器，开启fail_closed时按block处理
+func Moderate(ctx context.Context, conf *config.ModerationConf, stage string, text string) *Result {
+	res := &Result{Content: text}
+	if strings.TrimSpace(text) == "" {
+		return res
+	}
+
+	list, err := getFilters(conf)
+	if err != nil {
+		if conf.FailClosed {
+			res.Blocked = true
+			res.Violations = append(res.Violations, Violation{Provider: "config", Action: "error"})
+		}
+		return res
+	}
+
+	for _, nf := range list {
+		v, err := nf.filter.Check(ctx, stage, res.Content)
+		if err != nil {
+			mylog.Logger.Error("moderation check failed", zap.String("provider", nf.name), zap.String("stage", stage), zap.Error(err))
+			if conf.FailClosed {
+				res.Blocked = true
+				res.Violations = append(res.Violations, Violation{Provider: nf.name, Action: "error"})
+				return res
+			}
+			continue
+		}
+		if v == nil || !v.Flagged {
+			continue
+		}
+
+		res.Violations = append(res.Violations, Violation{Provider: nf.name, Action: nf.action, Categories: v.Categories})
+		if nf.action != config.ModerationActionMask {
+			res.Blocked = true
+			return res
+		}
+		if v.Content != "" {
+			res.Content = v.Content
+		} else {
+			res.Content = nf.mask
+		}
+	}
+	return res
+}
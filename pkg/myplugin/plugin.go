@@ -0,0 +1,169 @@
+package myplugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"net/http"
+	"sync"
+)
+
+// HookContext 同一个请求的所有钩子共用，Values用于在请求钩子和响应钩子之间传递数据，例如脱敏前后的对应关系
+type HookContext struct {
+	Context   context.Context
+	Request   *http.Request
+	RequestID string
+	KeyName   string
+	Tenant    string
+	Model     string // 客户端请求的模型名称
+	Values    map[string]interface{}
+}
+
+// RequestHook 在请求发送给上游之前调用，可以直接修改req；返回错误时中止请求，*Error按其中的状态码返回，其他错误返回500
+type RequestHook func(hc *HookContext, req *openai.ChatCompletionRequest) error
+
+// StreamChunkHook 流式响应中每个分片输出给客户端之前调用，可以直接修改chunk，不包括[DONE]和错误事件
+type StreamChunkHook func(hc *HookContext, chunk *openai.ChatCompletionStreamResponse)
+
+// ResponseHook 非流式响应成功时输出给客户端之前调用，可以直接修改resp
+type ResponseHook func(hc *HookContext, resp *openai.ChatCompletionResponse)
+
+// StreamCompleteHook 流式响应成功结束后调用，resp为拼接好的完整回答，内容已经输出给客户端，修改不会生效
+type StreamCompleteHook func(hc *HookContext, resp *openai.ChatCompletionResponse)
+
+// Plugin 一组钩子，不需要的钩子可以为nil
+type Plugin struct {
+	Name             string
+	OnRequest        RequestHook
+	OnStreamChunk    StreamChunkHook
+	OnResponse       ResponseHook
+	OnStreamComplete StreamCompleteHook
+}
+
+// Error 请求钩子返回该错误时按Status返回给客户端
+type Error struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError Type按状态码取默认值，4xx为invalid_request_error，5xx为server_error
+func NewError(status int, message string) *Error {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+	return &Error{Status: status, Type: errType, Message: message}
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   []*Plugin
+)
+
+// Register 注册插件，一般在插件包的init中调用，钩子按注册的顺序执行；名称为空或重复时panic
+func Register(p Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if p.Name == "" {
+		panic("myplugin: plugin name is required")
+	}
+	for _, registered := range plugins {
+		if registered.Name == p.Name {
+			panic(fmt.Sprintf("myplugin: plugin %s is already registered", p.Name))
+		}
+	}
+	plugins = append(plugins, &p)
+}
+
+// Plugins 返回已注册的插件
+func Plugins() []*Plugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	return plugins
+}
+
+// Names 返回已注册的插件名称
+func Names() []string {
+	list := Plugins()
+	names := make([]string, len(list))
+	for i, p := range list {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// HasStreamChunkHooks 是否有插件注册了流式分片的钩子
+func HasStreamChunkHooks() bool {
+	for _, p := range Plugins() {
+		if p.OnStreamChunk != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasResponseHooks 是否有插件注册了非流式响应的钩子
+func HasResponseHooks() bool {
+	for _, p := range Plugins() {
+		if p.OnResponse != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasStreamCompleteHooks 是否有插件注册了流式响应结束的钩子
+func HasStreamCompleteHooks() bool {
+	for _, p := range Plugins() {
+		if p.OnStreamComplete != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RunRequestHooks 依次执行请求钩子，第一个返回错误的钩子中止后续的钩子，返回的名称为该插件
+func RunRequestHooks(hc *HookContext, req *openai.ChatCompletionRequest) (string, error) {
+	for _, p := range Plugins() {
+		if p.OnRequest == nil {
+			continue
+		}
+		if err := p.OnRequest(hc, req); err != nil {
+			return p.Name, err
+		}
+	}
+	return "", nil
+}
+
+// RunStreamChunkHooks 依次执行流式分片的钩子
+func RunStreamChunkHooks(hc *HookContext, chunk *openai.ChatCompletionStreamResponse) {
+	for _, p := range Plugins() {
+		if p.OnStreamChunk != nil {
+			p.OnStreamChunk(hc, chunk)
+		}
+	}
+}
+
+// RunResponseHooks 依次执行非流式响应的钩子
+func RunResponseHooks(hc *HookContext, resp *openai.ChatCompletionResponse) {
+	for _, p := range Plugins() {
+		if p.OnResponse != nil {
+			p.OnResponse(hc, resp)
+		}
+	}
+}
+
+// RunStreamCompleteHooks 依次执行流式响应结束的钩子
+func RunStreamCompleteHooks(hc *HookContext, resp *openai.ChatCompletionResponse) {
+	for _, p := range Plugins() {
+		if p.OnStreamComplete != nil {
+			p.OnStreamComplete(hc, resp)
+		}
+	}
+}
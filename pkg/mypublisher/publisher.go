@@ -0,0 +1,173 @@
+package mypublisher
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event 一次请求完成后发布的数据
+type Event struct {
+	Timestamp        int64  `json:"timestamp"`
+	ServiceName      string `json:"service_name"`
+	ClientModel      string `json:"client_model"`
+	Model            string `json:"model"`
+	Stream           bool   `json:"stream"`
+	StatusCode       int    `json:"status_code"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	LatencyMs        int64  `json:"latency_ms"`
+	Prompt           string `json:"prompt,omitempty"`
+	Completion       string `json:"completion,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Publisher 消息队列发布者，Kafka、NATS、Redis Streams等实现通过Register注册
+type Publisher interface {
+	Publish(ctx context.Context, event *Event) error
+	Close() error
+}
+
+// Factory 根据配置创建Publisher
+type Factory func(conf *config.PublisherConf) (Publisher, error)
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (noopPublisher) Close() error {
+	return nil
+}
+
+const defaultQueueSize = 1024
+const defaultPublishTimeout = 5 * time.Second
+
+var (
+	factories = map[string]Factory{
+		"noop": func(conf *config.PublisherConf) (Publisher, error) { return noopPublisher{}, nil },
+	}
+	factoriesMu sync.RWMutex
+
+	publisher Publisher = noopPublisher{}
+	eventCh   chan *Event
+	enabled   bool
+	enabledMu sync.RWMutex
+	pubConf   *config.PublisherConf
+	wg        sync.WaitGroup
+)
+
+// Register 注册一种Publisher实现
+func Register(pubType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(pubType)] = factory
+}
+
+// Init 根据配置初始化Publisher并启动异步发布协程
+func Init(conf *config.PublisherConf) error {
+	if conf == nil || !conf.Enable {
+		return nil
+	}
+
+	pubType := strings.ToLower(conf.Type)
+	if pubType == "" {
+		pubType = "noop"
+	}
+
+	factoriesMu.RLock()
+	factory, exists := factories[pubType]
+	factoriesMu.RUnlock()
+	if !exists {
+		return errors.New("unsupported publisher type: " + conf.Type)
+	}
+
+	p, err := factory(conf)
+	if err != nil {
+		return err
+	}
+
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	publisher = p
+	pubConf = conf
+	eventCh = make(chan *Event, queueSize)
+	enabled = true
+
+	wg.Add(1)
+	go run()
+
+	mylog.Logger.Info("publisher enabled", zap.String("type", pubType), zap.Int("queue_size", queueSize))
+	return nil
+}
+
+// Enabled 是否启用了发布
+func Enabled() bool {
+	return enabled
+}
+
+// IncludeContent 发布的数据中是否包含请求和响应内容
+func IncludeContent() bool {
+	return enabled && pubConf.IncludeContent
+}
+
+// MaxContentLength 发布内容的最大长度，0表示不限制
+func MaxContentLength() int {
+	if pubConf == nil {
+		return 0
+	}
+	return pubConf.MaxContentLength
+}
+
+// PublishAsync 异步发布事件，队列满时丢弃并记录日志，不影响请求处理
+func PublishAsync(event *Event) {
+	enabledMu.RLock()
+	defer enabledMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	select {
+	case eventCh <- event:
+	default:
+		mylog.Logger.Warn("publisher queue is full, event dropped", zap.String("model", event.ClientModel))
+	}
+}
+
+func run() {
+	defer wg.Done()
+	for event := range eventCh {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultPublishTimeout)
+		if err := publisher.Publish(ctx, event); err != nil {
+			mylog.Logger.Error("publish event failed", zap.String("model", event.ClientModel), zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// Close 发布完队列中剩余的事件后关闭Publisher
+func Close() {
+	enabledMu.Lock()
+	if !enabled {
+		enabledMu.Unlock()
+		return
+	}
+	enabled = false
+	close(eventCh)
+	enabledMu.Unlock()
+	wg.Wait()
+
+	if err := publisher.Close(); err != nil {
+		mylog.Logger.Error("close publisher failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,194 @@
+package myredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// poolSize 空闲连接数的上限，超过时用完即关闭
+const poolSize = 8
+
+const timeout = 3 * time.Second
+
+// Client 使用RESP协议的简单Redis客户端，只支持单机，连接用完后放回连接池
+type Client struct {
+	addr     string
+	password string
+	db       int
+	pool     chan *conn
+}
+
+type conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Error Redis返回的错误，不影响连接继续使用
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewClient(addr, password string, db int) *Client {
+	return &Client{
+		addr:     addr,
+		password: password,
+		db:       db,
+		pool:     make(chan *conn, poolSize),
+	}
+}
+
+// Addr 返回Redis的地址，用于日志
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Ping 检查Redis是否可以连接，初始化时调用，配置错误时尽早发现
+func (c *Client) Ping() error {
+	_, err := c.Do("PING")
+	return err
+}
+
+func (c *Client) getConn() (*conn, error) {
+	select {
+	case rc := <-c.pool:
+		return rc, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &conn{conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err = rc.do("AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err = rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *Client) putConn(rc *conn) {
+	select {
+	case c.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// Do 执行一条命令，网络错误时关闭连接。返回值为string（状态）、int64、[]byte、[]interface{}或者nil
+func (c *Client) Do(args ...string) (interface{}, error) {
+	rc, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	v, err := rc.do(args...)
+	var redisErr Error
+	if err != nil && !errors.As(err, &redisErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.putConn(rc)
+	return v, err
+}
+
+// Eval 执行Lua脚本
+func (c *Client) Eval(script string, keys []string, args ...string) (interface{}, error) {
+	cmd := make([]string, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVAL", script, strconv.Itoa(len(keys)))
+	cmd = append(cmd, keys...)
+	cmd = append(cmd, args...)
+	return c.Do(cmd...)
+}
+
+func (rc *conn) do(args ...string) (interface{}, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := rc.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply 读取一个回复，数组中的元素出错时返回第一个错误
+func (rc *conn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply: %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(rc.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		var firstErr error
+		for i := range items {
+			items[i], err = rc.readReply()
+			var redisErr Error
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return items, firstErr
+	}
+	return nil, fmt.Errorf("unsupported redis reply: %q", line)
+}
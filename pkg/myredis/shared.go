@@ -0,0 +1,100 @@
+package myredis
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SharedStateMemory = "memory"
+	SharedStateRedis  = "redis"
+)
+
+// errorLogInterval Redis不可用时每个操作最多每隔这么久输出一次日志，避免每个请求都输出
+const errorLogInterval = 10 * time.Second
+
+var (
+	shared       *Client
+	sharedPrefix string
+
+	lastErrorLog   = make(map[string]time.Time)
+	lastErrorLogMu sync.Mutex
+)
+
+// Init 按shared_state创建共享状态使用的Redis连接，backend为空或memory时各实例只使用进程内的状态
+func Init(conf *config.SharedStateConf) error {
+	switch strings.ToLower(conf.Backend) {
+	case "", SharedStateMemory:
+		return nil
+	case SharedStateRedis:
+		if conf.Redis.Addr == "" {
+			return errors.New("shared state redis addr is empty")
+		}
+		client := NewClient(conf.Redis.Addr, conf.Redis.Password, conf.Redis.DB)
+		if err := client.Ping(); err != nil {
+			return fmt.Errorf("connect shared state redis: %w", err)
+		}
+		sharedPrefix = conf.Redis.KeyPrefix
+		if sharedPrefix == "" {
+			sharedPrefix = config.DefaultSharedStateRedisKeyPrefix
+		}
+		shared = client
+		return nil
+	}
+	return fmt.Errorf("unsupported shared state backend: %s", conf.Backend)
+}
+
+// Shared 返回共享状态使用的Redis连接，没有配置时返回nil
+func Shared() *Client {
+	return shared
+}
+
+// Key 在各部分之间加上冒号并加上key_prefix
+func Key(parts ...string) string {
+	return sharedPrefix + strings.Join(parts, ":")
+}
+
+// LogError Redis操作失败时调用方会改用进程内的状态，这里按操作限制日志的频率
+func LogError(op string, err error) {
+	now := time.Now()
+	lastErrorLogMu.Lock()
+	if now.Sub(lastErrorLog[op]) < errorLogInterval {
+		lastErrorLogMu.Unlock()
+		return
+	}
+	lastErrorLog[op] = now
+	lastErrorLogMu.Unlock()
+	mylog.Logger.Warn("shared state redis failed, use local state", zap.String("op", op), zap.String("addr", shared.Addr()), zap.Error(err))
+}
+
+// Int64 把整数或者字符串的回复转为int64
+func Int64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case []byte:
+		i, _ := strconv.ParseInt(string(n), 10, 64)
+		return i
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
+
+// Int64s 把数组回复转为[]int64
+func Int64s(v interface{}) []int64 {
+	items, _ := v.([]interface{})
+	result := make([]int64, len(items))
+	for i, item := range items {
+		result[i] = Int64(item)
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package mysigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"strconv"
+	"time"
+)
+
+// hmacSigner 通用的HMAC-SHA256签名，待签名字符串为 METHOD\nPATH\nTIMESTAMP\nhex(sha256(body))
+type hmacSigner struct {
+	accessKey string
+	secretKey string
+	header    string
+}
+
+func newHMACSigner(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error) {
+	accessKey, err := getCredential(creds, config.KEYNAME_ACCESS_KEY, config.KEYNAME_API_KEY)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := getCredential(creds, config.KEYNAME_SECRET_KEY, config.KEYNAME_API_SECRET)
+	if err != nil {
+		return nil, err
+	}
+	header := conf.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	return &hmacSigner{accessKey: accessKey, secretKey: secretKey, header: header}, nil
+}
+
+func (s *hmacSigner) Sign(req *http.Request, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	stringToSign := req.Method + "\n" + req.URL.EscapedPath() + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])
+
+	mac := hmac.New(sha256.New, []byte(s.secretKey))
+	mac.Write([]byte(stringToSign))
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Access-Key", s.accessKey)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set(s.header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,139 @@
+package mysigner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/utils"
+	"strings"
+	"sync"
+)
+
+// RequestSigner 在请求发送给上游前完成鉴权，如设置token、计算签名等
+type RequestSigner interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// Factory 根据配置和凭证创建RequestSigner
+type Factory func(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error)
+
+var (
+	factories = map[string]Factory{
+		"bearer":  newBearerSigner,
+		"api_key": newAPIKeySigner,
+		"hmac":    newHMACSigner,
+		"sigv4":   newSigV4Signer,
+		"tc3":     newTC3Signer,
+	}
+	factoriesMu sync.RWMutex
+)
+
+// Register 注册新的签名方式
+func Register(signerType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(signerType)] = factory
+}
+
+// New 根据配置的type创建RequestSigner
+func New(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error) {
+	factoriesMu.RLock()
+	factory, exists := factories[strings.ToLower(conf.Type)]
+	factoriesMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unsupported signer type: %s", conf.Type)
+	}
+	return factory(conf, creds)
+}
+
+// Transport 在请求发出前调用Signer，签名需要的请求体会被读出后重新设置
+type Transport struct {
+	Transport http.RoundTripper
+	Signer    RequestSigner
+}
+
+func NewTransport(transport http.RoundTripper, signer RequestSigner) *Transport {
+	return &Transport{Transport: transport, Signer: signer}
+}
+
+// RoundTrip 签名会修改请求头和请求体，RoundTripper不能修改传入的请求，在副本上签名
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	if err := t.Signer.Sign(req, body); err != nil {
+		return nil, fmt.Errorf("sign request error: %w", err)
+	}
+
+	return t.Transport.RoundTrip(req)
+}
+
+func getCredential(creds map[string]interface{}, keys ...string) (string, error) {
+	for _, key := range keys {
+		if v, ok := utils.GetStringFromMap(creds, key); ok && v != "" {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("credential %s is empty", keys[0])
+}
+
+// bearerSigner Authorization: Bearer <api_key>
+type bearerSigner struct {
+	token  string
+	prefix string
+}
+
+func newBearerSigner(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error) {
+	token, err := getCredential(creds, config.KEYNAME_API_KEY, config.KEYNAME_TOKEN)
+	if err != nil {
+		return nil, err
+	}
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = "Bearer "
+	}
+	return &bearerSigner{token: token, prefix: prefix}, nil
+}
+
+func (s *bearerSigner) Sign(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", s.prefix+s.token)
+	return nil
+}
+
+// apiKeySigner 将api_key放在指定的请求头中，默认为api-key
+type apiKeySigner struct {
+	header string
+	value  string
+}
+
+func newAPIKeySigner(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error) {
+	apiKey, err := getCredential(creds, config.KEYNAME_API_KEY)
+	if err != nil {
+		return nil, err
+	}
+	header := conf.Header
+	if header == "" {
+		header = "api-key"
+	}
+	return &apiKeySigner{header: header, value: conf.Prefix + apiKey}, nil
+}
+
+func (s *apiKeySigner) Sign(req *http.Request, body []byte) error {
+	req.Header.Del("Authorization")
+	req.Header.Set(s.header, s.value)
+	return nil
+}
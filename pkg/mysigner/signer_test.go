@@ -0,0 +1,50 @@
+package mysigner
+
+import (
+	"io"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestTransportClonesRequest 签名设置在发出的请求上，调用方的请求头保持不变
+func TestTransportClonesRequest(t *testing.T) {
+	signer, err := New(&config.SignerConf{Type: "hmac"}, map[string]interface{}{
+		config.KEYNAME_ACCESS_KEY: "ak-test",
+		config.KEYNAME_SECRET_KEY: "secret-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	req.Header.Set("Authorization", "Bearer sk-test")
+
+	var sentBody string
+	var sentHeader http.Header
+	transport := NewTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		sentBody = string(body)
+		sentHeader = r.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}), signer)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if sentBody != `{"model":"m"}` {
+		t.Errorf("sent body = %q", sentBody)
+	}
+	if sentHeader.Get("X-Signature") == "" || sentHeader.Get("Authorization") != "" {
+		t.Errorf("sent headers = %v", sentHeader)
+	}
+	if req.Header.Get("Authorization") != "Bearer sk-test" || req.Header.Get("X-Signature") != "" {
+		t.Errorf("caller headers were modified: %v", req.Header)
+	}
+}
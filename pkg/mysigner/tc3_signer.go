@@ -0,0 +1,100 @@
+package mysigner
+
+import (
+	"encoding/hex"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tc3Signer 腾讯云API 3.0的TC3-HMAC-SHA256签名，X-TC-Action、X-TC-Version由调用方设置
+// https://cloud.tencent.com/document/api/213/30654
+type tc3Signer struct {
+	secretID  string
+	secretKey string
+	token     string
+	region    string
+	service   string
+}
+
+func newTC3Signer(conf *config.SignerConf, creds map[string]interface{}) (RequestSigner, error) {
+	secretID, err := getCredential(creds, config.KEYNAME_SECRET_ID, config.KEYNAME_ACCESS_KEY)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := getCredential(creds, config.KEYNAME_SECRET_KEY)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := getCredential(creds, config.KEYNAME_SESSION_TOKEN, config.KEYNAME_TOKEN)
+	region := conf.Region
+	if region == "" {
+		region, _ = getCredential(creds, config.KEYNAME_REGION)
+	}
+
+	return &tc3Signer{
+		secretID:  secretID,
+		secretKey: secretKey,
+		token:     token,
+		region:    region,
+		service:   conf.Service,
+	}, nil
+}
+
+func (s *tc3Signer) Sign(req *http.Request, body []byte) error {
+	return s.signAt(req, body, time.Now().UTC())
+}
+
+func (s *tc3Signer) signAt(req *http.Request, body []byte, now time.Time) error {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	date := now.UTC().Format("2006-01-02")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	service := s.service
+	if service == "" {
+		service = strings.SplitN(host, ".", 2)[0]
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-TC-Timestamp", timestamp)
+	if s.region != "" && req.Header.Get("X-TC-Region") == "" {
+		req.Header.Set("X-TC-Region", s.region)
+	}
+	if s.token != "" {
+		req.Header.Set("X-TC-Token", s.token)
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	canonicalHeaders := "content-type:" + contentType + "\n" + "host:" + host + "\n"
+	signedHeaders := "content-type;host"
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hashHex(body),
+	}, "\n")
+
+	scope := date + "/" + service + "/tc3_request"
+	stringToSign := "TC3-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("TC3"+s.secretKey), date)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "tc3_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "TC3-HMAC-SHA256 Credential="+s.secretID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
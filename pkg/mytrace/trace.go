@@ -0,0 +1,149 @@
+package mytrace
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"simple-one-api/pkg/config"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+)
+
+const tracerName = "simple-one-api"
+
+// shutdownTimeout 退出时等待剩余span导出的时长
+const shutdownTimeout = 5 * time.Second
+
+var provider *sdktrace.TracerProvider
+
+// Init 按tracing创建OTLP导出器并设置为全局的TracerProvider，没有开启时使用otel默认的空实现，不会产生span
+func Init(conf *config.TracingConf) error {
+	if !conf.Enable {
+		return nil
+	}
+	exporter, err := newExporter(conf)
+	if err != nil {
+		return fmt.Errorf("create otlp exporter: %w", err)
+	}
+
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = config.DefaultTracingServiceName
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 {
+		ratio = config.DefaultTracingSampleRatio
+	}
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+// newExporter endpoint带有http://或https://时作为完整地址，否则作为host:port，为空时使用导出器的默认地址和OTEL_EXPORTER_OTLP_*环境变量
+func newExporter(conf *config.TracingConf) (*otlptrace.Exporter, error) {
+	hasScheme := strings.HasPrefix(conf.Endpoint, "http://") || strings.HasPrefix(conf.Endpoint, "https://")
+	switch strings.ToLower(conf.Protocol) {
+	case "", ProtocolHTTP:
+		var opts []otlptracehttp.Option
+		if hasScheme {
+			opts = append(opts, otlptracehttp.WithEndpointURL(conf.Endpoint))
+		} else if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(conf.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(conf.Headers))
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	case ProtocolGRPC:
+		var opts []otlptracegrpc.Option
+		if hasScheme {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(conf.Endpoint))
+		} else if conf.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(conf.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(conf.Headers))
+		}
+		return otlptracegrpc.New(context.Background(), opts...)
+	}
+	return nil, fmt.Errorf("unsupported tracing protocol: %s", conf.Protocol)
+}
+
+// Enabled 是否开启了链路追踪
+func Enabled() bool {
+	return provider != nil
+}
+
+// Tracer 返回生成span使用的Tracer，没有开启时生成的span不会记录
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// tracedTransport 保留原来的Transport，websocket等需要*http.Transport的客户端通过BaseTransport取回
+type tracedTransport struct {
+	http.RoundTripper
+	base *http.Transport
+}
+
+// WrapTransport 开启链路追踪时为上游的HTTP请求生成span并传递traceparent，t为nil时使用http.DefaultTransport，
+// 没有开启时原样返回，t为nil时返回nil
+func WrapTransport(t *http.Transport) http.RoundTripper {
+	if !Enabled() {
+		if t == nil {
+			return nil
+		}
+		return t
+	}
+	var base http.RoundTripper = http.DefaultTransport
+	if t != nil {
+		base = t
+	}
+	return &tracedTransport{RoundTripper: otelhttp.NewTransport(base), base: t}
+}
+
+// BaseTransport 返回WrapTransport之前的*http.Transport，没有时返回nil
+func BaseTransport(rt http.RoundTripper) *http.Transport {
+	switch t := rt.(type) {
+	case *http.Transport:
+		return t
+	case *tracedTransport:
+		return t.base
+	}
+	return nil
+}
+
+// Shutdown 导出剩余的span
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	provider.Shutdown(ctx)
+}
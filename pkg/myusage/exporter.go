@@ -0,0 +1,149 @@
+package myusage
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/mylog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exporter 将用量明细批量写入外部存储，sqlite和mysql使用内置的sql实现，其他存储通过Register注册
+type Exporter interface {
+	Export(ctx context.Context, records []*Record) error
+	Close() error
+}
+
+// Factory 根据配置创建Exporter
+type Factory func(conf *config.UsageExportConf) (Exporter, error)
+
+const defaultExportTimeout = 10 * time.Second
+
+var (
+	exporterFactories = map[string]Factory{
+		"sqlite": newSQLExporter,
+		"mysql":  newSQLExporter,
+	}
+	exporterFactoriesMu sync.RWMutex
+
+	exporter   Exporter
+	exportCh   chan *Record
+	exportConf *config.UsageExportConf
+	exportMu   sync.RWMutex
+	exportWg   sync.WaitGroup
+)
+
+// Register 注册一种Exporter实现
+func Register(exportType string, factory Factory) {
+	exporterFactoriesMu.Lock()
+	defer exporterFactoriesMu.Unlock()
+	exporterFactories[strings.ToLower(exportType)] = factory
+}
+
+func initExporter(conf *config.UsageExportConf) error {
+	exporterFactoriesMu.RLock()
+	factory, exists := exporterFactories[strings.ToLower(conf.Type)]
+	exporterFactoriesMu.RUnlock()
+	if !exists {
+		return errors.New("unsupported usage export type: " + conf.Type)
+	}
+
+	e, err := factory(conf)
+	if err != nil {
+		return err
+	}
+
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = config.DefaultUsageExportQueueSize
+	}
+	exporter = e
+	exportConf = conf
+	exportCh = make(chan *Record, queueSize)
+
+	exportWg.Add(1)
+	go runExporter()
+
+	mylog.Logger.Info("usage export enabled", zap.String("type", conf.Type), zap.Int("queue_size", queueSize))
+	return nil
+}
+
+// exportAsync 队列满时丢弃并记录日志，内存中的汇总数据不受影响
+func exportAsync(r *Record) {
+	exportMu.RLock()
+	defer exportMu.RUnlock()
+	if exportCh == nil {
+		return
+	}
+
+	select {
+	case exportCh <- r:
+	default:
+		mylog.Logger.Warn("usage export queue is full, record dropped", zap.String("key_name", r.KeyName), zap.String("model", r.ClientModel))
+	}
+}
+
+// runExporter 攒够batch_size条或者每隔flush_interval秒写入一次
+func runExporter() {
+	defer exportWg.Done()
+
+	batchSize := exportConf.BatchSize
+	if batchSize <= 0 {
+		batchSize = config.DefaultUsageExportBatchSize
+	}
+	interval := exportConf.FlushInterval
+	if interval <= 0 {
+		interval = config.DefaultUsageExportFlushInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*Record, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), defaultExportTimeout)
+		if err := exporter.Export(ctx, batch); err != nil {
+			mylog.Logger.Error("export usage records failed", zap.Int("records", len(batch)), zap.Error(err))
+		}
+		cancel()
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case r, ok := <-exportCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close 写入队列中剩余的明细后关闭Exporter
+func Close() {
+	exportMu.Lock()
+	if exportCh == nil {
+		exportMu.Unlock()
+		return
+	}
+	close(exportCh)
+	exportCh = nil
+	exportMu.Unlock()
+	exportWg.Wait()
+
+	if err := exporter.Close(); err != nil {
+		mylog.Logger.Error("close usage exporter failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,111 @@
+package myusage
+
+import (
+	"encoding/json"
+	"simple-one-api/pkg/myredis"
+	"strconv"
+	"time"
+)
+
+// 配置了shared_state时按天、key和模型汇总的用量同时累加到Redis中，查询时返回所有实例的汇总；
+// 每天的汇总记录在usage:index:<date>集合中，汇总保存在usage:<date>:<["key","model"]>的hash中，超过保留天数后过期。
+// 明细只保留在各实例中
+
+// addSummaryScript KEYS为当天的索引和汇总，ARGV[1]为索引的成员，ARGV[2]为过期的毫秒数，之后为字段和增量
+const addSummaryScript = `
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+for i = 3, #ARGV, 2 do
+  redis.call('HINCRBY', KEYS[2], ARGV[i], ARGV[i + 1])
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`
+
+func sharedIndexName(date string) string {
+	return myredis.Key("usage", "index", date)
+}
+
+func sharedSummaryName(date string, member string) string {
+	return myredis.Key("usage", date, member)
+}
+
+func addSharedSummary(date string, r *Record) {
+	member, _ := json.Marshal([]string{r.KeyName, r.ClientModel})
+	failed, estimated := 0, 0
+	if r.StatusCode >= 400 {
+		failed = 1
+	}
+	if r.Estimated {
+		estimated = 1
+	}
+	// 保留天数按日期计算，多保留一天避免提前过期
+	ttl := getRetention() + 24*time.Hour
+	_, err := myredis.Shared().Eval(addSummaryScript, []string{sharedIndexName(date), sharedSummaryName(date, string(member))},
+		string(member), strconv.FormatInt(ttl.Milliseconds(), 10),
+		"requests", "1",
+		"failed_requests", strconv.Itoa(failed),
+		"estimated_requests", strconv.Itoa(estimated),
+		"prompt_tokens", strconv.Itoa(r.PromptTokens),
+		"completion_tokens", strconv.Itoa(r.CompletionTokens),
+		"total_tokens", strconv.Itoa(r.TotalTokens),
+		"latency_sum", strconv.FormatInt(r.LatencyMs, 10),
+		"cost_nanos", strconv.FormatInt(costToNanos(r.Cost), 10))
+	if err != nil {
+		myredis.LogError("add usage summary", err)
+	}
+}
+
+// getSharedSummaries 读取保留天数内符合条件的日期的汇总
+func getSharedSummaries(q *Query) ([]*Summary, error) {
+	client := myredis.Shared()
+	now := time.Now()
+	var list []*Summary
+	for day := now.Add(-getRetention()); !day.After(now); day = day.Add(24 * time.Hour) {
+		date := day.Format(dateLayout)
+		if (q.Start != "" && date < q.Start) || (q.End != "" && date > q.End) {
+			continue
+		}
+		v, err := client.Do("SMEMBERS", sharedIndexName(date))
+		if err != nil {
+			return nil, err
+		}
+		members, _ := v.([]interface{})
+		for _, m := range members {
+			member, _ := m.([]byte)
+			var names []string
+			if json.Unmarshal(member, &names) != nil || len(names) != 2 || !q.match(date, names[0], names[1]) {
+				continue
+			}
+			if v, err = client.Do("HGETALL", sharedSummaryName(date, string(member))); err != nil {
+				return nil, err
+			}
+			fields, _ := v.([]interface{})
+			s := &Summary{Date: date, KeyName: names[0], Model: names[1]}
+			for i := 1; i < len(fields); i += 2 {
+				name, _ := fields[i-1].([]byte)
+				n := myredis.Int64(fields[i])
+				switch string(name) {
+				case "requests":
+					s.Requests = int(n)
+				case "failed_requests":
+					s.FailedRequests = int(n)
+				case "estimated_requests":
+					s.EstimatedRequests = int(n)
+				case "prompt_tokens":
+					s.PromptTokens = int(n)
+				case "completion_tokens":
+					s.CompletionTokens = int(n)
+				case "total_tokens":
+					s.TotalTokens = int(n)
+				case "latency_sum":
+					s.latencySum = n
+				case "cost_nanos":
+					s.costNanos = n
+				}
+			}
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,106 @@
+package myusage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"simple-one-api/pkg/config"
+	"strings"
+)
+
+// defaultSQLDrivers 各类型默认使用的database/sql驱动名，程序中需要引入对应的驱动，
+// 如 _ "github.com/mattn/go-sqlite3" 或 _ "github.com/go-sql-driver/mysql"
+var defaultSQLDrivers = map[string]string{
+	"sqlite": "sqlite3",
+	"mysql":  "mysql",
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type sqlExporter struct {
+	db         *sql.DB
+	insertStmt string
+}
+
+func newSQLExporter(conf *config.UsageExportConf) (Exporter, error) {
+	exportType := strings.ToLower(conf.Type)
+	driver := conf.Driver
+	if driver == "" {
+		driver = defaultSQLDrivers[exportType]
+	}
+	table := conf.Table
+	if table == "" {
+		table = config.DefaultUsageExportTable
+	}
+	if !tableNameRegexp.MatchString(table) {
+		return nil, fmt.Errorf("invalid usage export table name: %s", table)
+	}
+
+	db, err := sql.Open(driver, conf.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open usage database: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect usage database: %w", err)
+	}
+
+	id := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	if exportType == "mysql" {
+		id = "id BIGINT PRIMARY KEY AUTO_INCREMENT"
+	}
+	createStmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	%s,
+	created_at BIGINT NOT NULL,
+	request_id VARCHAR(128),
+	key_name VARCHAR(128),
+	client_model VARCHAR(128),
+	model VARCHAR(128),
+	service_name VARCHAR(64),
+	stream BOOLEAN,
+	status_code INT,
+	prompt_tokens INT,
+	completion_tokens INT,
+	total_tokens INT,
+	estimated BOOLEAN,
+	latency_ms BIGINT
+)`, table, id)
+	if _, err = db.Exec(createStmt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create usage table: %w", err)
+	}
+
+	return &sqlExporter{
+		db: db,
+		insertStmt: fmt.Sprintf(`INSERT INTO %s (created_at, request_id, key_name, client_model, model, service_name, stream, status_code,
+	prompt_tokens, completion_tokens, total_tokens, estimated, latency_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, table),
+	}, nil
+}
+
+// Export 一个批次在同一个事务中写入
+func (e *sqlExporter) Export(ctx context.Context, records []*Record) error {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, e.insertStmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		if _, err = stmt.ExecContext(ctx, r.Timestamp, r.RequestID, r.KeyName, r.ClientModel, r.Model, r.ServiceName, r.Stream, r.StatusCode,
+			r.PromptTokens, r.CompletionTokens, r.TotalTokens, r.Estimated, r.LatencyMs); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (e *sqlExporter) Close() error {
+	return e.db.Close()
+}
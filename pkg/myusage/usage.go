@@ -0,0 +1,278 @@
+package myusage
+
+import (
+	"math"
+	"simple-one-api/pkg/config"
+	"simple-one-api/pkg/myredis"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Record 一次请求的用量明细
+type Record struct {
+	Timestamp        int64  `json:"timestamp"`
+	RequestID        string `json:"request_id"`
+	KeyName          string `json:"key_name"`
+	ClientModel      string `json:"client_model"`
+	Model            string `json:"model"`
+	ServiceName      string `json:"service_name"`
+	Stream           bool   `json:"stream"`
+	StatusCode       int    `json:"status_code"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	// Estimated 上游没有返回usage，token数为估算值
+	Estimated bool  `json:"estimated"`
+	LatencyMs int64 `json:"latency_ms"`
+	// Cost 按pricing计算的费用，没有配置价格的模型为0
+	Cost float64 `json:"cost"`
+}
+
+// Summary 按天、key和模型汇总的用量，查询时按group_by合并，没有参与分组的字段为空
+type Summary struct {
+	Date              string  `json:"date,omitempty"`
+	KeyName           string  `json:"key_name,omitempty"`
+	Model             string  `json:"model,omitempty"`
+	Requests          int     `json:"requests"`
+	FailedRequests    int     `json:"failed_requests"`
+	EstimatedRequests int     `json:"estimated_requests"`
+	PromptTokens      int     `json:"prompt_tokens"`
+	CompletionTokens  int     `json:"completion_tokens"`
+	TotalTokens       int     `json:"total_tokens"`
+	AvgLatencyMs      int64   `json:"avg_latency_ms"`
+	Cost              float64 `json:"cost"`
+	latencySum        int64
+	// costNanos 汇总时按十亿分之一的货币单位累加，避免浮点数误差
+	costNanos int64
+}
+
+// Query 查询条件，Start和End为包含在内的日期（YYYY-MM-DD），为空时不限制
+type Query struct {
+	Start   string
+	End     string
+	KeyName string
+	Model   string
+	GroupBy []string
+}
+
+const (
+	GroupByDate  = "date"
+	GroupByKey   = "key"
+	GroupByModel = "model"
+)
+
+var (
+	summaries   = make(map[string]*Summary)
+	records     []*Record
+	nextRecord  int
+	usageMu     sync.Mutex
+	lastSweep   time.Time
+	initialized bool
+)
+
+// Enabled 是否启用了用量记录
+func Enabled() bool {
+	return initialized
+}
+
+// Init 按配置启用用量记录和导出
+func Init(conf *config.UsageConf) error {
+	if conf == nil || !conf.Enable {
+		return nil
+	}
+	if conf.Export.Enable {
+		if err := initExporter(&conf.Export); err != nil {
+			return err
+		}
+	}
+	initialized = true
+	return nil
+}
+
+func getMaxRecords() int {
+	if n := config.GetConf().Usage.MaxRecords; n > 0 {
+		return n
+	}
+	return config.DefaultUsageMaxRecords
+}
+
+func getRetention() time.Duration {
+	days := config.GetConf().Usage.RetentionDays
+	if days <= 0 {
+		days = config.DefaultUsageRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// AddRecord 累加到按天汇总的用量，保留最近的明细，并异步导出
+func AddRecord(r *Record) {
+	if !initialized {
+		return
+	}
+
+	usageMu.Lock()
+	now := time.Now()
+	sweepSummaries(now)
+
+	date := time.Unix(r.Timestamp, 0).Format(dateLayout)
+	key := date + "|" + r.KeyName + "|" + r.ClientModel
+	s, exists := summaries[key]
+	if !exists {
+		s = &Summary{Date: date, KeyName: r.KeyName, Model: r.ClientModel}
+		summaries[key] = s
+	}
+	addToSummary(s, r)
+
+	maxRecords := getMaxRecords()
+	if len(records) < maxRecords {
+		records = append(records, r)
+	} else {
+		records[nextRecord%len(records)] = r
+	}
+	nextRecord++
+	usageMu.Unlock()
+
+	if myredis.Shared() != nil {
+		addSharedSummary(date, r)
+	}
+	exportAsync(r)
+}
+
+func addToSummary(s *Summary, r *Record) {
+	s.Requests++
+	if r.StatusCode >= 400 {
+		s.FailedRequests++
+	}
+	if r.Estimated {
+		s.EstimatedRequests++
+	}
+	s.PromptTokens += r.PromptTokens
+	s.CompletionTokens += r.CompletionTokens
+	s.TotalTokens += r.TotalTokens
+	s.latencySum += r.LatencyMs
+	s.costNanos += costToNanos(r.Cost)
+}
+
+func costToNanos(cost float64) int64 {
+	return int64(math.Round(cost * 1e9))
+}
+
+// sweepSummaries 每小时最多清理一次超过保留天数的汇总数据，需要持有锁
+func sweepSummaries(now time.Time) {
+	if now.Sub(lastSweep) < time.Hour {
+		return
+	}
+	lastSweep = now
+
+	oldest := now.Add(-getRetention()).Format(dateLayout)
+	for key, s := range summaries {
+		if s.Date < oldest {
+			delete(summaries, key)
+		}
+	}
+}
+
+func (q *Query) match(date, keyName, model string) bool {
+	return (q.Start == "" || date >= q.Start) && (q.End == "" || date <= q.End) &&
+		(q.KeyName == "" || keyName == q.KeyName) && (q.Model == "" || model == q.Model)
+}
+
+func (q *Query) groupBy(name string) bool {
+	for _, g := range q.GroupBy {
+		if strings.EqualFold(g, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSummaries 按条件查询汇总的用量，按日期、key、模型排序；配置了shared_state时返回所有实例的汇总，Redis出错时只返回本实例的
+func GetSummaries(q *Query) []*Summary {
+	if myredis.Shared() != nil {
+		list, err := getSharedSummaries(q)
+		if err == nil {
+			return groupSummaries(q, list)
+		}
+		myredis.LogError("get usage summaries", err)
+	}
+
+	usageMu.Lock()
+	list := make([]*Summary, 0, len(summaries))
+	for _, s := range summaries {
+		if q.match(s.Date, s.KeyName, s.Model) {
+			cp := *s
+			list = append(list, &cp)
+		}
+	}
+	usageMu.Unlock()
+	return groupSummaries(q, list)
+}
+
+// groupSummaries 按group_by合并汇总
+func groupSummaries(q *Query, list []*Summary) []*Summary {
+	grouped := make(map[string]*Summary)
+	for _, s := range list {
+		var g Summary
+		if q.groupBy(GroupByDate) {
+			g.Date = s.Date
+		}
+		if q.groupBy(GroupByKey) {
+			g.KeyName = s.KeyName
+		}
+		if q.groupBy(GroupByModel) {
+			g.Model = s.Model
+		}
+		key := g.Date + "|" + g.KeyName + "|" + g.Model
+		result, exists := grouped[key]
+		if !exists {
+			result = &g
+			grouped[key] = result
+		}
+		result.Requests += s.Requests
+		result.FailedRequests += s.FailedRequests
+		result.EstimatedRequests += s.EstimatedRequests
+		result.PromptTokens += s.PromptTokens
+		result.CompletionTokens += s.CompletionTokens
+		result.TotalTokens += s.TotalTokens
+		result.latencySum += s.latencySum
+		result.costNanos += s.costNanos
+	}
+
+	list = make([]*Summary, 0, len(grouped))
+	for _, s := range grouped {
+		if s.Requests > 0 {
+			s.AvgLatencyMs = s.latencySum / int64(s.Requests)
+		}
+		s.Cost = float64(s.costNanos) / 1e9
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date < list[j].Date
+		}
+		if list[i].KeyName != list[j].KeyName {
+			return list[i].KeyName < list[j].KeyName
+		}
+		return list[i].Model < list[j].Model
+	})
+	return list
+}
+
+// GetRecentRecords 按条件返回最近的明细，最新的在前，最多limit条
+func GetRecentRecords(q *Query, limit int) []*Record {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	var result []*Record
+	for i := 0; i < len(records) && len(result) < limit; i++ {
+		r := records[(nextRecord-1-i+len(records))%len(records)]
+		if q.match(time.Unix(r.Timestamp, 0).Format(dateLayout), r.KeyName, r.ClientModel) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
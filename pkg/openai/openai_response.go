@@ -31,27 +31,29 @@ type FunctionCall struct {
 // ToolType 工具类型
 type ToolType string
 
-// ToolCall 工具调用
+// ToolCall 工具调用，流式分片中只有第一个分片带有id和type
 type ToolCall struct {
 	Index    *int         `json:"index,omitempty"`
-	ID       string       `json:"id"`
-	Type     ToolType     `json:"type"`
+	ID       string       `json:"id,omitempty"`
+	Type     ToolType     `json:"type,omitempty"`
 	Function FunctionCall `json:"function"`
 }
 
 // ResponseMessage Message 定义了对话中的消息结构
 type ResponseMessage struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Role         string        `json:"role"`
+	Content      string        `json:"content"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string        `json:"tool_call_id,omitempty"`
 }
 
 // ResponseDelta Delta 定义了对话中的消息结构
 type ResponseDelta struct {
-	Role      string     `json:"role"`
-	Content   string     `json:"content"`
-	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Role         string        `json:"role"`
+	Content      string        `json:"content"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
 }
 
 // Usage 定义了使用统计的结构
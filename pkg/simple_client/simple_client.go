@@ -38,7 +38,7 @@ func (c *SimpleClient) CreateChatCompletion(
 ) (response openai.ChatCompletionResponse, err error) {
 	request.Stream = false
 	reqBody, _ := json.Marshal(request)
-	httpReq, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(reqBody))
+	httpReq, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewBuffer(reqBody))
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	// 创建Gin的实例和配置路由
@@ -90,7 +90,7 @@ func (c *SimpleClient) CreateChatCompletionStream(
 	go func() {
 		defer writer.Close()
 		requestData, _ := json.Marshal(request)
-		httpReq, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(requestData))
+		httpReq, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewBuffer(requestData))
 		httpReq.Header.Set("Content-Type", "application/json")
 		ginc.ServeHTTP(recorder, httpReq)
 	}()
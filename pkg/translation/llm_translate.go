@@ -27,15 +27,16 @@ func createLLMTranslationPromptJson(srcText string, srcLang string, targetLang s
 var defaultLLMTransPrompt = "你是一个机器翻译接口，遵循以下输入输出协议，当接收到输入，直接给出输出即可，不要任何多余的回复\n输入：\n```\n将以下文本翻译为目标语言：DE\n文本:\n\n\nHello world!\n```\n\n翻译结果直接输出：\n\nHallo, Welt!\n\n现在我的输入是：\n```\n将以下文本翻译为目标语言：%s\n文本:\n\n\n%s\n```\n输出："
 
 func createLLMTranslationPrompt(srcText string, srcLang string, targetLang string) string {
+	translation := config.GetTranslation()
 	prompt := defaultLLMTransPrompt
-	if config.GTranslation.PromptTemplate != "" {
-		prompt = config.GTranslation.PromptTemplate
+	if translation.PromptTemplate != "" {
+		prompt = translation.PromptTemplate
 	}
 
 	return fmt.Sprintf(prompt, targetLang, srcText)
 }
 
-func LLMTranslate(srcText string, srcLang string, targetLang string) (string, error) {
+func LLMTranslate(ctx context.Context, srcText string, srcLang string, targetLang string) (string, error) {
 
 	prompt := createLLMTranslationPrompt(srcText, srcLang, targetLang)
 
@@ -52,7 +53,7 @@ func LLMTranslate(srcText string, srcLang string, targetLang string) (string, er
 
 	client := simple_client.NewSimpleClient("")
 
-	resp, err := client.CreateChatCompletion(context.Background(), req)
+	resp, err := client.CreateChatCompletion(ctx, req)
 	if err != nil {
 		mylog.Logger.Error("Error creating chat completion:", zap.Error(err))
 		return "", err
@@ -67,7 +68,7 @@ func LLMTranslate(srcText string, srcLang string, targetLang string) (string, er
 	return "", errors.New("no result")
 }
 
-func LLMTranslateStream(srcText string, srcLang string, targetLang string, cb func(string)) (string, error) {
+func LLMTranslateStream(ctx context.Context, srcText string, srcLang string, targetLang string, cb func(string)) (string, error) {
 	var allResult string
 	prompt := createLLMTranslationPrompt(srcText, srcLang, targetLang)
 
@@ -84,7 +85,7 @@ func LLMTranslateStream(srcText string, srcLang string, targetLang string, cb fu
 
 	client := simple_client.NewSimpleClient("")
 
-	chatStream, err := client.CreateChatCompletionStream(context.Background(), req)
+	chatStream, err := client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
 		mylog.Logger.Error("Error creating chat completion:", zap.Error(err))
 		return "", err
@@ -64,7 +64,7 @@ func TranslateV1Handler(c *gin.Context) {
 			c.Writer.(http.Flusher).Flush()
 		}
 
-		_, err := LLMTranslateStream(req.Text, req.SourceLang, req.TargetLang, cb)
+		_, err := LLMTranslateStream(c.Request.Context(), req.Text, req.SourceLang, req.TargetLang, cb)
 		if err != nil {
 			mylog.Logger.Error("Error binding JSON:", zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -73,7 +73,7 @@ func TranslateV1Handler(c *gin.Context) {
 
 		return
 	} else {
-		targetText, err := LLMTranslate(req.Text, req.SourceLang, req.TargetLang)
+		targetText, err := LLMTranslate(c.Request.Context(), req.Text, req.SourceLang, req.TargetLang)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
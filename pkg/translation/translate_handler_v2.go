@@ -45,7 +45,7 @@ func translateStream(c *gin.Context, transReq *TranslationV2Request) error {
 		c.Writer.(http.Flusher).Flush()
 	}
 
-	_, err := LLMTranslateStream(transReq.Text[0], transReq.SourceLang, transReq.TargetLang, cb)
+	_, err := LLMTranslateStream(c.Request.Context(), transReq.Text[0], transReq.SourceLang, transReq.TargetLang, cb)
 	if err != nil {
 		mylog.Logger.Error("Error binding JSON:", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -85,7 +85,7 @@ func TranslateV2Handler(c *gin.Context) {
 				defer func() { <-sem }() // 释放一个并发槽
 
 				var trv2 TranslationV2Result
-				dstText, err := LLMTranslate(text, "", request.TargetLang)
+				dstText, err := LLMTranslate(c.Request.Context(), text, "", request.TargetLang)
 				if err != nil {
 					mylog.Logger.Error("Error translating stream:", zap.Error(err))
 					return
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"simple-one-api/pkg/mycomdef"
 	"strings"
 )
 
@@ -15,6 +16,21 @@ func SetEventStreamHeaders(c *gin.Context) {
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
 }
 
+// ClearEventStreamHeaders 去掉SetEventStreamHeaders设置的响应头，用于流式的上游响应转为非流式返回
+func ClearEventStreamHeaders(c *gin.Context) {
+	for _, key := range []string{"Content-Type", "Cache-Control", "Connection", "Transfer-Encoding", "X-Accel-Buffering"} {
+		c.Writer.Header().Del(key)
+	}
+}
+
+// SetUpstreamModelHeader 在响应头中返回上游实际使用的模型，只在响应头发送前设置一次
+func SetUpstreamModelHeader(c *gin.Context, model string) {
+	if model == "" || c.Writer.Written() || c.Writer.Header().Get(mycomdef.KEYNAME_HEADER_UPSTREAM_MODEL) != "" {
+		return
+	}
+	c.Writer.Header().Set(mycomdef.KEYNAME_HEADER_UPSTREAM_MODEL, model)
+}
+
 func SendOpenAIStreamEOFData(c *gin.Context) {
 	c.Writer.WriteString("data: [DONE]\n\n")
 	c.Writer.(http.Flusher).Flush()
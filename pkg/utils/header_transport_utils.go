@@ -0,0 +1,18 @@
+package utils
+
+import "net/http"
+
+// HeaderTransport 在请求中加入固定的请求头
+type HeaderTransport struct {
+	Transport http.RoundTripper
+	Headers   map[string]string
+}
+
+// RoundTrip 实现了 http.RoundTripper 接口，RoundTripper不能修改传入的请求，在副本上设置请求头
+func (t *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	return t.Transport.RoundTrip(req)
+}
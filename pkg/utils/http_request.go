@@ -3,6 +3,7 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
@@ -11,9 +12,9 @@ import (
 	"strings"
 )
 
-// 非SSE的HTTP请求处理函数
-func SendHTTPRequest(apiKey, url string, reqBody []byte, httpTransport *http.Transport) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+// 非SSE的HTTP请求处理函数，ctx取消时（如客户端断开）中止请求
+func SendHTTPRequest(ctx context.Context, apiKey, url string, reqBody []byte, httpTransport http.RoundTripper) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -36,14 +37,17 @@ func SendHTTPRequest(apiKey, url string, reqBody []byte, httpTransport *http.Tra
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
 
 	return respBody, nil
 }
 
-// SSE的HTTP请求处理函数，带回调处理每次接收的数据
-func SendSSERequest(apiKey, url string, reqBody []byte, callback func(data string), httpTransport *http.Transport) error {
+// SSE的HTTP请求处理函数，带回调处理每次接收的数据，ctx取消时关闭连接并返回ctx的错误
+func SendSSERequest(ctx context.Context, apiKey, url string, reqBody []byte, callback func(data string), httpTransport http.RoundTripper) error {
 	mylog.Logger.Debug("SendSSERequest", zap.String("url", url))
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -62,11 +66,19 @@ func SendSSERequest(apiKey, url string, reqBody []byte, callback func(data strin
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(errBody))
+	}
+
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadString('\n')
 		//mylog.Logger.Debug("SendSSERequest", zap.String("line", line))
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			break
 		}
 		if strings.HasPrefix(line, "data:") {
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// JSONBodyPatchTransport 在发送前修改JSON请求体中的顶层字段，用于go-openai不支持的参数
+type JSONBodyPatchTransport struct {
+	Transport http.RoundTripper
+	Set       map[string]interface{}
+}
+
+// RoundTrip 实现了 http.RoundTripper 接口，在请求的副本上替换请求体
+func (t *JSONBodyPatchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || len(t.Set) == 0 {
+		return t.Transport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		for k, v := range t.Set {
+			if data, err := json.Marshal(v); err == nil {
+				fields[k] = data
+			}
+		}
+		if patched, err := json.Marshal(fields); err == nil {
+			body = patched
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return t.Transport.RoundTrip(req)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestJSONBodyPatchTransportClonesRequest 请求体在副本上修改，调用方的请求保持不变
+func TestJSONBodyPatchTransportClonesRequest(t *testing.T) {
+	const original = `{"model":"o1-mini","max_tokens":300}`
+	req, _ := http.NewRequest(http.MethodPost, "http://upstream/v1/chat/completions", strings.NewReader(original))
+
+	var sent map[string]interface{}
+	var sentReq *http.Request
+	transport := &JSONBodyPatchTransport{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			sentReq = r
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &sent); err != nil {
+				t.Fatalf("decode patched body: %v", err)
+			}
+			if r.ContentLength != int64(len(body)) {
+				t.Errorf("ContentLength = %d, want %d", r.ContentLength, len(body))
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		Set: map[string]interface{}{"max_completion_tokens": 300},
+	}
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent["max_completion_tokens"] != float64(300) || sent["model"] != "o1-mini" {
+		t.Errorf("patched body = %v", sent)
+	}
+	if sentReq == req {
+		t.Fatal("RoundTrip sent the caller's request instead of a clone")
+	}
+	if req.ContentLength != int64(len(original)) {
+		t.Errorf("caller ContentLength = %d, want %d", req.ContentLength, len(original))
+	}
+	if req.Header.Get("Content-Length") != "" {
+		t.Errorf("caller Content-Length header = %q", req.Header.Get("Content-Length"))
+	}
+}
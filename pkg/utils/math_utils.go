@@ -6,3 +6,10 @@ func Min(a, b int) int {
 	}
 	return b
 }
+
+func Max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}